@@ -11,7 +11,12 @@ import * as path from 'path'
 import * as os from 'os'
 import {
   LiveLambdaLayerAspect,
-  LiveLambdaLayerAspectProps
+  LiveLambdaLayerAspectProps,
+  check_dynamic_config_parameter,
+  payload_key_action,
+  queue_arn_from_url,
+  routing_rules_action,
+  signing_secret_action
 } from './live-lambda-layer.aspect.js'
 import {
   LAYER_VERSION_NAME,
@@ -109,6 +114,18 @@ describe('LiveLambdaLayerAspect', () => {
     include_patterns?: string[]
     exclude_patterns?: string[]
     developer_principal_arns?: string[]
+    offload_bucket_name?: string
+    mailbox_queue_url?: string
+    iot_endpoint?: string
+    payload_key_arn?: string
+    response_signing_secret_arn?: string
+    routing_rules?: string
+    dynamic_config_parameter?: string
+    stage?: string
+    channel_scope?: string
+    developer_id?: string
+    requests_channel?: string
+    response_channel?: string
   }) {
     const app = new cdk.App()
     const env = { account: '123456789012', region: 'us-east-1' }
@@ -142,7 +159,19 @@ describe('LiveLambdaLayerAspect', () => {
       api: mock_api,
       include_patterns: options?.include_patterns,
       exclude_patterns: options?.exclude_patterns,
-      developer_principal_arns: options?.developer_principal_arns
+      developer_principal_arns: options?.developer_principal_arns,
+      offload_bucket_name: options?.offload_bucket_name,
+      mailbox_queue_url: options?.mailbox_queue_url,
+      iot_endpoint: options?.iot_endpoint,
+      payload_key_arn: options?.payload_key_arn,
+      response_signing_secret_arn: options?.response_signing_secret_arn,
+      routing_rules: options?.routing_rules,
+      dynamic_config_parameter: options?.dynamic_config_parameter,
+      stage: options?.stage,
+      channel_scope: options?.channel_scope,
+      developer_id: options?.developer_id,
+      requests_channel: options?.requests_channel,
+      response_channel: options?.response_channel
     }
 
     const aspect = new LiveLambdaLayerAspect(aspect_props)
@@ -197,6 +226,24 @@ describe('LiveLambdaLayerAspect', () => {
       })
     })
 
+    it('should grant the tag lookup on the function itself', () => {
+      const { template } = create_test_setup()
+
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: [
+            Match.objectLike({
+              Action: 'lambda:GetFunction',
+              Effect: 'Allow',
+              Resource: {
+                'Fn::GetAtt': [Match.stringLikeRegexp('^TestFunction'), 'Arn']
+              }
+            })
+          ]
+        }
+      })
+    })
+
     it('should add trust relationship for role assumption', () => {
       const { template } = create_test_setup()
 
@@ -291,6 +338,318 @@ describe('LiveLambdaLayerAspect', () => {
     })
   })
 
+  describe('Payload offload', () => {
+    it('should not configure offload by default', () => {
+      const { template } = create_test_setup()
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.not(
+            Match.objectLike({ LIVE_LAMBDA_OFFLOAD_BUCKET: Match.anyValue() })
+          )
+        }
+      })
+    })
+
+    it('should set the offload bucket and grant access to the payload prefix', () => {
+      const { template } = create_test_setup({
+        offload_bucket_name: 'my-offload-bucket'
+      })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_OFFLOAD_BUCKET: 'my-offload-bucket'
+          })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({
+              Action: ['s3:GetObject', 's3:PutObject', 's3:PutObjectTagging'],
+              Effect: 'Allow'
+            })
+          ])
+        }
+      })
+    })
+  })
+
+  describe('Pull mailbox', () => {
+    const queue_url = 'https://sqs.us-east-1.amazonaws.com/123456789012/live-lambda-mailbox'
+
+    it('should set the mailbox queue and grant send access to it', () => {
+      const { template } = create_test_setup({ mailbox_queue_url: queue_url })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_MAILBOX_QUEUE_URL: queue_url
+          })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({
+              Action: 'sqs:SendMessage',
+              Effect: 'Allow'
+            })
+          ])
+        }
+      })
+    })
+
+    it('should reject URLs that are not SQS queue URLs', () => {
+      expect(() => queue_arn_from_url('https://example.com/')).toThrow(
+        'Not an SQS queue URL'
+      )
+    })
+  })
+
+  describe('IoT Core transport', () => {
+    it('should select the iot transport and grant access to the live-lambda topics', () => {
+      const { template } = create_test_setup({
+        iot_endpoint: 'abc123-ats.iot.us-east-1.amazonaws.com'
+      })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_TRANSPORT: 'iot',
+            LIVE_LAMBDA_IOT_ENDPOINT: 'abc123-ats.iot.us-east-1.amazonaws.com'
+          })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'iot:Connect', Effect: 'Allow' }),
+            Match.objectLike({
+              Action: ['iot:Publish', 'iot:Receive'],
+              Effect: 'Allow'
+            }),
+            Match.objectLike({ Action: 'iot:Subscribe', Effect: 'Allow' })
+          ])
+        }
+      })
+    })
+  })
+
+  describe('Payload encryption', () => {
+    it('should set the payload key and grant data key generation on a KMS key', () => {
+      const key_arn = 'arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab'
+      const { template } = create_test_setup({ payload_key_arn: key_arn })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_PAYLOAD_KEY_ARN: key_arn
+          })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'kms:GenerateDataKey', Resource: key_arn })
+          ])
+        }
+      })
+    })
+
+    it('should grant read access to a key secret', () => {
+      const secret_arn = 'arn:aws:secretsmanager:us-east-1:123456789012:secret:live-lambda-key-AbCdEf'
+      const { template } = create_test_setup({ payload_key_arn: secret_arn })
+
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'secretsmanager:GetSecretValue', Resource: secret_arn })
+          ])
+        }
+      })
+    })
+
+    it('should reject ARNs that are not keys or secrets', () => {
+      expect(() => payload_key_action('arn:aws:s3:::bucket')).toThrow(
+        'Not a KMS key or Secrets Manager secret ARN'
+      )
+    })
+  })
+
+  describe('Response signing', () => {
+    it('should set the signing secret and grant read access to the parameter', () => {
+      const parameter_arn = 'arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/signing'
+      const { template } = create_test_setup({ response_signing_secret_arn: parameter_arn })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN: parameter_arn
+          })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'ssm:GetParameter', Resource: parameter_arn })
+          ])
+        }
+      })
+    })
+
+    it('should reject ARNs that are not parameters or secrets', () => {
+      expect(signing_secret_action('arn:aws:secretsmanager:us-east-1:123456789012:secret:s')).toBe(
+        'secretsmanager:GetSecretValue'
+      )
+      expect(() => signing_secret_action('arn:aws:kms:us-east-1:123456789012:key/abc')).toThrow(
+        'Not an SSM parameter or Secrets Manager secret ARN'
+      )
+    })
+  })
+
+  describe('Routing rules', () => {
+    it('should pass inline rules through without a grant', () => {
+      const rules = '{"default":"intercept","rules":[]}'
+      const { template } = create_test_setup({ routing_rules: rules })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({ LIVE_LAMBDA_ROUTING_RULES: rules })
+        }
+      })
+      expect(JSON.stringify(template.findResources('AWS::IAM::Policy'))).not.toContain('ssm:GetParameter')
+    })
+
+    it('should grant read access to a rules parameter', () => {
+      const parameter_arn = 'arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/routing'
+      const { template } = create_test_setup({ routing_rules: parameter_arn })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({ LIVE_LAMBDA_ROUTING_RULES: parameter_arn })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'ssm:GetParameter', Resource: parameter_arn })
+          ])
+        }
+      })
+    })
+
+    it('should reject ARNs that are not parameters', () => {
+      expect(() =>
+        routing_rules_action('arn:aws:secretsmanager:us-east-1:123456789012:secret:rules')
+      ).toThrow('Routing rules must be JSON or an SSM parameter ARN')
+    })
+  })
+
+  describe('Dynamic configuration', () => {
+    it('should point the extension at the parameter and grant read access', () => {
+      const parameter_arn = 'arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/settings'
+      const { template } = create_test_setup({ dynamic_config_parameter: parameter_arn })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({ LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER: parameter_arn })
+        }
+      })
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'ssm:GetParameter', Resource: parameter_arn })
+          ])
+        }
+      })
+    })
+
+    it('should reject ARNs that are not parameters', () => {
+      expect(() =>
+        check_dynamic_config_parameter('arn:aws:secretsmanager:us-east-1:123456789012:secret:settings')
+      ).toThrow('must be an SSM parameter ARN')
+    })
+  })
+
+  describe('Stages', () => {
+    it('should point the extension at the stage namespace and enforce the check', () => {
+      const { template } = create_test_setup({ stage: 'dev' })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_APPSYNC_NAMESPACE: 'live-lambda-dev',
+            LIVE_LAMBDA_NAMESPACE_CHECK: 'enforce'
+          })
+        }
+      })
+    })
+
+    it('should only grant publish and subscribe on the stage namespace', () => {
+      const { template } = create_test_setup({ stage: 'dev' })
+
+      template.hasResourceProperties('AWS::IAM::Policy', {
+        PolicyDocument: {
+          Statement: Match.arrayWith([
+            Match.objectLike({ Action: 'appsync:EventConnect', Effect: 'Allow' }),
+            Match.objectLike({
+              Action: ['appsync:EventPublish', 'appsync:EventSubscribe'],
+              Resource: {
+                'Fn::Join': Match.arrayWith([
+                  Match.arrayWith(['/channelNamespace/live-lambda-dev'])
+                ])
+              }
+            })
+          ])
+        }
+      })
+    })
+
+    it('should leave the namespace unset without a stage', () => {
+      const { template } = create_test_setup()
+      const functions = template.findResources('AWS::Lambda::Function')
+      for (const resource of Object.values(functions)) {
+        expect(
+          resource.Properties.Environment?.Variables?.LIVE_LAMBDA_APPSYNC_NAMESPACE
+        ).toBeUndefined()
+      }
+    })
+
+    it('should pass the channel scope and developer ID to the extension', () => {
+      const { template } = create_test_setup({
+        channel_scope: '{function}/{dev}',
+        developer_id: 'alice'
+      })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_CHANNEL_SCOPE: '{function}/{dev}',
+            LIVE_LAMBDA_DEVELOPER_ID: 'alice'
+          })
+        }
+      })
+    })
+
+    it('should pass custom requests and response channels to the extension', () => {
+      const { template } = create_test_setup({
+        requests_channel: 'invocations/{function}',
+        response_channel: 'answers/{request_id}'
+      })
+
+      template.hasResourceProperties('AWS::Lambda::Function', {
+        Environment: {
+          Variables: Match.objectLike({
+            LIVE_LAMBDA_REQUESTS_CHANNEL: 'invocations/{function}',
+            LIVE_LAMBDA_RESPONSE_CHANNEL: 'answers/{request_id}'
+          })
+        }
+      })
+    })
+  })
+
   describe('CloudFormation outputs', () => {
     it('should create function ARN output', () => {
       const { template } = create_test_setup()
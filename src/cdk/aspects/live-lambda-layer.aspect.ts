@@ -8,13 +8,16 @@ import * as iam from 'aws-cdk-lib/aws-iam'
 import { IConstruct } from 'constructs'
 import path from 'node:path'
 import { LiveLambdaLayerStack } from '../stacks/layer.stack.js'
+import { stage_channel_statements } from '../stacks/appsync.stack.js'
+import { stage_namespace } from '../../constants.js'
 import { logger } from '../../lib/logger.js'
 
-export interface LiveLambdaLayerAspectProps {
-  readonly layer_stack: LiveLambdaLayerStack
+/**
+ * Settings the extension in a function needs, whichever way the function is
+ * wired for live-lambda.
+ */
+export interface LiveLambdaFunctionProps {
   readonly api: appsync.EventApi
-  include_patterns?: string[]
-  exclude_patterns?: string[]
   /**
    * Additional IAM principal ARNs that should be allowed to assume Lambda execution roles.
    * By default, any principal in the same AWS account can assume the role (using account root).
@@ -22,6 +25,90 @@ export interface LiveLambdaLayerAspectProps {
    * Example: ['arn:aws:iam::OTHER_ACCOUNT:user/developer']
    */
   developer_principal_arns?: string[]
+  /**
+   * Name of an S3 bucket the extension may use to offload payloads larger than
+   * the AppSync event size limit. Functions are granted read/write access to the
+   * `live-lambda/payloads/` prefix, and write access to `live-lambda/recordings/`
+   * for LIVE_LAMBDA_RECORD=s3. Add a lifecycle rule to expire the objects.
+   */
+  offload_bucket_name?: string
+  /**
+   * URL of an SQS queue the extension may deliver requests to for agents
+   * running in pull mode (`live-lambda start --pull <queue url>`). Functions
+   * are granted `sqs:SendMessage` on the queue.
+   */
+  mailbox_queue_url?: string
+  /**
+   * AWS IoT Core data endpoint (`<prefix>-ats.iot.<region>.amazonaws.com`).
+   * When set, the extension talks to the agent over IoT Core MQTT instead of
+   * AppSync, and functions are granted access to the `live-lambda/*` topics
+   * (`live-lambda-{stage}/*` with a stage).
+   */
+  iot_endpoint?: string
+  /**
+   * ARN of a KMS key, or of a Secrets Manager secret holding a base64 256-bit
+   * key, that the extension encrypts event and response bodies with
+   * (LIVE_LAMBDA_PAYLOAD_KEY_ARN). Functions are granted
+   * `kms:GenerateDataKey` on the key or `secretsmanager:GetSecretValue` on the
+   * secret; the developer needs `kms:Decrypt` or the same secret access.
+   */
+  payload_key_arn?: string
+  /**
+   * ARN of an SSM SecureString parameter or Secrets Manager secret shared with
+   * the developer's agent (LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN). The
+   * extension then only posts responses the agent signed with it. Functions
+   * are granted `ssm:GetParameter` or `secretsmanager:GetSecretValue` on it.
+   */
+  response_signing_secret_arn?: string
+  /**
+   * Ordered rules choosing which invocations are intercepted
+   * (LIVE_LAMBDA_ROUTING_RULES), as inline JSON or the ARN of an SSM
+   * parameter holding them. Functions are granted `ssm:GetParameter` on a
+   * parameter.
+   */
+  routing_rules?: string
+  /**
+   * ARN of an SSM parameter whose settings override the deployed ones at
+   * runtime (LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER). Functions are granted
+   * `ssm:GetParameter` on it.
+   */
+  dynamic_config_parameter?: string
+  /**
+   * Stage the functions belong to when several stages share one Events API.
+   * Functions only get access to the stage's namespace (live-lambda-{stage},
+   * see `AppSyncStack` `stages`), and the extension refuses to intercept if it
+   * cannot confirm it reached that namespace.
+   */
+  stage?: string
+  /**
+   * Template for the channel scope the functions publish under
+   * (LIVE_LAMBDA_CHANNEL_SCOPE), e.g. `{function}/{dev}`, so developers and
+   * functions sharing one Events API do not see each other's invocations.
+   * Serve it with `live-lambda start --channel-scope <rendered scope>`.
+   */
+  channel_scope?: string
+  /**
+   * Developer ID that fills `{dev}` in `channel_scope` (LIVE_LAMBDA_DEVELOPER_ID).
+   */
+  developer_id?: string
+  /**
+   * Template for the requests channel (LIVE_LAMBDA_REQUESTS_CHANNEL), e.g.
+   * `invocations/{function}`. Give the same template to `AppSyncStack` so the
+   * namespace handlers accept it, and serve it with
+   * `live-lambda start --requests-channel <rendered channel>`.
+   */
+  requests_channel?: string
+  /**
+   * Template for the response channels (LIVE_LAMBDA_RESPONSE_CHANNEL), ending
+   * in `{request_id}`, e.g. `answers/{request_id}`.
+   */
+  response_channel?: string
+}
+
+export interface LiveLambdaLayerAspectProps extends LiveLambdaFunctionProps {
+  readonly layer_stack: LiveLambdaLayerStack
+  include_patterns?: string[]
+  exclude_patterns?: string[]
 }
 
 interface LiveLambdaMapEntryForCDK {
@@ -83,73 +170,24 @@ export class LiveLambdaLayerAspect implements cdk.IAspect {
       )
       node.addLayers(imported_layer)
 
-      node.addToRolePolicy(
-        new iam.PolicyStatement({
-          actions: [
-            'appsync:EventConnect',
-            'appsync:EventPublish',
-            'appsync:EventSubscribe'
-          ],
-          resources: [`${this.props.api.apiArn}/*`, `${this.props.api.apiArn}`]
-        })
-      )
-
-      // Add trust relationship to allow assuming the Lambda execution role for local development
-      // This enables the local dev server to run handlers with the same permissions as the deployed Lambda
-      if (node.role) {
-        const role = node.role as iam.Role
-        const account_id = cdk.Stack.of(node).account
-
-        // By default, allow any principal in the same account to assume the role
-        // This is required for live-lambda local development to work
-        const account_root_principal = `arn:aws:iam::${account_id}:root`
-
-        role.assumeRolePolicy?.addStatements(
+      if (this.props.stage) {
+        for (const statement of stage_channel_statements(this.props.api, this.props.stage)) {
+          node.addToRolePolicy(statement)
+        }
+      } else {
+        node.addToRolePolicy(
           new iam.PolicyStatement({
-            effect: iam.Effect.ALLOW,
-            principals: [new iam.ArnPrincipal(account_root_principal)],
-            actions: ['sts:AssumeRole']
+            actions: [
+              'appsync:EventConnect',
+              'appsync:EventPublish',
+              'appsync:EventSubscribe'
+            ],
+            resources: [`${this.props.api.apiArn}/*`, `${this.props.api.apiArn}`]
           })
         )
-
-        // If specific developer principals are provided, add those as well
-        if (this.props.developer_principal_arns?.length) {
-          for (const principal_arn of this.props.developer_principal_arns) {
-            role.assumeRolePolicy?.addStatements(
-              new iam.PolicyStatement({
-                effect: iam.Effect.ALLOW,
-                principals: [new iam.ArnPrincipal(principal_arn)],
-                actions: ['sts:AssumeRole']
-              })
-            )
-          }
-        }
       }
 
-      node.addEnvironment(
-        'AWS_LAMBDA_EXEC_WRAPPER',
-        '/opt/live-lambda-runtime-wrapper.sh'
-      )
-
-      // Set the listener port for the extension's Runtime API Proxy
-      node.addEnvironment('LRAP_LISTENER_PORT', '8082')
-
-      // Set the official extension name, required by the Go extension to register itself
-      node.addEnvironment('AWS_LAMBDA_EXTENSION_NAME', 'live-lambda-extension')
-
-      // Add AppSync configuration as environment variables for the extension
-      node.addEnvironment(
-        'LIVE_LAMBDA_APPSYNC_REGION',
-        this.props.api.env.region
-      )
-      node.addEnvironment(
-        'LIVE_LAMBDA_APPSYNC_REALTIME_HOST',
-        this.props.api.realtimeDns
-      )
-      node.addEnvironment(
-        'LIVE_LAMBDA_APPSYNC_HTTP_HOST',
-        this.props.api.httpDns
-      )
+      configure_live_lambda_function(node, this.props)
 
       // Add CloudFormation outputs for Function ARN and Role ARN
       new cdk.CfnOutput(node.stack, `${node.node.id}Arn`, {
@@ -216,6 +254,271 @@ export class LiveLambdaLayerAspect implements cdk.IAspect {
   }
 }
 
+/**
+ * Turns https://sqs.{region}.amazonaws.com/{account}/{name} into the queue ARN.
+ */
+export function queue_arn_from_url(queue_url: string): string {
+  const { hostname, pathname } = new URL(queue_url)
+  const [, region] = hostname.split('.')
+  const [account, name] = pathname.split('/').filter(Boolean)
+  if (!region || !account || !name) {
+    throw new Error(`Not an SQS queue URL: ${queue_url}`)
+  }
+  return `arn:${cdk.Aws.PARTITION}:sqs:${region}:${account}:${name}`
+}
+
+/**
+ * Returns the action the extension needs on a payload key: generating data
+ * keys under a KMS key, or reading a Secrets Manager secret.
+ */
+export function payload_key_action(key_arn: string): string {
+  const [, , service] = key_arn.split(':')
+  if (service === 'kms') {
+    return 'kms:GenerateDataKey'
+  }
+  if (service === 'secretsmanager') {
+    return 'secretsmanager:GetSecretValue'
+  }
+  throw new Error(`Not a KMS key or Secrets Manager secret ARN: ${key_arn}`)
+}
+
+/**
+ * Returns the action the extension needs to read the response signing
+ * secret from an SSM parameter or a Secrets Manager secret.
+ */
+export function signing_secret_action(secret_arn: string): string {
+  const [, , service] = secret_arn.split(':')
+  if (service === 'ssm') {
+    return 'ssm:GetParameter'
+  }
+  if (service === 'secretsmanager') {
+    return 'secretsmanager:GetSecretValue'
+  }
+  throw new Error(`Not an SSM parameter or Secrets Manager secret ARN: ${secret_arn}`)
+}
+
+/**
+ * Returns the action the extension needs to read routing rules, or undefined
+ * for inline rules, which need none.
+ */
+export function routing_rules_action(routing_rules: string): string | undefined {
+  if (!routing_rules.trim().startsWith('arn:')) {
+    return undefined
+  }
+  const [, , service] = routing_rules.split(':')
+  if (service === 'ssm') {
+    return 'ssm:GetParameter'
+  }
+  throw new Error(`Routing rules must be JSON or an SSM parameter ARN: ${routing_rules}`)
+}
+
+/**
+ * Throws unless parameter_arn is an SSM parameter ARN, the only source the
+ * extension reads dynamic settings from.
+ */
+export function check_dynamic_config_parameter(parameter_arn: string): void {
+  const [prefix, , service] = parameter_arn.split(':')
+  if (prefix !== 'arn' || service !== 'ssm') {
+    throw new Error(`The dynamic config parameter must be an SSM parameter ARN: ${parameter_arn}`)
+  }
+}
+
+/**
+ * Lets developers assume the function's role, points the extension at the
+ * Events API and grants and configures the optional features in props. The
+ * caller adds the layer and the AppSync policy.
+ */
+export function configure_live_lambda_function(
+  node: lambda.Function,
+  props: LiveLambdaFunctionProps
+): void {
+  // Add trust relationship to allow assuming the Lambda execution role for local development
+  // This enables the local dev server to run handlers with the same permissions as the deployed Lambda
+  if (node.role) {
+    const role = node.role as iam.Role
+    const account_id = cdk.Stack.of(node).account
+
+    // By default, allow any principal in the same account to assume the role
+    // This is required for live-lambda local development to work
+    const account_root_principal = `arn:aws:iam::${account_id}:root`
+
+    role.assumeRolePolicy?.addStatements(
+      new iam.PolicyStatement({
+        effect: iam.Effect.ALLOW,
+        principals: [new iam.ArnPrincipal(account_root_principal)],
+        actions: ['sts:AssumeRole']
+      })
+    )
+
+    // If specific developer principals are provided, add those as well
+    if (props.developer_principal_arns?.length) {
+      for (const principal_arn of props.developer_principal_arns) {
+        role.assumeRolePolicy?.addStatements(
+          new iam.PolicyStatement({
+            effect: iam.Effect.ALLOW,
+            principals: [new iam.ArnPrincipal(principal_arn)],
+            actions: ['sts:AssumeRole']
+          })
+        )
+      }
+    }
+  }
+
+  // The extension reads the function's own tags at init for live-lambda:enabled.
+  // A role policy naming the function would be a circular dependency, so the
+  // grant is a separate policy that the function does not wait for.
+  if (node.role) {
+    new iam.Policy(node, 'LiveLambdaTagLookup', {
+      roles: [node.role],
+      statements: [
+        new iam.PolicyStatement({
+          actions: ['lambda:GetFunction'],
+          resources: [node.functionArn]
+        })
+      ]
+    })
+  }
+
+  node.addEnvironment(
+    'AWS_LAMBDA_EXEC_WRAPPER',
+    '/opt/live-lambda-runtime-wrapper.sh'
+  )
+
+  // Set the listener port for the extension's Runtime API Proxy
+  node.addEnvironment('LRAP_LISTENER_PORT', '8082')
+
+  // Set the official extension name, required by the Go extension to register itself
+  node.addEnvironment('AWS_LAMBDA_EXTENSION_NAME', 'live-lambda-extension')
+
+  // Add AppSync configuration as environment variables for the extension
+  node.addEnvironment('LIVE_LAMBDA_APPSYNC_REGION', props.api.env.region)
+  node.addEnvironment(
+    'LIVE_LAMBDA_APPSYNC_REALTIME_HOST',
+    props.api.realtimeDns
+  )
+  node.addEnvironment('LIVE_LAMBDA_APPSYNC_HTTP_HOST', props.api.httpDns)
+  if (props.stage) {
+    node.addEnvironment(
+      'LIVE_LAMBDA_APPSYNC_NAMESPACE',
+      stage_namespace(props.stage)
+    )
+    node.addEnvironment('LIVE_LAMBDA_NAMESPACE_CHECK', 'enforce')
+  }
+  if (props.channel_scope) {
+    node.addEnvironment('LIVE_LAMBDA_CHANNEL_SCOPE', props.channel_scope)
+  }
+  if (props.developer_id) {
+    node.addEnvironment('LIVE_LAMBDA_DEVELOPER_ID', props.developer_id)
+  }
+  if (props.requests_channel) {
+    node.addEnvironment('LIVE_LAMBDA_REQUESTS_CHANNEL', props.requests_channel)
+  }
+  if (props.response_channel) {
+    node.addEnvironment('LIVE_LAMBDA_RESPONSE_CHANNEL', props.response_channel)
+  }
+
+  if (props.offload_bucket_name) {
+    node.addEnvironment(
+      'LIVE_LAMBDA_OFFLOAD_BUCKET',
+      props.offload_bucket_name
+    )
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ['s3:GetObject', 's3:PutObject', 's3:PutObjectTagging'],
+        resources: [
+          `arn:${cdk.Aws.PARTITION}:s3:::${props.offload_bucket_name}/live-lambda/payloads/*`,
+          `arn:${cdk.Aws.PARTITION}:s3:::${props.offload_bucket_name}/live-lambda/recordings/*`
+        ]
+      })
+    )
+  }
+
+  if (props.mailbox_queue_url) {
+    node.addEnvironment(
+      'LIVE_LAMBDA_MAILBOX_QUEUE_URL',
+      props.mailbox_queue_url
+    )
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ['sqs:SendMessage'],
+        resources: [queue_arn_from_url(props.mailbox_queue_url)]
+      })
+    )
+  }
+
+  if (props.iot_endpoint) {
+    node.addEnvironment('LIVE_LAMBDA_TRANSPORT', 'iot')
+    node.addEnvironment('LIVE_LAMBDA_IOT_ENDPOINT', props.iot_endpoint)
+    const iot_arn = `arn:${cdk.Aws.PARTITION}:iot:${node.stack.region}:${node.stack.account}`
+    const namespace = stage_namespace(props.stage)
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ['iot:Connect'],
+        resources: [`${iot_arn}:client/live-lambda-*`]
+      })
+    )
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ['iot:Publish', 'iot:Receive'],
+        resources: [`${iot_arn}:topic/${namespace}/*`]
+      })
+    )
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ['iot:Subscribe'],
+        resources: [`${iot_arn}:topicfilter/${namespace}/*`]
+      })
+    )
+  }
+
+  if (props.payload_key_arn) {
+    node.addEnvironment('LIVE_LAMBDA_PAYLOAD_KEY_ARN', props.payload_key_arn)
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: [payload_key_action(props.payload_key_arn)],
+        resources: [props.payload_key_arn]
+      })
+    )
+  }
+
+  if (props.response_signing_secret_arn) {
+    node.addEnvironment(
+      'LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN',
+      props.response_signing_secret_arn
+    )
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: [signing_secret_action(props.response_signing_secret_arn)],
+        resources: [props.response_signing_secret_arn]
+      })
+    )
+  }
+
+  if (props.routing_rules) {
+    node.addEnvironment('LIVE_LAMBDA_ROUTING_RULES', props.routing_rules)
+    const action = routing_rules_action(props.routing_rules)
+    if (action) {
+      node.addToRolePolicy(
+        new iam.PolicyStatement({
+          actions: [action],
+          resources: [props.routing_rules.trim()]
+        })
+      )
+    }
+  }
+
+  if (props.dynamic_config_parameter) {
+    check_dynamic_config_parameter(props.dynamic_config_parameter)
+    node.addEnvironment('LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER', props.dynamic_config_parameter)
+    node.addToRolePolicy(
+      new iam.PolicyStatement({
+        actions: ['ssm:GetParameter'],
+        resources: [props.dynamic_config_parameter]
+      })
+    )
+  }
+}
+
 function should_skip_function(
   props: LiveLambdaLayerAspectProps,
   function_path: string,
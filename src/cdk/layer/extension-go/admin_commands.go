@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Admin commands
+//
+// The local CLI reconfigures a running sandbox over the control channel
+// instead of changing its environment, which forces a cold start. Each
+// command is a control frame with a request_id and the RFC 3339 timestamp it
+// was issued at; every live extension of the function runs it and answers
+// with a command_result lifecycle event echoing the request_id and command,
+// with "ok" and, on failure, "error":
+//
+//   - enable_interception clears a disable_interception or a parameter's
+//     LIVE_LAMBDA_ENABLED=false. Tags, LIVE_LAMBDA_ENABLED=off and the tunnel
+//     breaker still win.
+//   - disable_interception passes every invocation through, naming "reason"
+//     in explain traces and the roster, until it is enabled again.
+//   - set_sample_rate replaces LIVE_LAMBDA_SAMPLE_RATE with "sample_rate"
+//     (0 to 100), keeping LIVE_LAMBDA_INTERCEPT_WHEN.
+//   - flush_cache empties the response cache and answers with "flushed".
+//   - run_self_checks runs the self-diagnostics checks now and answers with
+//     their "anomalies". The sandbox's full state is in the diagnostics dump
+//     instead; see diagnostics_dump.go.
+//
+// Changes last until the sandbox is recycled, or until the dynamic config
+// parameter changes the same setting. A command runs once: one whose
+// request_id already ran, or whose timestamp is more than
+// admin_command_max_age from the sandbox's clock, is ignored, so a command
+// copied off the control channel cannot be replayed later. With
+// LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN set, commands must be signed like
+// claim frames: over the frame without its signature, timestamp included,
+// with its request_id.
+
+const (
+	admin_command_timeout = 10 * time.Second
+	admin_command_max_age = time.Minute
+)
+
+var admin_commands = []string{"enable_interception", "disable_interception", "set_sample_rate", "flush_cache", "run_self_checks"}
+
+type admin_command struct {
+	Type       string   `json:"type"`
+	RequestID  string   `json:"request_id"`
+	Timestamp  string   `json:"timestamp"` // RFC 3339
+	Reason     string   `json:"reason"`
+	SampleRate *float64 `json:"sample_rate"`
+}
+
+// command_log remembers the admin commands run within admin_command_max_age,
+// which is as long as their timestamps let them run.
+type command_log struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	seen map[string]time.Time // request ID to when the command was issued
+}
+
+func new_command_log() *command_log {
+	return &command_log{now: time.Now, seen: map[string]time.Time{}}
+}
+
+// admit records command and returns why it must not run, if it must not.
+func (l *command_log) admit(command admin_command) error {
+	issued, err := time.Parse(time.RFC3339Nano, command.Timestamp)
+	if err != nil {
+		return fmt.Errorf("the command has no valid timestamp")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if age := now.Sub(issued); age > admin_command_max_age || age < -admin_command_max_age {
+		return fmt.Errorf("the command was issued at %s, more than %s from now", command.Timestamp, admin_command_max_age)
+	}
+	for id, at := range l.seen {
+		if now.Sub(at) > admin_command_max_age {
+			delete(l.seen, id)
+		}
+	}
+	if _, ran := l.seen[command.RequestID]; ran {
+		return fmt.Errorf("the command already ran")
+	}
+	l.seen[command.RequestID] = issued
+	return nil
+}
+
+// register_admin_handlers answers the admin commands on the control channel.
+func (p *RuntimeAPIProxy) register_admin_handlers() {
+	for _, command := range admin_commands {
+		p.control.register(command, p.handle_admin_command)
+	}
+}
+
+func (p *RuntimeAPIProxy) handle_admin_command(frame json.RawMessage) {
+	logger := component_logger(component_admin)
+	var command admin_command
+	if err := json.Unmarshal(frame, &command); err != nil || command.RequestID == "" {
+		logger.Warn("Ignoring malformed admin command", "error", err)
+		return
+	}
+	logger = logger.With("command", command.Type, "command_id", command.RequestID)
+	if err := p.signatures.verify_frame(command.RequestID, frame); err != nil {
+		logger.Warn("Ignoring unsigned admin command", "error", err)
+		return
+	}
+	if err := p.commands.admit(command); err != nil {
+		logger.Warn("Ignoring admin command", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, admin_command_timeout)
+	defer cancel()
+	result, err := p.run_admin_command(ctx, command)
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	result["request_id"] = command.RequestID
+	result["command"] = command.Type
+	result["ok"] = err == nil
+	if err != nil {
+		logger.Warn("Admin command failed", "error", err)
+		result["error"] = err.Error()
+	} else {
+		logger.Info("Ran admin command")
+	}
+	_ = p.publish_lifecycle_event(ctx, "command_result", result)
+}
+
+// run_admin_command applies command and returns the fields to answer with.
+func (p *RuntimeAPIProxy) run_admin_command(ctx context.Context, command admin_command) (map[string]interface{}, error) {
+	switch command.Type {
+	case "enable_interception":
+		p.interception.enable()
+		enabled, reason := p.interception.enabled()
+		if !enabled {
+			return nil, fmt.Errorf("interception stays disabled: %s", reason)
+		}
+		return nil, nil
+	case "disable_interception":
+		reason := command.Reason
+		if reason == "" {
+			reason = "disabled from the control channel"
+		}
+		p.interception.disable(reason)
+		return nil, nil
+	case "set_sample_rate":
+		if command.SampleRate == nil || *command.SampleRate < 0 || *command.SampleRate > 100 {
+			return nil, fmt.Errorf("sample_rate must be between 0 and 100")
+		}
+		p.traffic_split.Store(p.traffic_split.Load().with_rate(*command.SampleRate))
+		return map[string]interface{}{"sample_rate": *command.SampleRate}, nil
+	case "flush_cache":
+		if p.response_cache == nil {
+			return nil, fmt.Errorf("the response cache is off")
+		}
+		return map[string]interface{}{"flushed": p.response_cache.flush()}, nil
+	case "run_self_checks":
+		anomalies := []map[string]interface{}{}
+		for _, check := range p.diagnostic_checks() {
+			if anomaly := check.run(ctx); anomaly != nil {
+				anomalies = append(anomalies, anomaly.data())
+			}
+		}
+		return map[string]interface{}{"anomalies": anomalies}, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", command.Type)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// admin_frame returns a command frame issued now, with fields added.
+func admin_frame(command string, request_id string, fields map[string]interface{}) map[string]interface{} {
+	frame := map[string]interface{}{"type": command, "request_id": request_id, "timestamp": time.Now().UTC().Format(time.RFC3339Nano)}
+	for key, value := range fields {
+		frame[key] = value
+	}
+	return frame
+}
+
+// send_admin_command publishes frame on the proxy's control channel and
+// returns the command_result the proxy answers it with.
+func send_admin_command(t *testing.T, server *eventstest.Server, p *RuntimeAPIProxy, frame map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	server.Publish(p.control_topic(), frame)
+	return wait_for_lifecycle_event_matching(t, server, p, func(event map[string]interface{}) bool {
+		data, _ := event["data"].(map[string]interface{})
+		return event["type"] == "command_result" && data["request_id"] == frame["request_id"]
+	})
+}
+
+// wait_for_lifecycle_event_matching returns the data of the first lifecycle
+// event that matches.
+func wait_for_lifecycle_event_matching(t *testing.T, server *eventstest.Server, p *RuntimeAPIProxy, match func(event map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	data, _ := wait_for_published(t, server, p.lifecycle_topic(), match)[0]["data"].(map[string]interface{})
+	return data
+}
+
+// command_results returns the data of the command_result events published so far.
+func command_results(server *eventstest.Server, p *RuntimeAPIProxy) []map[string]interface{} {
+	var results []map[string]interface{}
+	for _, raw := range server.Published(p.lifecycle_topic()) {
+		var event lifecycle_event
+		if json.Unmarshal(raw, &event) == nil && event.Type == "command_result" {
+			results = append(results, event.Data)
+		}
+	}
+	return results
+}
+
+func TestAdminCommandsToggleInterception(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server)
+
+	send_admin_command(t, server, p, admin_frame("disable_interception", "cmd-1", map[string]interface{}{"reason": "debugging elsewhere"}))
+	if enabled, reason := p.interception.enabled(); enabled || reason != "debugging elsewhere" {
+		t.Fatalf("expected interception to be disabled, got %v %q", enabled, reason)
+	}
+	send_admin_command(t, server, p, admin_frame("enable_interception", "cmd-2", nil))
+	if enabled, _ := p.interception.enabled(); !enabled {
+		t.Fatal("expected interception to be enabled again")
+	}
+
+	p.interception.disable_hard("tagged off")
+	send_admin_command(t, server, p, admin_frame("enable_interception", "cmd-3", nil))
+	results := command_results(server, p)
+	if len(results) != 3 || results[0]["ok"] != true || results[1]["command"] != "enable_interception" {
+		t.Fatalf("unexpected results %v", results)
+	}
+	if results[2]["ok"] != false || !strings.Contains(results[2]["error"].(string), "tagged off") || results[2]["request_id"] != "cmd-3" {
+		t.Fatalf("expected a hard disable to be reported, got %v", results[2])
+	}
+}
+
+func TestAdminCommandsSetSampleRateAndFlushCache(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server, func(settings *Config) { settings.ResponseCacheTTL = time.Minute })
+	predicates, _ := parse_event_predicates("detail-type=OrderPlaced")
+	p.traffic_split.Store(&traffic_split{rate: 100, predicates: predicates})
+	p.response_cache.store([]byte(`{"a":1}`), []byte(`"cached"`))
+
+	send_admin_command(t, server, p, admin_frame("set_sample_rate", "cmd-1", map[string]interface{}{"sample_rate": 5}))
+	if split := p.traffic_split.Load(); split == nil || split.rate != 5 || len(split.predicates) != 1 {
+		t.Fatalf("expected a 5%% split keeping the predicates, got %+v", split)
+	}
+	if result := send_admin_command(t, server, p, admin_frame("set_sample_rate", "cmd-2", map[string]interface{}{"sample_rate": 150})); result["ok"] != false {
+		t.Fatalf("expected an out of range rate to be refused, got %v", result)
+	}
+	if result := send_admin_command(t, server, p, admin_frame("flush_cache", "cmd-3", nil)); result["flushed"] != float64(1) {
+		t.Fatalf("expected one entry flushed, got %v", result)
+	}
+	if _, _, ok := p.response_cache.lookup([]byte(`{"a":1}`)); ok {
+		t.Fatal("expected the cache to be empty")
+	}
+}
+
+func TestAdminCommandsRunSelfChecks(t *testing.T) {
+	server := new_events_server(t)
+	p := build_events_proxy(t, server)
+	frame, _ := json.Marshal(admin_frame("run_self_checks", "cmd-1", nil))
+	p.control.dispatch(frame)
+	if results := command_results(server, p); len(results) != 0 {
+		t.Fatalf("a disconnected sandbox cannot answer, got %v", results)
+	}
+
+	connect_events_proxy(t, p, server)
+	result := send_admin_command(t, server, p, admin_frame("run_self_checks", "cmd-2", nil))
+	if result["ok"] != true {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if _, ok := result["anomalies"].([]interface{}); !ok {
+		t.Fatalf("expected the anomalies in the result, got %v", result)
+	}
+}
+
+func TestAdminCommandsRequireSignatures(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server)
+	p.signatures = new_test_verifier()
+
+	// Commands are handled in order, so cmd-1 is done once cmd-2 is answered
+	server.Publish(p.control_topic(), admin_frame("disable_interception", "cmd-1", nil))
+	send_admin_command(t, server, p, signed_frame(t, p.signatures.secret, "cmd-2", admin_frame("set_sample_rate", "cmd-2", map[string]interface{}{"sample_rate": 50})))
+	if enabled, _ := p.interception.enabled(); !enabled {
+		t.Fatal("expected an unsigned command to be ignored")
+	}
+	send_admin_command(t, server, p, signed_frame(t, p.signatures.secret, "cmd-3", admin_frame("disable_interception", "cmd-3", nil)))
+	if enabled, _ := p.interception.enabled(); enabled {
+		t.Fatal("expected a signed command to run")
+	}
+	if results := command_results(server, p); len(results) != 2 || results[0]["request_id"] != "cmd-2" {
+		t.Fatalf("expected only the signed commands to be answered, got %v", results)
+	}
+}
+
+func TestAdminCommandsRunOnce(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server)
+	p.signatures = new_test_verifier()
+
+	disable := signed_frame(t, p.signatures.secret, "cmd-1", admin_frame("disable_interception", "cmd-1", nil))
+	send_admin_command(t, server, p, disable)
+	send_admin_command(t, server, p, signed_frame(t, p.signatures.secret, "cmd-2", admin_frame("enable_interception", "cmd-2", nil)))
+
+	// A replayed command, a stale one and one without a timestamp are
+	// ignored; cmd-5 is answered once they are handled
+	server.Publish(p.control_topic(), disable)
+	stale := admin_frame("disable_interception", "cmd-3", nil)
+	stale["timestamp"] = time.Now().Add(-2 * admin_command_max_age).UTC().Format(time.RFC3339Nano)
+	server.Publish(p.control_topic(), signed_frame(t, p.signatures.secret, "cmd-3", stale))
+	undated := admin_frame("disable_interception", "cmd-4", nil)
+	delete(undated, "timestamp")
+	server.Publish(p.control_topic(), signed_frame(t, p.signatures.secret, "cmd-4", undated))
+	send_admin_command(t, server, p, signed_frame(t, p.signatures.secret, "cmd-5", admin_frame("flush_cache", "cmd-5", nil)))
+
+	if enabled, _ := p.interception.enabled(); !enabled {
+		t.Fatal("expected the ignored commands not to disable interception")
+	}
+	if results := command_results(server, p); len(results) != 3 || results[2]["request_id"] != "cmd-5" {
+		t.Fatalf("expected only the first run of each command to be answered, got %v", results)
+	}
+}
+
+func TestCommandLogForgetsExpiredCommands(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	commands := new_command_log()
+	commands.now = func() time.Time { return now }
+	command := admin_command{RequestID: "cmd-1", Timestamp: now.Format(time.RFC3339Nano)}
+
+	if err := commands.admit(command); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := commands.admit(command); err == nil {
+		t.Fatal("expected a second run to be refused")
+	}
+	ahead := admin_command{RequestID: "cmd-2", Timestamp: now.Add(2 * admin_command_max_age).Format(time.RFC3339Nano)}
+	if err := commands.admit(ahead); err == nil {
+		t.Fatal("expected a command from the future to be refused")
+	}
+
+	now = now.Add(2 * admin_command_max_age)
+	if err := commands.admit(admin_command{RequestID: "cmd-3", Timestamp: now.Format(time.RFC3339Nano)}); err != nil || len(commands.seen) != 1 {
+		t.Fatalf("expected the expired command to be forgotten, got %v and %d remembered", err, len(commands.seen))
+	}
+}
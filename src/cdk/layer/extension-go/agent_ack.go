@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Invocation acknowledgments
+//
+// Without presence, or with a heartbeat that is still fresh when the agent has
+// just died, an invocation nobody is serving waits until its deadline, the
+// same as one a developer is stepping through. When the present agent
+// announces the ack capability, it answers every request it starts on as soon
+// as it arrives, before running the handler, on the response channel:
+//
+//	{"type": "ack", "request_id": "...", "agent_id": "...", "idempotency_key": "..."}
+//
+// An acknowledged invocation waits for its response as before. One that is
+// neither acknowledged nor answered within LIVE_LAMBDA_ACK_WINDOW is settled
+// as unacknowledged: the agent is told to cancel it, its presence is dropped
+// until its next heartbeat, and the fallback policy applies at once. The
+// first chunk or stream frame of a response counts as an ack. With signing on,
+// acks are signed like claims. LIVE_LAMBDA_ACK_WINDOW=off never waits for one.
+
+const (
+	default_ack_window        = 2 * time.Second
+	ack_frame_type            = "ack"
+	agent_unacknowledged_type = "LiveLambda.AgentUnacknowledged"
+	cancel_reason_no_ack      = "no_ack"
+)
+
+// parse_ack decodes an ack frame; ok is false for other frames.
+func parse_ack(frame []byte) (agent_id string, ok bool) {
+	var ack struct {
+		Type    string `json:"type"`
+		AgentID string `json:"agent_id"`
+	}
+	if json.Unmarshal(frame, &ack) != nil || ack.Type != ack_frame_type {
+		return "", false
+	}
+	return ack.AgentID, true
+}
+
+// acknowledge records the agent's ack and reports whether it is the first.
+func (r *pending_request) acknowledge(at time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.acked_at.IsZero() {
+		return false
+	}
+	r.acked_at = at
+	return true
+}
+
+// acknowledged reports whether the agent acked the request or started on its
+// response.
+func (r *pending_request) acknowledged() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.acked_at.IsZero() || r.state != response_waiting
+}
+
+// ack_timer returns a channel that fires when the ack window of a request
+// published now closes, or nil when the present agent is not asked for acks.
+func (p *RuntimeAPIProxy) ack_timer() (<-chan time.Time, func()) {
+	if p.config.AckWindow <= 0 || !p.presence.supports(capability_ack) {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(p.config.AckWindow)
+	return timer.C, func() { timer.Stop() }
+}
+
+// record_ack applies an ack frame from agent_id to request.
+func (p *RuntimeAPIProxy) record_ack(request *pending_request, agent_id string) {
+	now := time.Now()
+	if !request.acknowledge(now) {
+		return
+	}
+	after := "after an unknown time"
+	if published := request.published(); !published.IsZero() {
+		after = fmt.Sprintf("after %s", now.Sub(published).Round(time.Millisecond))
+	}
+	request_logger(request.request_id).Debug("Agent acknowledged the request", "agent_id", agent_id)
+	p.explain(request.request_id, "acked", "by %s %s", agent_id, after)
+}
+
+// check_acknowledged settles request as unacknowledged when its ack window has
+// closed without an ack or a response. The caller's wait on request.done then
+// applies the fallback policy.
+func (p *RuntimeAPIProxy) check_acknowledged(request *pending_request) {
+	if request.acknowledged() {
+		return
+	}
+	request_id := request.request_id
+	agent_id := request.lease_holder()
+	if agent_id == "" {
+		agent_id = p.presence.agent()
+	}
+	request.settle(response_unacknowledged, func() {
+		request_logger(request_id).Warn("No ack within the ack window; the agent is not serving it", "ack_window", p.config.AckWindow)
+		p.presence.mark_absent(agent_id)
+		p.trace_remote_execution(request, time.Now(), xray_outcome_timeout, nil)
+		p.cancel_invocation(request_id, cancel_reason_no_ack)
+		p.mark_fallback(request_id)
+		if p.fallback.Mode == FallbackError {
+			p.explain(request_id, "failed", "%s in error fallback mode", agent_unacknowledged_type)
+			p.post_invocation_error(request_id, agent_unacknowledged_type, fmt.Sprintf("live-lambda got no ack from the agent within %s", p.config.AckWindow))
+		}
+	})
+}
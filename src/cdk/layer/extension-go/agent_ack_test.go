@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAckTimerNeedsTheCapabilityAndAWindow(t *testing.T) {
+	proxy := &RuntimeAPIProxy{config: Config{AckWindow: default_ack_window}, presence: new_presence_tracker(time.Minute)}
+	proxy.presence.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"agent-1","protocol_version":2,"capabilities":["` + capability_ack + `"]}`))
+	if ack_window, stop := proxy.ack_timer(); ack_window == nil {
+		t.Fatal("expected an ack window for an agent that acks")
+	} else {
+		stop()
+	}
+
+	proxy.config.AckWindow = 0
+	if ack_window, _ := proxy.ack_timer(); ack_window != nil {
+		t.Fatal("expected no ack window when it is off")
+	}
+
+	proxy.config.AckWindow = default_ack_window
+	proxy.presence = nil
+	if ack_window, _ := proxy.ack_timer(); ack_window != nil {
+		t.Fatal("expected no ack window without presence, which assumes a protocol 1 agent")
+	}
+}
+
+func TestRouteAgentResponseRecordsAcks(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.AckWindow = default_ack_window })
+	publish_heartbeat(server, "orders", capability_ack)
+	wait_for_agent(t, proxy)
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	request.mark_published(time.Now())
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "ack", "request_id": "req-1", "agent_id": "agent-1", "idempotency_key": "req-1:1"})
+
+	if !request.acknowledged() || request.response_state() != response_waiting {
+		t.Fatalf("expected the request to be acknowledged and still waiting, got %s", request.response_state())
+	}
+	proxy.check_acknowledged(request)
+	if request.response_state() != response_waiting {
+		t.Fatalf("expected an acknowledged request to keep waiting, got %s", request.response_state())
+	}
+	steps, _ := proxy.explanations.lookup("req-1")
+	if len(steps) == 0 || steps[len(steps)-1].Decision != "acked" {
+		t.Fatalf("expected an acked step, got %+v", steps)
+	}
+}
+
+func TestCheckAcknowledgedFallsBackWithoutAnAck(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.AckWindow = default_ack_window })
+	publish_heartbeat(server, "orders", capability_ack)
+	wait_for_agent(t, proxy)
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+
+	proxy.check_acknowledged(request)
+
+	if request.response_state() != response_unacknowledged {
+		t.Fatalf("expected the request to be unacknowledged, got %s", request.response_state())
+	}
+	select {
+	case <-request.done:
+	default:
+		t.Fatal("expected the request to be settled")
+	}
+	if proxy.presence.present() {
+		t.Fatal("expected the agent to be treated as absent until its next heartbeat")
+	}
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-1/error" || !strings.Contains(posted.body, agent_unacknowledged_type) {
+			t.Fatalf("unexpected error post %+v", posted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error post")
+	}
+	if cancel := wait_for_published(t, server, proxy.requests_topic(), of_type(invocation_cancel_type))[0]; cancel["reason"] != cancel_reason_no_ack {
+		t.Fatalf("expected a no_ack cancel, got %v", cancel)
+	}
+
+	// A response that arrives after the fallback is dropped
+	proxy.route_agent_response("req-1", map[string]interface{}{"statusCode": 200})
+	select {
+	case posted := <-received:
+		t.Fatalf("expected the late response to be dropped, got %+v", posted)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCheckAcknowledgedWaitsForAResponseInProgress(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.AckWindow = default_ack_window })
+	publish_heartbeat(server, "orders", capability_ack)
+	wait_for_agent(t, proxy)
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	request.start_receiving()
+
+	proxy.check_acknowledged(request)
+
+	if request.response_state() != response_receiving {
+		t.Fatalf("expected the first chunk to count as an ack, got %s", request.response_state())
+	}
+	if !proxy.presence.present() {
+		t.Fatal("expected the agent to stay present")
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// AppSync auth modes
+//
+// LIVE_LAMBDA_APPSYNC_AUTH_MODE selects how the extension authorizes with the
+// AppSync Events API. iam (the default) signs with the function's credentials
+// through the AppSync WebSocket client. api_key sends
+// LIVE_LAMBDA_APPSYNC_API_KEY as x-api-key; cognito and lambda send
+// LIVE_LAMBDA_APPSYNC_AUTH_TOKEN as the Authorization header, for an API that
+// authorizes with a Cognito user pool or a Lambda authorizer. The client only
+// signs with SigV4, so those modes use appsync_header_transport, which speaks
+// the Events WebSocket protocol itself: the headers go base64url-encoded in a
+// header-<...> subprotocol of the handshake and in the authorization field of
+// every subscribe and publish.
+
+const (
+	appsync_auth_print_prefix    = "[LiveLambdaExt:AppSyncAuth]"
+	appsync_auth_iam             = "iam"
+	appsync_auth_api_key         = "api_key"
+	appsync_auth_cognito         = "cognito"
+	appsync_auth_lambda          = "lambda"
+	appsync_events_subprotocol   = "aws-appsync-event-ws"
+	appsync_operation_timeout    = 30 * time.Second
+	appsync_default_ka_timeout   = 5 * time.Minute // used until connection_ack says otherwise
+	appsync_max_events_per_batch = 5               // the Events API limit per publish
+)
+
+// appsync_auth_headers returns the headers that authorize mode's requests to
+// the API at http_host. IAM requests are signed per request and have none.
+func appsync_auth_headers(mode string, http_host string, api_key string, token string) (map[string]string, error) {
+	switch strings.ToLower(mode) {
+	case appsync_auth_api_key:
+		if api_key == "" {
+			return nil, fmt.Errorf("%s is required when %s is api_key", live_lambda_appsync_api_key_env, live_lambda_appsync_auth_mode_env)
+		}
+		return map[string]string{"host": http_host, "x-api-key": api_key}, nil
+	case appsync_auth_cognito, appsync_auth_lambda:
+		if token == "" {
+			return nil, fmt.Errorf("%s is required when %s is %s", live_lambda_appsync_auth_token_env, live_lambda_appsync_auth_mode_env, mode)
+		}
+		return map[string]string{"host": http_host, "Authorization": token}, nil
+	default:
+		return nil, fmt.Errorf("%s has no authorization headers", mode)
+	}
+}
+
+// appsync_handshake_subprotocols returns the WebSocket subprotocols that carry
+// headers through the handshake.
+func appsync_handshake_subprotocols(headers map[string]string) ([]string, error) {
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"header-" + base64.RawURLEncoding.EncodeToString(encoded), appsync_events_subprotocol}, nil
+}
+
+// appsync_message is a message of the Events WebSocket protocol.
+type appsync_message struct {
+	Type                string            `json:"type"`
+	ID                  string            `json:"id,omitempty"`
+	Channel             string            `json:"channel,omitempty"`
+	Events              []string          `json:"events,omitempty"`
+	Authorization       map[string]string `json:"authorization,omitempty"`
+	Event               json.RawMessage   `json:"event,omitempty"`
+	ConnectionTimeoutMs int               `json:"connectionTimeoutMs,omitempty"`
+	Errors              []struct {
+		ErrorType string `json:"errorType"`
+		Message   string `json:"message"`
+	} `json:"errors,omitempty"`
+	Failed []json.RawMessage `json:"failed,omitempty"`
+}
+
+// error_text summarizes the errors a server message carries.
+func (m appsync_message) error_text() string {
+	parts := make([]string, 0, len(m.Errors))
+	for _, e := range m.Errors {
+		parts = append(parts, strings.TrimSpace(e.ErrorType+" "+e.Message))
+	}
+	if len(parts) == 0 {
+		return m.Type
+	}
+	return strings.Join(parts, "; ")
+}
+
+// appsync_header_transport is a Transport for the AppSync Events API that
+// authorizes with fixed headers instead of SigV4. Like the AppSync client it
+// does not reconnect by itself; watch_connection does.
+type appsync_header_transport struct {
+	realtime_url string
+	auth         map[string]string
+	connected    atomic.Bool
+
+	keep_alive_tracker // see connection_check.go
+
+	mu       sync.Mutex // guards the fields below
+	conn     *websocket.Conn
+	cancel   context.CancelFunc
+	handlers map[string]func(data_payload interface{}) // subscription ID to handler
+	pending  map[string]chan appsync_message           // operation ID to its reply
+}
+
+func new_appsync_header_transport(settings Config) (*appsync_header_transport, error) {
+	auth, err := appsync_auth_headers(settings.AppSyncAuthMode, settings.AppSyncHTTPHost, settings.AppSyncAPIKey, settings.AppSyncAuthToken)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s Authorizing with the AppSync Events API by %s", appsync_auth_print_prefix, strings.ToLower(settings.AppSyncAuthMode))
+	return &appsync_header_transport{
+		realtime_url: fmt.Sprintf("wss://%s/event/realtime", settings.AppSyncRealtimeHost),
+		auth:         auth,
+		handlers:     map[string]func(data_payload interface{}){},
+		pending:      map[string]chan appsync_message{},
+	}, nil
+}
+
+// new_operation_id returns a random ID for a subscribe, publish or unsubscribe.
+func new_operation_id() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("op-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Connect opens the WebSocket and waits for connection_ack.
+func (t *appsync_header_transport) Connect(ctx context.Context) error {
+	if t.connected.Load() {
+		return nil
+	}
+	subprotocols, err := appsync_handshake_subprotocols(t.auth)
+	if err != nil {
+		return fmt.Errorf("failed to encode the handshake headers: %w", err)
+	}
+	dial_ctx, cancel_dial := context.WithTimeout(ctx, appsync_operation_timeout)
+	defer cancel_dial()
+	conn, _, err := websocket.Dial(dial_ctx, t.realtime_url, &websocket.DialOptions{Subprotocols: subprotocols})
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", t.realtime_url, err)
+	}
+
+	if err := write_appsync_message(dial_ctx, conn, appsync_message{Type: "connection_init"}); err != nil {
+		conn.Close(websocket.StatusInternalError, "")
+		return fmt.Errorf("failed to send connection_init: %w", err)
+	}
+	var ack appsync_message
+	for ack.Type != "connection_ack" {
+		if ack, err = read_appsync_message(dial_ctx, conn); err != nil {
+			conn.Close(websocket.StatusInternalError, "")
+			return fmt.Errorf("failed waiting for connection_ack: %w", err)
+		}
+		if ack.Type == "connection_error" || ack.Type == "error" {
+			conn.Close(websocket.StatusPolicyViolation, "")
+			return fmt.Errorf("AppSync refused the connection: %s", ack.error_text())
+		}
+	}
+
+	ka_timeout := appsync_default_ka_timeout
+	if ack.ConnectionTimeoutMs > 0 {
+		ka_timeout = time.Duration(ack.ConnectionTimeoutMs) * time.Millisecond
+	}
+	run_ctx, cancel := context.WithCancel(context.Background())
+	t.mu.Lock()
+	t.conn = conn
+	t.cancel = cancel
+	t.mu.Unlock()
+	t.set_timeout(ka_timeout)
+	t.heard(time.Now())
+	t.connected.Store(true)
+	log.Printf("%s Connected to %s", appsync_auth_print_prefix, t.realtime_url)
+
+	go t.read_loop(run_ctx, conn, ka_timeout)
+	return nil
+}
+
+func (t *appsync_header_transport) IsConnected() bool {
+	return t.connected.Load()
+}
+
+func write_appsync_message(ctx context.Context, conn *websocket.Conn, message appsync_message) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, websocket.MessageText, encoded)
+}
+
+func read_appsync_message(ctx context.Context, conn *websocket.Conn) (appsync_message, error) {
+	var message appsync_message
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(data, &message)
+	return message, err
+}
+
+// read_loop dispatches messages until the connection fails or no keep-alive
+// arrives within ka_timeout.
+func (t *appsync_header_transport) read_loop(ctx context.Context, conn *websocket.Conn, ka_timeout time.Duration) {
+	defer t.drop(conn)
+	for {
+		read_ctx, cancel := context.WithTimeout(ctx, ka_timeout)
+		message, err := read_appsync_message(read_ctx, conn)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("%s Connection lost: %v", appsync_auth_print_prefix, err)
+			}
+			return
+		}
+		t.heard(time.Now())
+		switch message.Type {
+		case "ka":
+		case "data":
+			t.deliver(message)
+		default:
+			t.mu.Lock()
+			reply, ok := t.pending[message.ID]
+			if ok {
+				reply <- message // buffered, and each operation gets one reply
+			}
+			t.mu.Unlock()
+			if !ok && (message.Type == "error" || message.Type == "connection_error") {
+				log.Printf("%s AppSync error: %s", appsync_auth_print_prefix, message.error_text())
+			}
+		}
+	}
+}
+
+// deliver hands a data message's event to its subscription, decoded when it is JSON.
+func (t *appsync_header_transport) deliver(message appsync_message) {
+	t.mu.Lock()
+	on_data := t.handlers[message.ID]
+	t.mu.Unlock()
+	if on_data == nil {
+		return
+	}
+	var event interface{}
+	if err := json.Unmarshal(message.Event, &event); err != nil {
+		return
+	}
+	if text, ok := event.(string); ok {
+		var decoded interface{}
+		if json.Unmarshal([]byte(text), &decoded) == nil {
+			event = decoded
+		}
+	}
+	on_data(event)
+}
+
+// drop marks conn as gone, fails every operation waiting on it and forgets
+// its subscriptions, which reconnect makes again under new IDs.
+func (t *appsync_header_transport) drop(conn *websocket.Conn) {
+	conn.Close(websocket.StatusNormalClosure, "")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != conn {
+		return
+	}
+	t.conn = nil
+	t.connected.Store(false)
+	for id, reply := range t.pending {
+		close(reply)
+		delete(t.pending, id)
+	}
+	clear(t.handlers)
+}
+
+// request sends message and waits for the server's reply to its ID.
+func (t *appsync_header_transport) request(ctx context.Context, message appsync_message) (appsync_message, error) {
+	reply := make(chan appsync_message, 1)
+	t.mu.Lock()
+	conn := t.conn
+	if conn == nil {
+		t.mu.Unlock()
+		return appsync_message{}, errors.New("not connected to the AppSync Events API")
+	}
+	t.pending[message.ID] = reply
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, message.ID)
+		t.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, appsync_operation_timeout)
+	defer cancel()
+	if err := write_appsync_message(ctx, conn, message); err != nil {
+		return appsync_message{}, err
+	}
+	select {
+	case response, ok := <-reply:
+		if !ok {
+			return appsync_message{}, errors.New("connection closed before AppSync replied")
+		}
+		return response, nil
+	case <-ctx.Done():
+		return appsync_message{}, ctx.Err()
+	}
+}
+
+// Publish sends events in batches of at most five, the Events API limit.
+func (t *appsync_header_transport) Publish(ctx context.Context, channel string, events []interface{}) error {
+	for start := 0; start < len(events); start += appsync_max_events_per_batch {
+		end := min(start+appsync_max_events_per_batch, len(events))
+		batch := make([]string, 0, end-start)
+		for _, event := range events[start:end] {
+			encoded, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("failed to marshal event for %s: %w", channel, err)
+			}
+			batch = append(batch, string(encoded))
+		}
+		response, err := t.request(ctx, appsync_message{
+			Type:          "publish",
+			ID:            new_operation_id(),
+			Channel:       channel,
+			Events:        batch,
+			Authorization: t.auth,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to publish to %s: %w", channel, err)
+		}
+		if response.Type != "publish_success" {
+			return fmt.Errorf("AppSync refused the publish to %s: %s", channel, response.error_text())
+		}
+		if len(response.Failed) > 0 {
+			return fmt.Errorf("AppSync rejected %d of %d events published to %s", len(response.Failed), len(batch), channel)
+		}
+	}
+	return nil
+}
+
+// Subscribe delivers events on channel to on_data once AppSync confirms the subscription.
+func (t *appsync_header_transport) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error) {
+	id := new_operation_id()
+	t.mu.Lock()
+	t.handlers[id] = on_data
+	t.mu.Unlock()
+	response, err := t.request(ctx, appsync_message{
+		Type:          "subscribe",
+		ID:            id,
+		Channel:       channel,
+		Authorization: t.auth,
+	})
+	if err == nil && response.Type != "subscribe_success" {
+		err = fmt.Errorf("AppSync refused the subscription: %s", response.error_text())
+	}
+	if err != nil {
+		t.mu.Lock()
+		delete(t.handlers, id)
+		t.mu.Unlock()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", channel, err)
+	}
+	return &appsync_header_subscription{transport: t, id: id}, nil
+}
+
+// Close ends the connection.
+func (t *appsync_header_transport) Close() error {
+	t.mu.Lock()
+	conn, cancel := t.conn, t.cancel
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if conn != nil {
+		t.drop(conn)
+	}
+	return nil
+}
+
+type appsync_header_subscription struct {
+	transport *appsync_header_transport
+	id        string
+}
+
+// Unsubscribe stops delivery right away and tells AppSync without waiting for
+// its reply.
+func (s *appsync_header_subscription) Unsubscribe() error {
+	t := s.transport
+	t.mu.Lock()
+	delete(t.handlers, s.id)
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), appsync_operation_timeout)
+	defer cancel()
+	return write_appsync_message(ctx, conn, appsync_message{Type: "unsubscribe", ID: s.id})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+func TestAppSyncAuthHeaders(t *testing.T) {
+	headers, err := appsync_auth_headers(appsync_auth_api_key, "api.example.com", "da2-key", "")
+	if err != nil || headers["x-api-key"] != "da2-key" || headers["host"] != "api.example.com" {
+		t.Fatalf("unexpected api_key headers %v (%v)", headers, err)
+	}
+	headers, err = appsync_auth_headers(appsync_auth_lambda, "api.example.com", "", "token")
+	if err != nil || headers["Authorization"] != "token" {
+		t.Fatalf("unexpected lambda headers %v (%v)", headers, err)
+	}
+	if _, err := appsync_auth_headers(appsync_auth_cognito, "api.example.com", "", ""); err == nil || !strings.Contains(err.Error(), live_lambda_appsync_auth_token_env) {
+		t.Fatalf("expected a missing token error, got %v", err)
+	}
+
+	subprotocols, err := appsync_handshake_subprotocols(map[string]string{"x-api-key": "da2-key"})
+	if err != nil || len(subprotocols) != 2 || subprotocols[1] != appsync_events_subprotocol {
+		t.Fatalf("unexpected subprotocols %v (%v)", subprotocols, err)
+	}
+	decoded, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(subprotocols[0], "header-"))
+	if string(decoded) != `{"x-api-key":"da2-key"}` {
+		t.Fatalf("unexpected encoded headers %s", decoded)
+	}
+}
+
+func TestTransportSelectionByAuthMode(t *testing.T) {
+	settings := default_config()
+	settings.AppSyncHTTPHost = "api.example.com"
+	settings.AppSyncRealtimeHost = "realtime.example.com"
+	settings.AppSyncRegion = "eu-west-1"
+	settings.AppSyncAuthMode = appsync_auth_api_key
+	settings.AppSyncAPIKey = "da2-key"
+
+	transport, err := new_transport_from_config(aws.Config{}, settings, "c")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	header_transport, ok := transport.(*appsync_header_transport)
+	if !ok || header_transport.realtime_url != "wss://realtime.example.com/event/realtime" {
+		t.Fatalf("expected a header transport, got %#v", transport)
+	}
+}
+
+func TestAppSyncHeaderTransportRoundTrip(t *testing.T) {
+	server := eventstest.NewServer(eventstest.Options{APIKey: "da2-key"})
+	defer server.Close()
+	transport := &appsync_header_transport{
+		realtime_url: server.RealtimeURL(),
+		auth:         map[string]string{"host": "api.example.com", "x-api-key": "da2-key"},
+		handlers:     map[string]func(data_payload interface{}){},
+		pending:      map[string]chan appsync_message{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer transport.Close()
+
+	received := make(chan interface{}, 10)
+	subscription, err := transport.Subscribe(ctx, "live-lambda/requests", func(data_payload interface{}) {
+		received <- data_payload
+	})
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	events := []interface{}{}
+	for i := 0; i < 7; i++ {
+		events = append(events, map[string]interface{}{"n": i})
+	}
+	if err := transport.Publish(ctx, "live-lambda/requests", events); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		select {
+		case data := <-received:
+			if event, ok := data.(map[string]interface{}); !ok || event["n"] != float64(i) {
+				t.Fatalf("unexpected event %d: %#v", i, data)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+
+	subscription.Unsubscribe()
+	if _, err := transport.Subscribe(ctx, "live-lambda/control/orders", func(interface{}) {}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	transport.Close()
+	if transport.IsConnected() {
+		t.Fatal("expected the transport to be disconnected after Close")
+	}
+	if len(transport.handlers) != 0 {
+		t.Fatalf("expected the closed connection's subscriptions to be forgotten, %d remain", len(transport.handlers))
+	}
+}
+
+func TestAppSyncHeaderTransportRejected(t *testing.T) {
+	server := eventstest.NewServer(eventstest.Options{APIKey: "da2-key"})
+	defer server.Close()
+	transport := &appsync_header_transport{
+		realtime_url: server.RealtimeURL(),
+		auth:         map[string]string{"x-api-key": "wrong"},
+		handlers:     map[string]func(data_payload interface{}){},
+		pending:      map[string]chan appsync_message{},
+	}
+	if err := transport.Connect(context.Background()); err == nil {
+		t.Fatal("expected the handshake to be refused")
+	}
+}
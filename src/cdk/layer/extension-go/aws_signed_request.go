@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// The extension makes a handful of small AWS API calls. Rather than pulling a
+// service client module into the layer binary for each of them, requests are
+// built by hand and signed with the SDK's SigV4 signer.
+
+const (
+	aws_json_content_type    = "application/x-amz-json-1.1"
+	ssm_get_parameter_target = "AmazonSSM.GetParameter"
+)
+
+var aws_api_http_client = &http.Client{Timeout: 10 * time.Second}
+
+// aws_service_endpoint returns the regional HTTPS endpoint for an AWS service.
+func aws_service_endpoint(service string, region string) string {
+	return fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+}
+
+// send_signed_request signs and sends a request to an AWS API and returns the
+// response body. Non-2xx responses are returned as errors including the body.
+func send_signed_request(ctx context.Context, cfg aws.Config, service string, region string, method string, url string, body []byte, headers http.Header) ([]byte, error) {
+	if cfg.Credentials == nil {
+		return nil, fmt.Errorf("no AWS credentials configured")
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	copy_headers(headers, req.Header)
+
+	payload_hash := sha256.Sum256(body)
+	if service == "s3" {
+		// S3 requires the payload hash as a header in addition to the signature
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload_hash[:]))
+	}
+	signer := v4.NewSigner()
+	if err := signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payload_hash[:]), service, region, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign %s request: %w", service, err)
+	}
+
+	resp, err := aws_api_http_client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	resp_body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s failed with status %d: %s", service, method, resp.StatusCode, string(resp_body))
+	}
+	return resp_body, nil
+}
+
+// presign_request returns a SigV4 query-string signed URL valid for expires.
+// The payload is left unsigned so the URL can be used with any body.
+func presign_request(ctx context.Context, cfg aws.Config, service string, region string, method string, url string, expires time.Duration) (string, error) {
+	if cfg.Credentials == nil {
+		return "", fmt.Errorf("no AWS credentials configured")
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	query := req.URL.Query()
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	req.URL.RawQuery = query.Encode()
+
+	signed_url, _, err := v4.NewSigner().PresignHTTP(ctx, credentials, req, "UNSIGNED-PAYLOAD", service, region, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s request: %w", service, err)
+	}
+	return signed_url, nil
+}
+
+// send_aws_json_request calls an AWS JSON 1.1 API operation.
+func send_aws_json_request(ctx context.Context, cfg aws.Config, service string, region string, target string, body []byte) ([]byte, error) {
+	headers := http.Header{}
+	headers.Set("Content-Type", aws_json_content_type)
+	headers.Set("X-Amz-Target", target)
+	return send_signed_request(ctx, cfg, service, region, http.MethodPost, aws_service_endpoint(service, region), body, headers)
+}
+
+// parse_resource_arn returns the service and region of a KMS key, SSM
+// parameter or Secrets Manager secret ARN, or empty strings for any other ARN.
+func parse_resource_arn(arn string) (string, string) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[3] == "" {
+		return "", ""
+	}
+	switch {
+	case parts[2] == "kms" && strings.HasPrefix(parts[5], "key/"):
+	case parts[2] == "ssm" && strings.HasPrefix(parts[5], "parameter/"):
+	case parts[2] == "secretsmanager" && strings.HasPrefix(parts[5], "secret:"):
+	default:
+		return "", ""
+	}
+	return parts[2], parts[3]
+}
+
+// read_ssm_parameter returns the value of a parameter, decrypting a
+// SecureString.
+func read_ssm_parameter(ctx context.Context, cfg aws.Config, region string, parameter_arn string) ([]byte, error) {
+	body, _ := json.Marshal(map[string]interface{}{"Name": parameter_arn, "WithDecryption": true})
+	response, err := send_aws_json_request(ctx, cfg, "ssm", region, ssm_get_parameter_target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", parameter_arn, err)
+	}
+	var parameter struct {
+		Parameter struct {
+			Value string
+		}
+	}
+	if err := json.Unmarshal(response, &parameter); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", parameter_arn, err)
+	}
+	return []byte(parameter.Parameter.Value), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// agent_capacity tracks how much work the local agent has said it will accept.
+// The agent advertises max_in_flight and may send busy/ready frames; while it is
+// at capacity or busy, invocations pass through to the bundled handler instead of
+// being offered over AppSync.
+
+const (
+	backpressure_print_prefix = "[LiveLambdaExt:Backpressure]"
+	default_busy_duration     = 5 * time.Second
+)
+
+type agent_capacity struct {
+	mu            sync.Mutex
+	max_in_flight int // 0 means unlimited
+	in_flight     int
+	busy_until    time.Time
+	now           func() time.Time
+}
+
+type capacity_frame struct {
+	Type         string `json:"type"`
+	MaxInFlight  *int   `json:"max_in_flight,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+func new_agent_capacity() *agent_capacity {
+	return &agent_capacity{now: time.Now}
+}
+
+// try_acquire reserves a slot for an invocation. It returns false when the agent
+// is busy or already has max_in_flight invocations outstanding.
+func (c *agent_capacity) try_acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now().Before(c.busy_until) {
+		return false
+	}
+	if c.max_in_flight > 0 && c.in_flight >= c.max_in_flight {
+		return false
+	}
+	c.in_flight++
+	return true
+}
+
+// release frees a slot reserved by try_acquire.
+func (c *agent_capacity) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.in_flight > 0 {
+		c.in_flight--
+	}
+}
+
+func (c *agent_capacity) set_max_in_flight(max_in_flight int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max_in_flight < 0 {
+		max_in_flight = 0
+	}
+	c.max_in_flight = max_in_flight
+}
+
+func (c *agent_capacity) mark_busy(duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy_until = c.now().Add(duration)
+}
+
+func (c *agent_capacity) clear_busy() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy_until = time.Time{}
+}
+
+// snapshot returns the current in-flight count and limit.
+func (c *agent_capacity) snapshot() (in_flight int, max_in_flight int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.in_flight, c.max_in_flight
+}
+
+// handle_frame applies a capacity, busy, or ready frame from the agent.
+func (c *agent_capacity) handle_frame(frame json.RawMessage) {
+	var parsed capacity_frame
+	if err := json.Unmarshal(frame, &parsed); err != nil {
+		log.Printf("%s Ignoring malformed %s frame: %v", backpressure_print_prefix, parsed.Type, err)
+		return
+	}
+
+	switch parsed.Type {
+	case "capacity":
+		if parsed.MaxInFlight == nil {
+			return
+		}
+		c.set_max_in_flight(*parsed.MaxInFlight)
+		log.Printf("%s Agent advertised max_in_flight=%d", backpressure_print_prefix, *parsed.MaxInFlight)
+	case "busy":
+		duration := default_busy_duration
+		if parsed.RetryAfterMs > 0 {
+			duration = time.Duration(parsed.RetryAfterMs) * time.Millisecond
+		}
+		if parsed.MaxInFlight != nil {
+			c.set_max_in_flight(*parsed.MaxInFlight)
+		}
+		c.mark_busy(duration)
+		log.Printf("%s Agent is busy, passing invocations through for %s", backpressure_print_prefix, duration)
+	case "ready":
+		c.clear_busy()
+		log.Printf("%s Agent is ready for invocations again", backpressure_print_prefix)
+	}
+}
+
+// register_capacity_handlers wires the agent capacity frames into the control dispatcher.
+func register_capacity_handlers(dispatcher *control_dispatcher, capacity *agent_capacity) {
+	for _, frame_type := range []string{"capacity", "busy", "ready"} {
+		dispatcher.register(frame_type, capacity.handle_frame)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAgentCapacityUnlimitedByDefault(t *testing.T) {
+	capacity := new_agent_capacity()
+	for i := 0; i < 100; i++ {
+		if !capacity.try_acquire() {
+			t.Fatalf("expected acquire %d to succeed without a limit", i)
+		}
+	}
+}
+
+func TestAgentCapacityRespectsMaxInFlight(t *testing.T) {
+	capacity := new_agent_capacity()
+	capacity.handle_frame(json.RawMessage(`{"type":"capacity","max_in_flight":2}`))
+
+	if !capacity.try_acquire() || !capacity.try_acquire() {
+		t.Fatal("expected the first two acquires to succeed")
+	}
+	if capacity.try_acquire() {
+		t.Fatal("expected the third acquire to be declined")
+	}
+
+	capacity.release()
+	if !capacity.try_acquire() {
+		t.Fatal("expected acquire to succeed after a release")
+	}
+}
+
+func TestAgentCapacityBusyFrame(t *testing.T) {
+	now := time.Unix(1000, 0)
+	capacity := new_agent_capacity()
+	capacity.now = func() time.Time { return now }
+
+	capacity.handle_frame(json.RawMessage(`{"type":"busy","retry_after_ms":1500}`))
+	if capacity.try_acquire() {
+		t.Fatal("expected acquire to be declined while busy")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if !capacity.try_acquire() {
+		t.Fatal("expected acquire to succeed once the busy window elapsed")
+	}
+}
+
+func TestAgentCapacityReadyFrameClearsBusy(t *testing.T) {
+	capacity := new_agent_capacity()
+	capacity.handle_frame(json.RawMessage(`{"type":"busy"}`))
+	if capacity.try_acquire() {
+		t.Fatal("expected acquire to be declined while busy")
+	}
+
+	capacity.handle_frame(json.RawMessage(`{"type":"ready"}`))
+	if !capacity.try_acquire() {
+		t.Fatal("expected acquire to succeed after a ready frame")
+	}
+}
+
+func TestControlDispatcherRoutesCapacityFrames(t *testing.T) {
+	dispatcher := new_control_dispatcher()
+	capacity := new_agent_capacity()
+	register_capacity_handlers(dispatcher, capacity)
+
+	dispatcher.dispatch(json.RawMessage(`{"type":"capacity","max_in_flight":1}`))
+	dispatcher.dispatch(json.RawMessage(`{"type":"unknown"}`))
+	dispatcher.dispatch(json.RawMessage(`not json`))
+
+	if _, max_in_flight := capacity.snapshot(); max_in_flight != 1 {
+		t.Fatalf("expected max_in_flight 1, got %d", max_in_flight)
+	}
+}
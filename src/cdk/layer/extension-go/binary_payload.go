@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Binary payloads
+//
+// Events are not always JSON: custom runtimes and direct invocations can hand
+// the function any bytes. A request envelope can only embed a JSON event as
+// is, so a non-JSON event is published with event_format "binary",
+// event_payload as the base64 of its bytes and content_type as the Runtime
+// API reported it. When the envelope is also compressed, event_payload is the
+// gzip of the bytes instead, and an offloaded event is uploaded as the bytes
+// themselves. Only agents with the binary capability are offered such events;
+// for other agents they pass through to the function.
+//
+// In the other direction, the agent publishes
+//
+//	{"type": "binary_payload", "data": "<base64>"}
+//
+// for a response whose exact bytes matter, and the extension posts the decoded
+// bytes unchanged. Like encoded_payload frames, it may arrive inline, in a
+// response envelope or in chunks.
+
+const (
+	binary_event_format       = protocol.EventFormatBinary
+	binary_payload_frame_type = "binary_payload"
+)
+
+type binary_payload struct {
+	Type string `json:"type"`
+	Data string `json:"data"` // base64 of the response bytes
+}
+
+// is_binary_event reports whether event cannot be embedded in an envelope as JSON.
+func is_binary_event(event []byte) bool {
+	return !json.Valid(event)
+}
+
+// add_binary_event frames a non-JSON event in a request envelope.
+func add_binary_event(envelope *protocol.Request, event []byte, content_type string) {
+	envelope.EventPayload, _ = json.Marshal(base64.StdEncoding.EncodeToString(event))
+	envelope.EventFormat = binary_event_format
+	envelope.ContentType = content_type
+}
+
+// parse_binary_payload decodes a frame if it is a binary_payload; ok is false
+// for other frames.
+func parse_binary_payload(frame []byte) ([]byte, bool, error) {
+	var probe binary_payload
+	if json.Unmarshal(frame, &probe) != nil || probe.Type != binary_payload_frame_type {
+		return nil, false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(probe.Data)
+	if err != nil {
+		return nil, true, fmt.Errorf("binary_payload data is not base64: %w", err)
+	}
+	return decoded, true, nil
+}
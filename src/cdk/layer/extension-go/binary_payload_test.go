@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestAddBinaryEvent(t *testing.T) {
+	event := []byte{0x1f, 0x8b, 0x00, 'x'}
+	if !is_binary_event(event) || is_binary_event([]byte(`{"a":1}`)) {
+		t.Fatal("expected only non-JSON events to be binary")
+	}
+	envelope := &protocol.Request{RequestID: "r1"}
+	add_binary_event(envelope, event, "application/x-protobuf")
+	if envelope.EventFormat != binary_event_format || envelope.ContentType != "application/x-protobuf" || envelope.Validate() != nil {
+		t.Fatalf("unexpected envelope %+v", envelope)
+	}
+	var encoded string
+	json.Unmarshal(envelope.EventPayload, &encoded)
+	if decoded, _ := base64.StdEncoding.DecodeString(encoded); string(decoded) != string(event) {
+		t.Fatalf("expected the event's bytes, got %q", decoded)
+	}
+}
+
+func TestParseBinaryPayload(t *testing.T) {
+	if _, ok, _ := parse_binary_payload([]byte(`{"statusCode":200}`)); ok {
+		t.Fatal("expected other frames to be ignored")
+	}
+	if _, ok, err := parse_binary_payload([]byte(`{"type":"binary_payload","data":"%%%"}`)); !ok || err == nil {
+		t.Fatal("expected invalid base64 to be reported")
+	}
+}
+
+func TestRouteAgentResponsePostsBinaryBytesUnchanged(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.requests.register("req-1", []byte("raw event"), nil)
+
+	response := []byte{0x00, 0xff, '{', '"'}
+	proxy.route_agent_response("req-1", map[string]interface{}{
+		"type":             response_envelope_type,
+		"protocol_version": current_protocol_version,
+		"body": map[string]interface{}{
+			"type": binary_payload_frame_type,
+			"data": base64.StdEncoding.EncodeToString(response),
+		},
+	})
+
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-1/response" || posted.body != string(response) {
+			t.Fatalf("expected the decoded bytes to be posted, got %s %q", posted.path, posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+}
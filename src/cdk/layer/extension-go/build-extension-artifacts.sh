@@ -18,7 +18,7 @@ HASH_FILE_PATH="$PROJECT_ROOT/dist/go_extension.sha256"
 
 calculate_current_hash() {
   # Ensure this command works on macOS and handles cases where go.mod/go.sum might not exist initially
-  (cd "$GO_EXT_SRC_DIR" && find . -maxdepth 1 \( -name '*.go' -o -name 'go.mod' -o -name 'go.sum' \) -print0 2>/dev/null | xargs -0 shasum -a 256 2>/dev/null | sort -k2 | shasum -a 256 | awk '{print $1}' || echo "hash_error")
+  (cd "$GO_EXT_SRC_DIR" && find . \( -path ./cmd -o -path ./e2e \) -prune -o \( -name '*.go' -o -name 'go.mod' -o -name 'go.sum' \) -print0 2>/dev/null | xargs -0 shasum -a 256 2>/dev/null | sort -k2 | shasum -a 256 | awk '{print $1}' || echo "hash_error")
 }
 
 CURRENT_HASH=$(calculate_current_hash)
@@ -39,10 +39,11 @@ elif [ "$CURRENT_HASH" == "hash_error" ]; then
 fi
 
 if ! ([ "$CURRENT_HASH" != "hash_error" ] && [ "$CURRENT_HASH" == "$PREVIOUS_HASH" ] && [ -f "$AMD64_ARTIFACT" ] && [ -f "$ARM64_ARTIFACT" ]); then
+  EXTENSION_VERSION=$(sed -n 's/^  "version": "\(.*\)",$/\1/p' "$PROJECT_ROOT/package.json")
   echo "Compiling Go extension for linux/amd64..."
-  (cd "$GO_EXT_SRC_DIR" && CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags='-s -w' -o "$AMD64_ARTIFACT" .)
+  (cd "$GO_EXT_SRC_DIR" && CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags="-s -w -X main.extension_version=${EXTENSION_VERSION:-dev}" -o "$AMD64_ARTIFACT" .)
   echo "Compiling Go extension for linux/arm64..."
-  (cd "$GO_EXT_SRC_DIR" && CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -ldflags='-s -w' -o "$ARM64_ARTIFACT" .)
+  (cd "$GO_EXT_SRC_DIR" && CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -ldflags="-s -w -X main.extension_version=${EXTENSION_VERSION:-dev}" -o "$ARM64_ARTIFACT" .)
   
   if [ "$CURRENT_HASH" != "hash_error" ] && [ -f "$AMD64_ARTIFACT" ] && [ -f "$ARM64_ARTIFACT" ]; then
     # Create dist directory for hash file if it doesn't exist (it should by now due to other outputs)
@@ -74,6 +75,15 @@ cp "$GO_WRAPPER_TEMPLATE" "$MAIN_EXTENSION_WRAPPER_TARGET"
 echo "Copying runtime wrapper script (live-lambda-runtime-wrapper.sh)..."
 cp "$SCRIPT_DIR/live-lambda-runtime-wrapper.sh" "$DIST_DIR_ABS/"
 
+# --- Optional extension configuration, read from /opt/live-lambda.config.json ---
+CONFIG_FILE_SOURCE="$PROJECT_ROOT/live-lambda.config.json"
+if [ -f "$CONFIG_FILE_SOURCE" ]; then
+  echo "Copying extension configuration (live-lambda.config.json)..."
+  cp "$CONFIG_FILE_SOURCE" "$DIST_DIR_ABS/live-lambda.config.json"
+else
+  rm -f "$DIST_DIR_ABS/live-lambda.config.json"
+fi
+
 echo "Setting execute permissions..."
 chmod +x "$MAIN_EXTENSION_WRAPPER_TARGET"
 chmod +x "$DIST_DIR_ABS/live-lambda-runtime-wrapper.sh"
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// add_caller_context copies the Cognito identity and mobile client context
+// Lambda sent with the invocation into the envelope's context. A header that
+// does not parse is passed on verbatim, so the agent still sees it.
+func add_caller_context(context_data *protocol.Context, headers http.Header, logger *slog.Logger) {
+	if header := headers.Get("Lambda-Runtime-Cognito-Identity"); header != "" {
+		if identity, err := protocol.ParseCognitoIdentity(header); err == nil {
+			context_data.Identity = identity
+		} else {
+			logger.Warn("Passing Lambda-Runtime-Cognito-Identity on unparsed", "error", err)
+			context_data.IdentityRaw = header
+		}
+	}
+	if header := headers.Get("Lambda-Runtime-Client-Context"); header != "" {
+		if client_context, err := protocol.ParseClientContext(header); err == nil {
+			context_data.ClientContext = client_context
+		} else {
+			logger.Warn("Passing Lambda-Runtime-Client-Context on unparsed", "error", err)
+			context_data.ClientContextRaw = header
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestAddCallerContextTypesTheHeaders(t *testing.T) {
+	client_context := `{"client":{"installation_id":"install-1","app_title":"App"},"custom":{"tenant":"acme"},"env":{"platform":"ios"}}`
+	headers := http.Header{}
+	headers.Set("Lambda-Runtime-Cognito-Identity", `{"cognitoIdentityId":"identity-id","cognitoIdentityPoolId":"pool-id"}`)
+	headers.Set("Lambda-Runtime-Client-Context", base64.StdEncoding.EncodeToString([]byte(client_context)))
+
+	var context_data protocol.Context
+	add_caller_context(&context_data, headers, request_logger("r1"))
+	if context_data.Identity == nil || context_data.Identity.IdentityPoolID != "pool-id" {
+		t.Fatalf("unexpected identity %+v", context_data.Identity)
+	}
+	if context_data.ClientContext == nil || context_data.ClientContext.Client.InstallationID != "install-1" || context_data.ClientContext.Custom["tenant"] != "acme" {
+		t.Fatalf("unexpected client context %+v", context_data.ClientContext)
+	}
+
+	// The agents read the same keys the untyped maps had.
+	encoded, _ := json.Marshal(context_data)
+	var fields struct {
+		Identity      map[string]string          `json:"identity"`
+		ClientContext map[string]json.RawMessage `json:"client_context"`
+	}
+	json.Unmarshal(encoded, &fields)
+	if fields.Identity["cognitoIdentityId"] != "identity-id" || string(fields.ClientContext["env"]) != `{"platform":"ios"}` {
+		t.Fatalf("unexpected context %s", encoded)
+	}
+}
+
+func TestAddCallerContextPassesUnparsedHeadersOn(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Lambda-Runtime-Cognito-Identity", "not json")
+	headers.Set("Lambda-Runtime-Client-Context", `{"custom":{"retries":3}}`)
+
+	var context_data protocol.Context
+	add_caller_context(&context_data, headers, request_logger("r1"))
+	if context_data.Identity != nil || context_data.IdentityRaw != "not json" {
+		t.Fatalf("unexpected identity %+v, %q", context_data.Identity, context_data.IdentityRaw)
+	}
+	if context_data.ClientContext != nil || context_data.ClientContextRaw != `{"custom":{"retries":3}}` {
+		t.Fatalf("unexpected client context %+v, %q", context_data.ClientContext, context_data.ClientContextRaw)
+	}
+
+	var without protocol.Context
+	add_caller_context(&without, http.Header{}, request_logger("r2"))
+	if encoded, _ := json.Marshal(without); string(encoded) != `{"invoked_function_arn":"","deadline_ms":"","trace_id":"","request_id":""}` {
+		t.Fatalf("expected no caller fields without the headers, got %s", encoded)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel namespaces
+//
+// Every channel lives in one AppSync Events namespace, live-lambda by default.
+// Stages that share an Events API each get their own namespace
+// (live-lambda-{stage}), set with LIVE_LAMBDA_APPSYNC_NAMESPACE, so IAM can keep
+// one stage's developers out of another stage's channels.
+//
+// The CDK stack gives each stage namespace an onPublish handler that stamps the
+// namespace into namespace_check lifecycle events. With
+// LIVE_LAMBDA_NAMESPACE_CHECK=warn or enforce the extension publishes one at
+// startup and reads its own echo back: an echo stamped with another namespace,
+// or none at all, means the function is not talking to the namespace it was
+// deployed for. enforce then turns interception off for the sandbox.
+//
+// Within a namespace, LIVE_LAMBDA_CHANNEL_SCOPE places a function's channels
+// under up to two scope segments, so several developers and functions can share
+// one Events API without seeing each other's invocations. The scope is a
+// template rendered once at startup:
+//
+//	LIVE_LAMBDA_CHANNEL_SCOPE={function}/{dev}   live-lambda/orders/alice/requests
+//	LIVE_LAMBDA_CHANNEL_SCOPE={function}-{version}   live-lambda/orders-7/requests
+//
+// {function} and {version} are the function's name and version, with
+// characters a channel segment cannot hold replaced by hyphens ($LATEST becomes
+// LATEST); {dev} is LIVE_LAMBDA_DEVELOPER_ID. Lambda does not tell a sandbox
+// which alias invoked it, so aliases are told apart by the version they point
+// to. {stage} is the stage of the namespace (dev for live-lambda-dev). AppSync
+// allows five segments per channel, which is why the scope can have no more
+// than two.
+//
+// The requests and response channels themselves are templates too,
+// LIVE_LAMBDA_REQUESTS_CHANNEL (requests by default) and
+// LIVE_LAMBDA_RESPONSE_CHANNEL (response/{request_id}), taking the same
+// placeholders. The response channel must end in a {request_id} segment,
+// which is filled in per invocation and lets the wildcard response
+// subscription use response/*. Each template starts with a fixed segment other
+// than those of the other channels, so the namespace handlers the CDK stack
+// generates can tell them apart, and the whole channel, namespace and scope
+// included, must fit AppSync's five segments. Templates are rendered and
+// checked once at startup; a bad one fails validation.
+
+const (
+	namespace_print_prefix    = "[LiveLambdaExt:Namespace]"
+	default_channel_namespace = "live-lambda"
+	namespace_check_off       = "off"
+	namespace_check_warn      = "warn"
+	namespace_check_enforce   = "enforce"
+	namespace_check_type      = "namespace_check"
+	namespace_check_timeout   = 5 * time.Second
+)
+
+const (
+	max_channel_scope_segments = 2
+	max_channel_segments       = 5
+	default_requests_channel   = "requests"
+	default_response_channel   = "response/{request_id}"
+	request_id_placeholder     = "{request_id}"
+)
+
+// reserved_channel_roots are the first segments of the channels whose names are fixed.
+var reserved_channel_roots = []string{"presence", "lifecycle", "control", "logs", "recordings", "agents", "reply"}
+
+var (
+	channel_namespace_pattern          = regexp.MustCompile(`^[A-Za-z0-9-]{1,50}$`)
+	channel_scope_placeholder_pattern  = regexp.MustCompile(`\{[^{}]*\}`)
+	invalid_channel_segment_characters = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+)
+
+// valid_channel_namespace reports whether name is a legal AppSync Events namespace name.
+func valid_channel_namespace(name string) bool {
+	return channel_namespace_pattern.MatchString(name)
+}
+
+// channel_segment_value replaces the characters a channel segment cannot hold with hyphens.
+func channel_segment_value(value string) string {
+	return strings.Trim(invalid_channel_segment_characters.ReplaceAllString(value, "-"), "-")
+}
+
+// channel_stage returns the stage of a stage namespace (dev for
+// live-lambda-dev), or "" for the default namespace and custom ones.
+func channel_stage(namespace string) string {
+	stage, found := strings.CutPrefix(namespace, default_channel_namespace+"-")
+	if !found {
+		return ""
+	}
+	return stage
+}
+
+// channel_scope_values returns what each channel template placeholder stands for.
+func (c Config) channel_scope_values() map[string]string {
+	return map[string]string{
+		"function": channel_segment_value(c.FunctionName),
+		"version":  channel_segment_value(c.FunctionVersion),
+		"stage":    channel_stage(c.AppSyncNamespace),
+		"dev":      c.DeveloperID,
+	}
+}
+
+// render_channel_segments fills in the placeholders of each segment of
+// template and checks the rendered segments. A segment that is exactly keep is
+// left as it is, to be filled in later.
+func render_channel_segments(template string, values map[string]string, keep string) ([]string, error) {
+	segments := strings.Split(template, "/")
+	var render_err error
+	for i, segment := range segments {
+		if keep != "" && segment == keep {
+			continue
+		}
+		rendered := channel_scope_placeholder_pattern.ReplaceAllStringFunc(segment, func(placeholder string) string {
+			name := strings.Trim(placeholder, "{}")
+			value, known := values[name]
+			switch {
+			case placeholder == keep && render_err == nil:
+				render_err = fmt.Errorf("%s in %q must be a segment of its own", placeholder, template)
+			case !known && render_err == nil:
+				render_err = fmt.Errorf("unknown placeholder %s in %q; use {function}, {version}, {stage} or {dev}", placeholder, template)
+			case known && value == "" && render_err == nil:
+				render_err = fmt.Errorf("%s in %q has no value", placeholder, template)
+			}
+			return value
+		})
+		if render_err != nil {
+			return nil, render_err
+		}
+		if !valid_channel_namespace(rendered) {
+			return nil, fmt.Errorf("segment %q of %q renders to %q; segments must be 1 to 50 letters, digits or hyphens", segment, template, rendered)
+		}
+		segments[i] = rendered
+	}
+	return segments, nil
+}
+
+// render_channel_scope fills in a LIVE_LAMBDA_CHANNEL_SCOPE template. An empty
+// template renders to an empty scope.
+func render_channel_scope(template string, values map[string]string) (string, error) {
+	template = strings.Trim(template, "/")
+	if template == "" {
+		return "", nil
+	}
+	if segments := strings.Count(template, "/") + 1; segments > max_channel_scope_segments {
+		return "", fmt.Errorf("%q has %d segments; a channel scope can have at most %d", template, segments, max_channel_scope_segments)
+	}
+	segments, err := render_channel_segments(template, values, "")
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// channel_templates are the rendered LIVE_LAMBDA_REQUESTS_CHANNEL and
+// LIVE_LAMBDA_RESPONSE_CHANNEL. The response channel still ends in
+// {request_id}. Empty fields stand for the defaults.
+type channel_templates struct {
+	requests string
+	response string
+}
+
+func (t channel_templates) requests_channel() string {
+	if t.requests == "" {
+		return default_requests_channel
+	}
+	return t.requests
+}
+
+func (t channel_templates) response_channel(request_id string) string {
+	response := t.response
+	if response == "" {
+		response = default_response_channel
+	}
+	return strings.Replace(response, request_id_placeholder, request_id, 1)
+}
+
+// render_channel_templates renders the requests and response channel
+// templates and checks them against AppSync's channel rules and the other
+// live-lambda channels.
+func (c Config) render_channel_templates() (channel_templates, error) {
+	scope, err := render_channel_scope(c.ChannelScope, c.channel_scope_values())
+	if err != nil {
+		return channel_templates{}, fmt.Errorf("%s: %w", live_lambda_channel_scope_env, err)
+	}
+	scope_segments := 0
+	if scope != "" {
+		scope_segments = strings.Count(scope, "/") + 1
+	}
+
+	render := func(env string, template string, fallback string, keep string) (string, error) {
+		template = strings.Trim(template, "/")
+		if template == "" {
+			template = fallback
+		}
+		segments := strings.Split(template, "/")
+		switch {
+		case strings.Contains(segments[0], "{"):
+			return "", fmt.Errorf("%s must start with a fixed segment, got %q", env, template)
+		case slices.Contains(reserved_channel_roots, segments[0]):
+			return "", fmt.Errorf("%s cannot start with %q, which another live-lambda channel uses", env, segments[0])
+		case 1+scope_segments+len(segments) > max_channel_segments:
+			return "", fmt.Errorf("%s %q has %d segments; with the namespace and channel scope a channel can have at most %d", env, template, len(segments), max_channel_segments)
+		case keep != "" && (segments[len(segments)-1] != keep || strings.Count(template, keep) != 1):
+			return "", fmt.Errorf("%s %q must end in a %s segment", env, template, keep)
+		case keep == "" && strings.Contains(template, request_id_placeholder):
+			return "", fmt.Errorf("%s %q cannot use %s", env, template, request_id_placeholder)
+		}
+		rendered, err := render_channel_segments(template, c.channel_scope_values(), keep)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", env, err)
+		}
+		return strings.Join(rendered, "/"), nil
+	}
+
+	var templates channel_templates
+	if templates.requests, err = render(live_lambda_requests_channel_env, c.RequestsChannel, default_requests_channel, ""); err != nil {
+		return channel_templates{}, err
+	}
+	if templates.response, err = render(live_lambda_response_channel_env, c.ResponseChannel, default_response_channel, request_id_placeholder); err != nil {
+		return channel_templates{}, err
+	}
+	if strings.Split(templates.requests, "/")[0] == strings.Split(templates.response, "/")[0] {
+		return channel_templates{}, fmt.Errorf("%s and %s must start with different segments", live_lambda_requests_channel_env, live_lambda_response_channel_env)
+	}
+	return templates, nil
+}
+
+// namespace returns the channel namespace this extension publishes in.
+func (p *RuntimeAPIProxy) namespace() string {
+	if namespace := p.dynamic_config.namespace(); namespace != "" {
+		return namespace
+	}
+	if p.config.AppSyncNamespace == "" {
+		return default_channel_namespace
+	}
+	return p.config.AppSyncNamespace
+}
+
+// channel returns a channel path in the extension's namespace, under its channel scope if it has one.
+func (p *RuntimeAPIProxy) channel(format string, args ...interface{}) string {
+	if p.channel_scope != "" {
+		return p.namespace() + "/" + p.channel_scope + "/" + fmt.Sprintf(format, args...)
+	}
+	return p.namespace() + "/" + fmt.Sprintf(format, args...)
+}
+
+// requests_topic returns the channel every extension publishes invocations on.
+func (p *RuntimeAPIProxy) requests_topic() string {
+	return p.channel("%s", p.channels.requests_channel())
+}
+
+// response_topic returns the channel the agent answers request_id on.
+func (p *RuntimeAPIProxy) response_topic(request_id string) string {
+	return p.channel("%s", p.channels.response_channel(request_id))
+}
+
+// namespace_echo is what came back for a namespace_check event.
+type namespace_echo struct {
+	received  bool
+	namespace string // stamped by the namespace handler; empty when there is none
+}
+
+// check_namespace_echo compares an echo with the expected namespace.
+func check_namespace_echo(expected string, echo namespace_echo) error {
+	switch {
+	case !echo.received:
+		return fmt.Errorf("no namespace_check echo within %s; the %s namespace may not exist or lack its handlers", namespace_check_timeout, expected)
+	case echo.namespace == "":
+		return fmt.Errorf("the %s namespace has no live-lambda handlers; deploy it from the CDK stack", expected)
+	case echo.namespace != expected:
+		return fmt.Errorf("connected to namespace %s, expected %s", echo.namespace, expected)
+	}
+	return nil
+}
+
+// parse_namespace_echo returns the namespace stamped on the namespace_check
+// event this sandbox published with nonce, if frame is that event.
+func parse_namespace_echo(frame []byte, sandbox_id string, nonce string) (string, bool) {
+	var event struct {
+		Type      string `json:"type"`
+		SandboxID string `json:"sandbox_id"`
+		Data      struct {
+			Nonce     string `json:"nonce"`
+			Namespace string `json:"namespace"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(frame, &event) != nil || event.Type != namespace_check_type {
+		return "", false
+	}
+	if event.SandboxID != sandbox_id || event.Data.Nonce != nonce {
+		return "", false
+	}
+	return event.Data.Namespace, true
+}
+
+// verify_namespace checks that the transport reaches the expected namespace,
+// as configured by LIVE_LAMBDA_NAMESPACE_CHECK.
+func (p *RuntimeAPIProxy) verify_namespace(ctx context.Context) {
+	mode := strings.ToLower(p.config.NamespaceCheck)
+	if mode == "" || mode == namespace_check_off {
+		return
+	}
+	expected := p.namespace()
+	err := check_namespace_echo(expected, p.probe_namespace(ctx))
+	if err == nil {
+		log.Printf("%s Verified channel namespace %s", namespace_print_prefix, expected)
+		return
+	}
+	if mode == namespace_check_enforce {
+		log.Printf("%s Disabling interception: %v", namespace_print_prefix, err)
+		p.interception.disable_hard(fmt.Sprintf("namespace check failed: %v", err))
+		return
+	}
+	log.Printf("%s Warning: %v", namespace_print_prefix, err)
+}
+
+// probe_namespace publishes a namespace_check event and waits for its echo.
+func (p *RuntimeAPIProxy) probe_namespace(ctx context.Context) namespace_echo {
+	check_ctx, cancel := context.WithTimeout(ctx, namespace_check_timeout)
+	defer cancel()
+
+	nonce := new_sandbox_id()
+	echoes := make(chan string, 1)
+	var once sync.Once
+	subscription, err := p.transport.Subscribe(check_ctx, p.lifecycle_topic(), func(data_payload interface{}) {
+		frame, err := decode_channel_payload(data_payload)
+		if err != nil {
+			return
+		}
+		if namespace, ok := parse_namespace_echo(frame, p.sandbox_id, nonce); ok {
+			once.Do(func() { echoes <- namespace })
+		}
+	})
+	if err != nil {
+		log.Printf("%s Error subscribing to %s: %v", namespace_print_prefix, p.lifecycle_topic(), err)
+		return namespace_echo{}
+	}
+	if subscription != nil {
+		defer subscription.Unsubscribe()
+	}
+
+	if err := p.publish_lifecycle_event(check_ctx, namespace_check_type, map[string]interface{}{
+		"nonce":    nonce,
+		"expected": p.namespace(),
+	}); err != nil {
+		return namespace_echo{}
+	}
+
+	select {
+	case namespace := <-echoes:
+		return namespace_echo{received: true, namespace: namespace}
+	case <-check_ctx.Done():
+		return namespace_echo{}
+	}
+}
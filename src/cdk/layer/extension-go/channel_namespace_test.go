@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// stamp_namespace stamps namespace_check events with namespace on their way
+// through the Events API, the way the generated onPublish handler does. An
+// empty namespace stands for a namespace without handlers.
+func stamp_namespace(namespace string) func(channel string, event json.RawMessage) json.RawMessage {
+	return func(channel string, event json.RawMessage) json.RawMessage {
+		var echoed map[string]interface{}
+		if namespace == "" || json.Unmarshal(event, &echoed) != nil {
+			return event
+		}
+		data, ok := echoed["data"].(map[string]interface{})
+		if !ok || echoed["type"] != namespace_check_type {
+			return event
+		}
+		data["namespace"] = namespace
+		stamped, _ := json.Marshal(echoed)
+		return stamped
+	}
+}
+
+// new_namespace_proxy returns an unconnected proxy for the orders function
+// whose channels are in namespace.
+func new_namespace_proxy(namespace string) *RuntimeAPIProxy {
+	settings := default_config()
+	settings.AppSyncNamespace = namespace
+	return &RuntimeAPIProxy{
+		ctx:           context.Background(),
+		sandbox_id:    "sandbox-1",
+		function_name: "orders",
+		interception:  new_interception_switch(),
+		config:        settings,
+	}
+}
+
+func TestChannelsUseConfiguredNamespace(t *testing.T) {
+	proxy := new_namespace_proxy("live-lambda-dev")
+	if proxy.requests_topic() != "live-lambda-dev/requests" || proxy.presence_topic() != "live-lambda-dev/presence/orders" {
+		t.Fatalf("unexpected channels %s, %s", proxy.requests_topic(), proxy.presence_topic())
+	}
+	if (&RuntimeAPIProxy{}).response_topic("req-1") != "live-lambda/response/req-1" {
+		t.Fatal("expected the default namespace without configuration")
+	}
+}
+
+func TestChannelScope(t *testing.T) {
+	values := Config{FunctionName: "orders_api", FunctionVersion: "$LATEST", DeveloperID: "alice"}.channel_scope_values()
+	for _, c := range []struct {
+		template, scope string
+	}{
+		{"", ""},
+		{"{function}/{dev}", "orders-api/alice"},
+		{"/{function}-{version}/", "orders-api-LATEST"},
+		{"team-a/{dev}", "team-a/alice"},
+	} {
+		if scope, err := render_channel_scope(c.template, values); err != nil || scope != c.scope {
+			t.Errorf("render_channel_scope(%q) = %q, %v; expected %q", c.template, scope, err, c.scope)
+		}
+	}
+	for _, template := range []string{"{function}/{version}/{dev}", "{alias}", "{function}.{dev}", "{dev}//x"} {
+		if _, err := render_channel_scope(template, values); err == nil {
+			t.Errorf("expected %q to be rejected", template)
+		}
+	}
+	if _, err := render_channel_scope("{dev}", Config{}.channel_scope_values()); err == nil {
+		t.Error("expected {dev} without a developer ID to be rejected")
+	}
+
+	proxy := new_namespace_proxy("live-lambda-dev")
+	proxy.channel_scope = "orders/alice"
+	if proxy.requests_topic() != "live-lambda-dev/orders/alice/requests" || proxy.response_topic("req-1") != "live-lambda-dev/orders/alice/response/req-1" {
+		t.Fatalf("unexpected channels %s, %s", proxy.requests_topic(), proxy.response_topic("req-1"))
+	}
+}
+
+func TestVerifyNamespace(t *testing.T) {
+	cases := []struct {
+		name      string
+		stamped   string
+		mode      string
+		intercept bool
+	}{
+		{name: "matching namespace", stamped: "live-lambda-dev", mode: namespace_check_enforce, intercept: true},
+		{name: "other stage", stamped: "live-lambda-prod", mode: namespace_check_enforce, intercept: false},
+		{name: "namespace without handlers", stamped: "", mode: namespace_check_enforce, intercept: false},
+		{name: "warn only", stamped: "live-lambda-prod", mode: namespace_check_warn, intercept: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := new_events_server(t)
+			server.HandlePublish(stamp_namespace(tc.stamped))
+			proxy := new_events_proxy(t, server, func(settings *Config) {
+				settings.AppSyncNamespace = "live-lambda-dev"
+				settings.NamespaceCheck = tc.mode
+			})
+			proxy.verify_namespace(proxy.ctx)
+			if enabled, reason := proxy.interception.enabled(); enabled != tc.intercept {
+				t.Fatalf("expected interception %v, got %v (%s)", tc.intercept, enabled, reason)
+			}
+		})
+	}
+}
+
+func TestCheckNamespaceEcho(t *testing.T) {
+	if err := check_namespace_echo("live-lambda-dev", namespace_echo{}); err == nil || !strings.Contains(err.Error(), "no namespace_check echo") {
+		t.Fatalf("expected a missing echo to be reported, got %v", err)
+	}
+	if err := check_namespace_echo("live-lambda-dev", namespace_echo{received: true, namespace: "live-lambda-qa"}); err == nil || !strings.Contains(err.Error(), "live-lambda-qa") {
+		t.Fatalf("expected the namespace that answered in the error, got %v", err)
+	}
+}
+
+func TestParseNamespaceEchoIgnoresOtherSandboxes(t *testing.T) {
+	frame := []byte(`{"type":"namespace_check","sandbox_id":"sandbox-2","data":{"nonce":"n1","namespace":"live-lambda"}}`)
+	if _, ok := parse_namespace_echo(frame, "sandbox-1", "n1"); ok {
+		t.Fatal("expected another sandbox's check to be ignored")
+	}
+	if namespace, ok := parse_namespace_echo(frame, "sandbox-2", "n1"); !ok || namespace != "live-lambda" {
+		t.Fatalf("unexpected echo %q, %v", namespace, ok)
+	}
+}
+
+func TestChannelTemplates(t *testing.T) {
+	settings := default_config()
+	settings.FunctionName = "orders"
+	settings.AppSyncNamespace = "live-lambda-dev"
+	settings.ChannelScope = "{dev}"
+	settings.DeveloperID = "alice"
+	settings.RequestsChannel = "invocations/{stage}-{function}"
+	settings.ResponseChannel = "answers/{request_id}"
+	channels, err := settings.render_channel_templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := new_namespace_proxy("live-lambda-dev")
+	proxy.channel_scope = "alice"
+	proxy.channels = channels
+	if proxy.requests_topic() != "live-lambda-dev/alice/invocations/dev-orders" || proxy.response_topic("req-1") != "live-lambda-dev/alice/answers/req-1" {
+		t.Fatalf("unexpected channels %s, %s", proxy.requests_topic(), proxy.response_topic("req-1"))
+	}
+	if proxy.response_topic(response_wildcard_id) != "live-lambda-dev/alice/answers/*" {
+		t.Fatalf("expected the wildcard in place of the request ID, got %s", proxy.response_topic(response_wildcard_id))
+	}
+
+	for _, c := range []struct {
+		requests, response, message string
+	}{
+		{"{function}/requests", default_response_channel, "fixed segment"},
+		{"presence/x", default_response_channel, "another live-lambda channel"},
+		{"requests/{request_id}", default_response_channel, "cannot use"},
+		{"requests/{branch}", default_response_channel, "unknown placeholder"},
+		{default_requests_channel, "answers", "must end in a {request_id} segment"},
+		{default_requests_channel, "answers/{request_id}/x", "must end in a {request_id} segment"},
+		{default_requests_channel, "answers/req-{request_id}", "must end in a {request_id} segment"},
+		{default_requests_channel, "a/b/c/{request_id}", "at most 5"},
+		{"answers", "answers/{request_id}", "different segments"},
+	} {
+		settings.RequestsChannel, settings.ResponseChannel = c.requests, c.response
+		if _, err := settings.render_channel_templates(); err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("expected %q and %q to fail with %q, got %v", c.requests, c.response, c.message, err)
+		}
+	}
+
+	settings.AppSyncNamespace = default_channel_namespace
+	settings.RequestsChannel, settings.ResponseChannel = "requests/{stage}", default_response_channel
+	if _, err := settings.render_channel_templates(); err == nil || !strings.Contains(err.Error(), "has no value") {
+		t.Errorf("expected {stage} outside a stage namespace to fail, got %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Chunk protocol
+//
+// A payload too large for a single AppSync event is sent as a series of "chunk"
+// frames sharing a transfer_id. Each frame carries its zero-based seq, the total
+// number of chunks, and the SHA-256 of the complete payload. AppSync delivers at
+// least once and in no particular order, so the receiver:
+//
+//   - accepts chunks in any order and buffers them until all seqs are present,
+//   - drops exact duplicates (same transfer_id and seq), including late
+//     duplicates that arrive after the transfer completed,
+//   - rejects frames whose total or checksum disagree with earlier frames,
+//   - verifies the checksum over the reassembled payload, and
+//   - discards transfers that do not complete within the reassembly timeout.
+//
+// When a transfer stalls with chunks missing, the receiver asks the sender for
+// them with a "chunk_retransmit" frame listing the missing seqs. The transfer_id
+// of an invocation's request or response is its request ID; the extension sends
+// retransmit requests on the requests channel and the agent sends them on the
+// invocation's response channel. The extension reassembles a response under
+// the idempotency key of the attempt it answers (see idempotency.go), so the
+// response to a retried invocation is not dropped as a late duplicate of the
+// first attempt's.
+
+const (
+	chunk_frame_type                 = protocol.TypeChunk
+	chunk_retransmit_frame_type      = "chunk_retransmit"
+	default_chunk_reassembly_timeout = 30 * time.Second
+	default_chunk_retransmit_after   = 2 * time.Second
+	completed_transfer_retention     = 2 * time.Minute
+	// Raw bytes per chunk; base64 keeps each frame under the 240KB AppSync event limit
+	default_chunk_size = 150 * 1024
+	// Request envelopes larger than this are sent as chunks
+	max_inline_event_bytes = 200 * 1024
+)
+
+// payload_checksum returns the hex SHA-256 used in chunk frames.
+func payload_checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// split_into_chunks splits payload into frames of at most chunk_size raw bytes.
+// An empty payload produces a single empty chunk.
+func split_into_chunks(transfer_id string, payload []byte, chunk_size int) []protocol.Chunk {
+	if chunk_size <= 0 {
+		chunk_size = len(payload)
+	}
+	total := 1
+	if len(payload) > 0 && chunk_size > 0 {
+		total = (len(payload) + chunk_size - 1) / chunk_size
+	}
+	checksum := payload_checksum(payload)
+
+	chunks := make([]protocol.Chunk, 0, total)
+	for seq := 0; seq < total; seq++ {
+		start := seq * chunk_size
+		end := start + chunk_size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunks = append(chunks, protocol.Chunk{
+			Type:       chunk_frame_type,
+			TransferID: transfer_id,
+			Seq:        seq,
+			Total:      total,
+			Checksum:   checksum,
+			Data:       base64.StdEncoding.EncodeToString(payload[start:end]),
+		})
+	}
+	return chunks
+}
+
+// chunk_retransmit_request asks the sender of a transfer to publish seqs again.
+type chunk_retransmit_request struct {
+	Type       string `json:"type"`
+	RequestID  string `json:"request_id,omitempty"`
+	TransferID string `json:"transfer_id"`
+	Seqs       []int  `json:"seqs"`
+	// IdempotencyKey is set on the extension's requests; see idempotency.go
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// parse_chunk_retransmit decodes a frame if it is a retransmit request; ok is false for other frames.
+func parse_chunk_retransmit(frame json.RawMessage) (request chunk_retransmit_request, ok bool, err error) {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &probe) != nil || probe.Type != chunk_retransmit_frame_type {
+		return chunk_retransmit_request{}, false, nil
+	}
+	if err := json.Unmarshal(frame, &request); err != nil {
+		return chunk_retransmit_request{}, true, fmt.Errorf("malformed chunk_retransmit frame: %w", err)
+	}
+	return request, true, nil
+}
+
+// select_chunks returns the chunks with the given seqs, ignoring unknown seqs.
+func select_chunks(chunks []protocol.Chunk, seqs []int) []protocol.Chunk {
+	var selected []protocol.Chunk
+	for _, seq := range seqs {
+		if seq >= 0 && seq < len(chunks) {
+			selected = append(selected, chunks[seq])
+		}
+	}
+	return selected
+}
+
+// parse_chunk_frame decodes a frame if it is a chunk; ok is false for other frames.
+func parse_chunk_frame(frame json.RawMessage) (chunk protocol.Chunk, ok bool, err error) {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &probe) != nil || probe.Type != chunk_frame_type {
+		return protocol.Chunk{}, false, nil
+	}
+	if err := json.Unmarshal(frame, &chunk); err != nil {
+		return protocol.Chunk{}, true, fmt.Errorf("malformed chunk frame: %w", err)
+	}
+	return chunk, true, nil
+}
+
+type pending_transfer struct {
+	total         int
+	checksum      string
+	parts         map[int][]byte
+	started_at    time.Time
+	last_chunk_at time.Time
+}
+
+// chunk_reassembler keeps transfers under a key the caller chooses, so that
+// two transfers with the same transfer_id can be told apart.
+type chunk_reassembler struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	pending   map[string]*pending_transfer // by key
+	completed map[string]time.Time         // by key
+	now       func() time.Time
+}
+
+func new_chunk_reassembler(timeout time.Duration) *chunk_reassembler {
+	if timeout <= 0 {
+		timeout = default_chunk_reassembly_timeout
+	}
+	return &chunk_reassembler{
+		timeout:   timeout,
+		pending:   map[string]*pending_transfer{},
+		completed: map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+// add records a chunk of the transfer kept under key. It returns the full
+// payload once the last missing chunk arrives; complete is false while chunks
+// are outstanding or for duplicates.
+func (r *chunk_reassembler) add(key string, chunk protocol.Chunk) (payload []byte, complete bool, err error) {
+	if err := chunk.Validate(); err != nil {
+		return nil, false, err
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		return nil, false, fmt.Errorf("chunk %d of transfer %s has invalid data: %w", chunk.Seq, chunk.TransferID, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.expire_locked(now)
+
+	if _, done := r.completed[key]; done {
+		return nil, false, nil
+	}
+
+	transfer, ok := r.pending[key]
+	if !ok {
+		transfer = &pending_transfer{
+			total:      chunk.Total,
+			checksum:   chunk.Checksum,
+			parts:      map[int][]byte{},
+			started_at: now,
+		}
+		r.pending[key] = transfer
+	}
+	if transfer.total != chunk.Total || transfer.checksum != chunk.Checksum {
+		return nil, false, fmt.Errorf("chunk %d of transfer %s disagrees with earlier chunks (total %d vs %d)", chunk.Seq, chunk.TransferID, chunk.Total, transfer.total)
+	}
+	if existing, seen := transfer.parts[chunk.Seq]; seen {
+		if !bytes.Equal(existing, data) {
+			return nil, false, fmt.Errorf("duplicate chunk %d of transfer %s has different data", chunk.Seq, chunk.TransferID)
+		}
+		return nil, false, nil
+	}
+	transfer.parts[chunk.Seq] = data
+	transfer.last_chunk_at = now
+	if len(transfer.parts) < transfer.total {
+		return nil, false, nil
+	}
+
+	delete(r.pending, key)
+	var assembled bytes.Buffer
+	for seq := 0; seq < transfer.total; seq++ {
+		assembled.Write(transfer.parts[seq])
+	}
+	if payload_checksum(assembled.Bytes()) != transfer.checksum {
+		return nil, false, fmt.Errorf("checksum mismatch for transfer %s", chunk.TransferID)
+	}
+	r.completed[key] = now
+	return assembled.Bytes(), true, nil
+}
+
+// discard drops a pending transfer and treats it as completed, so that its
+// late chunks are ignored.
+func (r *chunk_reassembler) discard(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, key)
+	r.completed[key] = r.now()
+}
+
+// missing returns the seqs not yet received for a pending transfer.
+func (r *chunk_reassembler) missing(key string) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transfer, ok := r.pending[key]
+	if !ok {
+		return nil
+	}
+	var seqs []int
+	for seq := 0; seq < transfer.total; seq++ {
+		if _, seen := transfer.parts[seq]; !seen {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs
+}
+
+// stalled returns the missing seqs of a transfer that has received no chunk for
+// at least quiet. The quiet period restarts, so the next call only reports the
+// transfer again after another quiet period.
+func (r *chunk_reassembler) stalled(key string, quiet time.Duration) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transfer, ok := r.pending[key]
+	now := r.now()
+	if !ok || now.Sub(transfer.last_chunk_at) < quiet {
+		return nil
+	}
+	transfer.last_chunk_at = now
+	var seqs []int
+	for seq := 0; seq < transfer.total; seq++ {
+		if _, seen := transfer.parts[seq]; !seen {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs
+}
+
+// expire drops transfers that exceeded the reassembly timeout and returns their keys.
+func (r *chunk_reassembler) expire() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expire_locked(r.now())
+}
+
+func (r *chunk_reassembler) expire_locked(now time.Time) []string {
+	var expired []string
+	for id, transfer := range r.pending {
+		if now.Sub(transfer.started_at) > r.timeout {
+			expired = append(expired, id)
+			delete(r.pending, id)
+		}
+	}
+	for id, completed_at := range r.completed {
+		if now.Sub(completed_at) > completed_transfer_retention {
+			delete(r.completed, id)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// retransmit_interval is how long a chunked transfer may stall before missing
+// chunks are requested again.
+func (p *RuntimeAPIProxy) retransmit_interval() time.Duration {
+	if p.retransmit_after <= 0 {
+		return default_chunk_retransmit_after
+	}
+	return p.retransmit_after
+}
+
+func (p *RuntimeAPIProxy) outgoing_chunk_size() int {
+	if p.chunk_size <= 0 {
+		return default_chunk_size
+	}
+	return p.chunk_size
+}
+
+// publish_chunked publishes an invocation's request envelope as chunk frames and
+// keeps them on the request for retransmission.
+func (p *RuntimeAPIProxy) publish_chunked(ctx context.Context, topic string, request *pending_request, payload []byte) error {
+	chunks := split_into_chunks(request.request_id, payload, p.outgoing_chunk_size())
+	request.set_sent_chunks(chunks)
+	transport := p.request_transport(request.request_id)
+	for _, chunk := range chunks {
+		if err := transport.Publish(ctx, topic, []interface{}{chunk}); err != nil {
+			return fmt.Errorf("failed to publish chunk %d of %d: %w", chunk.Seq, chunk.Total, err)
+		}
+	}
+	request_logger(request.request_id).Info("Published the request in chunks", "chunks", len(chunks))
+	return nil
+}
+
+// resend_chunks publishes the requested chunks of request's envelope again.
+func (p *RuntimeAPIProxy) resend_chunks(request *pending_request, seqs []int) {
+	chunks := request.chunks_to_resend(seqs)
+	if len(chunks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
+	defer cancel()
+	transport := p.request_transport(request.request_id)
+	for _, chunk := range chunks {
+		if err := transport.Publish(ctx, p.request_topic(request.request_id), []interface{}{chunk}); err != nil {
+			request_logger(request.request_id).Warn("Error retransmitting a chunk", "seq", chunk.Seq, "error", err)
+			return
+		}
+	}
+	request_logger(request.request_id).Info("Retransmitted chunks", "chunks", len(chunks))
+}
+
+// transfer_key is the key request_id's response is reassembled under: the
+// idempotency key of the attempt in flight, or the request ID when it is not
+// tracked.
+func (p *RuntimeAPIProxy) transfer_key(request_id string) string {
+	if request, ok := p.requests.lookup(request_id); ok {
+		return request.idempotency_key()
+	}
+	return request_id
+}
+
+// request_missing_chunks asks the agent to resend response chunks when the
+// response for request_id has stalled part way.
+func (p *RuntimeAPIProxy) request_missing_chunks(request_id string) {
+	seqs := p.chunks.stalled(p.transfer_key(request_id), p.retransmit_interval())
+	if len(seqs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+	defer cancel()
+	request := chunk_retransmit_request{
+		Type:       chunk_retransmit_frame_type,
+		RequestID:  request_id,
+		TransferID: request_id,
+		Seqs:       seqs,
+	}
+	if pending, ok := p.requests.lookup(request_id); ok {
+		request.IdempotencyKey = pending.idempotency_key()
+	}
+	if err := p.request_transport(request_id).Publish(ctx, p.request_topic(request_id), []interface{}{request}); err != nil {
+		request_logger(request_id).Warn("Error requesting missing chunks", "chunks", len(seqs), "error", err)
+		return
+	}
+	request_logger(request_id).Info("Requested missing chunks", "chunks", len(seqs))
+}
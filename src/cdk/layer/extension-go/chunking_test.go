@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// deliver shuffles chunks and duplicates some of them, mimicking at-least-once,
+// unordered delivery over AppSync.
+func deliver(chunks []protocol.Chunk, random *rand.Rand) []protocol.Chunk {
+	delivered := append([]protocol.Chunk{}, chunks...)
+	for _, chunk := range chunks {
+		if random.Intn(3) == 0 {
+			delivered = append(delivered, chunk)
+		}
+	}
+	random.Shuffle(len(delivered), func(i, j int) { delivered[i], delivered[j] = delivered[j], delivered[i] })
+	return delivered
+}
+
+func TestChunkRoundTripProperty(t *testing.T) {
+	property := func(payload []byte, chunk_size uint8, seed int64) bool {
+		size := int(chunk_size%64) + 1
+		chunks := split_into_chunks("transfer", payload, size)
+		reassembler := new_chunk_reassembler(time.Minute)
+
+		completions := 0
+		var result []byte
+		for _, chunk := range deliver(chunks, rand.New(rand.NewSource(seed))) {
+			assembled, complete, err := reassembler.add("transfer", chunk)
+			if err != nil {
+				t.Logf("unexpected error: %v", err)
+				return false
+			}
+			if complete {
+				completions++
+				result = assembled
+			}
+		}
+		return completions == 1 && bytes.Equal(result, payload)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChunkSplitProperty(t *testing.T) {
+	property := func(payload []byte, chunk_size uint8) bool {
+		size := int(chunk_size%64) + 1
+		chunks := split_into_chunks("transfer", payload, size)
+		for seq, chunk := range chunks {
+			if chunk.Seq != seq || chunk.Total != len(chunks) || chunk.Checksum != payload_checksum(payload) {
+				return false
+			}
+			if chunk.Validate() != nil {
+				return false
+			}
+		}
+		return len(chunks) >= 1
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChunkReassemblerInterleavedTransfers(t *testing.T) {
+	reassembler := new_chunk_reassembler(time.Minute)
+	first := split_into_chunks("a", []byte("first payload"), 4)
+	second := split_into_chunks("b", []byte("second payload"), 3)
+
+	results := map[string]string{}
+	for i := 0; i < len(first) || i < len(second); i++ {
+		for _, chunks := range [][]protocol.Chunk{first, second} {
+			if i >= len(chunks) {
+				continue
+			}
+			payload, complete, err := reassembler.add(chunks[i].TransferID, chunks[i])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if complete {
+				results[chunks[i].TransferID] = string(payload)
+			}
+		}
+	}
+	if results["a"] != "first payload" || results["b"] != "second payload" {
+		t.Fatalf("unexpected results %v", results)
+	}
+}
+
+func TestChunkReassemblerRejectsInconsistentChunks(t *testing.T) {
+	reassembler := new_chunk_reassembler(time.Minute)
+	chunks := split_into_chunks("t", []byte("abcdef"), 2)
+	if _, _, err := reassembler.add("t", chunks[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wrong_total := chunks[1]
+	wrong_total.Total = 5
+	if _, _, err := reassembler.add("t", wrong_total); err == nil {
+		t.Error("expected a chunk with a different total to be rejected")
+	}
+
+	tampered := chunks[0]
+	tampered.Data = "eHg="
+	if _, _, err := reassembler.add("t", tampered); err == nil {
+		t.Error("expected a duplicate with different data to be rejected")
+	}
+
+	out_of_range := chunks[1]
+	out_of_range.Seq = 3
+	if _, _, err := reassembler.add("t", out_of_range); err == nil {
+		t.Error("expected a seq outside the total to be rejected")
+	}
+}
+
+func TestChunkReassemblerDetectsChecksumMismatch(t *testing.T) {
+	reassembler := new_chunk_reassembler(time.Minute)
+	chunks := split_into_chunks("t", []byte("abcdef"), 3)
+	forged := split_into_chunks("t", []byte("abcxyz"), 3)
+	forged[1].Checksum = chunks[1].Checksum
+
+	if _, _, err := reassembler.add("t", chunks[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := reassembler.add("t", forged[1]); err == nil {
+		t.Fatal("expected checksum mismatch to be reported")
+	}
+}
+
+func TestChunkReassemblerTimeoutAndMissing(t *testing.T) {
+	now := time.Unix(0, 0)
+	reassembler := new_chunk_reassembler(10 * time.Second)
+	reassembler.now = func() time.Time { return now }
+
+	chunks := split_into_chunks("slow", []byte("0123456789"), 2)
+	reassembler.add("slow", chunks[0])
+	reassembler.add("slow", chunks[3])
+
+	if missing := reassembler.missing("slow"); len(missing) != 3 || missing[0] != 1 || missing[1] != 2 || missing[2] != 4 {
+		t.Fatalf("unexpected missing seqs %v", missing)
+	}
+
+	now = now.Add(11 * time.Second)
+	if expired := reassembler.expire(); len(expired) != 1 || expired[0] != "slow" {
+		t.Fatalf("expected transfer to expire, got %v", expired)
+	}
+	if missing := reassembler.missing("slow"); missing != nil {
+		t.Fatalf("expected expired transfer to be forgotten, got %v", missing)
+	}
+}
+
+func TestChunkReassemblerIgnoresLateDuplicates(t *testing.T) {
+	reassembler := new_chunk_reassembler(time.Minute)
+	chunks := split_into_chunks("done", []byte("payload"), 4)
+	for _, chunk := range chunks {
+		reassembler.add("done", chunk)
+	}
+	if _, complete, err := reassembler.add("done", chunks[0]); complete || err != nil {
+		t.Fatalf("expected late duplicate to be ignored, got complete=%v err=%v", complete, err)
+	}
+}
+
+func TestChunkReassemblerKeepsAttemptsApart(t *testing.T) {
+	reassembler := new_chunk_reassembler(time.Minute)
+	// Lambda retried req-1, so both responses share the transfer ID
+	first := split_into_chunks("req-1", []byte("first attempt"), 4)
+	second := split_into_chunks("req-1", []byte("second attempt"), 4)
+	for _, chunk := range first {
+		reassembler.add(idempotency_key("req-1", 1), chunk)
+	}
+
+	var result []byte
+	for _, chunk := range second {
+		if payload, complete, err := reassembler.add(idempotency_key("req-1", 2), chunk); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if complete {
+			result = payload
+		}
+	}
+	if string(result) != "second attempt" {
+		t.Fatalf("expected the retry to be reassembled, got %q", result)
+	}
+}
+
+func TestParseChunkFrame(t *testing.T) {
+	frame, _ := json.Marshal(split_into_chunks("t", []byte("x"), 1)[0])
+	if _, ok, err := parse_chunk_frame(frame); !ok || err != nil {
+		t.Fatalf("expected chunk frame to be parsed, got ok=%v err=%v", ok, err)
+	}
+	if _, ok, _ := parse_chunk_frame([]byte(`{"statusCode":200}`)); ok {
+		t.Fatal("expected a plain response not to be treated as a chunk")
+	}
+}
+
+func TestChunkReassemblerStalled(t *testing.T) {
+	now := time.Unix(0, 0)
+	reassembler := new_chunk_reassembler(time.Minute)
+	reassembler.now = func() time.Time { return now }
+
+	chunks := split_into_chunks("stall", []byte("0123456789"), 4)
+	reassembler.add("stall", chunks[1])
+
+	now = now.Add(time.Second)
+	if seqs := reassembler.stalled("stall", 2*time.Second); seqs != nil {
+		t.Fatalf("expected no retransmit before the quiet period, got %v", seqs)
+	}
+	now = now.Add(time.Second)
+	if seqs := reassembler.stalled("stall", 2*time.Second); len(seqs) != 2 || seqs[0] != 0 || seqs[1] != 2 {
+		t.Fatalf("unexpected stalled seqs %v", seqs)
+	}
+	if seqs := reassembler.stalled("stall", 2*time.Second); seqs != nil {
+		t.Fatalf("expected the quiet period to restart, got %v", seqs)
+	}
+	if seqs := reassembler.stalled("unknown", 0); seqs != nil {
+		t.Fatalf("expected no seqs for an unknown transfer, got %v", seqs)
+	}
+}
+
+func TestParseChunkRetransmitAndSelect(t *testing.T) {
+	frame := []byte(`{"type":"chunk_retransmit","request_id":"r","transfer_id":"r","seqs":[2,0,9]}`)
+	request, ok, err := parse_chunk_retransmit(frame)
+	if !ok || err != nil {
+		t.Fatalf("expected retransmit frame to be parsed, got ok=%v err=%v", ok, err)
+	}
+	chunks := split_into_chunks("r", []byte("abcdefg"), 3)
+	selected := select_chunks(chunks, request.Seqs)
+	if len(selected) != 2 || selected[0].Seq != 2 || selected[1].Seq != 0 {
+		t.Fatalf("unexpected selected chunks %+v", selected)
+	}
+	if _, ok, _ := parse_chunk_retransmit([]byte(`{"type":"chunk"}`)); ok {
+		t.Fatal("expected a chunk frame not to be treated as a retransmit request")
+	}
+}
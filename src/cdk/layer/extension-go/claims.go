@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Invocation claims
+//
+// Every agent subscribed to a function's requests channel receives every
+// request, so two developers serving the same channel would both run each
+// invocation. When the present agent announces the claims capability, the
+// extension first offers the invocation on the requests channel:
+//
+//	{"type": "invocation_offer", "request_id": "...", "function_name": "...", "sandbox_id": "..."}
+//
+// Agents that want it answer on the invocation's response channel:
+//
+//	{"type": "claim", "request_id": "...", "agent_id": "..."}
+//
+// The first claim wins the lease. The extension announces the winner on the
+// response channel, so the other claimants stop waiting,
+//
+//	{"type": "lease_granted", "request_id": "...", "agent_id": "..."}
+//
+// and publishes the request only on the winner's private channel,
+// agents/{agent_id}. Chunks and retransmit requests for the invocation follow
+// it there. When no claim arrives within LIVE_LAMBDA_CLAIM_WINDOW, the request
+// is published on the requests channel as before, so agents without claims
+// still receive it. LIVE_LAMBDA_CLAIM_WINDOW=off never offers.
+
+const (
+	default_claim_window       = 500 * time.Millisecond
+	invocation_offer_type      = "invocation_offer"
+	claim_frame_type           = "claim"
+	lease_granted_frame_type   = "lease_granted"
+	lease_announcement_timeout = 5 * time.Second
+)
+
+// is_lease_announcement reports whether frame is the extension's own lease_granted frame.
+func is_lease_announcement(frame []byte) bool {
+	var announcement struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(frame, &announcement) == nil && announcement.Type == lease_granted_frame_type
+}
+
+// parse_claim returns the agent a claim frame is from; ok is false for other
+// frames and for agent IDs that cannot name a channel.
+func parse_claim(frame []byte) (agent_id string, ok bool) {
+	var claim struct {
+		Type    string `json:"type"`
+		AgentID string `json:"agent_id"`
+	}
+	if json.Unmarshal(frame, &claim) != nil || claim.Type != claim_frame_type {
+		return "", false
+	}
+	if !valid_channel_namespace(claim.AgentID) {
+		return "", false
+	}
+	return claim.AgentID, true
+}
+
+// open_offer starts taking claims for the request. The returned channel is
+// closed when one is granted.
+func (r *pending_request) open_offer() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.offer_open = true
+	r.leased = make(chan struct{})
+	return r.leased
+}
+
+// claim grants the lease to agent_id if the offer is open and nobody holds it.
+func (r *pending_request) claim(agent_id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.offer_open || r.lease != "" {
+		return false
+	}
+	r.lease = agent_id
+	r.offer_open = false
+	close(r.leased)
+	return true
+}
+
+// close_offer stops taking claims and returns the lease holder, if a claim won
+// before the offer closed.
+func (r *pending_request) close_offer() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.offer_open = false
+	return r.lease
+}
+
+// lease_holder returns the agent holding the request's lease, or "".
+func (r *pending_request) lease_holder() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lease
+}
+
+// agent_topic returns an agent's private channel.
+func (p *RuntimeAPIProxy) agent_topic(agent_id string) string {
+	return p.channel("agents/%s", agent_id)
+}
+
+// request_topic returns the channel the request for request_id goes out on:
+// the lease holder's private channel, or the requests channel.
+func (p *RuntimeAPIProxy) request_topic(request_id string) string {
+	if request, ok := p.requests.lookup(request_id); ok {
+		if agent_id := request.lease_holder(); agent_id != "" {
+			return p.agent_topic(agent_id)
+		}
+	}
+	return p.requests_topic()
+}
+
+// offer_invocation offers the request to the agents and waits for a claim, up
+// to the claim window. ok is false when no agent claimed it, or offers are off
+// or not supported by the present agent; the request then goes out on the
+// requests channel.
+func (p *RuntimeAPIProxy) offer_invocation(ctx context.Context, request *pending_request) (agent_id string, ok bool) {
+	if p.config.ClaimWindow <= 0 || !p.presence.supports(capability_claims) {
+		return "", false
+	}
+	request_id := request.request_id
+	logger := request_logger(request_id)
+	leased := request.open_offer()
+	offer := map[string]interface{}{
+		"type":                invocation_offer_type,
+		"request_id":          request_id,
+		"function_name":       p.function_name,
+		"sandbox_id":          p.sandbox_id,
+		idempotency_key_field: request.idempotency_key(),
+	}
+	add_protocol_envelope(offer)
+	p.add_function_metadata(offer)
+	offered_at := time.Now()
+	if err := p.request_transport(request_id).Publish(ctx, p.requests_topic(), []interface{}{offer}); err != nil {
+		request.close_offer()
+		logger.Warn("Could not offer the invocation, publishing it to every agent", "error", err)
+		return "", false
+	}
+
+	timer := time.NewTimer(p.config.ClaimWindow)
+	defer timer.Stop()
+	select {
+	case <-leased:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	agent_id = request.close_offer()
+	if agent_id == "" {
+		p.explain(request_id, "unclaimed", "no claim within %s", p.config.ClaimWindow)
+		logger.Info("No agent claimed the invocation, publishing it to every agent", "window", p.config.ClaimWindow)
+		return "", false
+	}
+	p.explain(request_id, "claimed", "by agent %s after %s", agent_id, time.Since(offered_at).Round(time.Millisecond))
+	p.announce_lease(ctx, request_id, agent_id)
+	return agent_id, true
+}
+
+// announce_lease tells every claimant which agent won the invocation.
+func (p *RuntimeAPIProxy) announce_lease(ctx context.Context, request_id string, agent_id string) {
+	publish_ctx, cancel := context.WithTimeout(ctx, lease_announcement_timeout)
+	defer cancel()
+	granted := map[string]interface{}{
+		"type":       lease_granted_frame_type,
+		"request_id": request_id,
+		"agent_id":   agent_id,
+	}
+	p.add_idempotency_key(granted, request_id)
+	if err := p.request_transport(request_id).Publish(publish_ctx, p.response_topic(request_id), []interface{}{granted}); err != nil {
+		request_logger(request_id).Warn("Could not announce the lease", "agent_id", agent_id, "error", err)
+	}
+}
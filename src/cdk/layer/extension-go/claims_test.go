@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// new_claims_proxy connects a proxy with a claim window to server, where an
+// agent with capabilities is heard, and registers req-1 with its response
+// channel subscribed. Every invocation offer is answered with a claim from
+// each agent in claimants, in order, the way agents sharing a channel would.
+func new_claims_proxy(t *testing.T, server *eventstest.Server, claimants []string, capabilities ...string) (*RuntimeAPIProxy, *pending_request) {
+	t.Helper()
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.ClaimWindow = 200 * time.Millisecond })
+	server.OnPublish(func(channel string, event json.RawMessage) {
+		var offer struct {
+			Type      string `json:"type"`
+			RequestID string `json:"request_id"`
+		}
+		if json.Unmarshal(event, &offer) != nil || offer.Type != invocation_offer_type {
+			return
+		}
+		go func() {
+			for _, agent_id := range claimants {
+				server.Publish(proxy.response_topic(offer.RequestID), map[string]interface{}{"type": claim_frame_type, "request_id": offer.RequestID, "agent_id": agent_id})
+			}
+		}()
+	})
+	publish_heartbeat(server, "orders", capabilities...)
+	wait_for_agent(t, proxy)
+	request, err := proxy.requests.register("req-1", []byte(`{}`), nil)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if _, err := proxy.transport.Subscribe(proxy.ctx, proxy.response_topic("req-1"), func(data interface{}) { proxy.route_agent_response("req-1", data) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	return proxy, request
+}
+
+func TestOfferInvocationLeasesToFirstClaimant(t *testing.T) {
+	server := new_events_server(t)
+	proxy, request := new_claims_proxy(t, server, []string{"agent-a", "agent-b"}, capability_claims)
+
+	agent_id, ok := proxy.offer_invocation(proxy.ctx, request)
+	if !ok || (agent_id != "agent-a" && agent_id != "agent-b") {
+		t.Fatalf("expected a lease for one of the claimants, got %q, %v", agent_id, ok)
+	}
+	if offers := wait_for_published(t, server, "live-lambda/requests", nil); len(offers) != 1 || offers[0]["type"] != invocation_offer_type || offers[0]["function_name"] != "orders" {
+		t.Fatalf("expected one offer on the requests channel, got %v", offers)
+	}
+	granted := wait_for_published(t, server, "live-lambda/response/req-1", nil)
+	if len(granted) != 1 || granted[0]["type"] != lease_granted_frame_type || granted[0]["agent_id"] != agent_id {
+		t.Fatalf("expected the lease announced on the response channel, got %v", granted)
+	}
+	if topic := proxy.request_topic("req-1"); topic != "live-lambda/agents/"+agent_id {
+		t.Fatalf("expected follow-up frames on the lease holder's channel, got %s", topic)
+	}
+	if request.claim("agent-c") {
+		t.Fatal("expected a late claim to be refused")
+	}
+}
+
+func TestOfferInvocationFallsBackWithoutClaims(t *testing.T) {
+	server := new_events_server(t)
+	proxy, request := new_claims_proxy(t, server, nil, capability_claims)
+	started := time.Now()
+	if _, ok := proxy.offer_invocation(proxy.ctx, request); ok {
+		t.Fatal("expected no lease without a claim")
+	}
+	if waited := time.Since(started); waited < proxy.config.ClaimWindow {
+		t.Fatalf("expected to wait out the claim window, waited %s", waited)
+	}
+	if request.claim("agent-a") {
+		t.Fatal("expected claims after the window to be refused")
+	}
+	if topic := proxy.request_topic("req-1"); topic != "live-lambda/requests" {
+		t.Fatalf("expected the requests channel without a lease, got %s", topic)
+	}
+	if len(server.Published("live-lambda/requests")) != 1 {
+		t.Fatal("expected the offer to have been published")
+	}
+
+	// Agents without the capability are never offered invocations
+	server = new_events_server(t)
+	proxy, request = new_claims_proxy(t, server, []string{"agent-a"}, capability_response_envelope)
+	if _, ok := proxy.offer_invocation(proxy.ctx, request); ok || len(server.Published("live-lambda/requests")) != 0 {
+		t.Fatal("expected no offer to an agent without claims")
+	}
+}
+
+func TestParseClaim(t *testing.T) {
+	if agent_id, ok := parse_claim([]byte(`{"type":"claim","request_id":"r","agent_id":"go-agent-1"}`)); !ok || agent_id != "go-agent-1" {
+		t.Fatalf("unexpected claim %q, %v", agent_id, ok)
+	}
+	for _, frame := range []string{`{"type":"claim","agent_id":"a/b"}`, `{"type":"claim"}`, `{"type":"response","agent_id":"a"}`} {
+		if _, ok := parse_claim([]byte(frame)); ok {
+			t.Errorf("expected %s to be ignored", frame)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+)
+
+// control_commands are the admin commands the extension answers, see
+// admin_commands.go in the extension.
+var control_commands = []string{"enable_interception", "disable_interception", "set_sample_rate", "flush_cache", "run_self_checks"}
+
+type control_options struct {
+	connection.Options
+	function_name string
+	command       string
+	reason        string
+	sample_rate   float64
+	wait          time.Duration
+}
+
+// control_result is one extension's answer to an admin command.
+type control_result struct {
+	SandboxID  string                   `json:"sandbox_id"`
+	OK         bool                     `json:"ok"`
+	Error      string                   `json:"error"`
+	SampleRate *float64                 `json:"sample_rate"`
+	Flushed    *int                     `json:"flushed"`
+	Anomalies  []map[string]interface{} `json:"anomalies"`
+}
+
+func parse_control_flags(args []string) (control_options, error) {
+	var opts control_options
+	flags := flag.NewFlagSet("control", flag.ContinueOnError)
+	flags.StringVar(&opts.function_name, "function", "", "function whose extensions run the command (required)")
+	flags.StringVar(&opts.command, "command", "", "one of "+strings.Join(control_commands, ", ")+" (required)")
+	flags.StringVar(&opts.reason, "reason", "", "reason shown for disable_interception")
+	flags.Float64Var(&opts.sample_rate, "sample-rate", -1, "percent of invocations to intercept, for set_sample_rate")
+	flags.DurationVar(&opts.wait, "wait", 3*time.Second, "how long to collect answers")
+	opts.Options.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.function_name == "" || opts.command == "" {
+		return opts, fmt.Errorf("--function and --command are required")
+	}
+	known := false
+	for _, command := range control_commands {
+		known = known || command == opts.command
+	}
+	if !known {
+		return opts, fmt.Errorf("--command must be one of %s, got %q", strings.Join(control_commands, ", "), opts.command)
+	}
+	if opts.command == "set_sample_rate" && (opts.sample_rate < 0 || opts.sample_rate > 100) {
+		return opts, fmt.Errorf("set_sample_rate needs --sample-rate between 0 and 100")
+	}
+	return opts, opts.Options.Validate()
+}
+
+// control_frame returns the control frame for the command, issued at now.
+// Extensions ignore a command whose timestamp is over a minute from their clock.
+func (o control_options) control_frame(request_id string, now time.Time) map[string]interface{} {
+	frame := map[string]interface{}{"type": o.command, "request_id": request_id, "timestamp": now.UTC().Format(time.RFC3339Nano)}
+	switch o.command {
+	case "disable_interception":
+		if o.reason != "" {
+			frame["reason"] = o.reason
+		}
+	case "set_sample_rate":
+		frame["sample_rate"] = o.sample_rate
+	}
+	return frame
+}
+
+// parse_control_event extracts a result from a lifecycle event answering request_id.
+func parse_control_event(event []byte, request_id string) (control_result, bool) {
+	var envelope struct {
+		Type      string          `json:"type"`
+		SandboxID string          `json:"sandbox_id"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(event, &envelope); err != nil || envelope.Type != "command_result" {
+		return control_result{}, false
+	}
+	var data struct {
+		control_result
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(envelope.Data, &data); err != nil || data.RequestID != request_id {
+		return control_result{}, false
+	}
+	data.control_result.SandboxID = envelope.SandboxID
+	return data.control_result, true
+}
+
+// format_control renders results as a table sorted by sandbox ID.
+func format_control(command string, results []control_result) string {
+	sort.Slice(results, func(i, j int) bool { return results[i].SandboxID < results[j].SandboxID })
+
+	var out strings.Builder
+	failed := 0
+	for _, result := range results {
+		if !result.OK {
+			failed++
+		}
+	}
+	fmt.Fprintf(&out, "%s ran on %d sandbox(es), %d failed\n", command, len(results), failed)
+	if len(results) == 0 {
+		return out.String()
+	}
+
+	writer := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SANDBOX\tRESULT\tDETAIL")
+	for _, result := range results {
+		status, detail := "ok", ""
+		switch {
+		case !result.OK:
+			status, detail = "failed", result.Error
+		case result.Flushed != nil:
+			detail = fmt.Sprintf("%d response(s) flushed", *result.Flushed)
+		case result.SampleRate != nil:
+			detail = fmt.Sprintf("sampling %g%%", *result.SampleRate)
+		case result.Anomalies != nil:
+			var messages []string
+			for _, anomaly := range result.Anomalies {
+				messages = append(messages, fmt.Sprintf("%v: %v", anomaly["check"], anomaly["message"]))
+			}
+			detail = "no anomalies"
+			if len(messages) > 0 {
+				detail = strings.Join(messages, "; ")
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", result.SandboxID, status, detail)
+	}
+	writer.Flush()
+	return out.String()
+}
+
+func run_control(args []string) error {
+	opts, err := parse_control_flags(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	request_id := new_request_id()
+	var mu sync.Mutex
+	results := map[string]control_result{}
+
+	collect_ctx, cancel := context.WithTimeout(ctx, opts.wait)
+	defer cancel()
+
+	lifecycle_topic := opts.Channel(lifecycle_topic_format, opts.function_name)
+	if _, err := client.Subscribe(collect_ctx, lifecycle_topic, func(data_payload interface{}) {
+		event, err := channel_payload_bytes(data_payload)
+		if err != nil {
+			return
+		}
+		if result, ok := parse_control_event(event, request_id); ok {
+			// AppSync delivers at least once; keep one result per sandbox
+			mu.Lock()
+			results[result.SandboxID] = result
+			mu.Unlock()
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", lifecycle_topic, err)
+	}
+
+	control_topic := opts.Channel(control_topic_format, opts.function_name)
+	if err := client.Publish(collect_ctx, control_topic, []interface{}{opts.control_frame(request_id, time.Now())}); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", opts.command, err)
+	}
+
+	<-collect_ctx.Done()
+
+	mu.Lock()
+	collected := make([]control_result, 0, len(results))
+	for _, result := range results {
+		collected = append(collected, result)
+	}
+	mu.Unlock()
+	fmt.Print(format_control(opts.command, collected))
+	return nil
+}
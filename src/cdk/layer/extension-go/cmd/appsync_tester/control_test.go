@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseControlFlags(t *testing.T) {
+	common := []string{"--function", "orders", "--http-host", "a", "--realtime-host", "b", "--region", "eu-west-1"}
+	opts, err := parse_control_flags(append(common, "--command", "set_sample_rate", "--sample-rate", "10"))
+	if err != nil {
+		t.Fatalf("parse_control_flags: %v", err)
+	}
+	issued := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	if frame := opts.control_frame("r1", issued); frame["type"] != "set_sample_rate" || frame["sample_rate"] != 10.0 || frame["request_id"] != "r1" || frame["timestamp"] != "2026-01-01T12:00:00Z" {
+		t.Fatalf("unexpected frame %v", frame)
+	}
+	for _, args := range [][]string{
+		{"--command", "reboot"},
+		{"--command", "set_sample_rate"},
+		{},
+	} {
+		if _, err := parse_control_flags(append(common, args...)); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestParseControlEvent(t *testing.T) {
+	event := []byte(`{"type":"command_result","sandbox_id":"abc","data":{"request_id":"r1","command":"flush_cache","ok":true,"flushed":3}}`)
+	result, ok := parse_control_event(event, "r1")
+	if !ok || result.SandboxID != "abc" || !result.OK || result.Flushed == nil || *result.Flushed != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if _, ok := parse_control_event(event, "r2"); ok {
+		t.Fatal("answers to other commands should be ignored")
+	}
+
+	out := format_control("flush_cache", []control_result{
+		result,
+		{SandboxID: "0ab", Error: "the response cache is off"},
+	})
+	if !strings.HasPrefix(out, "flush_cache ran on 2 sandbox(es), 1 failed\n") {
+		t.Fatalf("unexpected header: %q", out)
+	}
+	if !strings.Contains(out, "3 response(s) flushed") || !strings.Contains(out, "the response cache is off") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
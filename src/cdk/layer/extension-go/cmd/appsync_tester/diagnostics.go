@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+)
+
+const reply_topic_format = "reply/%s"
+
+type diagnostics_options struct {
+	connection.Options
+	function_name string
+	wait          time.Duration
+}
+
+func parse_diagnostics_flags(args []string) (diagnostics_options, error) {
+	var opts diagnostics_options
+	flags := flag.NewFlagSet("diagnostics", flag.ContinueOnError)
+	flags.StringVar(&opts.function_name, "function", "", "function whose extensions should dump their state (required)")
+	flags.DurationVar(&opts.wait, "wait", 3*time.Second, "how long to collect dumps")
+	opts.Options.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.function_name == "" {
+		return opts, fmt.Errorf("--function is required")
+	}
+	return opts, opts.Options.Validate()
+}
+
+// parse_diagnostics_dump extracts the sandbox ID of a dump answering request_id.
+func parse_diagnostics_dump(event []byte, request_id string) (string, bool) {
+	var dump struct {
+		Type      string `json:"type"`
+		RequestID string `json:"request_id"`
+		SandboxID string `json:"sandbox_id"`
+	}
+	if err := json.Unmarshal(event, &dump); err != nil || dump.Type != "diagnostics" || dump.RequestID != request_id {
+		return "", false
+	}
+	return dump.SandboxID, true
+}
+
+func run_diagnostics(args []string) error {
+	opts, err := parse_diagnostics_flags(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	request_id := new_request_id()
+	var mu sync.Mutex
+	dumps := map[string]json.RawMessage{}
+
+	collect_ctx, cancel := context.WithTimeout(ctx, opts.wait)
+	defer cancel()
+
+	reply_topic := opts.Channel(reply_topic_format, request_id)
+	if _, err := client.Subscribe(collect_ctx, reply_topic, func(data_payload interface{}) {
+		event, err := channel_payload_bytes(data_payload)
+		if err != nil {
+			return
+		}
+		if sandbox_id, ok := parse_diagnostics_dump(event, request_id); ok {
+			// AppSync delivers at least once; keep one dump per sandbox
+			mu.Lock()
+			dumps[sandbox_id] = event
+			mu.Unlock()
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", reply_topic, err)
+	}
+
+	frame := map[string]interface{}{"type": "diagnostics", "request_id": request_id}
+	control_topic := opts.Channel(control_topic_format, opts.function_name)
+	if err := client.Publish(collect_ctx, control_topic, []interface{}{frame}); err != nil {
+		return fmt.Errorf("failed to publish diagnostics request: %w", err)
+	}
+
+	<-collect_ctx.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dumps) == 0 {
+		return fmt.Errorf("no extension of %s answered within %s", opts.function_name, opts.wait)
+	}
+	sandbox_ids := make([]string, 0, len(dumps))
+	for sandbox_id := range dumps {
+		sandbox_ids = append(sandbox_ids, sandbox_id)
+	}
+	sort.Strings(sandbox_ids)
+	collected := make([]json.RawMessage, 0, len(dumps))
+	for _, sandbox_id := range sandbox_ids {
+		collected = append(collected, dumps[sandbox_id])
+	}
+	encoded, err := json.MarshalIndent(collected, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
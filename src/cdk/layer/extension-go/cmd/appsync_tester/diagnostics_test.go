@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestParseDiagnosticsDump(t *testing.T) {
+	event := []byte(`{"type":"diagnostics","request_id":"r1","sandbox_id":"abc","goroutines":12}`)
+
+	sandbox_id, ok := parse_diagnostics_dump(event, "r1")
+	if !ok || sandbox_id != "abc" {
+		t.Fatalf("expected the dump of abc, got %q %v", sandbox_id, ok)
+	}
+	if _, ok := parse_diagnostics_dump(event, "r2"); ok {
+		t.Fatal("dumps for other requests should be ignored")
+	}
+	if _, ok := parse_diagnostics_dump([]byte(`{"type":"roster","request_id":"r1"}`), "r1"); ok {
+		t.Fatal("other frames should be ignored")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+)
+
+type explain_options struct {
+	connection.Options
+	function_name string
+	request_id    string
+	wait          time.Duration
+}
+
+// explain_trace is a sandbox's answer to an explain_request.
+type explain_trace struct {
+	SandboxID string `json:"sandbox_id"`
+	Steps     []struct {
+		At       string `json:"at"`
+		Decision string `json:"decision"`
+		Detail   string `json:"detail"`
+	} `json:"steps"`
+}
+
+func parse_explain_flags(args []string) (explain_options, error) {
+	var opts explain_options
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.StringVar(&opts.function_name, "function", "", "function that received the invocation (required)")
+	flags.StringVar(&opts.request_id, "request-id", "", "Lambda request ID of the invocation (required)")
+	flags.DurationVar(&opts.wait, "wait", 3*time.Second, "how long to wait for an answer")
+	opts.Options.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.function_name == "" || opts.request_id == "" {
+		return opts, fmt.Errorf("--function and --request-id are required")
+	}
+	return opts, opts.Options.Validate()
+}
+
+// parse_explain_event extracts the trace from a lifecycle event explaining request_id.
+func parse_explain_event(event []byte, request_id string) (explain_trace, bool) {
+	var envelope struct {
+		Type      string          `json:"type"`
+		SandboxID string          `json:"sandbox_id"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(event, &envelope); err != nil || envelope.Type != "explain" {
+		return explain_trace{}, false
+	}
+	var data struct {
+		explain_trace
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(envelope.Data, &data); err != nil || data.RequestID != request_id {
+		return explain_trace{}, false
+	}
+	data.explain_trace.SandboxID = envelope.SandboxID
+	return data.explain_trace, true
+}
+
+// format_explain renders a trace as one line per decision.
+func format_explain(request_id string, trace explain_trace) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s was handled by sandbox %s\n", request_id, trace.SandboxID)
+	writer := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "AT\tDECISION\tDETAIL")
+	for _, step := range trace.Steps {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", step.At, step.Decision, step.Detail)
+	}
+	writer.Flush()
+	return out.String()
+}
+
+func run_explain(args []string) error {
+	opts, err := parse_explain_flags(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	wait_ctx, cancel := context.WithTimeout(ctx, opts.wait)
+	defer cancel()
+
+	answers := make(chan explain_trace, 1)
+	lifecycle_topic := opts.Channel(lifecycle_topic_format, opts.function_name)
+	if _, err := client.Subscribe(wait_ctx, lifecycle_topic, func(data_payload interface{}) {
+		event, err := channel_payload_bytes(data_payload)
+		if err != nil {
+			return
+		}
+		if trace, ok := parse_explain_event(event, opts.request_id); ok {
+			select {
+			case answers <- trace:
+			default:
+			}
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", lifecycle_topic, err)
+	}
+
+	frame := map[string]interface{}{"type": "explain_request", "request_id": opts.request_id}
+	control_topic := opts.Channel(control_topic_format, opts.function_name)
+	if err := client.Publish(wait_ctx, control_topic, []interface{}{frame}); err != nil {
+		return fmt.Errorf("failed to publish explain request: %w", err)
+	}
+
+	select {
+	case trace := <-answers:
+		fmt.Print(format_explain(opts.request_id, trace))
+		return nil
+	case <-wait_ctx.Done():
+		return fmt.Errorf("no sandbox of %s answered for %s within %s; it may have been recycled, frozen or evicted from the trace buffer", opts.function_name, opts.request_id, opts.wait)
+	}
+}
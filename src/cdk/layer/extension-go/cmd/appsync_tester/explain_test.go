@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseExplainEvent(t *testing.T) {
+	event := []byte(`{"type":"explain","sandbox_id":"abc","data":{"request_id":"r1","steps":[{"at":"2025-01-01T00:00:00Z","decision":"not_intercepted","detail":"the agent is at capacity"}]}}`)
+
+	trace, ok := parse_explain_event(event, "r1")
+	if !ok {
+		t.Fatal("expected a trace")
+	}
+	if trace.SandboxID != "abc" || len(trace.Steps) != 1 || trace.Steps[0].Decision != "not_intercepted" {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+	if _, ok := parse_explain_event(event, "r2"); ok {
+		t.Fatal("traces of other requests should be ignored")
+	}
+
+	out := format_explain("r1", trace)
+	if !strings.HasPrefix(out, "r1 was handled by sandbox abc\n") || !strings.Contains(out, "the agent is at capacity") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
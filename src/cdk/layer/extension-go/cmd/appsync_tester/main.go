@@ -0,0 +1,64 @@
+// Command appsync_tester exercises a live-lambda AppSync Events API from a
+// developer machine.
+//
+// Usage:
+//
+//	appsync_tester simulate --function my-function --rps 5 --payload event.json
+//	appsync_tester roster --function my-function
+//	appsync_tester explain --function my-function --request-id <id>
+//	appsync_tester control --function my-function --command disable_interception
+//	appsync_tester diagnostics --function my-function
+//
+// The simulate subcommand behaves like a fleet of deployed extensions: it
+// publishes request envelopes on live-lambda/requests and waits for the agent's
+// responses on live-lambda/response/{request_id}, so agent developers can load
+// test and validate their local setup without deploying any Lambdas. The roster
+// subcommand asks every live extension of a function to report in, explain
+// asks for the decisions an extension took for one invocation, control
+// runs an admin command on every live extension, and diagnostics collects
+// their state.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const tester_print_prefix = "[LiveLambdaTester]"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n  simulate     Publish request envelopes like a deployed extension and consume responses\n  roster       List the live extensions of a function and whether they are claimed\n  explain      Show why an invocation was or was not sent to the agent\n  control      Run an admin command, such as disable_interception, on every live extension\n  diagnostics  Dump the connection, in-flight requests, recent errors and config of every live extension\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "simulate":
+		err = run_simulate(os.Args[2:])
+	case "roster":
+		err = run_roster(os.Args[2:])
+	case "explain":
+		err = run_explain(os.Args[2:])
+	case "control":
+		err = run_control(os.Args[2:])
+	case "diagnostics":
+		err = run_diagnostics(os.Args[2:])
+	case "-h", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "%s Unknown command %q\n\n", tester_print_prefix, os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", tester_print_prefix, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+)
+
+const (
+	control_topic_format   = "control/%s"
+	lifecycle_topic_format = "lifecycle/%s"
+)
+
+type roster_options struct {
+	connection.Options
+	function_name string
+	wait          time.Duration
+}
+
+// roster_row is one extension's answer to a roster_request.
+type roster_row struct {
+	SandboxID           string `json:"sandbox_id"`
+	FunctionVersion     string `json:"function_version"`
+	ExtensionVersion    string `json:"extension_version"`
+	Claimed             bool   `json:"claimed"`
+	InFlight            int    `json:"in_flight"`
+	InterceptionEnabled bool   `json:"interception_enabled"`
+	DisabledReason      string `json:"disabled_reason"`
+	UptimeSeconds       int64  `json:"uptime_seconds"`
+}
+
+func parse_roster_flags(args []string) (roster_options, error) {
+	var opts roster_options
+	flags := flag.NewFlagSet("roster", flag.ContinueOnError)
+	flags.StringVar(&opts.function_name, "function", "", "function whose extensions should report in (required)")
+	flags.DurationVar(&opts.wait, "wait", 3*time.Second, "how long to collect answers")
+	opts.Options.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.function_name == "" {
+		return opts, fmt.Errorf("--function is required")
+	}
+	return opts, opts.Options.Validate()
+}
+
+// parse_roster_event extracts a roster row from a lifecycle event answering request_id.
+func parse_roster_event(event []byte, request_id string) (roster_row, bool) {
+	var envelope struct {
+		Type      string          `json:"type"`
+		SandboxID string          `json:"sandbox_id"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(event, &envelope); err != nil || envelope.Type != "roster" {
+		return roster_row{}, false
+	}
+	var data struct {
+		roster_row
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(envelope.Data, &data); err != nil || data.RequestID != request_id {
+		return roster_row{}, false
+	}
+	data.roster_row.SandboxID = envelope.SandboxID
+	return data.roster_row, true
+}
+
+// format_roster renders rows as a table sorted by sandbox ID.
+func format_roster(function_name string, rows []roster_row) string {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].SandboxID < rows[j].SandboxID })
+
+	var out strings.Builder
+	claimed := 0
+	for _, row := range rows {
+		if row.Claimed {
+			claimed++
+		}
+	}
+	fmt.Fprintf(&out, "%d sandbox(es) for %s, %d claimed\n", len(rows), function_name, claimed)
+	if len(rows) == 0 {
+		return out.String()
+	}
+
+	writer := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SANDBOX\tFUNCTION VERSION\tEXTENSION\tCLAIMED\tIN FLIGHT\tINTERCEPTION\tUPTIME")
+	for _, row := range rows {
+		interception := "enabled"
+		if !row.InterceptionEnabled {
+			interception = "disabled"
+			if row.DisabledReason != "" {
+				interception += " (" + row.DisabledReason + ")"
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t%d\t%s\t%s\n",
+			row.SandboxID, row.FunctionVersion, row.ExtensionVersion, row.Claimed, row.InFlight,
+			interception, time.Duration(row.UptimeSeconds)*time.Second)
+	}
+	writer.Flush()
+	return out.String()
+}
+
+func run_roster(args []string) error {
+	opts, err := parse_roster_flags(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	request_id := new_request_id()
+	var mu sync.Mutex
+	rows := map[string]roster_row{}
+
+	collect_ctx, cancel := context.WithTimeout(ctx, opts.wait)
+	defer cancel()
+
+	lifecycle_topic := opts.Channel(lifecycle_topic_format, opts.function_name)
+	if _, err := client.Subscribe(collect_ctx, lifecycle_topic, func(data_payload interface{}) {
+		event, err := channel_payload_bytes(data_payload)
+		if err != nil {
+			return
+		}
+		if row, ok := parse_roster_event(event, request_id); ok {
+			// AppSync delivers at least once; keep one row per sandbox
+			mu.Lock()
+			rows[row.SandboxID] = row
+			mu.Unlock()
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", lifecycle_topic, err)
+	}
+
+	frame := map[string]interface{}{"type": "roster_request", "request_id": request_id}
+	control_topic := opts.Channel(control_topic_format, opts.function_name)
+	if err := client.Publish(collect_ctx, control_topic, []interface{}{frame}); err != nil {
+		return fmt.Errorf("failed to publish roster request: %w", err)
+	}
+
+	<-collect_ctx.Done()
+
+	mu.Lock()
+	collected := make([]roster_row, 0, len(rows))
+	for _, row := range rows {
+		collected = append(collected, row)
+	}
+	mu.Unlock()
+	fmt.Print(format_roster(opts.function_name, collected))
+	return nil
+}
+
+// channel_payload_bytes normalizes an AppSync event, which may arrive decoded or as a JSON string.
+func channel_payload_bytes(data_payload interface{}) ([]byte, error) {
+	if encoded, ok := data_payload.(string); ok {
+		return []byte(encoded), nil
+	}
+	return json.Marshal(data_payload)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRosterEvent(t *testing.T) {
+	event := []byte(`{"type":"roster","sandbox_id":"abc","data":{"request_id":"r1","function_version":"7","extension_version":"1.0.0","claimed":true,"in_flight":1,"interception_enabled":true,"uptime_seconds":90}}`)
+
+	row, ok := parse_roster_event(event, "r1")
+	if !ok {
+		t.Fatal("expected a roster row")
+	}
+	if row.SandboxID != "abc" || row.FunctionVersion != "7" || !row.Claimed || row.InFlight != 1 {
+		t.Fatalf("unexpected row: %+v", row)
+	}
+
+	if _, ok := parse_roster_event(event, "other"); ok {
+		t.Fatal("answers to other requests should be ignored")
+	}
+	if _, ok := parse_roster_event([]byte(`{"type":"probe","sandbox_id":"abc"}`), "r1"); ok {
+		t.Fatal("non-roster events should be ignored")
+	}
+}
+
+func TestFormatRoster(t *testing.T) {
+	out := format_roster("orders", []roster_row{
+		{SandboxID: "b", FunctionVersion: "$LATEST", InterceptionEnabled: false, DisabledReason: "tag"},
+		{SandboxID: "a", FunctionVersion: "$LATEST", Claimed: true, InFlight: 1, InterceptionEnabled: true, UptimeSeconds: 60},
+	})
+	if !strings.HasPrefix(out, "2 sandbox(es) for orders, 1 claimed\n") {
+		t.Fatalf("unexpected header: %q", out)
+	}
+	if strings.Index(out, "\na ") > strings.Index(out, "\nb ") {
+		t.Fatalf("rows should be sorted by sandbox ID:\n%s", out)
+	}
+	if !strings.Contains(out, "disabled (tag)") {
+		t.Fatalf("missing disabled reason:\n%s", out)
+	}
+
+	if out := format_roster("orders", nil); out != "0 sandbox(es) for orders, 0 claimed\n" {
+		t.Fatalf("unexpected empty roster: %q", out)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+	"live-lambda-extension-go/pkg/protocol"
+
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+type simulate_options struct {
+	connection.Options
+	function_name string
+	rps           float64
+	payload_path  string
+	count         int
+	duration      time.Duration
+	timeout       time.Duration
+	memory_mb     int
+}
+
+func parse_simulate_flags(args []string) (simulate_options, error) {
+	var opts simulate_options
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.StringVar(&opts.function_name, "function", "", "function name to report in the invocation context (required)")
+	flags.Float64Var(&opts.rps, "rps", 1, "invocations published per second")
+	flags.StringVar(&opts.payload_path, "payload", "", "path to a JSON event payload (defaults to {})")
+	flags.IntVar(&opts.count, "count", 0, "stop after this many invocations (0 = no limit)")
+	flags.DurationVar(&opts.duration, "duration", 0, "stop after this long (0 = until interrupted)")
+	flags.DurationVar(&opts.timeout, "timeout", 30*time.Second, "how long to wait for each response")
+	opts.Options.AddFlags(flags)
+	flags.IntVar(&opts.memory_mb, "memory", 128, "memory size in MB to report in the invocation context")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.function_name == "" {
+		return opts, fmt.Errorf("--function is required")
+	}
+	if opts.rps <= 0 {
+		return opts, fmt.Errorf("--rps must be greater than zero")
+	}
+	return opts, opts.Options.Validate()
+}
+
+// load_event_payload reads the event from path, or returns an empty object.
+func load_event_payload(path string) (json.RawMessage, error) {
+	if path == "" {
+		return json.RawMessage(`{}`), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payload: %w", err)
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("payload %s is not valid JSON", path)
+	}
+	return json.RawMessage(data), nil
+}
+
+func new_request_id() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	id := hex.EncodeToString(buf)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32])
+}
+
+// trace_suffix derives the 24 hex digit X-Ray trace ID suffix from a request ID.
+func trace_suffix(request_id string) string {
+	suffix := strings.ReplaceAll(request_id, "-", "")
+	for len(suffix) < 24 {
+		suffix += "0"
+	}
+	return suffix[:24]
+}
+
+// build_request_envelope builds the message an extension publishes for an invocation.
+func build_request_envelope(opts simulate_options, request_id string, event json.RawMessage, now time.Time) protocol.Request {
+	account_id := "000000000000"
+	return protocol.Request{
+		RequestID:    request_id,
+		EventPayload: event,
+		Context: protocol.Context{
+			InvokedFunctionARN: fmt.Sprintf("arn:aws:lambda:%s:%s:function:%s", opts.Region, account_id, opts.function_name),
+			DeadlineMs:         strconv.FormatInt(now.Add(opts.timeout).UnixMilli(), 10),
+			TraceID:            fmt.Sprintf("Root=1-%08x-%s;Sampled=0", now.Unix(), trace_suffix(request_id)),
+			RequestID:          request_id,
+			FunctionName:       opts.function_name,
+			FunctionVersion:    "$LATEST",
+			MemorySizeMB:       strconv.Itoa(opts.memory_mb),
+			LogGroupName:       "/aws/lambda/" + opts.function_name,
+			LogStreamName:      "live-lambda-simulator",
+			AWSRegion:          opts.Region,
+		},
+	}
+}
+
+// simulation_stats collects outcomes for the run summary.
+type simulation_stats struct {
+	mu        sync.Mutex
+	sent      int
+	failed    int
+	timed_out int
+	latencies []time.Duration
+}
+
+func (s *simulation_stats) record_sent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+}
+
+func (s *simulation_stats) record_failed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed++
+}
+
+func (s *simulation_stats) record_timeout() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timed_out++
+}
+
+func (s *simulation_stats) record_response(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies = append(s.latencies, latency)
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func (s *simulation_stats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := append([]time.Duration{}, s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return fmt.Sprintf("sent=%d responded=%d timed_out=%d failed=%d p50=%s p90=%s p99=%s",
+		s.sent, len(sorted), s.timed_out, s.failed,
+		percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99))
+}
+
+func run_simulate(args []string) error {
+	opts, err := parse_simulate_flags(args)
+	if err != nil {
+		return err
+	}
+	event, err := load_event_payload(opts.payload_path)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("%s Simulating %s at %.2f rps", tester_print_prefix, opts.function_name, opts.rps)
+
+	stats := &simulation_stats{}
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rps))
+	defer ticker.Stop()
+
+launch:
+	for launched := 0; opts.count == 0 || launched < opts.count; launched++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			simulate_invocation(ctx, client, opts, event, stats)
+		}()
+
+		select {
+		case <-ctx.Done():
+			break launch
+		case <-ticker.C:
+		}
+	}
+
+	wg.Wait()
+	log.Printf("%s Done: %s", tester_print_prefix, stats.summary())
+	return nil
+}
+
+// simulate_invocation mirrors handle_next in the extension: subscribe to the
+// response topic, publish the request, and wait for the first response.
+func simulate_invocation(ctx context.Context, client *appsyncwsclient.Client, opts simulate_options, event json.RawMessage, stats *simulation_stats) {
+	request_id := new_request_id()
+	response_topic := opts.ResponseTopic(request_id)
+
+	invocation_ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	responded := make(chan struct{})
+	var once sync.Once
+	if _, err := client.Subscribe(invocation_ctx, response_topic, func(data_payload interface{}) {
+		once.Do(func() { close(responded) })
+	}); err != nil {
+		log.Printf("%s Error subscribing to %s: %v", tester_print_prefix, response_topic, err)
+		stats.record_failed()
+		return
+	}
+
+	started := time.Now()
+	envelope := build_request_envelope(opts, request_id, event, started)
+	if err := client.Publish(invocation_ctx, opts.RequestsTopic(), []interface{}{envelope}); err != nil {
+		log.Printf("%s Error publishing request %s: %v", tester_print_prefix, request_id, err)
+		stats.record_failed()
+		return
+	}
+	stats.record_sent()
+
+	select {
+	case <-responded:
+		latency := time.Since(started)
+		stats.record_response(latency)
+		log.Printf("%s Response for %s after %s", tester_print_prefix, request_id, latency)
+	case <-invocation_ctx.Done():
+		log.Printf("%s No response for %s within %s", tester_print_prefix, request_id, opts.timeout)
+		stats.record_timeout()
+	case <-ctx.Done():
+		// Interrupted; in-flight requests are not counted as timeouts
+	}
+}
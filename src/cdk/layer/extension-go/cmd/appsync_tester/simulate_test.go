@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestParseSimulateFlags(t *testing.T) {
+	opts, err := parse_simulate_flags([]string{
+		"--function", "orders", "--rps", "5", "--http-host", "h", "--realtime-host", "r", "--region", "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.function_name != "orders" || opts.rps != 5 || opts.timeout != 30*time.Second {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	if _, err := parse_simulate_flags([]string{"--http-host", "h", "--realtime-host", "r", "--region", "x"}); err == nil {
+		t.Fatal("expected an error without --function")
+	}
+	if _, err := parse_simulate_flags([]string{"--function", "f", "--rps", "0", "--http-host", "h", "--realtime-host", "r", "--region", "x"}); err == nil {
+		t.Fatal("expected an error for --rps 0")
+	}
+}
+
+func TestLoadEventPayload(t *testing.T) {
+	payload, err := load_event_payload("")
+	if err != nil || string(payload) != "{}" {
+		t.Fatalf("default payload = %s, %v", payload, err)
+	}
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "event.json")
+	os.WriteFile(valid, []byte(`{"orderId":42}`), 0o600)
+	if payload, err := load_event_payload(valid); err != nil || string(payload) != `{"orderId":42}` {
+		t.Fatalf("payload = %s, %v", payload, err)
+	}
+
+	invalid := filepath.Join(dir, "bad.json")
+	os.WriteFile(invalid, []byte(`{`), 0o600)
+	if _, err := load_event_payload(invalid); err == nil {
+		t.Fatal("expected an error for invalid JSON")
+	}
+}
+
+func TestBuildRequestEnvelope(t *testing.T) {
+	opts := simulate_options{Options: connection.Options{Region: "eu-west-1"}, function_name: "orders", timeout: 10 * time.Second, memory_mb: 256}
+	request_id := new_request_id()
+	now := time.Unix(1700000000, 0)
+	envelope := build_request_envelope(opts, request_id, json.RawMessage(`{"a":1}`), now)
+
+	if envelope.RequestID != request_id {
+		t.Fatalf("request_id = %v", envelope.RequestID)
+	}
+	context_data := envelope.Context
+	if context_data.FunctionName != "orders" || context_data.MemorySizeMB != "256" {
+		t.Fatalf("unexpected context: %+v", context_data)
+	}
+	if context_data.DeadlineMs != "1700000010000" {
+		t.Fatalf("deadline_ms = %v", context_data.DeadlineMs)
+	}
+	if !strings.HasPrefix(context_data.InvokedFunctionARN, "arn:aws:lambda:eu-west-1:") {
+		t.Fatalf("invoked_function_arn = %v", context_data.InvokedFunctionARN)
+	}
+	frame, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("envelope does not marshal: %v", err)
+	}
+	if _, err := protocol.ParseRequest(frame); err != nil {
+		t.Fatalf("envelope is not valid: %v", err)
+	}
+}
+
+func TestSimulationStatsSummary(t *testing.T) {
+	stats := &simulation_stats{}
+	for i := 1; i <= 10; i++ {
+		stats.record_sent()
+		stats.record_response(time.Duration(i) * time.Millisecond)
+	}
+	stats.record_timeout()
+	summary := stats.summary()
+	for _, want := range []string{"sent=10", "responded=10", "timed_out=1", "p50=5ms", "p99=10ms"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary %q missing %q", summary, want)
+		}
+	}
+}
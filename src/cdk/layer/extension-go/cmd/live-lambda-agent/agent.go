@@ -0,0 +1,938 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// The agent speaks the workstation half of the extension protocol: it answers
+// presence probes with heartbeats, runs each request envelope published on
+// live-lambda/requests through a handler, and publishes the result on
+// live-lambda/response/{request_id}. It implements only part of the protocol
+// and says so in its heartbeats, so extensions do not chunk or stream to it.
+// Responses are kept for a while so they can be published again when an
+// extension that reconnected mid-invocation sends a retransmit_request. The
+// agent claims the invocations offered for the functions it serves; those it
+// wins arrive on its private channel, live-lambda/agents/{agent_id}. A cancel
+// message from the extension stops a handler whose invocation Lambda has given
+// up on, and its result is not published. An invalid_response message says
+// why the extension did not post a response. Each request runs once per
+// idempotency key and sandbox: a duplicate delivery or a republished request
+// is dropped while its handler runs and answered with the kept response after.
+
+const (
+	default_channel_namespace = "live-lambda"
+	default_requests_channel  = "requests"
+	default_response_channel  = "response/{request_id}"
+	request_id_placeholder    = "{request_id}"
+	presence_topic_format     = "presence/%s"
+	presence_topic_pattern    = "presence/*"
+	env_topic_pattern         = "env/*"
+
+	protocol_version     = protocol.Version
+	min_protocol_version = protocol.MinVersion
+
+	heartbeat_interval     = 5 * time.Second
+	heartbeat_ttl          = 15 * time.Second
+	publish_timeout        = 10 * time.Second
+	max_inline_bytes       = 200 * 1024
+	max_payload_bytes      = 6 * 1024 * 1024
+	content_encoding_gzip  = protocol.ContentEncodingGzip
+	binary_event_format    = protocol.EventFormatBinary
+	response_envelope_type = protocol.TypeResponse
+
+	retransmit_request_type = "retransmit_request"
+	invocation_cancel_type  = "cancel"
+	invalid_response_type   = "invalid_response"
+	invocation_offer_type   = "invocation_offer"
+	claim_frame_type        = "claim"
+	ack_frame_type          = "ack"
+	agent_topic_format      = "agents/%s"
+	response_retention      = 15 * time.Minute // the longest a Lambda invocation can run
+)
+
+// agent_capabilities are the optional protocol features this agent supports.
+var agent_capabilities = []string{
+	protocol.CapabilityCompression,
+	protocol.CapabilityOffload,
+	protocol.CapabilityResponseEnvelope,
+	protocol.CapabilityErrorFrames,
+	protocol.CapabilityXRay,
+	protocol.CapabilityClaims,
+	protocol.CapabilityBinary,
+	protocol.CapabilityEncryption,
+	protocol.CapabilityTaggedResponses,
+	protocol.CapabilityTiming,
+	protocol.CapabilityAck,
+}
+
+// publisher publishes events on an AppSync channel.
+type publisher func(ctx context.Context, channel string, events []interface{}) error
+
+// invocation is a request envelope as published by the extension. The other
+// messages on the requests channel share its request_id and add a type.
+type invocation struct {
+	Type string `json:"type"`
+	protocol.Request
+
+	event    json.RawMessage // the decoded event, set by resolve_event; raw bytes for a binary event
+	reply    publisher       // the connection the request arrived on; nil is the primary
+	received time.Time       // when the request arrived
+	started  time.Time       // when the handler was called
+	ended    time.Time       // when the handler returned
+
+	function_env map[string]string // the function's environment, from its env channel
+}
+
+// delivery_key identifies the request's attempt across duplicate deliveries,
+// or is "" when the extension sends no idempotency key.
+func (r invocation) delivery_key() string {
+	if r.IdempotencyKey == "" {
+		return ""
+	}
+	return r.SandboxID + "/" + r.IdempotencyKey
+}
+
+// timing is the agent's side of the extension's latency breakdown: the time
+// since the request arrived, and the handler's share.
+func (r invocation) timing() *protocol.Timing {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return &protocol.Timing{
+		AgentMs:   ms(time.Since(r.received)),
+		HandlerMs: ms(r.ended.Sub(r.started)),
+	}
+}
+
+// served returns the function and handler an invocation is for, for logs.
+func (r invocation) served() string {
+	if r.Function == nil {
+		return r.function_name()
+	}
+	served := r.Function.Name + ":" + r.Function.Version + " (" + r.Function.Handler + ")"
+	if r.Function.AccountID != "" {
+		served = r.Function.AccountID + "/" + served
+	}
+	return served
+}
+
+func (r invocation) function_name() string {
+	return r.Context.FunctionName
+}
+
+// trace_header returns the X-Ray trace header for the handler: the extension's,
+// which nests the handler's calls under the live-lambda subsegment, or Lambda's.
+func (r invocation) trace_header() string {
+	if r.Trace != nil && r.Trace.Header != "" {
+		return r.Trace.Header
+	}
+	return r.Context.TraceID
+}
+
+// caller_headers returns the Cognito identity and client context as the
+// Runtime API would send them: the JSON Lambda received, or the header the
+// extension could not parse.
+func (r invocation) caller_headers() (identity string, client_context string) {
+	identity, client_context = r.Context.IdentityRaw, r.Context.ClientContextRaw
+	if r.Context.Identity != nil {
+		encoded, _ := json.Marshal(r.Context.Identity)
+		identity = string(encoded)
+	}
+	if r.Context.ClientContext != nil {
+		encoded, _ := json.Marshal(r.Context.ClientContext)
+		client_context = string(encoded)
+	}
+	return identity, client_context
+}
+
+// handler_subsegment describes the handler call as an X-Ray subsegment.
+func (r invocation) handler_subsegment(failed bool) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         new_subsegment_id(),
+		"name":       "live-lambda-agent handler",
+		"start_time": float64(r.started.UnixNano()) / float64(time.Second),
+		"end_time":   float64(r.ended.UnixNano()) / float64(time.Second),
+		"error":      failed,
+	}
+}
+
+// supports reports whether the extension offered capability. Unlike
+// protocol.Handshake.Supports, it assumes nothing of an extension that
+// announced no capabilities.
+func (r invocation) supports(capability string) bool {
+	for _, offered := range r.Capabilities {
+		if offered == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// environment returns the function's environment, when its extension
+// published it, and the invocation's context and metadata as environment
+// variables for a command handler. The context comes last, so it wins over the
+// snapshot.
+func (r invocation) environment() []string {
+	var environment []string
+	for name, value := range r.function_env {
+		environment = append(environment, name+"="+value)
+	}
+	sort.Strings(environment)
+	context_json, _ := json.Marshal(r.Context)
+	if len(r.Metadata) > 0 {
+		metadata_json, _ := json.Marshal(r.Metadata)
+		environment = append(environment, "LIVE_LAMBDA_METADATA="+string(metadata_json))
+	}
+	return append(environment,
+		"LIVE_LAMBDA_REQUEST_ID="+r.RequestID,
+		"LIVE_LAMBDA_CONTEXT="+string(context_json),
+		"AWS_LAMBDA_FUNCTION_NAME="+r.function_name(),
+		"AWS_LAMBDA_FUNCTION_VERSION="+r.Context.FunctionVersion,
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE="+r.Context.MemorySizeMB,
+		"_X_AMZN_TRACE_ID="+r.trace_header(),
+	)
+}
+
+type agent struct {
+	id        string
+	namespace string
+	scope     string // channel scope, see connection.Options
+	requests  string // requests channel, see connection.Options
+	response  string // response channel template, ending in {request_id}
+	handler   handler
+	publish   publisher
+	functions map[string]bool // empty serves every function
+	http      *http.Client
+	keys      *payload_keys
+	// signing_secret signs responses for extensions that verify them; nil signs nothing
+	signing_secret []byte
+	// preferred_region asks extensions with regional endpoints to use this one
+	preferred_region string
+
+	mu        sync.Mutex
+	announced map[string]bool                      // functions that get heartbeats
+	followed  map[string]map[string]presence_route // by function and endpoint, where its extensions probed
+	responses map[string]sent_response             // by request ID, for retransmit requests
+	running   map[string]context.CancelCauseFunc   // by request ID, for cancel messages
+	delivered map[string]time.Time                 // by delivery key, for duplicate requests
+	env       map[string]map[string]string         // by function, the unredacted part of its env snapshot
+}
+
+// cancelled_by_extension is the cause of a handler's context ending on a cancel message.
+var cancelled_by_extension = errors.New("the extension cancelled the invocation")
+
+// sent_response is a published response kept for retransmission.
+type sent_response struct {
+	channel         string
+	message         interface{}
+	idempotency_key string // the attempt it answers, or ""
+	sent_at         time.Time
+}
+
+func new_agent(handler handler, publish publisher, functions []string) *agent {
+	a := &agent{
+		id:        new_agent_id(),
+		namespace: default_channel_namespace,
+		requests:  default_requests_channel,
+		response:  default_response_channel,
+		handler:   handler,
+		publish:   publish,
+		functions: map[string]bool{},
+		http:      &http.Client{Timeout: 30 * time.Second},
+		keys:      new_payload_keys(aws.Config{}),
+		announced: map[string]bool{},
+		followed:  map[string]map[string]presence_route{},
+		responses: map[string]sent_response{},
+		running:   map[string]context.CancelCauseFunc{},
+		delivered: map[string]time.Time{},
+		env:       map[string]map[string]string{},
+	}
+	for _, function_name := range functions {
+		a.functions[function_name] = true
+	}
+	return a
+}
+
+func new_agent_id() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return "go-agent-" + hex.EncodeToString(buf)
+}
+
+func new_subsegment_id() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// channel returns a channel path in the agent's namespace and channel scope.
+func (a *agent) channel(format string, args ...interface{}) string {
+	if a.scope != "" {
+		return a.namespace + "/" + a.scope + "/" + fmt.Sprintf(format, args...)
+	}
+	return a.namespace + "/" + fmt.Sprintf(format, args...)
+}
+
+// requests_topic returns the channel extensions publish invocations on.
+func (a *agent) requests_topic() string {
+	return a.channel("%s", a.requests)
+}
+
+// response_topic returns the channel request_id is answered on.
+func (a *agent) response_topic(request_id string) string {
+	return a.channel("%s", strings.Replace(a.response, request_id_placeholder, request_id, 1))
+}
+
+func (a *agent) serves(function_name string) bool {
+	return len(a.functions) == 0 || a.functions[function_name]
+}
+
+// heartbeat is the agent's presence frame and its half of the protocol handshake.
+// capabilities returns agent_capabilities, with signing when the agent has a
+// signing secret.
+func (a *agent) capabilities() []string {
+	if a.signing_secret == nil {
+		return agent_capabilities
+	}
+	return append(append([]string{}, agent_capabilities...), "signing")
+}
+
+func (a *agent) heartbeat() map[string]interface{} {
+	heartbeat := map[string]interface{}{
+		"type":                 "heartbeat",
+		"agent_id":             a.id,
+		"ttl_ms":               heartbeat_ttl.Milliseconds(),
+		"timestamp":            time.Now().UTC().Format(time.RFC3339Nano),
+		"accept_encoding":      []string{content_encoding_gzip},
+		"protocol_version":     protocol_version,
+		"min_protocol_version": min_protocol_version,
+		"capabilities":         a.capabilities(),
+	}
+	if a.preferred_region != "" {
+		heartbeat["preferred_region"] = a.preferred_region
+	}
+	return heartbeat
+}
+
+// announce starts sending heartbeats to function_name.
+func (a *agent) announce(ctx context.Context, function_name string) {
+	a.mu.Lock()
+	first := !a.announced[function_name]
+	a.announced[function_name] = true
+	a.mu.Unlock()
+	if first {
+		log.Printf("%s Announcing presence to %s", agent_print_prefix, function_name)
+	}
+	a.send_heartbeat(ctx, function_name)
+}
+
+// presence_route is where an extension probed for the agent.
+type presence_route struct {
+	endpoint string    // the extension's active endpoint, when it has standby ones
+	reply    publisher // the connection the probe arrived on; nil is the primary
+}
+
+// follow heartbeats to function_name on route as well. Sandboxes that failed
+// over and sandboxes that did not can run side by side, so every endpoint a
+// probe arrived on keeps getting heartbeats.
+func (a *agent) follow(function_name string, route presence_route) {
+	a.mu.Lock()
+	routes := a.followed[function_name]
+	if routes == nil {
+		routes = map[string]presence_route{}
+		a.followed[function_name] = routes
+	}
+	_, known := routes[route.endpoint]
+	routes[route.endpoint] = route
+	a.mu.Unlock()
+	if route.endpoint != "" && !known {
+		log.Printf("%s Following %s to %s", agent_print_prefix, function_name, route.endpoint)
+	}
+}
+
+func (a *agent) send_heartbeat(ctx context.Context, function_name string) {
+	a.mu.Lock()
+	routes := make([]presence_route, 0, len(a.followed[function_name]))
+	for _, route := range a.followed[function_name] {
+		routes = append(routes, route)
+	}
+	a.mu.Unlock()
+	if len(routes) == 0 {
+		routes = append(routes, presence_route{})
+	}
+	for _, route := range routes {
+		heartbeat := a.heartbeat()
+		if route.endpoint != "" {
+			heartbeat["endpoint"] = route.endpoint
+		}
+		publish_ctx, cancel := context.WithTimeout(ctx, publish_timeout)
+		err := a.reply_publisher(route.reply)(publish_ctx, a.channel(presence_topic_format, function_name), []interface{}{heartbeat})
+		cancel()
+		if err != nil {
+			log.Printf("%s Failed to send heartbeat to %s: %v", agent_print_prefix, function_name, err)
+		}
+	}
+}
+
+// run_heartbeats keeps every announced function's presence fresh until ctx is done.
+func (a *agent) run_heartbeats(ctx context.Context) {
+	ticker := time.NewTicker(heartbeat_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			functions := make([]string, 0, len(a.announced))
+			for function_name := range a.announced {
+				functions = append(functions, function_name)
+			}
+			a.mu.Unlock()
+			for _, function_name := range functions {
+				a.send_heartbeat(ctx, function_name)
+			}
+		}
+	}
+}
+
+// handle_presence answers probes from the functions the agent serves and
+// reports protocol rejections addressed to it.
+func (a *agent) handle_presence(ctx context.Context, frame []byte) {
+	a.handle_presence_from(ctx, frame, nil)
+}
+
+// handle_presence_from handles a presence frame that arrived on the
+// connection reply publishes to, and heartbeats there. A nil reply is the
+// primary connection.
+func (a *agent) handle_presence_from(ctx context.Context, frame []byte, reply publisher) {
+	var message struct {
+		Type               string `json:"type"`
+		AgentID            string `json:"agent_id"`
+		FunctionName       string `json:"function_name"`
+		Message            string `json:"message"`
+		MinProtocolVersion int    `json:"min_protocol_version"`
+		Endpoint           string `json:"endpoint"`
+	}
+	if json.Unmarshal(frame, &message) != nil {
+		return
+	}
+	switch message.Type {
+	case "probe":
+		if !a.serves(message.FunctionName) {
+			return
+		}
+		if message.MinProtocolVersion > protocol_version {
+			log.Printf("%s Not serving %s: the extension needs protocol %d or newer but this agent speaks %d; upgrade live-lambda-agent", agent_print_prefix, message.FunctionName, message.MinProtocolVersion, protocol_version)
+			return
+		}
+		a.follow(message.FunctionName, presence_route{endpoint: message.Endpoint, reply: reply})
+		a.announce(ctx, message.FunctionName)
+	case "protocol_rejected":
+		if message.AgentID == a.id {
+			log.Printf("%s %s will not send invocations to this agent: %s", agent_print_prefix, message.FunctionName, message.Message)
+		}
+	}
+}
+
+// handle_request runs one request envelope through the handler and publishes the result.
+func (a *agent) handle_request(ctx context.Context, frame []byte) {
+	a.handle_request_from(ctx, frame, nil)
+}
+
+// handle_request_from handles a request that arrived on the connection reply
+// publishes to, and answers it there. A nil reply is the primary connection.
+func (a *agent) handle_request_from(ctx context.Context, frame []byte, reply publisher) {
+	var request invocation
+	if err := json.Unmarshal(frame, &request); err != nil {
+		log.Printf("%s Ignoring malformed request: %v", agent_print_prefix, err)
+		return
+	}
+	request.reply = reply
+	request.received = time.Now()
+	if request.RequestID == "" {
+		// Chunk frames and other traffic on the requests channel
+		return
+	}
+	if request.Type == retransmit_request_type {
+		a.resend(ctx, request.RequestID, request.IdempotencyKey, reply)
+		return
+	}
+	if request.Type == invocation_offer_type {
+		a.claim(ctx, frame, reply)
+		return
+	}
+	if request.Type == invocation_cancel_type {
+		a.cancel(frame)
+		return
+	}
+	if request.Type == invalid_response_type {
+		a.report_invalid_response(frame)
+		return
+	}
+	if !a.serves(request.function_name()) {
+		return
+	}
+	if !request.Accepts(protocol_version) {
+		log.Printf("%s Ignoring request %s from %s: the extension needs protocol %d or newer but this agent speaks %d; upgrade live-lambda-agent", agent_print_prefix, request.RequestID, request.function_name(), request.MinVersion, protocol_version)
+		return
+	}
+	if err := request.Validate(); err != nil {
+		log.Printf("%s Invalid request %s: %v", agent_print_prefix, request.RequestID, err)
+		a.publish_error(ctx, request, &invocation_error{ErrorType: "LiveLambda.InvalidRequest", ErrorMessage: err.Error()})
+		return
+	}
+	if !a.first_delivery(request) {
+		// AppSync delivered it again, or the extension republished it
+		log.Printf("%s %s was already delivered; not running it again", agent_print_prefix, request.IdempotencyKey)
+		a.resend(ctx, request.RequestID, request.IdempotencyKey, reply)
+		return
+	}
+	if request.supports("ack") {
+		// Tells the extension someone is serving the request before the
+		// handler runs, so it only falls back when nobody is
+		a.acknowledge(ctx, request)
+	}
+
+	invoke_ctx := ctx
+	if deadline, ok := request.Context.Deadline(); ok {
+		var cancel context.CancelFunc
+		invoke_ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	invoke_ctx, cancel := context.WithCancelCause(invoke_ctx)
+	defer cancel(nil)
+	a.track(request.RequestID, cancel)
+	defer a.untrack(request.RequestID)
+
+	started := time.Now()
+	event, err := a.resolve_event(invoke_ctx, request)
+	if err != nil {
+		log.Printf("%s Could not read the event for %s: %v", agent_print_prefix, request.RequestID, err)
+		a.publish_error(ctx, request, &invocation_error{ErrorType: "LiveLambda.InvalidRequest", ErrorMessage: err.Error()})
+		return
+	}
+	request.event = event
+	request.function_env = a.function_environment(request.function_name())
+
+	request.started = time.Now()
+	response, function_error, err := a.handler.invoke(invoke_ctx, request)
+	request.ended = time.Now()
+	if errors.Is(context.Cause(invoke_ctx), cancelled_by_extension) {
+		log.Printf("%s %s stopped after %s: %v", agent_print_prefix, request.RequestID, time.Since(started).Round(time.Millisecond), cancelled_by_extension)
+		return
+	}
+	if err != nil {
+		function_error = &invocation_error{ErrorType: "LiveLambda.AgentError", ErrorMessage: err.Error()}
+	}
+	if function_error != nil {
+		log.Printf("%s %s failed after %s: %s: %s", agent_print_prefix, request.RequestID, time.Since(started).Round(time.Millisecond), function_error.ErrorType, function_error.ErrorMessage)
+		a.publish_error(ctx, request, function_error)
+		return
+	}
+	log.Printf("%s %s for %s handled in %s", agent_print_prefix, request.RequestID, request.served(), time.Since(started).Round(time.Millisecond))
+	a.publish_response(ctx, request, response)
+}
+
+// handle_env_snapshot keeps the environment an extension published for a
+// function this agent serves. Redacted variables are dropped, so a command
+// handler keeps the workstation's value for them.
+func (a *agent) handle_env_snapshot(frame []byte) {
+	var snapshot protocol.EnvSnapshot
+	if err := json.Unmarshal(frame, &snapshot); err != nil {
+		return
+	}
+	if err := snapshot.Validate(); err != nil {
+		log.Printf("%s Ignoring env snapshot: %v", agent_print_prefix, err)
+		return
+	}
+	if !a.serves(snapshot.FunctionName) {
+		return
+	}
+	variables := snapshot.Unredacted()
+	a.mu.Lock()
+	_, known := a.env[snapshot.FunctionName]
+	a.env[snapshot.FunctionName] = variables
+	a.mu.Unlock()
+	if !known {
+		log.Printf("%s Running %s with %d variables from its environment (%d redacted)", agent_print_prefix, snapshot.FunctionName, len(variables), len(snapshot.Redacted))
+	}
+}
+
+// function_environment returns the environment last published for function_name, or nil.
+func (a *agent) function_environment(function_name string) map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.env[function_name]
+}
+
+// first_delivery records request's delivery key, and reports whether it was
+// new. Keys are forgotten with the responses, after response_retention.
+func (a *agent) first_delivery(request invocation) bool {
+	key := request.delivery_key()
+	if key == "" {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for delivered, at := range a.delivered {
+		if now.Sub(at) > response_retention {
+			delete(a.delivered, delivered)
+		}
+	}
+	if _, seen := a.delivered[key]; seen {
+		return false
+	}
+	a.delivered[key] = now
+	return true
+}
+
+// track remembers how to cancel the running request_id.
+func (a *agent) track(request_id string, cancel context.CancelCauseFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.running[request_id] = cancel
+}
+
+func (a *agent) untrack(request_id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.running, request_id)
+}
+
+// cancel stops the handler running the request a cancel message names, if any.
+func (a *agent) cancel(frame []byte) {
+	var message struct {
+		RequestID string `json:"request_id"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.Unmarshal(frame, &message); err != nil {
+		return
+	}
+	a.mu.Lock()
+	cancel, ok := a.running[message.RequestID]
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+	log.Printf("%s The extension cancelled %s (%s); stopping its handler", agent_print_prefix, message.RequestID, message.Reason)
+	cancel(cancelled_by_extension)
+}
+
+// report_invalid_response logs why the extension did not post a response
+// this agent sent. Lambda got an invocation error instead.
+func (a *agent) report_invalid_response(frame []byte) {
+	var message struct {
+		RequestID string `json:"request_id"`
+		Message   string `json:"message"`
+	}
+	if err := json.Unmarshal(frame, &message); err != nil {
+		return
+	}
+	a.mu.Lock()
+	_, sent := a.responses[message.RequestID]
+	a.mu.Unlock()
+	if sent {
+		log.Printf("%s The extension rejected the response to %s: %s", agent_print_prefix, message.RequestID, message.Message)
+	}
+}
+
+// claim answers an invocation offer for a function the agent serves. If the
+// claim wins, the request follows on the agent's private channel.
+func (a *agent) claim(ctx context.Context, frame []byte, reply publisher) {
+	var offer struct {
+		RequestID          string `json:"request_id"`
+		FunctionName       string `json:"function_name"`
+		MinProtocolVersion int    `json:"min_protocol_version"`
+		IdempotencyKey     string `json:"idempotency_key"`
+	}
+	if json.Unmarshal(frame, &offer) != nil || !a.serves(offer.FunctionName) || offer.MinProtocolVersion > protocol_version {
+		return
+	}
+	claim := map[string]interface{}{
+		"type":       claim_frame_type,
+		"request_id": offer.RequestID,
+		"agent_id":   a.id,
+	}
+	if offer.IdempotencyKey != "" {
+		claim["idempotency_key"] = offer.IdempotencyKey
+	}
+	if a.signing_secret != nil {
+		signature, err := sign_response(a.signing_secret, offer.RequestID, claim)
+		if err != nil {
+			log.Printf("%s Could not sign the claim for %s: %v", agent_print_prefix, offer.RequestID, err)
+			return
+		}
+		claim["signature"] = signature
+	}
+	publish_ctx, cancel := context.WithTimeout(ctx, publish_timeout)
+	defer cancel()
+	if err := a.reply_publisher(reply)(publish_ctx, a.response_topic(offer.RequestID), []interface{}{claim}); err != nil {
+		log.Printf("%s Failed to claim %s: %v", agent_print_prefix, offer.RequestID, err)
+	}
+}
+
+// acknowledge publishes an ack for request on its response channel. It is
+// published before the handler runs, so it always precedes the response.
+func (a *agent) acknowledge(ctx context.Context, request invocation) {
+	ack := map[string]interface{}{
+		"type":       ack_frame_type,
+		"request_id": request.RequestID,
+		"agent_id":   a.id,
+	}
+	if request.IdempotencyKey != "" {
+		ack["idempotency_key"] = request.IdempotencyKey
+	}
+	if a.signing_secret != nil {
+		signature, err := sign_response(a.signing_secret, request.RequestID, ack)
+		if err != nil {
+			log.Printf("%s Could not sign the ack for %s: %v", agent_print_prefix, request.RequestID, err)
+			return
+		}
+		ack["signature"] = signature
+	}
+	publish_ctx, cancel := context.WithTimeout(ctx, publish_timeout)
+	defer cancel()
+	if err := a.reply_publisher(request.reply)(publish_ctx, a.response_topic(request.RequestID), []interface{}{ack}); err != nil {
+		log.Printf("%s Failed to acknowledge %s: %v", agent_print_prefix, request.RequestID, err)
+	}
+}
+
+// resolve_event returns the event, downloading and decoding it as needed.
+func (a *agent) resolve_event(ctx context.Context, request invocation) (json.RawMessage, error) {
+	if request.EventPayloadRef != nil {
+		return a.download(ctx, *request.EventPayloadRef)
+	}
+	if request.PayloadKey != nil {
+		opened, err := a.keys.open(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		request.EventPayload = opened
+	}
+	switch request.ContentEncoding {
+	case "":
+		if request.EventFormat != binary_event_format {
+			return request.EventPayload, nil
+		}
+		var encoded string
+		if err := json.Unmarshal(request.EventPayload, &encoded); err != nil {
+			return nil, fmt.Errorf("binary event_payload must be a base64 string: %w", err)
+		}
+		return base64.StdEncoding.DecodeString(encoded)
+	case content_encoding_gzip:
+		var encoded string
+		if err := json.Unmarshal(request.EventPayload, &encoded); err != nil {
+			return nil, fmt.Errorf("encoded event_payload must be a base64 string: %w", err)
+		}
+		compressed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode event_payload: %w", err)
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress event_payload: %w", err)
+		}
+		return io.ReadAll(io.LimitReader(reader, max_payload_bytes))
+	default:
+		return nil, fmt.Errorf("unsupported content_encoding %q", request.ContentEncoding)
+	}
+}
+
+// download fetches an offloaded payload and verifies its checksum.
+func (a *agent) download(ctx context.Context, ref protocol.PayloadReference) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download payload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("payload download failed with status %d", resp.StatusCode)
+	}
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, max_payload_bytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payload: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	if ref.Checksum != "" && hex.EncodeToString(sum[:]) != ref.Checksum {
+		return nil, fmt.Errorf("payload checksum mismatch")
+	}
+	return payload, nil
+}
+
+// upload stores an oversized response through the presigned URLs the extension
+// sent and returns the payload_ref frame pointing at it.
+func (a *agent) upload(ctx context.Context, upload protocol.ResponseUpload, payload []byte) (protocol.PayloadReference, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, upload.PutURL, bytes.NewReader(payload))
+	if err != nil {
+		return protocol.PayloadReference{}, err
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return protocol.PayloadReference{}, fmt.Errorf("failed to upload response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return protocol.PayloadReference{}, fmt.Errorf("response upload failed with status %d", resp.StatusCode)
+	}
+	sum := sha256.Sum256(payload)
+	return protocol.PayloadReference{Type: protocol.TypePayloadReference, URL: upload.GetURL, Size: len(payload), Checksum: hex.EncodeToString(sum[:])}, nil
+}
+
+// publish_response sends the handler's response, through S3 when it is too
+// large for one event.
+func (a *agent) publish_response(ctx context.Context, request invocation, response json.RawMessage) {
+	var message interface{} = response
+	if len(response) > max_inline_bytes {
+		if request.ResponseUpload == nil {
+			a.publish_error(ctx, request, &invocation_error{ErrorType: "LiveLambda.ResponseTooLarge", ErrorMessage: fmt.Sprintf("response is %d bytes and the extension offered no upload URL", len(response))})
+			return
+		}
+		ref, err := a.upload(ctx, *request.ResponseUpload, response)
+		if err != nil {
+			a.publish_error(ctx, request, &invocation_error{ErrorType: "LiveLambda.ResponseTooLarge", ErrorMessage: err.Error()})
+			return
+		}
+		message = ref
+	}
+	a.publish_message(ctx, request, message, false)
+}
+
+// publish_error sends an error frame, or only logs when the extension cannot
+// tell an error frame from a response.
+func (a *agent) publish_error(ctx context.Context, request invocation, function_error *invocation_error) {
+	if !request.supports("error_frames") {
+		log.Printf("%s The extension for %s does not accept error frames; it will wait for the invocation deadline", agent_print_prefix, request.function_name())
+		return
+	}
+	frame := protocol.NewInvocationError(function_error.ErrorType, function_error.ErrorMessage, function_error.StackTrace)
+	a.publish_message(ctx, request, frame, true)
+}
+
+// publish_message publishes message on the request's response channel,
+// wrapped in a response envelope when the extension negotiated one. The
+// envelope reports the handler call for the extension's X-Ray subsegment when
+// the extension traces the invocation, and names the request when the
+// extension listens on a wildcard response subscription.
+func (a *agent) publish_message(ctx context.Context, request invocation, message interface{}, failed bool) {
+	if _, is_ref := message.(protocol.PayloadReference); request.PayloadKey != nil && !is_ref {
+		sealed, err := a.keys.seal(ctx, request, message)
+		if err != nil {
+			// The extension drops responses that are not encrypted
+			log.Printf("%s Could not encrypt the response for %s: %v", agent_print_prefix, request.RequestID, err)
+			return
+		}
+		message = sealed
+	}
+	if request.supports("response_envelope") {
+		envelope, err := protocol.NewResponse(message)
+		if err != nil {
+			log.Printf("%s Could not encode the response for %s: %v", agent_print_prefix, request.RequestID, err)
+			return
+		}
+		if request.supports(protocol.CapabilityTaggedResponses) {
+			// Lets an extension on a wildcard response subscription route the frame
+			envelope.RequestID = request.RequestID
+		}
+		// Lets the extension drop answers to an earlier attempt
+		envelope.IdempotencyKey = request.IdempotencyKey
+		if a.signing_secret != nil && request.supports(protocol.CapabilitySigning) {
+			signature, err := sign_response(a.signing_secret, request.RequestID, message)
+			if err != nil {
+				log.Printf("%s Could not sign the response for %s: %v", agent_print_prefix, request.RequestID, err)
+				return
+			}
+			envelope.Signature = signature
+		}
+		if request.supports(protocol.CapabilityXRay) && request.Trace != nil && !request.started.IsZero() {
+			envelope.Trace, _ = json.Marshal(map[string]interface{}{
+				"subsegments": []interface{}{request.handler_subsegment(failed)},
+			})
+		}
+		if request.supports(protocol.CapabilityTiming) {
+			// Lets the extension tell the handler's time from AppSync's
+			envelope.Timing = request.timing()
+		}
+		message = envelope
+	}
+	channel := a.response_topic(request.RequestID)
+	a.remember(request.RequestID, sent_response{channel: channel, message: message, idempotency_key: request.IdempotencyKey, sent_at: time.Now()})
+	publish_ctx, cancel := context.WithTimeout(ctx, publish_timeout)
+	defer cancel()
+	if err := a.reply_publisher(request.reply)(publish_ctx, channel, []interface{}{message}); err != nil {
+		log.Printf("%s Failed to publish the response for %s: %v", agent_print_prefix, request.RequestID, err)
+	}
+}
+
+// remember keeps a response for retransmission and drops expired ones.
+func (a *agent) remember(request_id string, response sent_response) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, sent := range a.responses {
+		if response.sent_at.Sub(sent.sent_at) > response_retention {
+			delete(a.responses, id)
+		}
+	}
+	a.responses[request_id] = response
+}
+
+// reply_publisher returns reply, or the primary connection's publisher when it is nil.
+func (a *agent) reply_publisher(reply publisher) publisher {
+	if reply == nil {
+		return a.publish
+	}
+	return reply
+}
+
+// resend publishes the response for request_id again, on the connection the
+// retransmit request or duplicate arrived on, which is where the extension now
+// listens. A request still being handled has no response yet; it goes out on
+// the new subscription when done. With an idempotency key, only a response to
+// that attempt is resent.
+func (a *agent) resend(ctx context.Context, request_id string, idempotency_key string, reply publisher) {
+	a.mu.Lock()
+	sent, ok := a.responses[request_id]
+	a.mu.Unlock()
+	if !ok || time.Since(sent.sent_at) > response_retention {
+		return
+	}
+	if idempotency_key != "" && sent.idempotency_key != "" && sent.idempotency_key != idempotency_key {
+		return
+	}
+	publish_ctx, cancel := context.WithTimeout(ctx, publish_timeout)
+	defer cancel()
+	if err := a.reply_publisher(reply)(publish_ctx, sent.channel, []interface{}{sent.message}); err != nil {
+		log.Printf("%s Failed to resend the response for %s: %v", agent_print_prefix, request_id, err)
+		return
+	}
+	log.Printf("%s Resent the response for %s", agent_print_prefix, request_id)
+}
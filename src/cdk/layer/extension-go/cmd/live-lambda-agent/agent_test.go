@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// echo_handler answers with the event, or fails when the event asks it to.
+type echo_handler struct{}
+
+func (echo_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	if strings.Contains(string(request.event), "fail") {
+		return nil, &invocation_error{ErrorType: "Handler.Failed", ErrorMessage: "asked to fail"}, nil
+	}
+	return request.event, nil, nil
+}
+
+type published_event struct {
+	channel string
+	frame   string
+}
+
+type recording_publisher struct {
+	mu     sync.Mutex
+	events []published_event
+}
+
+func (p *recording_publisher) publish(ctx context.Context, channel string, events []interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, event := range events {
+		frame, _ := json.Marshal(event)
+		p.events = append(p.events, published_event{channel: channel, frame: string(frame)})
+	}
+	return nil
+}
+
+func request_frame(t *testing.T, event string, capabilities ...string) []byte {
+	t.Helper()
+	frame, err := json.Marshal(map[string]interface{}{
+		"request_id":           "req-1",
+		"event_payload":        json.RawMessage(event),
+		"context":              map[string]interface{}{"function_name": "orders"},
+		"protocol_version":     2,
+		"min_protocol_version": 1,
+		"capabilities":         capabilities,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestHandleRequestPublishesEnvelopedResponse(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`, "response_envelope", "error_frames"))
+
+	if len(recorder.events) != 1 || recorder.events[0].channel != "live-lambda/response/req-1" {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+	if recorder.events[0].frame != `{"type":"response","protocol_version":2,"body":{"id":7}}` {
+		t.Fatalf("unexpected frame %s", recorder.events[0].frame)
+	}
+}
+
+func TestHandleRequestAnswersOnCustomResponseChannel(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+	a.scope = "alice"
+	a.response = "answers/orders/{request_id}"
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`))
+
+	if len(recorder.events) != 1 || recorder.events[0].channel != "live-lambda/alice/answers/orders/req-1" {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestTagsEnvelopeWithRequestID(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`, "response_envelope", "tagged_responses"))
+
+	if len(recorder.events) != 1 || recorder.events[0].frame != `{"type":"response","protocol_version":2,"body":{"id":7},"request_id":"req-1"}` {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestReportsTimingToExtensionsThatAskForIt(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`, "response_envelope", "timing"))
+
+	var envelope struct {
+		Timing *struct {
+			AgentMs   *float64 `json:"agent_ms"`
+			HandlerMs *float64 `json:"handler_ms"`
+		} `json:"timing"`
+	}
+	if err := json.Unmarshal([]byte(recorder.events[0].frame), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Timing == nil || envelope.Timing.AgentMs == nil || envelope.Timing.HandlerMs == nil || *envelope.Timing.HandlerMs > *envelope.Timing.AgentMs {
+		t.Fatalf("expected the agent's timing in the envelope, got %s", recorder.events[0].frame)
+	}
+}
+
+func TestHandleRequestAcknowledgesBeforeResponding(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`, "ack"))
+
+	if len(recorder.events) != 2 || recorder.events[0].channel != "live-lambda/response/req-1" {
+		t.Fatalf("expected an ack and a response on the response channel, got %+v", recorder.events)
+	}
+	expected := `{"agent_id":"` + a.id + `","request_id":"req-1","type":"ack"}`
+	if recorder.events[0].frame != expected || recorder.events[1].frame != `{"id":7}` {
+		t.Fatalf("expected the ack before the response, got %+v", recorder.events)
+	}
+
+	recorder.events = nil
+	a.handle_request(context.Background(), request_frame(t, `{"id":8}`))
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected no ack for an extension that does not ask for one, got %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestClaimsOffersForServedFunctions(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, []string{"orders"})
+
+	a.handle_request(context.Background(), []byte(`{"type":"invocation_offer","request_id":"req-1","function_name":"orders","min_protocol_version":1}`))
+	a.handle_request(context.Background(), []byte(`{"type":"invocation_offer","request_id":"req-2","function_name":"billing"}`))
+
+	if len(recorder.events) != 1 || recorder.events[0].channel != "live-lambda/response/req-1" {
+		t.Fatalf("expected one claim on the offered request's response channel, got %+v", recorder.events)
+	}
+	expected := `{"agent_id":"` + a.id + `","request_id":"req-1","type":"claim"}`
+	if recorder.events[0].frame != expected {
+		t.Fatalf("unexpected claim %s", recorder.events[0].frame)
+	}
+}
+
+// trace_recording_handler remembers the trace header it ran under.
+type trace_recording_handler struct {
+	header *string
+}
+
+func (h trace_recording_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	*h.header = request.trace_header()
+	return json.RawMessage(`null`), nil, nil
+}
+
+func TestHandleRequestRunsUnderTheExtensionsTraceHeader(t *testing.T) {
+	recorder := &recording_publisher{}
+	var header string
+	a := new_agent(trace_recording_handler{header: &header}, recorder.publish, nil)
+	frame, _ := json.Marshal(map[string]interface{}{
+		"request_id":       "req-1",
+		"event_payload":    json.RawMessage(`{}`),
+		"context":          map[string]interface{}{"function_name": "orders", "trace_id": "Root=1-abc;Parent=1111111111111111;Sampled=1"},
+		"protocol_version": 2,
+		"capabilities":     []string{"response_envelope", "xray"},
+		"trace":            map[string]interface{}{"header": "Root=1-abc;Parent=2222222222222222;Sampled=1"},
+	})
+
+	a.handle_request(context.Background(), frame)
+
+	if header != "Root=1-abc;Parent=2222222222222222;Sampled=1" {
+		t.Fatalf("expected the propagated header, got %q", header)
+	}
+	var envelope struct {
+		Trace struct {
+			Subsegments []struct {
+				Name      string  `json:"name"`
+				StartTime float64 `json:"start_time"`
+				EndTime   float64 `json:"end_time"`
+			} `json:"subsegments"`
+		} `json:"trace"`
+	}
+	if len(recorder.events) != 1 || json.Unmarshal([]byte(recorder.events[0].frame), &envelope) != nil {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+	if subsegments := envelope.Trace.Subsegments; len(subsegments) != 1 || subsegments[0].Name == "" || subsegments[0].EndTime < subsegments[0].StartTime {
+		t.Fatalf("expected the handler subsegment, got %s", recorder.events[0].frame)
+	}
+}
+
+func TestHandleRequestResendsResponseOnRetransmitRequest(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+	retransmit := func(request_id string) []byte {
+		frame, _ := json.Marshal(map[string]interface{}{"type": "retransmit_request", "request_id": request_id, "sandbox_id": "sandbox-1"})
+		return frame
+	}
+
+	// Nothing to resend before the response exists
+	a.handle_request(context.Background(), retransmit("req-1"))
+	if len(recorder.events) != 0 {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`, "response_envelope"))
+	a.handle_request(context.Background(), retransmit("req-1"))
+	if len(recorder.events) != 2 || recorder.events[1] != recorder.events[0] {
+		t.Fatalf("expected the response to be published again, got %+v", recorder.events)
+	}
+}
+
+// counting_handler echoes the event and counts its calls.
+type counting_handler struct {
+	calls *int
+}
+
+func (h counting_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	*h.calls++
+	return request.event, nil, nil
+}
+
+func TestHandleRequestRunsEachIdempotencyKeyOnce(t *testing.T) {
+	recorder := &recording_publisher{}
+	calls := 0
+	a := new_agent(counting_handler{calls: &calls}, recorder.publish, nil)
+	attempt := func(sandbox_id string, key string) []byte {
+		var request map[string]interface{}
+		json.Unmarshal(request_frame(t, `{"id":7}`, "response_envelope"), &request)
+		request["sandbox_id"] = sandbox_id
+		request["idempotency_key"] = key
+		frame, _ := json.Marshal(request)
+		return frame
+	}
+
+	a.handle_request(context.Background(), attempt("sandbox-1", "req-1:1"))
+	// A duplicate delivery gets the kept response instead of a second run
+	a.handle_request(context.Background(), attempt("sandbox-1", "req-1:1"))
+	if calls != 1 || len(recorder.events) != 2 || recorder.events[1] != recorder.events[0] {
+		t.Fatalf("expected one run answered twice, got %d runs and %+v", calls, recorder.events)
+	}
+	if recorder.events[0].frame != `{"type":"response","protocol_version":2,"body":{"id":7},"idempotency_key":"req-1:1"}` {
+		t.Fatalf("expected the response to echo the key, got %s", recorder.events[0].frame)
+	}
+
+	// Lambda retried the invocation, in the same sandbox and in another one
+	a.handle_request(context.Background(), attempt("sandbox-1", "req-1:2"))
+	a.handle_request(context.Background(), attempt("sandbox-2", "req-1:1"))
+	if calls != 3 {
+		t.Fatalf("expected new attempts to run, got %d runs", calls)
+	}
+}
+
+// blocking_handler runs until its context ends.
+type blocking_handler struct {
+	started chan struct{}
+}
+
+func (h blocking_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	close(h.started)
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func TestHandleRequestStopsOnCancel(t *testing.T) {
+	recorder := &recording_publisher{}
+	handler := blocking_handler{started: make(chan struct{})}
+	a := new_agent(handler, recorder.publish, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.handle_request(context.Background(), request_frame(t, `{"id":7}`))
+	}()
+	<-handler.started
+	a.handle_request(context.Background(), []byte(`{"type":"cancel","request_id":"req-1","reason":"deadline"}`))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the cancel to stop the handler")
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.events) != 0 {
+		t.Fatalf("expected nothing published for a cancelled invocation, got %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestLogsRejectedResponses(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`))
+
+	a.handle_request(context.Background(), []byte(`{"type":"invalid_response","request_id":"req-1","message":"statusCode is missing"}`))
+	a.handle_request(context.Background(), []byte(`{"type":"invalid_response","request_id":"req-other","message":"body must be a string"}`))
+
+	if !strings.Contains(logged.String(), "The extension rejected the response to req-1: statusCode is missing") {
+		t.Fatalf("expected the rejection to be logged, got %q", logged.String())
+	}
+	if strings.Contains(logged.String(), "req-other") {
+		t.Fatalf("expected rejections of other agents' responses to be ignored, got %q", logged.String())
+	}
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected only the response to be published, got %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestAnswersOnTheConnectionItArrivedOn(t *testing.T) {
+	primary, preferred := &recording_publisher{}, &recording_publisher{}
+	a := new_agent(echo_handler{}, primary.publish, nil)
+	a.preferred_region = "eu-west-1"
+
+	a.handle_request_from(context.Background(), request_frame(t, `{"id":7}`), preferred.publish)
+	if len(primary.events) != 0 || len(preferred.events) != 1 {
+		t.Fatalf("expected the response in the preferred region, got %+v and %+v", primary.events, preferred.events)
+	}
+
+	// After a failover the extension asks for the response on the primary endpoint
+	a.handle_request(context.Background(), []byte(`{"type":"retransmit_request","request_id":"req-1"}`))
+	if len(primary.events) != 1 || primary.events[0] != preferred.events[0] {
+		t.Fatalf("expected the response resent on the primary endpoint, got %+v", primary.events)
+	}
+	if a.heartbeat()["preferred_region"] != "eu-west-1" {
+		t.Fatalf("expected the preferred region in heartbeats, got %v", a.heartbeat())
+	}
+}
+
+func TestParseAgentFlagsPreferredRegion(t *testing.T) {
+	base := []string{"--command", "cat", "--http-host", "a.appsync-api.us-east-1.amazonaws.com", "--realtime-host", "r", "--region", "us-east-1"}
+	opts, err := parse_agent_flags(append(base, "--preferred-region", "eu-west-1", "--preferred-http-host", "b.appsync-api.eu-west-1.amazonaws.com", "--channel-scope", "/orders/alice/"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.preferred.RealtimeHost != "b.appsync-realtime-api.eu-west-1.amazonaws.com" || opts.preferred.Namespace != default_channel_namespace {
+		t.Fatalf("unexpected preferred endpoint %+v", opts.preferred)
+	}
+	if got := opts.preferred.ResponseTopic("req-1"); got != "live-lambda/orders/alice/response/req-1" {
+		t.Fatalf("expected the channel scope on the preferred endpoint, got %s", got)
+	}
+	for _, extra := range [][]string{
+		{"--preferred-region", "eu-west-1"},
+		{"--preferred-region", "us-east-1", "--preferred-http-host", "b.appsync-api.us-east-1.amazonaws.com"},
+		{"--preferred-http-host", "b.appsync-api.eu-west-1.amazonaws.com"},
+	} {
+		if _, err := parse_agent_flags(append(append([]string{}, base...), extra...)); err == nil {
+			t.Errorf("expected %v to be rejected", extra)
+		}
+	}
+}
+
+func TestHandlePresenceFollowsExtensionsToStandbyEndpoints(t *testing.T) {
+	primary, standby := &recording_publisher{}, &recording_publisher{}
+	a := new_agent(echo_handler{}, primary.publish, nil)
+
+	a.handle_presence(context.Background(), []byte(`{"type":"probe","function_name":"orders"}`))
+	a.handle_presence_from(context.Background(), []byte(`{"type":"probe","function_name":"orders","endpoint":"b.appsync-api.us-west-2.amazonaws.com"}`), standby.publish)
+	if len(standby.events) != 1 || !strings.Contains(standby.events[0].frame, `"endpoint":"b.appsync-api.us-west-2.amazonaws.com"`) {
+		t.Fatalf("expected a heartbeat naming the standby endpoint, got %+v", standby.events)
+	}
+
+	// Sandboxes still on the primary endpoint keep getting heartbeats too
+	primary.events, standby.events = nil, nil
+	a.send_heartbeat(context.Background(), "orders")
+	if len(primary.events) != 1 || len(standby.events) != 1 || strings.Contains(primary.events[0].frame, "endpoint") {
+		t.Fatalf("expected a heartbeat on each endpoint, got %+v and %+v", primary.events, standby.events)
+	}
+}
+
+func TestParseAgentFlagsFailoverEndpoints(t *testing.T) {
+	base := []string{"--command", "cat", "--http-host", "a.appsync-api.us-east-1.amazonaws.com", "--realtime-host", "r", "--region", "us-east-1"}
+	opts, err := parse_agent_flags(append(base, "--failover-endpoints", "us-west-2=b.appsync-api.us-west-2.amazonaws.com, eu-west-1=c.example.com|c-rt.example.com"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(opts.failover) != 2 || opts.failover[0].RealtimeHost != "b.appsync-realtime-api.us-west-2.amazonaws.com" || opts.failover[1].Region != "eu-west-1" || opts.failover[1].Namespace != default_channel_namespace {
+		t.Fatalf("unexpected failover endpoints %+v", opts.failover)
+	}
+	for _, value := range []string{"b.appsync-api.us-west-2.amazonaws.com", "us-west-2=b.example.com"} {
+		if _, err := parse_agent_flags(append(append([]string{}, base...), "--failover-endpoints", value)); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestHandleRequestPublishesErrorFrame(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_request(context.Background(), request_frame(t, `"fail"`, "error_frames"))
+
+	if len(recorder.events) != 1 || !strings.Contains(recorder.events[0].frame, `"type":"invocation_error"`) || !strings.Contains(recorder.events[0].frame, `"errorType":"Handler.Failed"`) {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+
+	// Extensions that cannot tell an error frame from a response get nothing
+	recorder.events = nil
+	a.handle_request(context.Background(), request_frame(t, `"fail"`))
+	if len(recorder.events) != 0 {
+		t.Fatalf("expected no response without error_frames, got %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestFiltersFunctionsAndProtocol(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, []string{"payments"})
+	a.handle_request(context.Background(), request_frame(t, `{}`))
+	if len(recorder.events) != 0 {
+		t.Fatalf("expected requests for other functions to be ignored, got %+v", recorder.events)
+	}
+
+	a = new_agent(echo_handler{}, recorder.publish, nil)
+	a.handle_request(context.Background(), []byte(`{"request_id":"req-1","event_payload":{},"min_protocol_version":9}`))
+	if len(recorder.events) != 0 {
+		t.Fatalf("expected a request from a newer protocol to be ignored, got %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestAnswersInvalidEnvelopesWithAnError(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_request(context.Background(), []byte(`{"request_id":"req-1","context":{"function_name":"orders"},"capabilities":["response_envelope","error_frames"]}`))
+
+	if len(recorder.events) != 1 || !strings.Contains(recorder.events[0].frame, `"errorType":"LiveLambda.InvalidRequest"`) || !strings.Contains(recorder.events[0].frame, "event_payload") {
+		t.Fatalf("expected an invalid request error, got %+v", recorder.events)
+	}
+}
+
+func TestHandleRequestRunsCommandsInTheFunctionsEnvironment(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "local")
+	recorder := &recording_publisher{}
+	a := new_agent(command_handler{command: `printf "$TABLE_NAME/$DB_PASSWORD/$AWS_LAMBDA_FUNCTION_NAME"`}, recorder.publish, []string{"orders"})
+	a.handle_env_snapshot([]byte(`{"type":"env_snapshot","function_name":"payments","variables":{"TABLE_NAME":"payments"}}`))
+	a.handle_env_snapshot([]byte(`{"type":"env_snapshot","function_name":"orders","variables":{"TABLE_NAME":"orders","DB_PASSWORD":"redacted:sha256:0123456789abcdef","AWS_LAMBDA_FUNCTION_NAME":"stale"},"redacted":["DB_PASSWORD"]}`))
+
+	a.handle_request(context.Background(), request_frame(t, `{}`, "response_envelope"))
+
+	if len(recorder.events) != 1 || !strings.Contains(recorder.events[0].frame, `"body":"orders/local/orders"`) {
+		t.Fatalf("expected the handler to see the published environment, got %+v", recorder.events)
+	}
+	if a.function_environment("payments") != nil {
+		t.Fatal("expected snapshots of functions the agent does not serve to be ignored")
+	}
+}
+
+func TestEnvironmentCarriesTheLocalAPIMetadata(t *testing.T) {
+	request := invocation{Request: protocol.Request{RequestID: "req-1", Metadata: map[string]json.RawMessage{"otel": json.RawMessage(`{"trace_id":"abc"}`)}}}
+	environment := strings.Join(request.environment(), "\n")
+	if !strings.Contains(environment, `LIVE_LAMBDA_METADATA={"otel":{"trace_id":"abc"}}`) {
+		t.Fatalf("expected the metadata in the environment, got %s", environment)
+	}
+	if strings.Contains(strings.Join(invocation{}.environment(), "\n"), "LIVE_LAMBDA_METADATA") {
+		t.Fatal("expected no LIVE_LAMBDA_METADATA without metadata")
+	}
+}
+
+func TestResolveEventDecompressesGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"big":true}`))
+	writer.Close()
+	encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(compressed.Bytes()))
+
+	a := new_agent(echo_handler{}, (&recording_publisher{}).publish, nil)
+	event, err := a.resolve_event(context.Background(), invocation{Request: protocol.Request{EventPayload: encoded, ContentEncoding: content_encoding_gzip}})
+	if err != nil || string(event) != `{"big":true}` {
+		t.Fatalf("unexpected event %q, %v", event, err)
+	}
+}
+
+func TestResolveEventDecodesBinaryEvents(t *testing.T) {
+	encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString([]byte{0xff, 0x00, 'x'}))
+
+	a := new_agent(echo_handler{}, (&recording_publisher{}).publish, nil)
+	event, err := a.resolve_event(context.Background(), invocation{Request: protocol.Request{EventPayload: encoded, EventFormat: binary_event_format}})
+	if err != nil || !bytes.Equal(event, []byte{0xff, 0x00, 'x'}) {
+		t.Fatalf("unexpected event %q, %v", event, err)
+	}
+}
+
+func TestHandleRequestDecryptsEventsAndEncryptsResponses(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+	key := bytes.Repeat([]byte{7}, payload_key_bytes)
+	a.keys.fetch = func(ctx context.Context, description protocol.PayloadKey) ([]byte, error) {
+		return key, nil
+	}
+	request := invocation{Request: protocol.Request{RequestID: "req-1", PayloadKey: &protocol.PayloadKey{KeyARN: "arn:aws:kms:us-east-1:123456789012:key/abc", WrappedKey: "d3JhcHBlZA=="}}}
+	sealed, _ := a.keys.seal(context.Background(), request, json.RawMessage(`{"id":7}`))
+	frame, _ := json.Marshal(map[string]interface{}{
+		"request_id":    "req-1",
+		"event_payload": sealed,
+		"payload_key":   request.PayloadKey,
+		"context":       map[string]interface{}{"function_name": "orders"},
+		"capabilities":  []string{"response_envelope"},
+	})
+
+	a.handle_request(context.Background(), frame)
+
+	var published struct {
+		Body protocol.EncryptedPayload `json:"body"`
+	}
+	if len(recorder.events) != 1 || json.Unmarshal([]byte(recorder.events[0].frame), &published) != nil || published.Body.Type != encrypted_payload_frame_type {
+		t.Fatalf("expected an encrypted response, got %+v", recorder.events)
+	}
+	request.EventPayload, _ = json.Marshal(published.Body)
+	response, err := a.keys.open(context.Background(), request)
+	if err != nil || string(response) != `{"id":7}` {
+		t.Fatalf("unexpected response %q, %v", response, err)
+	}
+
+	// Ciphertext for one request does not decrypt as another's
+	request.RequestID = "req-2"
+	if _, err := a.keys.open(context.Background(), request); err == nil {
+		t.Fatal("expected a response for another request to be rejected")
+	}
+}
+
+func TestHandleRequestSignsResponsesForExtensionsThatVerifyThem(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+	a.signing_secret = []byte("shared secret")
+
+	a.handle_request(context.Background(), request_frame(t, `{"id":7}`, "response_envelope", "signing"))
+
+	var published struct {
+		Body      json.RawMessage `json:"body"`
+		Signature string          `json:"signature"`
+	}
+	json.Unmarshal([]byte(recorder.events[0].frame), &published)
+	expected, _ := sign_response(a.signing_secret, "req-1", json.RawMessage(`{"id": 7}`))
+	if published.Signature == "" || published.Signature != expected {
+		t.Fatalf("expected the body's signature, got %s", recorder.events[0].frame)
+	}
+	capabilities := a.heartbeat()["capabilities"].([]string)
+	if capabilities[len(capabilities)-1] != "signing" || len(agent_capabilities) == len(capabilities) {
+		t.Fatalf("expected signing to be listed, got %v", capabilities)
+	}
+}
+
+func TestHandleRequestSignsClaims(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, []string{"orders"})
+	a.signing_secret = []byte("shared secret")
+
+	a.handle_request(context.Background(), []byte(`{"type":"invocation_offer","request_id":"req-1","function_name":"orders"}`))
+
+	var claim map[string]interface{}
+	json.Unmarshal([]byte(recorder.events[0].frame), &claim)
+	signature, _ := claim["signature"].(string)
+	delete(claim, "signature")
+	expected, _ := sign_response(a.signing_secret, "req-1", claim)
+	if signature == "" || signature != expected {
+		t.Fatalf("expected the claim to be signed over its other fields, got %s", recorder.events[0].frame)
+	}
+}
+
+// The extension checks signatures against the same vector in internal/signing
+func TestSignResponseMatchesTheExtension(t *testing.T) {
+	signature, err := sign_response([]byte("secret"), "req-1", map[string]interface{}{"statusCode": 200, "body": "<ok> & done"})
+	if err != nil || signature != "6VghmQrl0JQL3iKlTmOYXwRqIeYVtjHQ8yAiIiz27po=" {
+		t.Fatalf("unexpected signature %s (%v)", signature, err)
+	}
+}
+
+func TestInvocationDescribesTheServedFunction(t *testing.T) {
+	var request invocation
+	json.Unmarshal([]byte(`{"context":{"function_name":"orders"}}`), &request)
+	if request.served() != "orders" {
+		t.Fatalf("expected the context's function name without a function block, got %q", request.served())
+	}
+	json.Unmarshal([]byte(`{"function":{"name":"orders","version":"7","handler":"index.handler","account_id":"123456789012"}}`), &request)
+	if request.served() != "123456789012/orders:7 (index.handler)" {
+		t.Fatalf("unexpected description %q", request.served())
+	}
+}
+
+func TestHandlePresenceAnswersProbes(t *testing.T) {
+	recorder := &recording_publisher{}
+	a := new_agent(echo_handler{}, recorder.publish, nil)
+
+	a.handle_presence(context.Background(), []byte(`{"type":"probe","function_name":"orders","protocol_version":2,"min_protocol_version":1}`))
+	a.handle_presence(context.Background(), []byte(`{"type":"probe","function_name":"billing","min_protocol_version":9}`))
+
+	if len(recorder.events) != 1 || recorder.events[0].channel != "live-lambda/presence/orders" {
+		t.Fatalf("unexpected events %+v", recorder.events)
+	}
+	var heartbeat struct {
+		Type         string   `json:"type"`
+		AgentID      string   `json:"agent_id"`
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := json.Unmarshal([]byte(recorder.events[0].frame), &heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.Type != "heartbeat" || heartbeat.AgentID != a.id || strings.Join(heartbeat.Capabilities, ",") != strings.Join(agent_capabilities, ",") {
+		t.Fatalf("unexpected heartbeat %+v", heartbeat)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Extensions with LIVE_LAMBDA_PAYLOAD_KEY_ARN set encrypt event_payload as an
+// encrypted_payload frame and describe the key in the envelope's payload_key.
+// The agent decrypts the event with the same key, read from the Secrets
+// Manager secret or unwrapped with kms:Decrypt, and publishes its response or
+// error frame encrypted the same way. Offloaded payloads stay unencrypted.
+
+const (
+	encrypted_payload_frame_type    = protocol.TypeEncryptedPayload
+	payload_encryption_algorithm    = "A256GCM"
+	payload_key_bytes               = 32
+	kms_decrypt_target              = "TrentService.Decrypt"
+	secrets_get_secret_value_target = "secretsmanager.GetSecretValue"
+	aws_json_content_type           = "application/x-amz-json-1.1"
+)
+
+var aws_api_http_client = &http.Client{Timeout: 10 * time.Second}
+
+// payload_keys fetches and caches the keys of the extensions the agent serves.
+type payload_keys struct {
+	fetch func(ctx context.Context, key protocol.PayloadKey) ([]byte, error)
+
+	mu   sync.Mutex
+	keys map[protocol.PayloadKey][]byte
+}
+
+func new_payload_keys(cfg aws.Config) *payload_keys {
+	return &payload_keys{
+		fetch: func(ctx context.Context, key protocol.PayloadKey) ([]byte, error) {
+			return fetch_payload_key(ctx, cfg, key)
+		},
+		keys: map[protocol.PayloadKey][]byte{},
+	}
+}
+
+// key returns the key for a request, fetching it on first use.
+func (k *payload_keys) key(ctx context.Context, description protocol.PayloadKey) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[description]; ok {
+		return key, nil
+	}
+	key, err := k.fetch(ctx, description)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != payload_key_bytes {
+		return nil, fmt.Errorf("%s is not a %d-bit key", description.KeyARN, payload_key_bytes*8)
+	}
+	k.keys[description] = key
+	return key, nil
+}
+
+// open decrypts a request's event_payload, returning the JSON value the
+// extension encrypted.
+func (k *payload_keys) open(ctx context.Context, request invocation) (json.RawMessage, error) {
+	var frame protocol.EncryptedPayload
+	if json.Unmarshal(request.EventPayload, &frame) != nil || frame.Type != encrypted_payload_frame_type {
+		return nil, fmt.Errorf("event_payload is not encrypted")
+	}
+	if frame.Algorithm != payload_encryption_algorithm {
+		return nil, fmt.Errorf("unsupported payload encryption %q", frame.Algorithm)
+	}
+	key, err := k.key(ctx, *request.PayloadKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(frame.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("nonce is not base64: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(frame.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("ciphertext is not base64: %w", err)
+	}
+	aead := new_payload_aead(key)
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce is %d bytes, expected %d", len(nonce), aead.NonceSize())
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(request.RequestID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt event_payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// seal encrypts a response or error frame under the request's key.
+func (k *payload_keys) seal(ctx context.Context, request invocation, message interface{}) (protocol.EncryptedPayload, error) {
+	key, err := k.key(ctx, *request.PayloadKey)
+	if err != nil {
+		return protocol.EncryptedPayload{}, err
+	}
+	plaintext, err := json.Marshal(message)
+	if err != nil {
+		return protocol.EncryptedPayload{}, err
+	}
+	aead := new_payload_aead(key)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return protocol.EncryptedPayload{
+		Type:       encrypted_payload_frame_type,
+		Algorithm:  payload_encryption_algorithm,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, []byte(request.RequestID))),
+	}, nil
+}
+
+// new_payload_aead returns AES-256-GCM for a key payload_keys has checked.
+func new_payload_aead(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// fetch_payload_key unwraps a KMS data key or reads a base64 key from a
+// Secrets Manager secret, in the region of the key's ARN.
+func fetch_payload_key(ctx context.Context, cfg aws.Config, key protocol.PayloadKey) ([]byte, error) {
+	parts := strings.SplitN(key.KeyARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return nil, fmt.Errorf("payload key %q is not an ARN", key.KeyARN)
+	}
+	service, region := parts[2], parts[3]
+	switch service {
+	case "kms":
+		body, _ := json.Marshal(map[string]string{"KeyId": key.KeyARN, "CiphertextBlob": key.WrappedKey})
+		response, err := send_aws_json_request(ctx, cfg, service, region, kms_decrypt_target, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the data key: %w", err)
+		}
+		var decrypted struct {
+			Plaintext string
+		}
+		if err := json.Unmarshal(response, &decrypted); err != nil {
+			return nil, fmt.Errorf("failed to parse the data key: %w", err)
+		}
+		return base64.StdEncoding.DecodeString(decrypted.Plaintext)
+	case "secretsmanager":
+		body, _ := json.Marshal(map[string]string{"SecretId": key.KeyARN})
+		response, err := send_aws_json_request(ctx, cfg, service, region, secrets_get_secret_value_target, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the key secret: %w", err)
+		}
+		var secret struct {
+			SecretString string
+		}
+		if err := json.Unmarshal(response, &secret); err != nil {
+			return nil, fmt.Errorf("failed to parse the key secret: %w", err)
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(secret.SecretString))
+	default:
+		return nil, fmt.Errorf("payload key %s is neither a KMS key nor a secret", key.KeyARN)
+	}
+}
+
+// send_aws_json_request signs and sends an AWS JSON 1.1 API operation.
+func send_aws_json_request(ctx context.Context, cfg aws.Config, service string, region string, target string, body []byte) ([]byte, error) {
+	if cfg.Credentials == nil {
+		return nil, fmt.Errorf("no AWS credentials configured")
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://%s.%s.amazonaws.com", service, region), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", aws_json_content_type)
+	req.Header.Set("X-Amz-Target", target)
+	payload_hash := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(payload_hash[:]), service, region, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign %s request: %w", service, err)
+	}
+	resp, err := aws_api_http_client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	resp_body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s failed with status %d: %s", service, target, resp.StatusCode, string(resp_body))
+	}
+	return resp_body, nil
+}
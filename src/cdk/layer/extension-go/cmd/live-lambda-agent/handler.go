@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"plugin"
+	"strings"
+)
+
+// A handler runs one invocation on the workstation. It returns the response,
+// or a function error to report as if the handler had thrown in Lambda; err is
+// reserved for failures of the agent itself.
+type handler interface {
+	invoke(ctx context.Context, request invocation) (response json.RawMessage, function_error *invocation_error, err error)
+}
+
+// invocation_error is the error frame body, shaped like a Lambda function error.
+type invocation_error struct {
+	ErrorType    string   `json:"errorType"`
+	ErrorMessage string   `json:"errorMessage"`
+	StackTrace   []string `json:"stackTrace,omitempty"`
+}
+
+// as_json_response returns output as is when it is JSON, or as a JSON string.
+func as_json_response(output []byte) json.RawMessage {
+	trimmed := bytes.TrimSpace(output)
+	if len(trimmed) == 0 {
+		return json.RawMessage("null")
+	}
+	if json.Valid(trimmed) {
+		return json.RawMessage(trimmed)
+	}
+	encoded, _ := json.Marshal(string(output))
+	return encoded
+}
+
+// command_handler runs a shell command per invocation. The event is written to
+// its stdin and stdout is the response; a non-zero exit status fails the
+// invocation with stderr as the message.
+type command_handler struct {
+	command string
+}
+
+func (h command_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(request.event)
+	cmd.Env = append(os.Environ(), request.environment()...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = exit_err.Error()
+		}
+		return nil, &invocation_error{ErrorType: "Runtime.ExitError", ErrorMessage: message}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to run %q: %w", h.command, err)
+	}
+	return as_json_response(stdout.Bytes()), nil, nil
+}
+
+// http_handler POSTs the event to a local HTTP endpoint with the Runtime API
+// invocation headers. A 2xx body is the response; any other status fails the
+// invocation, using the body's errorType and errorMessage when it has them.
+type http_handler struct {
+	url    string
+	client *http.Client
+}
+
+func (h http_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(request.event))
+	if err != nil {
+		return nil, nil, err
+	}
+	content_type := "application/json"
+	if request.EventFormat == binary_event_format {
+		content_type = request.ContentType
+		if content_type == "" {
+			content_type = "application/octet-stream"
+		}
+	}
+	req.Header.Set("Content-Type", content_type)
+	req.Header.Set("Lambda-Runtime-Aws-Request-Id", request.RequestID)
+	req.Header.Set("Lambda-Runtime-Invoked-Function-Arn", request.Context.InvokedFunctionARN)
+	req.Header.Set("Lambda-Runtime-Deadline-Ms", request.Context.DeadlineMs)
+	req.Header.Set("Lambda-Runtime-Trace-Id", request.trace_header())
+	identity, client_context := request.caller_headers()
+	if identity != "" {
+		req.Header.Set("Lambda-Runtime-Cognito-Identity", identity)
+	}
+	if client_context != "" {
+		req.Header.Set("Lambda-Runtime-Client-Context", client_context)
+	}
+
+	client := h.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to call %s: %w", h.url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the response from %s: %w", h.url, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return as_json_response(body), nil, nil
+	}
+
+	function_error := &invocation_error{}
+	if json.Unmarshal(body, function_error) != nil || function_error.ErrorType == "" {
+		function_error = &invocation_error{
+			ErrorType:    "HTTPError",
+			ErrorMessage: fmt.Sprintf("%s returned %d: %s", h.url, resp.StatusCode, strings.TrimSpace(string(body))),
+		}
+	}
+	return nil, function_error, nil
+}
+
+// plugin_handler_symbol is the function a Go plugin handler must export.
+const plugin_handler_symbol = "Handler"
+
+// plugin_handler calls a Handler function exported by a Go plugin built with
+// -buildmode=plugin:
+//
+//	func Handler(ctx context.Context, event json.RawMessage) (json.RawMessage, error)
+//
+// A returned error fails the invocation, with the error's ErrorType() as the
+// errorType when it has that method and "Error" otherwise.
+type plugin_handler struct {
+	handle func(ctx context.Context, event json.RawMessage) (json.RawMessage, error)
+}
+
+func open_plugin_handler(path string) (plugin_handler, error) {
+	loaded, err := plugin.Open(path)
+	if err != nil {
+		return plugin_handler{}, fmt.Errorf("failed to open plugin %s: %w", path, err)
+	}
+	symbol, err := loaded.Lookup(plugin_handler_symbol)
+	if err != nil {
+		return plugin_handler{}, fmt.Errorf("plugin %s does not export %s: %w", path, plugin_handler_symbol, err)
+	}
+	handle, ok := symbol.(func(context.Context, json.RawMessage) (json.RawMessage, error))
+	if !ok {
+		return plugin_handler{}, fmt.Errorf("plugin %s exports %s as %T, expected func(context.Context, json.RawMessage) (json.RawMessage, error)", path, plugin_handler_symbol, symbol)
+	}
+	return plugin_handler{handle: handle}, nil
+}
+
+func (h plugin_handler) invoke(ctx context.Context, request invocation) (json.RawMessage, *invocation_error, error) {
+	response, err := h.handle(ctx, request.event)
+	if err != nil {
+		error_type := "Error"
+		var typed interface{ ErrorType() string }
+		if errors.As(err, &typed) {
+			error_type = typed.ErrorType()
+		}
+		return nil, &invocation_error{ErrorType: error_type, ErrorMessage: err.Error()}, nil
+	}
+	if response == nil {
+		return json.RawMessage("null"), nil, nil
+	}
+	return response, nil, nil
+}
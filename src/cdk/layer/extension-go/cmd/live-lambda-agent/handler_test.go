@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestCommandHandler(t *testing.T) {
+	request := invocation{Request: protocol.Request{RequestID: "req-1"}, event: json.RawMessage(`{"id":1}`)}
+
+	response, function_error, err := command_handler{command: "cat"}.invoke(context.Background(), request)
+	if err != nil || function_error != nil || string(response) != `{"id":1}` {
+		t.Fatalf("unexpected result %q, %+v, %v", response, function_error, err)
+	}
+
+	response, _, _ = command_handler{command: `printf "$LIVE_LAMBDA_REQUEST_ID"`}.invoke(context.Background(), request)
+	if string(response) != `"req-1"` {
+		t.Fatalf("expected non-JSON output as a JSON string, got %s", response)
+	}
+
+	_, function_error, err = command_handler{command: "echo boom >&2; exit 3"}.invoke(context.Background(), request)
+	if err != nil || function_error == nil || function_error.ErrorType != "Runtime.ExitError" || function_error.ErrorMessage != "boom" {
+		t.Fatalf("unexpected failure %+v, %v", function_error, err)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == `"fail"` {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errorType":"Handler.Failed","errorMessage":"nope"}`))
+			return
+		}
+		if identity := r.Header.Get("Lambda-Runtime-Cognito-Identity"); identity != "" {
+			w.Write([]byte(identity))
+			return
+		}
+		w.Write([]byte(`{"request_id":"` + r.Header.Get("Lambda-Runtime-Aws-Request-Id") + `"}`))
+	}))
+	defer server.Close()
+	h := http_handler{url: server.URL, client: server.Client()}
+
+	response, function_error, err := h.invoke(context.Background(), invocation{Request: protocol.Request{RequestID: "req-1"}, event: json.RawMessage(`{}`)})
+	if err != nil || function_error != nil || string(response) != `{"request_id":"req-1"}` {
+		t.Fatalf("unexpected result %q, %+v, %v", response, function_error, err)
+	}
+
+	_, function_error, err = h.invoke(context.Background(), invocation{Request: protocol.Request{RequestID: "req-2"}, event: json.RawMessage(`"fail"`)})
+	if err != nil || function_error == nil || function_error.ErrorType != "Handler.Failed" {
+		t.Fatalf("unexpected failure %+v, %v", function_error, err)
+	}
+
+	identity := &protocol.CognitoIdentity{IdentityID: "identity-id", IdentityPoolID: "pool-id"}
+	response, _, err = h.invoke(context.Background(), invocation{Request: protocol.Request{RequestID: "req-3", Context: protocol.Context{Identity: identity}}, event: json.RawMessage(`{}`)})
+	if err != nil || string(response) != `{"cognitoIdentityId":"identity-id","cognitoIdentityPoolId":"pool-id"}` {
+		t.Fatalf("expected the handler to get the Cognito identity header, got %q, %v", response, err)
+	}
+}
@@ -0,0 +1,319 @@
+// Command live-lambda-agent serves live-lambda invocations from a developer
+// machine without Node.js.
+//
+// Usage:
+//
+//	live-lambda-agent --command 'python handler.py'
+//	live-lambda-agent --url http://localhost:8080/invoke --functions my-function
+//	live-lambda-agent --plugin ./handler.so
+//
+// It subscribes to live-lambda/requests, runs each invocation through exactly
+// one local handler, and publishes the result on
+// live-lambda/response/{request_id}. A command handler gets the event on stdin
+// and answers on stdout; an HTTP handler receives the event as a POST with the
+// Runtime API invocation headers; a Go plugin exports a Handler function (see
+// plugin_handler). The agent answers presence probes itself, so extensions
+// only forward invocations while it is running.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"live-lambda-extension-go/internal/connection"
+
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+const agent_print_prefix = "[LiveLambdaAgent]"
+
+type agent_options struct {
+	connection.Options
+	command     string
+	url         string
+	plugin_path string
+	functions   string
+	secret_arn  string             // the secret to sign responses with, see signing.go
+	preferred   connection.Options // the preferred region's endpoint, when --preferred-region is set
+	// failover_endpoints are the extensions' standby endpoints, see --failover-endpoints
+	failover_endpoints string
+	failover           []connection.Options
+}
+
+func parse_agent_flags(args []string) (agent_options, error) {
+	var opts agent_options
+	flags := flag.NewFlagSet("live-lambda-agent", flag.ContinueOnError)
+	flags.StringVar(&opts.command, "command", "", "shell command to run per invocation (event on stdin, response on stdout)")
+	flags.StringVar(&opts.url, "url", "", "local HTTP endpoint to POST each event to")
+	flags.StringVar(&opts.plugin_path, "plugin", "", "Go plugin (-buildmode=plugin) exporting Handler")
+	flags.StringVar(&opts.functions, "functions", "", "comma-separated function names to serve (defaults to all)")
+	flags.StringVar(&opts.secret_arn, "signing-secret-arn", os.Getenv("LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN"), "SSM parameter or Secrets Manager secret to sign responses with")
+	flags.StringVar(&opts.preferred.Region, "preferred-region", "", "ask extensions with regional endpoints to tunnel through this region")
+	flags.StringVar(&opts.preferred.HTTPHost, "preferred-http-host", "", "AppSync Events HTTP host in --preferred-region")
+	flags.StringVar(&opts.preferred.RealtimeHost, "preferred-realtime-host", "", "AppSync Events realtime host in --preferred-region (defaults to the HTTP host's appsync-realtime-api host)")
+	flags.StringVar(&opts.failover_endpoints, "failover-endpoints", os.Getenv("LIVE_LAMBDA_FAILOVER_ENDPOINTS"), "the extensions' standby endpoints as region=http_host[|realtime_host],..., to follow them there")
+	opts.Options.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	handlers := 0
+	for _, value := range []string{opts.command, opts.url, opts.plugin_path} {
+		if value != "" {
+			handlers++
+		}
+	}
+	if handlers != 1 {
+		return opts, fmt.Errorf("exactly one of --command, --url or --plugin is required")
+	}
+	if err := opts.Options.Validate(); err != nil {
+		return opts, err
+	}
+	if err := opts.validate_preferred(); err != nil {
+		return opts, err
+	}
+	return opts, opts.parse_failover()
+}
+
+// validate_preferred checks the preferred region's endpoint, which is served
+// alongside the primary one; see regional.go in the extension.
+func (o *agent_options) validate_preferred() error {
+	p := &o.preferred
+	if p.Region == "" {
+		if p.HTTPHost != "" || p.RealtimeHost != "" {
+			return fmt.Errorf("--preferred-http-host and --preferred-realtime-host need --preferred-region")
+		}
+		return nil
+	}
+	if p.Region == o.Region {
+		return fmt.Errorf("--preferred-region %s is the primary endpoint's region; leave it out", p.Region)
+	}
+	if p.HTTPHost == "" {
+		return fmt.Errorf("--preferred-region needs --preferred-http-host")
+	}
+	if p.RealtimeHost == "" {
+		if !strings.Contains(p.HTTPHost, ".appsync-api.") {
+			return fmt.Errorf("--preferred-realtime-host is required when --preferred-http-host is not an appsync-api host")
+		}
+		p.RealtimeHost = strings.Replace(p.HTTPHost, ".appsync-api.", ".appsync-realtime-api.", 1)
+	}
+	p.Namespace = o.Namespace
+	p.ChannelScope = o.ChannelScope
+	p.RequestsChannel = o.RequestsChannel
+	p.ResponseChannel = o.ResponseChannel
+	return nil
+}
+
+// parse_failover parses --failover-endpoints, which the agent connects to
+// alongside the primary endpoint; see endpoint_failover.go in the extension.
+func (o *agent_options) parse_failover() error {
+	for _, entry := range strings.Split(o.failover_endpoints, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		region, hosts, ok := strings.Cut(entry, "=")
+		http_host, realtime_host, _ := strings.Cut(hosts, "|")
+		region, http_host, realtime_host = strings.TrimSpace(region), strings.TrimSpace(http_host), strings.TrimSpace(realtime_host)
+		if !ok || region == "" || http_host == "" {
+			return fmt.Errorf("--failover-endpoints: %q is not region=http_host[|realtime_host]", entry)
+		}
+		if realtime_host == "" {
+			if !strings.Contains(http_host, ".appsync-api.") {
+				return fmt.Errorf("--failover-endpoints: %s needs a realtime host, as it is not an appsync-api host", http_host)
+			}
+			realtime_host = strings.Replace(http_host, ".appsync-api.", ".appsync-realtime-api.", 1)
+		}
+		standby := o.Options
+		standby.Region = region
+		standby.HTTPHost = http_host
+		standby.RealtimeHost = realtime_host
+		o.failover = append(o.failover, standby)
+	}
+	return nil
+}
+
+// function_list splits --functions, dropping empty entries.
+func (o agent_options) function_list() []string {
+	var functions []string
+	for _, function_name := range strings.Split(o.functions, ",") {
+		if function_name = strings.TrimSpace(function_name); function_name != "" {
+			functions = append(functions, function_name)
+		}
+	}
+	return functions
+}
+
+func (o agent_options) new_handler() (handler, error) {
+	switch {
+	case o.command != "":
+		return command_handler{command: o.command}, nil
+	case o.url != "":
+		return http_handler{url: o.url, client: &http.Client{}}, nil
+	default:
+		return open_plugin_handler(o.plugin_path)
+	}
+}
+
+// channel_payload_bytes normalizes an AppSync event, which may arrive decoded or as a JSON string.
+func channel_payload_bytes(data_payload interface{}) ([]byte, error) {
+	if encoded, ok := data_payload.(string); ok {
+		return []byte(encoded), nil
+	}
+	return json.Marshal(data_payload)
+}
+
+func run(args []string) error {
+	opts, err := parse_agent_flags(args)
+	if err != nil {
+		return err
+	}
+	h, err := opts.new_handler()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	a := new_agent(h, client.Publish, opts.function_list())
+	a.namespace = opts.Namespace
+	a.scope = opts.ChannelScope
+	a.requests = opts.RequestsChannel
+	a.response = opts.ResponseChannel
+	a.preferred_region = opts.preferred.Region
+	aws_cfg, err := connection.LoadAWSConfig(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	// Decrypts payloads from extensions that encrypt them
+	a.keys = new_payload_keys(aws_cfg)
+	if opts.secret_arn != "" {
+		if a.signing_secret, err = read_signing_secret(ctx, aws_cfg, opts.secret_arn); err != nil {
+			return err
+		}
+	}
+	if err := subscribe_agent(ctx, client, a); err != nil {
+		return err
+	}
+	if opts.preferred.Region != "" {
+		// Requests arrive here while the extension's route to the preferred
+		// region is healthy, and on the primary endpoint otherwise
+		preferred, err := connection.Connect(ctx, opts.preferred)
+		if err != nil {
+			return fmt.Errorf("failed to connect in %s: %w", opts.preferred.Region, err)
+		}
+		defer preferred.Close()
+		if err := subscribe_requests(ctx, preferred, a, preferred.Publish); err != nil {
+			return err
+		}
+		log.Printf("%s Preferring %s through %s", agent_print_prefix, opts.preferred.Region, opts.preferred.RealtimeHost)
+	}
+	for _, standby := range opts.failover {
+		// Extensions that fail over probe here, and the agent heartbeats
+		// and answers requests on the endpoint they use
+		client, err := connection.Connect(ctx, standby)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", standby.HTTPHost, err)
+		}
+		defer client.Close()
+		if err := subscribe_requests(ctx, client, a, client.Publish); err != nil {
+			return err
+		}
+		if err := subscribe_presence(ctx, client, a, client.Publish); err != nil {
+			return err
+		}
+		log.Printf("%s Standing by on %s", agent_print_prefix, standby.HTTPHost)
+	}
+	log.Printf("%s Agent %s is serving %s", agent_print_prefix, a.id, describe_functions(opts.function_list()))
+
+	go a.run_heartbeats(ctx)
+	<-ctx.Done()
+	log.Printf("%s Shutting down", agent_print_prefix)
+	return nil
+}
+
+// subscribe_agent routes the requests, presence and env channels to the agent.
+func subscribe_agent(ctx context.Context, client *appsyncwsclient.Client, a *agent) error {
+	if err := subscribe_requests(ctx, client, a, nil); err != nil {
+		return err
+	}
+	if err := subscribe_presence(ctx, client, a, nil); err != nil {
+		return err
+	}
+	if _, err := client.Subscribe(ctx, a.channel(env_topic_pattern), func(data_payload interface{}) {
+		frame, err := channel_payload_bytes(data_payload)
+		if err != nil {
+			return
+		}
+		a.handle_env_snapshot(frame)
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", a.channel(env_topic_pattern), err)
+	}
+	return nil
+}
+
+// subscribe_presence hands the presence frames published through client to
+// a, which heartbeats with reply (nil for the primary connection).
+func subscribe_presence(ctx context.Context, client *appsyncwsclient.Client, a *agent, reply publisher) error {
+	if _, err := client.Subscribe(ctx, a.channel(presence_topic_pattern), func(data_payload interface{}) {
+		frame, err := channel_payload_bytes(data_payload)
+		if err != nil {
+			return
+		}
+		a.handle_presence_from(ctx, frame, reply)
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", a.channel(presence_topic_pattern), err)
+	}
+	return nil
+}
+
+// subscribe_requests hands the requests published through client, on the
+// requests channel and the agent's private channel, to a, which answers them
+// with reply (nil for the primary connection).
+func subscribe_requests(ctx context.Context, client *appsyncwsclient.Client, a *agent, reply publisher) error {
+	for _, channel := range []string{a.requests_topic(), a.channel(agent_topic_format, a.id)} {
+		if _, err := client.Subscribe(ctx, channel, func(data_payload interface{}) {
+			frame, err := channel_payload_bytes(data_payload)
+			if err != nil {
+				log.Printf("%s Error decoding request: %v", agent_print_prefix, err)
+				return
+			}
+			go a.handle_request_from(ctx, frame, reply)
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", channel, err)
+		}
+	}
+	return nil
+}
+
+func describe_functions(functions []string) string {
+	if len(functions) == 0 {
+		return "all functions"
+	}
+	return strings.Join(functions, ", ")
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s %v\n", agent_print_prefix, err)
+		os.Exit(1)
+	}
+}
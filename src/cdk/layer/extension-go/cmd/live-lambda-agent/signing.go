@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"live-lambda-extension-go/internal/signing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Extensions with LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN set only post
+// responses signed with the secret it names. With --signing-secret-arn the
+// agent reads the same secret, lists the signing capability and adds a
+// signature to every response envelope: the base64 HMAC-SHA256 of the request
+// ID, a newline and the envelope's body as canonical JSON. Claims are signed
+// the same way over the whole frame, since the extension drops unsigned ones.
+// The scheme is shared with the extension through internal/signing.
+
+const ssm_get_parameter_target = "AmazonSSM.GetParameter"
+
+// read_signing_secret reads an SSM parameter or a Secrets Manager secret.
+func read_signing_secret(ctx context.Context, cfg aws.Config, secret_arn string) ([]byte, error) {
+	parts := strings.SplitN(secret_arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return nil, fmt.Errorf("signing secret %q is not an ARN", secret_arn)
+	}
+	service, region := parts[2], parts[3]
+	var secret string
+	switch service {
+	case "ssm":
+		body, _ := json.Marshal(map[string]interface{}{"Name": secret_arn, "WithDecryption": true})
+		response, err := send_aws_json_request(ctx, cfg, service, region, ssm_get_parameter_target, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the signing parameter: %w", err)
+		}
+		var parameter struct {
+			Parameter struct {
+				Value string
+			}
+		}
+		if err := json.Unmarshal(response, &parameter); err != nil {
+			return nil, fmt.Errorf("failed to parse the signing parameter: %w", err)
+		}
+		secret = parameter.Parameter.Value
+	case "secretsmanager":
+		body, _ := json.Marshal(map[string]string{"SecretId": secret_arn})
+		response, err := send_aws_json_request(ctx, cfg, service, region, secrets_get_secret_value_target, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the signing secret: %w", err)
+		}
+		var value struct {
+			SecretString string
+		}
+		if err := json.Unmarshal(response, &value); err != nil {
+			return nil, fmt.Errorf("failed to parse the signing secret: %w", err)
+		}
+		secret = value.SecretString
+	default:
+		return nil, fmt.Errorf("signing secret %s is neither an SSM parameter nor a secret", secret_arn)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("signing secret %s is empty", secret_arn)
+	}
+	return []byte(secret), nil
+}
+
+// sign_response returns the signature of a response envelope's body, or of a
+// whole claim frame.
+func sign_response(secret []byte, request_id string, body interface{}) (string, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	signature, err := signing.Sign(secret, request_id, encoded)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
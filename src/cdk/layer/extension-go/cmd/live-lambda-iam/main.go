@@ -0,0 +1,144 @@
+// Command live-lambda-iam prints the IAM policies live-lambda needs and checks
+// that the current credentials can use the Events API.
+//
+// Usage:
+//
+//	live-lambda-iam --api-arn arn:aws:appsync:us-east-1:123456789012:apis/abcdefghij
+//	live-lambda-iam --api-arn <arn> --namespace live-lambda-dev --side extension
+//	live-lambda-iam --api-arn <arn> --verify
+//
+// It prints two minimal policy documents as one JSON object: "extension", for
+// the execution roles of the functions running the layer, and "agent", for the
+// developer credentials the agent runs with. Both allow appsync:EventConnect
+// on the API and appsync:EventPublish and appsync:EventSubscribe on the one
+// channel namespace only. The extension is also allowed lambda:GetFunction on
+// the functions named by --function-name (default all in the API's account
+// and region) for the live-lambda:enabled tag lookup, unless
+// --tag-lookup=false. --offload-bucket, --mailbox-queue-url,
+// --payload-key-arn, --signing-secret-arn and --routing-rules-arn add the
+// grants for those features. --side prints one document on its own, ready for
+// aws iam put-role-policy.
+//
+// --verify instead connects to the Events API with the default AWS credential
+// chain, subscribes to a lifecycle channel in the namespace, publishes on it
+// and waits for the event to come back, reporting each step, so missing
+// permissions show up before a dev session rather than as invocations that
+// never reach the agent.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	iam_print_prefix          = "[LiveLambdaIAM]"
+	default_channel_namespace = "live-lambda"
+	side_both                 = "both"
+	side_extension            = "extension"
+	side_agent                = "agent"
+)
+
+type iam_options struct {
+	api_arn            string
+	namespace          string
+	side               string
+	offload_bucket     string
+	mailbox_queue_url  string
+	payload_key_arn    string
+	signing_secret_arn string
+	routing_rules_arn  string
+	dynamic_config_arn string
+	tag_lookup         bool
+	function_name      string
+
+	verify        bool
+	http_host     string
+	realtime_host string
+	timeout       time.Duration
+}
+
+func parse_iam_flags(args []string) (iam_options, error) {
+	var opts iam_options
+	flags := flag.NewFlagSet("live-lambda-iam", flag.ContinueOnError)
+	flags.StringVar(&opts.api_arn, "api-arn", "", "ARN of the AppSync Events API (required)")
+	flags.StringVar(&opts.namespace, "namespace", os.Getenv("LIVE_LAMBDA_APPSYNC_NAMESPACE"), "channel namespace, e.g. live-lambda-dev for the dev stage (defaults to live-lambda)")
+	flags.StringVar(&opts.side, "side", side_both, "policy to print: extension, agent or both")
+	flags.StringVar(&opts.offload_bucket, "offload-bucket", "", "payload offload bucket (LIVE_LAMBDA_OFFLOAD_BUCKET)")
+	flags.StringVar(&opts.mailbox_queue_url, "mailbox-queue-url", "", "pull delivery queue URL (LIVE_LAMBDA_MAILBOX_QUEUE_URL)")
+	flags.StringVar(&opts.payload_key_arn, "payload-key-arn", "", "KMS key or Secrets Manager secret ARN (LIVE_LAMBDA_PAYLOAD_KEY_ARN)")
+	flags.StringVar(&opts.signing_secret_arn, "signing-secret-arn", "", "SSM parameter or Secrets Manager secret ARN (LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN)")
+	flags.StringVar(&opts.routing_rules_arn, "routing-rules-arn", "", "SSM parameter ARN holding the routing rules (LIVE_LAMBDA_ROUTING_RULES)")
+	flags.StringVar(&opts.dynamic_config_arn, "dynamic-config-parameter", "", "SSM parameter ARN holding dynamic settings (LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER)")
+	flags.BoolVar(&opts.tag_lookup, "tag-lookup", true, "grant lambda:GetFunction for the live-lambda:enabled tag lookup (LIVE_LAMBDA_TAG_LOOKUP)")
+	flags.StringVar(&opts.function_name, "function-name", "*", "name or name pattern of the functions running the layer, for the tag lookup grant")
+	flags.BoolVar(&opts.verify, "verify", false, "connect, subscribe and publish with the current credentials instead of printing policies")
+	flags.StringVar(&opts.http_host, "http-host", os.Getenv("LIVE_LAMBDA_APPSYNC_HTTP_HOST"), "AppSync Events HTTP host, for --verify")
+	flags.StringVar(&opts.realtime_host, "realtime-host", os.Getenv("LIVE_LAMBDA_APPSYNC_REALTIME_HOST"), "AppSync Events realtime host, for --verify")
+	flags.DurationVar(&opts.timeout, "timeout", 10*time.Second, "how long --verify waits for each step")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.api_arn == "" {
+		return opts, fmt.Errorf("--api-arn is required")
+	}
+	if _, err := parse_api_arn(opts.api_arn); err != nil {
+		return opts, err
+	}
+	if opts.namespace == "" {
+		opts.namespace = default_channel_namespace
+	}
+	switch opts.side {
+	case side_both, side_extension, side_agent:
+	default:
+		return opts, fmt.Errorf("--side must be extension, agent or both, got %q", opts.side)
+	}
+	if opts.verify {
+		if opts.http_host == "" || opts.realtime_host == "" {
+			return opts, fmt.Errorf("--verify needs --http-host and --realtime-host (or LIVE_LAMBDA_APPSYNC_HTTP_HOST and LIVE_LAMBDA_APPSYNC_REALTIME_HOST)")
+		}
+		if opts.timeout <= 0 {
+			return opts, fmt.Errorf("--timeout must be greater than zero")
+		}
+	}
+	return opts, nil
+}
+
+func run(args []string) error {
+	opts, err := parse_iam_flags(args)
+	if err != nil {
+		return err
+	}
+
+	if opts.verify {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return verify_access(ctx, opts, os.Stdout)
+	}
+
+	policies, err := build_policies(opts)
+	if err != nil {
+		return err
+	}
+	var output interface{} = policies
+	if opts.side != side_both {
+		output = policies[opts.side]
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", iam_print_prefix, err)
+		os.Exit(1)
+	}
+}
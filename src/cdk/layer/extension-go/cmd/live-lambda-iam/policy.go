@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const policy_version = "2012-10-17"
+
+type policy_document struct {
+	Version   string             `json:"Version"`
+	Statement []policy_statement `json:"Statement"`
+}
+
+type policy_statement struct {
+	Sid      string   `json:"Sid"`
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// api_arn is a parsed AppSync API ARN.
+type api_arn struct {
+	arn       string
+	partition string
+	region    string
+	account   string
+}
+
+func parse_api_arn(arn string) (api_arn, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "appsync" || parts[3] == "" || parts[4] == "" || !strings.HasPrefix(parts[5], "apis/") || len(parts[5]) == len("apis/") {
+		return api_arn{}, fmt.Errorf("%q is not an AppSync API ARN (arn:aws:appsync:<region>:<account>:apis/<id>)", arn)
+	}
+	return api_arn{arn: arn, partition: parts[1], region: parts[3], account: parts[4]}, nil
+}
+
+// build_policies returns the extension and agent policies for opts, keyed by side.
+func build_policies(opts iam_options) (map[string]policy_document, error) {
+	api, err := parse_api_arn(opts.api_arn)
+	if err != nil {
+		return nil, err
+	}
+	appsync := []policy_statement{
+		statement("LiveLambdaConnect", []string{"appsync:EventConnect"}, api.arn),
+		statement("LiveLambdaChannels", []string{"appsync:EventPublish", "appsync:EventSubscribe"}, fmt.Sprintf("%s/channelNamespace/%s", api.arn, opts.namespace)),
+	}
+	extension := append([]policy_statement(nil), appsync...)
+	agent := append([]policy_statement(nil), appsync...)
+
+	// The extension reads its own tags at init, see function_tags.go
+	if opts.tag_lookup {
+		function_name := opts.function_name
+		if function_name == "" {
+			function_name = "*"
+		}
+		extension = append(extension, statement("LiveLambdaFunctionTags", []string{"lambda:GetFunction"},
+			fmt.Sprintf("arn:%s:lambda:%s:%s:function:%s", api.partition, api.region, api.account, function_name)))
+	}
+	// The agent reads and writes offloaded payloads through presigned URLs
+	if opts.offload_bucket != "" {
+		extension = append(extension, statement("LiveLambdaOffload", []string{"s3:GetObject", "s3:PutObject", "s3:PutObjectTagging"},
+			fmt.Sprintf("arn:%s:s3:::%s/live-lambda/payloads/*", api.partition, opts.offload_bucket),
+			fmt.Sprintf("arn:%s:s3:::%s/live-lambda/recordings/*", api.partition, opts.offload_bucket)))
+	}
+	if opts.mailbox_queue_url != "" {
+		queue, err := queue_arn_from_url(api.partition, opts.mailbox_queue_url)
+		if err != nil {
+			return nil, err
+		}
+		extension = append(extension, statement("LiveLambdaMailbox", []string{"sqs:SendMessage"}, queue))
+		agent = append(agent, statement("LiveLambdaMailbox", []string{"sqs:ReceiveMessage", "sqs:DeleteMessage"}, queue))
+	}
+	if opts.payload_key_arn != "" {
+		switch arn_service(opts.payload_key_arn) {
+		case "kms":
+			extension = append(extension, statement("LiveLambdaPayloadKey", []string{"kms:GenerateDataKey"}, opts.payload_key_arn))
+			agent = append(agent, statement("LiveLambdaPayloadKey", []string{"kms:Decrypt"}, opts.payload_key_arn))
+		case "secretsmanager":
+			extension = append(extension, statement("LiveLambdaPayloadKey", []string{"secretsmanager:GetSecretValue"}, opts.payload_key_arn))
+			agent = append(agent, statement("LiveLambdaPayloadKey", []string{"secretsmanager:GetSecretValue"}, opts.payload_key_arn))
+		default:
+			return nil, fmt.Errorf("--payload-key-arn must be a KMS key or Secrets Manager secret ARN, got %q", opts.payload_key_arn)
+		}
+	}
+	if opts.signing_secret_arn != "" {
+		var action string
+		switch arn_service(opts.signing_secret_arn) {
+		case "ssm":
+			action = "ssm:GetParameter"
+		case "secretsmanager":
+			action = "secretsmanager:GetSecretValue"
+		default:
+			return nil, fmt.Errorf("--signing-secret-arn must be an SSM parameter or Secrets Manager secret ARN, got %q", opts.signing_secret_arn)
+		}
+		extension = append(extension, statement("LiveLambdaSigningSecret", []string{action}, opts.signing_secret_arn))
+		agent = append(agent, statement("LiveLambdaSigningSecret", []string{action}, opts.signing_secret_arn))
+	}
+	if opts.routing_rules_arn != "" {
+		if arn_service(opts.routing_rules_arn) != "ssm" {
+			return nil, fmt.Errorf("--routing-rules-arn must be an SSM parameter ARN, got %q", opts.routing_rules_arn)
+		}
+		extension = append(extension, statement("LiveLambdaRoutingRules", []string{"ssm:GetParameter"}, opts.routing_rules_arn))
+	}
+	if opts.dynamic_config_arn != "" {
+		if arn_service(opts.dynamic_config_arn) != "ssm" {
+			return nil, fmt.Errorf("--dynamic-config-parameter must be an SSM parameter ARN, got %q", opts.dynamic_config_arn)
+		}
+		extension = append(extension, statement("LiveLambdaDynamicConfig", []string{"ssm:GetParameter"}, opts.dynamic_config_arn))
+	}
+
+	return map[string]policy_document{
+		side_extension: {Version: policy_version, Statement: extension},
+		side_agent:     {Version: policy_version, Statement: agent},
+	}, nil
+}
+
+func statement(sid string, actions []string, resources ...string) policy_statement {
+	return policy_statement{Sid: sid, Effect: "Allow", Action: actions, Resource: resources}
+}
+
+// arn_service returns the service segment of an ARN.
+func arn_service(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[2]
+}
+
+// queue_arn_from_url turns https://sqs.{region}.amazonaws.com/{account}/{name}
+// into the queue ARN.
+func queue_arn_from_url(partition string, queue_url string) (string, error) {
+	parsed, err := url.Parse(queue_url)
+	if err != nil {
+		return "", fmt.Errorf("not an SQS queue URL: %s", queue_url)
+	}
+	host := strings.Split(parsed.Hostname(), ".")
+	path := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(host) < 2 || host[0] != "sqs" || len(path) != 2 || path[0] == "" || path[1] == "" {
+		return "", fmt.Errorf("not an SQS queue URL: %s", queue_url)
+	}
+	return fmt.Sprintf("arn:%s:sqs:%s:%s:%s", partition, host[1], path[0], path[1]), nil
+}
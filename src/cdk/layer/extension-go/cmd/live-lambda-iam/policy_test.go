@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+const test_api_arn = "arn:aws:appsync:us-east-1:123456789012:apis/abcdefghij"
+
+func TestParseIAMFlagsRequiresAPIArn(t *testing.T) {
+	if _, err := parse_iam_flags(nil); err == nil {
+		t.Fatalf("expected an error without --api-arn")
+	}
+	if _, err := parse_iam_flags([]string{"--api-arn", "arn:aws:lambda:us-east-1:123456789012:function:orders"}); err == nil {
+		t.Fatalf("expected an error for a non-AppSync ARN")
+	}
+	opts, err := parse_iam_flags([]string{"--api-arn", test_api_arn})
+	if err != nil {
+		t.Fatalf("parse_iam_flags: %v", err)
+	}
+	if opts.namespace != default_channel_namespace || opts.side != side_both || !opts.tag_lookup || opts.function_name != "*" {
+		t.Fatalf("unexpected defaults: %+v", opts)
+	}
+	if _, err := parse_iam_flags([]string{"--api-arn", test_api_arn, "--verify", "--http-host", "", "--realtime-host", ""}); err == nil {
+		t.Fatalf("expected --verify to require the hosts")
+	}
+}
+
+func TestBuildPoliciesScopesChannelsToNamespace(t *testing.T) {
+	policies, err := build_policies(iam_options{api_arn: test_api_arn, namespace: "live-lambda-dev"})
+	if err != nil {
+		t.Fatalf("build_policies: %v", err)
+	}
+	for _, side := range []string{side_extension, side_agent} {
+		statements := policies[side].Statement
+		if len(statements) != 2 {
+			t.Fatalf("%s: expected only the AppSync statements, got %+v", side, statements)
+		}
+		if !reflect.DeepEqual(statements[0].Resource, []string{test_api_arn}) {
+			t.Fatalf("%s: connect resource = %v", side, statements[0].Resource)
+		}
+		if want := test_api_arn + "/channelNamespace/live-lambda-dev"; !reflect.DeepEqual(statements[1].Resource, []string{want}) {
+			t.Fatalf("%s: channel resource = %v, want %s", side, statements[1].Resource, want)
+		}
+	}
+}
+
+func TestBuildPoliciesSplitsFeatureGrantsBySide(t *testing.T) {
+	policies, err := build_policies(iam_options{
+		api_arn:            test_api_arn,
+		namespace:          default_channel_namespace,
+		offload_bucket:     "payloads",
+		mailbox_queue_url:  "https://sqs.us-east-1.amazonaws.com/123456789012/live-lambda-mailbox",
+		payload_key_arn:    "arn:aws:kms:us-east-1:123456789012:key/1234",
+		signing_secret_arn: "arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/signing",
+		routing_rules_arn:  "arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/routing",
+		dynamic_config_arn: "arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/settings",
+	})
+	if err != nil {
+		t.Fatalf("build_policies: %v", err)
+	}
+	actions := func(side string) map[string][]string {
+		found := map[string][]string{}
+		for _, statement := range policies[side].Statement {
+			found[statement.Sid] = statement.Action
+		}
+		return found
+	}
+
+	extension := actions(side_extension)
+	if _, ok := extension["LiveLambdaOffload"]; !ok {
+		t.Fatalf("extension policy is missing the offload grant: %v", extension)
+	}
+	if !reflect.DeepEqual(extension["LiveLambdaMailbox"], []string{"sqs:SendMessage"}) || !reflect.DeepEqual(extension["LiveLambdaPayloadKey"], []string{"kms:GenerateDataKey"}) {
+		t.Fatalf("unexpected extension grants: %v", extension)
+	}
+
+	agent := actions(side_agent)
+	if _, ok := agent["LiveLambdaOffload"]; ok {
+		t.Fatalf("agent policy should not reach the bucket: %v", agent)
+	}
+	if !reflect.DeepEqual(agent["LiveLambdaMailbox"], []string{"sqs:ReceiveMessage", "sqs:DeleteMessage"}) || !reflect.DeepEqual(agent["LiveLambdaPayloadKey"], []string{"kms:Decrypt"}) {
+		t.Fatalf("unexpected agent grants: %v", agent)
+	}
+	if !reflect.DeepEqual(agent["LiveLambdaSigningSecret"], []string{"ssm:GetParameter"}) {
+		t.Fatalf("unexpected signing grant: %v", agent)
+	}
+	if !reflect.DeepEqual(extension["LiveLambdaRoutingRules"], []string{"ssm:GetParameter"}) {
+		t.Fatalf("expected the extension to read the routing rules: %v", extension)
+	}
+	if _, ok := agent["LiveLambdaRoutingRules"]; ok {
+		t.Fatalf("agent policy should not read the routing rules: %v", agent)
+	}
+	if !reflect.DeepEqual(extension["LiveLambdaDynamicConfig"], []string{"ssm:GetParameter"}) {
+		t.Fatalf("expected the extension to read the dynamic settings: %v", extension)
+	}
+	if _, ok := agent["LiveLambdaDynamicConfig"]; ok {
+		t.Fatalf("agent policy should not read the dynamic settings: %v", agent)
+	}
+
+	for _, statement := range policies[side_agent].Statement {
+		if statement.Sid == "LiveLambdaMailbox" && statement.Resource[0] != "arn:aws:sqs:us-east-1:123456789012:live-lambda-mailbox" {
+			t.Fatalf("queue ARN = %s", statement.Resource[0])
+		}
+	}
+}
+
+func TestBuildPoliciesGrantsTheTagLookupToTheExtension(t *testing.T) {
+	policies, err := build_policies(iam_options{api_arn: test_api_arn, namespace: default_channel_namespace, tag_lookup: true, function_name: "orders-*"})
+	if err != nil {
+		t.Fatalf("build_policies: %v", err)
+	}
+	var found bool
+	for _, statement := range policies[side_extension].Statement {
+		if statement.Sid == "LiveLambdaFunctionTags" {
+			found = true
+			if !reflect.DeepEqual(statement.Action, []string{"lambda:GetFunction"}) || statement.Resource[0] != "arn:aws:lambda:us-east-1:123456789012:function:orders-*" {
+				t.Fatalf("unexpected tag lookup grant: %+v", statement)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected the extension to be granted lambda:GetFunction")
+	}
+	for _, statement := range policies[side_agent].Statement {
+		if statement.Sid == "LiveLambdaFunctionTags" {
+			t.Fatal("the agent does not look up tags")
+		}
+	}
+}
+
+// echo_client delivers each publish back to the subscriber, or fails the
+// configured step.
+type echo_client struct {
+	fail    string
+	on_data func(interface{})
+}
+
+func (c *echo_client) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (*appsyncwsclient.Subscription, error) {
+	if c.fail == "subscribe" {
+		return nil, errors.New("unauthorized")
+	}
+	c.on_data = on_data
+	return nil, nil
+}
+
+func (c *echo_client) Publish(ctx context.Context, channel string, events []interface{}) error {
+	if c.fail == "publish" {
+		return errors.New("unauthorized")
+	}
+	if c.fail != "receive" {
+		for _, event := range events {
+			c.on_data(event)
+		}
+	}
+	return nil
+}
+
+func TestRunChecksReportsEachStep(t *testing.T) {
+	var out bytes.Buffer
+	if err := run_checks(context.Background(), &echo_client{}, default_channel_namespace, time.Second, &out); err != nil {
+		t.Fatalf("run_checks: %v\n%s", err, out.String())
+	}
+	if got := out.String(); got != "PASS subscribe\nPASS publish\nPASS receive\n" {
+		t.Fatalf("unexpected report:\n%s", got)
+	}
+
+	for _, step := range []string{"subscribe", "publish", "receive"} {
+		out.Reset()
+		if err := run_checks(context.Background(), &echo_client{fail: step}, default_channel_namespace, 50*time.Millisecond, &out); err == nil {
+			t.Fatalf("%s: expected an error", step)
+		}
+		if !strings.Contains(out.String(), "FAIL "+step) {
+			t.Fatalf("%s: unexpected report:\n%s", step, out.String())
+		}
+	}
+}
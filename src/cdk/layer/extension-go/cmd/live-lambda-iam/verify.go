@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+const (
+	// The probe goes to a lifecycle channel so the namespace handlers accept it;
+	// agents ignore its event type.
+	verify_channel_format = "%s/lifecycle/live-lambda-iam-check-%s"
+	verify_event_type     = "iam_check"
+)
+
+// events_client is the part of the AppSync client the checks use.
+type events_client interface {
+	Publish(ctx context.Context, channel string, events []interface{}) error
+	Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (*appsyncwsclient.Subscription, error)
+}
+
+// verify_access connects with the default credential chain and runs the
+// subscribe and publish checks, printing one line per step.
+func verify_access(ctx context.Context, opts iam_options, out io.Writer) error {
+	api, err := parse_api_arn(opts.api_arn)
+	if err != nil {
+		return err
+	}
+	connect_ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	client, err := connection.Connect(connect_ctx, connection.Options{
+		HTTPHost:         opts.http_host,
+		RealtimeHost:     opts.realtime_host,
+		Region:           api.region,
+		OperationTimeout: opts.timeout,
+	})
+	if err != nil {
+		report(out, "connect", err)
+		return fmt.Errorf("appsync:EventConnect check failed on %s", api.arn)
+	}
+	defer client.Close()
+	report(out, "connect", nil)
+
+	return run_checks(ctx, client, opts.namespace, opts.timeout, out)
+}
+
+// run_checks subscribes to a fresh channel in namespace, publishes a probe on
+// it and waits for the probe to come back.
+func run_checks(ctx context.Context, client events_client, namespace string, timeout time.Duration, out io.Writer) error {
+	check_id := new_check_id()
+	channel := fmt.Sprintf(verify_channel_format, namespace, check_id)
+
+	received := make(chan struct{}, 1)
+	subscribe_ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := client.Subscribe(subscribe_ctx, channel, func(data_payload interface{}) {
+		if is_check_event(data_payload, check_id) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}); err != nil {
+		report(out, "subscribe", err)
+		return fmt.Errorf("appsync:EventSubscribe check failed on %s", channel)
+	}
+	report(out, "subscribe", nil)
+
+	publish_ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	probe := map[string]interface{}{"type": verify_event_type, "check_id": check_id}
+	if err := client.Publish(publish_ctx, channel, []interface{}{probe}); err != nil {
+		report(out, "publish", err)
+		return fmt.Errorf("appsync:EventPublish check failed on %s", channel)
+	}
+	report(out, "publish", nil)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-received:
+		report(out, "receive", nil)
+		return nil
+	case <-timer.C:
+		err := fmt.Errorf("the probe did not come back within %s", timeout)
+		report(out, "receive", err)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func report(out io.Writer, step string, err error) {
+	if err != nil {
+		fmt.Fprintf(out, "FAIL %-9s %v\n", step, err)
+		return
+	}
+	fmt.Fprintf(out, "PASS %s\n", step)
+}
+
+// is_check_event reports whether an AppSync event, which may arrive decoded
+// or as a JSON string, is the probe with check_id.
+func is_check_event(data_payload interface{}, check_id string) bool {
+	var raw []byte
+	if encoded, ok := data_payload.(string); ok {
+		raw = []byte(encoded)
+	} else {
+		var err error
+		if raw, err = json.Marshal(data_payload); err != nil {
+			return false
+		}
+	}
+	var event struct {
+		Type    string `json:"type"`
+		CheckID string `json:"check_id"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return false
+	}
+	return event.Type == verify_event_type && event.CheckID == check_id
+}
+
+func new_check_id() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,148 @@
+// Command live-lambda-replay replays recorded invocations against a local
+// agent and reports how the responses differ from the recorded ones.
+//
+// Usage:
+//
+//	live-lambda-replay --records s3://my-bucket/live-lambda/recordings/orders/
+//	live-lambda-replay --records ./recordings --function orders --ignore headers.Date
+//
+// It reads what the extension records with LIVE_LAMBDA_RECORD, from S3 or from
+// disk, and publishes each event on live-lambda/requests under a synthetic
+// replay- request ID, the way a deployed extension would, so whatever agent is
+// serving the function handles it with the local code. Each response is
+// compared with the recorded one, and the command fails when any differs, so
+// it can gate handler changes in a regression test.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+const replay_print_prefix = "[LiveLambdaReplay]"
+
+type replay_options struct {
+	connection.Options
+	records       string
+	function_name string
+	timeout       time.Duration
+	limit         int
+	ignore        string
+	s3_region     string
+}
+
+func parse_replay_flags(args []string) (replay_options, error) {
+	var opts replay_options
+	flags := flag.NewFlagSet("live-lambda-replay", flag.ContinueOnError)
+	flags.StringVar(&opts.records, "records", "", "recording file, directory, or s3://bucket/prefix (required)")
+	flags.StringVar(&opts.function_name, "function", "", "only replay this function's events")
+	flags.DurationVar(&opts.timeout, "timeout", 30*time.Second, "how long to wait for each response")
+	flags.IntVar(&opts.limit, "limit", 0, "replay at most this many events (0 = all)")
+	flags.StringVar(&opts.ignore, "ignore", "", "comma-separated response paths to leave out of the comparison, e.g. headers.Date,body.requestTime")
+	flags.StringVar(&opts.s3_region, "s3-region", "", "region of the recordings bucket (defaults to --region)")
+	opts.Options.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.records == "" {
+		return opts, fmt.Errorf("--records is required")
+	}
+	if opts.timeout <= 0 {
+		return opts, fmt.Errorf("--timeout must be greater than zero")
+	}
+	if err := opts.Options.Validate(); err != nil {
+		return opts, err
+	}
+	if opts.s3_region == "" {
+		opts.s3_region = opts.Region
+	}
+	return opts, nil
+}
+
+// ignored_paths parses the --ignore list.
+func ignored_paths(value string) map[string]bool {
+	ignored := map[string]bool{}
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			ignored[path] = true
+		}
+	}
+	return ignored
+}
+
+// load_records reads the recordings from S3 or disk.
+func load_records(ctx context.Context, opts replay_options) ([]recording, error) {
+	location, ok := parse_s3_location(opts.records)
+	if !ok {
+		return read_local_records(opts.records)
+	}
+	if location.prefix == "" {
+		location.prefix = recordings_prefix
+		if opts.function_name != "" {
+			location.prefix += opts.function_name + "/"
+		}
+	}
+	aws_cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(opts.s3_region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	reader := &s3_reader{cfg: aws_cfg, region: opts.s3_region, client: &http.Client{Timeout: 30 * time.Second}}
+	return reader.read(ctx, location)
+}
+
+func run(args []string) error {
+	opts, err := parse_replay_flags(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	records, err := load_records(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read recordings: %w", err)
+	}
+	invocations, skipped := pair_records(records, opts.function_name)
+	if opts.limit > 0 && len(invocations) > opts.limit {
+		invocations = invocations[:opts.limit]
+	}
+	if len(invocations) == 0 {
+		return fmt.Errorf("no replayable events in %s", opts.records)
+	}
+
+	client, err := connection.Connect(ctx, opts.Options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("%s Replaying %d events from %s", replay_print_prefix, len(invocations), opts.records)
+	stats := replay_invocations(ctx, invocations, appsync_invoker(client, opts.Options, opts.timeout), opts.timeout, ignored_paths(opts.ignore))
+	stats.skipped = skipped
+	log.Printf("%s Done: %s", replay_print_prefix, stats.summary())
+	if stats.differed > 0 || stats.timed_out > 0 || stats.failed > 0 {
+		return fmt.Errorf("%d of %d replays did not match their recordings", stats.differed+stats.timed_out+stats.failed, stats.replayed)
+	}
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", replay_print_prefix, err)
+		os.Exit(1)
+	}
+}
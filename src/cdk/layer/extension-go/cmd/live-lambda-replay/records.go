@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Recordings are read from what the extension writes with LIVE_LAMBDA_RECORD
+// (see recorder.go in the extension): JSON Lines objects under
+// live-lambda/recordings/ in S3, downloaded copies of them, or the one-record
+// files of a sandbox's /tmp/live-lambda-recordings buffer.
+
+const (
+	record_kind_event    = "event"
+	record_kind_response = "response"
+	recordings_prefix    = "live-lambda/recordings/"
+	max_record_bytes     = 8 * 1024 * 1024
+)
+
+// recording is one record as written by the extension.
+type recording struct {
+	Kind         string                 `json:"kind"`
+	RequestID    string                 `json:"request_id"`
+	FunctionName string                 `json:"function_name"`
+	SandboxID    string                 `json:"sandbox_id"`
+	RecordedAt   time.Time              `json:"recorded_at"`
+	Event        json.RawMessage        `json:"event,omitempty"`
+	Context      map[string]interface{} `json:"context,omitempty"`
+	Response     json.RawMessage        `json:"response,omitempty"`
+	Error        bool                   `json:"error,omitempty"`
+	Truncated    bool                   `json:"truncated,omitempty"`
+}
+
+// recorded_invocation is an event record with the response recorded for it, if any.
+type recorded_invocation struct {
+	event    recording
+	response *recording
+}
+
+// parse_records decodes JSON Lines, or a single JSON record.
+func parse_records(data []byte) ([]recording, error) {
+	var records []recording
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), max_record_bytes)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var record recording
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// pair_records matches each event with its response and returns the events of
+// function_name (all functions when empty) in the order they were recorded.
+// Truncated events cannot be replayed and are counted in skipped.
+func pair_records(records []recording, function_name string) (invocations []recorded_invocation, skipped int) {
+	responses := map[string]*recording{}
+	for i := range records {
+		if records[i].Kind == record_kind_response {
+			responses[records[i].RequestID] = &records[i]
+		}
+	}
+	for _, record := range records {
+		if record.Kind != record_kind_event || function_name != "" && record.FunctionName != function_name {
+			continue
+		}
+		if record.Truncated || len(record.Event) == 0 {
+			skipped++
+			continue
+		}
+		invocations = append(invocations, recorded_invocation{event: record, response: responses[record.RequestID]})
+	}
+	sort.SliceStable(invocations, func(i, j int) bool {
+		return invocations[i].event.RecordedAt.Before(invocations[j].event.RecordedAt)
+	})
+	return invocations, skipped
+}
+
+// read_local_records reads a recording file, or every .json and .jsonl file in a directory.
+func read_local_records(path string) ([]recording, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if name := entry.Name(); !entry.IsDir() && (strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".jsonl")) {
+				files = append(files, filepath.Join(path, name))
+			}
+		}
+	}
+	var records []recording
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parse_records(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+		records = append(records, parsed...)
+	}
+	return records, nil
+}
+
+// s3_location is a bucket and key prefix given as s3://bucket/prefix.
+type s3_location struct {
+	bucket string
+	prefix string
+}
+
+func parse_s3_location(value string) (s3_location, bool) {
+	rest, ok := strings.CutPrefix(value, "s3://")
+	if !ok || rest == "" {
+		return s3_location{}, false
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	return s3_location{bucket: bucket, prefix: prefix}, bucket != ""
+}
+
+// s3_bucket_url is overridden in tests.
+var s3_bucket_url = func(bucket string, region string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+}
+
+// s3_reader lists and downloads recordings with SigV4-signed requests, like
+// the extension does, rather than pulling in the S3 client module.
+type s3_reader struct {
+	cfg    aws.Config
+	region string
+	client *http.Client
+}
+
+func (s *s3_reader) get(ctx context.Context, url string) ([]byte, error) {
+	credentials, err := s.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	empty := sha256.Sum256(nil)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(empty[:]))
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(empty[:]), "s3", s.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign the S3 request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 GET %s failed with status %d: %s", url, resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+type list_bucket_result struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the keys under location's prefix.
+func (s *s3_reader) list(ctx context.Context, location s3_location) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {location.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s.get(ctx, s3_bucket_url(location.bucket, s.region)+"/?"+query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var result list_bucket_result
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse the bucket listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// read downloads and parses every .jsonl object under location's prefix.
+func (s *s3_reader) read(ctx context.Context, location s3_location) ([]recording, error) {
+	keys, err := s.list(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	var records []recording
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".jsonl") {
+			continue
+		}
+		body, err := s.get(ctx, s3_bucket_url(location.bucket, s.region)+"/"+(&url.URL{Path: key}).EscapedPath())
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parse_records(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse s3://%s/%s: %w", location.bucket, key, err)
+		}
+		records = append(records, parsed...)
+	}
+	return records, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/internal/connection"
+
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+const (
+	default_channel_namespace = "live-lambda"
+	protocol_version          = 2
+	min_protocol_version      = 1
+	replay_id_prefix          = "replay-"
+)
+
+// Replays only offer error frames, so agents answer with the bare response or
+// an invocation_error frame, the same bytes the extension records.
+var replay_capabilities = []string{"error_frames"}
+
+var err_no_response = errors.New("no response")
+
+// invoke_func publishes envelope as request_id and returns the agent's response.
+type invoke_func func(ctx context.Context, request_id string, envelope map[string]interface{}) (json.RawMessage, error)
+
+func new_replay_id() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return replay_id_prefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	id := hex.EncodeToString(buf)
+	return replay_id_prefix + fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32])
+}
+
+// build_replay_envelope builds the request envelope for a recorded event under
+// a synthetic request ID, with a fresh deadline.
+func build_replay_envelope(request_id string, event recording, timeout time.Duration, now time.Time) map[string]interface{} {
+	context_data := map[string]interface{}{}
+	for key, value := range event.Context {
+		context_data[key] = value
+	}
+	context_data["request_id"] = request_id
+	context_data["deadline_ms"] = strconv.FormatInt(now.Add(timeout).UnixMilli(), 10)
+	context_data["invoked_at_ms"] = now.UnixMilli()
+	context_data["replay_of"] = event.RequestID
+	if _, ok := context_data["function_name"]; !ok && event.FunctionName != "" {
+		context_data["function_name"] = event.FunctionName
+	}
+	return map[string]interface{}{
+		"request_id":           request_id,
+		"event_payload":        event.Event,
+		"context":              context_data,
+		"protocol_version":     protocol_version,
+		"min_protocol_version": min_protocol_version,
+		"capabilities":         replay_capabilities,
+	}
+}
+
+// appsync_invoker mirrors handle_next in the extension: subscribe to the
+// response topic, publish the request, and wait for the first response.
+func appsync_invoker(client *appsyncwsclient.Client, c connection.Options, timeout time.Duration) invoke_func {
+	return func(ctx context.Context, request_id string, envelope map[string]interface{}) (json.RawMessage, error) {
+		invocation_ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		responses := make(chan json.RawMessage, 1)
+		var once sync.Once
+		subscription, err := client.Subscribe(invocation_ctx, c.ResponseTopic(request_id), func(data_payload interface{}) {
+			encoded, err := json.Marshal(data_payload)
+			if err != nil {
+				return
+			}
+			once.Do(func() { responses <- encoded })
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe: %w", err)
+		}
+		defer subscription.Unsubscribe()
+
+		if err := client.Publish(invocation_ctx, c.RequestsTopic(), []interface{}{envelope}); err != nil {
+			return nil, fmt.Errorf("failed to publish: %w", err)
+		}
+		select {
+		case response := <-responses:
+			return response, nil
+		case <-invocation_ctx.Done():
+			return nil, fmt.Errorf("%w within %s", err_no_response, timeout)
+		}
+	}
+}
+
+// json_diff lists where got differs from want, one line per path. Strings
+// holding JSON, such as API Gateway bodies, are compared as JSON. Paths in
+// ignored are skipped with everything under them.
+func json_diff(path string, want interface{}, got interface{}, ignored map[string]bool, diffs []string) []string {
+	if ignored[path] {
+		return diffs
+	}
+	want, got = decode_json_string(want), decode_json_string(got)
+	switch want_value := want.(type) {
+	case map[string]interface{}:
+		got_value, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for key := range want_value {
+			keys[key] = true
+		}
+		for key := range got_value {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			want_child, in_want := want_value[key]
+			got_child, in_got := got_value[key]
+			switch {
+			case ignored[child]:
+			case !in_want:
+				diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", child, format_json(got_child)))
+			case !in_got:
+				diffs = append(diffs, fmt.Sprintf("%s: missing, recorded %s", child, format_json(want_child)))
+			default:
+				diffs = json_diff(child, want_child, got_child, ignored, diffs)
+			}
+		}
+		return diffs
+	case []interface{}:
+		got_value, ok := got.([]interface{})
+		if !ok || len(got_value) != len(want_value) {
+			break
+		}
+		for i := range want_value {
+			diffs = json_diff(fmt.Sprintf("%s[%d]", path, i), want_value[i], got_value[i], ignored, diffs)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(want, got) {
+		label := path
+		if label == "" {
+			label = "response"
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: recorded %s, got %s", label, format_json(want), format_json(got)))
+	}
+	return diffs
+}
+
+// decode_json_string returns the decoded object or array a string holds, or value unchanged.
+func decode_json_string(value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok || !strings.HasPrefix(strings.TrimSpace(text), "{") && !strings.HasPrefix(strings.TrimSpace(text), "[") {
+		return value
+	}
+	var decoded interface{}
+	if json.Unmarshal([]byte(text), &decoded) != nil {
+		return value
+	}
+	return decoded
+}
+
+func format_json(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	if len(encoded) > 120 {
+		return string(encoded[:117]) + "..."
+	}
+	return string(encoded)
+}
+
+// compare_responses diffs a replayed response against the recorded one.
+func compare_responses(recorded json.RawMessage, replayed json.RawMessage, ignored map[string]bool) ([]string, error) {
+	var want, got interface{}
+	if err := json.Unmarshal(recorded, &want); err != nil {
+		return nil, fmt.Errorf("the recorded response is not JSON: %w", err)
+	}
+	if err := json.Unmarshal(replayed, &got); err != nil {
+		return nil, fmt.Errorf("the response is not JSON: %w", err)
+	}
+	return json_diff("", want, got, ignored, nil), nil
+}
+
+// replay_stats collects outcomes for the run summary.
+type replay_stats struct {
+	replayed    int
+	matched     int
+	differed    int
+	unrecorded  int // replayed, but no response was recorded to compare with
+	timed_out   int
+	failed      int
+	skipped     int // truncated records, which cannot be replayed
+	differences map[string][]string
+}
+
+func (s *replay_stats) summary() string {
+	return fmt.Sprintf("replayed=%d matched=%d differed=%d unrecorded=%d timed_out=%d failed=%d skipped=%d",
+		s.replayed, s.matched, s.differed, s.unrecorded, s.timed_out, s.failed, s.skipped)
+}
+
+// replay_invocations publishes each recorded event in turn and compares the
+// response with the recorded one.
+func replay_invocations(ctx context.Context, invocations []recorded_invocation, invoke invoke_func, timeout time.Duration, ignored map[string]bool) *replay_stats {
+	stats := &replay_stats{differences: map[string][]string{}}
+	for _, invocation := range invocations {
+		if ctx.Err() != nil {
+			break
+		}
+		original := invocation.event.RequestID
+		request_id := new_replay_id()
+		envelope := build_replay_envelope(request_id, invocation.event, timeout, time.Now())
+		started := time.Now()
+		response, err := invoke(ctx, request_id, envelope)
+		stats.replayed++
+		switch {
+		case errors.Is(err, err_no_response):
+			stats.timed_out++
+			log.Printf("%s %s: no response within %s", replay_print_prefix, original, timeout)
+			continue
+		case err != nil:
+			stats.failed++
+			log.Printf("%s %s: %v", replay_print_prefix, original, err)
+			continue
+		case invocation.response == nil:
+			stats.unrecorded++
+			log.Printf("%s %s: responded in %s, no recorded response to compare", replay_print_prefix, original, time.Since(started).Round(time.Millisecond))
+			continue
+		}
+		diffs, err := compare_responses(invocation.response.Response, response, ignored)
+		if err != nil {
+			stats.failed++
+			log.Printf("%s %s: %v", replay_print_prefix, original, err)
+			continue
+		}
+		if len(diffs) == 0 {
+			stats.matched++
+			log.Printf("%s %s: matched in %s", replay_print_prefix, original, time.Since(started).Round(time.Millisecond))
+			continue
+		}
+		stats.differed++
+		stats.differences[original] = diffs
+		log.Printf("%s %s: %d differences", replay_print_prefix, original, len(diffs))
+		for _, diff := range diffs {
+			log.Printf("%s   %s", replay_print_prefix, diff)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+const recorded_lines = `{"kind":"event","request_id":"r2","function_name":"orders","recorded_at":"2025-06-01T10:00:02Z","event":{"n":2},"context":{"trace_id":"t2"}}
+{"kind":"event","request_id":"r1","function_name":"orders","recorded_at":"2025-06-01T10:00:01Z","event":{"n":1}}
+{"kind":"response","request_id":"r1","function_name":"orders","recorded_at":"2025-06-01T10:00:01Z","response":{"statusCode":200,"body":"{\"total\":10,\"at\":\"x\"}"}}
+{"kind":"event","request_id":"r3","function_name":"orders","recorded_at":"2025-06-01T10:00:03Z","truncated":true}
+{"kind":"event","request_id":"r4","function_name":"billing","recorded_at":"2025-06-01T10:00:04Z","event":{}}
+`
+
+func TestParseReplayFlags(t *testing.T) {
+	opts, err := parse_replay_flags([]string{"--records", "./recordings", "--http-host", "h", "--realtime-host", "r", "--region", "us-east-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.timeout != 30*time.Second || opts.s3_region != "us-east-1" || opts.Namespace != default_channel_namespace {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+	if _, err := parse_replay_flags([]string{"--http-host", "h", "--realtime-host", "r", "--region", "x"}); err == nil {
+		t.Fatal("expected an error without --records")
+	}
+	if ignored := ignored_paths(" headers.Date, ,body.at"); len(ignored) != 2 || !ignored["headers.Date"] || !ignored["body.at"] {
+		t.Fatalf("unexpected ignored paths %v", ignored)
+	}
+}
+
+func TestPairRecords(t *testing.T) {
+	records, err := parse_records([]byte(recorded_lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invocations, skipped := pair_records(records, "orders")
+	if skipped != 1 || len(invocations) != 2 {
+		t.Fatalf("expected two replayable events and one skipped, got %d and %d", len(invocations), skipped)
+	}
+	if invocations[0].event.RequestID != "r1" || invocations[0].response == nil || invocations[1].response != nil {
+		t.Fatalf("unexpected pairing %+v", invocations)
+	}
+	if all, _ := pair_records(records, ""); len(all) != 3 {
+		t.Fatalf("expected every function's events without a filter, got %d", len(all))
+	}
+}
+
+func TestReadLocalRecordsFromBufferDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for i, line := range strings.Split(strings.TrimSpace(recorded_lines), "\n") {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d.json", i)), []byte(line), 0o600)
+	}
+	os.WriteFile(filepath.Join(dir, "00000000000000000009.json.tmp"), []byte("partial"), 0o600)
+
+	records, err := read_local_records(dir)
+	if err != nil || len(records) != 5 {
+		t.Fatalf("expected five records, got %d (%v)", len(records), err)
+	}
+}
+
+func TestBuildReplayEnvelope(t *testing.T) {
+	now := time.UnixMilli(1_000_000)
+	event := recording{RequestID: "r1", FunctionName: "orders", Event: json.RawMessage(`{"n":1}`), Context: map[string]interface{}{"request_id": "r1", "trace_id": "t1"}}
+	envelope := build_replay_envelope("replay-1", event, time.Second, now)
+
+	context_data := envelope["context"].(map[string]interface{})
+	if context_data["request_id"] != "replay-1" || context_data["replay_of"] != "r1" || context_data["function_name"] != "orders" || context_data["deadline_ms"] != "1001000" {
+		t.Fatalf("unexpected context %v", context_data)
+	}
+	if event.Context["request_id"] != "r1" {
+		t.Fatal("expected the recorded context to be left alone")
+	}
+}
+
+func TestCompareResponses(t *testing.T) {
+	recorded := json.RawMessage(`{"statusCode":200,"headers":{"Date":"a"},"body":"{\"total\":10,\"items\":[1,2]}"}`)
+	diffs, err := compare_responses(recorded, json.RawMessage(`{"statusCode":200,"headers":{"Date":"b"},"body":"{\"total\":10,\"items\":[1,2]}"}`), map[string]bool{"headers.Date": true})
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("expected a match, got %v (%v)", diffs, err)
+	}
+
+	diffs, _ = compare_responses(recorded, json.RawMessage(`{"statusCode":500,"headers":{"Date":"a","X-New":"1"},"body":"{\"total\":11,\"items\":[1,3]}"}`), nil)
+	want := []string{
+		"body.items[1]: recorded 2, got 3",
+		"body.total: recorded 10, got 11",
+		`headers.X-New: unexpected "1"`,
+		"statusCode: recorded 200, got 500",
+	}
+	if strings.Join(diffs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diffs:\n%s", strings.Join(diffs, "\n"))
+	}
+}
+
+func TestReplayInvocations(t *testing.T) {
+	records, _ := parse_records([]byte(recorded_lines))
+	invocations, _ := pair_records(records, "orders")
+	var published []map[string]interface{}
+	invoke := func(ctx context.Context, request_id string, envelope map[string]interface{}) (json.RawMessage, error) {
+		published = append(published, envelope)
+		if envelope["context"].(map[string]interface{})["replay_of"] == "r2" {
+			return nil, fmt.Errorf("%w within 1s", err_no_response)
+		}
+		return json.RawMessage(`{"statusCode":200,"body":"{\"total\":12,\"at\":\"y\"}"}`), nil
+	}
+
+	stats := replay_invocations(context.Background(), invocations, invoke, time.Second, map[string]bool{"body.at": true})
+	if stats.replayed != 2 || stats.differed != 1 || stats.timed_out != 1 || len(published) != 2 {
+		t.Fatalf("unexpected stats %s", stats.summary())
+	}
+	if diffs := stats.differences["r1"]; len(diffs) != 1 || diffs[0] != "body.total: recorded 10, got 12" {
+		t.Fatalf("unexpected differences %v", stats.differences)
+	}
+	if id := published[0]["request_id"].(string); !strings.HasPrefix(id, replay_id_prefix) {
+		t.Fatalf("expected a synthetic request ID, got %s", id)
+	}
+}
+
+func TestS3ReaderPagesThroughRecordings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.URL.Path == "/" && r.URL.Query().Get("continuation-token") == "":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>live-lambda/recordings/orders/sb-1/a.jsonl</Key></Contents><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken></ListBucketResult>`)
+		case r.URL.Path == "/":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>live-lambda/recordings/orders/sb-2/b.jsonl</Key></Contents><Contents><Key>live-lambda/recordings/notes.txt</Key></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`)
+		case strings.HasSuffix(r.URL.Path, "/a.jsonl"):
+			fmt.Fprint(w, strings.SplitAfterN(recorded_lines, "\n", 2)[0])
+		case strings.HasSuffix(r.URL.Path, "/b.jsonl"):
+			fmt.Fprint(w, strings.SplitAfterN(recorded_lines, "\n", 2)[1])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	previous := s3_bucket_url
+	s3_bucket_url = func(bucket string, region string) string { return server.URL }
+	defer func() { s3_bucket_url = previous }()
+
+	reader := &s3_reader{
+		cfg:    aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")},
+		region: "us-east-1",
+		client: server.Client(),
+	}
+	location, ok := parse_s3_location("s3://recordings/live-lambda/recordings/orders/")
+	if !ok || location.bucket != "recordings" || location.prefix != "live-lambda/recordings/orders/" {
+		t.Fatalf("unexpected location %+v", location)
+	}
+	records, err := reader.read(context.Background(), location)
+	if err != nil || len(records) != 5 {
+		t.Fatalf("expected five records from two objects, got %d (%v)", len(records), err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// soak_agent plays the developer agent inside the fake Events API: it sends
+// heartbeats, answers probes, and answers each request with its own event in
+// a protocol 2 response envelope, resending it on a retransmit_request.
+
+const (
+	soak_agent_id          = "soak-agent"
+	soak_channel_namespace = "live-lambda"
+	soak_heartbeat_every   = 2 * time.Second
+	soak_heartbeat_ttl     = 15 * time.Second
+)
+
+type soak_agent struct {
+	server        *eventstest.Server
+	function_name string
+
+	mu            sync.Mutex
+	responses     map[string]interface{} // request ID to the response envelope, until the invocation ends
+	answered      int
+	retransmitted int
+}
+
+func new_soak_agent(server *eventstest.Server, function_name string) *soak_agent {
+	return &soak_agent{server: server, function_name: function_name, responses: map[string]interface{}{}}
+}
+
+func (a *soak_agent) channel(name string) string {
+	return soak_channel_namespace + "/" + name
+}
+
+// heartbeat announces the agent until ctx ends.
+func (a *soak_agent) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(soak_heartbeat_every)
+	defer ticker.Stop()
+	for {
+		a.send_heartbeat()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *soak_agent) send_heartbeat() {
+	a.server.Publish(a.channel("presence/"+a.function_name), map[string]interface{}{
+		"type":                 "heartbeat",
+		"agent_id":             soak_agent_id,
+		"ttl_ms":               soak_heartbeat_ttl.Milliseconds(),
+		"protocol_version":     2,
+		"min_protocol_version": 1,
+		"capabilities":         []string{"response_envelope", "error_frames"},
+	})
+}
+
+// handle receives what the extension publishes.
+func (a *soak_agent) handle(channel string, event json.RawMessage) {
+	var frame struct {
+		Type         string          `json:"type"`
+		RequestID    string          `json:"request_id"`
+		EventPayload json.RawMessage `json:"event_payload"`
+	}
+	if json.Unmarshal(event, &frame) != nil {
+		return
+	}
+	switch {
+	case strings.HasPrefix(channel, a.channel("presence/")):
+		if frame.Type == "probe" {
+			go a.send_heartbeat()
+		}
+	case channel == a.channel("requests"):
+		switch frame.Type {
+		case "":
+			envelope := map[string]interface{}{"type": "response", "protocol_version": 2, "body": frame.EventPayload}
+			a.mu.Lock()
+			a.responses[frame.RequestID] = envelope
+			a.answered++
+			a.mu.Unlock()
+			go a.server.Publish(a.channel("response/"+frame.RequestID), envelope)
+		case "retransmit_request":
+			a.mu.Lock()
+			envelope, ok := a.responses[frame.RequestID]
+			if ok {
+				a.retransmitted++
+			}
+			a.mu.Unlock()
+			if ok {
+				go a.server.Publish(a.channel("response/"+frame.RequestID), envelope)
+			}
+		}
+	}
+}
+
+// forget drops the response kept for request_id once its invocation is over.
+func (a *soak_agent) forget(request_id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.responses, request_id)
+}
+
+// counts returns how many requests the agent answered and resent.
+func (a *soak_agent) counts() (answered int, retransmitted int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.answered, a.retransmitted
+}
@@ -0,0 +1,126 @@
+// Command soak drives a built extension through thousands of invocations with
+// the sandbox frozen between them, the way Lambda reuses a warm sandbox, and
+// fails when the extension leaks goroutines, heap, subscriptions or
+// connections.
+//
+// Usage:
+//
+//	go build -o /tmp/extension . && go run ./cmd/soak --extension /tmp/extension
+//	go run ./cmd/soak --extension /tmp/extension --cycles 5000 --reconnect-every 25 --log /tmp/soak.log
+//
+// The extension runs as a subprocess against an emulated Runtime and
+// Extensions API and an in-process fake of the AppSync Events API
+// (internal/eventstest), where the soak also plays the developer agent. After
+// each invocation it waits for the sandbox to go idle, freezes the extension
+// with SIGSTOP, and thaws it with SIGCONT; every --reconnect-every cycles it
+// drops the WebSocket while the extension is frozen, as happens when a sandbox
+// sits idle for a while. Every --sample-every cycles after --warmup it reads
+// /healthz and the fake's own counts, and at the end it sends SHUTDOWN and
+// expects a clean exit. Linux and macOS only.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// soak_logger writes the soak's progress to stderr; the extension's own output
+// goes to --log.
+var soak_logger = slog.Default().With("component", "soak")
+
+type soak_options struct {
+	extension       string
+	cycles          int
+	freeze          time.Duration
+	reconnect_every int
+	sample_every    int
+	warmup          int
+	goroutine_slack int
+	heap_growth     uint64 // bytes
+	max_failures    int
+	timeout         time.Duration
+	log             string
+}
+
+func parse_soak_flags(args []string) (soak_options, error) {
+	var opts soak_options
+	var heap_growth_mb float64
+	flags := flag.NewFlagSet("soak", flag.ContinueOnError)
+	flags.StringVar(&opts.extension, "extension", "", "path to the built extension binary (required)")
+	flags.IntVar(&opts.cycles, "cycles", 1000, "invoke/freeze/thaw cycles to run")
+	flags.DurationVar(&opts.freeze, "freeze", 50*time.Millisecond, "how long the extension stays frozen between invocations")
+	flags.IntVar(&opts.reconnect_every, "reconnect-every", 50, "drop the WebSocket while frozen every this many cycles (0 = never)")
+	flags.IntVar(&opts.sample_every, "sample-every", 50, "read the extension's state every this many cycles")
+	flags.IntVar(&opts.warmup, "warmup", 50, "cycles to run before the baseline sample")
+	flags.IntVar(&opts.goroutine_slack, "goroutine-slack", 10, "goroutines the extension may gain over the run")
+	flags.Float64Var(&heap_growth_mb, "heap-growth", 16, "MB the extension's heap may grow over the run")
+	flags.IntVar(&opts.max_failures, "max-failures", 10, "failed cycles to tolerate before stopping early")
+	flags.DurationVar(&opts.timeout, "timeout", 10*time.Second, "how long to wait for each invocation and reconnect")
+	flags.StringVar(&opts.log, "log", "", "file to write the extension's output to (default: discarded)")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.extension == "" {
+		return opts, fmt.Errorf("--extension is required")
+	}
+	if opts.cycles <= 0 || opts.sample_every <= 0 || opts.warmup < 0 || opts.reconnect_every < 0 || opts.max_failures < 0 {
+		return opts, fmt.Errorf("--cycles and --sample-every must be greater than zero, and --warmup, --reconnect-every and --max-failures at least zero")
+	}
+	if opts.warmup+2*opts.sample_every > opts.cycles {
+		return opts, fmt.Errorf("--cycles %d leaves fewer than two samples after --warmup %d at --sample-every %d", opts.cycles, opts.warmup, opts.sample_every)
+	}
+	if opts.freeze < 0 || opts.timeout <= 0 || heap_growth_mb < 0 {
+		return opts, fmt.Errorf("--freeze and --heap-growth must be at least zero and --timeout greater than zero")
+	}
+	opts.heap_growth = uint64(heap_growth_mb * (1 << 20))
+	return opts, nil
+}
+
+func run(args []string) error {
+	opts, err := parse_soak_flags(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var output io.Writer = io.Discard
+	if opts.log != "" {
+		file, err := os.Create(opts.log)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", opts.log, err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	soak_logger.Info("Running the soak", "extension", opts.extension, "cycles", opts.cycles)
+	report, err := run_soak(ctx, opts, output)
+	if err != nil {
+		return err
+	}
+	soak_logger.Info("Done", "summary", report.summary())
+	for _, finding := range report.findings {
+		soak_logger.Error("Leak", "finding", finding)
+	}
+	if len(report.findings) > 0 {
+		return fmt.Errorf("%d problems found over %d cycles", len(report.findings), report.cycles)
+	}
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		soak_logger.Error("Soak failed", "error", err)
+		os.Exit(1)
+	}
+}
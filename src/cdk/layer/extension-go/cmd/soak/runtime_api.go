@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runtime_api emulates the Lambda Runtime API and Extensions API for one
+// extension and one function. Like Lambda, it hands an invocation to the
+// function and an INVOKE event to the extension, and considers the sandbox
+// idle, and so safe to freeze, only once the function has responded and both
+// are waiting on their next call again.
+
+const (
+	runtime_api_path     = "/2018-06-01/runtime"
+	extension_api_path   = "/2020-01-01/extension"
+	soak_function_arn    = "arn:aws:lambda:us-east-1:000000000000:function:"
+	extension_identifier = "soak-extension"
+)
+
+// invocation is one event handed to the sandbox.
+type invocation struct {
+	request_id string
+	event      []byte
+	deadline   time.Time
+	done       chan invocation_result
+}
+
+type invocation_result struct {
+	body     []byte
+	is_error bool
+}
+
+type runtime_api struct {
+	listener      net.Listener
+	server        *http.Server
+	function_name string
+
+	mu                sync.Mutex
+	changed           chan struct{} // closed and replaced whenever the state below changes
+	function_queue    []*invocation
+	extension_queue   []*invocation
+	active            map[string]*invocation
+	function_waiting  bool
+	extension_waiting bool
+	shutdown          bool
+	registered        bool
+}
+
+func new_runtime_api(function_name string) (*runtime_api, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the Runtime API: %w", err)
+	}
+	api := &runtime_api{
+		listener:      listener,
+		function_name: function_name,
+		changed:       make(chan struct{}),
+		active:        map[string]*invocation{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(extension_api_path+"/register", api.handle_register)
+	mux.HandleFunc(extension_api_path+"/event/next", api.handle_event_next)
+	mux.HandleFunc(runtime_api_path+"/invocation/next", api.handle_invocation_next)
+	mux.HandleFunc(runtime_api_path+"/invocation/", api.handle_invocation_result)
+	api.server = &http.Server{Handler: mux}
+	go api.server.Serve(listener)
+	return api, nil
+}
+
+// address is the host:port for AWS_LAMBDA_RUNTIME_API.
+func (api *runtime_api) address() string {
+	return api.listener.Addr().String()
+}
+
+func (api *runtime_api) close() {
+	api.server.Close()
+}
+
+// notify wakes everything waiting on a state change. mu must be held.
+func (api *runtime_api) notify() {
+	close(api.changed)
+	api.changed = make(chan struct{})
+}
+
+// wait_for blocks until ready reports true under mu, or ctx ends.
+func (api *runtime_api) wait_for(ctx context.Context, ready func() bool) error {
+	for {
+		api.mu.Lock()
+		if ready() {
+			api.mu.Unlock()
+			return nil
+		}
+		changed := api.changed
+		api.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// invoke queues event for the sandbox and waits for the function's result.
+func (api *runtime_api) invoke(ctx context.Context, request_id string, event []byte, timeout time.Duration) (invocation_result, error) {
+	inv := &invocation{request_id: request_id, event: event, deadline: time.Now().Add(timeout), done: make(chan invocation_result, 1)}
+	api.mu.Lock()
+	api.function_queue = append(api.function_queue, inv)
+	api.extension_queue = append(api.extension_queue, inv)
+	api.active[request_id] = inv
+	api.notify()
+	api.mu.Unlock()
+
+	ctx, cancel := context.WithDeadline(ctx, inv.deadline)
+	defer cancel()
+	select {
+	case result := <-inv.done:
+		return result, nil
+	case <-ctx.Done():
+		api.mu.Lock()
+		delete(api.active, request_id)
+		api.mu.Unlock()
+		return invocation_result{}, fmt.Errorf("invocation %s got no result: %w", request_id, ctx.Err())
+	}
+}
+
+// wait_idle blocks until both the function and the extension are waiting for
+// their next event with nothing queued, the point where Lambda freezes.
+func (api *runtime_api) wait_idle(ctx context.Context) error {
+	return api.wait_for(ctx, func() bool {
+		return api.function_waiting && api.extension_waiting && len(api.function_queue) == 0 && len(api.extension_queue) == 0
+	})
+}
+
+// wait_registered blocks until the extension has registered.
+func (api *runtime_api) wait_registered(ctx context.Context) error {
+	return api.wait_for(ctx, func() bool { return api.registered })
+}
+
+// shut_down sends SHUTDOWN to the extension.
+func (api *runtime_api) shut_down() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.shutdown = true
+	api.notify()
+}
+
+func (api *runtime_api) handle_register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	io.Copy(io.Discard, r.Body)
+	api.mu.Lock()
+	api.registered = true
+	api.notify()
+	api.mu.Unlock()
+	w.Header().Set("Lambda-Extension-Identifier", extension_identifier)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"functionName":%q,"functionVersion":"$LATEST","handler":"index.handler"}`, api.function_name)
+}
+
+func (api *runtime_api) handle_event_next(w http.ResponseWriter, r *http.Request) {
+	var inv *invocation
+	var shutdown bool
+	api.mu.Lock()
+	api.extension_waiting = true
+	api.notify()
+	api.mu.Unlock()
+	err := api.wait_for(r.Context(), func() bool {
+		if len(api.extension_queue) > 0 {
+			inv, api.extension_queue = api.extension_queue[0], api.extension_queue[1:]
+			api.extension_waiting = false
+			api.notify()
+			return true
+		}
+		if api.shutdown {
+			shutdown = true
+			api.extension_waiting = false
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		api.mu.Lock()
+		api.extension_waiting = false
+		api.notify()
+		api.mu.Unlock()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if shutdown {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"eventType":      "SHUTDOWN",
+			"shutdownReason": "spindown",
+			"deadlineMs":     time.Now().Add(2 * time.Second).UnixMilli(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"eventType":          "INVOKE",
+		"requestId":          inv.request_id,
+		"deadlineMs":         inv.deadline.UnixMilli(),
+		"invokedFunctionArn": soak_function_arn + api.function_name,
+	})
+}
+
+func (api *runtime_api) handle_invocation_next(w http.ResponseWriter, r *http.Request) {
+	var inv *invocation
+	api.mu.Lock()
+	api.function_waiting = true
+	api.notify()
+	api.mu.Unlock()
+	err := api.wait_for(r.Context(), func() bool {
+		if len(api.function_queue) == 0 {
+			return false
+		}
+		inv, api.function_queue = api.function_queue[0], api.function_queue[1:]
+		api.function_waiting = false
+		api.notify()
+		return true
+	})
+	if err != nil {
+		api.mu.Lock()
+		api.function_waiting = false
+		api.notify()
+		api.mu.Unlock()
+		return
+	}
+
+	w.Header().Set("Lambda-Runtime-Aws-Request-Id", inv.request_id)
+	w.Header().Set("Lambda-Runtime-Deadline-Ms", fmt.Sprint(inv.deadline.UnixMilli()))
+	w.Header().Set("Lambda-Runtime-Invoked-Function-Arn", soak_function_arn+api.function_name)
+	w.Header().Set("Lambda-Runtime-Trace-Id", "Root=1-00000000-000000000000000000000000;Parent=0000000000000000;Sampled=0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(inv.event)
+}
+
+// handle_invocation_result records POST /invocation/{id}/response and /error.
+func (api *runtime_api) handle_invocation_result(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, runtime_api_path+"/invocation/")
+	request_id, kind, ok := strings.Cut(rest, "/")
+	if !ok || r.Method != http.MethodPost || (kind != "response" && kind != "error") {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.mu.Lock()
+	inv, found := api.active[request_id]
+	delete(api.active, request_id)
+	api.mu.Unlock()
+	if !found {
+		// Lambda refuses a second result for the same invocation
+		http.Error(w, `{"errorType":"InvalidStateTransition"}`, http.StatusForbidden)
+		return
+	}
+	inv.done <- invocation_result{body: body, is_error: kind == "error"}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"OK"}`))
+}
+
+// function plays the Lambda runtime behind the extension's proxy. It answers
+// each event it is given with the event itself, which only happens when the
+// extension passes an invocation through; an intercepted invocation comes back
+// from /next with no request ID once the agent's response has been posted.
+type function struct {
+	proxy_url string
+	client    *http.Client
+	mu        sync.Mutex
+	passed    int
+}
+
+func new_function(proxy_port int) *function {
+	return &function{
+		proxy_url: fmt.Sprintf("http://127.0.0.1:%d%s", proxy_port, runtime_api_path),
+		client:    &http.Client{},
+	}
+}
+
+// passed_through returns how many invocations the function answered itself.
+func (f *function) passed_through() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.passed
+}
+
+// run polls for events until ctx ends.
+func (f *function) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := f.next(ctx); err != nil {
+			// The extension is starting, frozen or gone; poll again shortly
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+}
+
+func (f *function) next(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.proxy_url+"/invocation/next", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	event, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	request_id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+	if resp.StatusCode != http.StatusOK || request_id == "" {
+		return nil
+	}
+
+	post, err := http.NewRequestWithContext(ctx, http.MethodPost, f.proxy_url+"/invocation/"+request_id+"/response", strings.NewReader(string(event)))
+	if err != nil {
+		return err
+	}
+	result, err := f.client.Do(post)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, result.Body)
+	result.Body.Close()
+	f.mu.Lock()
+	f.passed++
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+const (
+	soak_function_name  = "soak"
+	soak_poll_interval  = 50 * time.Millisecond
+	soak_settle_timeout = 2 * time.Second
+	soak_exit_timeout   = 10 * time.Second
+	heap_window         = 3 // samples the heap minimum is taken over at each end of the run
+)
+
+// soak_sample is the extension's state between two cycles.
+type soak_sample struct {
+	cycle         int
+	goroutines    int
+	heap_bytes    uint64
+	in_flight     int
+	connections   int
+	subscriptions int
+}
+
+// healthz is the part of the extension's /healthz report the soak reads.
+type healthz struct {
+	WebSocketConnected bool `json:"websocket_connected"`
+	InFlight           int  `json:"in_flight"`
+	AgentPresent       bool `json:"agent_present"`
+	Runtime            struct {
+		Goroutines     int    `json:"goroutines"`
+		HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	} `json:"runtime"`
+}
+
+type soak_report struct {
+	cycles        int
+	answered      int
+	passed        int
+	retransmitted int
+	failures      int
+	reconnects    int
+	samples       []soak_sample
+	findings      []string
+	elapsed       time.Duration
+}
+
+func (r soak_report) summary() string {
+	if len(r.samples) == 0 {
+		return fmt.Sprintf("%d cycles in %s, too few to sample after warmup", r.cycles, r.elapsed.Round(time.Second))
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	return fmt.Sprintf("%d cycles in %s: %d answered by the agent, %d passed through, %d retransmitted, %d failed, %d reconnects; goroutines %d -> %d, heap %.1fMB -> %.1fMB, subscriptions %d -> %d",
+		r.cycles, r.elapsed.Round(time.Second), r.answered, r.passed, r.retransmitted, r.failures, r.reconnects,
+		first.goroutines, last.goroutines, float64(first.heap_bytes)/(1<<20), float64(last.heap_bytes)/(1<<20), first.subscriptions, last.subscriptions)
+}
+
+// evaluate_samples reports leaks in samples taken after warmup. The first
+// sample is the baseline.
+func evaluate_samples(samples []soak_sample, opts soak_options) []string {
+	if len(samples) < 2 {
+		return nil
+	}
+	var findings []string
+	baseline := samples[0]
+	for _, sample := range samples {
+		if sample.subscriptions > baseline.subscriptions {
+			findings = append(findings, fmt.Sprintf("cycle %d: %d subscriptions, %d at baseline", sample.cycle, sample.subscriptions, baseline.subscriptions))
+		}
+		if sample.connections != 1 {
+			findings = append(findings, fmt.Sprintf("cycle %d: %d connections to the Events API", sample.cycle, sample.connections))
+		}
+		if sample.in_flight != 0 {
+			findings = append(findings, fmt.Sprintf("cycle %d: %d invocations still in flight while idle", sample.cycle, sample.in_flight))
+		}
+	}
+
+	last := samples[len(samples)-1]
+	if growth := last.goroutines - baseline.goroutines; growth > opts.goroutine_slack {
+		findings = append(findings, fmt.Sprintf("goroutines grew by %d (%d -> %d), more than --goroutine-slack %d", growth, baseline.goroutines, last.goroutines, opts.goroutine_slack))
+	}
+	window := min(heap_window, len(samples)/2)
+	start, end := min_heap(samples[:window]), min_heap(samples[len(samples)-window:])
+	if end > start && end-start > opts.heap_growth {
+		findings = append(findings, fmt.Sprintf("heap grew by %.1fMB (%.1fMB -> %.1fMB), more than --heap-growth %.1fMB",
+			float64(end-start)/(1<<20), float64(start)/(1<<20), float64(end)/(1<<20), float64(opts.heap_growth)/(1<<20)))
+	}
+	return findings
+}
+
+func min_heap(samples []soak_sample) uint64 {
+	lowest := samples[0].heap_bytes
+	for _, sample := range samples[1:] {
+		lowest = min(lowest, sample.heap_bytes)
+	}
+	return lowest
+}
+
+// last_line_writer keeps the last complete line written to it.
+type last_line_writer struct {
+	mu      sync.Mutex
+	partial []byte
+	last    []byte
+}
+
+func (w *last_line_writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		line, rest, ok := bytes.Cut(w.partial, []byte("\n"))
+		if !ok {
+			break
+		}
+		w.last = append(w.last[:0], line...)
+		w.partial = append(w.partial[:0], rest...)
+	}
+	return len(p), nil
+}
+
+func (w *last_line_writer) line() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.last...)
+}
+
+// soak runs the extension binary through the configured cycles.
+type soak struct {
+	opts     soak_options
+	server   *eventstest.Server
+	api      *runtime_api
+	agent    *soak_agent
+	function *function
+	stop_fn  context.CancelFunc
+	cmd      *exec.Cmd
+	stderr   *last_line_writer
+	exited   chan error
+	health   string
+	client   *http.Client
+}
+
+// free_port returns a loopback port nothing is listening on.
+func free_port() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// start brings up the fake Events API, the Runtime API and the extension.
+func (s *soak) start(ctx context.Context, workdir string, output io.Writer) error {
+	s.server = eventstest.NewServer(eventstest.Options{KeepAliveInterval: 10 * time.Second, TLS: true})
+	certificate := filepath.Join(workdir, "events-api.pem")
+	if err := s.server.WriteCertificate(certificate); err != nil {
+		return fmt.Errorf("failed to write the Events API certificate: %w", err)
+	}
+	s.agent = new_soak_agent(s.server, soak_function_name)
+	s.server.OnPublish(s.agent.handle)
+	go s.agent.heartbeat(ctx)
+
+	api, err := new_runtime_api(soak_function_name)
+	if err != nil {
+		return err
+	}
+	s.api = api
+	port, err := free_port()
+	if err != nil {
+		return fmt.Errorf("failed to pick a proxy port: %w", err)
+	}
+	s.health = fmt.Sprintf("http://127.0.0.1:%d/healthz", port)
+	s.client = &http.Client{Timeout: s.opts.timeout}
+
+	s.cmd = exec.Command(s.opts.extension)
+	s.cmd.Env = append(os.Environ(),
+		"AWS_LAMBDA_RUNTIME_API="+api.address(),
+		"LRAP_LISTENER_PORT="+strconv.Itoa(port),
+		"AWS_LAMBDA_FUNCTION_NAME="+soak_function_name,
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE=1024",
+		"AWS_REGION=us-east-1",
+		"LIVE_LAMBDA_APPSYNC_HTTP_HOST="+s.server.Host(),
+		"LIVE_LAMBDA_APPSYNC_REALTIME_HOST="+s.server.Host(),
+		"LIVE_LAMBDA_APPSYNC_REGION=us-east-1",
+		"LIVE_LAMBDA_APPSYNC_AUTH_MODE=api_key",
+		"LIVE_LAMBDA_APPSYNC_API_KEY=soak",
+		"LIVE_LAMBDA_TELEMETRY=off",
+		"LIVE_LAMBDA_TAG_LOOKUP=off",
+		"LIVE_LAMBDA_XRAY=off",
+		"SSL_CERT_FILE="+certificate,
+	)
+	s.stderr = &last_line_writer{}
+	s.cmd.Stdout = output
+	s.cmd.Stderr = io.MultiWriter(output, s.stderr)
+	if err := s.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", s.opts.extension, err)
+	}
+	s.exited = make(chan error, 1)
+	go func() { s.exited <- s.cmd.Wait() }()
+
+	if err := s.within(ctx, s.api.wait_registered); err != nil {
+		return fmt.Errorf("the extension did not register: %w", err)
+	}
+	s.function = new_function(port)
+	function_ctx, stop_fn := context.WithCancel(ctx)
+	s.stop_fn = stop_fn
+	go s.function.run(function_ctx)
+	if err := s.wait_ready(ctx); err != nil {
+		return fmt.Errorf("the extension did not connect: %w", err)
+	}
+	return nil
+}
+
+func (s *soak) close() {
+	if s.stop_fn != nil {
+		s.stop_fn()
+	}
+	if s.cmd != nil && s.cmd.Process != nil {
+		// Either fails harmlessly once the extension has exited
+		s.cmd.Process.Signal(syscall.SIGCONT)
+		s.cmd.Process.Kill()
+	}
+	if s.api != nil {
+		s.api.close()
+	}
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// within runs wait with the per-step timeout.
+func (s *soak) within(ctx context.Context, wait func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.timeout)
+	defer cancel()
+	return wait(ctx)
+}
+
+func (s *soak) read_health(ctx context.Context) (healthz, error) {
+	var report healthz
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.health, nil)
+	if err != nil {
+		return report, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	return report, err
+}
+
+// poll calls done every soak_poll_interval until it reports true or the
+// per-step timeout passes.
+func (s *soak) poll(ctx context.Context, done func() bool) error {
+	return s.within(ctx, func(ctx context.Context) error {
+		ticker := time.NewTicker(soak_poll_interval)
+		defer ticker.Stop()
+		for !done() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-s.exited:
+				s.exited <- err
+				return fmt.Errorf("the extension exited: %v", err)
+			case <-ticker.C:
+			}
+		}
+		return nil
+	})
+}
+
+// wait_ready waits until the extension holds one connection, reports itself
+// connected and sees the agent.
+func (s *soak) wait_ready(ctx context.Context) error {
+	return s.poll(ctx, func() bool {
+		connections, _ := s.server.Counts()
+		report, err := s.read_health(ctx)
+		return err == nil && connections == 1 && report.WebSocketConnected && report.AgentPresent
+	})
+}
+
+// cycle invokes the function once and freezes the sandbox afterwards,
+// dropping its connection while frozen when reconnect is set.
+func (s *soak) cycle(ctx context.Context, n int, reconnect bool) error {
+	request_id := fmt.Sprintf("soak-%06d", n)
+	event := []byte(fmt.Sprintf(`{"cycle":%d}`, n))
+	result, err := s.api.invoke(ctx, request_id, event, s.opts.timeout)
+	s.agent.forget(request_id)
+	if err != nil {
+		return err
+	}
+	if result.is_error || !json_equal(result.body, event) {
+		return fmt.Errorf("invocation %s returned %s", request_id, result.body)
+	}
+	if err := s.within(ctx, s.api.wait_idle); err != nil {
+		return fmt.Errorf("the sandbox did not go idle after %s: %w", request_id, err)
+	}
+
+	if err := s.cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		return fmt.Errorf("failed to freeze the extension: %w", err)
+	}
+	time.Sleep(s.opts.freeze)
+	if reconnect {
+		s.server.DropConnections()
+	}
+	if err := s.cmd.Process.Signal(syscall.SIGCONT); err != nil {
+		return fmt.Errorf("failed to thaw the extension: %w", err)
+	}
+	if reconnect {
+		return s.wait_ready(ctx)
+	}
+	return nil
+}
+
+func json_equal(a, b []byte) bool {
+	var left, right interface{}
+	if json.Unmarshal(a, &left) != nil || json.Unmarshal(b, &right) != nil {
+		return false
+	}
+	l, _ := json.Marshal(left)
+	r, _ := json.Marshal(right)
+	return bytes.Equal(l, r)
+}
+
+// sample reads the extension's state once its subscriptions settle; a
+// reconnect restores them a moment after the connection itself.
+func (s *soak) sample(ctx context.Context, n int, baseline int) (soak_sample, error) {
+	sample := soak_sample{cycle: n}
+	deadline := time.Now().Add(soak_settle_timeout)
+	for {
+		report, err := s.read_health(ctx)
+		if err != nil {
+			return sample, fmt.Errorf("failed to read /healthz: %w", err)
+		}
+		sample.goroutines = report.Runtime.Goroutines
+		sample.heap_bytes = report.Runtime.HeapAllocBytes
+		sample.in_flight = report.InFlight
+		sample.connections, sample.subscriptions = s.server.Counts()
+		if baseline < 0 || (sample.subscriptions <= baseline && sample.connections == 1 && sample.in_flight == 0) || time.Now().After(deadline) {
+			return sample, nil
+		}
+		time.Sleep(soak_poll_interval)
+	}
+}
+
+// shut_down stops the function and sends SHUTDOWN, in Lambda's order, and
+// checks the extension exits cleanly with its exit summary as the last line on
+// stderr.
+func (s *soak) shut_down() error {
+	s.stop_fn()
+	s.api.shut_down()
+	var err error
+	select {
+	case err = <-s.exited:
+	case <-time.After(soak_exit_timeout):
+		return fmt.Errorf("the extension did not exit within %s of SHUTDOWN", soak_exit_timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("the extension exited uncleanly: %w", err)
+	}
+	var summary struct {
+		Event         string `json:"event"`
+		ExitCode      int    `json:"exit_code"`
+		ShutdownError string `json:"shutdown_error"`
+	}
+	line := s.stderr.line()
+	if json.Unmarshal(line, &summary) != nil || summary.Event != "live_lambda_exit" {
+		return fmt.Errorf("expected the exit summary as the last line on stderr, got %q", line)
+	}
+	if summary.ExitCode != 0 || summary.ShutdownError != "" {
+		return fmt.Errorf("unclean shutdown: %s", line)
+	}
+	return nil
+}
+
+// run_soak drives the extension through opts.cycles invocations.
+func run_soak(ctx context.Context, opts soak_options, output io.Writer) (soak_report, error) {
+	report := soak_report{}
+	workdir, err := os.MkdirTemp("", "live-lambda-soak")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(workdir)
+
+	s := &soak{opts: opts}
+	defer s.close()
+	if err := s.start(ctx, workdir, output); err != nil {
+		return report, err
+	}
+
+	started := time.Now()
+	baseline := -1
+	for n := 1; n <= opts.cycles; n++ {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		reconnect := opts.reconnect_every > 0 && n%opts.reconnect_every == 0
+		if err := s.cycle(ctx, n, reconnect); err != nil {
+			report.failures++
+			soak_logger.Warn("Cycle failed", "cycle", n, "error", err)
+			if report.failures > opts.max_failures {
+				return report, fmt.Errorf("stopping after %d failed cycles: %w", report.failures, err)
+			}
+		}
+		if reconnect {
+			report.reconnects++
+		}
+		report.cycles = n
+		if n < opts.warmup || (n-opts.warmup)%opts.sample_every != 0 {
+			continue
+		}
+		sample, err := s.sample(ctx, n, baseline)
+		if err != nil {
+			return report, err
+		}
+		if baseline < 0 {
+			baseline = sample.subscriptions
+		}
+		report.samples = append(report.samples, sample)
+		soak_logger.Info("Sampled", "cycle", n, "goroutines", sample.goroutines, "heap_mb", fmt.Sprintf("%.1f", float64(sample.heap_bytes)/(1<<20)), "subscriptions", sample.subscriptions, "connections", sample.connections)
+	}
+	report.elapsed = time.Since(started)
+	report.answered, report.retransmitted = s.agent.counts()
+	report.passed = s.function.passed_through()
+	report.findings = evaluate_samples(report.samples, opts)
+	if report.failures > 0 {
+		report.findings = append(report.findings, fmt.Sprintf("%d of %d cycles failed", report.failures, report.cycles))
+	}
+	if err := s.shut_down(); err != nil {
+		report.findings = append(report.findings, err.Error())
+	}
+	return report, nil
+}
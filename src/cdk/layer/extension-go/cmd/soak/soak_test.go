@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuntimeAPIHandsInvocationToFunctionAndExtension(t *testing.T) {
+	api, err := new_runtime_api("orders")
+	if err != nil {
+		t.Fatalf("new_runtime_api: %v", err)
+	}
+	defer api.close()
+	base := "http://" + api.address()
+	resp, err := http.Post(base+extension_api_path+"/register", "application/json", strings.NewReader(`{"events":["INVOKE","SHUTDOWN"]}`))
+	if err != nil || resp.Header.Get("Lambda-Extension-Identifier") == "" {
+		t.Fatalf("register failed: %v", err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result := make(chan invocation_result, 1)
+	go func() {
+		r, _ := api.invoke(ctx, "r1", []byte(`{"n":1}`), 5*time.Second)
+		result <- r
+	}()
+
+	next, err := http.Get(base + runtime_api_path + "/invocation/next")
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	event, _ := io.ReadAll(next.Body)
+	next.Body.Close()
+	if next.Header.Get("Lambda-Runtime-Aws-Request-Id") != "r1" || string(event) != `{"n":1}` {
+		t.Fatalf("unexpected invocation %q for %q", event, next.Header.Get("Lambda-Runtime-Aws-Request-Id"))
+	}
+	extension_event, err := http.Get(base + extension_api_path + "/event/next")
+	if err != nil {
+		t.Fatalf("event/next: %v", err)
+	}
+	var invoke struct {
+		EventType string `json:"eventType"`
+		RequestID string `json:"requestId"`
+	}
+	json.NewDecoder(extension_event.Body).Decode(&invoke)
+	extension_event.Body.Close()
+	if invoke.EventType != "INVOKE" || invoke.RequestID != "r1" {
+		t.Fatalf("unexpected extension event %+v", invoke)
+	}
+
+	posted, err := http.Post(base+runtime_api_path+"/invocation/r1/response", "application/json", strings.NewReader(`{"ok":true}`))
+	if err != nil || posted.StatusCode != http.StatusAccepted {
+		t.Fatalf("response failed: %v", err)
+	}
+	posted.Body.Close()
+	if r := <-result; string(r.body) != `{"ok":true}` || r.is_error {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	again, _ := http.Post(base+runtime_api_path+"/invocation/r1/response", "application/json", strings.NewReader(`{}`))
+	if again.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a second response to be refused, got %d", again.StatusCode)
+	}
+	again.Body.Close()
+}
+
+func TestEvaluateSamplesFindsLeaks(t *testing.T) {
+	opts := soak_options{goroutine_slack: 5, heap_growth: 1 << 20}
+	steady := []soak_sample{}
+	for n := 0; n < 8; n++ {
+		steady = append(steady, soak_sample{cycle: n * 50, goroutines: 20 + n%2, heap_bytes: 4<<20 + uint64(n%3)<<19, connections: 1, subscriptions: 2})
+	}
+	if findings := evaluate_samples(steady, opts); len(findings) != 0 {
+		t.Fatalf("expected a steady run to pass, got %v", findings)
+	}
+
+	leaking := append([]soak_sample(nil), steady...)
+	for i := range leaking {
+		leaking[i].goroutines += i * 2
+		leaking[i].heap_bytes += uint64(i) << 20
+	}
+	leaking[4].subscriptions = 3
+	leaking[5].connections = 2
+	leaking[6].in_flight = 1
+	findings := evaluate_samples(leaking, opts)
+	for _, expected := range []string{"goroutines grew", "heap grew", "3 subscriptions", "2 connections", "still in flight"} {
+		found := false
+		for _, finding := range findings {
+			found = found || strings.Contains(finding, expected)
+		}
+		if !found {
+			t.Errorf("expected a finding about %q in %v", expected, findings)
+		}
+	}
+}
+
+func TestLastLineWriter(t *testing.T) {
+	w := &last_line_writer{}
+	io.WriteString(w, "first\nsec")
+	io.WriteString(w, "ond\nthi")
+	if got := string(w.line()); got != "second" {
+		t.Fatalf("expected the last complete line, got %q", got)
+	}
+}
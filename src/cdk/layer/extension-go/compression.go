@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// JSON events compress well, so gzip keeps typical payloads well under the
+// AppSync event limit and cuts WebSocket traffic. Compression is negotiated:
+// the agent lists the encodings it can decode in accept_encoding on its
+// heartbeats, and only then does a request envelope carry event_payload as a
+// base64 string with content_encoding naming the encoding. Every envelope
+// carries accept_encoding so the agent may answer with an encoded_payload frame.
+// LIVE_LAMBDA_COMPRESSION=off disables both directions.
+
+const (
+	compression_print_prefix      = "[LiveLambdaExt:Compression]"
+	content_encoding_gzip         = protocol.ContentEncodingGzip
+	compression_off               = "off"
+	encoded_payload_frame_type    = "encoded_payload"
+	default_compression_min_bytes = 1024
+)
+
+// encoded_payload is a response the agent compressed before publishing.
+type encoded_payload struct {
+	Type            string `json:"type"`
+	ContentEncoding string `json:"content_encoding"`
+	Data            string `json:"data"` // base64 of the encoded payload
+}
+
+type payload_compressor struct {
+	min_bytes int // smaller events are sent as they are
+}
+
+// new_payload_compressor_from_config returns nil when compression is disabled.
+func new_payload_compressor_from_config(settings Config) *payload_compressor {
+	if settings.Compression == compression_off {
+		log.Printf("%s Compression disabled", compression_print_prefix)
+		return nil
+	}
+	return &payload_compressor{min_bytes: settings.CompressionMinBytes}
+}
+
+// compress_request_envelope gzips the event in envelope when the agent accepts
+// gzip and it is worth it. A nil compressor leaves envelope unchanged.
+func (c *payload_compressor) compress_request_envelope(envelope *protocol.Request, event []byte, agent_accepts bool) {
+	if c == nil {
+		return
+	}
+	envelope.AcceptEncoding = []string{content_encoding_gzip}
+	if !agent_accepts || len(event) < c.min_bytes {
+		return
+	}
+	data, err := gzip_base64(event)
+	if err != nil {
+		log.Printf("%s Could not compress event, publishing it as is: %v", compression_print_prefix, err)
+		return
+	}
+	if len(data) >= len(event) {
+		return
+	}
+	envelope.EventPayload, _ = json.Marshal(data)
+	envelope.ContentEncoding = content_encoding_gzip
+}
+
+func gzip_base64(payload []byte) (string, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// parse_encoded_payload decodes a frame if it is an encoded_payload; ok is false for other frames.
+func parse_encoded_payload(frame []byte) (encoded_payload, bool, error) {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &probe) != nil || probe.Type != encoded_payload_frame_type {
+		return encoded_payload{}, false, nil
+	}
+	var encoded encoded_payload
+	if err := json.Unmarshal(frame, &encoded); err != nil {
+		return encoded_payload{}, true, fmt.Errorf("malformed encoded_payload frame: %w", err)
+	}
+	return encoded, true, nil
+}
+
+// decode_encoded_payload returns the original payload, refusing anything that
+// inflates beyond Lambda's payload limit.
+func decode_encoded_payload(encoded encoded_payload) ([]byte, error) {
+	if encoded.ContentEncoding != content_encoding_gzip {
+		return nil, fmt.Errorf("unsupported content_encoding %q", encoded.ContentEncoding)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(encoded.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encoded_payload data: %w", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gzip payload: %w", err)
+	}
+	defer reader.Close()
+	payload, err := io.ReadAll(io.LimitReader(reader, max_offloaded_payload_bytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+	if len(payload) > max_offloaded_payload_bytes {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", max_offloaded_payload_bytes)
+	}
+	return payload, nil
+}
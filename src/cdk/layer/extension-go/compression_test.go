@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func large_event() []byte {
+	return []byte(`{"records":[` + strings.Repeat(`{"body":"hello world"},`, 200) + `{}]}`)
+}
+
+func TestCompressRequestEnvelopeRoundTrip(t *testing.T) {
+	compressor := &payload_compressor{min_bytes: default_compression_min_bytes}
+	event := large_event()
+	envelope := &protocol.Request{RequestID: "r1", EventPayload: event}
+
+	compressor.compress_request_envelope(envelope, event, true)
+
+	if envelope.ContentEncoding != content_encoding_gzip || envelope.Validate() != nil {
+		t.Fatalf("expected content_encoding gzip, got %q", envelope.ContentEncoding)
+	}
+	var data string
+	json.Unmarshal(envelope.EventPayload, &data)
+	if len(data) >= len(event) {
+		t.Fatalf("expected the event to shrink, got %d bytes from %d", len(data), len(event))
+	}
+	decoded, err := decode_encoded_payload(encoded_payload{ContentEncoding: content_encoding_gzip, Data: data})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(decoded, event) {
+		t.Fatal("expected the decoded event to match the original")
+	}
+}
+
+func TestCompressRequestEnvelopeNegotiates(t *testing.T) {
+	event := large_event()
+	cases := map[string]struct {
+		compressor    *payload_compressor
+		agent_accepts bool
+	}{
+		"disabled":        {compressor: nil, agent_accepts: true},
+		"agent declines":  {compressor: &payload_compressor{min_bytes: 1024}, agent_accepts: false},
+		"below threshold": {compressor: &payload_compressor{min_bytes: len(event) + 1}, agent_accepts: true},
+	}
+	for name, tc := range cases {
+		envelope := &protocol.Request{EventPayload: event}
+		tc.compressor.compress_request_envelope(envelope, event, tc.agent_accepts)
+		if envelope.ContentEncoding != "" {
+			t.Errorf("%s: expected the event to stay uncompressed", name)
+		}
+		if (envelope.AcceptEncoding != nil) != (tc.compressor != nil) {
+			t.Errorf("%s: expected accept_encoding only when compression is enabled", name)
+		}
+	}
+}
+
+func TestDecodeAgentResponseDecompresses(t *testing.T) {
+	response := large_event()
+	data, err := gzip_base64(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &RuntimeAPIProxy{chunks: new_chunk_reassembler(time.Minute)}
+	frame := map[string]interface{}{"type": encoded_payload_frame_type, "content_encoding": content_encoding_gzip, "data": data}
+
+	decoded, _, complete, err := proxy.decode_agent_response("req-1", frame)
+	if err != nil || !complete {
+		t.Fatalf("expected a complete response, got complete=%v err=%v", complete, err)
+	}
+	if !bytes.Equal(decoded, response) {
+		t.Fatal("expected the decompressed response")
+	}
+}
+
+func TestDecodeEncodedPayloadRejectsUnknownEncodings(t *testing.T) {
+	if _, err := decode_encoded_payload(encoded_payload{ContentEncoding: "zstd", Data: ""}); err == nil {
+		t.Fatal("expected an unsupported encoding to be rejected")
+	}
+	if _, _, err := parse_encoded_payload([]byte(`{"type":"encoded_payload","data":1}`)); err == nil {
+		t.Fatal("expected a malformed frame to be rejected")
+	}
+}
+
+func TestPresenceTrackerRecordsAcceptedEncodings(t *testing.T) {
+	var disabled *presence_tracker
+	if disabled.accepts_encoding(content_encoding_gzip) {
+		t.Fatal("expected a disabled presence check to accept no encodings")
+	}
+	tracker := new_presence_tracker(15 * time.Second)
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1","accept_encoding":["gzip"]}`))
+	if !tracker.accepts_encoding(content_encoding_gzip) {
+		t.Fatal("expected gzip to be accepted after the heartbeat")
+	}
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1"}`))
+	if tracker.accepts_encoding(content_encoding_gzip) {
+		t.Fatal("expected a heartbeat without accept_encoding to withdraw it")
+	}
+}
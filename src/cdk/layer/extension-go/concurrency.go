@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Concurrency pings
+//
+// While the agent is present, every sandbox publishes a ping lifecycle event
+// each LIVE_LAMBDA_PING_INTERVAL (default 10s; off disables) with the number
+// of invocations it is handling. The agent counts the sandboxes that pinged
+// recently and how many of them are busy, which estimates the function's live
+// concurrency: how many execution environments a change would affect once
+// interception is on. Invocations passed through to the function count until
+// the runtime posts their response or error, or until their deadline.
+
+const (
+	ping_event_type       = "ping"
+	default_ping_interval = 10 * time.Second
+	ping_publish_timeout  = 5 * time.Second
+)
+
+// invocation_activity tracks invocations passed through to the function.
+type invocation_activity struct {
+	mu          sync.Mutex
+	passthrough map[string]time.Time // request ID to deadline
+	now         func() time.Time
+}
+
+func new_invocation_activity() *invocation_activity {
+	return &invocation_activity{passthrough: map[string]time.Time{}, now: time.Now}
+}
+
+// start records that the function is handling request_id until deadline at the latest.
+func (a *invocation_activity) start(request_id string, deadline time.Time) {
+	if a == nil || request_id == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.passthrough[request_id] = deadline
+}
+
+// finish records that the runtime answered request_id.
+func (a *invocation_activity) finish(request_id string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.passthrough, request_id)
+}
+
+// count returns the passed-through invocations that are still running.
+func (a *invocation_activity) count() int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for request_id, deadline := range a.passthrough {
+		if now.After(deadline) {
+			delete(a.passthrough, request_id)
+		}
+	}
+	return len(a.passthrough)
+}
+
+// in_flight returns every invocation this sandbox is handling, intercepted or not.
+func (p *RuntimeAPIProxy) in_flight() int {
+	return p.requests.in_flight() + p.activity.count()
+}
+
+// ping_data is the data of a ping lifecycle event.
+func (p *RuntimeAPIProxy) ping_data(interval time.Duration) map[string]interface{} {
+	enabled, _ := p.interception.enabled()
+	return map[string]interface{}{
+		"in_flight":            p.in_flight(),
+		"interception_enabled": enabled && !p.shedder.active(),
+		"interval_ms":          interval.Milliseconds(),
+	}
+}
+
+// run_pings publishes a ping every interval while the agent is present, until
+// ctx is done. An interval of 0 disables pings.
+func (p *RuntimeAPIProxy) run_pings(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !p.presence.present() {
+				continue
+			}
+			ping_ctx, cancel := context.WithTimeout(ctx, ping_publish_timeout)
+			_ = p.publish_lifecycle_event(ping_ctx, ping_event_type, p.ping_data(interval))
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvocationActivityCountsUntilAnsweredOrExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	activity := new_invocation_activity()
+	activity.now = func() time.Time { return now }
+
+	activity.start("req-1", now.Add(time.Minute))
+	activity.start("req-2", now.Add(time.Second))
+	activity.start("", now.Add(time.Minute))
+	if got := activity.count(); got != 2 {
+		t.Fatalf("expected 2 running invocations, got %d", got)
+	}
+
+	activity.finish("req-1")
+	now = now.Add(2 * time.Second)
+	if got := activity.count(); got != 0 {
+		t.Fatalf("expected answered and expired invocations to be dropped, got %d", got)
+	}
+
+	var disabled *invocation_activity
+	disabled.start("req-3", now)
+	if disabled.count() != 0 {
+		t.Fatal("expected a nil tracker to count nothing")
+	}
+}
+
+func TestPingDataCountsInterceptedAndPassedThroughInvocations(t *testing.T) {
+	proxy := new_tracking_proxy()
+	proxy.interception = new_interception_switch()
+	proxy.activity = new_invocation_activity()
+	proxy.requests.register("req-intercepted", nil, nil)
+	proxy.activity.start("req-passed", time.Now().Add(time.Minute))
+
+	data := proxy.ping_data(10 * time.Second)
+	if data["in_flight"] != 2 || data["interception_enabled"] != true || data["interval_ms"] != int64(10000) {
+		t.Fatalf("unexpected ping data %v", data)
+	}
+}
@@ -0,0 +1,818 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration
+//
+// Every setting is read once at startup into a Config. Each value comes from
+// the environment variable of the same name if it is set, otherwise from the
+// optional JSON file named by LIVE_LAMBDA_CONFIG_FILE (by default
+// /opt/live-lambda.config.json, which the layer build copies from
+// live-lambda.config.json at the project root), otherwise from its default.
+// The file is an object keyed by environment variable name:
+//
+//	{"LIVE_LAMBDA_CHUNK_SIZE": 102400, "LIVE_LAMBDA_FALLBACK": "error"}
+//
+// Durations accept Go durations such as "30s" or a plain number of seconds.
+
+const (
+	config_print_prefix   = "[LiveLambdaExt:Config]"
+	default_config_file   = "/opt/live-lambda.config.json"
+	default_listener_port = 9009
+	redacted_config_value = "REDACTED"
+)
+
+// Config is the extension's effective configuration.
+type Config struct {
+	AppSyncHTTPHost     string
+	AppSyncRealtimeHost string
+	AppSyncRegion       string
+	AppSyncNamespace    string // channel namespace; one per stage when stages share an API
+	AppSyncAuthMode     string // iam, api_key, cognito or lambda
+	AppSyncAPIKey       string // required when AppSyncAuthMode is api_key
+	AppSyncAuthToken    string // required when AppSyncAuthMode is cognito or lambda
+	NamespaceCheck      string // off, warn or enforce
+	ChannelScope        string // template for the segments between the namespace and each channel, e.g. {function}/{dev}
+	DeveloperID         string // fills {dev} in ChannelScope
+	RequestsChannel     string // template for the requests channel, e.g. requests/{function}
+	ResponseChannel     string // template for the response channels, ending in {request_id}
+	ListenerPort        int
+	RuntimeAPIEndpoint  string
+
+	FunctionName     string
+	FunctionVersion  string
+	FunctionRegion   string
+	FunctionMemoryMB int
+	FunctionInitType string // on-demand, provisioned-concurrency or snap-start
+
+	AWSProfile          string
+	AWSCredentialSource string
+
+	DiagnosticsInterval    time.Duration // 0 disables self-diagnostics
+	PingInterval           time.Duration // 0 disables concurrency pings
+	ChunkReassemblyTimeout time.Duration
+	ChunkSize              int
+	ChunkRetransmitAfter   time.Duration
+	LatencySummaryEvery    int
+	EnvAllowlist           string
+	EnvDenylist            string
+	EnvEncryption          string // auto or required
+	ShareCredentials       bool   // add AWS credentials to sealed env snapshots
+	EnvChannel             bool   // publish the environment on env/{function}
+	EnvRedact              string // patterns to redact from it, besides the denylist
+	RedactLogs             bool   // scrub the redacted variables' values from forwarded logs
+	RedactPaths            string // JSONPath patterns of event fields to redact
+	LocalAPISocket         string // empty disables the local API
+	FunctionTags           string // injected tags; skips the Lambda API lookup
+	TagLookup              bool
+	OffloadBucket          string // empty disables payload offloading
+	OffloadPrefix          string
+	OffloadRegion          string
+	OffloadThreshold       int
+	OffloadTTL             time.Duration // 0 leaves uploads without an expiry tag
+	SamplingMaxRPS         float64       // 0 disables adaptive sampling
+	SamplingMinRate        float64
+	SamplingRecoverRatio   float64
+	SamplingCooldown       time.Duration
+	PresenceTTL            time.Duration // 0 offers every invocation to the agent
+	Fallback               FallbackPolicy
+	MailboxQueueURL        string // empty disables pull delivery
+	Compression            string // gzip or off
+	CompressionMinBytes    int
+	TunnelFailureLimit     int // 0 never disables interception after tunnel failures
+	TunnelFailureWindow    time.Duration
+	Transport              string        // appsync or iot
+	TransportPoolSize      int           // connections publishes are spread over
+	IoTEndpoint            string        // required when Transport is iot
+	IoTRegion              string        // defaults to AppSyncRegion
+	DrainTimeout           time.Duration // how long shutdown waits for in-flight invocations
+	DeadlineMargin         time.Duration // stop waiting for the agent this long before the invocation deadline
+	Telemetry              bool
+	TelemetryTypes         string
+	TelemetryPort          int
+	TelemetryCooperative   string // auto, on or off
+	Metrics                bool   // write EMF metrics to stdout
+	MetricsNamespace       string
+	Record                 string // off, s3 or channel
+	RecordResponses        bool
+	RecordCapacity         int
+	RecordFlushInterval    time.Duration
+	LoadShedding           bool
+	ShedMemoryPercent      int    // of the function's memory size
+	ShedMaxFunctionMB      int    // larger functions never shed load
+	RegionalEndpoints      string // region=http_host[|realtime_host],... for agents preferring another region
+	RegionRetryInterval    time.Duration
+	FailoverEndpoints      string // region=http_host[|realtime_host],... standby endpoints, in priority order
+	FailoverAfter          int    // failures in a row before switching endpoints
+	LogLevel               string // debug, info, warn or error
+	LogFormat              string // text or json
+	XRay                   bool
+	XRayDaemonAddress      string        // set by Lambda when active tracing is enabled
+	Enabled                bool          // false registers for INVOKE only and passes every invocation through
+	ClaimWindow            time.Duration // 0 never offers invocations for agents to claim
+	AckWindow              time.Duration // 0 waits for the agent's response without an ack
+	RestoreReconnect       bool          // false forwards SnapStart restore calls without reconnecting
+	ResponseCacheTTL       time.Duration // 0 disables the response cache
+	ResponseCacheSize      int
+	ResponseCacheMaxBytes  int
+	ResponseCacheIgnore    string // top-level event fields left out of the cache key
+	ReencodeEvents         bool   // true re-encodes JSON object events instead of passing their bytes through
+	ResponseShapeCheck     bool   // false posts agent responses without checking them against the event source
+	RuntimeAPIMaxIdleConns int
+	RuntimeAPIPostTimeout  time.Duration // 0 never times out posts to the Runtime API
+	PayloadKeyARN          string        // KMS key or Secrets Manager secret; empty sends payloads unencrypted
+	SigningSecretARN       string        // SSM parameter or Secrets Manager secret; empty accepts unsigned responses
+	IdleReconnectAfter     time.Duration // 0 never checks the connection after the sandbox idled
+	WarmStandby            string        // auto, on or off
+	ResponseSubscription   string        // per_request or wildcard
+	ConnectionCheckAfter   time.Duration // 0 never checks the connection before an invocation
+	SampleRate             float64       // percent of matching invocations intercepted
+	InterceptWhen          string        // event predicates; empty matches every invocation
+	RoutingRules           string        // JSON rules or an SSM parameter ARN holding them
+	DynamicConfigParameter string        // SSM parameter ARN; empty never changes settings at runtime
+	DynamicConfigRefresh   time.Duration // 0 reads the parameter on every invocation
+
+	file    string            // the config file that was read, if any
+	sources map[string]string // setting name to "env", "file" or "parameter"; defaults are absent
+}
+
+func default_config() Config {
+	return Config{
+		AppSyncNamespace:       default_channel_namespace,
+		AppSyncAuthMode:        appsync_auth_iam,
+		NamespaceCheck:         namespace_check_off,
+		RequestsChannel:        default_requests_channel,
+		ResponseChannel:        default_response_channel,
+		ListenerPort:           default_listener_port,
+		TagLookup:              true,
+		DiagnosticsInterval:    default_diagnostics_interval,
+		PingInterval:           default_ping_interval,
+		ChunkReassemblyTimeout: default_chunk_reassembly_timeout,
+		ChunkSize:              default_chunk_size,
+		ChunkRetransmitAfter:   default_chunk_retransmit_after,
+		LatencySummaryEvery:    default_latency_summary_every,
+		OffloadPrefix:          default_offload_prefix,
+		OffloadThreshold:       default_offload_threshold,
+		OffloadTTL:             default_offload_ttl,
+		SamplingMinRate:        default_sampling_min_rate,
+		SamplingRecoverRatio:   default_sampling_recover_ratio,
+		SamplingCooldown:       default_sampling_cooldown,
+		PresenceTTL:            default_presence_ttl,
+		ClaimWindow:            default_claim_window,
+		AckWindow:              default_ack_window,
+		RestoreReconnect:       true,
+		ResponseShapeCheck:     true,
+		ResponseCacheSize:      default_response_cache_size,
+		ResponseCacheMaxBytes:  default_response_cache_max_bytes,
+		ResponseCacheIgnore:    default_response_cache_ignore,
+		RuntimeAPIMaxIdleConns: default_runtime_api_max_idle_conns,
+		RuntimeAPIPostTimeout:  default_runtime_api_post_timeout,
+		IdleReconnectAfter:     default_idle_reconnect_after,
+		WarmStandby:            warm_standby_auto,
+		ResponseSubscription:   response_subscription_per_request,
+		ConnectionCheckAfter:   default_connection_check_after,
+		SampleRate:             default_sample_rate,
+		DynamicConfigRefresh:   default_dynamic_config_refresh,
+		Compression:            content_encoding_gzip,
+		CompressionMinBytes:    default_compression_min_bytes,
+		TunnelFailureLimit:     default_tunnel_failure_limit,
+		TunnelFailureWindow:    default_tunnel_failure_window,
+		Transport:              transport_appsync,
+		TransportPoolSize:      default_transport_pool_size,
+		DrainTimeout:           default_drain_timeout,
+		DeadlineMargin:         default_deadline_margin,
+		EnvEncryption:          env_encryption_auto,
+		RedactLogs:             true,
+		Fallback: FallbackPolicy{
+			Mode:    FallbackLocal,
+			Retries: default_fallback_retries,
+			Backoff: default_fallback_backoff,
+		},
+		Telemetry:            true,
+		TelemetryTypes:       default_telemetry_types,
+		TelemetryPort:        default_telemetry_port,
+		TelemetryCooperative: telemetry_cooperative_auto,
+		MetricsNamespace:     default_metrics_namespace,
+		Record:               record_off,
+		RecordCapacity:       default_record_capacity,
+		RecordFlushInterval:  default_record_flush_every,
+		LoadShedding:         true,
+		ShedMemoryPercent:    default_shed_memory_percent,
+		ShedMaxFunctionMB:    default_shed_max_function_mb,
+		RegionRetryInterval:  default_region_retry_interval,
+		FailoverAfter:        default_failover_after,
+		LogLevel:             "info",
+		LogFormat:            log_format_text,
+		XRay:                 true,
+		Enabled:              true,
+		sources:              map[string]string{},
+	}
+}
+
+// config_setting binds a setting name to a Config field.
+type config_setting struct {
+	name  string
+	parse func(c *Config, value string) error
+	show  func(c Config) string
+}
+
+func string_setting(name string, field func(c *Config) *string) config_setting {
+	return config_setting{
+		name:  name,
+		parse: func(c *Config, value string) error { *field(c) = value; return nil },
+		show:  func(c Config) string { return *field(&c) },
+	}
+}
+
+func int_setting(name string, field func(c *Config) *int) config_setting {
+	return config_setting{
+		name: name,
+		parse: func(c *Config, value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.New("expected an integer")
+			}
+			*field(c) = parsed
+			return nil
+		},
+		show: func(c Config) string { return strconv.Itoa(*field(&c)) },
+	}
+}
+
+func float_setting(name string, field func(c *Config) *float64) config_setting {
+	return config_setting{
+		name: name,
+		parse: func(c *Config, value string) error {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.New("expected a number")
+			}
+			*field(c) = parsed
+			return nil
+		},
+		show: func(c Config) string { return strconv.FormatFloat(*field(&c), 'g', -1, 64) },
+	}
+}
+
+// duration_setting reads a duration. With allow_off, "off" reads as 0.
+func duration_setting(name string, allow_off bool, field func(c *Config) *time.Duration) config_setting {
+	return config_setting{
+		name: name,
+		parse: func(c *Config, value string) error {
+			if allow_off && strings.EqualFold(value, "off") {
+				*field(c) = 0
+				return nil
+			}
+			parsed, err := parse_config_duration(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = parsed
+			return nil
+		},
+		show: func(c Config) string {
+			if allow_off && *field(&c) == 0 {
+				return "off"
+			}
+			return field(&c).String()
+		},
+	}
+}
+
+// switch_setting reads on/off, true/false, yes/no or 1/0.
+func switch_setting(name string, field func(c *Config) *bool) config_setting {
+	return config_setting{
+		name: name,
+		parse: func(c *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "on", "true", "yes", "1":
+				*field(c) = true
+			case "off", "false", "no", "0":
+				*field(c) = false
+			default:
+				return errors.New("expected on or off")
+			}
+			return nil
+		},
+		show: func(c Config) string {
+			if *field(&c) {
+				return "on"
+			}
+			return "off"
+		},
+	}
+}
+
+func fallback_mode_setting(name string) config_setting {
+	return config_setting{
+		name: name,
+		parse: func(c *Config, value string) error {
+			mode, err := ParseFallbackMode(value)
+			if err != nil {
+				return err
+			}
+			c.Fallback.Mode = mode
+			return nil
+		},
+		show: func(c Config) string { return string(c.Fallback.Mode) },
+	}
+}
+
+// config_settings lists every setting in the order Dump prints them.
+var config_settings = []config_setting{
+	string_setting(live_lambda_appsync_http_host_env, func(c *Config) *string { return &c.AppSyncHTTPHost }),
+	string_setting(live_lambda_appsync_realtime_host_env, func(c *Config) *string { return &c.AppSyncRealtimeHost }),
+	string_setting(live_lambda_appsync_region_env, func(c *Config) *string { return &c.AppSyncRegion }),
+	string_setting(live_lambda_appsync_namespace_env, func(c *Config) *string { return &c.AppSyncNamespace }),
+	string_setting(live_lambda_appsync_auth_mode_env, func(c *Config) *string { return &c.AppSyncAuthMode }),
+	string_setting(live_lambda_appsync_api_key_env, func(c *Config) *string { return &c.AppSyncAPIKey }),
+	string_setting(live_lambda_appsync_auth_token_env, func(c *Config) *string { return &c.AppSyncAuthToken }),
+	string_setting(live_lambda_namespace_check_env, func(c *Config) *string { return &c.NamespaceCheck }),
+	string_setting(live_lambda_channel_scope_env, func(c *Config) *string { return &c.ChannelScope }),
+	string_setting(live_lambda_developer_id_env, func(c *Config) *string { return &c.DeveloperID }),
+	string_setting(live_lambda_requests_channel_env, func(c *Config) *string { return &c.RequestsChannel }),
+	string_setting(live_lambda_response_channel_env, func(c *Config) *string { return &c.ResponseChannel }),
+	int_setting(lrap_listener_port_env, func(c *Config) *int { return &c.ListenerPort }),
+	string_setting(lrap_runtime_api_endpoint_env, func(c *Config) *string { return &c.RuntimeAPIEndpoint }),
+	string_setting("AWS_LAMBDA_FUNCTION_NAME", func(c *Config) *string { return &c.FunctionName }),
+	string_setting("AWS_LAMBDA_FUNCTION_VERSION", func(c *Config) *string { return &c.FunctionVersion }),
+	string_setting("AWS_REGION", func(c *Config) *string { return &c.FunctionRegion }),
+	int_setting("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", func(c *Config) *int { return &c.FunctionMemoryMB }),
+	string_setting("AWS_LAMBDA_INITIALIZATION_TYPE", func(c *Config) *string { return &c.FunctionInitType }),
+	string_setting(live_lambda_aws_profile_env, func(c *Config) *string { return &c.AWSProfile }),
+	string_setting(live_lambda_aws_credential_source_env, func(c *Config) *string { return &c.AWSCredentialSource }),
+	duration_setting(live_lambda_diagnostics_interval_env, true, func(c *Config) *time.Duration { return &c.DiagnosticsInterval }),
+	duration_setting(live_lambda_ping_interval_env, true, func(c *Config) *time.Duration { return &c.PingInterval }),
+	duration_setting(live_lambda_chunk_timeout_env, false, func(c *Config) *time.Duration { return &c.ChunkReassemblyTimeout }),
+	int_setting(live_lambda_chunk_size_env, func(c *Config) *int { return &c.ChunkSize }),
+	duration_setting(live_lambda_chunk_retransmit_env, false, func(c *Config) *time.Duration { return &c.ChunkRetransmitAfter }),
+	int_setting(live_lambda_latency_summary_every_env, func(c *Config) *int { return &c.LatencySummaryEvery }),
+	string_setting(live_lambda_env_allowlist_env, func(c *Config) *string { return &c.EnvAllowlist }),
+	string_setting(live_lambda_env_denylist_env, func(c *Config) *string { return &c.EnvDenylist }),
+	string_setting(live_lambda_env_encryption_env, func(c *Config) *string { return &c.EnvEncryption }),
+	switch_setting(live_lambda_share_credentials_env, func(c *Config) *bool { return &c.ShareCredentials }),
+	switch_setting(live_lambda_env_channel_env, func(c *Config) *bool { return &c.EnvChannel }),
+	string_setting(live_lambda_env_redact_env, func(c *Config) *string { return &c.EnvRedact }),
+	switch_setting(live_lambda_redact_logs_env, func(c *Config) *bool { return &c.RedactLogs }),
+	string_setting(live_lambda_redact_paths_env, func(c *Config) *string { return &c.RedactPaths }),
+	string_setting(live_lambda_local_api_socket_env, func(c *Config) *string { return &c.LocalAPISocket }),
+	string_setting(live_lambda_function_tags_env, func(c *Config) *string { return &c.FunctionTags }),
+	switch_setting(live_lambda_tag_lookup_env, func(c *Config) *bool { return &c.TagLookup }),
+	string_setting(live_lambda_offload_bucket_env, func(c *Config) *string { return &c.OffloadBucket }),
+	string_setting(live_lambda_offload_prefix_env, func(c *Config) *string { return &c.OffloadPrefix }),
+	string_setting(live_lambda_offload_region_env, func(c *Config) *string { return &c.OffloadRegion }),
+	int_setting(live_lambda_offload_threshold_env, func(c *Config) *int { return &c.OffloadThreshold }),
+	duration_setting(live_lambda_offload_ttl_env, true, func(c *Config) *time.Duration { return &c.OffloadTTL }),
+	float_setting(live_lambda_sampling_max_rps_env, func(c *Config) *float64 { return &c.SamplingMaxRPS }),
+	float_setting(live_lambda_sampling_min_rate_env, func(c *Config) *float64 { return &c.SamplingMinRate }),
+	float_setting(live_lambda_sampling_recover_ratio_env, func(c *Config) *float64 { return &c.SamplingRecoverRatio }),
+	duration_setting(live_lambda_sampling_cooldown_env, false, func(c *Config) *time.Duration { return &c.SamplingCooldown }),
+	duration_setting(live_lambda_presence_ttl_env, true, func(c *Config) *time.Duration { return &c.PresenceTTL }),
+	fallback_mode_setting(live_lambda_fallback_env),
+	int_setting(live_lambda_fallback_retries_env, func(c *Config) *int { return &c.Fallback.Retries }),
+	duration_setting(live_lambda_fallback_backoff_env, false, func(c *Config) *time.Duration { return &c.Fallback.Backoff }),
+	string_setting(live_lambda_mailbox_queue_url_env, func(c *Config) *string { return &c.MailboxQueueURL }),
+	string_setting(live_lambda_compression_env, func(c *Config) *string { return &c.Compression }),
+	int_setting(live_lambda_compression_min_bytes_env, func(c *Config) *int { return &c.CompressionMinBytes }),
+	int_setting(live_lambda_tunnel_failure_limit_env, func(c *Config) *int { return &c.TunnelFailureLimit }),
+	duration_setting(live_lambda_tunnel_failure_window_env, false, func(c *Config) *time.Duration { return &c.TunnelFailureWindow }),
+	string_setting(live_lambda_transport_env, func(c *Config) *string { return &c.Transport }),
+	int_setting(live_lambda_transport_pool_size_env, func(c *Config) *int { return &c.TransportPoolSize }),
+	string_setting(live_lambda_iot_endpoint_env, func(c *Config) *string { return &c.IoTEndpoint }),
+	string_setting(live_lambda_iot_region_env, func(c *Config) *string { return &c.IoTRegion }),
+	duration_setting(live_lambda_drain_timeout_env, true, func(c *Config) *time.Duration { return &c.DrainTimeout }),
+	duration_setting(live_lambda_deadline_margin_env, true, func(c *Config) *time.Duration { return &c.DeadlineMargin }),
+	switch_setting(live_lambda_telemetry_env, func(c *Config) *bool { return &c.Telemetry }),
+	string_setting(live_lambda_telemetry_types_env, func(c *Config) *string { return &c.TelemetryTypes }),
+	int_setting(live_lambda_telemetry_port_env, func(c *Config) *int { return &c.TelemetryPort }),
+	string_setting(live_lambda_telemetry_cooperative_env, func(c *Config) *string { return &c.TelemetryCooperative }),
+	switch_setting(live_lambda_metrics_env, func(c *Config) *bool { return &c.Metrics }),
+	string_setting(live_lambda_metrics_namespace_env, func(c *Config) *string { return &c.MetricsNamespace }),
+	string_setting(live_lambda_record_env, func(c *Config) *string { return &c.Record }),
+	switch_setting(live_lambda_record_responses_env, func(c *Config) *bool { return &c.RecordResponses }),
+	int_setting(live_lambda_record_capacity_env, func(c *Config) *int { return &c.RecordCapacity }),
+	duration_setting(live_lambda_record_flush_interval_env, false, func(c *Config) *time.Duration { return &c.RecordFlushInterval }),
+	switch_setting(live_lambda_load_shedding_env, func(c *Config) *bool { return &c.LoadShedding }),
+	int_setting(live_lambda_shed_memory_percent_env, func(c *Config) *int { return &c.ShedMemoryPercent }),
+	int_setting(live_lambda_shed_max_function_mb_env, func(c *Config) *int { return &c.ShedMaxFunctionMB }),
+	string_setting(live_lambda_regional_endpoints_env, func(c *Config) *string { return &c.RegionalEndpoints }),
+	duration_setting(live_lambda_region_retry_interval_env, false, func(c *Config) *time.Duration { return &c.RegionRetryInterval }),
+	string_setting(live_lambda_failover_endpoints_env, func(c *Config) *string { return &c.FailoverEndpoints }),
+	int_setting(live_lambda_failover_after_env, func(c *Config) *int { return &c.FailoverAfter }),
+	string_setting(live_lambda_log_level_env, func(c *Config) *string { return &c.LogLevel }),
+	string_setting(live_lambda_log_format_env, func(c *Config) *string { return &c.LogFormat }),
+	switch_setting(live_lambda_xray_env, func(c *Config) *bool { return &c.XRay }),
+	string_setting("AWS_XRAY_DAEMON_ADDRESS", func(c *Config) *string { return &c.XRayDaemonAddress }),
+	switch_setting(live_lambda_enabled_env, func(c *Config) *bool { return &c.Enabled }),
+	duration_setting(live_lambda_claim_window_env, true, func(c *Config) *time.Duration { return &c.ClaimWindow }),
+	duration_setting(live_lambda_ack_window_env, true, func(c *Config) *time.Duration { return &c.AckWindow }),
+	switch_setting(live_lambda_restore_reconnect_env, func(c *Config) *bool { return &c.RestoreReconnect }),
+	duration_setting(live_lambda_response_cache_ttl_env, true, func(c *Config) *time.Duration { return &c.ResponseCacheTTL }),
+	int_setting(live_lambda_response_cache_size_env, func(c *Config) *int { return &c.ResponseCacheSize }),
+	int_setting(live_lambda_response_cache_bytes_env, func(c *Config) *int { return &c.ResponseCacheMaxBytes }),
+	string_setting(live_lambda_response_cache_ignore_env, func(c *Config) *string { return &c.ResponseCacheIgnore }),
+	switch_setting(live_lambda_reencode_events_env, func(c *Config) *bool { return &c.ReencodeEvents }),
+	switch_setting(live_lambda_response_shape_check_env, func(c *Config) *bool { return &c.ResponseShapeCheck }),
+	int_setting(live_lambda_runtime_api_idle_conns_env, func(c *Config) *int { return &c.RuntimeAPIMaxIdleConns }),
+	duration_setting(live_lambda_runtime_api_timeout_env, true, func(c *Config) *time.Duration { return &c.RuntimeAPIPostTimeout }),
+	string_setting(live_lambda_payload_key_arn_env, func(c *Config) *string { return &c.PayloadKeyARN }),
+	string_setting(live_lambda_signing_secret_arn_env, func(c *Config) *string { return &c.SigningSecretARN }),
+	duration_setting(live_lambda_idle_reconnect_env, true, func(c *Config) *time.Duration { return &c.IdleReconnectAfter }),
+	string_setting(live_lambda_warm_standby_env, func(c *Config) *string { return &c.WarmStandby }),
+	string_setting(live_lambda_response_subscription_env, func(c *Config) *string { return &c.ResponseSubscription }),
+	duration_setting(live_lambda_connection_check_env, true, func(c *Config) *time.Duration { return &c.ConnectionCheckAfter }),
+	float_setting(live_lambda_sample_rate_env, func(c *Config) *float64 { return &c.SampleRate }),
+	string_setting(live_lambda_intercept_when_env, func(c *Config) *string { return &c.InterceptWhen }),
+	string_setting(live_lambda_routing_rules_env, func(c *Config) *string { return &c.RoutingRules }),
+	string_setting(live_lambda_dynamic_config_env, func(c *Config) *string { return &c.DynamicConfigParameter }),
+	duration_setting(live_lambda_dynamic_config_refresh_env, false, func(c *Config) *time.Duration { return &c.DynamicConfigRefresh }),
+}
+
+// LoadConfig reads the configuration from the environment and the config file.
+func LoadConfig() (Config, error) {
+	return load_config(os.LookupEnv)
+}
+
+// load_config returns the configuration with every value that could be read.
+// Values that cannot be parsed keep their defaults and are reported together
+// in the error.
+func load_config(lookup_env func(string) (string, bool)) (Config, error) {
+	loaded := default_config()
+	var errs []error
+
+	file_values, file, err := read_config_file(lookup_env)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	loaded.file = file
+
+	for _, setting := range config_settings {
+		value, source := "", ""
+		if env_value, ok := lookup_env(setting.name); ok && env_value != "" {
+			value, source = env_value, "env"
+		} else if file_value, ok := file_values[setting.name]; ok {
+			value, source = file_value, "file"
+		} else {
+			continue
+		}
+		if err := setting.parse(&loaded, strings.TrimSpace(value)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", setting.name, value, err))
+			continue
+		}
+		loaded.sources[setting.name] = source
+	}
+
+	// The wrapper script points the function's runtime at the proxy, but the
+	// extension itself still sees the real Runtime API
+	if loaded.RuntimeAPIEndpoint == "" {
+		if endpoint, ok := lookup_env("AWS_LAMBDA_RUNTIME_API"); ok && endpoint != "" {
+			loaded.RuntimeAPIEndpoint = endpoint
+			loaded.sources[lrap_runtime_api_endpoint_env] = "env"
+		}
+	}
+	return loaded, errors.Join(errs...)
+}
+
+// read_config_file returns the settings in the config file. A missing default
+// file is not an error; a missing file named by LIVE_LAMBDA_CONFIG_FILE is.
+func read_config_file(lookup_env func(string) (string, bool)) (map[string]string, string, error) {
+	path, named := lookup_env(live_lambda_config_file_env)
+	if !named || path == "" {
+		path, named = default_config_file, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !named && errors.Is(err, fs.ErrNotExist) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, "", fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	known := map[string]bool{}
+	for _, setting := range config_settings {
+		known[setting.name] = true
+	}
+	values := map[string]string{}
+	var errs []error
+	for name, value := range raw {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("unknown setting %s in %s", name, path))
+			continue
+		}
+		text, ok := config_value_string(value)
+		if !ok {
+			errs = append(errs, fmt.Errorf("setting %s in %s must be a string, number or boolean", name, path))
+			continue
+		}
+		values[name] = text
+	}
+	return values, path, errors.Join(errs...)
+}
+
+// config_value_string returns a decoded JSON setting value as the text an
+// environment variable would hold.
+func config_value_string(value interface{}) (string, bool) {
+	switch typed := value.(type) {
+	case string:
+		return typed, true
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(typed), true
+	}
+	return "", false
+}
+
+// parse_config_duration reads a duration such as "30s" or a plain number of seconds.
+func parse_config_duration(value string) (time.Duration, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("expected a duration such as 30s")
+}
+
+// Validate reports every missing or out-of-range setting.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	// A disabled extension never connects, so it needs no transport settings
+	if c.Enabled {
+		switch strings.ToLower(c.Transport) {
+		case transport_appsync:
+			check(c.AppSyncHTTPHost != "", "%s is required", live_lambda_appsync_http_host_env)
+			check(c.AppSyncRealtimeHost != "", "%s is required", live_lambda_appsync_realtime_host_env)
+			check(c.AppSyncRegion != "", "%s is required", live_lambda_appsync_region_env)
+			switch strings.ToLower(c.AppSyncAuthMode) {
+			case appsync_auth_iam:
+			case appsync_auth_api_key:
+				check(c.AppSyncAPIKey != "", "%s is required when %s is api_key", live_lambda_appsync_api_key_env, live_lambda_appsync_auth_mode_env)
+			case appsync_auth_cognito, appsync_auth_lambda:
+				check(c.AppSyncAuthToken != "", "%s is required when %s is %s", live_lambda_appsync_auth_token_env, live_lambda_appsync_auth_mode_env, c.AppSyncAuthMode)
+			default:
+				check(false, "%s must be iam, api_key, cognito or lambda, got %q", live_lambda_appsync_auth_mode_env, c.AppSyncAuthMode)
+			}
+		case transport_iot:
+			check(c.IoTEndpoint != "", "%s is required when %s is iot", live_lambda_iot_endpoint_env, live_lambda_transport_env)
+			check(c.IoTRegion != "" || c.AppSyncRegion != "", "%s or %s is required", live_lambda_iot_region_env, live_lambda_appsync_region_env)
+		default:
+			check(false, "%s must be appsync or iot, got %q", live_lambda_transport_env, c.Transport)
+		}
+	}
+	check(c.RuntimeAPIEndpoint != "", "%s or AWS_LAMBDA_RUNTIME_API is required", lrap_runtime_api_endpoint_env)
+	check(c.ListenerPort > 0 && c.ListenerPort <= 65535, "%s must be a port number, got %d", lrap_listener_port_env, c.ListenerPort)
+	check(c.RuntimeAPIMaxIdleConns > 0, "%s must be positive", live_lambda_runtime_api_idle_conns_env)
+	if c.PayloadKeyARN != "" {
+		service, _ := parse_resource_arn(c.PayloadKeyARN)
+		check(service == "kms" || service == "secretsmanager", "%s must be a KMS key or Secrets Manager secret ARN, got %q", live_lambda_payload_key_arn_env, c.PayloadKeyARN)
+	}
+	if c.SigningSecretARN != "" {
+		service, _ := parse_resource_arn(c.SigningSecretARN)
+		check(service == "ssm" || service == "secretsmanager", "%s must be an SSM parameter or Secrets Manager secret ARN, got %q", live_lambda_signing_secret_arn_env, c.SigningSecretARN)
+	}
+
+	check(valid_channel_namespace(c.AppSyncNamespace), "%s must be 1 to 50 letters, digits or hyphens, got %q", live_lambda_appsync_namespace_env, c.AppSyncNamespace)
+	switch strings.ToLower(c.NamespaceCheck) {
+	case namespace_check_off, namespace_check_warn, namespace_check_enforce:
+	default:
+		check(false, "%s must be off, warn or enforce, got %q", live_lambda_namespace_check_env, c.NamespaceCheck)
+	}
+	check(c.DeveloperID == "" || valid_channel_namespace(c.DeveloperID), "%s must be 1 to 50 letters, digits or hyphens, got %q", live_lambda_developer_id_env, c.DeveloperID)
+	if _, err := c.render_channel_templates(); err != nil {
+		check(false, "%v", err)
+	}
+
+	switch credential_source_kind(strings.ToLower(c.AWSCredentialSource)) {
+	case "", credential_source_env, credential_source_role, credential_source_profile:
+	default:
+		check(false, "%s must be env, role or profile, got %q", live_lambda_aws_credential_source_env, c.AWSCredentialSource)
+	}
+
+	switch strings.ToLower(c.EnvEncryption) {
+	case env_encryption_auto, env_encryption_required:
+	default:
+		check(false, "%s must be auto or required, got %q", live_lambda_env_encryption_env, c.EnvEncryption)
+	}
+	check(!c.EnvChannel || !strings.EqualFold(c.EnvEncryption, env_encryption_required), "%s cannot be on with %s=required", live_lambda_env_channel_env, live_lambda_env_encryption_env)
+	if c.RedactPaths != "" {
+		_, err := parse_json_paths(c.RedactPaths)
+		check(err == nil, "%s: %v", live_lambda_redact_paths_env, err)
+	}
+	if c.LocalAPISocket != "" {
+		err := check_socket_path(c.LocalAPISocket)
+		check(err == nil, "%s: %v", live_lambda_local_api_socket_env, err)
+	}
+
+	check(c.DiagnosticsInterval >= 0, "%s must not be negative", live_lambda_diagnostics_interval_env)
+	check(c.PingInterval >= 0, "%s must not be negative", live_lambda_ping_interval_env)
+	check(c.ChunkReassemblyTimeout > 0, "%s must be positive", live_lambda_chunk_timeout_env)
+	check(c.ChunkSize > 0, "%s must be positive", live_lambda_chunk_size_env)
+	check(c.ChunkRetransmitAfter > 0, "%s must be positive", live_lambda_chunk_retransmit_env)
+	check(c.LatencySummaryEvery >= 0, "%s must not be negative", live_lambda_latency_summary_every_env)
+	check(c.OffloadThreshold > 0, "%s must be positive", live_lambda_offload_threshold_env)
+	check(c.OffloadTTL >= 0, "%s must not be negative", live_lambda_offload_ttl_env)
+	check(c.SamplingMaxRPS >= 0, "%s must not be negative", live_lambda_sampling_max_rps_env)
+	check(c.SamplingMinRate > 0 && c.SamplingMinRate <= 1, "%s must be in (0, 1]", live_lambda_sampling_min_rate_env)
+	check(c.SamplingRecoverRatio > 0 && c.SamplingRecoverRatio <= 1, "%s must be in (0, 1]", live_lambda_sampling_recover_ratio_env)
+	check(c.SamplingCooldown >= 0, "%s must not be negative", live_lambda_sampling_cooldown_env)
+	check(c.PresenceTTL >= 0, "%s must not be negative", live_lambda_presence_ttl_env)
+	check(c.ClaimWindow >= 0, "%s must not be negative", live_lambda_claim_window_env)
+	check(c.AckWindow >= 0, "%s must not be negative", live_lambda_ack_window_env)
+	check(c.Fallback.Retries >= 0, "%s must not be negative", live_lambda_fallback_retries_env)
+	check(c.Fallback.Backoff >= 0, "%s must not be negative", live_lambda_fallback_backoff_env)
+	check(c.Compression == content_encoding_gzip || c.Compression == compression_off, "%s must be gzip or off, got %q", live_lambda_compression_env, c.Compression)
+	check(c.CompressionMinBytes >= 0, "%s must not be negative", live_lambda_compression_min_bytes_env)
+	check(c.TunnelFailureLimit >= 0, "%s must not be negative", live_lambda_tunnel_failure_limit_env)
+	check(c.TunnelFailureWindow > 0, "%s must be positive", live_lambda_tunnel_failure_window_env)
+	check(c.TransportPoolSize >= 1 && c.TransportPoolSize <= max_transport_pool_size, "%s must be between 1 and %d, got %d", live_lambda_transport_pool_size_env, max_transport_pool_size, c.TransportPoolSize)
+	check(c.DrainTimeout >= 0, "%s must not be negative", live_lambda_drain_timeout_env)
+	check(c.DeadlineMargin >= 0, "%s must not be negative", live_lambda_deadline_margin_env)
+	check(c.IdleReconnectAfter >= 0, "%s must not be negative", live_lambda_idle_reconnect_env)
+	check(c.ConnectionCheckAfter >= 0, "%s must not be negative", live_lambda_connection_check_env)
+	check(c.SampleRate >= 0 && c.SampleRate <= 100, "%s must be between 0 and 100", live_lambda_sample_rate_env)
+	if _, err := parse_event_predicates(c.InterceptWhen); err != nil {
+		check(false, "%s: %v", live_lambda_intercept_when_env, err)
+	}
+	if rules := strings.TrimSpace(c.RoutingRules); is_routing_rules_parameter(rules) {
+		service, _ := parse_resource_arn(rules)
+		check(service == "ssm", "%s must be JSON rules or an SSM parameter ARN, got %q", live_lambda_routing_rules_env, rules)
+	} else if rules != "" {
+		if _, err := parse_routing_rules([]byte(rules)); err != nil {
+			check(false, "%s: %v", live_lambda_routing_rules_env, err)
+		}
+	}
+	if c.DynamicConfigParameter != "" {
+		service, _ := parse_resource_arn(c.DynamicConfigParameter)
+		check(service == "ssm", "%s must be an SSM parameter ARN, got %q", live_lambda_dynamic_config_env, c.DynamicConfigParameter)
+	}
+	check(c.DynamicConfigRefresh >= 0, "%s must not be negative", live_lambda_dynamic_config_refresh_env)
+	switch strings.ToLower(c.WarmStandby) {
+	case warm_standby_auto, warm_standby_off:
+	case warm_standby_on:
+		check(c.IdleReconnectAfter > 0, "%s=on requires %s", live_lambda_warm_standby_env, live_lambda_idle_reconnect_env)
+	default:
+		check(false, "%s must be auto, on or off, got %q", live_lambda_warm_standby_env, c.WarmStandby)
+	}
+	switch strings.ToLower(c.ResponseSubscription) {
+	case response_subscription_per_request:
+	case response_subscription_wildcard:
+		check(strings.ToLower(c.Transport) != transport_iot, "%s=wildcard is not supported with %s=iot", live_lambda_response_subscription_env, live_lambda_transport_env)
+	default:
+		check(false, "%s must be per_request or wildcard, got %q", live_lambda_response_subscription_env, c.ResponseSubscription)
+	}
+
+	if c.MailboxQueueURL != "" {
+		parsed, err := url.Parse(c.MailboxQueueURL)
+		check(err == nil && parsed.Scheme == "https" && parsed.Host != "", "%s must be an https queue URL", live_lambda_mailbox_queue_url_env)
+	}
+	if c.Telemetry {
+		_, err := parse_telemetry_types(c.TelemetryTypes)
+		check(err == nil, "invalid %s: %v", live_lambda_telemetry_types_env, err)
+		check(c.TelemetryPort > 0 && c.TelemetryPort <= 65535, "%s must be a port number, got %d", live_lambda_telemetry_port_env, c.TelemetryPort)
+		switch strings.ToLower(c.TelemetryCooperative) {
+		case telemetry_cooperative_auto, telemetry_cooperative_on, telemetry_cooperative_off:
+		default:
+			check(false, "%s must be auto, on or off, got %q", live_lambda_telemetry_cooperative_env, c.TelemetryCooperative)
+		}
+	}
+	if c.Metrics {
+		check(c.MetricsNamespace != "" && len(c.MetricsNamespace) <= 255, "%s must be 1 to 255 characters", live_lambda_metrics_namespace_env)
+	}
+	switch strings.ToLower(c.Record) {
+	case record_off:
+	case record_s3:
+		check(c.OffloadBucket != "", "%s=s3 requires %s", live_lambda_record_env, live_lambda_offload_bucket_env)
+		fallthrough
+	case record_channel:
+		check(c.RecordCapacity > 0, "%s must be positive", live_lambda_record_capacity_env)
+		check(c.RecordFlushInterval > 0, "%s must be positive", live_lambda_record_flush_interval_env)
+	default:
+		check(false, "%s must be off, s3 or channel, got %q", live_lambda_record_env, c.Record)
+	}
+	if c.LoadShedding {
+		check(c.ShedMemoryPercent > 0 && c.ShedMemoryPercent <= 100, "%s must be 1 to 100, got %d", live_lambda_shed_memory_percent_env, c.ShedMemoryPercent)
+		check(c.ShedMaxFunctionMB >= 0, "%s must not be negative", live_lambda_shed_max_function_mb_env)
+	}
+	if c.ResponseCacheTTL != 0 {
+		check(c.ResponseCacheTTL > 0, "%s must not be negative", live_lambda_response_cache_ttl_env)
+		check(c.ResponseCacheSize > 0, "%s must be positive", live_lambda_response_cache_size_env)
+		check(c.ResponseCacheMaxBytes > 0, "%s must be positive", live_lambda_response_cache_bytes_env)
+	}
+	if c.RegionalEndpoints != "" {
+		_, err := parse_regional_endpoints(c.RegionalEndpoints)
+		check(err == nil, "%s: %v", live_lambda_regional_endpoints_env, err)
+		check(strings.ToLower(c.Transport) == transport_appsync, "%s requires %s=appsync", live_lambda_regional_endpoints_env, live_lambda_transport_env)
+		check(c.RegionRetryInterval > 0, "%s must be positive", live_lambda_region_retry_interval_env)
+	}
+	if c.FailoverEndpoints != "" {
+		_, err := parse_failover_endpoints(c.FailoverEndpoints)
+		check(err == nil, "%s: %v", live_lambda_failover_endpoints_env, err)
+		check(strings.ToLower(c.Transport) == transport_appsync, "%s requires %s=appsync", live_lambda_failover_endpoints_env, live_lambda_transport_env)
+		check(c.FailoverAfter > 0, "%s must be positive", live_lambda_failover_after_env)
+	}
+	_, err := parse_log_level(c.LogLevel)
+	check(err == nil, "%s: %v", live_lambda_log_level_env, err)
+	switch strings.ToLower(c.LogFormat) {
+	case log_format_text, log_format_json:
+	default:
+		check(false, "%s must be text or json, got %q", live_lambda_log_format_env, c.LogFormat)
+	}
+	return errors.Join(errs...)
+}
+
+// Dump logs the effective configuration and where each value came from.
+func (c Config) Dump() {
+	if c.file != "" {
+		log.Printf("%s Effective configuration (file: %s):", config_print_prefix, c.file)
+	} else {
+		log.Printf("%s Effective configuration:", config_print_prefix)
+	}
+	for _, line := range c.dump_lines() {
+		log.Printf("%s   %s", config_print_prefix, line)
+	}
+}
+
+func (c Config) dump_lines() []string {
+	lines := make([]string, 0, len(config_settings))
+	for _, setting := range config_settings {
+		value := redact_config_value(setting.name, setting.show(c))
+		lines = append(lines, fmt.Sprintf("%s=%s (%s)", setting.name, value, c.source(setting.name)))
+	}
+	return lines
+}
+
+// source returns where a setting's value came from: env, file, parameter or default.
+func (c Config) source(name string) string {
+	if source := c.sources[name]; source != "" {
+		return source
+	}
+	return "default"
+}
+
+// effective_settings returns each setting's redacted value and source, as Dump logs them.
+func (c Config) effective_settings() map[string]map[string]string {
+	settings := make(map[string]map[string]string, len(config_settings))
+	for _, setting := range config_settings {
+		settings[setting.name] = map[string]string{
+			"value":  redact_config_value(setting.name, setting.show(c)),
+			"source": c.source(setting.name),
+		}
+	}
+	return settings
+}
+
+// redact_config_value hides values of secret-looking settings, and any
+// credentials or query string embedded in a URL.
+func redact_config_value(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	if matches_env_pattern(default_env_denylist, name) {
+		return redacted_config_value
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" {
+		return value
+	}
+	if parsed.User != nil {
+		parsed.User = url.User(redacted_config_value)
+	}
+	if parsed.RawQuery != "" {
+		parsed.RawQuery = redacted_config_value
+	}
+	return parsed.String()
+}
+
+// credential_env resolves the live-lambda credential settings from the config
+// and everything else, such as AWS_ACCESS_KEY_ID, from the environment.
+func (c Config) credential_env(name string) string {
+	switch name {
+	case live_lambda_aws_profile_env:
+		return c.AWSProfile
+	case live_lambda_aws_credential_source_env:
+		return c.AWSCredentialSource
+	}
+	return os.Getenv(name)
+}
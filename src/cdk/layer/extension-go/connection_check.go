@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pre-invoke connection check
+//
+// A frozen sandbox misses the server's keep-alives, and after a long enough
+// freeze AppSync has closed the WebSocket. The transport still reports itself
+// connected until a write fails, so the first invocation after a thaw would
+// pay for a failed publish and its timeout before watch_connection
+// reconnects.
+//
+// Both AppSync transports record when they last heard from the server and the
+// connection timeout the server announced in connection_ack. Before it
+// subscribes for a request, handle_next compares that silence with the
+// timeout: past the timeout the connection is dead, so the extension closes
+// it and waits up to idle_reconnect_timeout for watch_connection to
+// reconnect; past LIVE_LAMBDA_CONNECTION_CHECK_AFTER (default 90s, more than
+// one missed keep-alive) it first pings the connection with a presence probe
+// and reconnects only if the ping fails. Transports that do not see
+// keep-alives (IoT) are pinged when the previous check was that long ago. The
+// request is only published once the connection is known to be good.
+// LIVE_LAMBDA_CONNECTION_CHECK_AFTER=off disables the check.
+
+const default_connection_check_after = 90 * time.Second
+
+// keep_alive_reporter is implemented by transports that see the server's keep-alives.
+type keep_alive_reporter interface {
+	// keep_alive returns when the server was last heard from, and how long it
+	// lets a connection stay silent before closing it.
+	keep_alive() (last_heard time.Time, timeout time.Duration)
+}
+
+// keep_alive_tracker implements keep_alive_reporter for a transport to embed.
+type keep_alive_tracker struct {
+	last_heard atomic.Int64 // unix nanoseconds
+	timeout    atomic.Int64 // nanoseconds
+}
+
+func (k *keep_alive_tracker) heard(at time.Time) {
+	k.last_heard.Store(at.UnixNano())
+}
+
+func (k *keep_alive_tracker) set_timeout(timeout time.Duration) {
+	k.timeout.Store(int64(timeout))
+}
+
+func (k *keep_alive_tracker) keep_alive() (time.Time, time.Duration) {
+	last := k.last_heard.Load()
+	if last == 0 {
+		return time.Time{}, time.Duration(k.timeout.Load())
+	}
+	return time.Unix(0, last), time.Duration(k.timeout.Load())
+}
+
+// connection_verdict is what a check decides to do with the connection.
+type connection_verdict int
+
+const (
+	connection_trusted connection_verdict = iota
+	connection_suspect                    // ping before trusting it
+	connection_stale                      // the server has closed it; reconnect
+)
+
+// connection_check runs the pre-invoke check. A nil connection_check checks
+// nothing.
+type connection_check struct {
+	after time.Duration
+	now   func() time.Time
+
+	mu           sync.Mutex // held while a check runs, so concurrent requests reconnect once
+	last_checked time.Time  // guarded by mu
+	reconnected  time.Time  // guarded by mu; when a check last reconnected
+}
+
+// new_connection_check_from_config returns nil when
+// LIVE_LAMBDA_CONNECTION_CHECK_AFTER is off.
+func new_connection_check_from_config(settings Config) *connection_check {
+	if settings.ConnectionCheckAfter <= 0 {
+		return nil
+	}
+	return &connection_check{
+		after: settings.ConnectionCheckAfter,
+		now:   time.Now,
+	}
+}
+
+// verdict judges the connection from the transport's keep-alives, or from the
+// time since the last check when it has none.
+func (c *connection_check) verdict(transport Transport) (connection_verdict, time.Duration) {
+	now := c.now()
+	reporter, ok := transport.(keep_alive_reporter)
+	if !ok {
+		if c.last_checked.IsZero() {
+			return connection_trusted, 0
+		}
+		silence := now.Sub(c.last_checked)
+		if silence >= c.after {
+			return connection_suspect, silence
+		}
+		return connection_trusted, silence
+	}
+	last_heard, timeout := reporter.keep_alive()
+	// The connection_ack of a reconnect may not have been read yet
+	if c.reconnected.After(last_heard) {
+		last_heard = c.reconnected
+	}
+	if last_heard.IsZero() {
+		return connection_trusted, 0
+	}
+	silence := now.Sub(last_heard)
+	switch {
+	case timeout > 0 && silence >= timeout:
+		return connection_stale, silence
+	case silence >= c.after:
+		return connection_suspect, silence
+	}
+	return connection_trusted, silence
+}
+
+// check_connection makes sure the connection survived the freeze before
+// request_id is handed to the agent. The reconnect waits no longer than ctx.
+func (p *RuntimeAPIProxy) check_connection(ctx context.Context, request_id string) {
+	c := p.connection_check
+	if c == nil || p.transport == nil || request_id == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer func() { c.last_checked = c.now() }()
+	if !p.transport.IsConnected() {
+		// watch_connection is already reconnecting
+		return
+	}
+
+	logger := request_logger(request_id)
+	verdict, silence := c.verdict(p.transport)
+	switch verdict {
+	case connection_trusted:
+		return
+	case connection_suspect:
+		err := p.ping_transport(ctx)
+		if err == nil {
+			return
+		}
+		logger.Info("The connection did not answer after the sandbox was frozen, reconnecting", "silent_for", silence.Round(time.Second), "error", err)
+		p.explain(request_id, "stale_connection", "silent for %s, ping failed: %v", silence.Round(time.Second), err)
+	case connection_stale:
+		logger.Info("The server has closed the connection while the sandbox was frozen, reconnecting", "silent_for", silence.Round(time.Second))
+		p.explain(request_id, "stale_connection", "silent for %s, past the server's keep-alive timeout", silence.Round(time.Second))
+	}
+	p.transport.Close()
+	if !wait_until(ctx, idle_reconnect_timeout, p.transport.IsConnected) {
+		logger.Warn("Could not reconnect before the invocation", "timeout", idle_reconnect_timeout)
+		return
+	}
+	c.reconnected = c.now()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionCheckVerdict(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	check := &connection_check{after: 90 * time.Second, now: func() time.Time { return now }}
+
+	transport := &appsync_transport{}
+	transport.set_timeout(5 * time.Minute)
+	if verdict, _ := check.verdict(transport); verdict != connection_trusted {
+		t.Fatalf("expected a transport never heard from to be trusted, got %v", verdict)
+	}
+	for _, tc := range []struct {
+		silence time.Duration
+		want    connection_verdict
+	}{
+		{30 * time.Second, connection_trusted},
+		{2 * time.Minute, connection_suspect},
+		{10 * time.Minute, connection_stale},
+	} {
+		transport.heard(now.Add(-tc.silence))
+		if verdict, silence := check.verdict(transport); verdict != tc.want || silence != tc.silence {
+			t.Errorf("after %s of silence: got %v (%s), want %v", tc.silence, verdict, silence, tc.want)
+		}
+	}
+
+	// A reconnect counts as hearing from the server, even before its connection_ack
+	check.reconnected = now.Add(-30 * time.Second)
+	if verdict, silence := check.verdict(transport); verdict != connection_trusted || silence != 30*time.Second {
+		t.Fatalf("expected a connection just reopened to be trusted, got %v (%s)", verdict, silence)
+	}
+	check.reconnected = time.Time{}
+
+	// Without keep-alives, the time since the last check stands in for the freeze
+	plain := &fake_transport{}
+	if verdict, _ := check.verdict(plain); verdict != connection_trusted {
+		t.Fatalf("expected the first check to trust the connection, got %v", verdict)
+	}
+	check.last_checked = now.Add(-time.Hour)
+	if verdict, _ := check.verdict(plain); verdict != connection_suspect {
+		t.Fatalf("expected a ping after an hour without a check, got %v", verdict)
+	}
+}
+
+func TestCheckConnectionReconnectsOnce(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+	// The sandbox was frozen for an hour, and the server closed the connection
+	proxy.transport.(*appsync_transport).heard(time.Now().Add(-time.Hour))
+	server.DropConnections()
+	ctx := proxy.ctx
+
+	// Two requests arriving together reconnect once
+	done := make(chan struct{})
+	go func() {
+		proxy.check_connection(ctx, "req-0")
+		close(done)
+	}()
+	proxy.check_connection(ctx, "req-1")
+	<-done
+
+	if connections, _ := server.Counts(); !proxy.transport.IsConnected() || connections != 1 {
+		t.Fatalf("expected one reconnect before the invocation, got %d connections", connections)
+	}
+	// The control and presence channels
+	wait_for_subscriptions(t, server, 2)
+	// Whichever request ran first found the connection stale
+	first, _ := proxy.explanations.lookup("req-0")
+	second, _ := proxy.explanations.lookup("req-1")
+	steps := append(first, second...)
+	if len(steps) != 1 || steps[0].Decision != "stale_connection" {
+		t.Fatalf("unexpected explanations %+v", steps)
+	}
+
+	// The reconnect was just heard from, so the next invocation goes straight through
+	probes := len(server.Published(proxy.presence_topic()))
+	proxy.check_connection(ctx, "req-2")
+	if len(server.Published(proxy.presence_topic())) != probes {
+		t.Fatal("expected no ping on a fresh connection")
+	}
+}
+
+func TestConnectionCheckFromConfig(t *testing.T) {
+	settings := default_config()
+	if check := new_connection_check_from_config(settings); check == nil || check.after != default_connection_check_after {
+		t.Fatalf("expected the check on by default, got %+v", check)
+	}
+	settings.ConnectionCheckAfter = 0
+	if check := new_connection_check_from_config(settings); check != nil {
+		t.Fatalf("expected no check, got %+v", check)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// The control channel carries frames from the local agent to the extensions of a
+// single function. Every frame is a JSON object with a "type" discriminator; the
+// handlers registered here receive the raw frame and decode what they need.
+
+type control_frame_handler func(frame json.RawMessage)
+
+type control_dispatcher struct {
+	mu       sync.RWMutex
+	handlers map[string]control_frame_handler
+}
+
+func new_control_dispatcher() *control_dispatcher {
+	return &control_dispatcher{handlers: map[string]control_frame_handler{}}
+}
+
+// register installs the handler for a frame type, replacing any previous one.
+func (d *control_dispatcher) register(frame_type string, handler control_frame_handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[frame_type] = handler
+}
+
+// dispatch routes a frame to its handler. Unknown frame types are ignored so that
+// newer agents can talk to older extensions.
+func (d *control_dispatcher) dispatch(frame json.RawMessage) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(frame, &envelope); err != nil {
+		component_logger(component_control).Warn("Ignoring a malformed control frame", "error", err)
+		return
+	}
+
+	d.mu.RLock()
+	handler, ok := d.handlers[envelope.Type]
+	d.mu.RUnlock()
+	if !ok {
+		component_logger(component_control).Info("Ignoring an unknown control frame type", "type", envelope.Type)
+		return
+	}
+	handler(frame)
+}
+
+// control_topic returns the channel the agent uses to talk to this function's extensions.
+func (p *RuntimeAPIProxy) control_topic() string {
+	return p.channel("control/%s", p.function_name)
+}
+
+// subscribe_control_channel subscribes to the function's control topic for the lifetime of ctx.
+func (p *RuntimeAPIProxy) subscribe_control_channel(ctx context.Context) {
+	topic := p.control_topic()
+	_, err := p.transport.Subscribe(ctx, topic, func(data_payload interface{}) {
+		frame, err := decode_channel_payload(data_payload)
+		if err != nil {
+			component_logger(component_control).Warn("Error decoding a control frame", "error", err)
+			return
+		}
+		p.control.dispatch(frame)
+	})
+	if err != nil {
+		component_logger(component_control).Error("Error subscribing to the control topic", "topic", topic, "error", err)
+		return
+	}
+	component_logger(component_control).Info("Subscribed to the control topic", "topic", topic)
+}
+
+// decode_channel_payload normalizes an AppSync event into raw JSON. Events may
+// arrive already decoded or as a JSON-encoded string, depending on the publisher.
+func decode_channel_payload(data_payload interface{}) (json.RawMessage, error) {
+	if encoded, ok := data_payload.(string); ok {
+		if json.Valid([]byte(encoded)) {
+			return json.RawMessage(encoded), nil
+		}
+		return nil, fmt.Errorf("event is a string but not valid JSON")
+	}
+	raw, err := json.Marshal(data_payload)
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// Credential source selection
+//
+// Credentials for AppSync and the AWS APIs the extension calls are resolved from
+// the first available source, in this order:
+//
+//  1. env     - AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY (/ AWS_SESSION_TOKEN).
+//     Inside Lambda these are the execution role's credentials.
+//  2. role    - a container credentials endpoint or a web identity token
+//     (AWS_CONTAINER_CREDENTIALS_*_URI, AWS_WEB_IDENTITY_TOKEN_FILE + AWS_ROLE_ARN).
+//  3. profile - the shared config profile named by LIVE_LAMBDA_AWS_PROFILE.
+//
+// LIVE_LAMBDA_AWS_CREDENTIAL_SOURCE=env|role|profile forces a single source. When
+// no source applies, the SDK default chain is used unchanged.
+
+const credentials_print_prefix = "[LiveLambdaExt:Credentials]"
+
+type credential_source_kind string
+
+const (
+	credential_source_env     credential_source_kind = "env"
+	credential_source_role    credential_source_kind = "role"
+	credential_source_profile credential_source_kind = "profile"
+	credential_source_default credential_source_kind = "default"
+)
+
+type credential_source struct {
+	kind    credential_source_kind
+	profile string
+	env     func(string) string
+}
+
+// select_credential_source picks the credential source from the environment.
+func select_credential_source(getenv func(string) string) (credential_source, error) {
+	available := map[credential_source_kind]bool{
+		credential_source_env: getenv("AWS_ACCESS_KEY_ID") != "" && getenv("AWS_SECRET_ACCESS_KEY") != "",
+		credential_source_role: getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" ||
+			getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" ||
+			(getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && getenv("AWS_ROLE_ARN") != ""),
+		credential_source_profile: getenv(live_lambda_aws_profile_env) != "",
+	}
+	source := credential_source{profile: getenv(live_lambda_aws_profile_env), env: getenv}
+
+	if forced := strings.ToLower(strings.TrimSpace(getenv(live_lambda_aws_credential_source_env))); forced != "" {
+		kind := credential_source_kind(forced)
+		is_known, ok := available[kind]
+		if !ok {
+			return credential_source{}, fmt.Errorf("unknown %s %q (expected env, role, or profile)", live_lambda_aws_credential_source_env, forced)
+		}
+		if !is_known {
+			return credential_source{}, fmt.Errorf("%s=%s but that source is not configured", live_lambda_aws_credential_source_env, forced)
+		}
+		source.kind = kind
+		return source, nil
+	}
+
+	for _, kind := range []credential_source_kind{credential_source_env, credential_source_role, credential_source_profile} {
+		if available[kind] {
+			source.kind = kind
+			return source, nil
+		}
+	}
+	source.kind = credential_source_default
+	return source, nil
+}
+
+// load_options returns the config.LoadDefaultConfig options for the source.
+func (s credential_source) load_options() []func(*config.LoadOptions) error {
+	switch s.kind {
+	case credential_source_env:
+		return []func(*config.LoadOptions) error{
+			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+				s.env("AWS_ACCESS_KEY_ID"), s.env("AWS_SECRET_ACCESS_KEY"), s.env("AWS_SESSION_TOKEN"),
+			)),
+		}
+	case credential_source_profile:
+		return []func(*config.LoadOptions) error{config.WithSharedConfigProfile(s.profile)}
+	default:
+		// The SDK default chain already resolves container and web identity roles.
+		return nil
+	}
+}
+
+func (s credential_source) describe() string {
+	if s.kind == credential_source_profile {
+		return fmt.Sprintf("%s (%s)", s.kind, s.profile)
+	}
+	return string(s.kind)
+}
+
+func log_credential_source(s credential_source) {
+	log.Printf("%s Using AWS credential source: %s", credentials_print_prefix, s.describe())
+}
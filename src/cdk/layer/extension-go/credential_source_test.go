@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+func fake_env(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func apply_load_options(t *testing.T, source credential_source) config.LoadOptions {
+	t.Helper()
+	var options config.LoadOptions
+	for _, fn := range source.load_options() {
+		if err := fn(&options); err != nil {
+			t.Fatalf("unexpected load option error: %v", err)
+		}
+	}
+	return options
+}
+
+func TestCredentialSourceEnv(t *testing.T) {
+	source, err := select_credential_source(fake_env(map[string]string{
+		"AWS_ACCESS_KEY_ID":         "AKID",
+		"AWS_SECRET_ACCESS_KEY":     "secret",
+		"AWS_SESSION_TOKEN":         "token",
+		"AWS_ROLE_ARN":              "arn:aws:iam::123456789012:role/ignored",
+		live_lambda_aws_profile_env: "ignored",
+	}))
+	if err != nil || source.kind != credential_source_env {
+		t.Fatalf("expected env source, got %q (err %v)", source.kind, err)
+	}
+	options := apply_load_options(t, source)
+	credentials, err := options.Credentials.Retrieve(context.Background())
+	if err != nil || credentials.AccessKeyID != "AKID" || credentials.SessionToken != "token" {
+		t.Fatalf("expected env credentials, got %+v (err %v)", credentials, err)
+	}
+}
+
+func TestCredentialSourceRole(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://169.254.170.2/creds"},
+		{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials"},
+		{"AWS_WEB_IDENTITY_TOKEN_FILE": "/var/run/token", "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/dev"},
+	} {
+		env[live_lambda_aws_profile_env] = "ignored"
+		source, err := select_credential_source(fake_env(env))
+		if err != nil || source.kind != credential_source_role {
+			t.Fatalf("expected role source for %v, got %q (err %v)", env, source.kind, err)
+		}
+		if options := apply_load_options(t, source); options.Credentials != nil || options.SharedConfigProfile != "" {
+			t.Errorf("expected role source to defer to the SDK chain, got %+v", options)
+		}
+	}
+}
+
+func TestCredentialSourceProfile(t *testing.T) {
+	source, err := select_credential_source(fake_env(map[string]string{live_lambda_aws_profile_env: "team-dev"}))
+	if err != nil || source.kind != credential_source_profile {
+		t.Fatalf("expected profile source, got %q (err %v)", source.kind, err)
+	}
+	if options := apply_load_options(t, source); options.SharedConfigProfile != "team-dev" {
+		t.Errorf("expected profile team-dev, got %q", options.SharedConfigProfile)
+	}
+}
+
+func TestCredentialSourceDefault(t *testing.T) {
+	source, err := select_credential_source(fake_env(nil))
+	if err != nil || source.kind != credential_source_default {
+		t.Fatalf("expected default source, got %q (err %v)", source.kind, err)
+	}
+	if options := source.load_options(); options != nil {
+		t.Errorf("expected no load options for the default chain, got %d", len(options))
+	}
+}
+
+func TestCredentialSourceForced(t *testing.T) {
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":                   "AKID",
+		"AWS_SECRET_ACCESS_KEY":               "secret",
+		live_lambda_aws_profile_env:           "team-dev",
+		live_lambda_aws_credential_source_env: "profile",
+	}
+	source, err := select_credential_source(fake_env(env))
+	if err != nil || source.kind != credential_source_profile {
+		t.Fatalf("expected forced profile source, got %q (err %v)", source.kind, err)
+	}
+
+	env[live_lambda_aws_credential_source_env] = "role"
+	if _, err := select_credential_source(fake_env(env)); err == nil {
+		t.Error("expected forcing an unconfigured source to fail")
+	}
+
+	env[live_lambda_aws_credential_source_env] = "instance"
+	if _, err := select_credential_source(fake_env(env)); err == nil {
+		t.Error("expected an unknown source to fail")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// The proxy waits for the agent only until shortly before the invocation's own
+// deadline, which the Runtime API sends with each /next response in the
+// Lambda-Runtime-Deadline-Ms header. Waiting any longer would let Lambda time
+// the function out while the proxy still holds the event. When the agent has
+// not answered by then, the invocation is passed through to the function, or
+// failed with LiveLambda.AgentTimeout in error fallback mode.
+
+const (
+	default_deadline_margin = time.Second
+	agent_timeout_error     = "LiveLambda.AgentTimeout"
+	// Lambda's 15 minute limit, less time to clean up, for an invocation
+	// without a deadline header
+	max_invocation_wait = 15*time.Minute - 30*time.Second
+)
+
+// invocation_deadline returns when to stop waiting for the agent: margin before
+// the deadline in header, or max_invocation_wait from now when the header is
+// missing or malformed.
+func invocation_deadline(header string, margin time.Duration, now time.Time) time.Time {
+	deadline_ms, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || deadline_ms <= 0 {
+		return now.Add(max_invocation_wait)
+	}
+	return time.UnixMilli(deadline_ms).Add(-margin)
+}
+
+// agent_timed_out applies the fallback policy to an invocation the agent did not
+// answer before its deadline. It returns true when the invocation was failed.
+// Unlike fall_back it does not count against the tunnel, since a developer
+// paused at a breakpoint looks the same.
+func (p *RuntimeAPIProxy) agent_timed_out(request_id string, deadline time.Time) bool {
+	p.mark_fallback(request_id)
+	if p.fallback.Mode != FallbackError {
+		log.Printf("%s No response for request ID %s before its deadline, passing it through to the function", fallback_print_prefix, request_id)
+		return false
+	}
+	log.Printf("%s No response for request ID %s before its deadline, failing it", fallback_print_prefix, request_id)
+	p.explain(request_id, "failed", "%s in error fallback mode", agent_timeout_error)
+	p.post_invocation_error(request_id, agent_timeout_error, fmt.Sprintf("live-lambda got no response from the agent before %s", deadline.UTC().Format(time.RFC3339Nano)))
+	return true
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvocationDeadline(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	if got := invocation_deadline("1700000003000", time.Second, now); !got.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("expected the margin before the deadline, got %s", got)
+	}
+	for _, header := range []string{"", "soon", "0"} {
+		if got := invocation_deadline(header, time.Second, now); !got.Equal(now.Add(max_invocation_wait)) {
+			t.Errorf("%q: expected the fixed timeout, got %s", header, got)
+		}
+	}
+}
+
+func TestAgentTimedOutFollowsFallbackMode(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	deadline := time.Now()
+
+	if proxy.agent_timed_out("req-local", deadline) {
+		t.Fatal("expected the zero policy to pass invocations through")
+	}
+
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+	if !proxy.agent_timed_out("req-error", deadline) {
+		t.Fatal("expected error mode to fail the invocation")
+	}
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-error/error" || !strings.Contains(posted.body, agent_timeout_error) {
+			t.Fatalf("unexpected error post %+v", posted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error post")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Deadline warnings
+//
+// A developer stepping through a handler cannot see how long Lambda will keep
+// waiting. Once deadline_warning_ratio of an invocation's time budget, from
+// the event's arrival to its Lambda deadline, has passed without a response,
+// the extension publishes on the invocation's response channel:
+//
+//	{"type": "deadline_warning", "request_id": "...", "deadline": "<RFC 3339>",
+//	 "budget_ms": 3000, "remaining_ms": 600, "fallback": "local"}
+//
+// remaining_ms counts down to the Lambda deadline itself; the proxy stops
+// waiting LIVE_LAMBDA_DEADLINE_MARGIN earlier and then applies fallback. The
+// warning is sent once per invocation, and not at all when the proxy would stop
+// waiting before it is due.
+
+const (
+	deadline_warning_frame_type = "deadline_warning"
+	deadline_warning_ratio      = 0.8
+	deadline_warning_timeout    = 5 * time.Second
+)
+
+// is_deadline_warning reports whether frame is the extension's own deadline_warning frame.
+func is_deadline_warning(frame []byte) bool {
+	var warning struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(frame, &warning) == nil && warning.Type == deadline_warning_frame_type
+}
+
+// deadline_warning_at returns when to warn about an invocation received at
+// received that Lambda times out at lambda_deadline. ok is false when the proxy
+// stops waiting, at wait_until, before then.
+func deadline_warning_at(received time.Time, lambda_deadline time.Time, wait_until time.Time) (at time.Time, ok bool) {
+	budget := lambda_deadline.Sub(received)
+	if budget <= 0 {
+		return time.Time{}, false
+	}
+	at = received.Add(time.Duration(float64(budget) * deadline_warning_ratio))
+	return at, at.Before(wait_until)
+}
+
+// deadline_warning_timer fires when the invocation's deadline warning is due.
+// It returns a nil channel, which never fires, when no warning is due.
+func deadline_warning_timer(received time.Time, lambda_deadline time.Time, wait_until time.Time) (<-chan time.Time, func()) {
+	at, ok := deadline_warning_at(received, lambda_deadline, wait_until)
+	if !ok {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(at))
+	return timer.C, func() { timer.Stop() }
+}
+
+// warn_deadline publishes request_id's deadline warning in the background.
+func (p *RuntimeAPIProxy) warn_deadline(request_id string, received time.Time, lambda_deadline time.Time) {
+	remaining := time.Until(lambda_deadline)
+	mode := p.fallback.Mode
+	if mode == "" {
+		mode = FallbackLocal
+	}
+	warning := map[string]interface{}{
+		"type":         deadline_warning_frame_type,
+		"request_id":   request_id,
+		"deadline":     lambda_deadline.UTC().Format(time.RFC3339Nano),
+		"budget_ms":    lambda_deadline.Sub(received).Milliseconds(),
+		"remaining_ms": remaining.Milliseconds(),
+		"fallback":     string(mode),
+	}
+	p.add_idempotency_key(warning, request_id)
+	p.explain(request_id, "deadline_warning", "%s left before the deadline", remaining.Round(time.Millisecond))
+	go func() {
+		ctx, cancel := context.WithTimeout(p.ctx, deadline_warning_timeout)
+		defer cancel()
+		if err := p.request_transport(request_id).Publish(ctx, p.response_topic(request_id), []interface{}{warning}); err != nil {
+			request_logger(request_id).Warn("Could not publish the deadline warning", "error", err)
+		}
+	}()
+}
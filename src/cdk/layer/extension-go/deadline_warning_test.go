@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDeadlineWarningAt(t *testing.T) {
+	received := time.UnixMilli(1_700_000_000_000)
+	lambda_deadline := received.Add(10 * time.Second)
+
+	at, ok := deadline_warning_at(received, lambda_deadline, lambda_deadline.Add(-time.Second))
+	if !ok || !at.Equal(received.Add(8*time.Second)) {
+		t.Fatalf("expected a warning 8s in, got %s (%v)", at.Sub(received), ok)
+	}
+	if _, ok := deadline_warning_at(received, lambda_deadline, received.Add(8*time.Second)); ok {
+		t.Fatal("expected no warning when the wait ends first")
+	}
+	if _, ok := deadline_warning_at(received, received, received); ok {
+		t.Fatal("expected no warning without a time budget")
+	}
+}
+
+func TestWarnDeadlinePublishesOnTheResponseChannel(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+	received := time.Now().Add(-8 * time.Second)
+
+	proxy.warn_deadline("req-1", received, received.Add(10*time.Second))
+
+	topic := proxy.response_topic("req-1")
+	published := wait_for_published(t, server, topic, nil)
+	if len(published) != 1 {
+		t.Fatalf("expected one warning on %s, got %v", topic, published)
+	}
+	frame, _ := json.Marshal(published[0])
+	var warning struct {
+		Type        string `json:"type"`
+		RequestID   string `json:"request_id"`
+		BudgetMS    int64  `json:"budget_ms"`
+		RemainingMS int64  `json:"remaining_ms"`
+		Fallback    string `json:"fallback"`
+	}
+	if err := json.Unmarshal(frame, &warning); err != nil {
+		t.Fatal(err)
+	}
+	if warning.Type != deadline_warning_frame_type || warning.RequestID != "req-1" || warning.BudgetMS != 10000 || warning.Fallback != "error" {
+		t.Fatalf("unexpected warning %s", frame)
+	}
+	if warning.RemainingMS <= 0 || warning.RemainingMS > 2000 {
+		t.Fatalf("expected about 2s remaining, got %dms", warning.RemainingMS)
+	}
+	if !is_deadline_warning(frame) {
+		t.Fatal("expected the extension to recognize its own warning")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Diagnostics dump
+//
+// Supporting a user whose invocations hang needs the sandbox's state, not just
+// its configuration. The agent publishes a diagnostics frame with a request_id
+// on the control channel, and every live extension of the function answers on
+// live-lambda/reply/{request_id} with a diagnostics frame holding:
+//
+//   - connection: the transport, whether it is connected, and the endpoint it
+//     is connected to,
+//   - interception: whether it is enabled and, if not, why,
+//   - in_flight: the invocations waiting on the agent, with when each was
+//     published, the region it was routed through and the agent that claimed it,
+//   - recent_errors: the last 20 warnings and errors logged,
+//   - memory: the extension's resident memory and Go heap,
+//   - goroutines: the number of goroutines,
+//   - config: every setting's value and source, redacted as in the startup
+//     dump, including changes from the dynamic config parameter.
+//
+// The reply channel keeps the dump off the lifecycle channel, which every
+// agent of the function watches. Frozen sandboxes answer when they are next
+// invoked.
+
+const (
+	diagnostics_frame_type   = "diagnostics"
+	reply_topic_format       = "reply/%s"
+	diagnostics_dump_timeout = 5 * time.Second
+)
+
+type diagnostics_request struct {
+	RequestID string `json:"request_id"`
+}
+
+// reply_topic returns the channel answers to request_id are published on.
+func (p *RuntimeAPIProxy) reply_topic(request_id string) string {
+	return p.channel(reply_topic_format, request_id)
+}
+
+// diagnostics_dump describes the sandbox's state.
+func (p *RuntimeAPIProxy) diagnostics_dump(request_id string, now time.Time) map[string]interface{} {
+	connection := map[string]interface{}{"transport": p.config.Transport, "connected": false}
+	if p.transport != nil {
+		connection["connected"] = p.transport.IsConnected()
+		connection["realtime_host"] = p.appsync_realtime_url
+	}
+
+	interception := map[string]interface{}{"enabled": true}
+	if enabled, reason := p.interception.enabled(); !enabled {
+		interception = map[string]interface{}{"enabled": false, "reason": reason}
+	}
+
+	in_flight := []map[string]interface{}{}
+	if p.requests != nil {
+		for _, request := range p.requests.snapshot() {
+			entry := map[string]interface{}{"request_id": request.request_id}
+			if published := request.published(); !published.IsZero() {
+				entry["published_at"] = published.UTC().Format(time.RFC3339Nano)
+				entry["waiting_ms"] = now.Sub(published).Milliseconds()
+			}
+			if region, _ := request.route(); region != "" {
+				entry["region"] = region
+			}
+			request.mu.Lock()
+			if request.lease != "" {
+				entry["agent_id"] = request.lease
+			}
+			request.mu.Unlock()
+			in_flight = append(in_flight, entry)
+		}
+		sort.Slice(in_flight, func(i, j int) bool {
+			return in_flight[i]["request_id"].(string) < in_flight[j]["request_id"].(string)
+		})
+	}
+
+	var heap runtime.MemStats
+	runtime.ReadMemStats(&heap)
+	memory := map[string]interface{}{
+		"heap_alloc_bytes":   heap.HeapAlloc,
+		"heap_sys_bytes":     heap.HeapSys,
+		"function_memory_mb": p.config.FunctionMemoryMB,
+	}
+	if rss, err := read_self_rss(); err == nil {
+		memory["rss_bytes"] = rss
+	}
+
+	return map[string]interface{}{
+		"type":              diagnostics_frame_type,
+		"request_id":        request_id,
+		"sandbox_id":        p.sandbox_id,
+		"function_name":     p.function_name,
+		"function_version":  p.config.FunctionVersion,
+		"extension_version": extension_version,
+		"timestamp":         now.UTC().Format(time.RFC3339Nano),
+		"uptime_seconds":    int64(now.Sub(p.started_at).Seconds()),
+		"connection":        connection,
+		"interception":      interception,
+		"in_flight":         in_flight,
+		"recent_errors":     recent_errors.snapshot(),
+		"memory":            memory,
+		"goroutines":        runtime.NumGoroutine(),
+		"config":            p.dynamic_config.settings(p.config).effective_settings(),
+	}
+}
+
+// register_diagnostics_handler answers diagnostics frames on the reply channel.
+func (p *RuntimeAPIProxy) register_diagnostics_handler() {
+	p.control.register(diagnostics_frame_type, func(frame json.RawMessage) {
+		logger := component_logger(component_main)
+		var request diagnostics_request
+		if err := json.Unmarshal(frame, &request); err != nil || request.RequestID == "" {
+			logger.Warn("Ignoring malformed diagnostics frame", "error", err)
+			return
+		}
+		if p.transport == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, diagnostics_dump_timeout)
+		defer cancel()
+		topic := p.reply_topic(request.RequestID)
+		if err := p.transport.Publish(ctx, topic, []interface{}{p.diagnostics_dump(request.RequestID, time.Now())}); err != nil {
+			logger.Warn("Could not publish the diagnostics dump", "topic", topic, "error", err)
+			return
+		}
+		logger.Info("Answered diagnostics request", "command_id", request.RequestID)
+	})
+}
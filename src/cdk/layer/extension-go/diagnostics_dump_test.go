@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDiagnosticsDumpPublishedOnReplyChannel(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server, func(settings *Config) { settings.AppSyncAPIKey = "secret-key" })
+
+	request, _ := p.requests.register("req-1", []byte(`{}`), nil)
+	request.mark_published(time.Now().Add(-time.Second))
+	request.set_route("eu-west-1", nil)
+	p.interception.disable("paused")
+	recent_errors.record(logged_error{Level: "WARN", Message: "Publish failed"})
+
+	server.Publish(p.control_topic(), map[string]interface{}{"type": "diagnostics", "request_id": "diag-1"})
+
+	published := wait_for_published(t, server, p.reply_topic("diag-1"), nil)
+	if len(published) != 1 {
+		t.Fatalf("expected one dump on the reply channel, got %v", published)
+	}
+	encoded, _ := json.Marshal(published[0])
+	var dump struct {
+		Type         string                       `json:"type"`
+		RequestID    string                       `json:"request_id"`
+		SandboxID    string                       `json:"sandbox_id"`
+		Connection   map[string]interface{}       `json:"connection"`
+		Interception map[string]interface{}       `json:"interception"`
+		InFlight     []map[string]interface{}     `json:"in_flight"`
+		RecentErrors []logged_error               `json:"recent_errors"`
+		Memory       map[string]interface{}       `json:"memory"`
+		Goroutines   int                          `json:"goroutines"`
+		Config       map[string]map[string]string `json:"config"`
+	}
+	if err := json.Unmarshal(encoded, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Type != "diagnostics" || dump.RequestID != "diag-1" || dump.SandboxID != p.sandbox_id || dump.Connection["connected"] != true {
+		t.Fatalf("unexpected dump %s", encoded)
+	}
+	if dump.Interception["enabled"] != false || dump.Interception["reason"] != "paused" {
+		t.Fatalf("expected the interception state, got %v", dump.Interception)
+	}
+	if len(dump.InFlight) != 1 || dump.InFlight[0]["request_id"] != "req-1" || dump.InFlight[0]["region"] != "eu-west-1" {
+		t.Fatalf("expected the in-flight request, got %v", dump.InFlight)
+	}
+	if len(dump.RecentErrors) == 0 || dump.RecentErrors[len(dump.RecentErrors)-1].Message != "Publish failed" {
+		t.Fatalf("expected the recent errors, got %v", dump.RecentErrors)
+	}
+	if dump.Goroutines == 0 || dump.Memory["heap_alloc_bytes"] == nil {
+		t.Fatalf("expected memory and goroutine counts, got %v %d", dump.Memory, dump.Goroutines)
+	}
+	if dump.Config[live_lambda_appsync_api_key_env]["value"] == "secret-key" || dump.Config[live_lambda_appsync_api_key_env]["source"] != "default" {
+		t.Fatalf("expected the API key redacted, got %v", dump.Config[live_lambda_appsync_api_key_env])
+	}
+}
+
+func TestDiagnosticsIgnoresFrameWithoutRequestID(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server)
+
+	// Control frames are handled in order, so the first is done once the second is answered
+	server.Publish(p.control_topic(), map[string]interface{}{"type": "diagnostics"})
+	server.Publish(p.control_topic(), map[string]interface{}{"type": "diagnostics", "request_id": "diag-2"})
+	wait_for_published(t, server, p.reply_topic("diag-2"), nil)
+	if published := server.Published(p.reply_topic("")); len(published) != 0 {
+		t.Fatalf("expected nothing published, got %s", published)
+	}
+}
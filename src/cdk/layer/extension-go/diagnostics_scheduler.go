@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// The diagnostics scheduler runs cheap self-checks while the sandbox is warm so
+// that degradations (a dead WebSocket, credentials about to expire, the extension
+// eating into the function's memory) are reported before the next invocation
+// trips over them. Lambda freezes the sandbox between invocations, so checks only
+// run while it is thawed.
+
+const (
+	diagnostics_print_prefix        = "[LiveLambdaExt:Diagnostics]"
+	default_diagnostics_interval    = 60 * time.Second
+	diagnostics_jitter_fraction     = 0.2
+	credential_expiry_warning       = 5 * time.Minute
+	default_memory_warning_fraction = 0.10
+	// The extension idles at about 15 MB, so 10% of a small function is not a warning sign
+	min_memory_warning_bytes = 24 * 1024 * 1024
+)
+
+type diagnostic_anomaly struct {
+	Check   string
+	Message string
+	Details map[string]interface{}
+}
+
+type diagnostic_check struct {
+	name string
+	run  func(ctx context.Context) *diagnostic_anomaly
+}
+
+type diagnostics_scheduler struct {
+	interval time.Duration
+	checks   []diagnostic_check
+	report   func(ctx context.Context, anomaly diagnostic_anomaly)
+	random   *rand.Rand
+}
+
+func new_diagnostics_scheduler(interval time.Duration, report func(ctx context.Context, anomaly diagnostic_anomaly), checks ...diagnostic_check) *diagnostics_scheduler {
+	return &diagnostics_scheduler{
+		interval: interval,
+		checks:   checks,
+		report:   report,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next_delay returns the interval with +/- diagnostics_jitter_fraction of jitter
+// so sandboxes of the same function do not probe in lockstep.
+func (s *diagnostics_scheduler) next_delay() time.Duration {
+	jitter := (s.random.Float64()*2 - 1) * diagnostics_jitter_fraction * float64(s.interval)
+	return s.interval + time.Duration(jitter)
+}
+
+// run executes all checks on a jittered schedule until ctx is cancelled.
+func (s *diagnostics_scheduler) run(ctx context.Context) {
+	if s.interval <= 0 {
+		log.Printf("%s Periodic diagnostics disabled", diagnostics_print_prefix)
+		return
+	}
+	log.Printf("%s Running %d check(s) every ~%s", diagnostics_print_prefix, len(s.checks), s.interval)
+
+	timer := time.NewTimer(s.next_delay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			s.run_checks(ctx)
+			timer.Reset(s.next_delay())
+		}
+	}
+}
+
+func (s *diagnostics_scheduler) run_checks(ctx context.Context) {
+	for _, check := range s.checks {
+		if anomaly := check.run(ctx); anomaly != nil {
+			log.Printf("%s %s: %s", diagnostics_print_prefix, anomaly.Check, anomaly.Message)
+			s.report(ctx, *anomaly)
+		}
+	}
+}
+
+// websocket_probe_check publishes a probe on the lifecycle topic. The probe also
+// serves as a liveness ping for the agent.
+func (p *RuntimeAPIProxy) websocket_probe_check() diagnostic_check {
+	return diagnostic_check{
+		name: "websocket",
+		run: func(ctx context.Context) *diagnostic_anomaly {
+			if p.transport == nil || !p.transport.IsConnected() {
+				return &diagnostic_anomaly{Check: "websocket", Message: "AppSync WebSocket is not connected"}
+			}
+			probe_ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			started := time.Now()
+			if err := p.publish_lifecycle_event(probe_ctx, "probe", nil); err != nil {
+				return &diagnostic_anomaly{
+					Check:   "websocket",
+					Message: fmt.Sprintf("liveness probe publish failed: %v", err),
+				}
+			}
+			if elapsed := time.Since(started); elapsed > 2*time.Second {
+				return &diagnostic_anomaly{
+					Check:   "websocket",
+					Message: "liveness probe publish was slow",
+					Details: map[string]interface{}{"elapsed_ms": elapsed.Milliseconds()},
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// credential_expiry_check flags credentials that cannot be retrieved or expire soon.
+func credential_expiry_check(provider aws.CredentialsProvider, now func() time.Time) diagnostic_check {
+	return diagnostic_check{
+		name: "credentials",
+		run: func(ctx context.Context) *diagnostic_anomaly {
+			if provider == nil {
+				return nil
+			}
+			credentials, err := provider.Retrieve(ctx)
+			if err != nil {
+				return &diagnostic_anomaly{Check: "credentials", Message: fmt.Sprintf("failed to retrieve credentials: %v", err)}
+			}
+			if !credentials.CanExpire {
+				return nil
+			}
+			remaining := credentials.Expires.Sub(now())
+			if remaining < credential_expiry_warning {
+				return &diagnostic_anomaly{
+					Check:   "credentials",
+					Message: "credentials expire soon",
+					Details: map[string]interface{}{"expires_in_seconds": int64(remaining.Seconds()), "source": credentials.Source},
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// memory_usage_check flags the extension when its resident memory exceeds
+// threshold_bytes. read_rss is injectable for tests.
+func memory_usage_check(threshold_bytes int64, read_rss func() (int64, error)) diagnostic_check {
+	return diagnostic_check{
+		name: "memory",
+		run: func(ctx context.Context) *diagnostic_anomaly {
+			if threshold_bytes <= 0 {
+				return nil
+			}
+			rss, err := read_rss()
+			if err != nil {
+				return nil
+			}
+			if rss > threshold_bytes {
+				return &diagnostic_anomaly{
+					Check:   "memory",
+					Message: "extension memory usage above threshold",
+					Details: map[string]interface{}{"rss_bytes": rss, "threshold_bytes": threshold_bytes},
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// memory_warning_threshold derives the memory threshold from the function's
+// configured memory size, never going below min_memory_warning_bytes.
+func memory_warning_threshold(memory_mb int) int64 {
+	if memory_mb <= 0 {
+		return 0
+	}
+	threshold := int64(float64(int64(memory_mb)*1024*1024) * default_memory_warning_fraction)
+	if threshold < min_memory_warning_bytes {
+		return min_memory_warning_bytes
+	}
+	return threshold
+}
+
+// read_self_rss returns the resident set size of this process from /proc.
+func read_self_rss() (int64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			break
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	return 0, fmt.Errorf("VmRSS not found in /proc/self/status")
+}
+
+// data returns the anomaly as the data of a lifecycle event.
+func (a diagnostic_anomaly) data() map[string]interface{} {
+	data := map[string]interface{}{"check": a.Check, "message": a.Message}
+	for key, value := range a.Details {
+		data[key] = value
+	}
+	return data
+}
+
+// diagnostic_checks returns the checks the scheduler runs.
+func (p *RuntimeAPIProxy) diagnostic_checks() []diagnostic_check {
+	return []diagnostic_check{
+		p.websocket_probe_check(),
+		credential_expiry_check(p.aws_cfg.Credentials, time.Now),
+		memory_usage_check(memory_warning_threshold(p.config.FunctionMemoryMB), read_self_rss),
+	}
+}
+
+// run_diagnostics starts the self-diagnostics scheduler for the lifetime of ctx.
+func (p *RuntimeAPIProxy) run_diagnostics(ctx context.Context, interval time.Duration) {
+	scheduler := new_diagnostics_scheduler(interval,
+		func(ctx context.Context, anomaly diagnostic_anomaly) {
+			_ = p.publish_lifecycle_event(ctx, "diagnostic_anomaly", anomaly.data())
+		},
+		p.diagnostic_checks()...,
+	)
+	scheduler.run(ctx)
+}
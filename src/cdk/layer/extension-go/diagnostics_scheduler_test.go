@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestDiagnosticsSchedulerJitterStaysInBounds(t *testing.T) {
+	scheduler := new_diagnostics_scheduler(time.Minute, nil)
+	low := time.Duration(float64(time.Minute) * (1 - diagnostics_jitter_fraction))
+	high := time.Duration(float64(time.Minute) * (1 + diagnostics_jitter_fraction))
+	for i := 0; i < 1000; i++ {
+		delay := scheduler.next_delay()
+		if delay < low || delay > high {
+			t.Fatalf("delay %s outside [%s, %s]", delay, low, high)
+		}
+	}
+}
+
+func TestDiagnosticsSchedulerReportsOnlyAnomalies(t *testing.T) {
+	var reported []string
+	scheduler := new_diagnostics_scheduler(time.Minute,
+		func(ctx context.Context, anomaly diagnostic_anomaly) { reported = append(reported, anomaly.Check) },
+		diagnostic_check{name: "healthy", run: func(context.Context) *diagnostic_anomaly { return nil }},
+		diagnostic_check{name: "broken", run: func(context.Context) *diagnostic_anomaly {
+			return &diagnostic_anomaly{Check: "broken", Message: "boom"}
+		}},
+	)
+	scheduler.run_checks(context.Background())
+	if len(reported) != 1 || reported[0] != "broken" {
+		t.Fatalf("expected only the broken check to be reported, got %v", reported)
+	}
+}
+
+func TestCredentialExpiryCheck(t *testing.T) {
+	now := time.Unix(10000, 0)
+	clock := func() time.Time { return now }
+	provider := func(expires time.Time, can_expire bool) aws.CredentialsProvider {
+		return aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", CanExpire: can_expire, Expires: expires}, nil
+		})
+	}
+
+	if anomaly := credential_expiry_check(provider(now.Add(time.Hour), true), clock).run(context.Background()); anomaly != nil {
+		t.Errorf("expected no anomaly for long-lived credentials, got %+v", anomaly)
+	}
+	if anomaly := credential_expiry_check(provider(now.Add(time.Minute), true), clock).run(context.Background()); anomaly == nil {
+		t.Error("expected an anomaly for credentials expiring within the warning window")
+	}
+	if anomaly := credential_expiry_check(provider(now, false), clock).run(context.Background()); anomaly != nil {
+		t.Errorf("expected no anomaly for non-expiring credentials, got %+v", anomaly)
+	}
+
+	failing := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, errors.New("no credentials")
+	})
+	if anomaly := credential_expiry_check(failing, clock).run(context.Background()); anomaly == nil {
+		t.Error("expected an anomaly when credentials cannot be retrieved")
+	}
+}
+
+func TestMemoryUsageCheck(t *testing.T) {
+	rss := func(value int64) func() (int64, error) {
+		return func() (int64, error) { return value, nil }
+	}
+	if anomaly := memory_usage_check(100, rss(50)).run(context.Background()); anomaly != nil {
+		t.Errorf("expected no anomaly below threshold, got %+v", anomaly)
+	}
+	if anomaly := memory_usage_check(100, rss(150)).run(context.Background()); anomaly == nil {
+		t.Error("expected an anomaly above threshold")
+	}
+	if anomaly := memory_usage_check(0, rss(150)).run(context.Background()); anomaly != nil {
+		t.Error("expected a zero threshold to disable the check")
+	}
+}
+
+func TestMemoryWarningThresholdOnSmallFunctions(t *testing.T) {
+	// An idle extension uses about 14.5 MB, which is over 10% of 128 MB
+	idle_rss := func() (int64, error) { return 14_500_000, nil }
+	if threshold := memory_warning_threshold(128); threshold != min_memory_warning_bytes {
+		t.Fatalf("expected the floor on a 128 MB function, got %d", threshold)
+	}
+	if anomaly := memory_usage_check(memory_warning_threshold(128), idle_rss).run(context.Background()); anomaly != nil {
+		t.Fatalf("expected no warning for an idle extension on a 128 MB function, got %+v", anomaly)
+	}
+	if threshold := memory_warning_threshold(1024); threshold != 1024*1024*1024/10 {
+		t.Fatalf("expected 10%% of a large function, got %d", threshold)
+	}
+	if memory_warning_threshold(0) != 0 {
+		t.Fatal("expected no threshold for an unknown memory size")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Dynamic configuration
+//
+// Changing a function's environment forces a cold start, which is too heavy
+// just to turn live routing on or off. LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER
+// names an SSM parameter holding a JSON object keyed by setting name, like
+// the config file:
+//
+//	{"LIVE_LAMBDA_ENABLED": false, "LIVE_LAMBDA_SAMPLE_RATE": 10}
+//
+// Only the settings in dynamic_settings can be changed this way; they
+// override the environment and the config file, and removing one from the
+// parameter restores its deployed value. The extension reads the parameter
+// before connecting, then in handle_next once the last read is
+// LIVE_LAMBDA_DYNAMIC_CONFIG_REFRESH old (default 30s, 0 reads it on every
+// invocation). A frozen sandbox runs no timers, so the invocation is what
+// starts the refresh, and it is routed under the refreshed settings. A
+// parameter that cannot be read or is invalid leaves the last good settings
+// in place.
+//
+// LIVE_LAMBDA_ENABLED=false in the parameter passes every invocation through
+// but keeps the connection, so turning it back on takes effect immediately.
+// An extension deployed with LIVE_LAMBDA_ENABLED=off never connects and
+// cannot be turned on from the parameter. A new LIVE_LAMBDA_APPSYNC_NAMESPACE
+// reconnects the transport so that its channels move; invocations in flight
+// at that moment fall back. Each change is published as a config_reloaded
+// lifecycle event with the names of the changed settings.
+
+const (
+	default_dynamic_config_refresh = 30 * time.Second
+	dynamic_config_fetch_timeout   = 2 * time.Second
+)
+
+// dynamic_settings are the settings the parameter may change.
+var dynamic_settings = map[string]bool{
+	live_lambda_enabled_env:           true,
+	live_lambda_sample_rate_env:       true,
+	live_lambda_intercept_when_env:    true,
+	live_lambda_routing_rules_env:     true,
+	live_lambda_appsync_namespace_env: true,
+}
+
+// dynamic_config refreshes the settings from the parameter. A nil
+// dynamic_config never changes them.
+type dynamic_config struct {
+	parameter string
+	refresh   time.Duration
+	fetch     func(ctx context.Context) ([]byte, error)
+	now       func() time.Time
+
+	mu         sync.Mutex // held while a refresh runs
+	fetched_at time.Time
+	document   string // the last document applied
+	applied    Config // the settings in effect
+
+	namespace_override atomic.Pointer[string]
+}
+
+// new_dynamic_config_from_config returns nil unless
+// LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER is set. Validate has already checked
+// the ARN.
+func new_dynamic_config_from_config(cfg aws.Config, settings Config) *dynamic_config {
+	if settings.DynamicConfigParameter == "" {
+		return nil
+	}
+	_, region := parse_resource_arn(settings.DynamicConfigParameter)
+	d := &dynamic_config{
+		parameter: settings.DynamicConfigParameter,
+		refresh:   settings.DynamicConfigRefresh,
+		now:       time.Now,
+		applied:   settings,
+	}
+	d.fetch = func(ctx context.Context) ([]byte, error) {
+		return read_ssm_parameter(ctx, cfg, region, d.parameter)
+	}
+	component_logger(component_dynamic_config).Info("Reading settings from a parameter", "parameter", d.parameter, "refresh", d.refresh)
+	return d
+}
+
+// settings returns the settings in effect, or deployed without a parameter.
+func (d *dynamic_config) settings(deployed Config) Config {
+	if d == nil {
+		return deployed
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.applied
+}
+
+// namespace returns the channel namespace set by the parameter, or an empty
+// string when it sets none.
+func (d *dynamic_config) namespace() string {
+	if d == nil {
+		return ""
+	}
+	if namespace := d.namespace_override.Load(); namespace != nil {
+		return *namespace
+	}
+	return ""
+}
+
+// parse_dynamic_config applies a parameter document to the deployed settings.
+func parse_dynamic_config(deployed Config, document []byte) (Config, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(document, &raw); err != nil {
+		return deployed, fmt.Errorf("the parameter is not a JSON object: %w", err)
+	}
+	settings := deployed
+	settings.sources = maps.Clone(deployed.sources)
+	if settings.sources == nil {
+		settings.sources = map[string]string{}
+	}
+	for _, setting := range config_settings {
+		value, ok := raw[setting.name]
+		if !ok {
+			continue
+		}
+		delete(raw, setting.name)
+		if !dynamic_settings[setting.name] {
+			return deployed, fmt.Errorf("%s cannot be changed at runtime", setting.name)
+		}
+		text, ok := config_value_string(value)
+		if !ok {
+			return deployed, fmt.Errorf("%s must be a string, number or boolean", setting.name)
+		}
+		if err := setting.parse(&settings, strings.TrimSpace(text)); err != nil {
+			return deployed, fmt.Errorf("invalid %s %q: %w", setting.name, text, err)
+		}
+		settings.sources[setting.name] = "parameter"
+	}
+	for name := range raw {
+		return deployed, fmt.Errorf("unknown setting %s", name)
+	}
+	if err := settings.Validate(); err != nil {
+		return deployed, err
+	}
+	return settings, nil
+}
+
+// refresh_dynamic_config reads the parameter when the last read is older than
+// the refresh interval, and applies what changed. request_id is empty for the
+// read before connecting.
+func (p *RuntimeAPIProxy) refresh_dynamic_config(ctx context.Context, request_id string) {
+	d := p.dynamic_config
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	logger := component_logger(component_dynamic_config)
+	if request_id != "" {
+		logger = logger.With("request_id", request_id)
+	}
+	now := d.now()
+	if !d.fetched_at.IsZero() && now.Sub(d.fetched_at) < d.refresh {
+		return
+	}
+	d.fetched_at = now
+
+	fetch_ctx, cancel := context.WithTimeout(ctx, dynamic_config_fetch_timeout)
+	document, err := d.fetch(fetch_ctx)
+	cancel()
+	if err != nil {
+		logger.Warn("Keeping the current settings, the parameter could not be read", "parameter", d.parameter, "error", err)
+		return
+	}
+	if string(document) == d.document {
+		return
+	}
+	settings, err := parse_dynamic_config(p.config, document)
+	if err != nil {
+		logger.Warn("Keeping the current settings, the parameter is invalid", "parameter", d.parameter, "error", err)
+		return
+	}
+	d.document = string(document)
+	changed := p.apply_dynamic_config(ctx, d.applied, settings)
+	d.applied = settings
+	if len(changed) == 0 {
+		return
+	}
+	logger.Info("Applied settings from the parameter", "parameter", d.parameter, "changed", strings.Join(changed, ","))
+	_ = p.publish_lifecycle_event(ctx, "config_reloaded", map[string]interface{}{
+		"parameter": d.parameter,
+		"changed":   changed,
+	})
+}
+
+// apply_dynamic_config switches the proxy from the previous settings to the
+// next and returns the names of the settings that changed.
+func (p *RuntimeAPIProxy) apply_dynamic_config(ctx context.Context, previous Config, next Config) []string {
+	var changed []string
+	if next.Enabled != previous.Enabled {
+		changed = append(changed, live_lambda_enabled_env)
+		if next.Enabled {
+			p.interception.enable()
+		} else {
+			p.interception.disable(live_lambda_enabled_env + " is off in " + p.dynamic_config.parameter)
+		}
+	}
+	if next.SampleRate != previous.SampleRate || next.InterceptWhen != previous.InterceptWhen {
+		if next.SampleRate != previous.SampleRate {
+			changed = append(changed, live_lambda_sample_rate_env)
+		}
+		if next.InterceptWhen != previous.InterceptWhen {
+			changed = append(changed, live_lambda_intercept_when_env)
+		}
+		p.traffic_split.Store(new_traffic_split_from_config(next))
+	}
+	if next.RoutingRules != previous.RoutingRules {
+		changed = append(changed, live_lambda_routing_rules_env)
+		p.routing_rules.Store(new_routing_rules_from_config(p.aws_cfg, next))
+	}
+	if next.AppSyncNamespace != previous.AppSyncNamespace {
+		changed = append(changed, live_lambda_appsync_namespace_env)
+		namespace := next.AppSyncNamespace
+		p.dynamic_config.namespace_override.Store(&namespace)
+		p.move_namespace(ctx)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// move_namespace reconnects so that watch_connection subscribes in the new
+// namespace, and waits for the reconnect.
+func (p *RuntimeAPIProxy) move_namespace(ctx context.Context) {
+	if p.transport == nil || !p.transport.IsConnected() {
+		return
+	}
+	logger := component_logger(component_dynamic_config)
+	logger.Info("Reconnecting to move to a new namespace", "namespace", p.namespace())
+	p.transport.Close()
+	if !wait_until(ctx, idle_reconnect_timeout, p.transport.IsConnected) {
+		logger.Warn("Could not reconnect in the new namespace", "timeout", idle_reconnect_timeout)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+const test_dynamic_config_parameter = "arn:aws:ssm:eu-west-1:123456789012:parameter/live-lambda/orders"
+
+func deployed_test_config(t *testing.T) Config {
+	t.Helper()
+	settings, err := load_config(lookup_from(map[string]string{
+		lrap_runtime_api_endpoint_env:  "127.0.0.1:9001",
+		live_lambda_dynamic_config_env: test_dynamic_config_parameter,
+	}))
+	if err != nil {
+		t.Fatalf("load_config: %v", err)
+	}
+	// NewRuntimeAPIProxy fills these in from its arguments
+	settings.AppSyncHTTPHost = "example.appsync-api.eu-west-1.amazonaws.com"
+	settings.AppSyncRealtimeHost = "example.appsync-realtime-api.eu-west-1.amazonaws.com"
+	settings.AppSyncRegion = "eu-west-1"
+	return settings
+}
+
+// build_dynamic_config_proxy builds a proxy for server that reads its settings
+// from the test parameter through fetch; a nil fetch reads an empty
+// parameter, which keeps the deployed settings. The proxy is not connected yet.
+func build_dynamic_config_proxy(t *testing.T, server *eventstest.Server, fetch func(ctx context.Context) ([]byte, error)) *RuntimeAPIProxy {
+	t.Helper()
+	p := build_events_proxy(t, server, func(settings *Config) { settings.DynamicConfigParameter = test_dynamic_config_parameter })
+	if fetch == nil {
+		fetch = func(ctx context.Context) ([]byte, error) { return []byte(`{}`), nil }
+	}
+	p.dynamic_config.fetch = fetch
+	return p
+}
+
+// config_reloads counts the config_reloaded events p has published.
+func config_reloads(server *eventstest.Server, p *RuntimeAPIProxy) int {
+	reloads := 0
+	for _, raw := range server.Published(p.lifecycle_topic()) {
+		var event lifecycle_event
+		if json.Unmarshal(raw, &event) == nil && event.Type == "config_reloaded" {
+			reloads++
+		}
+	}
+	return reloads
+}
+
+func TestParseDynamicConfig(t *testing.T) {
+	deployed := deployed_test_config(t)
+	settings, err := parse_dynamic_config(deployed, []byte(`{"LIVE_LAMBDA_ENABLED": false, "LIVE_LAMBDA_SAMPLE_RATE": 10, "LIVE_LAMBDA_APPSYNC_NAMESPACE": "live-lambda-dev"}`))
+	if err != nil {
+		t.Fatalf("parse_dynamic_config: %v", err)
+	}
+	if settings.Enabled || settings.SampleRate != 10 || settings.AppSyncNamespace != "live-lambda-dev" {
+		t.Fatalf("expected the parameter to override the deployed settings, got %+v", settings)
+	}
+	if settings, err := parse_dynamic_config(deployed, []byte(`{}`)); err != nil || settings.SampleRate != deployed.SampleRate || !settings.Enabled {
+		t.Fatalf("expected an empty parameter to keep the deployed settings, got %v, %v", settings.SampleRate, err)
+	}
+
+	for document, want := range map[string]string{
+		`[]`:                                   "not a JSON object",
+		`{"LIVE_LAMBDA_TRANSPORT": "iot"}`:     "cannot be changed at runtime",
+		`{"LIVE_LAMBDA_NOT_A_SETTING": 1}`:     "unknown setting",
+		`{"LIVE_LAMBDA_SAMPLE_RATE": "often"}`: "invalid LIVE_LAMBDA_SAMPLE_RATE",
+		`{"LIVE_LAMBDA_SAMPLE_RATE": [10]}`:    "string, number or boolean",
+		`{"LIVE_LAMBDA_SAMPLE_RATE": 150}`:     "LIVE_LAMBDA_SAMPLE_RATE",
+	} {
+		settings, err := parse_dynamic_config(deployed, []byte(document))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", document, want, err)
+		}
+		if settings.SampleRate != deployed.SampleRate {
+			t.Errorf("%s: expected the deployed settings back on error", document)
+		}
+	}
+}
+
+func TestApplyDynamicConfig(t *testing.T) {
+	server := new_events_server(t)
+	p := build_dynamic_config_proxy(t, server, nil)
+	connect_events_proxy(t, p, server)
+	previous := p.config
+
+	next := previous
+	next.Enabled = false
+	next.SampleRate = 25
+	changed := p.apply_dynamic_config(context.Background(), previous, next)
+	if strings.Join(changed, ",") != live_lambda_enabled_env+","+live_lambda_sample_rate_env {
+		t.Fatalf("unexpected changed settings %v", changed)
+	}
+	if enabled, reason := p.interception.enabled(); enabled || !strings.Contains(reason, test_dynamic_config_parameter) {
+		t.Fatalf("expected interception to be disabled by the parameter, got %v %q", enabled, reason)
+	}
+	if split := p.traffic_split.Load(); split == nil || split.rate != 25 {
+		t.Fatalf("expected a 25%% traffic split, got %+v", split)
+	}
+
+	changed = p.apply_dynamic_config(context.Background(), next, previous)
+	if enabled, _ := p.interception.enabled(); !enabled || len(changed) != 2 {
+		t.Fatalf("expected restoring the settings to enable interception, got %v", changed)
+	}
+	if p.traffic_split.Load() != nil {
+		t.Fatal("expected the traffic split to be dropped at 100%")
+	}
+
+	// A hard disable is not undone by the parameter
+	p.interception.disable_hard("tagged off")
+	p.apply_dynamic_config(context.Background(), previous, next)
+	p.apply_dynamic_config(context.Background(), next, previous)
+	if enabled, reason := p.interception.enabled(); enabled || reason != "tagged off" {
+		t.Fatalf("expected the hard disable to stay, got %v %q", enabled, reason)
+	}
+}
+
+func TestMoveNamespace(t *testing.T) {
+	server := new_events_server(t)
+	p := build_dynamic_config_proxy(t, server, nil)
+	connect_events_proxy(t, p, server)
+	next := p.config
+	next.AppSyncNamespace = "live-lambda-dev"
+
+	changed := p.apply_dynamic_config(context.Background(), p.config, next)
+	if len(changed) != 1 || changed[0] != live_lambda_appsync_namespace_env {
+		t.Fatalf("unexpected changed settings %v", changed)
+	}
+	if p.requests_topic() != "live-lambda-dev/requests" {
+		t.Fatalf("expected the channels to move, got %s", p.requests_topic())
+	}
+	// The connection watch reconnects, and subscribes in the new namespace
+	wait_for_lifecycle_event(t, server, p, "reconnected")
+	if connections, _ := server.Counts(); connections != 1 || !p.transport.IsConnected() {
+		t.Fatalf("expected one reconnect, got %d connections", connections)
+	}
+
+	// Without a connection there is nothing to move
+	server = new_events_server(t)
+	p = build_dynamic_config_proxy(t, server, nil)
+	p.apply_dynamic_config(context.Background(), p.config, next)
+	if connections, _ := server.Counts(); connections != 0 {
+		t.Fatal("expected a disconnected transport to be left alone")
+	}
+}
+
+func TestRefreshDynamicConfig(t *testing.T) {
+	document := `{"LIVE_LAMBDA_SAMPLE_RATE": 10}`
+	var fetch_err error
+	var fetches atomic.Int32
+	server := new_events_server(t)
+	p := build_dynamic_config_proxy(t, server, func(ctx context.Context) ([]byte, error) {
+		fetches.Add(1)
+		return []byte(document), fetch_err
+	})
+	now := time.Unix(1700000000, 0)
+	p.dynamic_config.now = func() time.Time { return now }
+
+	// The parameter is first read before connecting, with no connection to
+	// report the reload on
+	connect_events_proxy(t, p, server)
+	if split := p.traffic_split.Load(); fetches.Load() != 1 || split == nil || split.rate != 10 {
+		t.Fatalf("expected the first read to apply the parameter, got %d reads", fetches.Load())
+	}
+
+	// Within the refresh interval the parameter is not read again
+	now = now.Add(default_dynamic_config_refresh / 2)
+	p.refresh_dynamic_config(context.Background(), "req-1")
+	if fetches.Load() != 1 {
+		t.Fatalf("expected no further reads, got %d", fetches.Load())
+	}
+
+	// A failed read or an invalid document keeps the current settings
+	now = now.Add(default_dynamic_config_refresh)
+	fetch_err = errors.New("throttled")
+	p.refresh_dynamic_config(context.Background(), "req-2")
+	fetch_err = nil
+	document = `{"LIVE_LAMBDA_SAMPLE_RATE": "often"}`
+	now = now.Add(default_dynamic_config_refresh)
+	p.refresh_dynamic_config(context.Background(), "req-3")
+	if split := p.traffic_split.Load(); fetches.Load() != 3 || split == nil || split.rate != 10 {
+		t.Fatalf("expected the current settings to be kept, got %d reads", fetches.Load())
+	}
+
+	// An unchanged document publishes nothing; removing the setting restores
+	// the deployed value
+	document = `{"LIVE_LAMBDA_SAMPLE_RATE": 10}`
+	now = now.Add(default_dynamic_config_refresh)
+	p.refresh_dynamic_config(context.Background(), "req-4")
+	document = `{}`
+	now = now.Add(default_dynamic_config_refresh)
+	p.refresh_dynamic_config(context.Background(), "req-5")
+	if reloads := config_reloads(server, p); p.traffic_split.Load() != nil || reloads != 1 {
+		t.Fatalf("expected the deployed sample rate back and a config_reloaded lifecycle event, got %d", reloads)
+	}
+
+	// Without a parameter nothing is read
+	(&RuntimeAPIProxy{}).refresh_dynamic_config(context.Background(), "req-6")
+}
+
+func TestConfigValidateDynamicConfigParameter(t *testing.T) {
+	for env, want := range map[string]string{
+		live_lambda_dynamic_config_env:         "SSM parameter ARN",
+		live_lambda_dynamic_config_refresh_env: "must not be negative",
+	} {
+		values := map[string]string{lrap_runtime_api_endpoint_env: "127.0.0.1:9001"}
+		switch env {
+		case live_lambda_dynamic_config_env:
+			values[env] = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:settings"
+		default:
+			values[live_lambda_dynamic_config_env] = test_dynamic_config_parameter
+			values[env] = "-5s"
+		}
+		settings, err := load_config(lookup_from(values))
+		if err == nil {
+			err = settings.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", env, want, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// agent plays the developer agent on the fake Events API. Until it is made
+// present it stays silent, so the extension passes every invocation through
+// to the function. Once present it sends heartbeats, answers probes, and
+// answers each request with its own event: a JSON event as the response body
+// and a binary event as a binary_payload frame.
+
+const (
+	agent_id              = "e2e-agent"
+	agent_heartbeat_every = 2 * time.Second
+	agent_heartbeat_ttl   = 15 * time.Second
+)
+
+type agent struct {
+	server        *eventstest.Server
+	function_name string
+	present       atomic.Bool
+
+	mu       sync.Mutex
+	received [][]byte // the event bytes of each request, in the order they arrived
+}
+
+func new_agent(server *eventstest.Server, function_name string) *agent {
+	return &agent{server: server, function_name: function_name}
+}
+
+// run sends heartbeats while the agent is present, until ctx ends.
+func (a *agent) run(ctx context.Context) {
+	ticker := time.NewTicker(agent_heartbeat_every)
+	defer ticker.Stop()
+	for {
+		if a.present.Load() {
+			a.send_heartbeat()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// arrive makes the agent present and announces it right away.
+func (a *agent) arrive() {
+	a.present.Store(true)
+	a.send_heartbeat()
+}
+
+func (a *agent) send_heartbeat() {
+	a.server.Publish("live-lambda/presence/"+a.function_name, map[string]interface{}{
+		"type":                 "heartbeat",
+		"agent_id":             agent_id,
+		"ttl_ms":               agent_heartbeat_ttl.Milliseconds(),
+		"protocol_version":     2,
+		"min_protocol_version": 1,
+		"capabilities":         []string{"response_envelope", "error_frames", "binary"},
+	})
+}
+
+// handle receives what the extension publishes.
+func (a *agent) handle(channel string, event json.RawMessage) {
+	var frame struct {
+		Type         string          `json:"type"`
+		RequestID    string          `json:"request_id"`
+		EventPayload json.RawMessage `json:"event_payload"`
+		EventFormat  string          `json:"event_format"`
+	}
+	if json.Unmarshal(event, &frame) != nil || !a.present.Load() {
+		return
+	}
+	switch {
+	case strings.HasPrefix(channel, "live-lambda/presence/"):
+		if frame.Type == "probe" {
+			go a.send_heartbeat()
+		}
+	case channel == "live-lambda/requests" && frame.Type == "":
+		received, body := []byte(frame.EventPayload), interface{}(frame.EventPayload)
+		if frame.EventFormat == "binary" {
+			var encoded string
+			if json.Unmarshal(frame.EventPayload, &encoded) != nil {
+				return
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return
+			}
+			received, body = decoded, map[string]interface{}{"type": "binary_payload", "data": encoded}
+		}
+		a.mu.Lock()
+		a.received = append(a.received, received)
+		a.mu.Unlock()
+		envelope := map[string]interface{}{"type": "response", "protocol_version": 2, "body": body}
+		go a.server.Publish("live-lambda/response/"+frame.RequestID, envelope)
+	}
+}
+
+// answered returns how many requests the agent answered.
+func (a *agent) answered() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.received)
+}
+
+// last_event returns the event bytes of the last request the agent answered.
+func (a *agent) last_event() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.received) == 0 {
+		return nil
+	}
+	return a.received[len(a.received)-1]
+}
@@ -0,0 +1,327 @@
+//go:build e2e
+
+// Package e2e runs the extension end to end under the AWS Lambda Runtime
+// Interface Emulator: invoke → extension → fake AppSync Events API → agent →
+// response → Runtime API → caller. It needs the emulator and a writable
+// /opt/extensions, which is where the emulator looks for extensions, so it
+// normally runs in the container `make e2e` builds:
+//
+//	make e2e
+//	make e2e E2E_FLAGS='-e2e.invocations=200 -e2e.added-p50=10ms'
+//
+// The test builds the extension into /opt/extensions and a function that
+// answers every event with function_response, starts the emulator with the
+// function behind live-lambda-runtime-wrapper.sh, and invokes it over the
+// emulator's invoke API. It first measures invocations the extension passes
+// through, while no agent is present, then checks that payloads survive the
+// round trip through the agent byte for byte and that interception adds no
+// more than the latency budgets.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+var (
+	invocations      = flag.Int("e2e.invocations", 50, "invocations to time, with and without the agent")
+	added_p50_budget = flag.Duration("e2e.added-p50", 25*time.Millisecond, "how much interception may add to the median invocation")
+	added_max_budget = flag.Duration("e2e.added-max", 250*time.Millisecond, "how much interception may add to the slowest invocation")
+)
+
+const (
+	function_name     = "orders"
+	function_response = `{"answered_by":"function"}`
+	step_timeout      = 30 * time.Second
+)
+
+// fidelity_cases are the payloads that must reach the agent, and come back
+// from it, byte for byte. Events travel as JSON values, which the transports
+// decode and encode again, so JSON is only preserved byte for byte in that
+// encoding: keys sorted, no insignificant whitespace, shortest numbers, and
+// <, > and & escaped. A binary event is carried as base64 and preserved as is.
+var fidelity_cases = []struct {
+	name  string
+	event []byte
+}{
+	{"empty object", []byte(`{}`)},
+	{"nested", []byte(`{"a":[1,2.5,-0.125,null],"b":{"c":true,"d":false},"e":""}`)},
+	{"strings", []byte(`{"escapes":"tab\t quote\" backslash\\ newline\n","html":"\u003cb\u003e \u0026","unicode":"é ü 😀"}`)},
+	{"large", []byte(`{"data":"` + strings.Repeat("0123456789abcdef", 4096) + `"}`)},
+	{"binary", binary_event()},
+}
+
+// binary_event is every byte value, which is not valid JSON.
+func binary_event() []byte {
+	event := make([]byte, 0, 512)
+	for i := 0; i < 512; i++ {
+		event = append(event, byte(i))
+	}
+	return event
+}
+
+// sandbox is the emulator running the extension and the function.
+type sandbox struct {
+	invoke_url string
+	client     *http.Client
+	cmd        *exec.Cmd
+	output     *locked_buffer
+	exited     chan error
+}
+
+// locked_buffer collects the emulator's output, which includes the
+// extension's and the function's.
+type locked_buffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *locked_buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *locked_buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// find_emulator returns the emulator binary, from LIVE_LAMBDA_RIE or the PATH.
+func find_emulator(t *testing.T) string {
+	t.Helper()
+	if path := os.Getenv("LIVE_LAMBDA_RIE"); path != "" {
+		return path
+	}
+	path, err := exec.LookPath("aws-lambda-rie")
+	if err != nil {
+		t.Skip("aws-lambda-rie is not installed; run make e2e")
+	}
+	return path
+}
+
+// free_port returns a loopback port nothing is listening on.
+func free_port(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// go_build builds the package in dir to output for Lambda.
+func go_build(t *testing.T, dir string, output string) {
+	t.Helper()
+	cmd := exec.Command("go", "build", "-o", output, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build %s: %v\n%s", dir, err, out)
+	}
+}
+
+// start_sandbox installs the extension and starts the emulator against server.
+func start_sandbox(t *testing.T, server *eventstest.Server) *sandbox {
+	t.Helper()
+	emulator := find_emulator(t)
+	if err := os.MkdirAll("/opt/extensions", 0o755); err != nil {
+		t.Skipf("/opt/extensions is not writable (%v); run make e2e", err)
+	}
+	source, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extension := "/opt/extensions/live-lambda-extension"
+	go_build(t, source, extension)
+	t.Cleanup(func() { os.Remove(extension) })
+	workdir := t.TempDir()
+	function := filepath.Join(workdir, "function")
+	go_build(t, filepath.Join(source, "e2e", "testdata", "function"), function)
+	certificate := filepath.Join(workdir, "events-api.pem")
+	if err := server.WriteCertificate(certificate); err != nil {
+		t.Fatal(err)
+	}
+
+	invoke_address := fmt.Sprintf("127.0.0.1:%d", free_port(t))
+	s := &sandbox{
+		invoke_url: "http://" + invoke_address + "/2015-03-31/functions/function/invocations",
+		client:     &http.Client{Timeout: step_timeout},
+		output:     &locked_buffer{},
+		exited:     make(chan error, 1),
+	}
+	s.cmd = exec.Command(emulator,
+		"--runtime-interface-emulator-address", invoke_address,
+		"--runtime-api-address", fmt.Sprintf("127.0.0.1:%d", free_port(t)),
+		"/bin/sh", filepath.Join(source, "live-lambda-runtime-wrapper.sh"), function,
+	)
+	s.cmd.Env = append(os.Environ(),
+		"AWS_LAMBDA_FUNCTION_NAME="+function_name,
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE=1024",
+		"AWS_LAMBDA_FUNCTION_TIMEOUT=30",
+		"AWS_REGION=us-east-1",
+		fmt.Sprintf("LRAP_LISTENER_PORT=%d", free_port(t)),
+		"LIVE_LAMBDA_APPSYNC_HTTP_HOST="+server.Host(),
+		"LIVE_LAMBDA_APPSYNC_REALTIME_HOST="+server.Host(),
+		"LIVE_LAMBDA_APPSYNC_REGION=us-east-1",
+		"LIVE_LAMBDA_APPSYNC_AUTH_MODE=api_key",
+		"LIVE_LAMBDA_APPSYNC_API_KEY=e2e",
+		"LIVE_LAMBDA_TELEMETRY=off",
+		"LIVE_LAMBDA_TAG_LOOKUP=off",
+		"LIVE_LAMBDA_XRAY=off",
+		"SSL_CERT_FILE="+certificate,
+	)
+	s.cmd.Stdout = s.output
+	s.cmd.Stderr = s.output
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("failed to start %s: %v", emulator, err)
+	}
+	go func() { s.exited <- s.cmd.Wait() }()
+	t.Cleanup(func() {
+		// The emulator's process group holds the extension and the function
+		syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+		<-s.exited
+		if t.Failed() {
+			t.Logf("emulator output:\n%s", s.output.String())
+		}
+	})
+
+	within(t, "the emulator to listen", func() bool {
+		conn, err := net.Dial("tcp", invoke_address)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return s
+}
+
+// invoke sends event to the function and returns its response and how long
+// the invocation took.
+func (s *sandbox) invoke(t *testing.T, event []byte) ([]byte, time.Duration) {
+	t.Helper()
+	started := time.Now()
+	resp, err := s.client.Post(s.invoke_url, "application/json", bytes.NewReader(event))
+	if err != nil {
+		t.Fatalf("invoke failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the invoke response: %v", err)
+	}
+	elapsed := time.Since(started)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("invoke returned %d: %s", resp.StatusCode, body)
+	}
+	return body, elapsed
+}
+
+// within polls done until it holds, failing the test after step_timeout.
+func within(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(step_timeout); !done(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// median sorts durations and returns the middle one.
+func median(durations []time.Duration) time.Duration {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
+
+func TestEndToEndUnderRuntimeInterfaceEmulator(t *testing.T) {
+	server := eventstest.NewServer(eventstest.Options{TLS: true, APIKey: "e2e"})
+	// Closed after the sandbox, which is cleaned up first
+	t.Cleanup(server.Close)
+	agent := new_agent(server, function_name)
+	server.OnPublish(agent.handle)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.run(ctx)
+
+	s := start_sandbox(t, server)
+	// The emulator starts the extension and the function on the first invoke
+	if response, _ := s.invoke(t, []byte(`{}`)); string(response) != function_response {
+		t.Fatalf("expected the function to answer while no agent is present, got %s", response)
+	}
+	within(t, "the extension to subscribe", func() bool {
+		connections, subscriptions := server.Counts()
+		return connections == 1 && subscriptions >= 2
+	})
+
+	passed_through := make([]time.Duration, 0, *invocations)
+	for i := 0; i < *invocations; i++ {
+		response, elapsed := s.invoke(t, []byte(`{"n":1}`))
+		if string(response) != function_response {
+			t.Fatalf("expected the function to answer while no agent is present, got %s", response)
+		}
+		passed_through = append(passed_through, elapsed)
+	}
+
+	agent.arrive()
+	within(t, "the extension to intercept an invocation", func() bool {
+		response, _ := s.invoke(t, []byte(`{"n":1}`))
+		return string(response) != function_response
+	})
+
+	t.Run("fidelity", func(t *testing.T) {
+		for _, c := range fidelity_cases {
+			answered := agent.answered()
+			response, _ := s.invoke(t, c.event)
+			if agent.answered() != answered+1 {
+				t.Fatalf("%s: expected the agent to answer, got %s", c.name, response)
+			}
+			if event := agent.last_event(); !bytes.Equal(event, c.event) {
+				t.Errorf("%s: the agent was sent a different event\n got: %q\nwant: %q", c.name, event, c.event)
+			}
+			if !bytes.Equal(response, c.event) {
+				t.Errorf("%s: the response differs from the agent's\n got: %q\nwant: %q", c.name, response, c.event)
+			}
+		}
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		intercepted := make([]time.Duration, 0, *invocations)
+		answered := agent.answered()
+		for i := 0; i < *invocations; i++ {
+			_, elapsed := s.invoke(t, []byte(`{"n":1}`))
+			intercepted = append(intercepted, elapsed)
+		}
+		if got := agent.answered() - answered; got != *invocations {
+			t.Fatalf("expected the agent to answer all %d invocations, it answered %d", *invocations, got)
+		}
+		baseline, p50 := median(passed_through), median(intercepted)
+		slowest := intercepted[len(intercepted)-1]
+		t.Logf("passed through p50 %s; intercepted p50 %s, max %s", baseline, p50, slowest)
+		added_p50, added_max := p50-baseline, slowest-baseline
+		if added_p50 > *added_p50_budget {
+			t.Errorf("interception added %s to the median invocation, over the %s budget", added_p50, *added_p50_budget)
+		}
+		if added_max > *added_max_budget {
+			t.Errorf("interception added %s to the slowest invocation, over the %s budget", added_max, *added_max_budget)
+		}
+	})
+}
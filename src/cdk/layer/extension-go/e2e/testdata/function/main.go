@@ -0,0 +1,36 @@
+// Command function is the Lambda function the end-to-end test runs under the
+// Runtime Interface Emulator. It answers every event with function_response,
+// so an invocation the agent did not answer is easy to tell apart.
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const function_response = `{"answered_by":"function"}`
+
+func main() {
+	runtime_api := "http://" + os.Getenv("AWS_LAMBDA_RUNTIME_API") + "/2018-06-01/runtime/invocation/"
+	for {
+		resp, err := http.Get(runtime_api + "next")
+		if err != nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		request_id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		if request_id == "" {
+			continue
+		}
+		result, err := http.Post(runtime_api+request_id+"/response", "application/json", bytes.NewReader([]byte(function_response)))
+		if err == nil {
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Endpoint failover
+//
+// Regional endpoints (see regional.go) only carry the tunnel; everything else
+// depends on the extension's own endpoint. LIVE_LAMBDA_FAILOVER_ENDPOINTS lists
+// standby Events API endpoints, in other regions or other APIs, as
+// region=http_host[|realtime_host] in priority order after the extension's
+// own. When LIVE_LAMBDA_FAILOVER_AFTER (default 3) connects or publishes in a
+// row fail on the active endpoint, the transport switches to the next one,
+// wrapping around after the last. At startup, an endpoint that cannot be
+// connected is skipped at once. The reconnect loop (see reconnect.go) then
+// connects the new endpoint, subscribes again and asks the agent to resend its
+// responses, as after any dropped connection, and publishes an
+// endpoint_failover lifecycle event.
+//
+// The agent follows through the presence channel: probes carry the active
+// endpoint,
+//
+//	{"type": "probe", ..., "endpoint": "<http_host>"}
+//
+// and the agent is treated as absent after a switch, so the extension probes
+// on the new endpoint at once. An agent connected to every endpoint answers
+// with a heartbeat on the one the probe arrived on, and heartbeats there from
+// then on. The extension stays on an endpoint until it fails in turn.
+
+const (
+	default_failover_after       = 3
+	endpoint_failover_event_type = "endpoint_failover"
+)
+
+// parse_failover_endpoints parses LIVE_LAMBDA_FAILOVER_ENDPOINTS, keeping the
+// priority order.
+func parse_failover_endpoints(value string) ([]*regional_endpoint, error) {
+	var endpoints []*regional_endpoint
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		endpoint, err := parse_endpoint(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[endpoint.http_host] {
+			return nil, fmt.Errorf("%s is listed twice", endpoint.http_host)
+		}
+		seen[endpoint.http_host] = true
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// failover_member is one endpoint of a failover_transport.
+type failover_member struct {
+	http_host string // names the endpoint in probes and lifecycle events
+	transport Transport
+	opened    bool // the member was active at some point, so it may need closing
+}
+
+// endpoint_switch is a failover the reconnect loop has not announced yet.
+type endpoint_switch struct {
+	from  string
+	to    string
+	cause error
+}
+
+// failover_transport sends everything through its active member and moves to
+// the next one when the active member keeps failing.
+type failover_transport struct {
+	mu       sync.Mutex
+	members  []*failover_member
+	active   int
+	failures int  // in a row on the active member
+	limit    int  // failures before a switch
+	started  bool // some member has connected, so startup is over
+	switched *endpoint_switch
+}
+
+// new_failover_transport_from_config wraps primary, the transport to the
+// extension's own endpoint, with the standby endpoints. It returns nil when
+// LIVE_LAMBDA_FAILOVER_ENDPOINTS is empty.
+func new_failover_transport_from_config(aws_cfg aws.Config, settings Config, client_id string, primary Transport) (*failover_transport, error) {
+	endpoints, err := parse_failover_endpoints(settings.FailoverEndpoints)
+	if err != nil || len(endpoints) == 0 {
+		return nil, err
+	}
+	t := &failover_transport{
+		members: []*failover_member{{http_host: settings.AppSyncHTTPHost, transport: primary}},
+		limit:   settings.FailoverAfter,
+	}
+	for i, endpoint := range endpoints {
+		standby := settings
+		standby.AppSyncHTTPHost = endpoint.http_host
+		standby.AppSyncRealtimeHost = endpoint.realtime_host
+		standby.AppSyncRegion = endpoint.region
+		transport, err := new_transport_from_config(aws_cfg, standby, fmt.Sprintf("%s-failover-%d", client_id, i+1))
+		if err != nil {
+			return nil, fmt.Errorf("failover endpoint %s: %w", endpoint.http_host, err)
+		}
+		t.members = append(t.members, &failover_member{http_host: endpoint.http_host, transport: transport})
+	}
+	component_logger(component_failover).Info("Failing over to standby endpoints", "endpoints", len(endpoints), "after_failures", t.limit)
+	return t, nil
+}
+
+// as_transport returns t as a Transport, reporting keep-alives when every
+// member does.
+func (t *failover_transport) as_transport() Transport {
+	for _, member := range t.members {
+		if _, ok := member.transport.(keep_alive_reporter); !ok {
+			return t
+		}
+	}
+	return reporting_failover_transport{t}
+}
+
+func (t *failover_transport) current() (int, Transport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.members[t.active].opened = true
+	return t.active, t.members[t.active].transport
+}
+
+// succeeded resets the failure count when index is still the active member.
+func (t *failover_transport) succeeded(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index == t.active {
+		t.failures = 0
+		t.started = true
+	}
+}
+
+// failed counts a failure of member index and switches to the next member
+// once the active one has failed limit times in a row, or at once during
+// startup. It reports whether it switched.
+func (t *failover_transport) failed(index int, cause error) bool {
+	t.mu.Lock()
+	if index != t.active {
+		t.mu.Unlock()
+		return false
+	}
+	t.failures++
+	if t.started && t.failures < t.limit {
+		t.mu.Unlock()
+		return false
+	}
+	from := t.members[t.active]
+	t.active = (t.active + 1) % len(t.members)
+	t.failures = 0
+	to := t.members[t.active]
+	t.switched = &endpoint_switch{from: from.http_host, to: to.http_host, cause: cause}
+	t.mu.Unlock()
+
+	component_logger(component_failover).Warn("Endpoint failed, switching", "from", from.http_host, "to", to.http_host, "error", cause)
+	// Its subscriptions are made again on the new endpoint
+	go from.transport.Close()
+	return true
+}
+
+// Connect connects the active member. During startup it moves on through the
+// members until one connects.
+func (t *failover_transport) Connect(ctx context.Context) error {
+	var err error
+	for range t.members {
+		index, transport := t.current()
+		if err = transport.Connect(ctx); err == nil {
+			t.succeeded(index)
+			return nil
+		}
+		if ctx.Err() != nil || !t.failed(index, err) {
+			return err
+		}
+		t.mu.Lock()
+		started := t.started
+		t.mu.Unlock()
+		if started {
+			// The reconnect loop connects the next member
+			return err
+		}
+	}
+	return err
+}
+
+func (t *failover_transport) IsConnected() bool {
+	_, transport := t.current()
+	return transport.IsConnected()
+}
+
+func (t *failover_transport) Publish(ctx context.Context, channel string, events []interface{}) error {
+	index, transport := t.current()
+	err := transport.Publish(ctx, channel, events)
+	switch {
+	case err == nil:
+		t.succeeded(index)
+	case ctx.Err() == nil:
+		t.failed(index, err)
+	}
+	return err
+}
+
+func (t *failover_transport) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error) {
+	_, transport := t.current()
+	return transport.Subscribe(ctx, channel, on_data)
+}
+
+// Close closes every member that was ever active.
+func (t *failover_transport) Close() error {
+	t.mu.Lock()
+	var opened []Transport
+	for _, member := range t.members {
+		if member.opened {
+			opened = append(opened, member.transport)
+		}
+	}
+	t.mu.Unlock()
+	var first error
+	for _, transport := range opened {
+		if err := transport.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// active_endpoint returns the HTTP host of the active member, or "" for a nil
+// transport.
+func (t *failover_transport) active_endpoint() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.members[t.active].http_host
+}
+
+// take_switch returns the last switch and forgets it, or nil when there was
+// none since the last call.
+func (t *failover_transport) take_switch() *endpoint_switch {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switched := t.switched
+	t.switched = nil
+	return switched
+}
+
+// reporting_failover_transport is a failover_transport whose members all see
+// the server's keep-alives; the connection check judges the active one.
+type reporting_failover_transport struct {
+	*failover_transport
+}
+
+func (t reporting_failover_transport) keep_alive() (time.Time, time.Duration) {
+	_, transport := t.current()
+	return transport.(keep_alive_reporter).keep_alive()
+}
+
+// announce_endpoint_switch runs once the transport has connected again. After
+// a failover it tells the lifecycle channel and probes for the agent on the
+// new endpoint, which it no longer counts as present.
+func (p *RuntimeAPIProxy) announce_endpoint_switch(ctx context.Context) {
+	switched := p.failover.take_switch()
+	if switched == nil {
+		return
+	}
+	component_logger(component_failover).Info("Now connected through the standby endpoint", "endpoint", switched.to)
+	p.presence.mark_absent(p.presence.agent())
+	// A probe sent on the old endpoint does not hold back the first on the new one
+	p.presence.forget_probe()
+	p.probe_presence()
+	data := map[string]interface{}{
+		"endpoint":          switched.to,
+		"previous_endpoint": switched.from,
+	}
+	if switched.cause != nil {
+		data["reason"] = switched.cause.Error()
+	}
+	if err := p.publish_lifecycle_event(ctx, endpoint_failover_event_type, data); err != nil {
+		component_logger(component_failover).Warn("Error publishing the failover event", "type", endpoint_failover_event_type, "error", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// new_events_failover builds the failover transport the extension's config
+// selects, with servers[0] as its own endpoint and the rest as standbys, in
+// order. limit is LIVE_LAMBDA_FAILOVER_AFTER.
+func new_events_failover(t *testing.T, limit int, servers ...*eventstest.Server) *failover_transport {
+	t.Helper()
+	settings := default_config()
+	settings.AppSyncHTTPHost = servers[0].Host()
+	settings.AppSyncRealtimeHost = servers[0].Host()
+	settings.AppSyncRegion = "us-east-1"
+	settings.FailoverAfter = limit
+	var standbys []string
+	for _, server := range servers[1:] {
+		standbys = append(standbys, events_endpoint("us-west-2", server))
+	}
+	settings.FailoverEndpoints = strings.Join(standbys, ",")
+	primary, err := new_transport_from_config(events_aws_config(), settings, "sandbox-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failover, err := new_failover_transport_from_config(events_aws_config(), settings, "sandbox-1", primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { failover.Close() })
+	return failover
+}
+
+func TestParseFailoverEndpoints(t *testing.T) {
+	endpoints, err := parse_failover_endpoints("us-west-2=b.appsync-api.us-west-2.amazonaws.com, us-east-1=c.example.com|c-rt.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 || endpoints[0].region != "us-west-2" || endpoints[0].realtime_host != "b.appsync-realtime-api.us-west-2.amazonaws.com" || endpoints[1].realtime_host != "c-rt.example.com" {
+		t.Fatalf("unexpected endpoints %+v %+v", endpoints[0], endpoints[1])
+	}
+	// Two APIs in one region are fine; the same API twice is not
+	if _, err := parse_failover_endpoints("us-east-1=a.appsync-api.us-east-1.amazonaws.com,us-east-1=b.appsync-api.us-east-1.amazonaws.com"); err != nil {
+		t.Fatalf("expected two APIs in one region to be accepted: %v", err)
+	}
+	if _, err := parse_failover_endpoints("us-east-1=a.appsync-api.us-east-1.amazonaws.com,eu-west-1=a.appsync-api.us-east-1.amazonaws.com"); err == nil {
+		t.Fatal("expected the same endpoint twice to be rejected")
+	}
+}
+
+func TestFailoverTransportSwitchesAfterFailuresInARow(t *testing.T) {
+	primary, standby := new_events_server(t), new_events_server(t)
+	failover := new_events_failover(t, 3, primary, standby)
+	ctx := context.Background()
+	if err := failover.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.RejectPublishes("outage")
+	failover.Publish(ctx, "live-lambda/requests", []interface{}{"a"})
+	failover.Publish(ctx, "live-lambda/requests", []interface{}{"b"})
+	primary.RejectPublishes("")
+	failover.Publish(ctx, "live-lambda/requests", []interface{}{"c"})
+	primary.RejectPublishes("outage")
+	failover.Publish(ctx, "live-lambda/requests", []interface{}{"d"})
+	failover.Publish(ctx, "live-lambda/requests", []interface{}{"e"})
+	if failover.active_endpoint() != primary.Host() {
+		t.Fatal("expected a success to reset the failure count")
+	}
+
+	failover.Publish(ctx, "live-lambda/requests", []interface{}{"f"})
+	if failover.active_endpoint() != standby.Host() {
+		t.Fatalf("expected a switch after three failures in a row, active %s", failover.active_endpoint())
+	}
+	if failover.IsConnected() {
+		t.Fatal("expected the standby to wait for the reconnect loop")
+	}
+	switched := failover.take_switch()
+	if switched == nil || switched.from != primary.Host() || switched.to != standby.Host() || switched.cause == nil {
+		t.Fatalf("unexpected switch %+v", switched)
+	}
+	if failover.take_switch() != nil {
+		t.Fatal("expected the switch to be reported once")
+	}
+	if err := failover.Connect(ctx); err != nil || !failover.IsConnected() {
+		t.Fatalf("expected the standby to connect, got %v", err)
+	}
+	if connections, _ := standby.Counts(); connections != 1 {
+		t.Fatalf("expected one connection to the standby, got %d", connections)
+	}
+}
+
+func TestFailoverTransportSkipsUnreachableEndpointsAtStartup(t *testing.T) {
+	primary, standby, third := new_events_server(t), new_events_server(t), new_events_server(t)
+	primary.SetUnavailable("outage")
+	standby.SetUnavailable("outage")
+	failover := new_events_failover(t, 3, primary, standby, third)
+
+	if err := failover.Connect(context.Background()); err != nil {
+		t.Fatalf("expected the third endpoint to connect, got %v", err)
+	}
+	if connections, _ := third.Counts(); failover.active_endpoint() != third.Host() || connections != 1 {
+		t.Fatalf("expected the third endpoint to be active, got %s", failover.active_endpoint())
+	}
+
+	// Once started, a connect failure only counts towards the limit
+	third.SetUnavailable("outage")
+	for wait := time.Now().Add(5 * time.Second); failover.IsConnected(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(wait) {
+			t.Fatal("timed out waiting for the connection to end")
+		}
+	}
+	if err := failover.Connect(context.Background()); err == nil {
+		t.Fatal("expected the connect to fail")
+	}
+	if failover.active_endpoint() != third.Host() {
+		t.Fatalf("expected no switch after one failure, got %s", failover.active_endpoint())
+	}
+}
+
+func TestReconnectAnnouncesAnEndpointSwitch(t *testing.T) {
+	primary, standby := new_events_server(t), new_events_server(t)
+	proxy := new_events_proxy(t, primary, func(settings *Config) {
+		settings.FailoverEndpoints = events_endpoint("us-west-2", standby)
+		settings.FailoverAfter = 1
+	})
+	publish_heartbeat(primary, "orders")
+	wait_for_agent(t, proxy)
+
+	// The connection watch connects the standby after the switch
+	primary.RejectPublishes("outage")
+	proxy.transport.Publish(proxy.ctx, proxy.requests_topic(), []interface{}{"request"})
+
+	probe := wait_for_published(t, standby, proxy.presence_topic(), of_type(presence_probe_type))[0]
+	if probe["endpoint"] != standby.Host() {
+		t.Fatalf("expected a probe naming the new endpoint, got %v", probe)
+	}
+	failed_over := wait_for_lifecycle_event(t, standby, proxy, endpoint_failover_event_type)
+	if failed_over["endpoint"] != standby.Host() || failed_over["previous_endpoint"] != primary.Host() {
+		t.Fatalf("expected an endpoint_failover event, got %v", failed_over)
+	}
+	if proxy.presence.present() {
+		t.Fatal("expected the agent to be treated as absent on the new endpoint")
+	}
+}
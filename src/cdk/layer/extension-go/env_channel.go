@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Environment channel
+//
+// With LIVE_LAMBDA_ENV_CHANNEL=on, each sandbox publishes its environment once,
+// on the first invocation it sees while connected, to env/{function}:
+//
+//	{"type": "env_snapshot", "sandbox_id": "...", "function_name": "...", "timestamp": "...",
+//	 "variables": {"TABLE_NAME": "orders", "DB_PASSWORD": "redacted:sha256:...", ...}, "redacted": ["DB_PASSWORD"]}
+//
+// Unlike the lifecycle env_snapshot, which only carries the allowlisted
+// variables, it has every variable the function sees, so the agent can give the
+// developer's handler the same environment. Variables matching the built-in
+// denylist or LIVE_LAMBDA_ENV_REDACT keep their name, with a hash in place of
+// their value (redaction.go).
+// Variables that only make sense inside the sandbox are left out.
+
+const (
+	env_channel_publish_timeout = 5 * time.Second
+)
+
+// sandbox_only_env are the variables an env channel snapshot leaves out: paths
+// into the sandbox, the Runtime API address and live-lambda's own settings.
+var sandbox_only_env = []string{
+	"PATH",
+	"LD_LIBRARY_PATH",
+	"HOME",
+	"PWD",
+	"SHLVL",
+	"_",
+	"_HANDLER",
+	"LAMBDA_TASK_ROOT",
+	"LAMBDA_RUNTIME_DIR",
+	"AWS_LAMBDA_RUNTIME_API",
+	"AWS_LAMBDA_EXEC_WRAPPER",
+	"LIVE_LAMBDA_*",
+	"LRAP_*",
+}
+
+type env_channel struct {
+	published atomic.Bool
+	// publishing is held while a snapshot is in flight
+	publishing atomic.Bool
+}
+
+// new_env_channel_from_config returns nil unless LIVE_LAMBDA_ENV_CHANNEL=on.
+func new_env_channel_from_config(settings Config) *env_channel {
+	if !settings.EnvChannel {
+		return nil
+	}
+	return &env_channel{}
+}
+
+// snapshot returns the variables in environ (KEY=value entries) to publish,
+// redacted by r, and, sorted, the names of those redacted.
+func (c *env_channel) snapshot(environ []string, r *redactor) (map[string]string, []string) {
+	variables := map[string]string{}
+	var redacted []string
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || matches_env_pattern(sandbox_only_env, name) {
+			continue
+		}
+		value, was_redacted := r.env_value(name, value)
+		if was_redacted {
+			redacted = append(redacted, name)
+		}
+		variables[name] = value
+	}
+	sort.Strings(redacted)
+	return variables, redacted
+}
+
+// env_topic returns the channel the function's environment is published on.
+func (p *RuntimeAPIProxy) env_topic() string {
+	return p.channel("env/%s", p.function_name)
+}
+
+// publish_env_channel publishes the sandbox's environment in the background,
+// unless it already has been or is being published. A failed publish is
+// retried on the next invocation.
+func (p *RuntimeAPIProxy) publish_env_channel() {
+	c := p.env_channel
+	if c == nil || c.published.Load() || !c.publishing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.publishing.Store(false)
+		variables, redacted := c.snapshot(os.Environ(), p.redactor)
+		snapshot := protocol.EnvSnapshot{
+			Type:         protocol.TypeEnvSnapshot,
+			SandboxID:    p.sandbox_id,
+			FunctionName: p.function_name,
+			Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+			Variables:    variables,
+			Redacted:     redacted,
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, env_channel_publish_timeout)
+		defer cancel()
+		topic := p.env_topic()
+		if err := p.transport.Publish(ctx, topic, []interface{}{snapshot}); err != nil {
+			component_logger(component_env_channel).Warn("Error publishing the environment", "topic", topic, "error", err)
+			return
+		}
+		c.published.Store(true)
+		component_logger(component_env_channel).Info("Published the environment", "topic", topic, "variables", len(variables), "redacted", len(redacted))
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestEnvChannelSnapshotRedactsAndDropsSandboxVariables(t *testing.T) {
+	settings := default_config()
+	settings.EnvChannel = true
+	settings.EnvRedact = "stripe_*"
+	c := new_env_channel_from_config(settings)
+	environ := []string{
+		"TABLE_NAME=orders",
+		"AWS_LAMBDA_FUNCTION_NAME=orders",
+		"DB_PASSWORD=hunter2",
+		"STRIPE_KEY=sk_live",
+		"AWS_SESSION_TOKEN=token",
+		"PATH=/var/lang/bin:/usr/bin",
+		"AWS_LAMBDA_RUNTIME_API=127.0.0.1:9009",
+		"LIVE_LAMBDA_APPSYNC_HTTP_HOST=api.example.com",
+		"EMPTY=",
+	}
+
+	variables, redacted := c.snapshot(environ, new_redactor_from_config(settings, environ))
+	if variables["TABLE_NAME"] != "orders" || variables["AWS_LAMBDA_FUNCTION_NAME"] != "orders" || variables["EMPTY"] != "" {
+		t.Fatalf("expected the function's variables, got %v", variables)
+	}
+	for name, value := range map[string]string{"DB_PASSWORD": "hunter2", "STRIPE_KEY": "sk_live", "AWS_SESSION_TOKEN": "token"} {
+		if variables[name] != protocol.Redact(value) {
+			t.Errorf("expected %s to be redacted, got %q", name, variables[name])
+		}
+	}
+	if strings.Join(redacted, ",") != "AWS_SESSION_TOKEN,DB_PASSWORD,STRIPE_KEY" {
+		t.Fatalf("unexpected redacted names %v", redacted)
+	}
+	for _, name := range []string{"PATH", "AWS_LAMBDA_RUNTIME_API", "LIVE_LAMBDA_APPSYNC_HTTP_HOST"} {
+		if _, ok := variables[name]; ok {
+			t.Errorf("expected %s to be left out", name)
+		}
+	}
+
+	if new_env_channel_from_config(default_config()) != nil {
+		t.Fatal("expected the env channel to be off by default")
+	}
+}
+
+func TestPublishEnvChannelPublishesOncePerSandbox(t *testing.T) {
+	settings := default_config()
+	settings.EnvChannel = true
+	transport := &fake_transport{}
+	p := &RuntimeAPIProxy{
+		ctx:           context.Background(),
+		transport:     transport,
+		function_name: "orders",
+		env_channel:   new_env_channel_from_config(settings),
+	}
+
+	p.publish_env_channel()
+	deadline := time.Now().Add(time.Second)
+	for !p.env_channel.published.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.publish_env_channel()
+	if strings.Join(transport.published, ",") != "live-lambda/env/orders" {
+		t.Fatalf("expected one snapshot on the env channel, got %v", transport.published)
+	}
+
+	(&RuntimeAPIProxy{transport: transport}).publish_env_channel()
+	if len(transport.published) != 1 {
+		t.Fatalf("expected nothing published without %s, got %v", live_lambda_env_channel_env, transport.published)
+	}
+}
+
+func TestEnvChannelNeedsPlaintextEnvironment(t *testing.T) {
+	settings := default_config()
+	settings.EnvChannel = true
+	settings.EnvEncryption = env_encryption_required
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), live_lambda_env_channel_env) {
+		t.Fatalf("expected %s to be rejected with encryption required, got %v", live_lambda_env_channel_env, err)
+	}
+}
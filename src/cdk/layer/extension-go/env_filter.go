@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Environment variables only leave the sandbox through env_filter. A variable is
+// published when it matches the allowlist and no denylist pattern; the denylist
+// always includes secret-like patterns, so a broad allowlist cannot leak
+// credentials by accident. Patterns are case-insensitive globs.
+
+var default_env_allowlist = []string{
+	"AWS_LAMBDA_*",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+	"AWS_EXECUTION_ENV",
+}
+
+var default_env_denylist = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN",
+	"*SECRET*",
+	"*TOKEN*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*PRIVATE*",
+	"*CREDENTIAL*",
+	"*API_KEY*",
+	"*APIKEY*",
+	"*ACCESS_KEY*",
+	"*AUTH*",
+}
+
+type env_filter struct {
+	allow []string
+	deny  []string
+}
+
+// new_env_filter builds a filter from comma-separated pattern lists. An empty
+// allow value keeps the default allowlist; deny patterns are added to the defaults.
+func new_env_filter(allow string, deny string) *env_filter {
+	filter := &env_filter{
+		allow: split_env_patterns(allow),
+		deny:  append(append([]string{}, default_env_denylist...), split_env_patterns(deny)...),
+	}
+	if len(filter.allow) == 0 {
+		filter.allow = append([]string{}, default_env_allowlist...)
+	}
+	return filter
+}
+
+func split_env_patterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, strings.ToUpper(pattern))
+		}
+	}
+	return patterns
+}
+
+func matches_env_pattern(patterns []string, name string) bool {
+	upper := strings.ToUpper(name)
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, upper); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the variable may be published.
+func (f *env_filter) allowed(name string) bool {
+	return matches_env_pattern(f.allow, name) && !matches_env_pattern(f.deny, name)
+}
+
+// snapshot returns every allowed variable in environ (KEY=value entries).
+func (f *env_filter) snapshot(environ []string) map[string]string {
+	snapshot := map[string]string{}
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || !f.allowed(name) {
+			continue
+		}
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// add_context_env copies the allowed context fields into context_data.
+func (f *env_filter) add_context_env(context_data *protocol.Context, getenv func(string) string) {
+	// The published context fields and the variables they come from
+	fields := map[string]*string{
+		"AWS_LAMBDA_FUNCTION_NAME":        &context_data.FunctionName,
+		"AWS_LAMBDA_FUNCTION_VERSION":     &context_data.FunctionVersion,
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": &context_data.MemorySizeMB,
+		"AWS_LAMBDA_LOG_GROUP_NAME":       &context_data.LogGroupName,
+		"AWS_LAMBDA_LOG_STREAM_NAME":      &context_data.LogStreamName,
+		"AWS_REGION":                      &context_data.AWSRegion,
+	}
+	for name, field := range fields {
+		if f.allowed(name) {
+			*field = getenv(name)
+		}
+	}
+}
+
+// publish_env_snapshot reports the allowed part of the sandbox environment to
+// the agent, unless it may only be sent sealed to an agent's key.
+func (p *RuntimeAPIProxy) publish_env_snapshot(ctx context.Context) {
+	if strings.EqualFold(p.config.EnvEncryption, env_encryption_required) {
+		log.Printf("%s Environment is only sent encrypted to agents that announce a public key", env_handoff_print_prefix)
+		return
+	}
+	data := map[string]interface{}{}
+	for name, value := range p.env_filter.snapshot(os.Environ()) {
+		data[name] = value
+	}
+	publish_ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_ = p.publish_lifecycle_event(publish_ctx, "env_snapshot", data)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestEnvFilterDefaults(t *testing.T) {
+	filter := new_env_filter("", "")
+	cases := map[string]bool{
+		"AWS_LAMBDA_FUNCTION_NAME": true,
+		"AWS_REGION":               true,
+		"AWS_SECRET_ACCESS_KEY":    false,
+		"AWS_SESSION_TOKEN":        false,
+		"AWS_ACCESS_KEY_ID":        false,
+		"DATABASE_URL":             false,
+	}
+	for name, want := range cases {
+		if got := filter.allowed(name); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEnvFilterDenylistWinsOverAllowlist(t *testing.T) {
+	filter := new_env_filter("*", "internal_*")
+	cases := map[string]bool{
+		"STAGE":             true,
+		"STRIPE_SECRET":     false,
+		"github_token":      false,
+		"DB_PASSWORD":       false,
+		"SERVICE_API_KEY":   false,
+		"INTERNAL_ENDPOINT": false,
+	}
+	for name, want := range cases {
+		if got := filter.allowed(name); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEnvFilterSnapshot(t *testing.T) {
+	filter := new_env_filter("STAGE, AWS_*", "")
+	snapshot := filter.snapshot([]string{
+		"STAGE=dev",
+		"AWS_REGION=us-east-1",
+		"AWS_SESSION_TOKEN=abc",
+		"OTHER=x",
+		"MALFORMED",
+	})
+	want := map[string]string{"STAGE": "dev", "AWS_REGION": "us-east-1"}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("snapshot = %v, want %v", snapshot, want)
+	}
+}
+
+func TestEnvFilterContextFields(t *testing.T) {
+	env := map[string]string{"AWS_LAMBDA_FUNCTION_NAME": "fn", "AWS_REGION": "eu-west-1"}
+	getenv := func(name string) string { return env[name] }
+
+	context_data := protocol.Context{}
+	new_env_filter("AWS_LAMBDA_*", "").add_context_env(&context_data, getenv)
+	if context_data.FunctionName != "fn" {
+		t.Fatalf("function_name = %v", context_data.FunctionName)
+	}
+	if context_data.AWSRegion != "" {
+		t.Fatal("aws_region should be excluded by the allowlist")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Encrypted environment hand-off
+//
+// An agent may include an X25519 public key in its heartbeats (public_key,
+// base64url without padding). The extension then sends that agent its own
+// env_snapshot, sealed to the key, so neither the transport nor other
+// subscribers of the lifecycle channel can read it. Sealing uses a fresh
+// ephemeral key per snapshot: the shared secret goes through HKDF-SHA256 to an
+// AES-256-GCM key, with the agent ID as additional data so a snapshot cannot be
+// replayed to another agent.
+//
+// With LIVE_LAMBDA_ENV_ENCRYPTION=required the plaintext snapshot is never
+// published. LIVE_LAMBDA_SHARE_CREDENTIALS=on adds the function's AWS
+// credentials to sealed snapshots; they are never sent in plaintext.
+
+const (
+	env_handoff_print_prefix    = "[LiveLambdaExt:EnvHandoff]"
+	env_seal_algorithm          = "X25519-HKDF-SHA256-A256GCM"
+	env_seal_info               = "live-lambda env snapshot v1"
+	env_encryption_auto         = "auto"
+	env_encryption_required     = "required"
+	env_handoff_publish_timeout = 5 * time.Second
+)
+
+// shared_credential_env are the variables LIVE_LAMBDA_SHARE_CREDENTIALS adds to sealed snapshots.
+var shared_credential_env = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+}
+
+var env_key_encoding = base64.RawURLEncoding
+
+// sealed_payload is a payload only the holder of the recipient's private key can open.
+type sealed_payload struct {
+	Algorithm    string `json:"alg"`
+	EphemeralKey string `json:"epk"`
+	Nonce        string `json:"nonce"`
+	Ciphertext   string `json:"ciphertext"`
+}
+
+// seal_to_agent encrypts plaintext to the agent's X25519 public key.
+func seal_to_agent(public_key string, agent_id string, plaintext []byte) (sealed_payload, error) {
+	raw_key, err := env_key_encoding.DecodeString(public_key)
+	if err != nil {
+		return sealed_payload{}, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw_key)
+	if err != nil {
+		return sealed_payload{}, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return sealed_payload{}, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return sealed_payload{}, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+	key, err := hkdf.Key(sha256.New, secret, nil, env_seal_info, 32)
+	if err != nil {
+		return sealed_payload{}, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return sealed_payload{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return sealed_payload{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return sealed_payload{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return sealed_payload{
+		Algorithm:    env_seal_algorithm,
+		EphemeralKey: env_key_encoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		Nonce:        env_key_encoding.EncodeToString(nonce),
+		Ciphertext:   env_key_encoding.EncodeToString(aead.Seal(nil, nonce, plaintext, []byte(agent_id))),
+	}, nil
+}
+
+// sealed_env_snapshot returns the allowed environment, plus the function's
+// credentials when share_credentials is set.
+func (f *env_filter) sealed_env_snapshot(environ []string, share_credentials bool) map[string]string {
+	snapshot := f.snapshot(environ)
+	if !share_credentials {
+		return snapshot
+	}
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		for _, shared := range shared_credential_env {
+			if name == shared {
+				snapshot[name] = value
+			}
+		}
+	}
+	return snapshot
+}
+
+// send_sealed_env_snapshot publishes an env_snapshot only agent_id can read.
+func (p *RuntimeAPIProxy) send_sealed_env_snapshot(agent_id string, public_key string) {
+	plaintext, err := json.Marshal(p.env_filter.sealed_env_snapshot(os.Environ(), p.config.ShareCredentials))
+	if err != nil {
+		log.Printf("%s Error encoding environment for agent %s: %v", env_handoff_print_prefix, agent_id, err)
+		return
+	}
+	sealed, err := seal_to_agent(public_key, agent_id, plaintext)
+	if err != nil {
+		log.Printf("%s Not sending environment to agent %s: %v", env_handoff_print_prefix, agent_id, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, env_handoff_publish_timeout)
+	defer cancel()
+	if err := p.publish_lifecycle_event(ctx, "env_snapshot", map[string]interface{}{
+		"agent_id":  agent_id,
+		"encrypted": sealed,
+	}); err == nil {
+		log.Printf("%s Sent encrypted environment to agent %s", env_handoff_print_prefix, agent_id)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// open_sealed mirrors what the agent does with a sealed snapshot.
+func open_sealed(t *testing.T, private_key *ecdh.PrivateKey, agent_id string, sealed sealed_payload) ([]byte, error) {
+	t.Helper()
+	raw_epk, err := env_key_encoding.DecodeString(sealed.EphemeralKey)
+	if err != nil {
+		t.Fatalf("decode epk: %v", err)
+	}
+	epk, err := ecdh.X25519().NewPublicKey(raw_epk)
+	if err != nil {
+		t.Fatalf("parse epk: %v", err)
+	}
+	secret, err := private_key.ECDH(epk)
+	if err != nil {
+		t.Fatalf("ecdh: %v", err)
+	}
+	key, err := hkdf.Key(sha256.New, secret, nil, env_seal_info, 32)
+	if err != nil {
+		t.Fatalf("hkdf: %v", err)
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce, _ := env_key_encoding.DecodeString(sealed.Nonce)
+	ciphertext, _ := env_key_encoding.DecodeString(sealed.Ciphertext)
+	return aead.Open(nil, nonce, ciphertext, []byte(agent_id))
+}
+
+func TestSealToAgentRoundTrip(t *testing.T) {
+	private_key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	public_key := env_key_encoding.EncodeToString(private_key.PublicKey().Bytes())
+
+	sealed, err := seal_to_agent(public_key, "agent-1", []byte(`{"AWS_REGION":"us-east-1"}`))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if sealed.Algorithm != env_seal_algorithm {
+		t.Fatalf("unexpected algorithm %q", sealed.Algorithm)
+	}
+
+	plaintext, err := open_sealed(t, private_key, "agent-1", sealed)
+	if err != nil || string(plaintext) != `{"AWS_REGION":"us-east-1"}` {
+		t.Fatalf("unexpected plaintext %q, %v", plaintext, err)
+	}
+	if _, err := open_sealed(t, private_key, "agent-2", sealed); err == nil {
+		t.Fatal("expected a snapshot sealed for one agent not to open for another")
+	}
+}
+
+func TestSealToAgentRejectsBadKeys(t *testing.T) {
+	for _, key := range []string{"not base64!", env_key_encoding.EncodeToString([]byte("short"))} {
+		if _, err := seal_to_agent(key, "agent-1", []byte("{}")); err == nil {
+			t.Fatalf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestSealedEnvSnapshotOnlySharesCredentialsWhenAsked(t *testing.T) {
+	filter := new_env_filter("", "")
+	environ := []string{"AWS_REGION=us-east-1", "AWS_ACCESS_KEY_ID=AKIA", "AWS_SECRET_ACCESS_KEY=secret", "AWS_SESSION_TOKEN=token", "DB_PASSWORD=hunter2"}
+
+	snapshot := filter.sealed_env_snapshot(environ, false)
+	if _, ok := snapshot["AWS_ACCESS_KEY_ID"]; ok || snapshot["AWS_REGION"] != "us-east-1" {
+		t.Fatalf("unexpected snapshot without shared credentials %v", snapshot)
+	}
+
+	snapshot = filter.sealed_env_snapshot(environ, true)
+	if snapshot["AWS_ACCESS_KEY_ID"] != "AKIA" || snapshot["AWS_SECRET_ACCESS_KEY"] != "secret" || snapshot["AWS_SESSION_TOKEN"] != "token" {
+		t.Fatalf("expected the credentials to be shared, got %v", snapshot)
+	}
+	if _, ok := snapshot["DB_PASSWORD"]; ok {
+		t.Fatal("expected other denied variables to stay out")
+	}
+}
+
+func TestPresenceTrackerReportsNewPublicKeys(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := new_presence_tracker(15 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	change := tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1","public_key":"k1"}`))
+	if change.public_key != "k1" {
+		t.Fatalf("expected the first heartbeat to hand off the environment, got %+v", change)
+	}
+	if change := tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1","public_key":"k1"}`)); change.public_key != "" {
+		t.Fatalf("expected the same key not to hand off again, got %+v", change)
+	}
+	if change := tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1","public_key":"k2"}`)); change.public_key != "k2" {
+		t.Fatalf("expected a new key to hand off again, got %+v", change)
+	}
+
+	// An agent that comes back after its TTL gets the environment again
+	now = now.Add(time.Minute)
+	if change := tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1","public_key":"k2"}`)); change.public_key != "k2" {
+		t.Fatalf("expected a returning agent to get the environment again, got %+v", change)
+	}
+}
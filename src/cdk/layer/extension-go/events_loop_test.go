@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// The tests here run invocations through the proxy and a real Events
+// WebSocket connection to eventstest, instead of an in-memory transport. The
+// helpers are shared by every test that checks what the proxy publishes or
+// subscribes to.
+
+// fake_runtime_api serves one invocation on /next and records the response
+// posted for it.
+func fake_runtime_api(t *testing.T, request_id string, event string) <-chan posted_response {
+	t.Helper()
+	posted := make(chan posted_response, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/invocation/next") {
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", request_id)
+			w.Header().Set("Lambda-Runtime-Deadline-Ms", strconv.FormatInt(time.Now().Add(10*time.Second).UnixMilli(), 10))
+			w.Header().Set("Lambda-Runtime-Invoked-Function-Arn", "arn:aws:lambda:us-east-1:123456789012:function:orders")
+			w.Write([]byte(event))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		posted <- posted_response{path: r.URL.Path, body: string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := aws_lambda_runtime_api
+	aws_lambda_runtime_api = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { aws_lambda_runtime_api = previous })
+	return posted
+}
+
+// events_agent answers every request published on the requests channel with
+// its event, and every presence probe with a heartbeat.
+func events_agent(server *eventstest.Server, function_name string) {
+	heartbeat := func() {
+		publish_heartbeat(server, function_name, capability_response_envelope, capability_error_frames)
+	}
+	server.OnPublish(func(channel string, event json.RawMessage) {
+		var frame struct {
+			Type         string          `json:"type"`
+			RequestID    string          `json:"request_id"`
+			EventPayload json.RawMessage `json:"event_payload"`
+		}
+		if json.Unmarshal(event, &frame) != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(channel, "live-lambda/presence/") && frame.Type == presence_probe_type:
+			go heartbeat()
+		case channel == "live-lambda/requests" && frame.Type == "":
+			envelope := map[string]interface{}{"type": response_envelope_type, "protocol_version": 2, "body": frame.EventPayload}
+			go server.Publish("live-lambda/response/"+frame.RequestID, envelope)
+		}
+	})
+	heartbeat()
+}
+
+// publish_heartbeat announces agent-1 on the presence channel of function_name
+// with capabilities, as a running agent does.
+func publish_heartbeat(server *eventstest.Server, function_name string, capabilities ...string) {
+	server.Publish("live-lambda/presence/"+function_name, map[string]interface{}{
+		"type":                 presence_heartbeat_type,
+		"agent_id":             "agent-1",
+		"ttl_ms":               15000,
+		"protocol_version":     current_protocol_version,
+		"min_protocol_version": 1,
+		"capabilities":         capabilities,
+	})
+}
+
+// new_events_server starts an eventstest server that the extension's default
+// transport, IAM-signed over wss://, can dial, and stops it with the test.
+func new_events_server(t *testing.T) *eventstest.Server {
+	t.Helper()
+	server := eventstest.NewServer(eventstest.Options{TLS: true})
+	t.Cleanup(server.Close)
+	// The AppSync client dials with http.DefaultClient
+	roots := x509.NewCertPool()
+	previous := http.DefaultClient
+	if transport, ok := previous.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil && transport.TLSClientConfig.RootCAs != nil {
+		roots = transport.TLSClientConfig.RootCAs.Clone()
+	}
+	roots.AddCert(server.Certificate())
+	http.DefaultClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	t.Cleanup(func() { http.DefaultClient = previous })
+	return server
+}
+
+// events_aws_config signs with static credentials, which eventstest accepts.
+func events_aws_config() aws.Config {
+	return aws.Config{Region: "us-east-1", Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")}
+}
+
+// events_endpoint is server as a LIVE_LAMBDA_REGIONAL_ENDPOINTS or
+// LIVE_LAMBDA_FAILOVER_ENDPOINTS entry for region.
+func events_endpoint(region string, server *eventstest.Server) string {
+	return region + "=" + server.Host() + "|" + server.Host()
+}
+
+// build_events_proxy builds a proxy for the orders function the way the
+// extension does, with the transport its config selects pointed at server.
+// configure adjusts the settings first. The proxy is not connected yet.
+func build_events_proxy(t *testing.T, server *eventstest.Server, configure ...func(settings *Config)) *RuntimeAPIProxy {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	settings := default_config()
+	settings.FunctionName = "orders"
+	for _, apply := range configure {
+		apply(&settings)
+	}
+	proxy, err := NewRuntimeAPIProxy(ctx, "127.0.0.1:9001", server.Host(), server.Host(), "us-east-1", "9009",
+		WithConfig(settings), WithAWSConfig(events_aws_config()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// connect_events_proxy runs the proxy's connection loop, and waits for its
+// control and presence subscriptions on server.
+func connect_events_proxy(t *testing.T, proxy *RuntimeAPIProxy, server *eventstest.Server) {
+	t.Helper()
+	go proxy.manage_web_socket_connection(proxy.ctx)
+	for wait := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, subscriptions := server.Counts(); subscriptions >= 2 && proxy.transport.IsConnected() {
+			return
+		}
+		if time.Now().After(wait) {
+			t.Fatal("timed out waiting for the proxy to subscribe")
+		}
+	}
+}
+
+// wait_for_subscriptions waits until server has one connection with
+// subscriptions subscriptions, as after a reconnect has restored them.
+func wait_for_subscriptions(t *testing.T, server *eventstest.Server, subscriptions int) {
+	t.Helper()
+	for wait := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		connections, subscribed := server.Counts()
+		if connections == 1 && subscribed == subscriptions {
+			return
+		}
+		if time.Now().After(wait) {
+			t.Fatalf("timed out waiting for %d subscriptions, got %d connections and %d subscriptions", subscriptions, connections, subscribed)
+		}
+	}
+}
+
+// new_events_proxy builds a proxy and connects it to server.
+func new_events_proxy(t *testing.T, server *eventstest.Server, configure ...func(settings *Config)) *RuntimeAPIProxy {
+	t.Helper()
+	proxy := build_events_proxy(t, server, configure...)
+	connect_events_proxy(t, proxy, server)
+	return proxy
+}
+
+// wait_for_agent waits until the proxy has heard agent-1's heartbeat.
+func wait_for_agent(t *testing.T, proxy *RuntimeAPIProxy) {
+	t.Helper()
+	for wait := time.Now().Add(5 * time.Second); proxy.presence.agent() == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(wait) {
+			t.Fatal("timed out waiting for the agent's heartbeat")
+		}
+	}
+}
+
+// wait_for_published returns the events published on channel that match,
+// once there is one. A nil match takes every event.
+func wait_for_published(t *testing.T, server *eventstest.Server, channel string, match func(event map[string]interface{}) bool) []map[string]interface{} {
+	t.Helper()
+	for wait := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var matched []map[string]interface{}
+		for _, raw := range server.Published(channel) {
+			var event map[string]interface{}
+			if json.Unmarshal(raw, &event) == nil && (match == nil || match(event)) {
+				matched = append(matched, event)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+		if time.Now().After(wait) {
+			t.Fatalf("nothing published on %s", channel)
+		}
+	}
+}
+
+// of_type matches events of type event_type.
+func of_type(event_type string) func(event map[string]interface{}) bool {
+	return func(event map[string]interface{}) bool { return event["type"] == event_type }
+}
+
+// wait_for_lifecycle_event returns the data of the first event_type event
+// the proxy published on its lifecycle channel.
+func wait_for_lifecycle_event(t *testing.T, server *eventstest.Server, proxy *RuntimeAPIProxy, event_type string) map[string]interface{} {
+	t.Helper()
+	data, _ := wait_for_published(t, server, proxy.lifecycle_topic(), of_type(event_type))[0]["data"].(map[string]interface{})
+	return data
+}
+
+func TestInvocationRoundTripOverEventsAPI(t *testing.T) {
+	server := new_events_server(t)
+	posted := fake_runtime_api(t, "req-1", `{"n":1}`)
+	proxy := new_events_proxy(t, server)
+	events_agent(server, "orders")
+	wait_for_agent(t, proxy)
+
+	runtime := httptest.NewServer(proxy.router())
+	defer runtime.Close()
+	resp, err := http.Get(runtime.URL + "/2018-06-01/runtime/invocation/next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case response := <-posted:
+		if response.path != "/2018-06-01/runtime/invocation/req-1/response" || response.body != `{"n":1}` {
+			t.Fatalf("unexpected response %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the agent's response to reach the Runtime API")
+	}
+	steps, _ := proxy.explanations.lookup("req-1")
+	decisions := map[string]bool{}
+	for _, step := range steps {
+		decisions[step.Decision] = true
+	}
+	if !decisions["published"] || !decisions["responded"] {
+		t.Fatalf("expected the invocation to go through the Events API, got %+v", steps)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit codes
+//
+// The extension process exits with a code per failure class, and writes one
+// JSON line to stderr just before it does, whatever LIVE_LAMBDA_LOG_FORMAT is:
+//
+//	{"event": "live_lambda_exit", "status": "registration_failed", "exit_code": 4, "error": "...", ...}
+//
+// so a CloudWatch metric filter such as
+// { $.event = "live_lambda_exit" && $.exit_code != 0 } can alarm on a class of
+// failure rather than on any crash. 1 is left to unclassified failures and 2
+// to Go runtime panics.
+//
+// Lambda itself is told too, so the failure shows up in the invoke error and
+// the platform logs rather than as an unexplained crash: before the event loop
+// starts, through /init/error, which fails the init phase; after, through
+// /exit/error, which resets the execution environment. Both need the extension
+// to be registered, so a failure before registration registers first. The
+// error type is Extension.<Status>, e.g. Extension.ConfigError. A failed
+// registration cannot be reported.
+
+type exit_status int
+
+const (
+	exit_shutdown            exit_status = 0 // SHUTDOWN event or signal; shutdown_error notes an unclean one
+	exit_config_error        exit_status = 3 // the configuration could not be read or is invalid
+	exit_registration_failed exit_status = 4 // the Extensions API refused or could not be reached
+	exit_transport_fatal     exit_status = 5 // the AWS configuration or transport could not be set up
+	exit_runtime_failed      exit_status = 6 // the event loop or the proxy listener failed
+
+	exit_summary_event = "live_lambda_exit"
+	// How long an exit waits on the Extensions API to take the error report
+	exit_report_timeout = 2 * time.Second
+)
+
+func (s exit_status) String() string {
+	switch s {
+	case exit_shutdown:
+		return "shutdown"
+	case exit_config_error:
+		return "config_error"
+	case exit_registration_failed:
+		return "registration_failed"
+	case exit_transport_fatal:
+		return "transport_fatal"
+	case exit_runtime_failed:
+		return "runtime_failed"
+	}
+	return fmt.Sprintf("exit_%d", int(s))
+}
+
+// error_type names the status for /init/error and /exit/error, e.g. Extension.ConfigError.
+func (s exit_status) error_type() string {
+	name := ""
+	for _, word := range strings.Split(s.String(), "_") {
+		if word != "" {
+			name += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return "Extension." + name
+}
+
+// exit_summary is the final line written before the process exits.
+type exit_summary struct {
+	Event         string `json:"event"`
+	Status        string `json:"status"`
+	ExitCode      int    `json:"exit_code"`
+	Error         string `json:"error,omitempty"`
+	ShutdownError string `json:"shutdown_error,omitempty"`
+	FunctionName  string `json:"function_name,omitempty"`
+	SandboxID     string `json:"sandbox_id,omitempty"`
+	UptimeMs      int64  `json:"uptime_ms"`
+	Time          string `json:"time"`
+}
+
+// exit_reporter ends the process with a summary. Fields are filled in as
+// startup learns them.
+type exit_reporter struct {
+	out           io.Writer
+	exit          func(code int)
+	now           func() time.Time
+	started       time.Time
+	function_name string
+	sandbox_id    string
+	// platform reports failures to the Extensions API; nil reports nothing
+	platform       *Client
+	extension_name string
+	initialized    bool // the event loop has started, so failures go to /exit/error
+}
+
+func new_exit_reporter() *exit_reporter {
+	return &exit_reporter{out: os.Stderr, exit: os.Exit, now: time.Now, started: time.Now()}
+}
+
+// summary describes an exit with status, caused by err.
+func (r *exit_reporter) summary(status exit_status, err error, shutdown_err error) exit_summary {
+	now := r.now()
+	summary := exit_summary{
+		Event:        exit_summary_event,
+		Status:       status.String(),
+		ExitCode:     int(status),
+		FunctionName: r.function_name,
+		SandboxID:    r.sandbox_id,
+		UptimeMs:     now.Sub(r.started).Milliseconds(),
+		Time:         now.UTC().Format(time.RFC3339Nano),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	if shutdown_err != nil {
+		summary.ShutdownError = shutdown_err.Error()
+	}
+	return summary
+}
+
+// report tells Lambda why the extension is about to exit with status.
+func (r *exit_reporter) report(status exit_status, err error) {
+	if r.platform == nil || status == exit_shutdown || status == exit_registration_failed {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("the extension failed with %s", status)
+	}
+	logger := component_logger(component_main)
+	ctx, cancel := context.WithTimeout(context.Background(), exit_report_timeout)
+	defer cancel()
+	if r.platform.ExtensionID() == "" {
+		if _, register_err := r.platform.Register(ctx, r.extension_name, []EventType{Shutdown}); register_err != nil {
+			logger.Warn("Could not register to report the failure to Lambda", "error", register_err)
+			return
+		}
+	}
+	report := r.platform.InitError
+	if r.initialized {
+		report = r.platform.ExitError
+	}
+	if _, report_err := report(ctx, status.error_type(), err); report_err != nil {
+		logger.Warn("Could not report the failure to Lambda", "error_type", status.error_type(), "error", report_err)
+	}
+}
+
+// finish reports the failure, if any, then writes the summary and exits with status.
+func (r *exit_reporter) finish(status exit_status, err error, shutdown_err error) {
+	r.report(status, err)
+	line, _ := json.Marshal(r.summary(status, err, shutdown_err))
+	fmt.Fprintln(r.out, string(line))
+	r.exit(int(status))
+}
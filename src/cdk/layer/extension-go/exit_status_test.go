@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExitReporterWritesSummaryLine(t *testing.T) {
+	var out bytes.Buffer
+	var code int
+	started := time.Unix(1_000, 0)
+	reporter := &exit_reporter{
+		out:           &out,
+		exit:          func(c int) { code = c },
+		now:           func() time.Time { return started.Add(1500 * time.Millisecond) },
+		started:       started,
+		function_name: "orders",
+	}
+
+	reporter.finish(exit_registration_failed, errors.New("connection refused"), nil)
+
+	if code != 4 {
+		t.Fatalf("expected exit code 4, got %d", code)
+	}
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("expected a single line, got %q", out.String())
+	}
+	var summary exit_summary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", out.String(), err)
+	}
+	if summary.Event != exit_summary_event || summary.Status != "registration_failed" || summary.ExitCode != 4 || summary.Error != "connection refused" || summary.FunctionName != "orders" || summary.UptimeMs != 1500 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestExitStatusesAreDistinct(t *testing.T) {
+	seen := map[int]string{}
+	for _, status := range []exit_status{exit_shutdown, exit_config_error, exit_registration_failed, exit_transport_fatal, exit_runtime_failed} {
+		if int(status) == 1 || int(status) == 2 {
+			t.Errorf("%s uses a code reserved for unclassified failures and panics", status)
+		}
+		if other, ok := seen[int(status)]; ok {
+			t.Errorf("%s and %s share exit code %d", status, other, int(status))
+		}
+		seen[int(status)] = status.String()
+	}
+}
+
+// fake_extensions_api records the paths and error type headers it is sent.
+func fake_extensions_api(t *testing.T) (*Client, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	calls := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.URL.Path+" "+r.Header.Get(extension_error_type))
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/register") {
+			w.Header().Set(extension_identifier_header, "ext-123")
+			w.Write([]byte(`{"functionName":"orders"}`))
+			return
+		}
+		var body ErrorRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ErrorMessage == "" || r.Header.Get(extension_identifier_header) != "ext-123" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(strings.TrimPrefix(server.URL, "http://")), &calls
+}
+
+func TestExitReporterReportsFailuresToLambda(t *testing.T) {
+	client, calls := fake_extensions_api(t)
+	reporter := &exit_reporter{out: &bytes.Buffer{}, exit: func(int) {}, now: time.Now, platform: client, extension_name: "live-lambda"}
+
+	// Before registration, the reporter registers so it can report
+	reporter.finish(exit_config_error, errors.New("bad setting"), nil)
+	reporter.initialized = true
+	reporter.finish(exit_runtime_failed, errors.New("listener failed"), nil)
+	reporter.finish(exit_shutdown, nil, nil)
+
+	expected := []string{
+		"/2020-01-01/extension/register ",
+		"/2020-01-01/extension/init/error Extension.ConfigError",
+		"/2020-01-01/extension/exit/error Extension.RuntimeFailed",
+	}
+	if strings.Join(*calls, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected %v, got %v", expected, *calls)
+	}
+}
+
+func TestExitReporterDoesNotReportFailedRegistration(t *testing.T) {
+	client, calls := fake_extensions_api(t)
+	reporter := &exit_reporter{out: &bytes.Buffer{}, exit: func(int) {}, now: time.Now, platform: client}
+
+	reporter.finish(exit_registration_failed, errors.New("connection refused"), nil)
+
+	if len(*calls) != 0 {
+		t.Fatalf("expected no calls, got %v", *calls)
+	}
+}
+
+func TestExitStatusErrorTypes(t *testing.T) {
+	for status, expected := range map[exit_status]string{
+		exit_config_error:    "Extension.ConfigError",
+		exit_transport_fatal: "Extension.TransportFatal",
+		exit_runtime_failed:  "Extension.RuntimeFailed",
+	} {
+		if got := status.error_type(); got != expected {
+			t.Errorf("%s: expected %s, got %s", status, expected, got)
+		}
+	}
+}
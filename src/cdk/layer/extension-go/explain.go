@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Every invocation the proxy sees gets an explain trace: the decisions taken
+// for it in order (whether it was intercepted and why not, the agent it went
+// to, timeouts, fallbacks), so "why didn't my laptop get that request?" is a
+// lookup. Traces for the most recent invocations are kept in memory and served
+// at GET /live-lambda/explain/{requestId} on the proxy listener. The agent can
+// also publish an explain_request frame on the control channel; the sandbox
+// that saw the invocation answers with an explain event on the lifecycle
+// channel.
+
+const (
+	explain_print_prefix     = "[LiveLambdaExt:Explain]"
+	explain_route            = "/live-lambda/explain/{requestId}"
+	default_explain_capacity = 200
+)
+
+type explain_step struct {
+	At       string `json:"at"`
+	Decision string `json:"decision"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// explain_log keeps the traces of the last capacity invocations.
+type explain_log struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string
+	traces   map[string][]explain_step
+	now      func() time.Time
+}
+
+func new_explain_log(capacity int) *explain_log {
+	return &explain_log{capacity: capacity, traces: map[string][]explain_step{}, now: time.Now}
+}
+
+// record appends a decision to the trace of request_id, evicting the oldest
+// trace when a new one would exceed the capacity.
+func (l *explain_log) record(request_id string, decision string, detail string) {
+	if l == nil || request_id == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.traces[request_id]; !ok {
+		if len(l.order) >= l.capacity {
+			delete(l.traces, l.order[0])
+			l.order = l.order[1:]
+		}
+		l.order = append(l.order, request_id)
+	}
+	l.traces[request_id] = append(l.traces[request_id], explain_step{
+		At:       l.now().UTC().Format(time.RFC3339Nano),
+		Decision: decision,
+		Detail:   detail,
+	})
+}
+
+// clear drops every trace.
+func (l *explain_log) clear() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order = nil
+	l.traces = map[string][]explain_step{}
+}
+
+func (l *explain_log) lookup(request_id string) ([]explain_step, bool) {
+	if l == nil {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	steps, ok := l.traces[request_id]
+	return append([]explain_step(nil), steps...), ok
+}
+
+// explain records a decision for request_id.
+func (p *RuntimeAPIProxy) explain(request_id string, decision string, format string, args ...interface{}) {
+	if p.shedder.active() {
+		return
+	}
+	p.explanations.record(request_id, decision, fmt.Sprintf(format, args...))
+}
+
+// explain_trace returns the trace of request_id as reported by the HTTP route
+// and the lifecycle channel.
+func (p *RuntimeAPIProxy) explain_trace(request_id string) (map[string]interface{}, bool) {
+	steps, ok := p.explanations.lookup(request_id)
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"request_id":    request_id,
+		"sandbox_id":    p.sandbox_id,
+		"function_name": p.function_name,
+		"steps":         steps,
+	}, true
+}
+
+func (p *RuntimeAPIProxy) handle_explain(w http.ResponseWriter, r *http.Request) {
+	request_id := chi.URLParam(r, "requestId")
+	trace, ok := p.explain_trace(request_id)
+	status := http.StatusOK
+	if !ok {
+		trace = map[string]interface{}{"request_id": request_id, "error": "this sandbox has no trace for the request"}
+		status = http.StatusNotFound
+	}
+	body, err := json.Marshal(trace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+type explain_request struct {
+	RequestID string `json:"request_id"`
+}
+
+// register_explain_handler answers explain_request frames for invocations this
+// sandbox has seen. Other sandboxes stay silent.
+func (p *RuntimeAPIProxy) register_explain_handler() {
+	p.control.register("explain_request", func(frame json.RawMessage) {
+		var request explain_request
+		if err := json.Unmarshal(frame, &request); err != nil {
+			log.Printf("%s Ignoring malformed explain_request frame: %v", explain_print_prefix, err)
+			return
+		}
+		trace, ok := p.explain_trace(request.RequestID)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+		defer cancel()
+		if err := p.publish_lifecycle_event(ctx, "explain", trace); err == nil {
+			log.Printf("%s Answered explain request for %s", explain_print_prefix, request.RequestID)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExplainLogKeepsRecentTraces(t *testing.T) {
+	traces := new_explain_log(2)
+	traces.record("r1", "received", "")
+	traces.record("r1", "not_intercepted", "the agent is at capacity")
+	traces.record("r2", "received", "")
+	traces.record("", "received", "")
+
+	steps, ok := traces.lookup("r1")
+	if !ok || len(steps) != 2 || steps[1].Decision != "not_intercepted" || steps[1].Detail != "the agent is at capacity" {
+		t.Fatalf("unexpected trace: %+v", steps)
+	}
+
+	traces.record("r3", "received", "")
+	if _, ok := traces.lookup("r1"); ok {
+		t.Fatal("expected the oldest trace to be evicted")
+	}
+	if _, ok := traces.lookup("r2"); !ok {
+		t.Fatal("expected newer traces to be kept")
+	}
+}
+
+func TestExplainRoute(t *testing.T) {
+	p := &RuntimeAPIProxy{sandbox_id: "sb", explanations: new_explain_log(10)}
+	p.explain("r1", "intercepted", "for agent %s", "laptop")
+	router := p.router()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/live-lambda/explain/r1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+	var trace struct {
+		RequestID string         `json:"request_id"`
+		SandboxID string         `json:"sandbox_id"`
+		Steps     []explain_step `json:"steps"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &trace); err != nil {
+		t.Fatalf("expected a JSON trace: %v", err)
+	}
+	if trace.RequestID != "r1" || trace.SandboxID != "sb" || len(trace.Steps) != 1 || trace.Steps[0].Detail != "for agent laptop" {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/live-lambda/explain/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown request, got %d", recorder.Code)
+	}
+}
+
+func TestTimedOutInvocationIsExplained(t *testing.T) {
+	start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.explanations = new_explain_log(10)
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+
+	proxy.agent_timed_out("r1", time.Now())
+	steps, _ := proxy.explanations.lookup("r1")
+	if len(steps) != 1 || steps[0].Decision != "failed" {
+		t.Fatalf("expected the failure to be explained: %+v", steps)
+	}
+}
@@ -4,7 +4,7 @@
 // Read about Lambda Runtime API here
 // https://docs.aws.amazon.com/lambda/latest/dg/runtimes-api.html
 
-package main // MODIFIED
+package main
 
 import (
 	"bytes"
@@ -21,6 +21,7 @@ type RegisterResponse struct {
 	FunctionName    string `json:"functionName"`
 	FunctionVersion string `json:"functionVersion"`
 	Handler         string `json:"handler"`
+	AccountID       string `json:"accountId,omitempty"` // only when the accountId feature is accepted
 }
 
 // NextEventResponse is the response for /event/next
@@ -31,7 +32,7 @@ type NextEventResponse struct {
 	InvokedFunctionArn string    `json:"invokedFunctionArn"`
 	Tracing            Tracing   `json:"tracing"`
 	// Added based on potential need from other file, review if necessary
-	ShutdownReason     string    `json:"shutdownReason,omitempty"` 
+	ShutdownReason string `json:"shutdownReason,omitempty"`
 }
 
 // Tracing is part of the response for /event/next
@@ -45,6 +46,13 @@ type StatusResponse struct {
 	Status string `json:"status"`
 }
 
+// ErrorRequest is the body of /init/error and /exit/error
+type ErrorRequest struct {
+	ErrorMessage string   `json:"errorMessage"`
+	ErrorType    string   `json:"errorType"`
+	StackTrace   []string `json:"stackTrace"`
+}
+
 // EventType represents the type of events received from /event/next
 type EventType string
 
@@ -53,33 +61,43 @@ const (
 	Invoke EventType = "INVOKE"
 
 	// Shutdown is a shutdown event for the environment
-	Shutdown EventType = "SHUTDOWN"
-	print_prefix string = "[LRAP:ExtensionsApiClient]" // MODIFIED
-	extension_name_header      = "Lambda-Extension-Name" // MODIFIED
-	extension_identifier_header = "Lambda-Extension-Identifier" // MODIFIED
-	extension_error_type       = "Lambda-Extension-Function-Error-Type" // MODIFIED
+	Shutdown                    EventType = "SHUTDOWN"
+	extension_name_header                 = "Lambda-Extension-Name"
+	extension_identifier_header           = "Lambda-Extension-Identifier"
+	extension_error_type                  = "Lambda-Extension-Function-Error-Type"
+)
+
+// Without the accountId feature, /register leaves the account ID out
+const (
+	extension_accept_feature_header = "Lambda-Extension-Accept-Feature"
+	extension_feature_account_id    = "accountId"
 )
 
 // Client is a simple client for the Lambda Extensions API
 type Client struct {
-	base_url     string // MODIFIED
-	http_client  *http.Client // MODIFIED
-	extension_id string // MODIFIED
+	base_url      string
+	http_client   *http.Client
+	extension_id  string
+	telemetry_url string
+	logs_url      string
+	registration  *RegisterResponse // nil until Register succeeds
 }
 
 // NewClient returns a Lambda Extensions API client
-func NewClient(aws_lambda_runtime_api string) *Client { // MODIFIED
-	println(print_prefix, "Creating extension client")
-	base_url := fmt.Sprintf("http://%s/2020-01-01/extension", aws_lambda_runtime_api) // MODIFIED
+func NewClient(aws_lambda_runtime_api string) *Client {
+	component_logger(component_extensions_api).Debug("Creating extension client")
+	base_url := fmt.Sprintf("http://%s/2020-01-01/extension", aws_lambda_runtime_api)
 	return &Client{
-		base_url:    base_url,
-		http_client: &http.Client{},
+		base_url:      base_url,
+		telemetry_url: fmt.Sprintf("http://%s/2022-07-01/telemetry", aws_lambda_runtime_api),
+		logs_url:      fmt.Sprintf("http://%s/%s/logs", aws_lambda_runtime_api, logs_api_version),
+		http_client:   &http.Client{},
 	}
 }
 
-// Register will register the extension with the Extensions API
-func (e *Client) Register(ctx context.Context, file_name string) (*RegisterResponse, error) { // MODIFIED
-	println(print_prefix, "register endpoint=", file_name)
+// Register will register the extension with the Extensions API for events
+func (e *Client) Register(ctx context.Context, file_name string, events []EventType) (*RegisterResponse, error) {
+	component_logger(component_extensions_api).Info("Registering", "file_name", file_name)
 	const action = "/register"
 
 	url := e.base_url + action
@@ -88,95 +106,200 @@ func (e *Client) Register(ctx context.Context, file_name string) (*RegisterRespo
 	// Fallback to file_name if not set (though it should be)
 	official_extension_name := os.Getenv("AWS_LAMBDA_EXTENSION_NAME")
 	if official_extension_name == "" {
-		println(print_prefix, "Warning: AWS_LAMBDA_EXTENSION_NAME not set, using executable name:", file_name)
+		component_logger(component_extensions_api).Warn("AWS_LAMBDA_EXTENSION_NAME not set, using the executable name", "file_name", file_name)
 		official_extension_name = file_name
 	}
 
-	// Register for both INVOKE and SHUTDOWN events
 	req_body, err := json.Marshal(map[string]interface{}{
-		"events": []EventType{Invoke, Shutdown},
+		"events": events,
 	})
 	if err != nil {
-		println(print_prefix, "failed to create request body:", err)
+		component_logger(component_extensions_api).Error("Failed to create request body", "error", err)
 		return nil, err
 	}
-	http_req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(req_body)) // MODIFIED
+	http_req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(req_body))
 	if err != nil {
-		println(print_prefix, "failed to create http request:", err)
+		component_logger(component_extensions_api).Error("Failed to create http request", "error", err)
 		return nil, err
 	}
 	http_req.Header.Set(extension_name_header, official_extension_name)
-	http_res, err := e.http_client.Do(http_req) // MODIFIED
+	http_req.Header.Set(extension_accept_feature_header, extension_feature_account_id)
+	http_res, err := e.http_client.Do(http_req)
 	if err != nil {
-		println(print_prefix, "failed to send request:", err)
+		component_logger(component_extensions_api).Error("Failed to send request", "error", err)
 		return nil, err
 	}
 	if http_res.StatusCode != 200 {
-		println(print_prefix, "request failed with status", http_res.Status)
+		component_logger(component_extensions_api).Error("Register request failed", "status", http_res.Status)
 		// Attempt to read body for more details even on error
 		defer http_res.Body.Close()
-		body_bytes, _ := io.ReadAll(http_res.Body) // MODIFIED
-		println(print_prefix, "Error response body:", string(body_bytes))
+		body_bytes, _ := io.ReadAll(http_res.Body)
+		component_logger(component_extensions_api).Error("Error response body", "body", string(body_bytes))
 		return nil, fmt.Errorf("request failed with status %s. Body: %s", http_res.Status, string(body_bytes))
 	}
 	defer http_res.Body.Close()
 	body, err := io.ReadAll(http_res.Body)
 	if err != nil {
-		println(print_prefix, "failed to read response body:", err)
+		component_logger(component_extensions_api).Error("Failed to read response body", "error", err)
 		return nil, err
 	}
 	res := RegisterResponse{}
 	err = json.Unmarshal(body, &res)
 	if err != nil {
-		println(print_prefix, "failed to unmarshal response body:", err)
+		component_logger(component_extensions_api).Error("Failed to unmarshal response body", "error", err)
 		return nil, err
 	}
 	e.extension_id = http_res.Header.Get(extension_identifier_header)
-	println(print_prefix, "register success, extension_id=", e.extension_id)
+	e.registration = &res
+	component_logger(component_extensions_api).Info("Registered", "extension_id", e.extension_id, "function_name", res.FunctionName, "function_version", res.FunctionVersion, "handler", res.Handler)
 	return &res, nil
 }
 
+// Function returns the function metadata from the /register response; ok is
+// false until Register succeeds. AccountID is empty when Lambda did not send it.
+func (e *Client) Function() (RegisterResponse, bool) {
+	if e.registration == nil {
+		return RegisterResponse{}, false
+	}
+	return *e.registration, true
+}
+
+// ExtensionID returns the identifier Lambda assigned on /register.
+func (e *Client) ExtensionID() string {
+	return e.extension_id
+}
+
 // NextEvent blocks while long polling for the next lambda invoke or shutdown
-func (e *Client) NextEvent(ctx context.Context) (*NextEventResponse, error) { // MODIFIED
-	println(print_prefix, "awaiting next event")
+func (e *Client) NextEvent(ctx context.Context) (*NextEventResponse, error) {
+	component_logger(component_extensions_api).Debug("Awaiting next event")
 	const action = "/event/next"
 	url := e.base_url + action
 
-	http_req, err := http.NewRequestWithContext(ctx, "GET", url, nil) // MODIFIED
+	http_req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		println(print_prefix, "failed to create http request:", err)
+		component_logger(component_extensions_api).Error("Failed to create http request", "error", err)
 		return nil, err
 	}
 	http_req.Header.Set(extension_identifier_header, e.extension_id)
-	http_res, err := e.http_client.Do(http_req) // MODIFIED
+	http_res, err := e.http_client.Do(http_req)
 	if err != nil {
 		// If context is cancelled, this is an expected error during shutdown.
 		if ctx.Err() != nil {
 			return nil, ctx.Err()
 		}
-		println(print_prefix, "failed to send request:", err)
+		component_logger(component_extensions_api).Error("Failed to send request", "error", err)
 		return nil, err
 	}
 	if http_res.StatusCode != 200 {
-		println(print_prefix, "get request failed with status", http_res.Status)
+		component_logger(component_extensions_api).Error("Next event request failed", "status", http_res.Status)
 		// Attempt to read body for more details even on error
 		defer http_res.Body.Close()
-		body_bytes, _ := io.ReadAll(http_res.Body) // MODIFIED
-		println(print_prefix, "Error response body:", string(body_bytes))
+		body_bytes, _ := io.ReadAll(http_res.Body)
+		component_logger(component_extensions_api).Error("Error response body", "body", string(body_bytes))
 		return nil, fmt.Errorf("request failed with status %s. Body: %s", http_res.Status, string(body_bytes))
 	}
 	defer http_res.Body.Close()
 	body, err := io.ReadAll(http_res.Body)
 	if err != nil {
-		println(print_prefix, "failed to read response body:", err)
+		component_logger(component_extensions_api).Error("Failed to read response body", "error", err)
 		return nil, err
 	}
 	res := NextEventResponse{}
 	err = json.Unmarshal(body, &res)
 	if err != nil {
-		println(print_prefix, "failed to unmarshal response body:", err)
+		component_logger(component_extensions_api).Error("Failed to unmarshal response body", "error", err)
+		return nil, err
+	}
+	component_logger(component_extensions_api).Debug("Received next event", "event_type", res.EventType, "request_id", res.RequestID)
+	return &res, nil
+}
+
+// SubscribeTelemetry subscribes the registered extension to the Telemetry API.
+// It must be called after Register and before the first NextEvent.
+func (e *Client) SubscribeTelemetry(ctx context.Context, subscription interface{}) error {
+	component_logger(component_extensions_api).Info("Subscribing to telemetry")
+	if err := e.subscribe(ctx, e.telemetry_url, subscription); err != nil {
+		return fmt.Errorf("telemetry subscription failed: %w", err)
+	}
+	component_logger(component_extensions_api).Info("Subscribed to telemetry")
+	return nil
+}
+
+// SubscribeLogs subscribes the registered extension to the Logs API, for
+// runtimes without the Telemetry API. The same ordering rules apply.
+func (e *Client) SubscribeLogs(ctx context.Context, subscription interface{}) error {
+	component_logger(component_extensions_api).Info("Subscribing to logs")
+	if err := e.subscribe(ctx, e.logs_url, subscription); err != nil {
+		return fmt.Errorf("logs subscription failed: %w", err)
+	}
+	component_logger(component_extensions_api).Info("Subscribed to logs")
+	return nil
+}
+
+func (e *Client) subscribe(ctx context.Context, url string, subscription interface{}) error {
+	req_body, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	http_req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(req_body))
+	if err != nil {
+		return err
+	}
+	http_req.Header.Set("Content-Type", "application/json")
+	http_req.Header.Set(extension_identifier_header, e.extension_id)
+	http_res, err := e.http_client.Do(http_req)
+	if err != nil {
+		return err
+	}
+	defer http_res.Body.Close()
+	if http_res.StatusCode != 200 {
+		body_bytes, _ := io.ReadAll(http_res.Body)
+		return fmt.Errorf("status %s. Body: %s", http_res.Status, string(body_bytes))
+	}
+	return nil
+}
+
+// InitError reports a failure during initialization to the Extensions API.
+// Lambda fails the init phase with error_type, which must look like
+// Extension.<Reason>, and the extension should then exit.
+func (e *Client) InitError(ctx context.Context, error_type string, cause error) (*StatusResponse, error) {
+	return e.report_error(ctx, "/init/error", error_type, cause)
+}
+
+// ExitError reports a failure after initialization to the Extensions API, just
+// before the extension exits. Lambda resets the execution environment.
+func (e *Client) ExitError(ctx context.Context, error_type string, cause error) (*StatusResponse, error) {
+	return e.report_error(ctx, "/exit/error", error_type, cause)
+}
+
+func (e *Client) report_error(ctx context.Context, action string, error_type string, cause error) (*StatusResponse, error) {
+	component_logger(component_extensions_api).Info("Reporting error", "action", action, "error_type", error_type)
+	req_body, err := json.Marshal(ErrorRequest{ErrorMessage: cause.Error(), ErrorType: error_type, StackTrace: []string{}})
+	if err != nil {
+		return nil, err
+	}
+	http_req, err := http.NewRequestWithContext(ctx, "POST", e.base_url+action, bytes.NewBuffer(req_body))
+	if err != nil {
+		return nil, err
+	}
+	http_req.Header.Set("Content-Type", "application/json")
+	http_req.Header.Set(extension_identifier_header, e.extension_id)
+	http_req.Header.Set(extension_error_type, error_type)
+	http_res, err := e.http_client.Do(http_req)
+	if err != nil {
+		return nil, err
+	}
+	defer http_res.Body.Close()
+	body, err := io.ReadAll(http_res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if http_res.StatusCode != 202 && http_res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s failed with status %s. Body: %s", action, http_res.Status, string(body))
+	}
+	res := StatusResponse{}
+	if err := json.Unmarshal(body, &res); err != nil {
 		return nil, err
 	}
-	println(print_prefix, "Next success")
 	return &res, nil
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Fallback policy
+//
+// When the extension cannot hand an invocation to the agent (subscribing to
+// the response channel or publishing the request fails), the FallbackPolicy
+// decides what happens to it:
+//
+//   - local: the invocation is passed through to the function in Lambda.
+//   - error: the invocation fails with a LiveLambda.PublishFailed error posted
+//     to /invocation/{id}/error, so a broken tunnel is visible to the caller.
+//   - retry-then-local: the failed step is retried with exponential backoff
+//     before passing the invocation through.
+
+const (
+	fallback_print_prefix    = "[LiveLambdaExt:Fallback]"
+	default_fallback_retries = 2
+	default_fallback_backoff = 250 * time.Millisecond
+	publish_failed_error     = "LiveLambda.PublishFailed"
+)
+
+// FallbackMode names what happens to an invocation the agent could not be sent.
+type FallbackMode string
+
+const (
+	FallbackLocal          FallbackMode = "local"
+	FallbackError          FallbackMode = "error"
+	FallbackRetryThenLocal FallbackMode = "retry-then-local"
+)
+
+// FallbackPolicy is applied when an invocation cannot be handed to the agent.
+// The zero value passes invocations through without retrying.
+type FallbackPolicy struct {
+	Mode    FallbackMode
+	Retries int           // extra attempts in retry-then-local mode
+	Backoff time.Duration // delay before the first retry, doubled after each
+}
+
+// ParseFallbackMode reads local, error or retry-then-local.
+func ParseFallbackMode(value string) (FallbackMode, error) {
+	switch mode := FallbackMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case FallbackLocal, FallbackError, FallbackRetryThenLocal:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown fallback mode %q", value)
+	}
+}
+
+// WithFallbackPolicy overrides the policy read from LIVE_LAMBDA_FALLBACK.
+func WithFallbackPolicy(policy FallbackPolicy) ProxyOption {
+	return func(o *proxy_options) {
+		o.fallback = &policy
+	}
+}
+
+// attempt runs step, retrying it in retry-then-local mode until it succeeds,
+// the retries are used up or ctx is done.
+func (f FallbackPolicy) attempt(ctx context.Context, step func(ctx context.Context) error) error {
+	err := step(ctx)
+	if err == nil || f.Mode != FallbackRetryThenLocal {
+		return err
+	}
+	backoff := f.Backoff
+	for retry := 1; retry <= f.Retries; retry++ {
+		log.Printf("%s Retrying in %s (%d of %d) after: %v", fallback_print_prefix, backoff, retry, f.Retries, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if err = step(ctx); err == nil {
+			return nil
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// fall_back applies the policy to an invocation that could not be handed to
+// the agent. It returns true when the invocation was failed and must not be
+// passed through to the function.
+func (p *RuntimeAPIProxy) fall_back(request_id string, cause error) bool {
+	// An oversized payload says nothing about the tunnel
+	too_large := is_payload_too_large(cause)
+	if !too_large {
+		p.record_tunnel_failure(cause)
+	}
+	p.mark_fallback(request_id)
+	if p.fallback.Mode != FallbackError {
+		log.Printf("%s Passing request ID %s through to the function: %v", fallback_print_prefix, request_id, cause)
+		return false
+	}
+	log.Printf("%s Failing request ID %s: %v", fallback_print_prefix, request_id, cause)
+	error_type, message := publish_failed_error, fmt.Sprintf("live-lambda could not reach the agent: %v", cause)
+	if too_large {
+		error_type, message = payload_too_large_error_type, cause.Error()
+	}
+	p.explain(request_id, "failed", "%s in error fallback mode: %v", error_type, cause)
+	p.post_invocation_error(request_id, error_type, message)
+	return true
+}
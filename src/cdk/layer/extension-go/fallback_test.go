@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFallbackMode(t *testing.T) {
+	for value, want := range map[string]FallbackMode{
+		"local":             FallbackLocal,
+		"ERROR":             FallbackError,
+		" retry-then-local": FallbackRetryThenLocal,
+	} {
+		if got, err := ParseFallbackMode(value); err != nil || got != want {
+			t.Fatalf("ParseFallbackMode(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseFallbackMode("retry"); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+func TestFallbackPolicyFromConfig(t *testing.T) {
+	settings, err := load_config(lookup_from(map[string]string{
+		live_lambda_fallback_env:         "retry-then-local",
+		live_lambda_fallback_retries_env: "4",
+		live_lambda_fallback_backoff_env: "50ms",
+	}))
+	policy := settings.Fallback
+	if err != nil || policy.Mode != FallbackRetryThenLocal || policy.Retries != 4 || policy.Backoff != 50*time.Millisecond {
+		t.Fatalf("unexpected policy %+v (err %v)", policy, err)
+	}
+
+	settings, err = load_config(lookup_from(map[string]string{live_lambda_fallback_env: "sometimes"}))
+	if err == nil || settings.Fallback.Mode != FallbackLocal {
+		t.Fatalf("expected an invalid mode to be reported and fall back to local, got %q (err %v)", settings.Fallback.Mode, err)
+	}
+}
+
+func TestFallbackPolicyAttempt(t *testing.T) {
+	failing := func(failures int, calls *int) func(context.Context) error {
+		return func(context.Context) error {
+			*calls++
+			if *calls <= failures {
+				return errors.New("publish failed")
+			}
+			return nil
+		}
+	}
+
+	calls := 0
+	if err := (FallbackPolicy{Mode: FallbackLocal, Retries: 3}).attempt(context.Background(), failing(1, &calls)); err == nil || calls != 1 {
+		t.Fatalf("expected local mode not to retry, got err=%v calls=%d", err, calls)
+	}
+
+	calls = 0
+	retrying := FallbackPolicy{Mode: FallbackRetryThenLocal, Retries: 3, Backoff: time.Millisecond}
+	if err := retrying.attempt(context.Background(), failing(2, &calls)); err != nil || calls != 3 {
+		t.Fatalf("expected success on the third attempt, got err=%v calls=%d", err, calls)
+	}
+
+	calls = 0
+	if err := retrying.attempt(context.Background(), failing(10, &calls)); err == nil || calls != 4 {
+		t.Fatalf("expected the retries to run out, got err=%v calls=%d", err, calls)
+	}
+
+	calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := retrying.attempt(ctx, failing(10, &calls)); err == nil || calls != 1 {
+		t.Fatalf("expected a cancelled context to stop retries, got err=%v calls=%d", err, calls)
+	}
+}
+
+func TestFallBackPostsErrorInErrorMode(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+
+	if proxy.fall_back("req-local", errors.New("boom")) {
+		t.Fatal("expected the zero policy to pass invocations through")
+	}
+
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+	if !proxy.fall_back("req-error", errors.New("boom")) {
+		t.Fatal("expected error mode to fail the invocation")
+	}
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-error/error" || !strings.Contains(posted.body, publish_failed_error) {
+			t.Fatalf("unexpected error post %+v", posted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error post")
+	}
+}
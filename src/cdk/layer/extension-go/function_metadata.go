@@ -0,0 +1,34 @@
+package main
+
+import "live-lambda-extension-go/pkg/protocol"
+
+// Function metadata
+//
+// /register answers with the function's name, version and handler, and with
+// its account ID because the extension accepts the accountId feature. The
+// proxy keeps them and adds them to every envelope it publishes (requests,
+// presence probes, offers, retransmit requests and protocol rejections):
+//
+//	"function": {"name": "...", "version": "...", "handler": "...", "account_id": "..."}
+//
+// so an agent can show which function and handler it is serving without
+// calling the Lambda API. Envelopes published before registration completes
+// carry no function block.
+
+// set_function_metadata keeps the function metadata from a /register response.
+func (p *RuntimeAPIProxy) set_function_metadata(registration RegisterResponse) {
+	p.function.Store(&protocol.Function{
+		Name:      registration.FunctionName,
+		Version:   registration.FunctionVersion,
+		Handler:   registration.Handler,
+		AccountID: registration.AccountID,
+	})
+}
+
+// add_function_metadata adds the function block to an envelope once the
+// extension has registered.
+func (p *RuntimeAPIProxy) add_function_metadata(message map[string]interface{}) {
+	if function := p.function.Load(); function != nil {
+		message["function"] = function
+	}
+}
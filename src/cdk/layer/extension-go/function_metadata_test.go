@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestRegisterKeepsFunctionMetadata(t *testing.T) {
+	var accepted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r.Header.Get(extension_accept_feature_header)
+		w.Header().Set(extension_identifier_header, "ext-123")
+		w.Write([]byte(`{"functionName":"orders","functionVersion":"$LATEST","handler":"index.handler","accountId":"123456789012"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(strings.TrimPrefix(server.URL, "http://"))
+	if _, ok := client.Function(); ok {
+		t.Fatal("expected no function metadata before registering")
+	}
+	if _, err := client.Register(context.Background(), "live-lambda-extension", []EventType{Invoke}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if accepted != extension_feature_account_id {
+		t.Fatalf("expected the accountId feature to be accepted, got %q", accepted)
+	}
+	function, ok := client.Function()
+	if !ok || function.Handler != "index.handler" || function.AccountID != "123456789012" || client.ExtensionID() != "ext-123" {
+		t.Fatalf("unexpected metadata %+v %s", function, client.ExtensionID())
+	}
+}
+
+func TestEnvelopesCarryFunctionMetadataOnceRegistered(t *testing.T) {
+	proxy := new_tracking_proxy()
+	probe := map[string]interface{}{}
+	proxy.add_function_metadata(probe)
+	if _, ok := probe["function"]; ok {
+		t.Fatal("expected no function block before registration")
+	}
+
+	proxy.set_function_metadata(RegisterResponse{FunctionName: "orders", FunctionVersion: "7", Handler: "index.handler"})
+	proxy.add_function_metadata(probe)
+	function, ok := probe["function"].(*protocol.Function)
+	if !ok || function.Name != "orders" || function.Version != "7" || function.Handler != "index.handler" || function.AccountID != "" {
+		t.Fatalf("unexpected function block %v", probe["function"])
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Platform teams can hard-disable interception for a function with the
+// live-lambda:enabled=false tag. Tags are taken from LIVE_LAMBDA_FUNCTION_TAGS
+// (a JSON object injected at deploy time) or, failing that, looked up once at
+// init with lambda:GetFunction. The lookup runs in the background so it never
+// holds up init; the connection and the first invocation wait for it, for at
+// most function_tag_lookup_budget.
+
+const (
+	live_lambda_enabled_tag    = "live-lambda:enabled"
+	function_tag_lookup_budget = 3 * time.Second
+)
+
+// lambda_api_endpoint is overridden in tests.
+var lambda_api_endpoint = func(region string) string {
+	return aws_service_endpoint("lambda", region)
+}
+
+// parse_function_tags decodes tags injected through the environment.
+func parse_function_tags(value string) (map[string]string, error) {
+	tags := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &tags); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of string tags: %w", err)
+	}
+	return tags, nil
+}
+
+// fetch_function_tags returns the function's tags from the Lambda GetFunction API.
+func fetch_function_tags(ctx context.Context, cfg aws.Config, region string, function_name string) (map[string]string, error) {
+	endpoint := fmt.Sprintf("%s/2015-03-31/functions/%s", lambda_api_endpoint(region), url.PathEscape(function_name))
+	body, err := send_signed_request(ctx, cfg, "lambda", region, http.MethodGet, endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Tags map[string]string `json:"Tags"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode GetFunction response: %w", err)
+	}
+	return response.Tags, nil
+}
+
+// interception_disabled_by_tags reports whether the tags opt the function out.
+func interception_disabled_by_tags(tags map[string]string) bool {
+	value, ok := tags[live_lambda_enabled_tag]
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "false", "0", "no", "off", "disabled":
+		return true
+	}
+	return false
+}
+
+// resolve_function_tags returns the injected function tags or reads them from the Lambda API.
+func resolve_function_tags(ctx context.Context, cfg aws.Config, settings Config) (map[string]string, string, error) {
+	if injected := settings.FunctionTags; injected != "" {
+		tags, err := parse_function_tags(injected)
+		if err != nil {
+			return nil, live_lambda_function_tags_env, fmt.Errorf("invalid %s: %w", live_lambda_function_tags_env, err)
+		}
+		return tags, live_lambda_function_tags_env, nil
+	}
+
+	if !settings.TagLookup || settings.FunctionName == "" {
+		return nil, "", nil
+	}
+
+	region := settings.FunctionRegion
+	if region == "" {
+		region = cfg.Region
+	}
+	lookup_ctx, cancel := context.WithTimeout(ctx, function_tag_lookup_budget)
+	defer cancel()
+	tags, err := fetch_function_tags(lookup_ctx, cfg, region, settings.FunctionName)
+	return tags, "lambda:GetFunction", err
+}
+
+// apply_function_tags hard-disables interception when the function is tagged out.
+// Lookup failures leave interception enabled.
+func (p *RuntimeAPIProxy) apply_function_tags(ctx context.Context) {
+	logger := component_logger(component_main)
+	tags, source, err := resolve_function_tags(ctx, p.aws_cfg, p.config)
+	if err != nil {
+		logger.Warn("Could not read function tags, leaving interception enabled", "source", source, "error", err)
+		return
+	}
+	if interception_disabled_by_tags(tags) {
+		reason := fmt.Sprintf("%s=%s tag (from %s)", live_lambda_enabled_tag, tags[live_lambda_enabled_tag], source)
+		p.interception.disable_hard(reason)
+		logger.Warn("Interception disabled by a function tag", "reason", reason)
+	}
+}
+
+// start_function_tags applies the function tags in the background.
+func (p *RuntimeAPIProxy) start_function_tags(ctx context.Context) {
+	ready := make(chan struct{})
+	p.function_tags_ready = ready
+	go func() {
+		defer close(ready)
+		p.apply_function_tags(ctx)
+	}()
+}
+
+// wait_for_function_tags returns once the function tags have been applied, or
+// ctx is done. It returns at once when no lookup was started.
+func (p *RuntimeAPIProxy) wait_for_function_tags(ctx context.Context) {
+	if p.function_tags_ready == nil {
+		return
+	}
+	select {
+	case <-p.function_tags_ready:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestInterceptionDisabledByTags(t *testing.T) {
+	cases := map[string]bool{"false": true, "FALSE": true, "0": true, "off": true, "true": false, "": false}
+	for value, want := range cases {
+		tags := map[string]string{live_lambda_enabled_tag: value}
+		if got := interception_disabled_by_tags(tags); got != want {
+			t.Errorf("tag value %q: expected disabled=%v, got %v", value, want, got)
+		}
+	}
+	if interception_disabled_by_tags(map[string]string{"team": "payments"}) {
+		t.Error("expected missing tag to leave interception enabled")
+	}
+}
+
+func TestResolveFunctionTagsPrefersEnvironment(t *testing.T) {
+	settings := default_config()
+	settings.FunctionName = "my-function"
+	settings.FunctionTags = `{"live-lambda:enabled":"false"}`
+
+	tags, source, err := resolve_function_tags(context.Background(), aws.Config{}, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source != live_lambda_function_tags_env {
+		t.Errorf("expected tags from %s, got %s", live_lambda_function_tags_env, source)
+	}
+	if !interception_disabled_by_tags(tags) {
+		t.Error("expected injected tag to disable interception")
+	}
+}
+
+func TestResolveFunctionTagsRejectsInvalidEnvironment(t *testing.T) {
+	settings := default_config()
+	settings.FunctionName = "my-function"
+	settings.FunctionTags = `["not","an","object"]`
+	if _, _, err := resolve_function_tags(context.Background(), aws.Config{}, settings); err == nil {
+		t.Error("expected invalid injected tags to be rejected")
+	}
+}
+
+func TestResolveFunctionTagsFromLambdaAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2015-03-31/functions/my-function" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"Configuration":{},"Tags":{"live-lambda:enabled":"false","team":"payments"}}`))
+	}))
+	defer server.Close()
+
+	original := lambda_api_endpoint
+	lambda_api_endpoint = func(string) string { return server.URL }
+	defer func() { lambda_api_endpoint = original }()
+
+	settings := default_config()
+	settings.FunctionName = "my-function"
+	settings.FunctionRegion = "us-east-1"
+	cfg := aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")}
+
+	tags, source, err := resolve_function_tags(context.Background(), cfg, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source != "lambda:GetFunction" || tags["team"] != "payments" {
+		t.Fatalf("unexpected tags %v from %s", tags, source)
+	}
+	if !interception_disabled_by_tags(tags) {
+		t.Error("expected tag from the Lambda API to disable interception")
+	}
+}
+
+func TestResolveFunctionTagsLookupCanBeTurnedOff(t *testing.T) {
+	settings := default_config()
+	settings.FunctionName = "my-function"
+	settings.TagLookup = false
+	tags, _, err := resolve_function_tags(context.Background(), aws.Config{}, settings)
+	if err != nil || tags != nil {
+		t.Fatalf("expected no lookup, got tags=%v err=%v", tags, err)
+	}
+}
+
+func TestInterceptionSwitchHardDisableWins(t *testing.T) {
+	s := new_interception_switch()
+	s.disable("paused")
+	s.disable_hard("tagged off")
+	s.enable()
+	if enabled, reason := s.enabled(); enabled || reason != "tagged off" {
+		t.Fatalf("expected hard disable to persist, got enabled=%v reason=%q", enabled, reason)
+	}
+}
+
+func TestFunctionTagsAreAppliedInTheBackground(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"Tags":{"live-lambda:enabled":"false"}}`))
+	}))
+	defer server.Close()
+
+	original := lambda_api_endpoint
+	lambda_api_endpoint = func(string) string { return server.URL }
+	defer func() { lambda_api_endpoint = original }()
+
+	settings := default_config()
+	settings.FunctionName = "my-function"
+	settings.FunctionRegion = "us-east-1"
+	p := &RuntimeAPIProxy{
+		aws_cfg:      aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")},
+		interception: new_interception_switch(),
+		config:       settings,
+	}
+	p.start_function_tags(context.Background())
+	if p.interception.hard_disabled() {
+		t.Fatal("expected start_function_tags to return before the lookup")
+	}
+
+	close(release)
+	p.wait_for_function_tags(context.Background())
+	if !p.interception.hard_disabled() {
+		t.Fatal("expected the tag to disable interception once the lookup finished")
+	}
+
+	// A proxy that never looked its tags up does not wait
+	(&RuntimeAPIProxy{}).wait_for_function_tags(context.Background())
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lambda Function URLs (and API Gateway HTTP APIs) use payload format 2.0. The
+// developer's response travels through AppSync as a generic JSON value, so before
+// it is posted to the Runtime API we check it against the 2.0 response rules and
+// normalize the few shapes that Function URLs would otherwise silently drop.
+// https://docs.aws.amazon.com/lambda/latest/dg/urls-invocation.html#urls-response-payload
+
+const function_url_print_prefix = "[LiveLambdaExt:FunctionURL]"
+
+// is_payload_format_v2_event reports whether the raw event is a payload format 2.0 request.
+func is_payload_format_v2_event(event []byte) bool {
+	var probe struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(event, &probe); err != nil {
+		return false
+	}
+	return probe.Version == "2.0"
+}
+
+// normalize_function_url_response validates a developer response against payload
+// format 2.0 and returns the bytes that should be posted to the Runtime API.
+//
+// Responses that are not JSON objects, or objects without a statusCode, are left
+// untouched: Lambda treats those as a 200 with the value serialized as the body.
+// Key order and number formatting of fields we do not touch are preserved.
+func normalize_function_url_response(response []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(response)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return response, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &fields); err != nil {
+		return nil, fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if _, ok := fields["statusCode"]; !ok {
+		return response, nil
+	}
+
+	changed := false
+
+	status_code, status_changed, err := normalize_status_code(fields["statusCode"])
+	if err != nil {
+		return nil, err
+	}
+	if status_changed {
+		fields["statusCode"] = status_code
+		changed = true
+	}
+
+	if raw, ok := fields["isBase64Encoded"]; ok {
+		normalized, was_changed, err := normalize_is_base64_encoded(raw)
+		if err != nil {
+			return nil, err
+		}
+		if was_changed {
+			fields["isBase64Encoded"] = normalized
+			changed = true
+		}
+	}
+
+	if raw, ok := fields["body"]; ok {
+		normalized, was_changed, err := normalize_body(raw)
+		if err != nil {
+			return nil, err
+		}
+		if was_changed {
+			fields["body"] = normalized
+			changed = true
+		}
+	}
+
+	var cookies []string
+	if raw, ok := fields["cookies"]; ok && !is_json_null(raw) {
+		if err := json.Unmarshal(raw, &cookies); err != nil {
+			return nil, fmt.Errorf("cookies must be an array of strings: %w", err)
+		}
+	}
+
+	headers, headers_changed, extra_cookies, err := normalize_headers(fields["headers"], fields["multiValueHeaders"])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fields["multiValueHeaders"]; ok {
+		// Format 2.0 has no multiValueHeaders; they were merged into headers above.
+		delete(fields, "multiValueHeaders")
+		changed = true
+	}
+	if headers_changed {
+		fields["headers"] = headers
+		changed = true
+	}
+	if len(extra_cookies) > 0 {
+		cookies = append(cookies, extra_cookies...)
+		encoded, err := json.Marshal(cookies)
+		if err != nil {
+			return nil, err
+		}
+		fields["cookies"] = encoded
+		changed = true
+	}
+
+	if !changed {
+		return response, nil
+	}
+	return json.Marshal(fields)
+}
+
+// normalize_status_code accepts an integer or a numeric string in the 100-599 range.
+func normalize_status_code(raw json.RawMessage) (json.RawMessage, bool, error) {
+	var code int
+	if err := json.Unmarshal(raw, &code); err == nil {
+		if code < 100 || code > 599 {
+			return nil, false, fmt.Errorf("statusCode %d is outside the valid HTTP range", code)
+		}
+		return raw, false, nil
+	}
+
+	var code_str string
+	if err := json.Unmarshal(raw, &code_str); err != nil {
+		return nil, false, fmt.Errorf("statusCode must be an integer, got %s", string(raw))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(code_str))
+	if err != nil || code < 100 || code > 599 {
+		return nil, false, fmt.Errorf("statusCode %q is not a valid HTTP status code", code_str)
+	}
+	return json.RawMessage(strconv.Itoa(code)), true, nil
+}
+
+// normalize_is_base64_encoded accepts a boolean or the strings "true"/"false".
+func normalize_is_base64_encoded(raw json.RawMessage) (json.RawMessage, bool, error) {
+	var flag bool
+	if err := json.Unmarshal(raw, &flag); err == nil {
+		return raw, false, nil
+	}
+	var flag_str string
+	if err := json.Unmarshal(raw, &flag_str); err == nil {
+		if parsed, err := strconv.ParseBool(flag_str); err == nil {
+			return json.RawMessage(strconv.FormatBool(parsed)), true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("isBase64Encoded must be a boolean, got %s", string(raw))
+}
+
+// normalize_body serializes non-string bodies, which Function URLs would reject.
+func normalize_body(raw json.RawMessage) (json.RawMessage, bool, error) {
+	if is_json_null(raw) {
+		return raw, false, nil
+	}
+	var body string
+	if err := json.Unmarshal(raw, &body); err == nil {
+		return raw, false, nil
+	}
+	encoded, err := json.Marshal(string(bytes.TrimSpace(raw)))
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, true, nil
+}
+
+// normalize_headers folds multi-value headers into the single-value map that
+// format 2.0 expects. Header names are matched case-insensitively and their
+// values comma-joined in order; a header in both maps takes its values from
+// multiValueHeaders, as API Gateway does. Set-Cookie values are returned
+// separately because 2.0 carries them in the cookies array.
+func normalize_headers(headers_raw json.RawMessage, multi_raw json.RawMessage) (json.RawMessage, bool, []string, error) {
+	headers := map[string]json.RawMessage{}
+	if len(headers_raw) > 0 && !is_json_null(headers_raw) {
+		if err := json.Unmarshal(headers_raw, &headers); err != nil {
+			return nil, false, nil, fmt.Errorf("headers must be an object: %w", err)
+		}
+	}
+
+	changed := false
+	single, err := fold_header_names(headers, func(name string, value json.RawMessage) ([]string, error) {
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			return []string{text}, nil
+		}
+		changed = true
+		return header_values(value)
+	})
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if len(single) != len(headers) {
+		changed = true
+	}
+
+	if len(multi_raw) > 0 && !is_json_null(multi_raw) {
+		var multi map[string]json.RawMessage
+		if err := json.Unmarshal(multi_raw, &multi); err != nil {
+			return nil, false, nil, fmt.Errorf("multiValueHeaders must map to string arrays: %w", err)
+		}
+		folded, err := fold_header_names(multi, func(name string, value json.RawMessage) ([]string, error) {
+			var values []string
+			if err := json.Unmarshal(value, &values); err != nil {
+				return nil, fmt.Errorf("multiValueHeaders must map to string arrays: %w", err)
+			}
+			return values, nil
+		})
+		if err != nil {
+			return nil, false, nil, err
+		}
+		for key, header := range folded {
+			single[key] = header
+		}
+		changed = true
+	}
+
+	var cookies []string
+	if header, ok := single["set-cookie"]; ok {
+		cookies = header.values
+		delete(single, "set-cookie")
+		changed = true
+	}
+	if !changed {
+		return headers_raw, false, nil, nil
+	}
+
+	normalized := make(map[string]string, len(single))
+	for _, header := range single {
+		normalized[header.name] = strings.Join(header.values, ",")
+	}
+	encoded, err := json.Marshal(normalized)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	log.Printf("%s Folded multi-value headers into format 2.0 headers (%d cookie(s) moved to cookies)", function_url_print_prefix, len(cookies))
+	return encoded, true, cookies, nil
+}
+
+// folded_header is one header after names differing only in case were merged.
+type folded_header struct {
+	name   string
+	values []string
+}
+
+// fold_header_names merges the headers whose names differ only in case, keyed
+// by the lowercased name. Names are visited in sorted order so the merged
+// values do not depend on map iteration.
+func fold_header_names(headers map[string]json.RawMessage, values_of func(name string, value json.RawMessage) ([]string, error)) (map[string]folded_header, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	folded := make(map[string]folded_header, len(headers))
+	for _, name := range names {
+		values, err := values_of(name, headers[name])
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %w", name, err)
+		}
+		key := strings.ToLower(name)
+		header, ok := folded[key]
+		if !ok {
+			header.name = name
+		}
+		header.values = append(header.values, values...)
+		folded[key] = header
+	}
+	return folded, nil
+}
+
+// header_values converts a header value that is an array, number, or boolean into strings.
+func header_values(raw json.RawMessage) ([]string, error) {
+	var list []interface{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		var scalar interface{}
+		if err := json.Unmarshal(raw, &scalar); err != nil {
+			return nil, err
+		}
+		list = []interface{}{scalar}
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		switch v := item.(type) {
+		case string:
+			values = append(values, v)
+		case float64, bool:
+			values = append(values, fmt.Sprint(v))
+		default:
+			return nil, fmt.Errorf("unsupported header value %v", item)
+		}
+	}
+	return values, nil
+}
+
+func is_json_null(raw json.RawMessage) bool {
+	return string(bytes.TrimSpace(raw)) == "null"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestIsPayloadFormatV2Event(t *testing.T) {
+	if !is_payload_format_v2_event([]byte(`{"version":"2.0","rawPath":"/"}`)) {
+		t.Error("expected version 2.0 event to be detected")
+	}
+	if is_payload_format_v2_event([]byte(`{"version":"1.0","path":"/"}`)) {
+		t.Error("expected version 1.0 event to be ignored")
+	}
+	if is_payload_format_v2_event([]byte(`not json`)) {
+		t.Error("expected non-JSON event to be ignored")
+	}
+}
+
+func TestNormalizeFunctionURLResponsePreservesValidResponse(t *testing.T) {
+	response := []byte(`{"statusCode":201,"cookies":["a=1; Path=/","b=2; HttpOnly"],"headers":{"content-type":"text/plain"},"body":"hi","isBase64Encoded":false}`)
+
+	normalized, err := normalize_function_url_response(response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(normalized) != string(response) {
+		t.Errorf("expected response to be byte-identical, got %s", normalized)
+	}
+}
+
+func TestNormalizeFunctionURLResponseLeavesNonHTTPShapes(t *testing.T) {
+	for _, response := range []string{`"plain string"`, `[1,2,3]`, `{"message":"no status code"}`} {
+		normalized, err := normalize_function_url_response([]byte(response))
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", response, err)
+		}
+		if string(normalized) != response {
+			t.Errorf("expected %s to be untouched, got %s", response, normalized)
+		}
+	}
+}
+
+func TestNormalizeFunctionURLResponseStatusCode(t *testing.T) {
+	normalized, err := normalize_function_url_response([]byte(`{"statusCode":"404","body":"missing"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields := decode_fields(t, normalized)
+	if fields["statusCode"] != float64(404) {
+		t.Errorf("expected numeric statusCode 404, got %#v", fields["statusCode"])
+	}
+
+	for _, response := range []string{`{"statusCode":99}`, `{"statusCode":"abc"}`, `{"statusCode":true}`} {
+		if _, err := normalize_function_url_response([]byte(response)); err == nil {
+			t.Errorf("expected %s to be rejected", response)
+		}
+	}
+}
+
+func TestNormalizeFunctionURLResponseIsBase64Encoded(t *testing.T) {
+	normalized, err := normalize_function_url_response([]byte(`{"statusCode":200,"body":"aGk=","isBase64Encoded":"true"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields := decode_fields(t, normalized)
+	if fields["isBase64Encoded"] != true {
+		t.Errorf("expected isBase64Encoded true, got %#v", fields["isBase64Encoded"])
+	}
+	if fields["body"] != "aGk=" {
+		t.Errorf("expected body to be preserved, got %#v", fields["body"])
+	}
+
+	if _, err := normalize_function_url_response([]byte(`{"statusCode":200,"isBase64Encoded":"maybe"}`)); err == nil {
+		t.Error("expected invalid isBase64Encoded to be rejected")
+	}
+}
+
+func TestNormalizeFunctionURLResponseSerializesObjectBody(t *testing.T) {
+	normalized, err := normalize_function_url_response([]byte(`{"statusCode":200,"body":{"b":1,"a":2}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields := decode_fields(t, normalized)
+	if fields["body"] != `{"b":1,"a":2}` {
+		t.Errorf("expected body serialized as string, got %#v", fields["body"])
+	}
+}
+
+func TestNormalizeFunctionURLResponseCookiesAndMultiValueHeaders(t *testing.T) {
+	response := []byte(`{
+		"statusCode": 200,
+		"cookies": ["session=abc; Secure"],
+		"headers": {"x-single": "one", "x-list": ["a", "b"]},
+		"multiValueHeaders": {"Set-Cookie": ["theme=dark", "lang=en"], "x-multi": ["c", "d"]},
+		"body": "ok"
+	}`)
+
+	normalized, err := normalize_function_url_response(response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields := decode_fields(t, normalized)
+
+	if _, ok := fields["multiValueHeaders"]; ok {
+		t.Error("expected multiValueHeaders to be removed")
+	}
+	want_cookies := []interface{}{"session=abc; Secure", "theme=dark", "lang=en"}
+	if !reflect.DeepEqual(fields["cookies"], want_cookies) {
+		t.Errorf("expected cookies %v, got %v", want_cookies, fields["cookies"])
+	}
+	want_headers := map[string]interface{}{"x-single": "one", "x-list": "a,b", "x-multi": "c,d"}
+	if !reflect.DeepEqual(fields["headers"], want_headers) {
+		t.Errorf("expected headers %v, got %v", want_headers, fields["headers"])
+	}
+}
+
+func TestNormalizeFunctionURLResponseFoldsHeaderNames(t *testing.T) {
+	response := []byte(`{
+		"statusCode": 200,
+		"headers": {"Content-Type": "text/plain", "x-both": "a", "X-Trace": "1", "x-trace": "2"},
+		"multiValueHeaders": {"X-Both": ["a"], "x-multi": ["c"], "X-Multi": ["d"]}
+	}`)
+
+	normalized, err := normalize_function_url_response(response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want_headers := map[string]interface{}{"Content-Type": "text/plain", "X-Both": "a", "X-Trace": "1,2", "X-Multi": "d,c"}
+	if headers := decode_fields(t, normalized)["headers"]; !reflect.DeepEqual(headers, want_headers) {
+		t.Errorf("expected headers %v, got %v", want_headers, headers)
+	}
+}
+
+func TestNormalizeFunctionURLResponseMovesEverySetCookie(t *testing.T) {
+	response := []byte(`{"statusCode": 200, "cookies": ["a=1"], "headers": {"Set-Cookie": "b=2", "x-single": "one"}}`)
+
+	normalized, err := normalize_function_url_response(response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields := decode_fields(t, normalized)
+	if want := []interface{}{"a=1", "b=2"}; !reflect.DeepEqual(fields["cookies"], want) {
+		t.Errorf("expected cookies %v, got %v", want, fields["cookies"])
+	}
+	if want := map[string]interface{}{"x-single": "one"}; !reflect.DeepEqual(fields["headers"], want) {
+		t.Errorf("expected headers %v, got %v", want, fields["headers"])
+	}
+
+	// Without a Set-Cookie, string headers are left as they are
+	plain := []byte(`{"statusCode":200,"headers":{"x-single":"one"}}`)
+	if normalized, _ := normalize_function_url_response(plain); string(normalized) != string(plain) {
+		t.Errorf("expected the response untouched, got %s", normalized)
+	}
+}
+
+func TestNormalizeFunctionURLResponseRejectsInvalidCookies(t *testing.T) {
+	if _, err := normalize_function_url_response([]byte(`{"statusCode":200,"cookies":"a=1"}`)); err == nil {
+		t.Error("expected non-array cookies to be rejected")
+	}
+}
+
+func decode_fields(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("normalized response is not valid JSON: %v", err)
+	}
+	return fields
+}
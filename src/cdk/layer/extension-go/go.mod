@@ -3,10 +3,10 @@ module live-lambda-extension-go
 go 1.24
 
 require (
-	github.com/aws/aws-sdk-go-v2 v1.36.3 // indirect
+	github.com/aws/aws-sdk-go-v2 v1.36.3
 	github.com/aws/aws-sdk-go-v2/config v1.29.14
-	github.com/aws/aws-sdk-go-v2/credentials v1.17.67 // indirect
-	nhooyr.io/websocket v1.8.11 // indirect
+	github.com/aws/aws-sdk-go-v2/credentials v1.17.67
+	nhooyr.io/websocket v1.8.11
 )
 
 require (
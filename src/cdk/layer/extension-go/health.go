@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The proxy listener also answers GET /livez and GET /healthz so the extension
+// can be debugged from inside the sandbox, e.g. by another extension or a test
+// harness. /livez answers 200 while the listener is serving. /healthz reports
+// the WebSocket connection, the last successful publish, in-flight invocations
+// and extension registration, and answers 503 until the extension is registered
+// and connected. Its runtime block (goroutines and heap) lets a soak test watch
+// for leaks across thousands of invocations.
+
+const (
+	livez_path   = "/livez"
+	healthz_path = "/healthz"
+)
+
+type health_state struct {
+	mu           sync.Mutex
+	registered   bool
+	last_publish time.Time
+}
+
+func new_health_state() *health_state {
+	return &health_state{}
+}
+
+// mark_registered records that the Extensions API accepted the registration.
+func (h *health_state) mark_registered() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.registered = true
+}
+
+// record_publish records a request successfully published to the agent.
+func (h *health_state) record_publish(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last_publish = at
+}
+
+func (h *health_state) snapshot() (registered bool, last_publish time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.registered, h.last_publish
+}
+
+// health_report describes the extension's state; healthy is false until it is
+// registered and, unless LIVE_LAMBDA_ENABLED is off, connected to AppSync.
+func (p *RuntimeAPIProxy) health_report(now time.Time) (report map[string]interface{}, healthy bool) {
+	registered, last_publish := p.health.snapshot()
+	connected := p.transport != nil && p.transport.IsConnected()
+	report = map[string]interface{}{
+		"registered":          registered,
+		"websocket_connected": connected,
+		"in_flight":           p.requests.in_flight(),
+		"agent_present":       p.presence.present(),
+		"extension_version":   extension_version,
+		"uptime_seconds":      int64(now.Sub(p.started_at).Seconds()),
+		"load_shedding":       p.shedder.active(),
+		"runtime":             runtime_report(),
+		"enabled":             p.config.Enabled,
+	}
+	if endpoint := p.failover.active_endpoint(); endpoint != "" {
+		report["endpoint"] = endpoint
+	}
+	if regions := p.regions.report(); regions != nil {
+		report["regions"] = regions
+	}
+	if !last_publish.IsZero() {
+		report["last_publish"] = last_publish.UTC().Format(time.RFC3339Nano)
+		report["seconds_since_last_publish"] = int64(now.Sub(last_publish).Seconds())
+	}
+	return report, registered && (connected || !p.config.Enabled)
+}
+
+// runtime_report describes the extension's goroutines and heap.
+func runtime_report() map[string]interface{} {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	return map[string]interface{}{
+		"goroutines":       runtime.NumGoroutine(),
+		"heap_alloc_bytes": memory.HeapAlloc,
+		"heap_objects":     memory.HeapObjects,
+		"gc_cycles":        memory.NumGC,
+	}
+}
+
+func (p *RuntimeAPIProxy) handle_livez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (p *RuntimeAPIProxy) handle_healthz(w http.ResponseWriter, r *http.Request) {
+	report, healthy := p.health_report(time.Now())
+	report["status"] = "ok"
+	status := http.StatusOK
+	if !healthy {
+		report["status"] = "unhealthy"
+		status = http.StatusServiceUnavailable
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthzReportsState(t *testing.T) {
+	p := &RuntimeAPIProxy{
+		requests:   new_request_tracker(),
+		health:     new_health_state(),
+		started_at: time.Now(),
+		config:     Config{Enabled: true},
+	}
+	router := p.router()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, healthz_path, nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before registration and connection, got %d", recorder.Code)
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("expected a JSON report: %v", err)
+	}
+	if report["status"] != "unhealthy" || report["registered"] != false || report["websocket_connected"] != false || report["in_flight"] != float64(0) {
+		t.Fatalf("unexpected report: %v", report)
+	}
+	if _, ok := report["last_publish"]; ok {
+		t.Fatal("last_publish should be omitted before the first publish")
+	}
+	if runtime_stats, ok := report["runtime"].(map[string]interface{}); !ok || runtime_stats["goroutines"].(float64) < 1 || runtime_stats["heap_alloc_bytes"].(float64) <= 0 {
+		t.Fatalf("expected goroutine and heap figures, got %v", report["runtime"])
+	}
+
+	p.health.mark_registered()
+	published := time.Now().Add(-3 * time.Second)
+	p.health.record_publish(published)
+	report, healthy := p.health_report(published.Add(3 * time.Second))
+	if healthy {
+		t.Fatal("expected a disconnected extension to be unhealthy")
+	}
+	if report["registered"] != true || report["seconds_since_last_publish"] != int64(3) {
+		t.Fatalf("unexpected report: %v", report)
+	}
+
+	p.config.Enabled = false
+	if report, healthy := p.health_report(time.Now()); !healthy || report["enabled"] != false {
+		t.Fatalf("expected a registered extension with %s off to be healthy without a connection, got %v", live_lambda_enabled_env, report)
+	}
+}
+
+func TestLivezAnswersWhileServing(t *testing.T) {
+	p := &RuntimeAPIProxy{}
+	recorder := httptest.NewRecorder()
+	p.router().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, livez_path, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Idempotency keys
+//
+// AppSync delivers at least once, and both sides retry: the extension
+// republishes a request when the fallback policy retries a publish or a
+// regional endpoint fails over, and the agent republishes a response when an
+// extension asks for it after a reconnect. Lambda itself can hand the sandbox
+// the same request ID again when it retries an invocation. Every message
+// about an invocation therefore carries
+//
+//	"idempotency_key": "<request_id>:<attempt>"
+//
+// where attempt counts the times this sandbox has intercepted the request ID,
+// from 1. Republishing a message keeps its key; only a new attempt changes it.
+// Request envelopes also carry sandbox_id, and the agent runs each key from a
+// sandbox once: a duplicate that arrives while the handler runs is dropped,
+// and one that arrives after it answered gets the kept response again. The
+// agent echoes the key in its response envelopes and control frames, and the
+// extension drops frames that answer another attempt than the one in flight.
+// Once an invocation is settled or over, later responses for it are logged
+// and dropped; see response_ordering.go. Frames without a key, from agents
+// that predate it, are accepted as before.
+
+const (
+	idempotency_key_field   = "idempotency_key"
+	max_remembered_attempts = 1024
+)
+
+// idempotency_key names one attempt at an invocation.
+func idempotency_key(request_id string, attempt int) string {
+	return fmt.Sprintf("%s:%d", request_id, attempt)
+}
+
+// attempt_counter counts the times each request ID was intercepted, for the
+// most recent max_remembered_attempts IDs. Lambda retries an invocation
+// within minutes, so older IDs are not needed. The request tracker guards it.
+type attempt_counter struct {
+	counts map[string]int
+	order  []string // oldest first
+}
+
+func new_attempt_counter() *attempt_counter {
+	return &attempt_counter{counts: map[string]int{}}
+}
+
+// next returns request_id's next attempt number.
+func (c *attempt_counter) next(request_id string) int {
+	attempt, seen := c.counts[request_id]
+	if !seen {
+		if len(c.order) == max_remembered_attempts {
+			delete(c.counts, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, request_id)
+	}
+	c.counts[request_id] = attempt + 1
+	return attempt + 1
+}
+
+// idempotency_key is the key of the attempt this request is.
+func (r *pending_request) idempotency_key() string {
+	return idempotency_key(r.request_id, r.attempt)
+}
+
+// answers_other_attempt reports whether frame carries the key of another
+// attempt at the invocation, and returns that key.
+func (r *pending_request) answers_other_attempt(frame []byte) (string, bool) {
+	key := frame_idempotency_key(frame)
+	return key, key != "" && key != r.idempotency_key()
+}
+
+// frame_idempotency_key returns frame's idempotency key, or "" without one.
+func frame_idempotency_key(frame []byte) string {
+	var probe struct {
+		IdempotencyKey string `json:"idempotency_key"`
+	}
+	if json.Unmarshal(frame, &probe) != nil {
+		return ""
+	}
+	return probe.IdempotencyKey
+}
+
+// add_idempotency_key adds the key of request_id's attempt in flight to a
+// message about it. Messages about requests no longer tracked go without.
+func (p *RuntimeAPIProxy) add_idempotency_key(message map[string]interface{}, request_id string) {
+	if request, ok := p.requests.lookup(request_id); ok {
+		message[idempotency_key_field] = request.idempotency_key()
+	}
+}
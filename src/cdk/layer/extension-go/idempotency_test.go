@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRequestTrackerCountsAttemptsPerRequestID(t *testing.T) {
+	tracker := new_request_tracker()
+	first, _ := tracker.register("req-1", nil, nil)
+	if key := first.idempotency_key(); key != "req-1:1" {
+		t.Fatalf("expected the first attempt to be req-1:1, got %s", key)
+	}
+	tracker.remove("req-1")
+	// Lambda retried the invocation into the same sandbox
+	second, _ := tracker.register("req-1", nil, nil)
+	if key := second.idempotency_key(); key != "req-1:2" {
+		t.Fatalf("expected the retry to be req-1:2, got %s", key)
+	}
+	other, _ := tracker.register("req-2", nil, nil)
+	if key := other.idempotency_key(); key != "req-2:1" {
+		t.Fatalf("expected another request ID to start at 1, got %s", key)
+	}
+}
+
+func TestAttemptCounterForgetsTheOldestRequestIDs(t *testing.T) {
+	counter := new_attempt_counter()
+	counter.next("req-0")
+	for i := 1; i <= max_remembered_attempts; i++ {
+		counter.next(fmt.Sprintf("req-%d", i))
+	}
+	if len(counter.counts) != max_remembered_attempts || len(counter.order) != max_remembered_attempts {
+		t.Fatalf("expected %d request IDs to be remembered, got %d", max_remembered_attempts, len(counter.counts))
+	}
+	if attempt := counter.next("req-0"); attempt != 1 {
+		t.Fatalf("expected the evicted request ID to start over, got attempt %d", attempt)
+	}
+	if attempt := counter.next(fmt.Sprintf("req-%d", max_remembered_attempts)); attempt != 2 {
+		t.Fatalf("expected a recent request ID to be counted, got attempt %d", attempt)
+	}
+}
+
+func TestRouteAgentResponseDropsOtherAttempts(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.requests.register("req-1", []byte(`{}`), nil)
+	proxy.requests.remove("req-1")
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+
+	envelope := func(key string, n int) map[string]interface{} {
+		return map[string]interface{}{
+			"type":                response_envelope_type,
+			"protocol_version":    2,
+			idempotency_key_field: key,
+			"body":                map[string]interface{}{"n": n},
+		}
+	}
+	// A late answer to the first attempt, then the answer to this one
+	proxy.route_agent_response("req-1", envelope("req-1:1", 1))
+	proxy.route_agent_response("req-1", envelope("req-1:2", 2))
+	// A duplicate delivery of the answer is a logged no-op
+	proxy.route_agent_response("req-1", envelope("req-1:2", 2))
+
+	select {
+	case posted := <-received:
+		if posted.body != `{"n":2}` {
+			t.Fatalf("expected the answer to the attempt in flight, got %s", posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+	select {
+	case extra := <-received:
+		t.Fatalf("unexpected extra post: %+v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if state := request.response_state(); state != response_responded {
+		t.Fatalf("expected the request to be responded, got %s", state)
+	}
+}
+
+func TestRouteAgentResponseAcceptsFramesWithoutAKey(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.requests.register("req-1", []byte(`{}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"n": 1})
+
+	select {
+	case posted := <-received:
+		if posted.body != `{"n":1}` {
+			t.Fatalf("unexpected response %s", posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+}
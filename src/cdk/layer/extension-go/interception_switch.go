@@ -0,0 +1,57 @@
+package main
+
+import "sync"
+
+// interception_switch decides whether invocations may be offered to the agent at
+// all. A hard disable (e.g. from function tags) cannot be undone at runtime; a
+// soft disable can be toggled back on.
+type interception_switch struct {
+	mu                   sync.RWMutex
+	hard_disabled_reason string
+	disabled_reason      string
+}
+
+func new_interception_switch() *interception_switch {
+	return &interception_switch{}
+}
+
+// disable_hard turns interception off for the lifetime of the sandbox.
+func (s *interception_switch) disable_hard(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hard_disabled_reason = reason
+}
+
+// disable turns interception off until enable is called.
+func (s *interception_switch) disable(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabled_reason = reason
+}
+
+// enable clears a soft disable. It has no effect on a hard disable.
+func (s *interception_switch) enable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabled_reason = ""
+}
+
+// enabled returns whether interception is allowed and, if not, why.
+func (s *interception_switch) enabled() (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.hard_disabled_reason != "" {
+		return false, s.hard_disabled_reason
+	}
+	if s.disabled_reason != "" {
+		return false, s.disabled_reason
+	}
+	return true, ""
+}
+
+// hard_disabled reports whether interception was turned off for good.
+func (s *interception_switch) hard_disabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hard_disabled_reason != ""
+}
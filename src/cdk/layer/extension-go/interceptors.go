@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Interceptors
+//
+// Code that changes what passes through the proxy registers an Interceptor at
+// startup instead of being patched into handle_next. The proxy runs every
+// registered interceptor, in registration order:
+//
+//   - OnEvent when the Runtime API hands out an event, before it is offered to
+//     the agent or passed to the function,
+//   - OnResponse before a response, from the function or the agent, is posted
+//     to the Runtime API,
+//   - OnError before an invocation error, from the function, the agent or the
+//     extension itself, is posted.
+//
+// An interceptor that returns an error is logged and skipped, and the next one
+// sees what the previous interceptors produced. Streamed responses are never
+// held in memory, so they bypass OnResponse. Embedders add interceptors with
+// WithInterceptor.
+//
+// Bodies are passed on as the bytes they arrived as. Decoding and re-encoding
+// JSON reorders keys, reformats numbers and drops whitespace, which breaks
+// anything that verifies a signature over the payload, such as SNS messages.
+// Only an interceptor that replaces a body changes it, and the old
+// re-encoding is kept as one, registered with LIVE_LAMBDA_REENCODE_EVENTS=on.
+
+// Invocation is what interceptors see of one invocation. OnEvent may replace
+// Event and change Headers, which the function receives as the /next response.
+type Invocation struct {
+	RequestID string
+	Event     []byte
+	Headers   http.Header
+	Deadline  time.Time
+}
+
+// Interceptor observes or changes invocations as they pass through the proxy.
+type Interceptor interface {
+	OnEvent(ctx context.Context, invocation *Invocation) error
+	// OnResponse returns the response body to post.
+	OnResponse(ctx context.Context, invocation *Invocation, response []byte) ([]byte, error)
+	// OnError returns the error body to post.
+	OnError(ctx context.Context, invocation *Invocation, error_body []byte) ([]byte, error)
+}
+
+type interceptor_chain struct {
+	mu           sync.Mutex
+	interceptors []Interceptor
+	invocations  map[string]*Invocation // by request ID, until the response or error is posted
+}
+
+func new_interceptor_chain(interceptors ...Interceptor) *interceptor_chain {
+	return &interceptor_chain{interceptors: interceptors, invocations: map[string]*Invocation{}}
+}
+
+// new_interceptor_chain_from_config returns the chain every proxy starts with,
+// which is empty unless events are re-encoded.
+func new_interceptor_chain_from_config(settings Config) *interceptor_chain {
+	if settings.ReencodeEvents {
+		component_logger(component_interceptors).Info("Re-encoding JSON object events")
+		return new_interceptor_chain(json_reencoding_interceptor{})
+	}
+	return new_interceptor_chain()
+}
+
+func (c *interceptor_chain) register(interceptor Interceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interceptors = append(c.interceptors, interceptor)
+}
+
+func (c *interceptor_chain) registered() []Interceptor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Interceptor(nil), c.interceptors...)
+}
+
+// on_event runs OnEvent and remembers the invocation for its response. A nil
+// chain leaves the invocation unchanged.
+func (c *interceptor_chain) on_event(ctx context.Context, invocation *Invocation) {
+	if c == nil {
+		return
+	}
+	if invocation.RequestID != "" {
+		c.mu.Lock()
+		// The runtime never answered invocations past their deadline
+		now := time.Now()
+		for request_id, tracked := range c.invocations {
+			if tracked.Deadline.Before(now) {
+				delete(c.invocations, request_id)
+			}
+		}
+		c.invocations[invocation.RequestID] = invocation
+		c.mu.Unlock()
+	}
+	for _, interceptor := range c.registered() {
+		if err := interceptor.OnEvent(ctx, invocation); err != nil {
+			request_logger(invocation.RequestID).Warn("Interceptor failed on the event", "interceptor", fmt.Sprintf("%T", interceptor), "error", err)
+		}
+	}
+}
+
+// on_response runs OnResponse and returns the response to post.
+func (c *interceptor_chain) on_response(ctx context.Context, request_id string, response []byte) []byte {
+	if c == nil {
+		return response
+	}
+	invocation := c.finish(request_id)
+	for _, interceptor := range c.registered() {
+		changed, err := interceptor.OnResponse(ctx, invocation, response)
+		if err != nil {
+			request_logger(request_id).Warn("Interceptor failed on the response", "interceptor", fmt.Sprintf("%T", interceptor), "error", err)
+			continue
+		}
+		response = changed
+	}
+	return response
+}
+
+// on_error runs OnError and returns the error body to post.
+func (c *interceptor_chain) on_error(ctx context.Context, request_id string, error_body []byte) []byte {
+	if c == nil {
+		return error_body
+	}
+	invocation := c.finish(request_id)
+	for _, interceptor := range c.registered() {
+		changed, err := interceptor.OnError(ctx, invocation, error_body)
+		if err != nil {
+			request_logger(request_id).Warn("Interceptor failed on the error", "interceptor", fmt.Sprintf("%T", interceptor), "error", err)
+			continue
+		}
+		error_body = changed
+	}
+	return error_body
+}
+
+// finish forgets request_id and returns its invocation. Invocations the chain
+// never saw, such as one that started before a restore, only carry the ID.
+func (c *interceptor_chain) finish(request_id string) *Invocation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	invocation, ok := c.invocations[request_id]
+	if !ok {
+		return &Invocation{RequestID: request_id, Headers: http.Header{}}
+	}
+	delete(c.invocations, request_id)
+	return invocation
+}
+
+// json_reencoding_interceptor decodes and re-encodes JSON object events. It is
+// registered first when LIVE_LAMBDA_REENCODE_EVENTS is on.
+type json_reencoding_interceptor struct{}
+
+func (json_reencoding_interceptor) OnEvent(ctx context.Context, invocation *Invocation) error {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(invocation.Event, &decoded); err != nil {
+		// Events are not always JSON objects; those pass unchanged
+		return nil
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	invocation.Event = encoded
+	return nil
+}
+
+func (json_reencoding_interceptor) OnResponse(ctx context.Context, invocation *Invocation, response []byte) ([]byte, error) {
+	return response, nil
+}
+
+func (json_reencoding_interceptor) OnError(ctx context.Context, invocation *Invocation, error_body []byte) ([]byte, error) {
+	return error_body, nil
+}
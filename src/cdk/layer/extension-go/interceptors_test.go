@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tagging_interceptor appends its tag to events, responses and errors.
+type tagging_interceptor struct {
+	tag  string
+	fail bool
+	seen []string
+}
+
+func (i *tagging_interceptor) OnEvent(ctx context.Context, invocation *Invocation) error {
+	if i.fail {
+		return errors.New("boom")
+	}
+	invocation.Event = append(invocation.Event, i.tag...)
+	invocation.Headers.Set("X-Tag", i.tag)
+	return nil
+}
+
+func (i *tagging_interceptor) OnResponse(ctx context.Context, invocation *Invocation, response []byte) ([]byte, error) {
+	if i.fail {
+		return nil, errors.New("boom")
+	}
+	i.seen = append(i.seen, string(invocation.Event))
+	return append(response, i.tag...), nil
+}
+
+func (i *tagging_interceptor) OnError(ctx context.Context, invocation *Invocation, error_body []byte) ([]byte, error) {
+	return append(error_body, i.tag...), nil
+}
+
+func TestInterceptorChainRunsInOrderAndSkipsFailures(t *testing.T) {
+	first, failing, last := &tagging_interceptor{tag: "a"}, &tagging_interceptor{tag: "x", fail: true}, &tagging_interceptor{tag: "b"}
+	chain := new_interceptor_chain(first, failing)
+	chain.register(last)
+
+	invocation := &Invocation{RequestID: "req-1", Event: []byte("event:"), Headers: http.Header{}, Deadline: time.Now().Add(time.Minute)}
+	chain.on_event(context.Background(), invocation)
+	if string(invocation.Event) != "event:ab" || invocation.Headers.Get("X-Tag") != "b" {
+		t.Fatalf("unexpected invocation %q %v", invocation.Event, invocation.Headers)
+	}
+
+	if response := chain.on_response(context.Background(), "req-1", []byte("response:")); string(response) != "response:ab" {
+		t.Fatalf("unexpected response %q", response)
+	}
+	if len(last.seen) != 1 || last.seen[0] != "event:ab" {
+		t.Fatalf("expected the response hook to see the invocation's event, got %v", last.seen)
+	}
+	if _, tracked := chain.invocations["req-1"]; tracked {
+		t.Fatal("expected the invocation to be forgotten once answered")
+	}
+	if body := chain.on_error(context.Background(), "req-unknown", []byte("error:")); string(body) != "error:axb" {
+		t.Fatalf("unexpected error body %q", body)
+	}
+
+	var disabled *interceptor_chain
+	if response := disabled.on_response(context.Background(), "req-2", []byte("unchanged")); string(response) != "unchanged" {
+		t.Fatalf("expected a nil chain to leave responses unchanged, got %q", response)
+	}
+}
+
+func TestInterceptorChainForgetsExpiredInvocations(t *testing.T) {
+	chain := new_interceptor_chain()
+	chain.on_event(context.Background(), &Invocation{RequestID: "req-old", Headers: http.Header{}, Deadline: time.Now().Add(-time.Second)})
+	chain.on_event(context.Background(), &Invocation{RequestID: "req-new", Headers: http.Header{}, Deadline: time.Now().Add(time.Minute)})
+	if _, tracked := chain.invocations["req-old"]; tracked || len(chain.invocations) != 1 {
+		t.Fatalf("expected only the live invocation to be tracked, got %v", chain.invocations)
+	}
+}
+
+func TestJSONReencodingInterceptor(t *testing.T) {
+	invocation := &Invocation{Event: []byte(`{ "b": 1, "a": 2 }`)}
+	json_reencoding_interceptor{}.OnEvent(context.Background(), invocation)
+	if string(invocation.Event) != `{"a":2,"b":1}` {
+		t.Fatalf("unexpected event %s", invocation.Event)
+	}
+	invocation.Event = []byte("not json")
+	json_reencoding_interceptor{}.OnEvent(context.Background(), invocation)
+	if string(invocation.Event) != "not json" {
+		t.Fatalf("expected non-JSON events to pass unchanged, got %s", invocation.Event)
+	}
+}
+
+func TestDefaultInterceptorChainKeepsEventBytes(t *testing.T) {
+	event := `{ "Message": "1.50", "b": 1e3, "a": 2 }`
+	invocation := &Invocation{RequestID: "req-1", Event: []byte(event), Headers: http.Header{}, Deadline: time.Now().Add(time.Minute)}
+	new_interceptor_chain_from_config(default_config()).on_event(context.Background(), invocation)
+	if string(invocation.Event) != event {
+		t.Fatalf("expected the event's bytes unchanged, got %s", invocation.Event)
+	}
+
+	settings := default_config()
+	settings.ReencodeEvents = true
+	if registered := new_interceptor_chain_from_config(settings).registered(); len(registered) != 1 {
+		t.Fatalf("expected the re-encoding interceptor to be registered, got %v", registered)
+	}
+}
+
+func TestRouterRunsInterceptorsOnPassThrough(t *testing.T) {
+	posted := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/next") {
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", "req-1")
+			w.Write([]byte("event:"))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		posted <- string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	previous := aws_lambda_runtime_api
+	aws_lambda_runtime_api = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { aws_lambda_runtime_api = previous })
+
+	proxy := new_tracking_proxy()
+	proxy.interception = new_interception_switch()
+	proxy.interceptors = new_interceptor_chain(&tagging_interceptor{tag: "a"})
+	router := proxy.router()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/2018-06-01/runtime/invocation/next", nil))
+	if recorder.Body.String() != "event:a" || recorder.Header().Get("X-Tag") != "a" {
+		t.Fatalf("expected the function to receive the intercepted event, got %q %v", recorder.Body.String(), recorder.Header())
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/2018-06-01/runtime/invocation/req-1/response", bytes.NewReader([]byte("response:"))))
+	select {
+	case body := <-posted:
+		if body != "response:a" {
+			t.Fatalf("expected the function's response to pass through the chain, got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+}
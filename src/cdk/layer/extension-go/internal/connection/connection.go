@@ -0,0 +1,134 @@
+// Package connection holds the AppSync Events settings and connection setup
+// the commands share, so each command dials the API the same way the
+// extension does.
+package connection
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+const (
+	DefaultNamespace        = "live-lambda"
+	DefaultRequestsChannel  = "requests"
+	DefaultResponseChannel  = "response/{request_id}"
+	RequestIDPlaceholder    = "{request_id}"
+	DefaultOperationTimeout = 30 * time.Second
+)
+
+// Options are the AppSync settings, defaulting to the same environment
+// variables the extension reads.
+type Options struct {
+	HTTPHost         string
+	RealtimeHost     string
+	Region           string
+	Namespace        string
+	ChannelScope     string        // segments between the namespace and each channel, as the extension rendered LIVE_LAMBDA_CHANNEL_SCOPE
+	RequestsChannel  string        // as the extension rendered LIVE_LAMBDA_REQUESTS_CHANNEL; DefaultRequestsChannel when empty
+	ResponseChannel  string        // as the extension rendered LIVE_LAMBDA_RESPONSE_CHANNEL, ending in {request_id}; DefaultResponseChannel when empty
+	OperationTimeout time.Duration // per subscribe and publish; DefaultOperationTimeout when zero
+}
+
+// AddFlags registers the connection flags on flags.
+func (o *Options) AddFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.HTTPHost, "http-host", os.Getenv("LIVE_LAMBDA_APPSYNC_HTTP_HOST"), "AppSync Events HTTP host")
+	flags.StringVar(&o.RealtimeHost, "realtime-host", os.Getenv("LIVE_LAMBDA_APPSYNC_REALTIME_HOST"), "AppSync Events realtime host")
+	flags.StringVar(&o.Region, "region", os.Getenv("LIVE_LAMBDA_APPSYNC_REGION"), "AppSync region")
+	flags.StringVar(&o.Namespace, "namespace", os.Getenv("LIVE_LAMBDA_APPSYNC_NAMESPACE"), "channel namespace, e.g. live-lambda-dev for the dev stage (defaults to live-lambda)")
+	flags.StringVar(&o.ChannelScope, "channel-scope", "", "channel scope the functions render LIVE_LAMBDA_CHANNEL_SCOPE to, e.g. orders/alice")
+	flags.StringVar(&o.RequestsChannel, "requests-channel", DefaultRequestsChannel, "requests channel the functions render LIVE_LAMBDA_REQUESTS_CHANNEL to")
+	flags.StringVar(&o.ResponseChannel, "response-channel", DefaultResponseChannel, "response channel the functions render LIVE_LAMBDA_RESPONSE_CHANNEL to, ending in {request_id}")
+}
+
+// Validate checks the required settings and fills in the defaults.
+func (o *Options) Validate() error {
+	if o.HTTPHost == "" || o.RealtimeHost == "" {
+		return fmt.Errorf("--http-host and --realtime-host (or LIVE_LAMBDA_APPSYNC_HTTP_HOST and LIVE_LAMBDA_APPSYNC_REALTIME_HOST) are required")
+	}
+	if o.Region == "" {
+		o.Region = os.Getenv("AWS_REGION")
+	}
+	if o.Namespace == "" {
+		o.Namespace = DefaultNamespace
+	}
+	o.ChannelScope = strings.Trim(o.ChannelScope, "/")
+	o.RequestsChannel = strings.Trim(o.RequestsChannel, "/")
+	o.ResponseChannel = strings.Trim(o.ResponseChannel, "/")
+	if o.Region == "" {
+		return fmt.Errorf("--region (or LIVE_LAMBDA_APPSYNC_REGION / AWS_REGION) is required")
+	}
+	if o.ResponseChannel != "" && !strings.HasSuffix(o.ResponseChannel, "/"+RequestIDPlaceholder) {
+		return fmt.Errorf("--response-channel must end in a %s segment, got %q", RequestIDPlaceholder, o.ResponseChannel)
+	}
+	return nil
+}
+
+// Channel returns a channel path in the configured namespace and channel scope.
+func (o Options) Channel(format string, args ...interface{}) string {
+	if o.ChannelScope != "" {
+		return o.Namespace + "/" + o.ChannelScope + "/" + fmt.Sprintf(format, args...)
+	}
+	return o.Namespace + "/" + fmt.Sprintf(format, args...)
+}
+
+// RequestsTopic returns the channel extensions publish invocations on.
+func (o Options) RequestsTopic() string {
+	if o.RequestsChannel == "" {
+		return o.Channel("%s", DefaultRequestsChannel)
+	}
+	return o.Channel("%s", o.RequestsChannel)
+}
+
+// ResponseTopic returns the channel the agent answers request_id on.
+func (o Options) ResponseTopic(request_id string) string {
+	response := o.ResponseChannel
+	if response == "" {
+		response = DefaultResponseChannel
+	}
+	return o.Channel("%s", strings.Replace(response, RequestIDPlaceholder, request_id, 1))
+}
+
+// LoadAWSConfig loads the default AWS credential chain for the connection's region.
+func LoadAWSConfig(ctx context.Context, o Options) (aws.Config, error) {
+	aws_cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(o.Region))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return aws_cfg, nil
+}
+
+// Connect opens a WebSocket to the AppSync Events API using the default AWS credential chain.
+func Connect(ctx context.Context, o Options) (*appsyncwsclient.Client, error) {
+	aws_cfg, err := LoadAWSConfig(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	operation_timeout := o.OperationTimeout
+	if operation_timeout <= 0 {
+		operation_timeout = DefaultOperationTimeout
+	}
+	client, err := appsyncwsclient.NewClient(appsyncwsclient.ClientOptions{
+		AppSyncAPIHost:      o.HTTPHost,
+		AppSyncRealtimeHost: o.RealtimeHost,
+		AWSRegion:           o.Region,
+		AWSCfg:              aws_cfg,
+		KeepAliveInterval:   2 * time.Minute,
+		ReadTimeout:         10 * time.Minute,
+		OperationTimeout:    operation_timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AppSync WebSocket client: %w", err)
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to AppSync: %w", err)
+	}
+	return client, nil
+}
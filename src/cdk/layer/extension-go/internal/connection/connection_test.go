@@ -0,0 +1,41 @@
+package connection
+
+import "testing"
+
+func TestValidateFillsDefaults(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	o := Options{HTTPHost: "a.appsync-api.eu-west-1.amazonaws.com", RealtimeHost: "a.appsync-realtime-api.eu-west-1.amazonaws.com", ChannelScope: "/orders/alice/"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if o.Region != "eu-west-1" || o.Namespace != DefaultNamespace || o.ChannelScope != "orders/alice" {
+		t.Fatalf("unexpected defaults: %+v", o)
+	}
+	if got := o.Channel("response/%s", "req-1"); got != "live-lambda/orders/alice/response/req-1" {
+		t.Fatalf("unexpected channel %q", got)
+	}
+}
+
+func TestValidateRequiresHosts(t *testing.T) {
+	o := Options{Region: "eu-west-1"}
+	if err := o.Validate(); err == nil {
+		t.Fatal("expected missing hosts to fail")
+	}
+}
+
+func TestRequestsAndResponseTopics(t *testing.T) {
+	o := Options{HTTPHost: "h", RealtimeHost: "r", Region: "eu-west-1", ChannelScope: "alice", RequestsChannel: "/invocations/orders/", ResponseChannel: "answers/{request_id}"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if o.RequestsTopic() != "live-lambda/alice/invocations/orders" || o.ResponseTopic("req-1") != "live-lambda/alice/answers/req-1" {
+		t.Fatalf("unexpected channels %s, %s", o.RequestsTopic(), o.ResponseTopic("req-1"))
+	}
+	if (Options{Namespace: DefaultNamespace}).ResponseTopic("req-1") != "live-lambda/response/req-1" {
+		t.Fatal("expected the default response channel without configuration")
+	}
+	o.ResponseChannel = "answers"
+	if err := o.Validate(); err == nil {
+		t.Fatal("expected a response channel without {request_id} to fail")
+	}
+}
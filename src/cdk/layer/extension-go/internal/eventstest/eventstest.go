@@ -0,0 +1,447 @@
+// Package eventstest is a stand-in for the AppSync Events API, for tests and
+// harnesses that need the extension's real WebSocket path without AWS. It
+// speaks enough of the Events realtime protocol for the extension and the
+// agents: connection_init and connection_ack, subscribe and unsubscribe,
+// publish, and ka keep-alives. Published events are fanned out to matching
+// subscriptions, and can be watched or answered in process through OnPublish
+// and Publish.
+package eventstest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	Subprotocol  = "aws-appsync-event-ws"
+	RealtimePath = "/event/realtime"
+
+	DefaultKeepAliveInterval = time.Minute
+	ConnectionTimeout        = 5 * time.Minute // sent in connection_ack
+
+	write_timeout     = 5 * time.Second
+	max_message_bytes = 1 << 20
+	header_prefix     = "header-"
+)
+
+// Message types of the Events WebSocket protocol.
+const (
+	ConnectionInitType   = "connection_init"
+	ConnectionAckType    = "connection_ack"
+	ConnectionErrorType  = "connection_error"
+	SubscribeType        = "subscribe"
+	SubscribeSuccessType = "subscribe_success"
+	SubscribeErrorType   = "subscribe_error"
+	UnsubscribeType      = "unsubscribe"
+	UnsubscribeOKType    = "unsubscribe_success"
+	PublishType          = "publish"
+	PublishSuccessType   = "publish_success"
+	PublishErrorType     = "publish_error"
+	DataType             = "data"
+	KeepAliveType        = "ka"
+	ErrorType            = "error"
+)
+
+// Message is a message of the Events WebSocket protocol.
+type Message struct {
+	Type                string            `json:"type"`
+	ID                  string            `json:"id,omitempty"`
+	Channel             string            `json:"channel,omitempty"`
+	Events              []string          `json:"events,omitempty"`
+	Event               json.RawMessage   `json:"event,omitempty"`
+	Authorization       map[string]string `json:"authorization,omitempty"`
+	ConnectionTimeoutMs int               `json:"connectionTimeoutMs,omitempty"`
+	Errors              []Error           `json:"errors,omitempty"`
+}
+
+// Error is an entry of a message's errors.
+type Error struct {
+	ErrorType string `json:"errorType"`
+	Message   string `json:"message"`
+}
+
+// Options configure a Server.
+type Options struct {
+	// KeepAliveInterval is how often ka is sent; DefaultKeepAliveInterval when zero
+	KeepAliveInterval time.Duration
+	// TLS serves wss:// with a self-signed certificate, as the AppSync client
+	// only dials wss://; see Client and WriteCertificate
+	TLS bool
+	// APIKey, when set, must be the x-api-key of the handshake and of every
+	// subscribe and publish. Otherwise any authorization is accepted.
+	APIKey string
+}
+
+// Server is a running fake Events API.
+type Server struct {
+	server  *httptest.Server
+	options Options
+
+	mu          sync.Mutex
+	conns       map[*conn]bool
+	on_publish  func(channel string, event json.RawMessage)
+	handler     func(channel string, event json.RawMessage) json.RawMessage
+	published   map[string][]json.RawMessage
+	rejecting   string
+	unavailable string
+}
+
+// conn is one client connection and its subscriptions.
+type conn struct {
+	ws            *websocket.Conn
+	write_mu      sync.Mutex
+	subscriptions map[string]string // subscription ID to channel, guarded by the server's mu
+}
+
+func (c *conn) write(message Message) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), write_timeout)
+	defer cancel()
+	c.write_mu.Lock()
+	defer c.write_mu.Unlock()
+	return c.ws.Write(ctx, websocket.MessageText, encoded)
+}
+
+// NewServer starts a server on a loopback port.
+func NewServer(options Options) *Server {
+	if options.KeepAliveInterval <= 0 {
+		options.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+	s := &Server{options: options, conns: map[*conn]bool{}, published: map[string][]json.RawMessage{}}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	if options.TLS {
+		s.server.StartTLS()
+	} else {
+		s.server.Start()
+	}
+	return s
+}
+
+// Host is the host:port to use for both Events API hosts.
+func (s *Server) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(s.server.URL, "https://"), "http://")
+}
+
+// RealtimeURL is the WebSocket URL clients dial.
+func (s *Server) RealtimeURL() string {
+	if s.options.TLS {
+		return "wss://" + s.Host() + RealtimePath
+	}
+	return "ws://" + s.Host() + RealtimePath
+}
+
+// Client returns an HTTP client that trusts the server's certificate, for
+// websocket.DialOptions.
+func (s *Server) Client() *http.Client {
+	return s.server.Client()
+}
+
+// Certificate is the server's TLS certificate, for a client's RootCAs.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.server.Certificate()
+}
+
+// WriteCertificate writes the TLS certificate as PEM, for SSL_CERT_FILE in a
+// process that dials the server.
+func (s *Server) WriteCertificate(path string) error {
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+	return os.WriteFile(path, encoded, 0o600)
+}
+
+// Close drops every connection and stops the server.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.server.Close()
+}
+
+// OnPublish calls handle with each event a client publishes, after it has been
+// fanned out to the subscriptions. channel has no leading slash.
+func (s *Server) OnPublish(handle func(channel string, event json.RawMessage)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.on_publish = handle
+}
+
+// Published returns the events clients have published on channel, oldest
+// first. channel has no leading slash.
+func (s *Server) Published(channel string) []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage(nil), s.published[channel]...)
+}
+
+// HandlePublish rewrites each event clients publish with handler before it is
+// delivered, the way a channel namespace's onPublish handler does. Published
+// still returns the events as the clients sent them.
+func (s *Server) HandlePublish(handler func(channel string, event json.RawMessage) json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+// RejectPublishes answers every publish with a publish_error carrying reason,
+// the way the Events API refuses them during an outage, until it is called
+// with an empty reason.
+func (s *Server) RejectPublishes(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejecting = reason
+}
+
+// SetUnavailable ends every connection with a connection_error carrying
+// reason and refuses new ones, the way an Events API endpoint fails during a
+// regional outage, until it is called with an empty reason. It returns once the
+// clients have answered the close handshakes.
+func (s *Server) SetUnavailable(reason string) {
+	s.mu.Lock()
+	s.unavailable = reason
+	conns := make([]*conn, 0, len(s.conns))
+	if reason != "" {
+		for c := range s.conns {
+			conns = append(conns, c)
+			delete(s.conns, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.write(Message{Type: ConnectionErrorType, Errors: []Error{{ErrorType: "ServiceUnavailable", Message: reason}}})
+		c.ws.Close(websocket.StatusGoingAway, reason)
+	}
+}
+
+// Counts returns the live connections and subscriptions.
+func (s *Server) Counts() (connections int, subscriptions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		subscriptions += len(c.subscriptions)
+	}
+	return len(s.conns), subscriptions
+}
+
+// DropConnections closes every connection without a close handshake, the way
+// a connection dies while its sandbox is frozen.
+func (s *Server) DropConnections() int {
+	s.mu.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+		delete(s.conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.ws.CloseNow()
+	}
+	return len(conns)
+}
+
+// ChannelMatches reports whether a subscription to pattern receives events
+// published on channel. A trailing /* matches any deeper channel.
+func ChannelMatches(pattern string, channel string) bool {
+	pattern, channel = strings.TrimPrefix(pattern, "/"), strings.TrimPrefix(channel, "/")
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(channel, prefix)
+	}
+	return pattern == channel
+}
+
+// Publish delivers events to every subscription matching channel, as if
+// another client had published them.
+func (s *Server) Publish(channel string, events ...interface{}) {
+	encoded := make([]string, 0, len(events))
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		encoded = append(encoded, string(body))
+	}
+	s.deliver(channel, encoded)
+}
+
+func (s *Server) deliver(channel string, events []string) {
+	type delivery struct {
+		conn *conn
+		id   string
+	}
+	var deliveries []delivery
+	s.mu.Lock()
+	for c := range s.conns {
+		for id, pattern := range c.subscriptions {
+			if ChannelMatches(pattern, channel) {
+				deliveries = append(deliveries, delivery{conn: c, id: id})
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, d := range deliveries {
+		for _, event := range events {
+			// The Events API delivers each event as a JSON string
+			encoded, _ := json.Marshal(event)
+			d.conn.write(Message{Type: DataType, ID: d.id, Event: encoded})
+		}
+	}
+}
+
+// authorized reports whether headers carry the API key, when one is required.
+func (s *Server) authorized(headers map[string]string) bool {
+	return s.options.APIKey == "" || headers["x-api-key"] == s.options.APIKey
+}
+
+// handshake_headers decodes the headers a client sent in its header-<...> subprotocol.
+func handshake_headers(r *http.Request) map[string]string {
+	for _, offered := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		encoded, ok := strings.CutPrefix(strings.TrimSpace(offered), header_prefix)
+		if !ok {
+			continue
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil
+		}
+		var headers map[string]string
+		json.Unmarshal(decoded, &headers)
+		return headers
+	}
+	return nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != RealtimePath {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(handshake_headers(r)) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	unavailable := s.unavailable
+	s.mu.Unlock()
+	if unavailable != "" {
+		http.Error(w, unavailable, http.StatusServiceUnavailable)
+		return
+	}
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{Subprotocol}})
+	if err != nil {
+		return
+	}
+	if ws.Subprotocol() != Subprotocol {
+		ws.Close(websocket.StatusPolicyViolation, "the "+Subprotocol+" subprotocol is required")
+		return
+	}
+	ws.SetReadLimit(max_message_bytes)
+	c := &conn{ws: ws, subscriptions: map[string]string{}}
+	s.mu.Lock()
+	s.conns[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		ws.CloseNow()
+	}()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go s.keep_alive(ctx, c)
+	for {
+		_, data, err := ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			c.write(Message{Type: ErrorType, Errors: []Error{{ErrorType: "BadRequest", Message: err.Error()}}})
+			continue
+		}
+		s.handle_message(c, message)
+	}
+}
+
+func (s *Server) handle_message(c *conn, message Message) {
+	switch message.Type {
+	case ConnectionInitType:
+		c.write(Message{Type: ConnectionAckType, ConnectionTimeoutMs: int(ConnectionTimeout / time.Millisecond)})
+	case SubscribeType:
+		if !s.authorized(message.Authorization) {
+			c.write(Message{Type: SubscribeErrorType, ID: message.ID, Errors: []Error{{ErrorType: "UnauthorizedException", Message: "invalid API key"}}})
+			return
+		}
+		s.mu.Lock()
+		c.subscriptions[message.ID] = message.Channel
+		s.mu.Unlock()
+		c.write(Message{Type: SubscribeSuccessType, ID: message.ID})
+	case UnsubscribeType:
+		s.mu.Lock()
+		delete(c.subscriptions, message.ID)
+		s.mu.Unlock()
+		c.write(Message{Type: UnsubscribeOKType, ID: message.ID})
+	case PublishType:
+		if !s.authorized(message.Authorization) {
+			c.write(Message{Type: PublishErrorType, ID: message.ID, Errors: []Error{{ErrorType: "UnauthorizedException", Message: "invalid API key"}}})
+			return
+		}
+		s.mu.Lock()
+		rejecting := s.rejecting
+		s.mu.Unlock()
+		if rejecting != "" {
+			c.write(Message{Type: PublishErrorType, ID: message.ID, Errors: []Error{{ErrorType: "ServiceUnavailable", Message: rejecting}}})
+			return
+		}
+		c.write(Message{Type: PublishSuccessType, ID: message.ID})
+		channel := strings.TrimPrefix(message.Channel, "/")
+		s.mu.Lock()
+		handler := s.handler
+		s.mu.Unlock()
+		delivered := message.Events
+		if handler != nil {
+			delivered = make([]string, 0, len(message.Events))
+			for _, event := range message.Events {
+				delivered = append(delivered, string(handler(channel, json.RawMessage(event))))
+			}
+		}
+		s.deliver(message.Channel, delivered)
+		s.mu.Lock()
+		for _, event := range message.Events {
+			s.published[channel] = append(s.published[channel], json.RawMessage(event))
+		}
+		on_publish := s.on_publish
+		s.mu.Unlock()
+		if on_publish != nil {
+			for _, event := range message.Events {
+				on_publish(channel, json.RawMessage(event))
+			}
+		}
+	default:
+		c.write(Message{Type: ErrorType, ID: message.ID, Errors: []Error{{ErrorType: "UnsupportedOperation", Message: message.Type}}})
+	}
+}
+
+// keep_alive sends ka messages until ctx is done.
+func (s *Server) keep_alive(ctx context.Context, c *conn) {
+	ticker := time.NewTicker(s.options.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.write(Message{Type: KeepAliveType})
+		}
+	}
+}
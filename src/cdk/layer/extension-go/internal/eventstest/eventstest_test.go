@@ -0,0 +1,166 @@
+package eventstest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestChannelMatches(t *testing.T) {
+	for _, c := range []struct {
+		pattern, channel string
+		matches          bool
+	}{
+		{"live-lambda/requests", "live-lambda/requests", true},
+		{"/live-lambda/requests", "live-lambda/requests", true},
+		{"live-lambda/*", "live-lambda/response/r1", true},
+		{"live-lambda/response/r1", "live-lambda/response/r2", false},
+		{"live-lambda/*", "other/requests", false},
+	} {
+		if got := ChannelMatches(c.pattern, c.channel); got != c.matches {
+			t.Errorf("ChannelMatches(%q, %q) = %v", c.pattern, c.channel, got)
+		}
+	}
+}
+
+func dial(t *testing.T, ctx context.Context, server *Server, headers string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.Dial(ctx, server.RealtimeURL(), &websocket.DialOptions{
+		HTTPClient:   server.Client(),
+		Subprotocols: []string{"header-" + base64.RawURLEncoding.EncodeToString([]byte(headers)), Subprotocol},
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+func exchange(t *testing.T, ctx context.Context, conn *websocket.Conn, message Message, reply_type string) Message {
+	encoded, _ := json.Marshal(message)
+	if err := conn.Write(ctx, websocket.MessageText, encoded); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return read_until(t, ctx, conn, reply_type)
+}
+
+// read_until returns the next message of reply_type.
+func read_until(t *testing.T, ctx context.Context, conn *websocket.Conn, reply_type string) Message {
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", reply_type, err)
+		}
+		var reply Message
+		json.Unmarshal(data, &reply)
+		if reply.Type == reply_type {
+			return reply
+		}
+	}
+}
+
+func TestServerSubscribesAndPublishes(t *testing.T) {
+	server := NewServer(Options{TLS: true})
+	defer server.Close()
+	published := make(chan string, 1)
+	server.OnPublish(func(channel string, event json.RawMessage) { published <- channel + " " + string(event) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dial(t, ctx, server, "{}")
+	defer conn.CloseNow()
+
+	if ack := exchange(t, ctx, conn, Message{Type: "connection_init"}, "connection_ack"); ack.ConnectionTimeoutMs == 0 {
+		t.Fatal("expected a connection timeout in the ack")
+	}
+	exchange(t, ctx, conn, Message{Type: "subscribe", ID: "s1", Channel: "live-lambda/response/r1"}, "subscribe_success")
+	if connections, subscriptions := server.Counts(); connections != 1 || subscriptions != 1 {
+		t.Fatalf("expected 1 connection and 1 subscription, got %d and %d", connections, subscriptions)
+	}
+
+	exchange(t, ctx, conn, Message{Type: "publish", ID: "p1", Channel: "/live-lambda/requests", Events: []string{`{"request_id":"r1"}`}}, "publish_success")
+	if got := <-published; got != `live-lambda/requests {"request_id":"r1"}` {
+		t.Fatalf("unexpected publish %q", got)
+	}
+	server.Publish("live-lambda/response/r1", map[string]string{"body": "ok"})
+	data := exchange(t, ctx, conn, Message{Type: "unsubscribe", ID: "s1"}, "data")
+	var event string
+	if json.Unmarshal(data.Event, &event) != nil || event != `{"body":"ok"}` || data.ID != "s1" {
+		t.Fatalf("expected the event as a JSON string on s1, got %+v", data)
+	}
+
+	if dropped := server.DropConnections(); dropped != 1 {
+		t.Fatalf("expected to drop 1 connection, dropped %d", dropped)
+	}
+	if _, _, err := conn.Read(ctx); err == nil {
+		t.Fatal("expected the dropped connection to fail")
+	}
+}
+
+func TestServerRequiresTheAPIKey(t *testing.T) {
+	server := NewServer(Options{APIKey: "da2-key"})
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, _, err := websocket.Dial(ctx, server.RealtimeURL(), &websocket.DialOptions{Subprotocols: []string{Subprotocol}}); err == nil {
+		t.Fatal("expected a handshake without the key to be refused")
+	}
+	conn := dial(t, ctx, server, `{"x-api-key":"da2-key"}`)
+	defer conn.CloseNow()
+	exchange(t, ctx, conn, Message{Type: ConnectionInitType}, ConnectionAckType)
+	exchange(t, ctx, conn, Message{Type: SubscribeType, ID: "s1", Channel: "live-lambda/requests"}, SubscribeErrorType)
+	exchange(t, ctx, conn, Message{Type: SubscribeType, ID: "s2", Channel: "live-lambda/requests", Authorization: map[string]string{"x-api-key": "da2-key"}}, SubscribeSuccessType)
+}
+
+func TestServerRewritesAndRecordsPublishes(t *testing.T) {
+	server := NewServer(Options{})
+	defer server.Close()
+	server.HandlePublish(func(channel string, event json.RawMessage) json.RawMessage {
+		return json.RawMessage(`{"stamped":true}`)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dial(t, ctx, server, "{}")
+	defer conn.CloseNow()
+	exchange(t, ctx, conn, Message{Type: ConnectionInitType}, ConnectionAckType)
+	exchange(t, ctx, conn, Message{Type: SubscribeType, ID: "s1", Channel: "live-lambda/requests"}, SubscribeSuccessType)
+
+	exchange(t, ctx, conn, Message{Type: PublishType, ID: "p1", Channel: "/live-lambda/requests", Events: []string{`{"n":1}`}}, PublishSuccessType)
+	data := read_until(t, ctx, conn, DataType)
+	var event string
+	if json.Unmarshal(data.Event, &event) != nil || event != `{"stamped":true}` {
+		t.Fatalf("expected the handler's event to be delivered, got %s", data.Event)
+	}
+	if published := server.Published("live-lambda/requests"); len(published) != 1 || string(published[0]) != `{"n":1}` {
+		t.Fatalf("expected the event as published, got %s", published)
+	}
+
+	server.RejectPublishes("outage")
+	if reply := exchange(t, ctx, conn, Message{Type: PublishType, ID: "p2", Channel: "live-lambda/requests", Events: []string{`{}`}}, PublishErrorType); reply.ID != "p2" || reply.Errors[0].Message != "outage" {
+		t.Fatalf("unexpected publish_error %+v", reply)
+	}
+}
+
+func TestServerSetUnavailable(t *testing.T) {
+	server := NewServer(Options{})
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dial(t, ctx, server, "{}")
+	defer conn.CloseNow()
+	exchange(t, ctx, conn, Message{Type: ConnectionInitType}, ConnectionAckType)
+
+	// The close handshake needs the client reading
+	go server.SetUnavailable("outage")
+	if reply := read_until(t, ctx, conn, ConnectionErrorType); reply.Errors[0].Message != "outage" {
+		t.Fatalf("unexpected connection_error %+v", reply)
+	}
+	if _, _, err := websocket.Dial(ctx, server.RealtimeURL(), &websocket.DialOptions{Subprotocols: []string{Subprotocol}}); err == nil {
+		t.Fatal("expected new connections to be refused")
+	}
+	server.SetUnavailable("")
+	dial(t, ctx, server, "{}").CloseNow()
+}
@@ -0,0 +1,41 @@
+// Package signing holds the HMAC scheme the extension and the agent share for
+// response signing. Both sides must produce the same bytes, so neither keeps
+// its own copy.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+)
+
+// CanonicalJSON re-encodes a JSON value with sorted keys and without HTML
+// escaping, so both sides sign the same bytes however the transport
+// re-encoded the value in between.
+func CanonicalJSON(value []byte) ([]byte, error) {
+	var decoded interface{}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(decoded); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Sign returns the HMAC-SHA256, keyed with secret, of request_id, a newline
+// and value as canonical JSON.
+func Sign(secret []byte, request_id string, value []byte) ([]byte, error) {
+	canonical, err := CanonicalJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(request_id + "\n"))
+	mac.Write(canonical)
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,31 @@
+package signing
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCanonicalJSONSortsKeysWithoutEscaping(t *testing.T) {
+	canonical, err := CanonicalJSON([]byte(`{"statusCode": 200.0, "body": "<ok> & done", "headers": {"b": 1, "a": [true, null]}}`))
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+	if want := `{"body":"<ok> & done","headers":{"a":[true,null],"b":1},"statusCode":200}`; string(canonical) != want {
+		t.Fatalf("got %s, want %s", canonical, want)
+	}
+	if _, err := CanonicalJSON([]byte(`not json`)); err == nil {
+		t.Fatal("expected an error for a value that is not JSON")
+	}
+}
+
+// The agent and the extension are tested against the same vector, so a
+// change here is a protocol change.
+func TestSignGoldenVector(t *testing.T) {
+	signature, err := Sign([]byte("secret"), "req-1", []byte(`{"statusCode": 200.0, "body": "<ok> & done"}`))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if got := base64.StdEncoding.EncodeToString(signature); got != "6VghmQrl0JQL3iKlTmOYXwRqIeYVtjHQ8yAiIiz27po=" {
+		t.Fatalf("unexpected signature %s", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Cancellation
+//
+// Once the proxy stops waiting for an invocation, nothing the agent does with
+// it matters any more: Lambda has either timed it out, handed it to the
+// function, or reset the sandbox. So that the agent can stop running the
+// handler, the extension tells it, on the same channel the request went out
+// on (or the mailbox, in pull delivery):
+//
+//	{"type": "cancel", "request_id": "...", "sandbox_id": "...",
+//	 "function_name": "...", "reason": "deadline"}
+//
+// reason is deadline when the wait reached the invocation's deadline, and
+// abandoned when the runtime's /next request went away first, as it does when
+// the function times out or the sandbox is reset. Agents that do not know the
+// message ignore it. The agent's own cancel frame, on the response channel,
+// is the other direction; see response_ordering.go.
+
+const (
+	invocation_cancel_type  = "cancel"
+	cancel_reason_deadline  = "deadline"
+	cancel_reason_abandoned = "abandoned"
+	cancel_publish_timeout  = 5 * time.Second
+)
+
+// cancel_invocation tells the agent, in the background, to stop working on request_id.
+func (p *RuntimeAPIProxy) cancel_invocation(request_id string, reason string) {
+	message := map[string]interface{}{
+		"type":          invocation_cancel_type,
+		"request_id":    request_id,
+		"sandbox_id":    p.sandbox_id,
+		"function_name": p.function_name,
+		"reason":        reason,
+	}
+	p.add_idempotency_key(message, request_id)
+	add_protocol_envelope(message)
+	p.add_function_metadata(message)
+	publish := p.agent_publisher(request_id)
+	go func() {
+		// The invocation's own context is done by now
+		ctx, cancel := context.WithTimeout(p.ctx, cancel_publish_timeout)
+		defer cancel()
+		if err := publish(ctx, message); err != nil {
+			request_logger(request_id).Warn("Could not tell the agent to cancel the invocation", "reason", reason, "error", err)
+			return
+		}
+		p.explain(request_id, "cancel_sent", "reason %s", reason)
+	}()
+}
+
+// agent_publisher returns a func that sends a message where request_id's
+// request went: the mailbox in pull delivery, or the request channel
+// otherwise. The channel is chosen now, while the invocation and any lease on
+// it are still tracked.
+func (p *RuntimeAPIProxy) agent_publisher(request_id string) func(ctx context.Context, message map[string]interface{}) error {
+	topic := p.request_topic(request_id)
+	transport := p.request_transport(request_id)
+	return func(ctx context.Context, message map[string]interface{}) error {
+		if p.pull_delivery(ctx) {
+			body, _ := json.Marshal(message)
+			return p.mailbox.send(ctx, body)
+		}
+		return transport.Publish(ctx, topic, []interface{}{message})
+	}
+}
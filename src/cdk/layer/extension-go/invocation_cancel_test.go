@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCancelInvocationTellsTheLeaseHolder(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	request.open_offer()
+	request.claim("agent-1")
+
+	proxy.cancel_invocation("req-1", cancel_reason_abandoned)
+	// The invocation is gone by the time the message is published
+	proxy.requests.remove("req-1")
+
+	message := wait_for_published(t, server, proxy.agent_topic("agent-1"), nil)[0]
+	if message["type"] != invocation_cancel_type || message["request_id"] != "req-1" || message["sandbox_id"] != proxy.sandbox_id || message["function_name"] != "orders" || message["reason"] != cancel_reason_abandoned {
+		t.Fatalf("unexpected cancel message %v", message)
+	}
+}
+
+func TestCancelInvocationWithoutLeaseUsesTheRequestsChannel(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+
+	proxy.cancel_invocation("req-1", cancel_reason_deadline)
+
+	if message := wait_for_published(t, server, proxy.requests_topic(), of_type(invocation_cancel_type))[0]; message["reason"] != cancel_reason_deadline {
+		t.Fatalf("unexpected cancel message %v", message)
+	}
+}
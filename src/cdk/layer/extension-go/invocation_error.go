@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Invocation errors
+//
+// When the handler throws on the developer's machine, an agent that negotiated
+// the error_frames capability sends an error frame on the response channel
+// instead of a response:
+//
+//	{"type": "invocation_error", "errorType": "TypeError", "errorMessage": "...", "stackTrace": ["..."]}
+//
+// The extension posts it to /runtime/invocation/{id}/error with the
+// Lambda-Runtime-Function-Error-Type header set to errorType, the same way the
+// Lambda runtime reports an unhandled exception. Error frames may be
+// compressed, chunked or offloaded like any other response.
+
+const (
+	invocation_error_frame_type   = protocol.TypeInvocationError
+	function_error_type_header    = "Lambda-Runtime-Function-Error-Type"
+	default_invocation_error_type = "Error"
+)
+
+// invocation_error is the body Lambda expects on /invocation/{id}/error.
+type invocation_error struct {
+	ErrorType    string   `json:"errorType"`
+	ErrorMessage string   `json:"errorMessage"`
+	StackTrace   []string `json:"stackTrace,omitempty"`
+}
+
+// parse_invocation_error decodes an error frame; ok is false for other frames.
+func parse_invocation_error(frame []byte) (invocation_error, bool) {
+	var parsed protocol.InvocationError
+	if json.Unmarshal(frame, &parsed) != nil || parsed.Type != invocation_error_frame_type {
+		return invocation_error{}, false
+	}
+	if parsed.ErrorType == "" {
+		parsed.ErrorType = default_invocation_error_type
+	}
+	return invocation_error{ErrorType: parsed.ErrorType, ErrorMessage: parsed.ErrorMessage, StackTrace: parsed.StackTrace}, true
+}
+
+// post_invocation_error reports a failed invocation to the Runtime API on behalf of the function.
+func (p *RuntimeAPIProxy) post_invocation_error(request_id string, error_type string, error_message string) {
+	p.post_function_error(request_id, invocation_error{ErrorType: error_type, ErrorMessage: error_message})
+}
+
+// post_function_error posts a function error, stack trace included, to the Runtime API.
+func (p *RuntimeAPIProxy) post_function_error(request_id string, function_error invocation_error) {
+	error_url := runtime_api_url(p.api_versions.current(), fmt.Sprintf("/runtime/invocation/%s/error", request_id))
+	error_body, _ := json.Marshal(function_error)
+	error_body = p.interceptors.on_error(context.Background(), request_id, error_body)
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	headers.Set(function_error_type_header, function_error.ErrorType)
+
+	if _, err := p.post_runtime_api(context.Background(), error_url, error_body, headers); err != nil {
+		request_logger(request_id).Error("Error posting the invocation error", "error", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseInvocationError(t *testing.T) {
+	parsed, ok := parse_invocation_error([]byte(`{"type":"invocation_error","errorType":"TypeError","errorMessage":"x is undefined","stackTrace":["at handler (index.ts:3:9)"]}`))
+	if !ok || parsed.ErrorType != "TypeError" || parsed.ErrorMessage != "x is undefined" || len(parsed.StackTrace) != 1 {
+		t.Fatalf("unexpected parse result %+v, %v", parsed, ok)
+	}
+
+	parsed, ok = parse_invocation_error([]byte(`{"type":"invocation_error","errorMessage":"thrown string"}`))
+	if !ok || parsed.ErrorType != default_invocation_error_type {
+		t.Fatalf("expected a default errorType, got %+v", parsed)
+	}
+
+	if _, ok := parse_invocation_error([]byte(`{"errorType":"Custom","errorMessage":"a handler's own result"}`)); ok {
+		t.Fatal("expected a response without the frame type not to be an error frame")
+	}
+}
+
+func TestRouteAgentResponsePostsErrorFrames(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	if _, err := proxy.requests.register("req-err", []byte(`{}`), nil); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	proxy.route_agent_response("req-err", map[string]interface{}{
+		"type":             response_envelope_type,
+		"protocol_version": current_protocol_version,
+		"body": map[string]interface{}{
+			"type":         invocation_error_frame_type,
+			"errorType":    "TypeError",
+			"errorMessage": "boom",
+			"stackTrace":   []string{"at handler"},
+		},
+	})
+
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-err/error" {
+			t.Fatalf("expected an error post, got %s", posted.path)
+		}
+		var body invocation_error
+		if err := json.Unmarshal([]byte(posted.body), &body); err != nil {
+			t.Fatalf("decode posted body: %v", err)
+		}
+		if body.ErrorType != "TypeError" || body.ErrorMessage != "boom" || len(body.StackTrace) != 1 {
+			t.Fatalf("unexpected posted error %+v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error post")
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"nhooyr.io/websocket"
+)
+
+// AWS IoT Core accepts MQTT over a WebSocket whose URL is SigV4 presigned for
+// the iotdevicegateway service. Channels map one-to-one to MQTT topics, and each
+// published event is sent as its own QoS 0 message. The connection is re-dialled
+// with backoff after it drops, and active subscriptions are restored.
+
+const (
+	iot_print_prefix     = "[LiveLambdaExt:IoT]"
+	iot_signing_service  = "iotdevicegateway"
+	iot_keep_alive       = 60 * time.Second
+	iot_ping_interval    = 30 * time.Second
+	iot_connack_timeout  = 10 * time.Second
+	iot_max_message_size = 128 * 1024 // IoT Core rejects larger messages
+	iot_reconnect_max    = 30 * time.Second
+	// SHA-256 of the empty string; the presigned handshake carries no body
+	iot_empty_payload_hash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type iot_transport struct {
+	aws_cfg   aws.Config
+	endpoint  string
+	region    string
+	client_id string
+
+	run_ctx   context.Context
+	stop      context.CancelFunc
+	connected atomic.Bool
+	closed    atomic.Bool
+
+	mu       sync.Mutex // guards the fields below and serializes writes to conn
+	conn     net.Conn
+	handlers map[string]func(data_payload interface{})
+	pending  map[uint16]chan bool
+	next_id  uint16
+}
+
+func new_iot_transport(aws_cfg aws.Config, endpoint string, region string, client_id string) *iot_transport {
+	run_ctx, stop := context.WithCancel(context.Background())
+	return &iot_transport{
+		aws_cfg:   aws_cfg,
+		endpoint:  endpoint,
+		region:    region,
+		client_id: client_id,
+		run_ctx:   run_ctx,
+		stop:      stop,
+		handlers:  map[string]func(data_payload interface{}){},
+		pending:   map[uint16]chan bool{},
+	}
+}
+
+// iot_topic converts a channel name to an MQTT topic, which must not start with
+// a slash.
+func iot_topic(channel string) string {
+	return strings.TrimPrefix(channel, "/")
+}
+
+// presign_iot_url returns the wss:// URL for the MQTT handshake. The session
+// token is appended after signing, as IoT Core expects.
+func presign_iot_url(ctx context.Context, cfg aws.Config, endpoint string, region string, now time.Time) (string, error) {
+	if cfg.Credentials == nil {
+		return "", fmt.Errorf("no AWS credentials configured")
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	session_token := credentials.SessionToken
+	credentials.SessionToken = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/mqtt", endpoint), nil)
+	if err != nil {
+		return "", err
+	}
+	signed_url, _, err := v4.NewSigner().PresignHTTP(ctx, credentials, req, iot_empty_payload_hash, iot_signing_service, region, now)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign IoT request: %w", err)
+	}
+	parsed, err := url.Parse(signed_url)
+	if err != nil {
+		return "", err
+	}
+	parsed.Scheme = "wss"
+	if session_token != "" {
+		if parsed.RawQuery != "" {
+			parsed.RawQuery += "&"
+		}
+		parsed.RawQuery += "X-Amz-Security-Token=" + url.QueryEscape(session_token)
+	}
+	return parsed.String(), nil
+}
+
+// Connect opens the MQTT session. Later drops are recovered in the background
+// until Close is called.
+func (t *iot_transport) Connect(ctx context.Context) error {
+	if t.endpoint == "" {
+		return fmt.Errorf("%s is required for the iot transport", live_lambda_iot_endpoint_env)
+	}
+	return t.open(ctx)
+}
+
+func (t *iot_transport) open(ctx context.Context) error {
+	signed_url, err := presign_iot_url(ctx, t.aws_cfg, t.endpoint, t.region, time.Now())
+	if err != nil {
+		return err
+	}
+	ws, _, err := websocket.Dial(ctx, signed_url, &websocket.DialOptions{Subprotocols: []string{"mqtt"}})
+	if err != nil {
+		return fmt.Errorf("failed to connect to AWS IoT Core at %s: %w", t.endpoint, err)
+	}
+	ws.SetReadLimit(2 * iot_max_message_size)
+	conn := websocket.NetConn(t.run_ctx, ws, websocket.MessageBinary)
+	reader := bufio.NewReader(conn)
+
+	if _, err := conn.Write(mqtt_connect_packet(t.client_id, uint16(iot_keep_alive.Seconds()))); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send MQTT CONNECT: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(iot_connack_timeout))
+	packet, err := read_mqtt_packet(reader)
+	if err == nil {
+		err = parse_mqtt_connack(packet)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("MQTT handshake with %s failed: %w", t.endpoint, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+	t.connected.Store(true)
+	log.Printf("%s Connected to %s as %s", iot_print_prefix, t.endpoint, t.client_id)
+
+	done := make(chan struct{})
+	go t.read_loop(conn, reader, done)
+	go t.keep_alive(done)
+	return nil
+}
+
+func (t *iot_transport) IsConnected() bool {
+	return t.connected.Load()
+}
+
+// write sends a packet on the current connection.
+func (t *iot_transport) write(packet []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil || !t.connected.Load() {
+		return errors.New("not connected to AWS IoT Core")
+	}
+	_, err := t.conn.Write(packet)
+	return err
+}
+
+func (t *iot_transport) Publish(ctx context.Context, channel string, events []interface{}) error {
+	topic := iot_topic(channel)
+	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event for %s: %w", topic, err)
+		}
+		if len(payload) > iot_max_message_size {
+			return fmt.Errorf("event for %s is %d bytes, over the IoT Core limit of %d", topic, len(payload), iot_max_message_size)
+		}
+		if err := t.write(mqtt_publish_packet(topic, payload)); err != nil {
+			return fmt.Errorf("failed to publish to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe delivers messages on channel to on_data once IoT Core acknowledges
+// the subscription.
+func (t *iot_transport) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error) {
+	topic := iot_topic(channel)
+	t.mu.Lock()
+	t.handlers[topic] = on_data
+	t.mu.Unlock()
+	if err := t.subscribe_topic(ctx, topic); err != nil {
+		t.mu.Lock()
+		delete(t.handlers, topic)
+		t.mu.Unlock()
+		return nil, err
+	}
+	return &iot_subscription{transport: t, topic: topic}, nil
+}
+
+func (t *iot_transport) subscribe_topic(ctx context.Context, topic string) error {
+	t.mu.Lock()
+	id := t.packet_id()
+	acked := make(chan bool, 1)
+	t.pending[id] = acked
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(mqtt_subscribe_packet(id, topic)); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+	}
+	select {
+	case accepted, ok := <-acked:
+		if !ok {
+			return fmt.Errorf("connection closed while subscribing to %s", topic)
+		}
+		if !accepted {
+			return fmt.Errorf("AWS IoT Core refused the subscription to %s", topic)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// packet_id returns the next non-zero packet ID. The caller holds t.mu.
+func (t *iot_transport) packet_id() uint16 {
+	t.next_id++
+	if t.next_id == 0 {
+		t.next_id = 1
+	}
+	return t.next_id
+}
+
+// read_loop dispatches incoming packets until the connection fails, then
+// starts reconnecting unless the transport was closed.
+func (t *iot_transport) read_loop(conn net.Conn, reader *bufio.Reader, done chan struct{}) {
+	defer close(done)
+	for {
+		packet, err := read_mqtt_packet(reader)
+		if err != nil {
+			t.drop(conn)
+			if t.closed.Load() {
+				return
+			}
+			log.Printf("%s Connection lost: %v", iot_print_prefix, err)
+			go t.reconnect()
+			return
+		}
+		switch packet.kind {
+		case mqtt_publish:
+			t.deliver(packet)
+		case mqtt_suback, mqtt_unsuback:
+			id, accepted, err := parse_mqtt_ack(packet)
+			if err != nil {
+				log.Printf("%s Ignoring malformed acknowledgement: %v", iot_print_prefix, err)
+				continue
+			}
+			t.mu.Lock()
+			if acked, ok := t.pending[id]; ok {
+				acked <- accepted
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *iot_transport) deliver(packet mqtt_packet) {
+	topic, payload, id, err := parse_mqtt_publish(packet)
+	if err != nil {
+		log.Printf("%s Ignoring malformed message: %v", iot_print_prefix, err)
+		return
+	}
+	if id != 0 {
+		if err := t.write(mqtt_puback_packet(id)); err != nil {
+			log.Printf("%s Failed to acknowledge message on %s: %v", iot_print_prefix, topic, err)
+		}
+	}
+	t.mu.Lock()
+	on_data := t.handlers[topic]
+	t.mu.Unlock()
+	if on_data == nil {
+		return
+	}
+	var data interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		data = string(payload)
+	}
+	on_data(data)
+}
+
+// drop marks conn as gone and fails any subscription waiting on it.
+func (t *iot_transport) drop(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		t.conn = nil
+		t.connected.Store(false)
+	}
+	for id, acked := range t.pending {
+		close(acked)
+		delete(t.pending, id)
+	}
+}
+
+func (t *iot_transport) keep_alive(done chan struct{}) {
+	ticker := time.NewTicker(iot_ping_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.run_ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.write(mqtt_pingreq_packet()); err != nil {
+				log.Printf("%s Keep-alive failed: %v", iot_print_prefix, err)
+			}
+		}
+	}
+}
+
+// reconnect re-dials with exponential backoff and restores every subscription.
+func (t *iot_transport) reconnect() {
+	backoff := time.Second
+	for !t.closed.Load() {
+		select {
+		case <-t.run_ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		ctx, cancel := context.WithTimeout(t.run_ctx, 30*time.Second)
+		err := t.open(ctx)
+		if err == nil {
+			t.resubscribe(ctx)
+			cancel()
+			return
+		}
+		cancel()
+		log.Printf("%s Reconnect failed, retrying in %s: %v", iot_print_prefix, backoff, err)
+		backoff = min(2*backoff, iot_reconnect_max)
+	}
+}
+
+func (t *iot_transport) resubscribe(ctx context.Context) {
+	t.mu.Lock()
+	topics := make([]string, 0, len(t.handlers))
+	for topic := range t.handlers {
+		topics = append(topics, topic)
+	}
+	t.mu.Unlock()
+	for _, topic := range topics {
+		if err := t.subscribe_topic(ctx, topic); err != nil {
+			log.Printf("%s Failed to restore subscription to %s: %v", iot_print_prefix, topic, err)
+		}
+	}
+}
+
+// Close ends the MQTT session and stops reconnecting.
+func (t *iot_transport) Close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
+	if t.connected.Load() {
+		t.write(mqtt_disconnect_packet())
+	}
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	t.stop()
+	if conn != nil {
+		t.drop(conn)
+	}
+	return nil
+}
+
+type iot_subscription struct {
+	transport *iot_transport
+	topic     string
+}
+
+// Unsubscribe stops delivery for the topic. The UNSUBSCRIBE is sent without
+// waiting for IoT Core to acknowledge it.
+func (s *iot_subscription) Unsubscribe() error {
+	s.transport.mu.Lock()
+	delete(s.transport.handlers, s.topic)
+	id := s.transport.packet_id()
+	s.transport.mu.Unlock()
+	if !s.transport.IsConnected() {
+		return nil
+	}
+	return s.transport.write(mqtt_unsubscribe_packet(id, s.topic))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Latency breakdowns
+//
+// Once the agent's answer to an invocation is posted, the extension logs
+// where the round trip went, as spans between the points it sees:
+//
+//	proxy      the runtime's /next call returned → the request was published
+//	appsync    published → the response arrived, less the agent's own time
+//	agent      the agent's time around the handler: decoding, encoding, publishing
+//	handler    the developer's handler ran
+//	post_back  the response arrived → it was posted to the Runtime API
+//
+// Agents with the timing capability report their side in the response
+// envelope, as durations so the two machines' clocks are never compared:
+//
+//	{"type": "response", ..., "timing": {"agent_ms": 41.2, "handler_ms": 38.9}}
+//
+// agent_ms runs from the request arriving at the agent to its response being
+// published, handler included. Without it, appsync covers the whole round
+// trip. The breakdown is also an explain step.
+
+type latency_breakdown struct {
+	proxy     time.Duration
+	appsync   time.Duration
+	agent     time.Duration
+	handler   time.Duration
+	post_back time.Duration
+	reported  bool // the agent reported its timing
+}
+
+// new_latency_breakdown splits the time from received to posted.
+func new_latency_breakdown(received, published, responded, posted time.Time, timing *protocol.Timing) latency_breakdown {
+	breakdown := latency_breakdown{
+		proxy:     published.Sub(received),
+		appsync:   responded.Sub(published),
+		post_back: posted.Sub(responded),
+	}
+	if timing != nil {
+		agent := milliseconds_duration(timing.AgentMs)
+		handler := min(milliseconds_duration(timing.HandlerMs), agent)
+		// The round trip is measured here and the agent's time there, so a
+		// fast AppSync hop can come out slightly negative
+		breakdown.appsync = max(breakdown.appsync-agent, 0)
+		breakdown.agent = agent - handler
+		breakdown.handler = handler
+		breakdown.reported = true
+	}
+	return breakdown
+}
+
+func milliseconds_duration(ms float64) time.Duration {
+	return max(time.Duration(ms*float64(time.Millisecond)), 0)
+}
+
+func (b latency_breakdown) total() time.Duration {
+	return b.proxy + b.appsync + b.agent + b.handler + b.post_back
+}
+
+// log_attrs are the spans as slog key-value pairs, in milliseconds.
+func (b latency_breakdown) log_attrs() []any {
+	ms := func(d time.Duration) float64 { return milliseconds(d.Round(100 * time.Microsecond)) }
+	attrs := []any{"total_ms", ms(b.total()), "proxy_ms", ms(b.proxy), "appsync_ms", ms(b.appsync)}
+	if b.reported {
+		attrs = append(attrs, "agent_ms", ms(b.agent), "handler_ms", ms(b.handler))
+	}
+	return append(attrs, "post_back_ms", ms(b.post_back))
+}
+
+func (b latency_breakdown) String() string {
+	round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+	if !b.reported {
+		return fmt.Sprintf("proxy %s, appsync and agent %s, post back %s", round(b.proxy), round(b.appsync), round(b.post_back))
+	}
+	return fmt.Sprintf("proxy %s, appsync %s, agent %s, handler %s, post back %s", round(b.proxy), round(b.appsync), round(b.agent), round(b.handler), round(b.post_back))
+}
+
+// log_latency_breakdown logs and explains where request's time went, from the
+// runtime's /next call returning to its response being posted at posted.
+func (p *RuntimeAPIProxy) log_latency_breakdown(request *pending_request, responded, posted time.Time, timing *protocol.Timing) {
+	received, published := request.received(), request.published()
+	if received.IsZero() || published.IsZero() {
+		return
+	}
+	breakdown := new_latency_breakdown(received, published, responded, posted, timing)
+	request_logger(request.request_id).Info("Latency breakdown", breakdown.log_attrs()...)
+	p.explain(request.request_id, "latency", "%s", breakdown)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestLatencyBreakdownSplitsTheRoundTrip(t *testing.T) {
+	received := time.Now()
+	published := received.Add(4 * time.Millisecond)
+	responded := published.Add(50 * time.Millisecond)
+	posted := responded.Add(2 * time.Millisecond)
+
+	breakdown := new_latency_breakdown(received, published, responded, posted, &protocol.Timing{AgentMs: 30, HandlerMs: 25})
+
+	if breakdown.proxy != 4*time.Millisecond || breakdown.appsync != 20*time.Millisecond || breakdown.agent != 5*time.Millisecond || breakdown.handler != 25*time.Millisecond || breakdown.post_back != 2*time.Millisecond {
+		t.Fatalf("unexpected breakdown %+v", breakdown)
+	}
+	if breakdown.total() != posted.Sub(received) {
+		t.Fatalf("expected the spans to add up to %s, got %s", posted.Sub(received), breakdown.total())
+	}
+	if got := breakdown.String(); got != "proxy 4ms, appsync 20ms, agent 5ms, handler 25ms, post back 2ms" {
+		t.Fatalf("unexpected summary %q", got)
+	}
+}
+
+func TestLatencyBreakdownWithoutAgentTiming(t *testing.T) {
+	received := time.Now()
+	breakdown := new_latency_breakdown(received, received.Add(time.Millisecond), received.Add(41*time.Millisecond), received.Add(42*time.Millisecond), nil)
+
+	if breakdown.appsync != 40*time.Millisecond || breakdown.reported {
+		t.Fatalf("expected AppSync to cover the whole round trip, got %+v", breakdown)
+	}
+	if got := breakdown.String(); got != "proxy 1ms, appsync and agent 40ms, post back 1ms" {
+		t.Fatalf("unexpected summary %q", got)
+	}
+}
+
+func TestLatencyBreakdownNeverGoesNegative(t *testing.T) {
+	received := time.Now()
+	// The agent measured a little more than the round trip seen here
+	breakdown := new_latency_breakdown(received, received, received.Add(10*time.Millisecond), received.Add(10*time.Millisecond), &protocol.Timing{AgentMs: 10.4, HandlerMs: 12})
+
+	if breakdown.appsync != 0 || breakdown.agent != 0 || breakdown.handler != 10400*time.Microsecond {
+		t.Fatalf("unexpected breakdown %+v", breakdown)
+	}
+}
+
+func TestRouteAgentResponseExplainsTheLatencyBreakdown(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_events_proxy(t, new_events_server(t))
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	request.mark_received(time.Now().Add(-60 * time.Millisecond))
+	request.mark_published(time.Now().Add(-50 * time.Millisecond))
+
+	proxy.route_agent_response("req-1", map[string]interface{}{
+		"type":             response_envelope_type,
+		"protocol_version": current_protocol_version,
+		"body":             map[string]interface{}{"ok": true},
+		"timing":           map[string]interface{}{"agent_ms": 30, "handler_ms": 25},
+	})
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response post")
+	}
+	steps, _ := proxy.explanations.lookup("req-1")
+	for _, step := range steps {
+		if step.Decision == "latency" {
+			if !strings.Contains(step.Detail, "agent 5ms, handler 25ms") {
+				t.Fatalf("unexpected breakdown %q", step.Detail)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected a latency step, got %+v", steps)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// latency_histogram is a small HDR-style histogram: values are bucketed by
+// power of two with a fixed number of linear sub-buckets per power, which keeps
+// relative error under 1/latency_sub_buckets across the whole range (1us to
+// well past the 15 minute Lambda limit) in a fixed amount of memory.
+
+const (
+	latency_print_prefix          = "[LiveLambdaExt:Latency]"
+	latency_sub_bucket_bits       = 3
+	latency_sub_buckets           = 1 << latency_sub_bucket_bits
+	latency_magnitudes            = 40
+	default_latency_summary_every = 50
+)
+
+type latency_phase string
+
+const (
+	latency_phase_claim     latency_phase = "claim"
+	latency_phase_execution latency_phase = "execution"
+	latency_phase_post_back latency_phase = "post_back"
+)
+
+var latency_phases = []latency_phase{latency_phase_claim, latency_phase_execution, latency_phase_post_back}
+
+type latency_histogram struct {
+	counts [latency_magnitudes * latency_sub_buckets]uint64
+	total  uint64
+	min_us int64
+	max_us int64
+	sum_us int64
+}
+
+type latency_summary struct {
+	Count  uint64  `json:"count"`
+	MinMs  float64 `json:"min_ms"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// latency_bucket_index maps a value in microseconds to its bucket.
+func latency_bucket_index(value_us int64) int {
+	if value_us < latency_sub_buckets {
+		if value_us < 0 {
+			return 0
+		}
+		return int(value_us)
+	}
+	magnitude := bits.Len64(uint64(value_us)) - latency_sub_bucket_bits
+	sub := int(value_us>>(magnitude-1)) - latency_sub_buckets
+	index := magnitude*latency_sub_buckets + sub
+	if index >= latency_magnitudes*latency_sub_buckets {
+		return latency_magnitudes*latency_sub_buckets - 1
+	}
+	return index
+}
+
+// latency_bucket_upper_bound returns the largest value in microseconds that maps to index.
+func latency_bucket_upper_bound(index int) int64 {
+	if index < latency_sub_buckets {
+		return int64(index)
+	}
+	magnitude := index / latency_sub_buckets
+	sub := index % latency_sub_buckets
+	return (int64(latency_sub_buckets+sub+1) << (magnitude - 1)) - 1
+}
+
+func (h *latency_histogram) record(duration time.Duration) {
+	value_us := duration.Microseconds()
+	if value_us < 0 {
+		value_us = 0
+	}
+	h.counts[latency_bucket_index(value_us)]++
+	if h.total == 0 || value_us < h.min_us {
+		h.min_us = value_us
+	}
+	if value_us > h.max_us {
+		h.max_us = value_us
+	}
+	h.total++
+	h.sum_us += value_us
+}
+
+// quantile returns the upper bound of the bucket containing quantile q, clamped to the observed max.
+func (h *latency_histogram) quantile(q float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for index, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			upper := latency_bucket_upper_bound(index)
+			if upper > h.max_us {
+				return h.max_us
+			}
+			return upper
+		}
+	}
+	return h.max_us
+}
+
+func (h *latency_histogram) summary() latency_summary {
+	if h.total == 0 {
+		return latency_summary{}
+	}
+	to_ms := func(us int64) float64 { return math.Round(float64(us)/10) / 100 }
+	return latency_summary{
+		Count:  h.total,
+		MinMs:  to_ms(h.min_us),
+		MeanMs: to_ms(h.sum_us / int64(h.total)),
+		P50Ms:  to_ms(h.quantile(0.50)),
+		P90Ms:  to_ms(h.quantile(0.90)),
+		P99Ms:  to_ms(h.quantile(0.99)),
+		MaxMs:  to_ms(h.max_us),
+	}
+}
+
+// phase_latencies keeps one histogram per invocation phase and decides when a
+// summary is due.
+type phase_latencies struct {
+	mu            sync.Mutex
+	histograms    map[latency_phase]*latency_histogram
+	summary_every int
+	invocations   int
+}
+
+func new_phase_latencies(summary_every int) *phase_latencies {
+	l := &phase_latencies{summary_every: summary_every}
+	l.reset()
+	return l
+}
+
+func (l *phase_latencies) record(phase latency_phase, duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.histograms[phase].record(duration)
+}
+
+// complete_invocation counts a finished invocation and returns a summary every summary_every invocations.
+func (l *phase_latencies) complete_invocation() (map[latency_phase]latency_summary, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.invocations++
+	if l.summary_every <= 0 || l.invocations%l.summary_every != 0 {
+		return nil, false
+	}
+	return l.summaries_locked(), true
+}
+
+func (l *phase_latencies) summaries() map[latency_phase]latency_summary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.summaries_locked()
+}
+
+func (l *phase_latencies) summaries_locked() map[latency_phase]latency_summary {
+	summaries := make(map[latency_phase]latency_summary, len(l.histograms))
+	for phase, histogram := range l.histograms {
+		summaries[phase] = histogram.summary()
+	}
+	return summaries
+}
+
+func (l *phase_latencies) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.histograms = make(map[latency_phase]*latency_histogram, len(latency_phases))
+	for _, phase := range latency_phases {
+		l.histograms[phase] = &latency_histogram{}
+	}
+	l.invocations = 0
+}
+
+// finish_latency_invocation publishes a latency summary when one is due.
+func (p *RuntimeAPIProxy) finish_latency_invocation() {
+	summaries, due := p.latencies.complete_invocation()
+	if !due {
+		return
+	}
+	data := map[string]interface{}{}
+	for phase, summary := range summaries {
+		data[string(phase)] = summary
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+	defer cancel()
+	if err := p.publish_lifecycle_event(ctx, "latency_summary", data); err == nil {
+		log.Printf("%s Published latency summary", latency_print_prefix)
+	}
+}
+
+// register_latency_handlers lets the agent reset the histograms with a reset_latency frame.
+func register_latency_handlers(dispatcher *control_dispatcher, latencies *phase_latencies) {
+	dispatcher.register("reset_latency", func(json.RawMessage) {
+		latencies.reset()
+		log.Printf("%s Latency histograms reset by the agent", latency_print_prefix)
+	})
+}
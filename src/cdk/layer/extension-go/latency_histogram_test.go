@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLatencyBucketBoundsAreConsistent(t *testing.T) {
+	for value := int64(0); value < 1<<16; value++ {
+		index := latency_bucket_index(value)
+		if upper := latency_bucket_upper_bound(index); value > upper {
+			t.Fatalf("value %d above its bucket's upper bound %d", value, upper)
+		}
+		if index > 0 {
+			if lower := latency_bucket_upper_bound(index - 1); value <= lower {
+				t.Fatalf("value %d not above previous bucket's upper bound %d", value, lower)
+			}
+		}
+	}
+}
+
+func TestLatencyHistogramQuantilesWithinRelativeError(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var histogram latency_histogram
+	values := make([]int64, 10000)
+	for i := range values {
+		values[i] = random.Int63n(int64(30 * time.Second / time.Microsecond))
+		histogram.record(time.Duration(values[i]) * time.Microsecond)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		exact := values[int(q*float64(len(values)))-1]
+		estimate := histogram.quantile(q)
+		if estimate < exact || float64(estimate-exact) > float64(exact)/latency_sub_buckets+1 {
+			t.Errorf("q%.2f: estimate %d too far from exact %d", q, estimate, exact)
+		}
+	}
+}
+
+func TestLatencyHistogramSummary(t *testing.T) {
+	var histogram latency_histogram
+	for _, ms := range []int{10, 20, 30, 40} {
+		histogram.record(time.Duration(ms) * time.Millisecond)
+	}
+	summary := histogram.summary()
+	if summary.Count != 4 || summary.MinMs != 10 || summary.MaxMs != 40 || summary.MeanMs != 25 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestPhaseLatenciesSummaryCadenceAndReset(t *testing.T) {
+	latencies := new_phase_latencies(3)
+	dispatcher := new_control_dispatcher()
+	register_latency_handlers(dispatcher, latencies)
+
+	for i := 1; i <= 3; i++ {
+		latencies.record(latency_phase_execution, time.Duration(i)*time.Millisecond)
+		summaries, due := latencies.complete_invocation()
+		if due != (i == 3) {
+			t.Fatalf("invocation %d: expected due=%v", i, i == 3)
+		}
+		if due && summaries[latency_phase_execution].Count != 3 {
+			t.Fatalf("expected 3 execution samples, got %+v", summaries[latency_phase_execution])
+		}
+	}
+
+	dispatcher.dispatch(json.RawMessage(`{"type":"reset_latency"}`))
+	if count := latencies.summaries()[latency_phase_execution].Count; count != 0 {
+		t.Fatalf("expected histograms to be reset, got %d samples", count)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// The lifecycle channel carries announcements from extensions to the local agent:
+// anomalies, decisions the extension made on its own, and replies to control
+// frames. Every event is tagged with the sandbox that produced it.
+
+type lifecycle_event struct {
+	Type         string                 `json:"type"`
+	SandboxID    string                 `json:"sandbox_id"`
+	FunctionName string                 `json:"function_name"`
+	Timestamp    string                 `json:"timestamp"`
+	Data         map[string]interface{} `json:"data,omitempty"`
+}
+
+// lifecycle_topic returns the channel extensions use to report to the agent.
+func (p *RuntimeAPIProxy) lifecycle_topic() string {
+	return p.channel("lifecycle/%s", p.function_name)
+}
+
+// new_sandbox_id returns a random identifier for this execution environment.
+func new_sandbox_id() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("sandbox-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// publish_lifecycle_event publishes an event on the function's lifecycle topic.
+func (p *RuntimeAPIProxy) publish_lifecycle_event(ctx context.Context, event_type string, data map[string]interface{}) error {
+	if p.transport == nil || !p.transport.IsConnected() {
+		return fmt.Errorf("transport is not connected")
+	}
+	event := lifecycle_event{
+		Type:         event_type,
+		SandboxID:    p.sandbox_id,
+		FunctionName: p.function_name,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+		Data:         data,
+	}
+	topic := p.lifecycle_topic()
+	if err := p.transport.Publish(ctx, topic, []interface{}{event}); err != nil {
+		component_logger(component_lifecycle).Warn("Error publishing a lifecycle event", "type", event_type, "topic", topic, "error", err)
+		return err
+	}
+	return nil
+}
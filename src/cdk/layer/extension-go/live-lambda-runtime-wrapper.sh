@@ -12,6 +12,18 @@ LISTENER_PORT="${LRAP_LISTENER_PORT:-8082}"
 
 export AWS_LAMBDA_RUNTIME_API="127.0.0.1:${LISTENER_PORT}"
 
+# In cooperative telemetry mode the extension creates this file and forwards
+# what the function writes to it, instead of subscribing to the Telemetry API.
+# Output still reaches CloudWatch through tee.
+FUNCTION_OUTPUT="/tmp/live-lambda-function-output.log"
+if [ -f "$FUNCTION_OUTPUT" ] && command -v tee >/dev/null 2>&1 && command -v mkfifo >/dev/null 2>&1; then
+  OUTPUT_PIPE="/tmp/live-lambda-function-output.$$"
+  if mkfifo "$OUTPUT_PIPE"; then
+    tee -a "$FUNCTION_OUTPUT" < "$OUTPUT_PIPE" &
+    exec "$@" > "$OUTPUT_PIPE" 2>&1
+  fi
+fi
+
 # Execute the original handler command (e.g., node index.js)
 # "$@" contains the original command and arguments provided by AWS Lambda.
 exec "$@"
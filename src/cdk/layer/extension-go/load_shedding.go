@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding
+//
+// On small functions the extension's own memory competes with the handler's,
+// and a layer that grows under load can get the whole sandbox OOM-killed. The
+// extension checks its resident memory every second; once it passes
+// LIVE_LAMBDA_SHED_MEMORY_PERCENT (default 25) of the function's memory size it
+// sheds everything but pass-through proxying:
+//
+//   - no invocations are offered to the agent, so nothing is captured or
+//     recorded and no request or chunk buffers are held,
+//   - function logs are no longer queued for forwarding,
+//   - explain traces are dropped, and a new invocation's trace only records
+//     that it was shed.
+//
+// Invocations already in flight finish as usual. The extension publishes a
+// degraded event on the lifecycle channel when it starts shedding and a
+// recovered event once its memory falls below three quarters of the threshold.
+// Functions with more than LIVE_LAMBDA_SHED_MAX_FUNCTION_MB (default 512) of
+// memory never shed; LIVE_LAMBDA_LOAD_SHEDDING=off disables it everywhere.
+
+const (
+	load_shedding_print_prefix    = "[LiveLambdaExt:LoadShedding]"
+	default_shed_memory_percent   = 25
+	default_shed_max_function_mb  = 512
+	load_shedding_check_interval  = time.Second
+	load_shedding_publish_timeout = 5 * time.Second
+	degraded_event_type           = "degraded"
+	recovered_event_type          = "recovered"
+)
+
+// shed_features lists what is turned off while shedding, as reported in the degraded event.
+var shed_features = []string{"interception", "recording", "log_forwarding", "explain"}
+
+type load_shedder struct {
+	threshold_bytes int64
+	resume_bytes    int64
+	read_rss        func() (int64, error)
+	shedding        atomic.Bool
+}
+
+// new_load_shedder_from_config returns nil when load shedding is off, or the
+// function is too large, or its memory size is unknown.
+func new_load_shedder_from_config(settings Config) *load_shedder {
+	memory_mb := settings.FunctionMemoryMB
+	if !settings.LoadShedding || memory_mb <= 0 || memory_mb > settings.ShedMaxFunctionMB {
+		return nil
+	}
+	threshold := int64(memory_mb) * 1024 * 1024 * int64(settings.ShedMemoryPercent) / 100
+	return &load_shedder{threshold_bytes: threshold, resume_bytes: threshold * 3 / 4, read_rss: read_self_rss}
+}
+
+// active reports whether the extension is shedding load.
+func (s *load_shedder) active() bool {
+	return s != nil && s.shedding.Load()
+}
+
+// observe updates the state from the current resident memory and reports
+// whether it changed.
+func (s *load_shedder) observe(rss int64) (changed bool) {
+	if s.shedding.Load() {
+		return rss < s.resume_bytes && s.shedding.CompareAndSwap(true, false)
+	}
+	return rss > s.threshold_bytes && s.shedding.CompareAndSwap(false, true)
+}
+
+// shed_invocation reports whether an invocation passes through because the
+// extension is shedding load, and records that as its only explain step.
+func (p *RuntimeAPIProxy) shed_invocation(request_id string) bool {
+	if !p.shedder.active() {
+		return false
+	}
+	request_logger(request_id).Info("Shedding load, passing through to the function")
+	// p.explain keeps nothing while shedding, so the step is recorded directly
+	p.explanations.record(request_id, "not_intercepted", "shedding load")
+	return true
+}
+
+// check_memory_pressure reads the extension's memory and starts or stops
+// shedding load.
+func (p *RuntimeAPIProxy) check_memory_pressure(ctx context.Context) {
+	s := p.shedder
+	rss, err := s.read_rss()
+	if err != nil || !s.observe(rss) {
+		return
+	}
+	data := map[string]interface{}{
+		"reason":          "memory",
+		"rss_bytes":       rss,
+		"threshold_bytes": s.threshold_bytes,
+	}
+	event_type := recovered_event_type
+	if s.active() {
+		log.Printf("%s Resident memory %d bytes is over %d bytes, shedding everything but pass-through proxying", load_shedding_print_prefix, rss, s.threshold_bytes)
+		p.explanations.clear()
+		debug.FreeOSMemory()
+		data["shed"] = shed_features
+		event_type = degraded_event_type
+	} else {
+		log.Printf("%s Resident memory is down to %d bytes, resuming interception", load_shedding_print_prefix, rss)
+	}
+	publish_ctx, cancel := context.WithTimeout(ctx, load_shedding_publish_timeout)
+	defer cancel()
+	_ = p.publish_lifecycle_event(publish_ctx, event_type, data)
+}
+
+// run_load_shedder checks the extension's memory every interval until ctx is done.
+func (p *RuntimeAPIProxy) run_load_shedder(ctx context.Context, interval time.Duration) {
+	if p.shedder == nil {
+		return
+	}
+	log.Printf("%s Shedding load above %d bytes of resident memory", load_shedding_print_prefix, p.shedder.threshold_bytes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.check_memory_pressure(ctx)
+		}
+	}
+}
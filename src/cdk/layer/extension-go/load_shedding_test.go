@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLoadShedderAppliesToSmallFunctions(t *testing.T) {
+	settings := default_config()
+	settings.FunctionMemoryMB = 128
+	shedder := new_load_shedder_from_config(settings)
+	if shedder == nil || shedder.threshold_bytes != 32*1024*1024 || shedder.resume_bytes != 24*1024*1024 {
+		t.Fatalf("unexpected shedder %+v", shedder)
+	}
+
+	settings.FunctionMemoryMB = 1024
+	if new_load_shedder_from_config(settings) != nil {
+		t.Fatal("expected no load shedding on a large function")
+	}
+	settings.FunctionMemoryMB = 128
+	settings.LoadShedding = false
+	if new_load_shedder_from_config(settings) != nil {
+		t.Fatal("expected no load shedding when turned off")
+	}
+}
+
+func TestLoadShedderHysteresis(t *testing.T) {
+	shedder := &load_shedder{threshold_bytes: 100, resume_bytes: 75}
+	for _, step := range []struct {
+		rss      int64
+		changed  bool
+		shedding bool
+	}{
+		{rss: 100, changed: false, shedding: false},
+		{rss: 101, changed: true, shedding: true},
+		{rss: 90, changed: false, shedding: true},
+		{rss: 74, changed: true, shedding: false},
+	} {
+		if changed := shedder.observe(step.rss); changed != step.changed || shedder.active() != step.shedding {
+			t.Fatalf("at %d bytes: expected changed=%v shedding=%v, got changed=%v shedding=%v", step.rss, step.changed, step.shedding, changed, shedder.active())
+		}
+	}
+}
+
+func TestMemoryPressureShedsAndRecovers(t *testing.T) {
+	var rss atomic.Int64
+	rss.Store(200)
+	server := new_events_server(t)
+	p := build_events_proxy(t, server)
+	// The shedder loop starts with the connection
+	p.shedder = &load_shedder{threshold_bytes: 100, resume_bytes: 75, read_rss: func() (int64, error) {
+		return rss.Load(), nil
+	}}
+	p.explain("r1", "received", "")
+	connect_events_proxy(t, p, server)
+
+	p.check_memory_pressure(context.Background())
+	if !p.shedder.active() {
+		t.Fatal("expected the extension to shed load")
+	}
+	if _, ok := p.explanations.lookup("r1"); ok {
+		t.Fatal("expected the explain traces to be dropped")
+	}
+	p.explain("r2", "received", "")
+	if _, ok := p.explanations.lookup("r2"); ok {
+		t.Fatal("expected no traces while shedding")
+	}
+	if data := p.ping_data(0); data["interception_enabled"] != false {
+		t.Fatalf("expected interception to be reported off, got %v", data)
+	}
+
+	rss.Store(50)
+	p.check_memory_pressure(context.Background())
+	if p.shedder.active() {
+		t.Fatal("expected the extension to recover")
+	}
+	if degraded := wait_for_lifecycle_event(t, server, p, degraded_event_type); degraded["threshold_bytes"] != float64(100) {
+		t.Fatalf("unexpected degraded event %v", degraded)
+	}
+	wait_for_lifecycle_event(t, server, p, recovered_event_type)
+}
+
+func TestShedInvocationIsExplained(t *testing.T) {
+	p := &RuntimeAPIProxy{
+		explanations: new_explain_log(default_explain_capacity),
+		shedder:      &load_shedder{threshold_bytes: 100, resume_bytes: 75},
+	}
+	if p.shed_invocation("r1") {
+		t.Fatal("expected no shedding below the threshold")
+	}
+	if _, ok := p.explanations.lookup("r1"); ok {
+		t.Fatal("expected nothing recorded when not shedding")
+	}
+
+	p.shedder.observe(200)
+	p.explain("r2", "received", "")
+	if !p.shed_invocation("r2") {
+		t.Fatal("expected the invocation to be shed")
+	}
+	steps, _ := p.explanations.lookup("r2")
+	if len(steps) != 1 || steps[0].Decision != "not_intercepted" || steps[0].Detail != "shedding load" {
+		t.Fatalf("expected only the shed step, got %+v", steps)
+	}
+}
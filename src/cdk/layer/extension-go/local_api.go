@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Local API
+//
+// With LIVE_LAMBDA_LOCAL_API_SOCKET set to a path such as
+// /tmp/live-lambda.sock, the extension serves a small HTTP API on that Unix
+// socket for other extensions and the function's own tooling in the sandbox:
+//
+//	GET  /status                                the extension's health, interception state and agent
+//	POST /invocations/{request_id}/pass-through let the function handle the invocation in Lambda
+//	POST /invocations/{request_id}/metadata     add a JSON object's members to the envelope's metadata
+//
+// A tool usually learns the request ID from its own INVOKE event, which may
+// arrive before or after the extension sees the invocation. A pass-through for
+// an invocation the extension has not seen yet is kept until it does (202);
+// one for an invocation waiting on the agent declines it, as the agent's
+// decline frame would (200). Metadata is only accepted until the envelope is
+// built (202), and is refused after (409). Both are forgotten after
+// local_api_ttl, the longest a Lambda invocation runs.
+//
+// Metadata is published as given, outside the encrypted event and without
+// redaction.
+
+const (
+	local_api_ttl      = 15 * time.Minute
+	local_api_capacity = 1024
+	// Most metadata, in bytes, one invocation's envelope carries
+	local_api_metadata_limit = 16 * 1024
+	// The longest path a Unix socket address holds on Linux
+	max_socket_path_length = 107
+)
+
+// local_invocation is what the local API was asked to do with an invocation.
+type local_invocation struct {
+	added          time.Time
+	pass_through   bool
+	metadata       map[string]json.RawMessage
+	metadata_bytes int
+	// claimed is set once the extension has built the invocation's envelope
+	claimed bool
+}
+
+type local_api struct {
+	socket string
+	now    func() time.Time
+
+	mu          sync.Mutex
+	invocations map[string]*local_invocation
+	server      *http.Server
+}
+
+// new_local_api_from_config returns nil unless LIVE_LAMBDA_LOCAL_API_SOCKET is
+// set.
+func new_local_api_from_config(settings Config) *local_api {
+	if settings.LocalAPISocket == "" {
+		return nil
+	}
+	return &local_api{
+		socket:      settings.LocalAPISocket,
+		now:         time.Now,
+		invocations: map[string]*local_invocation{},
+	}
+}
+
+// check_socket_path reports why path cannot be the local API's socket.
+func check_socket_path(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%q is not an absolute path", path)
+	}
+	if len(path) > max_socket_path_length {
+		return fmt.Errorf("%q is longer than the %d bytes a socket path can have", path, max_socket_path_length)
+	}
+	return nil
+}
+
+// invocation returns the entry for request_id, adding it if needed. Expired
+// entries are dropped first, then the oldest while the map is full. a.mu must
+// be held.
+func (a *local_api) invocation(request_id string) *local_invocation {
+	if entry, ok := a.invocations[request_id]; ok {
+		return entry
+	}
+	now := a.now()
+	oldest := ""
+	for id, entry := range a.invocations {
+		if now.Sub(entry.added) > local_api_ttl {
+			delete(a.invocations, id)
+		} else if oldest == "" || entry.added.Before(a.invocations[oldest].added) {
+			oldest = id
+		}
+	}
+	if len(a.invocations) >= local_api_capacity {
+		delete(a.invocations, oldest)
+	}
+	entry := &local_invocation{added: now}
+	a.invocations[request_id] = entry
+	return entry
+}
+
+// claim returns what the local API was asked to do with request_id, and stops
+// it accepting metadata for it. A nil local API was asked nothing.
+func (a *local_api) claim(request_id string) (pass_through bool, metadata map[string]json.RawMessage) {
+	if a == nil {
+		return false, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := a.invocation(request_id)
+	entry.claimed = true
+	return entry.pass_through, entry.metadata
+}
+
+// request_pass_through records a pass-through for request_id. claimed reports
+// whether the extension had already built its envelope, in which case only
+// declining the pending request still passes it through.
+func (a *local_api) request_pass_through(request_id string) (claimed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := a.invocation(request_id)
+	entry.pass_through = true
+	return entry.claimed
+}
+
+// add_metadata merges members into request_id's metadata. Later members
+// replace earlier ones of the same name.
+func (a *local_api) add_metadata(request_id string, members map[string]json.RawMessage) (status int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := a.invocation(request_id)
+	if entry.claimed {
+		return http.StatusConflict, fmt.Errorf("the envelope for request ID %s was already built", request_id)
+	}
+	size := entry.metadata_bytes
+	for name, value := range members {
+		if existing, ok := entry.metadata[name]; ok {
+			size -= len(name) + len(existing)
+		}
+		size += len(name) + len(value)
+	}
+	if size > local_api_metadata_limit {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("request ID %s would carry %d bytes of metadata, more than %d", request_id, size, local_api_metadata_limit)
+	}
+	if entry.metadata == nil {
+		entry.metadata = map[string]json.RawMessage{}
+	}
+	for name, value := range members {
+		entry.metadata[name] = value
+	}
+	entry.metadata_bytes = size
+	return http.StatusAccepted, nil
+}
+
+// listen creates the socket, replacing one a previous extension process left
+// behind, and serves handler on it until close.
+func (a *local_api) listen(handler http.Handler) (net.Listener, *http.Server, error) {
+	if err := os.Remove(a.socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to remove the stale socket %s: %w", a.socket, err)
+	}
+	listener, err := net.Listen("unix", a.socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := &http.Server{Handler: handler}
+	a.mu.Lock()
+	a.server = server
+	a.mu.Unlock()
+	return listener, server, nil
+}
+
+// close stops serving and removes the socket. It is a no-op for a nil local
+// API or one that is not listening.
+func (a *local_api) close(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	server := a.server
+	a.server = nil
+	a.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	err := server.Shutdown(ctx)
+	if remove_err := os.Remove(a.socket); remove_err != nil && !errors.Is(remove_err, fs.ErrNotExist) {
+		err = errors.Join(err, remove_err)
+	}
+	return err
+}
+
+// serve_local_api listens on the local API's socket and serves it until the
+// shutdown closes it. A socket it cannot create only costs the local API.
+func (p *RuntimeAPIProxy) serve_local_api() error {
+	listener, server, err := p.local_api.listen(p.local_api_router())
+	if err != nil {
+		component_logger(component_local_api).Error("Not serving the local API", "socket", p.local_api.socket, "error", err)
+		return nil
+	}
+	component_logger(component_local_api).Info("Serving the local API", "socket", p.local_api.socket)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (p *RuntimeAPIProxy) local_api_router() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/status", p.handle_local_status)
+	r.Post("/invocations/{requestId}/pass-through", p.handle_local_pass_through)
+	r.Post("/invocations/{requestId}/metadata", p.handle_local_metadata)
+	r.NotFound(handle_error)
+	r.MethodNotAllowed(handle_error)
+	return r
+}
+
+// local_status_report is the health report, with the interception state and
+// the build the sandbox runs.
+func (p *RuntimeAPIProxy) local_status_report(now time.Time) map[string]interface{} {
+	report, healthy := p.health_report(now)
+	report["healthy"] = healthy
+	report["sandbox_id"] = p.sandbox_id
+	report["function_name"] = p.function_name
+	enabled, reason := p.interception.enabled()
+	interception := map[string]interface{}{"enabled": enabled}
+	if !enabled {
+		interception["reason"] = reason
+	}
+	report["interception"] = interception
+	if agent := p.presence.agent(); agent != "" {
+		report["agent"] = agent
+	}
+	return report
+}
+
+func (p *RuntimeAPIProxy) handle_local_status(w http.ResponseWriter, r *http.Request) {
+	write_local_api_json(w, http.StatusOK, p.local_status_report(time.Now()))
+}
+
+func (p *RuntimeAPIProxy) handle_local_pass_through(w http.ResponseWriter, r *http.Request) {
+	request_id := chi.URLParam(r, "requestId")
+	if !p.local_api.request_pass_through(request_id) {
+		request_logger(request_id).Info("Pass-through requested over the local API before the invocation arrived")
+		write_local_api_json(w, http.StatusAccepted, map[string]string{"request_id": request_id, "outcome": "pending"})
+		return
+	}
+	request, ok := p.requests.lookup(request_id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("request ID %s is no longer in flight", request_id), http.StatusConflict)
+		return
+	}
+	if from, ok := request.settle(response_declined, nil); !ok {
+		p.explain(request_id, "decline_ignored", "pass-through requested over the local API, but the response was already %s", from)
+		http.Error(w, fmt.Sprintf("the response for request ID %s was already %s", request_id, from), http.StatusConflict)
+		return
+	}
+	request_logger(request_id).Info("Passed the invocation through to the function over the local API")
+	p.explain(request_id, "pass_through_requested", "over the local API")
+	write_local_api_json(w, http.StatusOK, map[string]string{"request_id": request_id, "outcome": "declined"})
+}
+
+func (p *RuntimeAPIProxy) handle_local_metadata(w http.ResponseWriter, r *http.Request) {
+	request_id := chi.URLParam(r, "requestId")
+	body, err := io.ReadAll(io.LimitReader(r.Body, local_api_metadata_limit+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body) > local_api_metadata_limit {
+		http.Error(w, fmt.Sprintf("metadata is limited to %d bytes per invocation", local_api_metadata_limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil || members == nil {
+		http.Error(w, "metadata must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	if _, empty := members[""]; empty {
+		http.Error(w, "metadata names must not be empty", http.StatusBadRequest)
+		return
+	}
+	status, err := p.local_api.add_metadata(request_id, members)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	write_local_api_json(w, status, map[string]string{"request_id": request_id, "outcome": "pending"})
+}
+
+func write_local_api_json(w http.ResponseWriter, status int, report interface{}) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func new_test_local_api(socket string) *RuntimeAPIProxy {
+	settings := default_config()
+	settings.LocalAPISocket = socket
+	return &RuntimeAPIProxy{
+		sandbox_id:   "sb",
+		requests:     new_request_tracker(),
+		health:       new_health_state(),
+		interception: new_interception_switch(),
+		explanations: new_explain_log(10),
+		local_api:    new_local_api_from_config(settings),
+		started_at:   time.Now(),
+		config:       settings,
+	}
+}
+
+func post_local_api(router http.Handler, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestLocalAPIPassThroughBeforeAndDuringAnInvocation(t *testing.T) {
+	p := new_test_local_api("/tmp/live-lambda.sock")
+	router := p.local_api_router()
+
+	// Before the extension sees the invocation, the request is kept for it
+	if recorder := post_local_api(router, "/invocations/r1/pass-through", ""); recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 before the invocation, got %d", recorder.Code)
+	}
+	if pass_through, _ := p.local_api.claim("r1"); !pass_through {
+		t.Fatal("expected the invocation to be passed through")
+	}
+
+	// While it waits on the agent, it is declined
+	pending, _ := p.requests.register("r2", []byte(`{}`), nil)
+	if pass_through, _ := p.local_api.claim("r2"); pass_through {
+		t.Fatal("expected no pass-through before one was requested")
+	}
+	if recorder := post_local_api(router, "/invocations/r2/pass-through", ""); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"declined"`) {
+		t.Fatalf("expected the waiting invocation to be declined, got %d %s", recorder.Code, recorder.Body)
+	}
+	if state := pending.response_state(); state != response_declined {
+		t.Fatalf("expected the request to be declined, got %s", state)
+	}
+	if recorder := post_local_api(router, "/invocations/r2/pass-through", ""); recorder.Code != http.StatusConflict {
+		t.Fatalf("expected 409 once the request is settled, got %d", recorder.Code)
+	}
+	p.requests.remove("r2")
+	if recorder := post_local_api(router, "/invocations/r2/pass-through", ""); recorder.Code != http.StatusConflict {
+		t.Fatalf("expected 409 once the invocation is done, got %d", recorder.Code)
+	}
+}
+
+func TestLocalAPIMetadataIsKeptUntilTheEnvelopeIsBuilt(t *testing.T) {
+	p := new_test_local_api("/tmp/live-lambda.sock")
+	router := p.local_api_router()
+
+	for _, body := range []string{`{"otel":{"trace_id":"abc"},"tool":"a"}`, `{"tool":"b"}`} {
+		if recorder := post_local_api(router, "/invocations/r1/metadata", body); recorder.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d %s", recorder.Code, recorder.Body)
+		}
+	}
+	for body, status := range map[string]int{
+		`[1]`:    http.StatusBadRequest,
+		`null`:   http.StatusBadRequest,
+		`{"":1}`: http.StatusBadRequest,
+		`{"big":"` + strings.Repeat("x", local_api_metadata_limit) + `"}`: http.StatusRequestEntityTooLarge,
+	} {
+		if recorder := post_local_api(router, "/invocations/r1/metadata", body); recorder.Code != status {
+			t.Errorf("expected %d for %.20s, got %d", status, body, recorder.Code)
+		}
+	}
+
+	_, metadata := p.local_api.claim("r1")
+	if len(metadata) != 2 || string(metadata["otel"]) != `{"trace_id":"abc"}` || string(metadata["tool"]) != `"b"` {
+		t.Fatalf("unexpected metadata %s", metadata)
+	}
+	if recorder := post_local_api(router, "/invocations/r1/metadata", `{"late":true}`); recorder.Code != http.StatusConflict {
+		t.Fatalf("expected 409 once the envelope is built, got %d", recorder.Code)
+	}
+}
+
+func TestLocalAPIForgetsExpiredInvocations(t *testing.T) {
+	p := new_test_local_api("/tmp/live-lambda.sock")
+	now := time.Now()
+	p.local_api.now = func() time.Time { return now }
+	p.local_api.request_pass_through("old")
+	now = now.Add(local_api_ttl + time.Second)
+	p.local_api.request_pass_through("new")
+	if pass_through, _ := p.local_api.claim("old"); pass_through {
+		t.Fatal("expected an expired pass-through to be forgotten")
+	}
+	for i := 0; i < local_api_capacity+10; i++ {
+		p.local_api.claim("r" + strconv.Itoa(i))
+	}
+	if len(p.local_api.invocations) > local_api_capacity {
+		t.Fatalf("expected at most %d invocations, got %d", local_api_capacity, len(p.local_api.invocations))
+	}
+}
+
+func TestLocalAPIServesStatusOnItsSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	// A socket left behind by a previous extension process is replaced
+	if err := os.WriteFile(socket, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := new_test_local_api(socket)
+	p.interception.disable("paused by the developer")
+	done := make(chan error, 1)
+	go func() { done <- p.serve_local_api() }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for wait := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://live-lambda/status"); err == nil {
+			break
+		}
+		if time.Now().After(wait) {
+			t.Fatal(err)
+		}
+	}
+	var report struct {
+		SandboxID    string `json:"sandbox_id"`
+		Interception struct {
+			Enabled bool   `json:"enabled"`
+			Reason  string `json:"reason"`
+		} `json:"interception"`
+	}
+	json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if report.SandboxID != "sb" || report.Interception.Enabled || report.Interception.Reason != "paused by the developer" {
+		t.Fatalf("unexpected status %+v", report)
+	}
+
+	if err := p.local_api.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestLocalAPISocketMustBeAnAbsolutePath(t *testing.T) {
+	values := required_settings()
+	values[live_lambda_local_api_socket_env] = "live-lambda.sock"
+	settings, _ := load_config(lookup_from(values))
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), live_lambda_local_api_socket_env) {
+		t.Fatalf("expected a relative socket path to be rejected, got %v", err)
+	}
+	settings.LocalAPISocket = "/tmp/live-lambda.sock"
+	if err := settings.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if new_local_api_from_config(default_config()) != nil {
+		t.Fatal("expected the local API to be off by default")
+	}
+}
+
+func TestLocalAPIMetadataReachesTheEnvelopeAndPassThroughSkipsTheAgent(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.LocalAPISocket = "/tmp/live-lambda.sock" })
+	events_agent(server, "orders")
+	wait_for_agent(t, proxy)
+	published := make(chan json.RawMessage, 4)
+	server.OnPublish(func(channel string, event json.RawMessage) {
+		var frame struct {
+			RequestID    string                     `json:"request_id"`
+			EventPayload json.RawMessage            `json:"event_payload"`
+			Metadata     map[string]json.RawMessage `json:"metadata"`
+		}
+		if channel != "live-lambda/requests" || json.Unmarshal(event, &frame) != nil || frame.RequestID == "" {
+			return
+		}
+		published <- frame.Metadata["otel"]
+		envelope := map[string]interface{}{"type": response_envelope_type, "protocol_version": 2, "body": frame.EventPayload}
+		go server.Publish("live-lambda/response/"+frame.RequestID, envelope)
+	})
+	runtime := httptest.NewServer(proxy.router())
+	defer runtime.Close()
+	local := proxy.local_api_router()
+
+	posted := fake_runtime_api(t, "req-1", `{"n":1}`)
+	post_local_api(local, "/invocations/req-1/metadata", `{"otel":{"trace_id":"abc"}}`)
+	resp, err := http.Get(runtime.URL + "/2018-06-01/runtime/invocation/next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case otel := <-published:
+		if string(otel) != `{"trace_id":"abc"}` {
+			t.Fatalf("expected the metadata in the envelope, got %s", otel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the envelope")
+	}
+	<-posted
+
+	fake_runtime_api(t, "req-2", `{"n":2}`)
+	post_local_api(local, "/invocations/req-2/pass-through", "")
+	resp, err = http.Get(runtime.URL + "/2018-06-01/runtime/invocation/next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	steps, _ := proxy.explanations.lookup("req-2")
+	if last := steps[len(steps)-1]; last.Decision != "passed_through" {
+		t.Fatalf("expected the invocation to pass through, got %+v", steps)
+	}
+	select {
+	case <-published:
+		t.Fatal("expected nothing published for the passed-through invocation")
+	default:
+	}
+}
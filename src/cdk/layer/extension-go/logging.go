@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Structured logging
+//
+// The extension logs through log/slog. LIVE_LAMBDA_LOG_LEVEL (debug, info,
+// warn or error; default info) drops records below it, and
+// LIVE_LAMBDA_LOG_FORMAT picks text (the default) or JSON lines. Every record
+// names the component that wrote it, and those about one invocation carry its
+// request_id, so a single invocation can be followed through the extension
+// with `filter request_id = "..."` in CloudWatch Logs Insights, or by grepping
+// request_id=... in text logs. Raw payloads are only logged at debug.
+//
+// Code that still uses the log package goes through the same handler at info
+// level, keeping its [LiveLambdaExt:...] prefix in the message.
+//
+// The last warnings and errors are also kept in memory, whatever the level,
+// for the diagnostics dump (see diagnostics_dump.go).
+
+const (
+	log_format_text = "text"
+	log_format_json = "json"
+
+	default_recent_errors = 20
+
+	component_main           = "main"
+	component_proxy          = "runtime_api_proxy"
+	component_extensions_api = "extensions_api"
+	component_routing        = "routing"
+	component_signing        = "signing"
+	component_response_cache = "response_cache"
+	component_interceptors   = "interceptors"
+	component_dynamic_config = "dynamic_config"
+	component_admin          = "admin"
+	component_transport      = "transport"
+	component_control        = "control"
+	component_lifecycle      = "lifecycle"
+	component_failover       = "failover"
+	component_env_channel    = "env_channel"
+	component_local_api      = "local_api"
+	component_encryption     = "encryption"
+	component_xray           = "xray"
+)
+
+// parse_log_level parses LIVE_LAMBDA_LOG_LEVEL.
+func parse_log_level(value string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", value)
+	}
+}
+
+// new_log_handler returns the handler settings ask for, writing to w.
+func new_log_handler(w io.Writer, settings Config) slog.Handler {
+	level, _ := parse_log_level(settings.LogLevel)
+	options := &slog.HandlerOptions{Level: level}
+	if strings.ToLower(settings.LogFormat) == log_format_json {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// setup_logging installs the configured handler for slog and the log package.
+func setup_logging(settings Config) {
+	slog.SetDefault(slog.New(&error_recording_handler{Handler: new_log_handler(os.Stderr, settings), errors: recent_errors}))
+}
+
+// logged_error is a warning or error kept for the diagnostics dump.
+type logged_error struct {
+	At      string            `json:"at"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// error_log keeps the last capacity warnings and errors.
+type error_log struct {
+	mu       sync.Mutex
+	capacity int
+	entries  []logged_error
+}
+
+func new_error_log(capacity int) *error_log {
+	return &error_log{capacity: capacity}
+}
+
+// recent_errors holds what the default logger warned about.
+var recent_errors = new_error_log(default_recent_errors)
+
+func (l *error_log) record(entry logged_error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) >= l.capacity {
+		l.entries = l.entries[1:]
+	}
+	l.entries = append(l.entries, entry)
+}
+
+// snapshot returns the kept entries, oldest first.
+func (l *error_log) snapshot() []logged_error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logged_error{}, l.entries...)
+}
+
+// error_recording_handler records warnings and errors in an error_log before
+// passing records on to Handler, which may drop them by level.
+type error_recording_handler struct {
+	slog.Handler
+	errors *error_log
+	attrs  []slog.Attr
+}
+
+func (h *error_recording_handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+func (h *error_recording_handler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		entry := logged_error{
+			At:      record.Time.UTC().Format(time.RFC3339Nano),
+			Level:   record.Level.String(),
+			Message: record.Message,
+			Attrs:   map[string]string{},
+		}
+		add := func(attr slog.Attr) bool {
+			entry.Attrs[attr.Key] = attr.Value.String()
+			return true
+		}
+		for _, attr := range h.attrs {
+			add(attr)
+		}
+		record.Attrs(add)
+		h.errors.record(entry)
+	}
+	if !h.Handler.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *error_recording_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &error_recording_handler{
+		Handler: h.Handler.WithAttrs(attrs),
+		errors:  h.errors,
+		attrs:   append(append([]slog.Attr{}, h.attrs...), attrs...),
+	}
+}
+
+func (h *error_recording_handler) WithGroup(name string) slog.Handler {
+	return &error_recording_handler{Handler: h.Handler.WithGroup(name), errors: h.errors, attrs: h.attrs}
+}
+
+// component_logger returns the default logger tagged with component. It is
+// looked up on every call, as setup_logging replaces the default once the
+// configuration has been read.
+func component_logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// request_logger returns the proxy's logger for one invocation.
+func request_logger(request_id string) *slog.Logger {
+	return component_logger(component_proxy).With("request_id", request_id)
+}
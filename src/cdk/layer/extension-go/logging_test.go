@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for value, expected := range map[string]slog.Level{"": slog.LevelInfo, "DEBUG": slog.LevelDebug, "warning": slog.LevelWarn, " error ": slog.LevelError} {
+		if level, err := parse_log_level(value); err != nil || level != expected {
+			t.Errorf("expected %q to parse as %s, got %s (%v)", value, expected, level, err)
+		}
+	}
+	if _, err := parse_log_level("verbose"); err == nil {
+		t.Fatal("expected an unknown level to be rejected")
+	}
+}
+
+func TestJSONLogsCarryRequestID(t *testing.T) {
+	var out bytes.Buffer
+	settings := default_config()
+	settings.LogLevel = "info"
+	settings.LogFormat = log_format_json
+	logger := slog.New(new_log_handler(&out, settings)).With("component", component_proxy).With("request_id", "r1")
+
+	logger.Debug("Raw WebSocket response", "payload", "{}")
+	logger.Info("Posted response")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the info record, got %q", out.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("expected a JSON line, got %q (%v)", lines[0], err)
+	}
+	if record["msg"] != "Posted response" || record["request_id"] != "r1" || record["component"] != component_proxy || record["level"] != "INFO" {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestErrorRecordingHandlerKeepsWarningsAboveLevel(t *testing.T) {
+	var out bytes.Buffer
+	settings := default_config()
+	settings.LogLevel = "error"
+	errors := new_error_log(2)
+	logger := slog.New(&error_recording_handler{Handler: new_log_handler(&out, settings), errors: errors}).With("component", component_proxy)
+
+	logger.Info("Connected")
+	logger.Warn("Publish failed", "attempt", 1)
+	logger.Warn("Publish failed", "attempt", 2)
+	logger.Error("Giving up", "request_id", "r1")
+
+	if strings.Contains(out.String(), "Publish failed") || !strings.Contains(out.String(), "Giving up") {
+		t.Fatalf("expected only the error written, got %q", out.String())
+	}
+	entries := errors.snapshot()
+	if len(entries) != 2 || entries[0].Attrs["attempt"] != "2" || entries[1].Message != "Giving up" {
+		t.Fatalf("expected the last two warnings and errors, got %v", entries)
+	}
+	if entries[1].Attrs["component"] != component_proxy || entries[1].Attrs["request_id"] != "r1" || entries[1].Level != "ERROR" {
+		t.Fatalf("expected the logger's attributes kept, got %v", entries[1])
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+// Logs API fallback
+//
+// Runtimes that predate the Telemetry API only offer the Logs API
+// (2020-08-15). When the Telemetry API rejects the subscription, the extension
+// subscribes to the Logs API instead, with the same types, listener and
+// buffering. Logs API batches are JSON arrays of {time, type, record} objects
+// like Telemetry API batches, so they are read into the same log_record and
+// republished on the same logs channel. Their platform.report records carry
+// the same requestId and metrics, so overhead reports keep working.
+
+const (
+	logs_api_version        = "2020-08-15"
+	logs_api_schema_version = "2021-03-18"
+)
+
+// new_logs_subscription returns the Logs API subscription for the telemetry listener.
+func new_logs_subscription(port int, types []string) telemetry_subscription {
+	subscription := new_telemetry_subscription(port, types)
+	subscription.SchemaVersion = logs_api_schema_version
+	return subscription
+}
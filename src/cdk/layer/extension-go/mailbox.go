@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Pull delivery
+//
+// Some networks kill long-lived WebSockets, so an agent may instead pull
+// requests from a mailbox: an SQS queue named by LIVE_LAMBDA_MAILBOX_QUEUE_URL.
+// The agent asks for pull delivery per session in its heartbeats
+// ({"delivery": "pull", "mailbox": "<queue url>"}), which it publishes over
+// AppSync's HTTP endpoint, as it does its responses. The extension accepts
+// only when the queue the agent names is the one it was configured with; it
+// then sends a delivery_accepted message through the mailbox once per agent
+// and delivers request envelopes there instead of on live-lambda/requests.
+// Otherwise it keeps publishing on AppSync and reports a delivery_rejected
+// lifecycle event. Presence probes are copied to the mailbox so a pull agent
+// can discover sandboxes that have not seen it yet.
+
+const (
+	mailbox_print_prefix       = "[LiveLambdaExt:Mailbox]"
+	delivery_pull              = "pull"
+	delivery_accepted_type     = "delivery_accepted"
+	max_mailbox_message_bytes  = 256 * 1024
+	sqs_json_content_type      = "application/x-amz-json-1.0"
+	sqs_send_message_operation = "AmazonSQS.SendMessage"
+)
+
+// sqs_mailbox delivers messages to an SQS queue. A nil mailbox drops them.
+type sqs_mailbox struct {
+	cfg       aws.Config
+	region    string
+	queue_url string
+
+	mu       sync.Mutex
+	accepted map[string]bool // agent IDs told that pull delivery is active
+	rejected map[string]bool // agent IDs whose pull request was reported as rejected
+}
+
+// new_sqs_mailbox_from_config returns nil unless LIVE_LAMBDA_MAILBOX_QUEUE_URL is set.
+func new_sqs_mailbox_from_config(cfg aws.Config, region string, settings Config) *sqs_mailbox {
+	queue_url := settings.MailboxQueueURL
+	if queue_url == "" {
+		return nil
+	}
+	if queue_region := sqs_queue_region(queue_url); queue_region != "" {
+		region = queue_region
+	}
+	log.Printf("%s Pull delivery available through %s", mailbox_print_prefix, queue_url)
+	return &sqs_mailbox{
+		cfg:       cfg,
+		region:    region,
+		queue_url: queue_url,
+		accepted:  map[string]bool{},
+		rejected:  map[string]bool{},
+	}
+}
+
+// sqs_queue_region reads the region from a queue URL such as
+// https://sqs.eu-west-1.amazonaws.com/123456789012/live-lambda.
+func sqs_queue_region(queue_url string) string {
+	parsed, err := url.Parse(queue_url)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(parsed.Hostname(), ".")
+	if len(parts) >= 3 && parts[0] == "sqs" {
+		return parts[1]
+	}
+	return ""
+}
+
+// send puts one message on the queue.
+func (m *sqs_mailbox) send(ctx context.Context, message []byte) error {
+	if len(message) > max_mailbox_message_bytes {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte mailbox limit", len(message), max_mailbox_message_bytes)
+	}
+	body, err := json.Marshal(map[string]string{
+		"QueueUrl":    m.queue_url,
+		"MessageBody": string(message),
+	})
+	if err != nil {
+		return err
+	}
+	headers := http.Header{}
+	headers.Set("Content-Type", sqs_json_content_type)
+	headers.Set("X-Amz-Target", sqs_send_message_operation)
+	if _, err := send_signed_request(ctx, m.cfg, "sqs", m.region, http.MethodPost, aws_service_endpoint("sqs", m.region), body, headers); err != nil {
+		return fmt.Errorf("failed to send to mailbox: %w", err)
+	}
+	return nil
+}
+
+// send_probe copies a presence probe to the mailbox.
+func (m *sqs_mailbox) send_probe(ctx context.Context, probe map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	message, _ := json.Marshal(probe)
+	if err := m.send(ctx, message); err != nil {
+		log.Printf("%s Error sending presence probe: %v", mailbox_print_prefix, err)
+	}
+}
+
+// first_acceptance records that agent_id was accepted and reports whether it is new.
+func (m *sqs_mailbox) first_acceptance(agent_id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.accepted[agent_id] {
+		return false
+	}
+	m.accepted[agent_id] = true
+	return true
+}
+
+// first_rejection records that agent_id was rejected and reports whether it is new.
+func (m *sqs_mailbox) first_rejection(agent_id string) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rejected[agent_id] {
+		return false
+	}
+	m.rejected[agent_id] = true
+	return true
+}
+
+// pull_delivery negotiates delivery with the present agent and reports whether
+// requests should go through the mailbox.
+func (p *RuntimeAPIProxy) pull_delivery(ctx context.Context) bool {
+	agent_id, requested, ok := p.presence.pull_mailbox()
+	if !ok {
+		return false
+	}
+	if p.mailbox == nil || requested != p.mailbox.queue_url {
+		if p.mailbox.first_rejection(agent_id) {
+			reason := "no mailbox is configured for this function"
+			if p.mailbox != nil {
+				reason = fmt.Sprintf("mailbox %s is not configured for this function", requested)
+			}
+			log.Printf("%s Agent %s asked for pull delivery, but %s; publishing on AppSync", mailbox_print_prefix, agent_id, reason)
+			go func() {
+				ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+				defer cancel()
+				p.publish_lifecycle_event(ctx, "delivery_rejected", map[string]interface{}{
+					"agent_id": agent_id,
+					"mailbox":  requested,
+					"reason":   reason,
+				})
+			}()
+		}
+		return false
+	}
+	if p.mailbox.first_acceptance(agent_id) {
+		accepted, _ := json.Marshal(map[string]interface{}{
+			"type":          delivery_accepted_type,
+			"agent_id":      agent_id,
+			"function_name": p.function_name,
+			"sandbox_id":    p.sandbox_id,
+			"timestamp":     time.Now().UTC().Format(time.RFC3339Nano),
+		})
+		if err := p.mailbox.send(ctx, accepted); err != nil {
+			log.Printf("%s Error confirming pull delivery to agent %s: %v", mailbox_print_prefix, agent_id, err)
+		} else {
+			log.Printf("%s Delivering requests to agent %s through %s", mailbox_print_prefix, agent_id, p.mailbox.queue_url)
+		}
+	}
+	return true
+}
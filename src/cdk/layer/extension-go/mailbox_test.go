@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSQSQueueRegion(t *testing.T) {
+	for queue_url, want := range map[string]string{
+		"https://sqs.eu-west-1.amazonaws.com/123456789012/live-lambda": "eu-west-1",
+		"https://queue.amazonaws.com/123456789012/live-lambda":         "",
+		"::not a url": "",
+	} {
+		if got := sqs_queue_region(queue_url); got != want {
+			t.Fatalf("sqs_queue_region(%q) = %q, want %q", queue_url, got, want)
+		}
+	}
+}
+
+func TestPresenceTrackerPullMailbox(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := new_presence_tracker(10 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1"}`))
+	if _, _, ok := tracker.pull_mailbox(); ok {
+		t.Fatal("expected a push agent not to ask for pull delivery")
+	}
+
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a2","delivery":"pull","mailbox":"https://sqs.us-east-1.amazonaws.com/1/q"}`))
+	agent_id, mailbox, ok := tracker.pull_mailbox()
+	if !ok || agent_id != "a2" || mailbox != "https://sqs.us-east-1.amazonaws.com/1/q" {
+		t.Fatalf("unexpected pull request %q %q %v", agent_id, mailbox, ok)
+	}
+
+	now = now.Add(11 * time.Second)
+	if _, _, ok := tracker.pull_mailbox(); ok {
+		t.Fatal("expected an absent agent not to receive pulled requests")
+	}
+
+	var disabled *presence_tracker
+	if _, _, ok := disabled.pull_mailbox(); ok {
+		t.Fatal("expected a nil tracker to use push delivery")
+	}
+}
+
+func TestPullDeliveryRejectsUnknownMailbox(t *testing.T) {
+	pull_heartbeat := json.RawMessage(`{"type":"heartbeat","agent_id":"a1","delivery":"pull","mailbox":"https://sqs.us-east-1.amazonaws.com/1/other"}`)
+
+	proxy := new_tracking_proxy()
+	proxy.ctx = context.Background()
+	proxy.presence = new_presence_tracker(time.Minute)
+	proxy.presence.handle_frame(pull_heartbeat)
+	if proxy.pull_delivery(context.Background()) {
+		t.Fatal("expected pull delivery to be rejected without a mailbox")
+	}
+
+	proxy.mailbox = &sqs_mailbox{
+		queue_url: "https://sqs.us-east-1.amazonaws.com/1/live-lambda",
+		accepted:  map[string]bool{},
+		rejected:  map[string]bool{},
+	}
+	if proxy.pull_delivery(context.Background()) {
+		t.Fatal("expected pull delivery to be rejected for a different queue")
+	}
+	if proxy.mailbox.first_rejection("a1") {
+		t.Fatal("expected the rejection to be reported once per agent")
+	}
+}
@@ -2,155 +2,389 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/config"
-	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
 	// Old proxy import removed, http_proxy_handlers.go and extensions_api_client.go are now part of package main
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
 )
 
 // Environment variables for configuration
 const (
-	live_lambda_appsync_http_host_env  = "LIVE_LAMBDA_APPSYNC_HTTP_HOST"
-	live_lambda_appsync_realtime_host_env = "LIVE_LAMBDA_APPSYNC_REALTIME_HOST"
-	lrap_listener_port_env           = "LRAP_LISTENER_PORT"
-	lrap_runtime_api_endpoint_env   = "LRAP_RUNTIME_API_ENDPOINT"
-	live_lambda_appsync_region_env    = "LIVE_LAMBDA_APPSYNC_REGION"
-	main_print_prefix                   = "[LiveLambdaExt:Main]" // MODIFIED
+	live_lambda_appsync_http_host_env      = "LIVE_LAMBDA_APPSYNC_HTTP_HOST"
+	live_lambda_appsync_realtime_host_env  = "LIVE_LAMBDA_APPSYNC_REALTIME_HOST"
+	lrap_listener_port_env                 = "LRAP_LISTENER_PORT"
+	lrap_runtime_api_endpoint_env          = "LRAP_RUNTIME_API_ENDPOINT"
+	live_lambda_appsync_region_env         = "LIVE_LAMBDA_APPSYNC_REGION"
+	live_lambda_diagnostics_interval_env   = "LIVE_LAMBDA_DIAGNOSTICS_INTERVAL"
+	live_lambda_function_tags_env          = "LIVE_LAMBDA_FUNCTION_TAGS"
+	live_lambda_tag_lookup_env             = "LIVE_LAMBDA_TAG_LOOKUP"
+	live_lambda_chunk_timeout_env          = "LIVE_LAMBDA_CHUNK_REASSEMBLY_TIMEOUT"
+	live_lambda_chunk_size_env             = "LIVE_LAMBDA_CHUNK_SIZE"
+	live_lambda_chunk_retransmit_env       = "LIVE_LAMBDA_CHUNK_RETRANSMIT_AFTER"
+	live_lambda_aws_profile_env            = "LIVE_LAMBDA_AWS_PROFILE"
+	live_lambda_aws_credential_source_env  = "LIVE_LAMBDA_AWS_CREDENTIAL_SOURCE"
+	live_lambda_latency_summary_every_env  = "LIVE_LAMBDA_LATENCY_SUMMARY_EVERY"
+	live_lambda_env_allowlist_env          = "LIVE_LAMBDA_ENV_ALLOWLIST"
+	live_lambda_env_denylist_env           = "LIVE_LAMBDA_ENV_DENYLIST"
+	live_lambda_offload_bucket_env         = "LIVE_LAMBDA_OFFLOAD_BUCKET"
+	live_lambda_offload_prefix_env         = "LIVE_LAMBDA_OFFLOAD_PREFIX"
+	live_lambda_offload_threshold_env      = "LIVE_LAMBDA_OFFLOAD_THRESHOLD"
+	live_lambda_offload_region_env         = "LIVE_LAMBDA_OFFLOAD_REGION"
+	live_lambda_offload_ttl_env            = "LIVE_LAMBDA_OFFLOAD_TTL"
+	live_lambda_sampling_max_rps_env       = "LIVE_LAMBDA_SAMPLING_MAX_RPS"
+	live_lambda_sampling_min_rate_env      = "LIVE_LAMBDA_SAMPLING_MIN_RATE"
+	live_lambda_sampling_recover_ratio_env = "LIVE_LAMBDA_SAMPLING_RECOVER_RATIO"
+	live_lambda_sampling_cooldown_env      = "LIVE_LAMBDA_SAMPLING_COOLDOWN"
+	live_lambda_presence_ttl_env           = "LIVE_LAMBDA_PRESENCE_TTL"
+	live_lambda_fallback_env               = "LIVE_LAMBDA_FALLBACK"
+	live_lambda_mailbox_queue_url_env      = "LIVE_LAMBDA_MAILBOX_QUEUE_URL"
+	live_lambda_fallback_retries_env       = "LIVE_LAMBDA_FALLBACK_RETRIES"
+	live_lambda_fallback_backoff_env       = "LIVE_LAMBDA_FALLBACK_BACKOFF"
+	live_lambda_telemetry_env              = "LIVE_LAMBDA_TELEMETRY"
+	live_lambda_telemetry_types_env        = "LIVE_LAMBDA_TELEMETRY_TYPES"
+	live_lambda_telemetry_port_env         = "LIVE_LAMBDA_TELEMETRY_PORT"
+	live_lambda_config_file_env            = "LIVE_LAMBDA_CONFIG_FILE"
+	live_lambda_compression_env            = "LIVE_LAMBDA_COMPRESSION"
+	live_lambda_compression_min_bytes_env  = "LIVE_LAMBDA_COMPRESSION_MIN_BYTES"
+	live_lambda_tunnel_failure_limit_env   = "LIVE_LAMBDA_TUNNEL_FAILURE_LIMIT"
+	live_lambda_tunnel_failure_window_env  = "LIVE_LAMBDA_TUNNEL_FAILURE_WINDOW"
+	live_lambda_transport_env              = "LIVE_LAMBDA_TRANSPORT"
+	live_lambda_transport_pool_size_env    = "LIVE_LAMBDA_TRANSPORT_POOL_SIZE"
+	live_lambda_iot_endpoint_env           = "LIVE_LAMBDA_IOT_ENDPOINT"
+	live_lambda_iot_region_env             = "LIVE_LAMBDA_IOT_REGION"
+	live_lambda_drain_timeout_env          = "LIVE_LAMBDA_DRAIN_TIMEOUT"
+	live_lambda_deadline_margin_env        = "LIVE_LAMBDA_DEADLINE_MARGIN"
+	live_lambda_env_encryption_env         = "LIVE_LAMBDA_ENV_ENCRYPTION"
+	live_lambda_share_credentials_env      = "LIVE_LAMBDA_SHARE_CREDENTIALS"
+	live_lambda_env_channel_env            = "LIVE_LAMBDA_ENV_CHANNEL"
+	live_lambda_env_redact_env             = "LIVE_LAMBDA_ENV_REDACT"
+	live_lambda_redact_logs_env            = "LIVE_LAMBDA_REDACT_LOGS"
+	live_lambda_redact_paths_env           = "LIVE_LAMBDA_REDACT_PATHS"
+	live_lambda_local_api_socket_env       = "LIVE_LAMBDA_LOCAL_API_SOCKET"
+	live_lambda_appsync_namespace_env      = "LIVE_LAMBDA_APPSYNC_NAMESPACE"
+	live_lambda_namespace_check_env        = "LIVE_LAMBDA_NAMESPACE_CHECK"
+	live_lambda_telemetry_cooperative_env  = "LIVE_LAMBDA_TELEMETRY_COOPERATIVE"
+	live_lambda_metrics_env                = "LIVE_LAMBDA_METRICS"
+	live_lambda_metrics_namespace_env      = "LIVE_LAMBDA_METRICS_NAMESPACE"
+	live_lambda_ping_interval_env          = "LIVE_LAMBDA_PING_INTERVAL"
+	live_lambda_appsync_auth_mode_env      = "LIVE_LAMBDA_APPSYNC_AUTH_MODE"
+	live_lambda_appsync_api_key_env        = "LIVE_LAMBDA_APPSYNC_API_KEY"
+	live_lambda_appsync_auth_token_env     = "LIVE_LAMBDA_APPSYNC_AUTH_TOKEN"
+	live_lambda_record_env                 = "LIVE_LAMBDA_RECORD"
+	live_lambda_record_responses_env       = "LIVE_LAMBDA_RECORD_RESPONSES"
+	live_lambda_record_capacity_env        = "LIVE_LAMBDA_RECORD_CAPACITY"
+	live_lambda_record_flush_interval_env  = "LIVE_LAMBDA_RECORD_FLUSH_INTERVAL"
+	live_lambda_load_shedding_env          = "LIVE_LAMBDA_LOAD_SHEDDING"
+	live_lambda_shed_memory_percent_env    = "LIVE_LAMBDA_SHED_MEMORY_PERCENT"
+	live_lambda_shed_max_function_mb_env   = "LIVE_LAMBDA_SHED_MAX_FUNCTION_MB"
+	live_lambda_regional_endpoints_env     = "LIVE_LAMBDA_REGIONAL_ENDPOINTS"
+	live_lambda_region_retry_interval_env  = "LIVE_LAMBDA_REGION_RETRY_INTERVAL"
+	live_lambda_failover_endpoints_env     = "LIVE_LAMBDA_FAILOVER_ENDPOINTS"
+	live_lambda_failover_after_env         = "LIVE_LAMBDA_FAILOVER_AFTER"
+	live_lambda_log_level_env              = "LIVE_LAMBDA_LOG_LEVEL"
+	live_lambda_log_format_env             = "LIVE_LAMBDA_LOG_FORMAT"
+	live_lambda_xray_env                   = "LIVE_LAMBDA_XRAY"
+	live_lambda_enabled_env                = "LIVE_LAMBDA_ENABLED"
+	live_lambda_channel_scope_env          = "LIVE_LAMBDA_CHANNEL_SCOPE"
+	live_lambda_requests_channel_env       = "LIVE_LAMBDA_REQUESTS_CHANNEL"
+	live_lambda_response_channel_env       = "LIVE_LAMBDA_RESPONSE_CHANNEL"
+	live_lambda_developer_id_env           = "LIVE_LAMBDA_DEVELOPER_ID"
+	live_lambda_claim_window_env           = "LIVE_LAMBDA_CLAIM_WINDOW"
+	live_lambda_ack_window_env             = "LIVE_LAMBDA_ACK_WINDOW"
+	live_lambda_restore_reconnect_env      = "LIVE_LAMBDA_RESTORE_RECONNECT"
+	live_lambda_response_cache_ttl_env     = "LIVE_LAMBDA_RESPONSE_CACHE_TTL"
+	live_lambda_response_cache_size_env    = "LIVE_LAMBDA_RESPONSE_CACHE_SIZE"
+	live_lambda_response_cache_bytes_env   = "LIVE_LAMBDA_RESPONSE_CACHE_MAX_BYTES"
+	live_lambda_response_cache_ignore_env  = "LIVE_LAMBDA_RESPONSE_CACHE_IGNORE"
+	live_lambda_reencode_events_env        = "LIVE_LAMBDA_REENCODE_EVENTS"
+	live_lambda_response_shape_check_env   = "LIVE_LAMBDA_RESPONSE_SHAPE_CHECK"
+	live_lambda_runtime_api_idle_conns_env = "LIVE_LAMBDA_RUNTIME_API_MAX_IDLE_CONNS"
+	live_lambda_runtime_api_timeout_env    = "LIVE_LAMBDA_RUNTIME_API_POST_TIMEOUT"
+	live_lambda_payload_key_arn_env        = "LIVE_LAMBDA_PAYLOAD_KEY_ARN"
+	live_lambda_signing_secret_arn_env     = "LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN"
+	live_lambda_idle_reconnect_env         = "LIVE_LAMBDA_IDLE_RECONNECT_AFTER"
+	live_lambda_warm_standby_env           = "LIVE_LAMBDA_WARM_STANDBY"
+	live_lambda_response_subscription_env  = "LIVE_LAMBDA_RESPONSE_SUBSCRIPTION"
+	live_lambda_connection_check_env       = "LIVE_LAMBDA_CONNECTION_CHECK_AFTER"
+	live_lambda_sample_rate_env            = "LIVE_LAMBDA_SAMPLE_RATE"
+	live_lambda_intercept_when_env         = "LIVE_LAMBDA_INTERCEPT_WHEN"
+	live_lambda_routing_rules_env          = "LIVE_LAMBDA_ROUTING_RULES"
+	live_lambda_dynamic_config_env         = "LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER"
+	live_lambda_dynamic_config_refresh_env = "LIVE_LAMBDA_DYNAMIC_CONFIG_REFRESH"
+	main_print_prefix                      = "[LiveLambdaExt:Main]"
 )
 
-// global_appsync_proxy will be an instance of RuntimeAPIProxy (defined below)
+// global_appsync_proxy is the extension's RuntimeAPIProxy
 var global_appsync_proxy *RuntimeAPIProxy
 
-// RuntimeAPIProxy struct definition (ensure this is defined or updated)
-// This struct needs to manage AppSync interactions and implement the AppSyncProxyHelper interface.
+// RuntimeAPIProxy serves the Runtime API to the function and hands the
+// invocations it intercepts to the agent over the transport.
 type RuntimeAPIProxy struct {
 	ctx                  context.Context
 	appsync_http_url     string // Corresponds to ClientOptions.AppSyncAPIHost
 	appsync_realtime_url string // Corresponds to ClientOptions.AppSyncRealtimeHost
 	aws_region           string // For AWS config
-	appsync_ws_client    *appsyncwsclient.Client
+	aws_cfg              aws.Config
+	transport            Transport
+	sandbox_id           string
+	function_name        string
+	channel_scope        string            // rendered LIVE_LAMBDA_CHANNEL_SCOPE; empty puts channels directly under the namespace
+	channels             channel_templates // rendered LIVE_LAMBDA_REQUESTS_CHANNEL and LIVE_LAMBDA_RESPONSE_CHANNEL
+	control              *control_dispatcher
+	agent_capacity       *agent_capacity
+	interception         *interception_switch
+	chunks               *chunk_reassembler
+	chunk_size           int
+	retransmit_after     time.Duration
+	requests             *request_tracker
+	activity             *invocation_activity
+	api_versions         runtime_api_versions
+	latencies            *phase_latencies
+	overhead             *overhead_tracker
+	env_filter           *env_filter
+	redactor             *redactor
+	started_at           time.Time
+	health               *health_state
+	explanations         *explain_log
+	offloader            *payload_offloader // nil unless LIVE_LAMBDA_OFFLOAD_BUCKET is set
+	sampler              *adaptive_sampler  // nil unless LIVE_LAMBDA_SAMPLING_MAX_RPS is set
+	presence             *presence_tracker  // nil when LIVE_LAMBDA_PRESENCE_TTL=off
+	fallback             FallbackPolicy
+	mailbox              *sqs_mailbox          // nil unless LIVE_LAMBDA_MAILBOX_QUEUE_URL is set
+	compressor           *payload_compressor   // nil when LIVE_LAMBDA_COMPRESSION=off
+	tunnel_breaker       *tunnel_breaker       // nil when LIVE_LAMBDA_TUNNEL_FAILURE_LIMIT is 0
+	output_tail          *function_output_tail // nil unless telemetry is cooperative
+	metrics              *emf_metrics          // nil unless LIVE_LAMBDA_METRICS=on
+	recorder             *payload_recorder     // nil unless LIVE_LAMBDA_RECORD is s3 or channel
+	shedder              *load_shedder         // nil when load shedding does not apply to the function
+	regions              *regional_router      // nil unless LIVE_LAMBDA_REGIONAL_ENDPOINTS names other regions
+	failover             *failover_transport   // the transport, when LIVE_LAMBDA_FAILOVER_ENDPOINTS lists standby endpoints
+	xray                 *xray_emitter         // nil when LIVE_LAMBDA_XRAY=off or active tracing is disabled
+	response_cache       *response_cache       // nil unless LIVE_LAMBDA_RESPONSE_CACHE_TTL is set
+	encryptor            *payload_encryptor    // nil unless LIVE_LAMBDA_PAYLOAD_KEY_ARN is set
+	signatures           *response_verifier    // nil unless LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN is set
+	env_channel          *env_channel          // nil unless LIVE_LAMBDA_ENV_CHANNEL=on
+	local_api            *local_api            // nil unless LIVE_LAMBDA_LOCAL_API_SOCKET is set
+	idle                 *idle_watch           // nil when LIVE_LAMBDA_IDLE_RECONNECT_AFTER=off
+	response_demux       *response_demux       // nil unless LIVE_LAMBDA_RESPONSE_SUBSCRIPTION=wildcard
+	connection_check     *connection_check     // nil when LIVE_LAMBDA_CONNECTION_CHECK_AFTER=off
+	commands             *command_log          // the admin commands already run
+	dynamic_config       *dynamic_config       // nil unless LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER is set
+	prometheus           *prometheus_metrics
+	interceptors         *interceptor_chain
+	function             atomic.Pointer[protocol.Function] // set once the extension has registered
+	function_tags_ready  chan struct{}                     // closed once the function tags are applied; nil when none were looked up
+	traffic_split        atomic.Pointer[traffic_split]     // nil unless LIVE_LAMBDA_SAMPLE_RATE or LIVE_LAMBDA_INTERCEPT_WHEN is set
+	routing_rules        atomic.Pointer[routing_rules]     // nil unless LIVE_LAMBDA_ROUTING_RULES is set
+	config               Config
 }
 
-// NewRuntimeAPIProxy constructor (ensure this is defined or updated)
-func NewRuntimeAPIProxy(ctx context.Context, actual_runtime_api string, appsync_http_url string, appsync_realtime_url string, aws_region string, listener_port_str string) (*RuntimeAPIProxy, error) {
-	log.Printf("%s Initializing RuntimeAPIProxy with target: %s, AppSync HTTP: %s, AppSync Realtime: %s, Region: %s, Listener Port: %s", main_print_prefix, actual_runtime_api, appsync_http_url, appsync_realtime_url, aws_region, listener_port_str)
+// NewRuntimeAPIProxy creates the proxy and its AppSync client. By default its
+// settings and AWS configuration are loaded from the environment; use
+// WithConfig, WithAWSConfig or WithCredentialsProvider to supply them.
+func NewRuntimeAPIProxy(ctx context.Context, actual_runtime_api string, appsync_http_url string, appsync_realtime_url string, aws_region string, listener_port_str string, opts ...ProxyOption) (*RuntimeAPIProxy, error) {
+	component_logger(component_main).Info("Initializing RuntimeAPIProxy", "runtime_api", actual_runtime_api, "appsync_http_host", appsync_http_url, "appsync_realtime_host", appsync_realtime_url, "region", aws_region, "listener_port", listener_port_str)
 
-	// Load AWS configuration (ensure your environment is set up for AWS credentials)
-	aws_cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(aws_region))
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	var options proxy_options
+	for _, opt := range opts {
+		opt(&options)
 	}
 
-	client_options := appsyncwsclient.ClientOptions{
-		AppSyncAPIHost:      appsync_http_url,     // e.g. <id>.appsync-api.<region>.amazonaws.com
-		AppSyncRealtimeHost: appsync_realtime_url, // e.g. <id>.appsync-realtime-api.<region>.amazonaws.com
-		AWSRegion:           aws_region,
-		AWSCfg:             aws_cfg,
-		Debug:              true, // Enable for detailed logging
-		KeepAliveInterval:  2 * time.Minute,
-		ReadTimeout:        10 * time.Minute, // Default in client is 15, AppSync server idle is often ~10 min
-		OperationTimeout:   30 * time.Second,
-		OnConnectionAck: func(msg appsyncwsclient.Message) {
-			log.Printf("%s [AppSyncWSClient CB] Connection Acknowledged. Timeout: %dms", main_print_prefix, *msg.ConnectionTimeoutMs)
-		},
-		OnConnectionError: func(msg appsyncwsclient.Message) {
-			log.Printf("%s [AppSyncWSClient CB] Connection Error: %s", main_print_prefix, msg.ToJSONString())
-		},
-		OnConnectionClose: func(code int, reason string) {
-			log.Printf("%s [AppSyncWSClient CB] Connection Closed. Code: %d, Reason: %s", main_print_prefix, code, reason)
-		},
-		OnKeepAlive: func() {
-			// log.Printf("%s [AppSyncWSClient CB] Keep-alive received.", main_print_prefix) // Can be noisy
-		},
-		OnGenericError: func(errMsg appsyncwsclient.MessageError) {
-			log.Printf("%s [AppSyncWSClient CB] Generic Error: Type=%s, Message=%s, Code=%v", main_print_prefix, errMsg.ErrorType, errMsg.Message, errMsg.ErrorCode)
-		},
-		OnSubscriptionError: func(subscriptionID string, errMsg appsyncwsclient.MessageError) {
-			log.Printf("%s [AppSyncWSClient CB] Subscription Error for ID '%s': Type=%s, Message=%s, Code=%v",
-				main_print_prefix, subscriptionID, errMsg.ErrorType, errMsg.Message, errMsg.ErrorCode)
-		},
+	settings := options.resolve_settings()
+	settings.RuntimeAPIEndpoint = actual_runtime_api
+	settings.AppSyncHTTPHost = appsync_http_url
+	settings.AppSyncRealtimeHost = appsync_realtime_url
+	settings.AppSyncRegion = aws_region
+	if port, err := strconv.Atoi(listener_port_str); err == nil {
+		settings.ListenerPort = port
 	}
+	options.settings = &settings
 
-	client, err := appsyncwsclient.NewClient(client_options)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AppSync WebSocket client: %w", err)
+	// A disabled extension needs neither AWS credentials nor a transport
+	var aws_cfg aws.Config
+	var err error
+	sandbox_id := new_sandbox_id()
+	transport := options.transport
+	var failover *failover_transport
+	if settings.Enabled {
+		aws_cfg, err = options.resolve_aws_config(ctx, aws_region)
+		if err != nil {
+			return nil, err
+		}
+		if transport == nil {
+			transport, err = new_transport_from_config(aws_cfg, settings, "live-lambda-"+sandbox_id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if failover, err = new_failover_transport_from_config(aws_cfg, settings, "live-lambda-"+sandbox_id, transport); err != nil {
+			return nil, err
+		} else if failover != nil {
+			transport = failover.as_transport()
+		}
 	}
 
-	return &RuntimeAPIProxy{
+	// Validate has already rejected a scope or channel that does not render
+	channel_scope, _ := render_channel_scope(settings.ChannelScope, settings.channel_scope_values())
+	channels, _ := settings.render_channel_templates()
+
+	proxy := &RuntimeAPIProxy{
 		ctx:                  ctx,
 		appsync_http_url:     appsync_http_url,
 		appsync_realtime_url: appsync_realtime_url,
 		aws_region:           aws_region,
-		appsync_ws_client:    client,
-	}, nil
+		aws_cfg:              aws_cfg,
+		transport:            transport,
+		sandbox_id:           sandbox_id,
+		function_name:        settings.FunctionName,
+		channel_scope:        channel_scope,
+		channels:             channels,
+		control:              new_control_dispatcher(),
+		agent_capacity:       new_agent_capacity(),
+		interception:         new_interception_switch(),
+		chunks:               new_chunk_reassembler(settings.ChunkReassemblyTimeout),
+		chunk_size:           settings.ChunkSize,
+		retransmit_after:     settings.ChunkRetransmitAfter,
+		requests:             new_request_tracker(),
+		activity:             new_invocation_activity(),
+		latencies:            new_phase_latencies(settings.LatencySummaryEvery),
+		overhead:             new_overhead_tracker(),
+		env_filter:           new_env_filter(settings.EnvAllowlist, settings.EnvDenylist),
+		redactor:             new_redactor_from_config(settings, os.Environ()),
+		started_at:           time.Now(),
+		health:               new_health_state(),
+		explanations:         new_explain_log(default_explain_capacity),
+		offloader:            new_payload_offloader_from_config(aws_cfg, aws_region, settings),
+		sampler:              new_adaptive_sampler_from_config(settings),
+		presence:             new_presence_tracker_from_config(settings),
+		fallback:             settings.Fallback,
+		mailbox:              new_sqs_mailbox_from_config(aws_cfg, aws_region, settings),
+		compressor:           new_payload_compressor_from_config(settings),
+		tunnel_breaker:       new_tunnel_breaker_from_config(settings),
+		metrics:              new_emf_metrics_from_config(settings),
+		recorder:             new_payload_recorder_from_config(aws_cfg, aws_region, settings, sandbox_id),
+		shedder:              new_load_shedder_from_config(settings),
+		regions:              new_regional_router_from_config(aws_cfg, settings, "live-lambda-"+sandbox_id),
+		failover:             failover,
+		xray:                 new_xray_emitter_from_config(settings, sandbox_id),
+		response_cache:       new_response_cache_from_config(settings),
+		encryptor:            new_payload_encryptor_from_config(aws_cfg, settings),
+		signatures:           new_response_verifier_from_config(aws_cfg, settings),
+		env_channel:          new_env_channel_from_config(settings),
+		local_api:            new_local_api_from_config(settings),
+		idle:                 new_idle_watch_from_config(settings),
+		response_demux:       new_response_demux_from_config(settings),
+		connection_check:     new_connection_check_from_config(settings),
+		commands:             new_command_log(),
+		dynamic_config:       new_dynamic_config_from_config(aws_cfg, settings),
+		prometheus:           new_prometheus_metrics(),
+		interceptors:         new_interceptor_chain_from_config(settings),
+		config:               settings,
+	}
+	proxy.traffic_split.Store(new_traffic_split_from_config(settings))
+	proxy.routing_rules.Store(new_routing_rules_from_config(aws_cfg, settings))
+	if options.fallback != nil {
+		proxy.fallback = *options.fallback
+	}
+	for _, interceptor := range options.interceptors {
+		proxy.interceptors.register(interceptor)
+	}
+	if !settings.Enabled {
+		proxy.interception.disable_hard(live_lambda_enabled_env + " is off")
+		return proxy, nil
+	}
+	register_capacity_handlers(proxy.control, proxy.agent_capacity)
+	register_latency_handlers(proxy.control, proxy.latencies)
+	proxy.register_roster_handler()
+	proxy.register_explain_handler()
+	proxy.register_status_handler()
+	proxy.register_admin_handlers()
+	proxy.register_diagnostics_handler()
+	proxy.start_function_tags(ctx)
+	return proxy, nil
 }
 
 // manage_web_socket_connection uses the initialized AppSync client to connect and then waits for context cancellation to close.
 func (p *RuntimeAPIProxy) manage_web_socket_connection(ctx context.Context) {
-	log.Println(main_print_prefix, "RuntimeAPIProxy: manage_web_socket_connection started.")
-
-	if p.appsync_ws_client == nil {
-		log.Printf("%s AppSync WebSocket client is nil. Cannot connect.", main_print_prefix)
+	logger := component_logger(component_main)
+	logger.Debug("manage_web_socket_connection started")
+
+	// A function tagged out never connects
+	p.wait_for_function_tags(ctx)
+	if p.interception.hard_disabled() {
+		_, reason := p.interception.enabled()
+		logger.Warn("Interception is disabled. Not connecting to AppSync.", "reason", reason)
+		return
+	}
+	if p.transport == nil {
+		logger.Error("AppSync WebSocket client is nil. Cannot connect.")
 		return
 	}
 
-	log.Printf("%s Attempting to connect to AppSync Events API via WebSocket (%s)...", main_print_prefix, p.appsync_realtime_url)
-	if err := p.appsync_ws_client.Connect(ctx); err != nil {
+	// The parameter may move the channels, so it is read before subscribing
+	p.refresh_dynamic_config(ctx, "")
+
+	logger.Info("Connecting to the AppSync Events API via WebSocket", "realtime_host", p.appsync_realtime_url)
+	if err := p.transport.Connect(ctx); err != nil {
 		// Error is already logged by OnConnectionError or initial connect failure within the client
-		log.Printf("%s Failed to connect AppSync WebSocket client: %v. Goroutine will exit.", main_print_prefix, err)
+		logger.Error("Failed to connect AppSync WebSocket client. Goroutine will exit.", "error", err)
 		// The client's Connect might retry internally; if it returns an error here, it's likely a non-recoverable initial setup issue
 		// or context cancellation during connect.
 		return
 	}
 	// If Connect returns nil, it means the connection was acknowledged or the client will handle retries internally.
 	// The actual connection_ack is handled by the OnConnectionAck callback.
-	log.Printf("%s AppSync WebSocket client Connect() method returned. Connection process initiated.", main_print_prefix)
+	logger.Info("AppSync WebSocket client connected")
+
+	p.verify_namespace(ctx)
+	p.subscribe_control_channel(ctx)
+	p.subscribe_presence_channel(ctx)
+	// The extension's own endpoint may have been skipped while connecting
+	p.announce_endpoint_switch(ctx)
+	p.publish_env_snapshot(ctx)
+	go p.run_diagnostics(ctx, p.config.DiagnosticsInterval)
+	go p.watch_connection(ctx, connection_watch_interval)
+	go p.run_pings(ctx, p.config.PingInterval)
+	go p.run_recorder(ctx, p.config.RecordFlushInterval)
+	go p.run_load_shedder(ctx, load_shedding_check_interval)
+	go p.run_regional_endpoints(ctx, regional_check_interval)
 
 	// Wait for the main context to be cancelled (e.g., Lambda shutdown)
 	<-ctx.Done()
 
-	log.Printf("%s Context cancelled. Closing AppSync WebSocket client...", main_print_prefix)
-	if err := p.appsync_ws_client.Close(); err != nil {
-		log.Printf("%s Error closing AppSync WebSocket client: %v", main_print_prefix, err)
+	logger.Info("Context cancelled. Closing AppSync WebSocket client...")
+	if err := p.transport.Close(); err != nil {
+		logger.Error("Error closing AppSync WebSocket client", "error", err)
 	} else {
-		log.Printf("%s AppSync WebSocket client closed successfully.", main_print_prefix)
+		logger.Info("AppSync WebSocket client closed successfully")
 	}
-	log.Println(main_print_prefix, "RuntimeAPIProxy: manage_web_socket_connection finished.")
-}
-
-// HandleAppSyncSubscriptionForRequest implements AppSyncProxyHelper interface (ensure this is defined or updated)
-func (p *RuntimeAPIProxy) HandleAppSyncSubscriptionForRequest(ctx context.Context, request_id string) {
-	log.Printf("%s RuntimeAPIProxy: HandleAppSyncSubscriptionForRequest for request_id: %s", main_print_prefix, request_id)
-	// Implement actual AppSync subscription logic here
-}
-
-// HandleAppSyncPublishForResponse implements AppSyncProxyHelper interface (ensure this is defined or updated)
-func (p *RuntimeAPIProxy) HandleAppSyncPublishForResponse(ctx context.Context, request_id string, response_body []byte) {
-	log.Printf("%s RuntimeAPIProxy: HandleAppSyncPublishForResponse for request_id: %s, body_len: %d", main_print_prefix, request_id, len(response_body))
-	// Implement actual AppSync publish logic here
+	logger.Debug("manage_web_socket_connection finished")
 }
 
 // HandleInvokeEvent is called when an INVOKE event is received from the Extensions API
 func (p *RuntimeAPIProxy) HandleInvokeEvent(ctx context.Context, event *NextEventResponse) error {
-	log.Printf("%s RuntimeAPIProxy: Handling INVOKE event: %+v", main_print_prefix, event)
-	// This is where you might interact with AppSync based on the invoke event details
-	// For example, ensuring subscriptions are active or publishing event-specific data.
-	// The actual Lambda function's request/response is handled by the http_proxy_handlers.
-	// This method is more about coordinating AppSync state with the Lambda lifecycle events.
+	request_logger(event.RequestID).Debug("Handling INVOKE event", "deadline_ms", event.DeadlineMs, "function_arn", event.InvokedFunctionArn)
+	// The actual Lambda function's request/response is handled by the http_proxy_handlers,
+	// which also refresh the dynamic settings and check the connection before
+	// publishing (see handle_next).
 	return nil
 }
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
-	log.Println(main_print_prefix, "Starting Live Lambda Go Extension...")
+	reporter := new_exit_reporter()
+	logger := component_logger(component_main)
+	logger.Info("Starting Live Lambda Go Extension...")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -159,131 +393,147 @@ func main() {
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		s := <-sigs
-		log.Printf("%s Received signal: %s. Initiating shutdown...", main_print_prefix, s)
+		component_logger(component_main).Info("Received signal. Initiating shutdown...", "signal", s.String())
 		cancel()
 	}()
 
-	appsync_http_url := os.Getenv(live_lambda_appsync_http_host_env)
-	appsync_realtime_url := os.Getenv(live_lambda_appsync_realtime_host_env)
-	aws_region := os.Getenv(live_lambda_appsync_region_env)
-
-	if appsync_http_url == "" || appsync_realtime_url == "" || aws_region == "" {
-		log.Fatalf("%s Missing required AppSync/AWS environment variables. Check Lambda config.", main_print_prefix)
-	}
-
-	log.Printf("%s Using AppSync HTTP Host: %s", main_print_prefix, appsync_http_url)
-	log.Printf("%s Using AppSync Realtime Host: %s", main_print_prefix, appsync_realtime_url)
-	log.Printf("%s Using AWS Region: %s", main_print_prefix, aws_region)
-
-	actual_runtime_api := get_runtime_api_endpoint()
-	listener_port := get_listener_port()
 	extension_name := filepath.Base(os.Args[0])
+	// Until the configuration names the endpoint, failures are reported through Lambda's
+	reporter.platform = NewClient(os.Getenv("AWS_LAMBDA_RUNTIME_API"))
+	reporter.extension_name = extension_name
 
-	var err error
-	global_appsync_proxy, err = NewRuntimeAPIProxy(ctx, actual_runtime_api, appsync_http_url, appsync_realtime_url, aws_region, strconv.Itoa(listener_port))
+	settings, err := LoadConfig()
+	if err == nil {
+		err = settings.Validate()
+	}
 	if err != nil {
-		log.Fatalf("%s Failed to create Runtime API Proxy for AppSync: %v", main_print_prefix, err)
+		logger.Error("Invalid configuration. Check the Lambda environment and config file", "error", err)
+		reporter.finish(exit_config_error, err, nil)
 	}
+	reporter.function_name = settings.FunctionName
+	setup_logging(settings)
+	logger = component_logger(component_main)
+	settings.Dump()
 
-	appsync_done_chan := make(chan struct{})
-	go func() {
-		defer close(appsync_done_chan)
-		log.Println(main_print_prefix, "AppSync WebSocket Manager goroutine starting...")
-		global_appsync_proxy.manage_web_socket_connection(ctx) 
-		log.Println(main_print_prefix, "AppSync WebSocket Manager goroutine finished.")
-	}()
-
-	// SetAppSyncHelper is removed as AppSync logic is now directly in RuntimeAPIProxy methods.
+	actual_runtime_api := settings.RuntimeAPIEndpoint
+	listener_port := settings.ListenerPort
 
-	StartProxy(global_appsync_proxy, actual_runtime_api, listener_port) // This function is from runtime_api_proxy.go (package main)
-	log.Printf("%s Proxy server started on port %d, targeting %s", main_print_prefix, listener_port, actual_runtime_api)
+	global_appsync_proxy, err = NewRuntimeAPIProxy(ctx, actual_runtime_api, settings.AppSyncHTTPHost, settings.AppSyncRealtimeHost, settings.AppSyncRegion, strconv.Itoa(listener_port), WithConfig(settings))
+	if err != nil {
+		logger.Error("Failed to create Runtime API Proxy for AppSync", "error", err)
+		reporter.finish(exit_transport_fatal, err, nil)
+	}
+	reporter.sandbox_id = global_appsync_proxy.sandbox_id
+
+	// The transport and the listeners outlive ctx so that shutdown can close them in order
+	transport_ctx, close_transport := context.WithCancel(context.Background())
+	listener_ctx, close_listeners := context.WithCancel(context.Background())
+	defer close_transport()
+	defer close_listeners()
+
+	group, group_ctx := new_task_group(ctx)
+	transport_done := make(chan struct{})
+	group.run("transport", func() error {
+		defer close(transport_done)
+		global_appsync_proxy.manage_web_socket_connection(transport_ctx)
+		return nil
+	})
+
+	server := new_proxy_server(global_appsync_proxy, actual_runtime_api, listener_port)
+	group.run("proxy listener", func() error {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+	logger.Info("Proxy server started", "port", listener_port, "runtime_api", actual_runtime_api)
+	if global_appsync_proxy.local_api != nil {
+		group.run("local API", global_appsync_proxy.serve_local_api)
+	}
 
 	// Initialize the Extensions API client (from extensions_api_client.go, package main)
-	extension_client := NewClient(actual_runtime_api) 
+	extension_client := NewClient(actual_runtime_api)
+	reporter.platform = extension_client
 
-	log.Println(main_print_prefix, "Registering extension...")
-	_, err = extension_client.Register(ctx, extension_name)
-	if err != nil {
-		log.Fatalf("%s Failed to register extension: %v", main_print_prefix, err)
+	if settings.Enabled {
+		global_appsync_proxy.prepare_telemetry()
+	} else {
+		logger.Info("Live Lambda is disabled. Passing every invocation through to the function", "setting", live_lambda_enabled_env)
 	}
-	log.Println(main_print_prefix, "Extension registered successfully. Starting event loop.")
 
-EventLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println(main_print_prefix, "Context cancelled, exiting main event loop.")
-			break EventLoop
-		default:
-			event, err := extension_client.NextEvent(ctx)
-			if err != nil {
-				if ctx.Err() != nil { // Context cancelled during NextEvent
-					log.Printf("%s Context cancelled while waiting for next event: %v", main_print_prefix, ctx.Err())
-				} else {
-					log.Printf("%s Error getting next event: %v. Exiting.", main_print_prefix, err)
-				}
-				cancel() // Ensure everything shuts down
-				break EventLoop
-			}
-
-			log.Printf("%s Received event type: %s", main_print_prefix, event.EventType)
-			switch event.EventType {
-			case Invoke:
-				if global_appsync_proxy != nil {
-					err := global_appsync_proxy.HandleInvokeEvent(ctx, event)
-					if err != nil {
-						log.Printf("%s Error handling INVOKE event: %v", main_print_prefix, err)
-						// Decide if this is fatal. For now, we continue.
-					}
-				} else {
-					log.Println(main_print_prefix, "global_appsync_proxy is nil, cannot handle INVOKE event")
-				}
-			case Shutdown:
-				log.Printf("%s Received SHUTDOWN event. Reason: %s. Exiting.", main_print_prefix, event.ShutdownReason)
-				cancel() // Trigger shutdown for other goroutines
-				break EventLoop 
-			default:
-				log.Printf("%s Received unknown event type: %s", main_print_prefix, event.EventType)
-			}
-		}
+	logger.Info("Registering extension...")
+	registration, err := extension_client.Register(group_ctx, extension_name, registered_events(settings))
+	if err != nil {
+		logger.Error("Failed to register extension", "error", err)
+		reporter.finish(exit_registration_failed, err, nil)
 	}
+	global_appsync_proxy.set_function_metadata(*registration)
+	logger.Info("Extension registered successfully")
+	global_appsync_proxy.health.mark_registered()
 
-	log.Println(main_print_prefix, "Main event loop finished.")
-	// Ensure main context is cancelled if loop exits for any reason other than context cancellation itself
-	cancel()
+	// The Telemetry API only accepts subscriptions before the first /event/next
+	if settings.Enabled {
+		global_appsync_proxy.start_telemetry(listener_ctx, extension_client)
+	}
+	logger.Info("Starting event loop")
+	reporter.initialized = true
 
-	log.Println(main_print_prefix, "Waiting for AppSync WebSocket Manager to shut down...")
-	wait_for_goroutine(appsync_done_chan, "AppSync WebSocket Manager", 5*time.Second)
+	shutdown_deadline, loop_err := run_event_loop(group_ctx, global_appsync_proxy, extension_client)
+	logger.Info("Main event loop finished. Shutting down...")
 
-	log.Println(main_print_prefix, "Live Lambda Go Extension finished.")
-}
+	shutdown_err := run_shutdown(global_appsync_proxy.shutdown_steps(server, shutdown_deadline, close_transport, transport_done, close_listeners))
+	cancel()
+	group_err := group.wait()
 
-func get_listener_port() int {
-	port_str := os.Getenv(lrap_listener_port_env)
-	port_int, err := strconv.Atoi(port_str)
-	if err != nil || port_int == 0 {
-		log.Printf("%s Invalid or missing %s, defaulting to 9009. Error: %v", main_print_prefix, lrap_listener_port_env, err)
-		port_int = 9009 // Default port
+	if err := errors.Join(loop_err, group_err); err != nil {
+		logger.Error("Live Lambda Go Extension failed", "error", err)
+		reporter.finish(exit_runtime_failed, err, shutdown_err)
+	}
+	if shutdown_err != nil {
+		logger.Warn("Shutdown was not clean", "error", shutdown_err)
 	}
-	return port_int
+	logger.Info("Live Lambda Go Extension finished")
+	reporter.finish(exit_shutdown, nil, shutdown_err)
 }
 
-func get_runtime_api_endpoint() string {
-	endpoint := os.Getenv(lrap_runtime_api_endpoint_env)
-	if endpoint == "" {
-		endpoint = os.Getenv("AWS_LAMBDA_RUNTIME_API")
+// registered_events are the Extensions API events to register for. A disabled
+// extension only registers for INVOKE, and Lambda stops it with the sandbox.
+func registered_events(settings Config) []EventType {
+	if !settings.Enabled {
+		return []EventType{Invoke}
 	}
-	if endpoint == "" {
-		log.Fatalf("%s AWS_LAMBDA_RUNTIME_API and %s are not set. Cannot determine Runtime API endpoint.", main_print_prefix, lrap_runtime_api_endpoint_env)
-	}
-	return endpoint
+	return []EventType{Invoke, Shutdown}
 }
 
-func wait_for_goroutine(done_chan <-chan struct{}, name string, timeout time.Duration) {
-	select {
-	case <-done_chan:
-		log.Printf("%s %s goroutine exited gracefully.", main_print_prefix, name)
-	case <-time.After(timeout):
-		log.Printf("%s Timeout waiting for %s goroutine to exit.", main_print_prefix, name)
+// run_event_loop reads events from the Extensions API until SHUTDOWN or until ctx
+// is cancelled, which both return a nil error. On SHUTDOWN it returns the
+// event's deadline; otherwise the deadline is zero. Any other failure is returned.
+func run_event_loop(ctx context.Context, p *RuntimeAPIProxy, extension_client *Client) (time.Time, error) {
+	logger := component_logger(component_main)
+	for {
+		event, err := extension_client.NextEvent(ctx)
+		if err != nil {
+			if ctx.Err() != nil { // Context cancelled during NextEvent
+				logger.Info("Context cancelled while waiting for next event", "error", ctx.Err())
+				return time.Time{}, nil
+			}
+			return time.Time{}, fmt.Errorf("failed to get next event: %w", err)
+		}
+
+		logger.Debug("Received event", "event_type", event.EventType, "request_id", event.RequestID)
+		switch event.EventType {
+		case Invoke:
+			if err := p.HandleInvokeEvent(ctx, event); err != nil {
+				request_logger(event.RequestID).Error("Error handling INVOKE event", "error", err)
+			}
+		case Shutdown:
+			logger.Info("Received SHUTDOWN event", "reason", event.ShutdownReason)
+			if event.DeadlineMs <= 0 {
+				return time.Time{}, nil
+			}
+			return time.UnixMilli(event.DeadlineMs), nil
+		default:
+			logger.Warn("Received unknown event type", "event_type", event.EventType)
+		}
 	}
 }
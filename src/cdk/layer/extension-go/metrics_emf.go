@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CloudWatch metrics
+//
+// With LIVE_LAMBDA_METRICS=on the extension writes one line in the CloudWatch
+// embedded metric format (EMF) to stdout after each intercepted invocation.
+// CloudWatch Logs turns it into metrics in LIVE_LAMBDA_METRICS_NAMESPACE
+// (default LiveLambda) with a FunctionName dimension, so no PutMetricData
+// calls are needed:
+//
+//   - ProxyLatency: time live-lambda spent on the invocation itself, from
+//     receiving it to publishing it plus posting the response back.
+//   - PublishLatency: how long the publish to the agent took.
+//   - RoundTrip: from publishing to receiving the agent's response.
+//   - Fallbacks: 1 when the invocation fell back or failed without a response.
+//   - Reconnects: reconnects while the invocation was in flight.
+
+const (
+	metrics_print_prefix      = "[LiveLambdaExt:Metrics]"
+	default_metrics_namespace = "LiveLambda"
+	emf_unit_milliseconds     = "Milliseconds"
+	emf_unit_count            = "Count"
+)
+
+// invocation_metrics are measured over one intercepted invocation.
+type invocation_metrics struct {
+	claim      time.Duration
+	publish    time.Duration
+	round_trip time.Duration
+	post_back  time.Duration
+	published  bool // claim and publish were measured
+	responded  bool // round_trip and post_back were measured
+	fell_back  bool
+	reconnects int
+}
+
+type emf_value struct {
+	name  string
+	unit  string
+	value float64
+}
+
+type emf_metrics struct {
+	mu            sync.Mutex
+	out           io.Writer
+	namespace     string
+	function_name string
+	now           func() time.Time
+}
+
+// new_emf_metrics_from_config returns nil unless LIVE_LAMBDA_METRICS is on.
+func new_emf_metrics_from_config(settings Config) *emf_metrics {
+	if !settings.Metrics {
+		return nil
+	}
+	return &emf_metrics{
+		out:           os.Stdout,
+		namespace:     settings.MetricsNamespace,
+		function_name: settings.FunctionName,
+		now:           time.Now,
+	}
+}
+
+// write emits values as one EMF line, with properties as extra searchable fields.
+func (m *emf_metrics) write(values []emf_value, properties map[string]interface{}) error {
+	definitions := make([]map[string]string, 0, len(values))
+	line := map[string]interface{}{
+		"FunctionName": m.function_name,
+	}
+	for name, value := range properties {
+		line[name] = value
+	}
+	for _, value := range values {
+		definitions = append(definitions, map[string]string{"Name": value.name, "Unit": value.unit})
+		line[value.name] = value.value
+	}
+	line["_aws"] = map[string]interface{}{
+		"Timestamp": m.now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  m.namespace,
+			"Dimensions": [][]string{{"FunctionName"}},
+			"Metrics":    definitions,
+		}},
+	}
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = fmt.Fprintf(m.out, "%s\n", encoded)
+	return err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// record_invocation emits the metrics of one intercepted invocation. A nil
+// emf_metrics does nothing.
+func (m *emf_metrics) record_invocation(request_id string, metrics invocation_metrics) {
+	if m == nil {
+		return
+	}
+	var values []emf_value
+	if metrics.published {
+		values = append(values,
+			emf_value{"ProxyLatency", emf_unit_milliseconds, milliseconds(metrics.claim + metrics.post_back)},
+			emf_value{"PublishLatency", emf_unit_milliseconds, milliseconds(metrics.publish)},
+		)
+	}
+	if metrics.responded {
+		values = append(values, emf_value{"RoundTrip", emf_unit_milliseconds, milliseconds(metrics.round_trip)})
+	}
+	fallbacks := 0.0
+	if metrics.fell_back {
+		fallbacks = 1
+	}
+	values = append(values,
+		emf_value{"Fallbacks", emf_unit_count, fallbacks},
+		emf_value{"Reconnects", emf_unit_count, float64(metrics.reconnects)},
+	)
+	if err := m.write(values, map[string]interface{}{"RequestId": request_id}); err != nil {
+		log.Printf("%s Error writing metrics for request ID %s: %v", metrics_print_prefix, request_id, err)
+	}
+}
+
+// mark_fallback records that request_id did not get the agent's response.
+func (p *RuntimeAPIProxy) mark_fallback(request_id string) {
+	p.prometheus.fell_back()
+	if p.requests == nil {
+		return
+	}
+	if request, ok := p.requests.lookup(request_id); ok {
+		request.update_metrics(func(m *invocation_metrics) { m.fell_back = true })
+	}
+}
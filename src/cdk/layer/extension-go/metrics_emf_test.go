@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEMFRecordInvocation(t *testing.T) {
+	var out bytes.Buffer
+	metrics := &emf_metrics{out: &out, namespace: "LiveLambda", function_name: "orders", now: func() time.Time { return time.UnixMilli(1700000000000) }}
+
+	metrics.record_invocation("req-1", invocation_metrics{
+		claim:      4 * time.Millisecond,
+		publish:    3 * time.Millisecond,
+		round_trip: 120 * time.Millisecond,
+		post_back:  time.Millisecond,
+		published:  true,
+		responded:  true,
+		reconnects: 1,
+	})
+
+	var line struct {
+		AWS struct {
+			Timestamp         int64 `json:"Timestamp"`
+			CloudWatchMetrics []struct {
+				Namespace  string              `json:"Namespace"`
+				Dimensions [][]string          `json:"Dimensions"`
+				Metrics    []map[string]string `json:"Metrics"`
+			} `json:"CloudWatchMetrics"`
+		} `json:"_aws"`
+		FunctionName   string  `json:"FunctionName"`
+		RequestID      string  `json:"RequestId"`
+		ProxyLatency   float64 `json:"ProxyLatency"`
+		PublishLatency float64 `json:"PublishLatency"`
+		RoundTrip      float64 `json:"RoundTrip"`
+		Fallbacks      float64 `json:"Fallbacks"`
+		Reconnects     float64 `json:"Reconnects"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("expected one JSON line, got %q: %v", out.String(), err)
+	}
+	if line.AWS.Timestamp != 1700000000000 || len(line.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("unexpected _aws %+v", line.AWS)
+	}
+	directive := line.AWS.CloudWatchMetrics[0]
+	if directive.Namespace != "LiveLambda" || len(directive.Dimensions) != 1 || directive.Dimensions[0][0] != "FunctionName" || len(directive.Metrics) != 5 {
+		t.Fatalf("unexpected directive %+v", directive)
+	}
+	if line.FunctionName != "orders" || line.RequestID != "req-1" || line.ProxyLatency != 5 || line.PublishLatency != 3 || line.RoundTrip != 120 || line.Fallbacks != 0 || line.Reconnects != 1 {
+		t.Fatalf("unexpected values %+v", line)
+	}
+}
+
+func TestEMFOmitsUnmeasuredLatencies(t *testing.T) {
+	var out bytes.Buffer
+	metrics := &emf_metrics{out: &out, namespace: "LiveLambda", function_name: "orders", now: time.Now}
+
+	metrics.record_invocation("req-1", invocation_metrics{fell_back: true})
+
+	var line map[string]interface{}
+	json.Unmarshal(out.Bytes(), &line)
+	if _, ok := line["RoundTrip"]; ok || line["Fallbacks"] != 1.0 {
+		t.Fatalf("unexpected line %s", out.String())
+	}
+
+	var disabled *emf_metrics
+	disabled.record_invocation("req-2", invocation_metrics{})
+}
+
+func TestRouteAgentResponseMeasuresRoundTrip(t *testing.T) {
+	start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	request.mark_published(time.Now().Add(-50 * time.Millisecond))
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"ok": true})
+
+	metrics := request.invocation_metrics()
+	if !metrics.responded || metrics.round_trip < 50*time.Millisecond {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The subset of MQTT 3.1.1 the IoT Core transport needs: a clean-session
+// CONNECT, QoS 0 PUBLISH, SUBSCRIBE/UNSUBSCRIBE and keep-alive pings. Incoming
+// QoS 1 publishes are acknowledged so the broker does not redeliver them.
+
+const (
+	mqtt_connect     byte = 1
+	mqtt_connack     byte = 2
+	mqtt_publish     byte = 3
+	mqtt_puback      byte = 4
+	mqtt_subscribe   byte = 8
+	mqtt_suback      byte = 9
+	mqtt_unsubscribe byte = 10
+	mqtt_unsuback    byte = 11
+	mqtt_pingreq     byte = 12
+	mqtt_pingresp    byte = 13
+	mqtt_disconnect  byte = 14
+
+	// SUBACK return code for a refused subscription
+	mqtt_suback_failure = 0x80
+)
+
+// mqtt_packet is a control packet split into its type, header flags and body.
+type mqtt_packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func mqtt_string(value string) []byte {
+	encoded := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(encoded, uint16(len(value)))
+	return append(encoded, value...)
+}
+
+func mqtt_packet_id(id uint16) []byte {
+	encoded := make([]byte, 2)
+	binary.BigEndian.PutUint16(encoded, id)
+	return encoded
+}
+
+// encode_mqtt_packet adds the fixed header to body.
+func encode_mqtt_packet(kind byte, flags byte, body []byte) []byte {
+	packet := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqtt_connect_packet opens a clean session for client_id.
+func mqtt_connect_packet(client_id string, keep_alive_seconds uint16) []byte {
+	body := mqtt_string("MQTT")
+	body = append(body, 4, 0x02) // protocol level 3.1.1, clean session
+	body = binary.BigEndian.AppendUint16(body, keep_alive_seconds)
+	body = append(body, mqtt_string(client_id)...)
+	return encode_mqtt_packet(mqtt_connect, 0, body)
+}
+
+func mqtt_publish_packet(topic string, payload []byte) []byte {
+	return encode_mqtt_packet(mqtt_publish, 0, append(mqtt_string(topic), payload...))
+}
+
+func mqtt_puback_packet(id uint16) []byte {
+	return encode_mqtt_packet(mqtt_puback, 0, mqtt_packet_id(id))
+}
+
+// mqtt_subscribe_packet asks for QoS 0 delivery of topic.
+func mqtt_subscribe_packet(id uint16, topic string) []byte {
+	body := append(mqtt_packet_id(id), mqtt_string(topic)...)
+	return encode_mqtt_packet(mqtt_subscribe, 0x02, append(body, 0))
+}
+
+func mqtt_unsubscribe_packet(id uint16, topic string) []byte {
+	return encode_mqtt_packet(mqtt_unsubscribe, 0x02, append(mqtt_packet_id(id), mqtt_string(topic)...))
+}
+
+func mqtt_pingreq_packet() []byte {
+	return encode_mqtt_packet(mqtt_pingreq, 0, nil)
+}
+
+func mqtt_disconnect_packet() []byte {
+	return encode_mqtt_packet(mqtt_disconnect, 0, nil)
+}
+
+// read_mqtt_packet reads the next control packet from r.
+func read_mqtt_packet(r *bufio.Reader) (mqtt_packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqtt_packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return mqtt_packet{}, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return mqtt_packet{}, errors.New("malformed MQTT remaining length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqtt_packet{}, err
+	}
+	return mqtt_packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// parse_mqtt_publish returns the topic and payload of a PUBLISH packet, and its
+// packet ID when it was sent with QoS 1 or 2.
+func parse_mqtt_publish(packet mqtt_packet) (topic string, payload []byte, id uint16, err error) {
+	if len(packet.body) < 2 {
+		return "", nil, 0, errors.New("truncated MQTT publish")
+	}
+	topic_length := int(binary.BigEndian.Uint16(packet.body))
+	rest := packet.body[2:]
+	if len(rest) < topic_length {
+		return "", nil, 0, errors.New("truncated MQTT publish topic")
+	}
+	topic, rest = string(rest[:topic_length]), rest[topic_length:]
+	if qos := (packet.flags >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return "", nil, 0, errors.New("truncated MQTT publish packet ID")
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	return topic, rest, id, nil
+}
+
+// parse_mqtt_ack returns the packet ID of a SUBACK, UNSUBACK or PUBACK and
+// whether the broker accepted it.
+func parse_mqtt_ack(packet mqtt_packet) (id uint16, accepted bool, err error) {
+	if len(packet.body) < 2 {
+		return 0, false, fmt.Errorf("truncated MQTT packet of type %d", packet.kind)
+	}
+	id = binary.BigEndian.Uint16(packet.body)
+	if packet.kind == mqtt_suback {
+		return id, len(packet.body) > 2 && packet.body[2] != mqtt_suback_failure, nil
+	}
+	return id, true, nil
+}
+
+// parse_mqtt_connack returns an error unless the broker accepted the connection.
+func parse_mqtt_connack(packet mqtt_packet) error {
+	if packet.kind != mqtt_connack || len(packet.body) < 2 {
+		return fmt.Errorf("expected CONNACK, got MQTT packet of type %d", packet.kind)
+	}
+	if code := packet.body[1]; code != 0 {
+		return fmt.Errorf("MQTT connection refused with code %d", code)
+	}
+	return nil
+}
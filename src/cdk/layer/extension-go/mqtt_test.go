@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func read_packet(t *testing.T, encoded []byte) mqtt_packet {
+	t.Helper()
+	packet, err := read_mqtt_packet(bufio.NewReader(bytes.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return packet
+}
+
+func TestMQTTPublishRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("x", 300)) // needs a two-byte remaining length
+	packet := read_packet(t, mqtt_publish_packet("live-lambda/requests", payload))
+	if packet.kind != mqtt_publish {
+		t.Fatalf("expected a PUBLISH, got type %d", packet.kind)
+	}
+	topic, body, id, err := parse_mqtt_publish(packet)
+	if err != nil || topic != "live-lambda/requests" || !bytes.Equal(body, payload) || id != 0 {
+		t.Fatalf("unexpected publish: %q %d bytes id %d (err %v)", topic, len(body), id, err)
+	}
+}
+
+func TestMQTTPublishWithQoS1CarriesPacketID(t *testing.T) {
+	body := append(append(mqtt_string("t"), 0x01, 0x02), "{}"...)
+	topic, payload, id, err := parse_mqtt_publish(mqtt_packet{kind: mqtt_publish, flags: 0x02, body: body})
+	if err != nil || topic != "t" || string(payload) != "{}" || id != 0x0102 {
+		t.Fatalf("unexpected publish: %q %q id %d (err %v)", topic, payload, id, err)
+	}
+}
+
+func TestMQTTSubscribeAcknowledgements(t *testing.T) {
+	packet := read_packet(t, mqtt_subscribe_packet(7, "live-lambda/control/fn"))
+	if packet.kind != mqtt_subscribe || packet.flags != 0x02 {
+		t.Fatalf("unexpected SUBSCRIBE header: type %d flags %d", packet.kind, packet.flags)
+	}
+
+	id, accepted, err := parse_mqtt_ack(mqtt_packet{kind: mqtt_suback, body: []byte{0, 7, 0}})
+	if err != nil || id != 7 || !accepted {
+		t.Fatalf("expected SUBACK 7 to be accepted, got %d %v (err %v)", id, accepted, err)
+	}
+	if _, accepted, _ := parse_mqtt_ack(mqtt_packet{kind: mqtt_suback, body: []byte{0, 7, mqtt_suback_failure}}); accepted {
+		t.Fatal("expected a failure return code to refuse the subscription")
+	}
+}
+
+func TestMQTTConnack(t *testing.T) {
+	if err := parse_mqtt_connack(mqtt_packet{kind: mqtt_connack, body: []byte{0, 0}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := parse_mqtt_connack(mqtt_packet{kind: mqtt_connack, body: []byte{0, 5}}); err == nil {
+		t.Fatal("expected a refused connection to fail")
+	}
+}
+
+func TestMQTTRejectsMalformedLength(t *testing.T) {
+	_, err := read_mqtt_packet(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})))
+	if err == nil {
+		t.Fatal("expected a five-byte remaining length to be rejected")
+	}
+}
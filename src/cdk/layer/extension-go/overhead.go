@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Overhead reports
+//
+// For an intercepted invocation, the round trip to the developer's machine
+// (publish to response) stands in for the function's own execution. Lambda's
+// platform.report record carries the duration the platform measured for the
+// whole invocation. Correlating the two by request ID gives the time
+// live-lambda added around the round trip: claiming the invocation,
+// publishing it, posting the response back and the proxy hops in between.
+// Each correlated report is logged and published as an "overhead_report"
+// lifecycle event.
+
+const (
+	overhead_print_prefix     = "[LiveLambdaExt:Overhead]"
+	platform_report_type      = "platform.report"
+	overhead_tunnel_retention = 5 * time.Minute
+	max_tracked_tunnels       = 256
+)
+
+type overhead_report struct {
+	RequestID          string  `json:"request_id"`
+	PlatformDurationMs float64 `json:"platform_duration_ms"`
+	BilledDurationMs   float64 `json:"billed_duration_ms"`
+	TunnelMs           float64 `json:"tunnel_ms"`
+	AddedMs            float64 `json:"added_ms"`
+}
+
+type tunnel_measurement struct {
+	duration    time.Duration
+	recorded_at time.Time
+}
+
+// overhead_tracker holds tunnel times until the matching platform.report
+// arrives. A nil tracker records nothing.
+type overhead_tracker struct {
+	mu      sync.Mutex
+	tunnels map[string]tunnel_measurement
+	now     func() time.Time
+}
+
+func new_overhead_tracker() *overhead_tracker {
+	return &overhead_tracker{
+		tunnels: map[string]tunnel_measurement{},
+		now:     time.Now,
+	}
+}
+
+// record_tunnel remembers how long request_id spent on the round trip to the agent.
+func (t *overhead_tracker) record_tunnel(request_id string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.expire_locked(now)
+	if len(t.tunnels) >= max_tracked_tunnels {
+		t.evict_oldest_locked()
+	}
+	t.tunnels[request_id] = tunnel_measurement{duration: duration, recorded_at: now}
+}
+
+// correlate matches platform.report events against recorded tunnel times. Each
+// tunnel is reported at most once; reports for pass-through invocations are skipped.
+func (t *overhead_tracker) correlate(events []log_record) []overhead_report {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire_locked(t.now())
+	var reports []overhead_report
+	for _, event := range events {
+		report, ok := parse_platform_report(event)
+		if !ok {
+			continue
+		}
+		tunnel, tracked := t.tunnels[report.RequestID]
+		if !tracked {
+			continue
+		}
+		delete(t.tunnels, report.RequestID)
+		report.TunnelMs = float64(tunnel.duration.Microseconds()) / 1000
+		report.AddedMs = report.PlatformDurationMs - report.TunnelMs
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func (t *overhead_tracker) expire_locked(now time.Time) {
+	for request_id, tunnel := range t.tunnels {
+		if now.Sub(tunnel.recorded_at) > overhead_tunnel_retention {
+			delete(t.tunnels, request_id)
+		}
+	}
+}
+
+func (t *overhead_tracker) evict_oldest_locked() {
+	var oldest_id string
+	var oldest time.Time
+	for request_id, tunnel := range t.tunnels {
+		if oldest_id == "" || tunnel.recorded_at.Before(oldest) {
+			oldest_id, oldest = request_id, tunnel.recorded_at
+		}
+	}
+	delete(t.tunnels, oldest_id)
+}
+
+// parse_platform_report reads the request ID and durations of a platform.report event.
+func parse_platform_report(event log_record) (overhead_report, bool) {
+	if event.Type != platform_report_type {
+		return overhead_report{}, false
+	}
+	var record struct {
+		RequestID string `json:"requestId"`
+		Metrics   struct {
+			DurationMs       float64 `json:"durationMs"`
+			BilledDurationMs float64 `json:"billedDurationMs"`
+		} `json:"metrics"`
+	}
+	if err := json.Unmarshal(event.Record, &record); err != nil || record.RequestID == "" {
+		return overhead_report{}, false
+	}
+	return overhead_report{
+		RequestID:          record.RequestID,
+		PlatformDurationMs: record.Metrics.DurationMs,
+		BilledDurationMs:   record.Metrics.BilledDurationMs,
+	}, true
+}
+
+// observe_platform_reports logs and publishes the overhead of every intercepted
+// invocation found in a Telemetry API batch.
+func (p *RuntimeAPIProxy) observe_platform_reports(events []log_record) {
+	reports := p.overhead.correlate(events)
+	if len(reports) == 0 {
+		return
+	}
+	go func() {
+		for _, report := range reports {
+			log.Printf("%s live-lambda added %.1f ms to request ID %s (platform %.1f ms, round trip %.1f ms)",
+				overhead_print_prefix, report.AddedMs, report.RequestID, report.PlatformDurationMs, report.TunnelMs)
+			ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+			p.publish_lifecycle_event(ctx, "overhead_report", map[string]interface{}{
+				"request_id":           report.RequestID,
+				"platform_duration_ms": report.PlatformDurationMs,
+				"billed_duration_ms":   report.BilledDurationMs,
+				"tunnel_ms":            report.TunnelMs,
+				"added_ms":             report.AddedMs,
+			})
+			cancel()
+		}
+	}()
+}
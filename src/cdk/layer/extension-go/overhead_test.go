@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func platform_report(request_id string, duration_ms float64) log_record {
+	record := fmt.Sprintf(`{"requestId":%q,"status":"success","metrics":{"durationMs":%g,"billedDurationMs":%g}}`, request_id, duration_ms, duration_ms+1)
+	return log_record{Time: "2024-01-01T00:00:00Z", Type: platform_report_type, Record: json.RawMessage(record)}
+}
+
+func TestOverheadTrackerCorrelatesReports(t *testing.T) {
+	tracker := new_overhead_tracker()
+	tracker.record_tunnel("req-1", 180*time.Millisecond)
+
+	reports := tracker.correlate([]log_record{
+		{Type: "function", Record: json.RawMessage(`"log line"`)},
+		platform_report("req-passthrough", 40),
+		platform_report("req-1", 212.5),
+	})
+	if len(reports) != 1 {
+		t.Fatalf("expected one report, got %+v", reports)
+	}
+	report := reports[0]
+	if report.RequestID != "req-1" || report.TunnelMs != 180 || report.AddedMs != 32.5 || report.BilledDurationMs != 213.5 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if again := tracker.correlate([]log_record{platform_report("req-1", 212.5)}); len(again) != 0 {
+		t.Fatalf("expected a tunnel to be reported once, got %+v", again)
+	}
+}
+
+func TestOverheadTrackerBoundsMemory(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := new_overhead_tracker()
+	tracker.now = func() time.Time { return now }
+
+	for i := 0; i <= max_tracked_tunnels; i++ {
+		now = now.Add(time.Millisecond)
+		tracker.record_tunnel(fmt.Sprintf("req-%d", i), time.Millisecond)
+	}
+	if len(tracker.tunnels) != max_tracked_tunnels {
+		t.Fatalf("expected %d tracked tunnels, got %d", max_tracked_tunnels, len(tracker.tunnels))
+	}
+	if _, kept := tracker.tunnels["req-0"]; kept {
+		t.Fatal("expected the oldest tunnel to be evicted")
+	}
+
+	now = now.Add(overhead_tunnel_retention + time.Second)
+	if reports := tracker.correlate([]log_record{platform_report("req-5", 10)}); len(reports) != 0 {
+		t.Fatalf("expected expired tunnels to be forgotten, got %+v", reports)
+	}
+}
+
+func TestNilOverheadTracker(t *testing.T) {
+	var tracker *overhead_tracker
+	tracker.record_tunnel("req-1", time.Second)
+	if reports := tracker.correlate([]log_record{platform_report("req-1", 10)}); reports != nil {
+		t.Fatalf("expected a nil tracker to report nothing, got %+v", reports)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Payload encryption
+//
+// AppSync Events is TLS on the wire, but the service itself sees every event.
+// LIVE_LAMBDA_PAYLOAD_KEY_ARN encrypts event and response bodies end to end
+// with AES-256-GCM, so the relay only ever carries ciphertext. The ARN names
+// either:
+//
+//   - a Secrets Manager secret whose SecretString is a base64 256-bit key,
+//     which the developer's agent reads as well, or
+//   - a KMS key, from which the extension generates one data key per sandbox.
+//     Envelopes carry the wrapped data key and the agent unwraps it with
+//     kms:Decrypt.
+//
+// After compression, the extension replaces event_payload with
+//
+//	{"type": "encrypted_payload", "alg": "A256GCM", "nonce": "...", "ciphertext": "..."}
+//
+// holding the JSON value event_payload had, and adds
+// "payload_key": {"key_arn": "...", "wrapped_key": "..."} to the envelope. The
+// agent publishes the same frame in place of the response it would otherwise
+// send, under the same key. The request ID is the additional data, so one
+// invocation's ciphertext cannot be replayed as another's.
+//
+// With a key configured, invocations for agents without the encryption
+// capability, or while the key cannot be fetched, pass through to the
+// function, and responses that are not encrypted are dropped. Payload
+// references are the exception: the offload bucket is in the function's
+// account, so offloaded events and responses are stored unencrypted.
+
+const (
+	encrypted_payload_frame_type    = protocol.TypeEncryptedPayload
+	payload_encryption_algorithm    = "A256GCM"
+	payload_key_bytes               = 32
+	kms_generate_data_key_target    = "TrentService.GenerateDataKey"
+	secrets_get_secret_value_target = "secretsmanager.GetSecretValue"
+)
+
+// data_key is the key payloads are encrypted with.
+type data_key struct {
+	key         []byte
+	description protocol.PayloadKey
+}
+
+// payload_encryptor fetches and caches the data key. A nil encryptor encrypts
+// nothing.
+type payload_encryptor struct {
+	key_arn string
+	fetch   func(ctx context.Context) (*data_key, error)
+
+	mu  sync.Mutex
+	key *data_key
+}
+
+// new_payload_encryptor_from_config returns nil unless LIVE_LAMBDA_PAYLOAD_KEY_ARN
+// is set. Validate has already checked the ARN.
+func new_payload_encryptor_from_config(cfg aws.Config, settings Config) *payload_encryptor {
+	if settings.PayloadKeyARN == "" {
+		return nil
+	}
+	service, region := parse_resource_arn(settings.PayloadKeyARN)
+	e := &payload_encryptor{key_arn: settings.PayloadKeyARN}
+	switch service {
+	case "kms":
+		e.fetch = func(ctx context.Context) (*data_key, error) {
+			return generate_kms_data_key(ctx, cfg, region, e.key_arn)
+		}
+	default:
+		e.fetch = func(ctx context.Context) (*data_key, error) {
+			return read_secret_key(ctx, cfg, region, e.key_arn)
+		}
+	}
+	component_logger(component_encryption).Info("Encrypting payloads", "key_arn", settings.PayloadKeyARN)
+	return e
+}
+
+// data_key returns the cached key, fetching it on first use. A failed fetch is
+// retried on the next call.
+func (e *payload_encryptor) data_key(ctx context.Context) (*data_key, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.key != nil {
+		return e.key, nil
+	}
+	key, err := e.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(key.key) != payload_key_bytes {
+		return nil, fmt.Errorf("%s is not a %d-bit key", e.key_arn, payload_key_bytes*8)
+	}
+	e.key = key
+	return key, nil
+}
+
+// cached_key returns the key without fetching it.
+func (e *payload_encryptor) cached_key() *data_key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.key
+}
+
+// seal_request_envelope encrypts the value of event_payload, if the envelope
+// has one, and describes the key.
+func (k *data_key) seal_request_envelope(request_id string, envelope *protocol.Request) {
+	description := k.description
+	envelope.PayloadKey = &description
+	if len(envelope.EventPayload) == 0 {
+		return
+	}
+	plaintext, _ := json.Marshal(envelope.EventPayload)
+	envelope.EventPayload, _ = json.Marshal(seal_payload(k.key, request_id, plaintext))
+}
+
+// open_response decrypts an agent's response frame. Only payload references
+// may arrive unencrypted.
+func (e *payload_encryptor) open_response(request_id string, frame []byte) ([]byte, error) {
+	if _, is_ref, _ := parse_payload_reference(frame); is_ref {
+		return frame, nil
+	}
+	var probe protocol.EncryptedPayload
+	if json.Unmarshal(frame, &probe) != nil || probe.Type != encrypted_payload_frame_type {
+		return nil, fmt.Errorf("the response is not encrypted")
+	}
+	key := e.cached_key()
+	if key == nil {
+		return nil, fmt.Errorf("no payload key has been fetched")
+	}
+	return open_payload(key.key, request_id, probe)
+}
+
+func seal_payload(key []byte, request_id string, plaintext []byte) protocol.EncryptedPayload {
+	aead := new_payload_aead(key)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return protocol.EncryptedPayload{
+		Type:       encrypted_payload_frame_type,
+		Algorithm:  payload_encryption_algorithm,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, []byte(request_id))),
+	}
+}
+
+func open_payload(key []byte, request_id string, frame protocol.EncryptedPayload) ([]byte, error) {
+	if frame.Algorithm != payload_encryption_algorithm {
+		return nil, fmt.Errorf("unsupported payload encryption %q", frame.Algorithm)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(frame.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("nonce is not base64: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(frame.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("ciphertext is not base64: %w", err)
+	}
+	aead := new_payload_aead(key)
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce is %d bytes, expected %d", len(nonce), aead.NonceSize())
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(request_id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// new_payload_aead returns AES-256-GCM for a key data_key has checked.
+func new_payload_aead(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// generate_kms_data_key asks KMS for a data key under key_arn.
+func generate_kms_data_key(ctx context.Context, cfg aws.Config, region string, key_arn string) (*data_key, error) {
+	body, _ := json.Marshal(map[string]string{"KeyId": key_arn, "KeySpec": "AES_256"})
+	response, err := send_aws_json_request(ctx, cfg, "kms", region, kms_generate_data_key_target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a data key: %w", err)
+	}
+	var generated struct {
+		CiphertextBlob string
+		Plaintext      string
+	}
+	if err := json.Unmarshal(response, &generated); err != nil {
+		return nil, fmt.Errorf("failed to parse the data key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(generated.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("data key is not base64: %w", err)
+	}
+	return &data_key{key: key, description: protocol.PayloadKey{KeyARN: key_arn, WrappedKey: generated.CiphertextBlob}}, nil
+}
+
+// read_secret_key reads a base64 key from a Secrets Manager secret.
+func read_secret_key(ctx context.Context, cfg aws.Config, region string, secret_arn string) (*data_key, error) {
+	body, _ := json.Marshal(map[string]string{"SecretId": secret_arn})
+	response, err := send_aws_json_request(ctx, cfg, "secretsmanager", region, secrets_get_secret_value_target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the key secret: %w", err)
+	}
+	var secret struct {
+		SecretString string
+	}
+	if err := json.Unmarshal(response, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse the key secret: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret.SecretString))
+	if err != nil {
+		return nil, fmt.Errorf("the key secret is not base64: %w", err)
+	}
+	return &data_key{key: key, description: protocol.PayloadKey{KeyARN: secret_arn}}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func new_test_encryptor() *payload_encryptor {
+	key := &data_key{key: bytes.Repeat([]byte{7}, payload_key_bytes), description: protocol.PayloadKey{KeyARN: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:live-lambda"}}
+	return &payload_encryptor{
+		key_arn: key.description.KeyARN,
+		fetch:   func(ctx context.Context) (*data_key, error) { return key, nil },
+	}
+}
+
+func TestSealedPayloadsAreBoundToTheirRequest(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, payload_key_bytes)
+	sealed := seal_payload(key, "req-1", []byte(`{"secret":true}`))
+	if plaintext, err := open_payload(key, "req-1", sealed); err != nil || string(plaintext) != `{"secret":true}` {
+		t.Fatalf("unexpected result %q, %v", plaintext, err)
+	}
+	if _, err := open_payload(key, "req-2", sealed); err == nil {
+		t.Fatal("expected a payload sealed for another request to be rejected")
+	}
+}
+
+func TestSealRequestEnvelopeEncryptsTheEventValue(t *testing.T) {
+	encryptor := new_test_encryptor()
+	key, _ := encryptor.data_key(context.Background())
+	payload := &protocol.Request{RequestID: "req-1", EventPayload: json.RawMessage(`{"card":"4111"}`)}
+	key.seal_request_envelope("req-1", payload)
+	if err := payload.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, _ := json.Marshal(payload)
+	if bytes.Contains(envelope, []byte("4111")) {
+		t.Fatalf("expected the event to be encrypted, got %s", envelope)
+	}
+	var decoded struct {
+		EventPayload protocol.EncryptedPayload `json:"event_payload"`
+		PayloadKey   protocol.PayloadKey       `json:"payload_key"`
+	}
+	json.Unmarshal(envelope, &decoded)
+	plaintext, err := open_payload(key.key, "req-1", decoded.EventPayload)
+	if err != nil || string(plaintext) != `{"card":"4111"}` || decoded.PayloadKey.KeyARN != encryptor.key_arn {
+		t.Fatalf("unexpected envelope %s: %q %v", envelope, plaintext, err)
+	}
+}
+
+func TestPayloadEncryptorRetriesFailedFetches(t *testing.T) {
+	attempts := 0
+	encryptor := &payload_encryptor{key_arn: "arn", fetch: func(ctx context.Context) (*data_key, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("throttled")
+		}
+		return &data_key{key: make([]byte, payload_key_bytes)}, nil
+	}}
+	if _, err := encryptor.data_key(context.Background()); err == nil {
+		t.Fatal("expected the first fetch to fail")
+	}
+	encryptor.data_key(context.Background())
+	encryptor.data_key(context.Background())
+	if attempts != 2 {
+		t.Fatalf("expected the key to be fetched until it succeeds and then cached, got %d fetches", attempts)
+	}
+}
+
+func TestRouteAgentResponseOnlyPostsEncryptedResponses(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.encryptor = new_test_encryptor()
+	key, _ := proxy.encryptor.data_key(context.Background())
+	proxy.requests.register("req-1", []byte(`{}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"statusCode": 200, "body": "spoofed"})
+	proxy.route_agent_response("req-1", seal_payload(key.key, "req-1", []byte(`{"statusCode":200}`)))
+
+	select {
+	case posted := <-received:
+		if posted.body != `{"statusCode":200}` {
+			t.Fatalf("expected only the decrypted response to be posted, got %q", posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+}
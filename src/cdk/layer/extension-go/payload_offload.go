@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// AppSync Events caps each event well below Lambda's 6MB payload limit. When
+// LIVE_LAMBDA_OFFLOAD_BUCKET is set, events larger than the offload threshold
+// are uploaded to S3 and the request envelope carries a presigned GET URL in
+// event_payload_ref instead. Every envelope also carries response_upload, a
+// presigned PUT/GET pair the agent can use to hand back an oversized response
+// as a payload_ref frame without needing its own S3 access.
+//
+// Uploaded objects are tagged live-lambda:expires-at with the Unix time after
+// which nothing will read them, so `live-lambda cleanup` can remove payloads
+// left behind by crashed sessions.
+
+const (
+	offload_print_prefix         = "[LiveLambdaExt:Offload]"
+	payload_ref_frame_type       = protocol.TypePayloadReference
+	default_offload_threshold    = 200 * 1024
+	default_offload_prefix       = "live-lambda/payloads/"
+	offload_url_expiry           = 15 * time.Minute
+	max_offloaded_payload_bytes  = 6 * 1024 * 1024
+	offload_request_payload_name = "request.json"
+	offload_response_name        = "response.json"
+	offload_expires_at_tag       = "live-lambda:expires-at"
+	default_offload_ttl          = time.Hour
+)
+
+type payload_offloader struct {
+	cfg       aws.Config
+	region    string
+	bucket    string
+	prefix    string
+	threshold int
+	ttl       time.Duration // how long uploads are kept; 0 leaves them untagged
+}
+
+// s3_object_url is overridden in tests.
+var s3_object_url = func(bucket string, region string, key string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, (&url.URL{Path: key}).EscapedPath())
+}
+
+// new_payload_offloader_from_config returns nil when no offload bucket is
+// configured. The bucket is assumed to be in the function's region unless
+// LIVE_LAMBDA_OFFLOAD_REGION says otherwise.
+func new_payload_offloader_from_config(cfg aws.Config, region string, settings Config) *payload_offloader {
+	bucket := settings.OffloadBucket
+	if bucket == "" {
+		return nil
+	}
+	prefix := settings.OffloadPrefix
+	if prefix == "" {
+		prefix = default_offload_prefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if bucket_region := settings.OffloadRegion; bucket_region != "" {
+		region = bucket_region
+	} else if function_region := settings.FunctionRegion; function_region != "" {
+		region = function_region
+	}
+	offloader := &payload_offloader{
+		cfg:       cfg,
+		region:    region,
+		bucket:    bucket,
+		prefix:    prefix,
+		threshold: settings.OffloadThreshold,
+		ttl:       settings.OffloadTTL,
+	}
+	log.Printf("%s Offloading payloads over %d bytes to s3://%s/%s", offload_print_prefix, offloader.threshold, bucket, prefix)
+	return offloader
+}
+
+func (o *payload_offloader) should_offload(size int) bool {
+	return o != nil && size > o.threshold
+}
+
+func (o *payload_offloader) object_url(request_id string, name string) string {
+	return s3_object_url(o.bucket, o.region, o.prefix+request_id+"/"+name)
+}
+
+// offload uploads payload for request_id and returns a reference to it.
+func (o *payload_offloader) offload(ctx context.Context, request_id string, name string, payload []byte) (protocol.PayloadReference, error) {
+	object_url := o.object_url(request_id, name)
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	if o.ttl > 0 {
+		headers.Set("X-Amz-Tagging", expiry_tagging(time.Now().Add(o.ttl)))
+	}
+	if _, err := send_signed_request(ctx, o.cfg, "s3", o.region, http.MethodPut, object_url, payload, headers); err != nil {
+		return protocol.PayloadReference{}, fmt.Errorf("failed to upload payload: %w", err)
+	}
+	get_url, err := presign_request(ctx, o.cfg, "s3", o.region, http.MethodGet, object_url, offload_url_expiry)
+	if err != nil {
+		return protocol.PayloadReference{}, err
+	}
+	return protocol.PayloadReference{
+		Type:     payload_ref_frame_type,
+		URL:      get_url,
+		Size:     len(payload),
+		Checksum: payload_checksum(payload),
+	}, nil
+}
+
+// expiry_tagging returns the X-Amz-Tagging value marking an object as expired after expires_at.
+func expiry_tagging(expires_at time.Time) string {
+	return url.Values{offload_expires_at_tag: {strconv.FormatInt(expires_at.Unix(), 10)}}.Encode()
+}
+
+// response_upload presigns the location the agent may upload an oversized response to.
+func (o *payload_offloader) response_upload(ctx context.Context, request_id string) (protocol.ResponseUpload, error) {
+	object_url := o.object_url(request_id, offload_response_name)
+	put_url, err := presign_request(ctx, o.cfg, "s3", o.region, http.MethodPut, object_url, offload_url_expiry)
+	if err != nil {
+		return protocol.ResponseUpload{}, err
+	}
+	get_url, err := presign_request(ctx, o.cfg, "s3", o.region, http.MethodGet, object_url, offload_url_expiry)
+	if err != nil {
+		return protocol.ResponseUpload{}, err
+	}
+	return protocol.ResponseUpload{PutURL: put_url, GetURL: get_url}, nil
+}
+
+// offload_request_envelope moves the event out of envelope when it is too
+// large and returns the envelope to publish. A nil offloader never offloads.
+func (o *payload_offloader) offload_request_envelope(ctx context.Context, request_id string, envelope *protocol.Request, event []byte) ([]byte, error) {
+	payload_bytes, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if !o.should_offload(len(payload_bytes)) {
+		return payload_bytes, nil
+	}
+	ref, err := o.offload(ctx, request_id, offload_request_payload_name, event)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s Offloaded %d byte event for request ID %s", offload_print_prefix, len(event), request_id)
+	envelope.EventPayload = nil
+	envelope.ContentEncoding = ""
+	envelope.EventPayloadRef = &ref
+	return json.Marshal(envelope)
+}
+
+// parse_payload_reference decodes a frame if it is a payload_ref; ok is false for other frames.
+func parse_payload_reference(frame []byte) (protocol.PayloadReference, bool, error) {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &probe) != nil || probe.Type != payload_ref_frame_type {
+		return protocol.PayloadReference{}, false, nil
+	}
+	var ref protocol.PayloadReference
+	if err := json.Unmarshal(frame, &ref); err != nil {
+		return protocol.PayloadReference{}, true, fmt.Errorf("malformed payload_ref frame: %w", err)
+	}
+	return ref, true, nil
+}
+
+// fetch_payload_reference downloads a referenced payload and verifies its checksum.
+func fetch_payload_reference(ctx context.Context, ref protocol.PayloadReference) ([]byte, error) {
+	if ref.URL == "" {
+		return nil, fmt.Errorf("payload_ref is missing url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := aws_api_http_client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download payload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("payload download failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(resp.Body, max_offloaded_payload_bytes+1)); err != nil {
+		return nil, fmt.Errorf("failed to read payload: %w", err)
+	}
+	if buf.Len() > max_offloaded_payload_bytes {
+		return nil, fmt.Errorf("payload exceeds %d bytes", max_offloaded_payload_bytes)
+	}
+	if ref.Size > 0 && buf.Len() != ref.Size {
+		return nil, fmt.Errorf("payload size %d does not match reference size %d", buf.Len(), ref.Size)
+	}
+	if ref.Checksum != "" && payload_checksum(buf.Bytes()) != ref.Checksum {
+		return nil, fmt.Errorf("payload checksum mismatch")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// start_fake_s3 stores PUT bodies by path and serves them back on GET.
+func start_fake_s3(t *testing.T) map[string][]byte {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	previous := s3_object_url
+	s3_object_url = func(bucket string, region string, key string) string {
+		return server.URL + "/" + bucket + "/" + key
+	}
+	t.Cleanup(func() { s3_object_url = previous })
+	return objects
+}
+
+func test_offloader(threshold int) *payload_offloader {
+	return &payload_offloader{
+		cfg:       aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")},
+		region:    "us-east-1",
+		bucket:    "payloads",
+		prefix:    default_offload_prefix,
+		threshold: threshold,
+	}
+}
+
+func TestOffloadRequestEnvelopeKeepsSmallEventsInline(t *testing.T) {
+	objects := start_fake_s3(t)
+	payload := &protocol.Request{RequestID: "r1", EventPayload: json.RawMessage(`{"a":1}`)}
+
+	envelope, err := test_offloader(1024).offload_request_envelope(context.Background(), "r1", payload, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(envelope), `"event_payload":{"a":1}`) || len(objects) != 0 {
+		t.Fatalf("expected the event inline, got %s", envelope)
+	}
+
+	var nil_offloader *payload_offloader
+	if _, err := nil_offloader.offload_request_envelope(context.Background(), "r1", payload, nil); err != nil {
+		t.Fatalf("a nil offloader should publish inline: %v", err)
+	}
+}
+
+func TestOffloadRequestEnvelopeRoundTrip(t *testing.T) {
+	objects := start_fake_s3(t)
+	event := []byte(`{"body":"` + strings.Repeat("x", 2048) + `"}`)
+	payload := &protocol.Request{RequestID: "r2", EventPayload: event}
+
+	envelope, err := test_offloader(1024).offload_request_envelope(context.Background(), "r2", payload, event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(envelope) >= 1024 {
+		t.Fatalf("envelope is still %d bytes", len(envelope))
+	}
+	if string(objects["/payloads/live-lambda/payloads/r2/request.json"]) != string(event) {
+		t.Fatalf("event was not uploaded: %v", objects)
+	}
+
+	var published struct {
+		EventPayload json.RawMessage           `json:"event_payload"`
+		Ref          protocol.PayloadReference `json:"event_payload_ref"`
+	}
+	json.Unmarshal(envelope, &published)
+	if published.EventPayload != nil || published.Ref.Type != payload_ref_frame_type || payload.Validate() != nil {
+		t.Fatalf("unexpected envelope: %s", envelope)
+	}
+
+	fetched, err := fetch_payload_reference(context.Background(), published.Ref)
+	if err != nil || string(fetched) != string(event) {
+		t.Fatalf("rehydrated %q, %v", fetched, err)
+	}
+}
+
+func TestOffloadTagsUploadsWithExpiry(t *testing.T) {
+	tagging := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			tagging <- r.Header.Get("X-Amz-Tagging")
+		}
+	}))
+	defer server.Close()
+	previous := s3_object_url
+	s3_object_url = func(bucket string, region string, key string) string { return server.URL + "/" + key }
+	defer func() { s3_object_url = previous }()
+
+	offloader := test_offloader(10)
+	offloader.ttl = time.Hour
+	before := time.Now()
+	if _, err := offloader.offload(context.Background(), "r1", offload_request_payload_name, []byte(`{}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	values, err := url.ParseQuery(<-tagging)
+	if err != nil {
+		t.Fatalf("malformed tagging header: %v", err)
+	}
+	expires_at, err := strconv.ParseInt(values.Get(offload_expires_at_tag), 10, 64)
+	if err != nil || expires_at < before.Add(time.Hour).Unix() || expires_at > time.Now().Add(time.Hour).Unix() {
+		t.Fatalf("expected an expiry an hour from now, got %v (err %v)", values, err)
+	}
+}
+
+func TestFetchPayloadReferenceVerifiesChecksum(t *testing.T) {
+	objects := start_fake_s3(t)
+	objects["/payloads/tampered"] = []byte(`{"ok":false}`)
+
+	ref := protocol.PayloadReference{
+		Type:     payload_ref_frame_type,
+		URL:      s3_object_url("payloads", "us-east-1", "tampered"),
+		Size:     len(`{"ok":false}`),
+		Checksum: payload_checksum([]byte(`{"ok":true}`)),
+	}
+	if _, err := fetch_payload_reference(context.Background(), ref); err == nil {
+		t.Fatal("expected a checksum mismatch")
+	}
+
+	ref.URL = s3_object_url("payloads", "us-east-1", "missing")
+	if _, err := fetch_payload_reference(context.Background(), ref); err == nil {
+		t.Fatal("expected an error for a missing object")
+	}
+}
+
+func TestParsePayloadReference(t *testing.T) {
+	ref, ok, err := parse_payload_reference([]byte(`{"type":"payload_ref","url":"https://example.com/x","size":3}`))
+	if !ok || err != nil || ref.URL != "https://example.com/x" || ref.Size != 3 {
+		t.Fatalf("unexpected result: %+v %v %v", ref, ok, err)
+	}
+	if _, ok, _ := parse_payload_reference([]byte(`{"statusCode":200}`)); ok {
+		t.Fatal("plain responses are not payload references")
+	}
+}
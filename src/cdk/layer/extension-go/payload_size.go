@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Payload size accounting
+//
+// AppSync Events caps each event at 240KB, and Lambda caps a synchronous
+// response at 6MB. A payload over either limit used to surface as an opaque
+// publish failure or a 413 from the Runtime API. Instead, the extension
+// measures each serialized envelope against the limit that applies to it:
+//
+//   - a request envelope published inline, against max_inline_event_bytes
+//     (request envelopes are only chunked when the agent supports it, and
+//     offloaded envelopes are small),
+//   - a response the agent sent, and a response the function posted itself,
+//     against Lambda's response limit.
+//
+// Payloads over payload_size_warning_ratio of their limit are logged as a
+// warning. Payloads over the limit are not sent; the extension publishes a
+// payload_too_large lifecycle event with the actual size and the limit,
+//
+//	{"type": "payload_too_large", "data": {"request_id": "...", "direction": "request", "size_bytes": 262144, "limit_bytes": 204800}}
+//
+// and applies the fallback policy to a request, or fails the invocation with
+// LiveLambda.PayloadTooLarge for an agent response. A function's own response
+// is still posted, so the function sees Lambda's own error.
+
+const (
+	lambda_response_limit_bytes  = 6 * 1024 * 1024
+	payload_size_warning_ratio   = 0.8
+	payload_too_large_event_type = "payload_too_large"
+	payload_too_large_error_type = "LiveLambda.PayloadTooLarge"
+	payload_size_publish_timeout = 5 * time.Second
+
+	payload_direction_request        = "request"
+	payload_direction_response       = "response"
+	payload_direction_function_reply = "function_response"
+)
+
+// payload_too_large_error is a payload that exceeds the limit for its direction.
+type payload_too_large_error struct {
+	direction string
+	size      int
+	limit     int
+}
+
+func (e *payload_too_large_error) Error() string {
+	return fmt.Sprintf("the %s is %d bytes, over the %d byte limit", e.direction, e.size, e.limit)
+}
+
+// is_payload_too_large reports whether err comes from account_payload_size.
+func is_payload_too_large(err error) bool {
+	var too_large *payload_too_large_error
+	return errors.As(err, &too_large)
+}
+
+// account_payload_size checks the serialized size of a payload for request_id
+// against limit. It warns when the payload approaches the limit, and reports
+// and returns a payload_too_large_error when it exceeds it.
+func (p *RuntimeAPIProxy) account_payload_size(request_id string, direction string, size int, limit int) error {
+	logger := request_logger(request_id)
+	if size <= limit {
+		if float64(size) >= payload_size_warning_ratio*float64(limit) {
+			logger.Warn("Payload is close to the size limit", "direction", direction, "bytes", size, "limit_bytes", limit)
+		}
+		return nil
+	}
+	err := &payload_too_large_error{direction: direction, size: size, limit: limit}
+	logger.Error("Payload is too large", "direction", direction, "bytes", size, "limit_bytes", limit)
+	p.explain(request_id, payload_too_large_event_type, "%v", err)
+	data := map[string]interface{}{
+		"request_id":  request_id,
+		"direction":   direction,
+		"size_bytes":  size,
+		"limit_bytes": limit,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), payload_size_publish_timeout)
+		defer cancel()
+		p.publish_lifecycle_event(ctx, payload_too_large_event_type, data)
+	}()
+	return err
+}
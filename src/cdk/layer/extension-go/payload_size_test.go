@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountPayloadSize(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+
+	if err := proxy.account_payload_size("req-1", payload_direction_request, 190*1024, max_inline_event_bytes); err != nil {
+		t.Fatalf("expected a payload under the limit to pass, got %v", err)
+	}
+	err := proxy.account_payload_size("req-2", payload_direction_request, 300*1024, max_inline_event_bytes)
+	if !is_payload_too_large(err) || !strings.Contains(err.Error(), "307200 bytes") {
+		t.Fatalf("expected a payload_too_large_error, got %v", err)
+	}
+	data := wait_for_lifecycle_event(t, server, proxy, payload_too_large_event_type)
+	if data["request_id"] != "req-2" || data["direction"] != payload_direction_request || data["size_bytes"] != float64(300*1024) || data["limit_bytes"] != float64(max_inline_event_bytes) {
+		t.Fatalf("unexpected payload_too_large event %v", data)
+	}
+}
+
+func TestPostAgentResponseRefusesOversizedResponses(t *testing.T) {
+	posts := start_flaky_runtime_api(t)
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+
+	response, _ := json.Marshal(strings.Repeat("x", lambda_response_limit_bytes))
+	proxy.post_agent_response("req-1", []byte(`{}`), response)
+	got := posts()
+	if len(got) != 1 || got[0].path != "/2018-06-01/runtime/invocation/req-1/error" || !strings.Contains(got[0].body, payload_too_large_error_type) {
+		t.Fatalf("expected only an invocation error, got %d posts", len(got))
+	}
+	data := wait_for_lifecycle_event(t, server, proxy, payload_too_large_event_type)
+	if data["direction"] != payload_direction_response || data["limit_bytes"] != float64(lambda_response_limit_bytes) {
+		t.Fatalf("unexpected payload_too_large event %v", data)
+	}
+}
+
+func TestFallBackOnOversizedRequestSparesTunnelBreaker(t *testing.T) {
+	posts := start_flaky_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+	proxy.tunnel_breaker = new_tunnel_breaker(1, time.Minute)
+	proxy.interception = new_interception_switch()
+
+	if !proxy.fall_back("req-1", &payload_too_large_error{direction: payload_direction_request, size: 2, limit: 1}) {
+		t.Fatal("expected the invocation to be failed in error mode")
+	}
+	if got := posts(); len(got) != 1 || !strings.Contains(got[0].body, payload_too_large_error_type) {
+		t.Fatalf("expected a %s invocation error, got %+v", payload_too_large_error_type, got)
+	}
+	if enabled, _ := proxy.interception.enabled(); !enabled {
+		t.Fatal("an oversized payload should not trip the tunnel breaker")
+	}
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RedactedPrefix starts a value the extension redacted. The rest is the first
+// 16 hex digits of the value's SHA-256, so equal values redact alike and a
+// developer can tell which secret a field held without seeing it.
+const RedactedPrefix = "redacted:sha256:"
+
+// Redact returns what the extension publishes in place of value.
+func Redact(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return RedactedPrefix + hex.EncodeToString(sum[:8])
+}
+
+// IsRedacted reports whether value is one Redact returned.
+func IsRedacted(value string) bool {
+	return strings.HasPrefix(value, RedactedPrefix)
+}
+
+// EnvSnapshot is a function's environment as one sandbox saw it at its first
+// invocation, published on the function's env channel so an agent can run the
+// handler with the same variables. Redacted lists the variables whose value the
+// extension replaced with Redact's hash; an agent keeps its own value for those.
+type EnvSnapshot struct {
+	Type         string            `json:"type"` // "env_snapshot"
+	SandboxID    string            `json:"sandbox_id"`
+	FunctionName string            `json:"function_name"`
+	Timestamp    string            `json:"timestamp"` // RFC 3339
+	Variables    map[string]string `json:"variables"`
+	Redacted     []string          `json:"redacted,omitempty"`
+}
+
+// Validate checks the fields a receiver relies on.
+func (s EnvSnapshot) Validate() error {
+	if s.Type != TypeEnvSnapshot {
+		return fmt.Errorf("env snapshot has type %q", s.Type)
+	}
+	if s.FunctionName == "" {
+		return errors.New("env snapshot is missing function_name")
+	}
+	return nil
+}
+
+// Unredacted returns the variables that carry their value.
+func (s EnvSnapshot) Unredacted() map[string]string {
+	redacted := map[string]bool{}
+	for _, name := range s.Redacted {
+		redacted[name] = true
+	}
+	variables := map[string]string{}
+	for name, value := range s.Variables {
+		if !redacted[name] {
+			variables[name] = value
+		}
+	}
+	return variables
+}
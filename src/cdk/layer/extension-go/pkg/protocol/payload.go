@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// PayloadReference points at a payload offloaded to S3, in place of an event
+// or a response too large for AppSync.
+type PayloadReference struct {
+	Type     string `json:"type"` // "payload_ref"
+	URL      string `json:"url"`  // a presigned GET
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"` // hex SHA-256 of the payload
+}
+
+// Validate checks the fields a receiver relies on.
+func (r PayloadReference) Validate() error {
+	if r.Type != TypePayloadReference {
+		return fmt.Errorf("payload reference has type %q", r.Type)
+	}
+	if r.URL == "" {
+		return errors.New("payload_ref is missing url")
+	}
+	return nil
+}
+
+// ResponseUpload is where the agent may upload a response too large for
+// AppSync, and where the extension then downloads it from.
+type ResponseUpload struct {
+	PutURL string `json:"put_url"`
+	GetURL string `json:"get_url"`
+}
+
+// PayloadKey describes the key payloads are encrypted with.
+type PayloadKey struct {
+	KeyARN     string `json:"key_arn"`
+	WrappedKey string `json:"wrapped_key,omitempty"` // KMS only: the data key encrypted under the KMS key
+}
+
+// EncryptedPayload is an AES-256-GCM sealed event or response. The request ID
+// is the additional data.
+type EncryptedPayload struct {
+	Type       string `json:"type"` // "encrypted_payload"
+	Algorithm  string `json:"alg"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// Chunk is one frame of a payload too large for a single AppSync event. The
+// chunks of a payload share a transfer ID, the request ID of their invocation.
+type Chunk struct {
+	Type       string `json:"type"` // "chunk"
+	TransferID string `json:"transfer_id"`
+	Seq        int    `json:"seq"`      // zero-based
+	Total      int    `json:"total"`    // chunks in the transfer
+	Checksum   string `json:"checksum"` // hex SHA-256 of the complete payload
+	Data       string `json:"data"`     // base64-encoded slice of the payload
+}
+
+// MaxChunks is the most chunks a transfer may have.
+const MaxChunks = 4096
+
+// Validate checks the fields a receiver relies on.
+func (c Chunk) Validate() error {
+	if c.TransferID == "" {
+		return errors.New("chunk is missing transfer_id")
+	}
+	if c.Total <= 0 || c.Total > MaxChunks {
+		return fmt.Errorf("chunk of transfer %s has invalid total %d", c.TransferID, c.Total)
+	}
+	if c.Seq < 0 || c.Seq >= c.Total {
+		return fmt.Errorf("chunk of transfer %s has seq %d outside [0, %d)", c.TransferID, c.Seq, c.Total)
+	}
+	if len(c.Checksum) != sha256.Size*2 {
+		return fmt.Errorf("chunk of transfer %s has invalid checksum", c.TransferID)
+	}
+	return nil
+}
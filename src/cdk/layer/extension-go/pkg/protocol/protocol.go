@@ -0,0 +1,107 @@
+// Package protocol holds the messages the extension and a developer agent
+// exchange over AppSync Events, so the wire format is defined once. The
+// extension publishes a Request on the requests channel; the agent answers on
+// the invocation's response channel with a Response envelope, an
+// InvocationError frame or, for large payloads, a series of Chunk frames.
+//
+// Both sides stamp their messages with a Handshake: the protocol version they
+// speak, the oldest one they still understand and the optional features they
+// support. A peer that omits it speaks protocol 1, which predates versioning.
+// Fields are only ever added within a version, so a decoder ignores fields it
+// does not know; Validate checks what a receiver relies on.
+package protocol
+
+const (
+	// Version is the protocol this package describes.
+	Version = 2
+	// MinVersion is the oldest protocol a peer of this package still understands.
+	MinVersion = 1
+	// UnversionedVersion is the protocol of a peer that sends no Handshake.
+	UnversionedVersion = 1
+)
+
+// Optional features a peer announces in its Handshake.
+const (
+	CapabilityChunking         = "chunking"
+	CapabilityCompression      = "compression"
+	CapabilityStreaming        = "streaming"
+	CapabilityOffload          = "offload"
+	CapabilityResponseEnvelope = "response_envelope"
+	CapabilityErrorFrames      = "error_frames"
+	CapabilityXRay             = "xray"
+	CapabilityClaims           = "claims"
+	CapabilityBinary           = "binary"
+	CapabilityEncryption       = "encryption"
+	CapabilitySigning          = "signing"
+	CapabilityTaggedResponses  = "tagged_responses"
+	CapabilityTiming           = "timing"
+	CapabilityAck              = "ack"
+)
+
+// UnversionedCapabilities are the features a protocol 1 peer is assumed to have.
+var UnversionedCapabilities = []string{
+	CapabilityChunking,
+	CapabilityCompression,
+	CapabilityStreaming,
+	CapabilityOffload,
+}
+
+// Frame types, the "type" field of a message. A request envelope has none.
+const (
+	TypeResponse         = "response"
+	TypeInvocationError  = "invocation_error"
+	TypeChunk            = "chunk"
+	TypePayloadReference = "payload_ref"
+	TypeEncryptedPayload = "encrypted_payload"
+	TypeEnvSnapshot      = "env_snapshot"
+)
+
+// Encodings and formats of a request's event_payload.
+const (
+	ContentEncodingGzip = "gzip"
+	EventFormatBinary   = "binary"
+)
+
+// Handshake is one side's protocol version and capabilities, sent with request
+// envelopes, presence probes and heartbeats.
+type Handshake struct {
+	Version      int      `json:"protocol_version,omitempty"`
+	MinVersion   int      `json:"min_protocol_version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Current returns the Handshake of a peer supporting capabilities.
+func Current(capabilities []string) Handshake {
+	return Handshake{Version: Version, MinVersion: MinVersion, Capabilities: capabilities}
+}
+
+// Normalized fills in the protocol 1 defaults for fields the peer omitted.
+func (h Handshake) Normalized() Handshake {
+	if h.Version == 0 {
+		h.Version = UnversionedVersion
+		if h.Capabilities == nil {
+			h.Capabilities = UnversionedCapabilities
+		}
+	}
+	if h.MinVersion == 0 {
+		h.MinVersion = UnversionedVersion
+	}
+	return h
+}
+
+// Supports reports whether the peer announced capability, counting the
+// protocol 1 defaults.
+func (h Handshake) Supports(capability string) bool {
+	for _, announced := range h.Normalized().Capabilities {
+		if announced == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts reports whether the side that sent h still works with a peer
+// speaking version.
+func (h Handshake) Accepts(version int) bool {
+	return h.Normalized().MinVersion <= version
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHandshakeDefaultsToProtocol1(t *testing.T) {
+	legacy := Handshake{}
+	if normalized := legacy.Normalized(); normalized.Version != 1 || normalized.MinVersion != 1 {
+		t.Fatalf("unexpected handshake %+v", normalized)
+	}
+	if !legacy.Supports(CapabilityChunking) || legacy.Supports(CapabilityResponseEnvelope) {
+		t.Fatal("expected a protocol 1 peer to have only the protocol 1 capabilities")
+	}
+	if current := Current([]string{CapabilityAck}); !current.Supports(CapabilityAck) || current.Supports(CapabilityChunking) {
+		t.Fatalf("expected only the announced capabilities, got %+v", current)
+	}
+	if !(Handshake{Version: 3, MinVersion: 2}).Accepts(2) || (Handshake{Version: 4, MinVersion: 3}).Accepts(2) {
+		t.Fatal("expected Accepts to compare with the peer's min_protocol_version")
+	}
+}
+
+func TestParseRequestReadsAnExtensionEnvelope(t *testing.T) {
+	request, err := ParseRequest([]byte(`{
+		"request_id": "req-1",
+		"event_payload": {"id": 7},
+		"context": {"function_name": "orders", "deadline_ms": "1700000010000", "invoked_at_ms": 1700000000000},
+		"function": {"name": "orders", "version": "3", "handler": "index.handler"},
+		"idempotency_key": "req-1:1",
+		"protocol_version": 2,
+		"min_protocol_version": 1,
+		"capabilities": ["ack", "timing"],
+		"added_in_a_later_release": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request.EventPayload) != `{"id": 7}` || request.Context.FunctionName != "orders" || request.Function.Handler != "index.handler" || !request.Supports(CapabilityAck) {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	if deadline, ok := request.Context.Deadline(); !ok || deadline.UnixMilli() != 1700000010000 {
+		t.Fatalf("unexpected deadline %v", deadline)
+	}
+}
+
+func TestRequestValidate(t *testing.T) {
+	cases := map[string]struct {
+		request Request
+		wantErr string
+	}{
+		"inline event":  {request: Request{RequestID: "r", EventPayload: json.RawMessage(`{}`)}},
+		"offloaded":     {request: Request{RequestID: "r", EventPayloadRef: &PayloadReference{Type: TypePayloadReference, URL: "https://s3"}}},
+		"null event":    {request: Request{RequestID: "r", EventPayload: json.RawMessage(`null`)}},
+		"no request id": {request: Request{EventPayload: json.RawMessage(`{}`)}, wantErr: "request_id"},
+		"no event":      {request: Request{RequestID: "r"}, wantErr: "exactly one"},
+		"both events": {
+			request: Request{RequestID: "r", EventPayload: json.RawMessage(`{}`), EventPayloadRef: &PayloadReference{Type: TypePayloadReference, URL: "https://s3"}},
+			wantErr: "exactly one",
+		},
+		"ref without url": {request: Request{RequestID: "r", EventPayloadRef: &PayloadReference{Type: TypePayloadReference}}, wantErr: "url"},
+		"unknown encoding": {
+			request: Request{RequestID: "r", EventPayload: json.RawMessage(`"H4sI"`), ContentEncoding: "br"},
+			wantErr: "content_encoding",
+		},
+		"gzip that is not a string": {
+			request: Request{RequestID: "r", EventPayload: json.RawMessage(`{}`), ContentEncoding: ContentEncodingGzip},
+			wantErr: "base64 string",
+		},
+		"encrypted gzip": {
+			request: Request{RequestID: "r", EventPayload: json.RawMessage(`{"type":"encrypted_payload"}`), ContentEncoding: ContentEncodingGzip, PayloadKey: &PayloadKey{KeyARN: "arn"}},
+		},
+		"inconsistent handshake": {
+			request: Request{RequestID: "r", EventPayload: json.RawMessage(`{}`), Handshake: Handshake{Version: 2, MinVersion: 3}},
+			wantErr: "min_protocol_version",
+		},
+	}
+	for name, tc := range cases {
+		err := tc.request.Validate()
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: expected an error about %s, got %v", name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestRequestMarshalsLikeTheExtensionEnvelope(t *testing.T) {
+	request := Request{
+		RequestID:    "req-1",
+		EventPayload: json.RawMessage(`{"id":7}`),
+		Context:      Context{RequestID: "req-1", FunctionName: "orders"},
+		Handshake:    Current([]string{CapabilityAck}),
+	}
+	frame, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(frame, &fields)
+	for _, field := range []string{"request_id", "event_payload", "context", "protocol_version", "min_protocol_version", "capabilities"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("expected %s in %s", field, frame)
+		}
+	}
+	for _, field := range []string{"event_payload_ref", "payload_key", "trace", "function", "idempotency_key", "metadata"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("expected no %s in %s", field, frame)
+		}
+	}
+}
+
+func TestParseClientContextAcceptsJSONAndBase64(t *testing.T) {
+	header := `{"client":{"app_title":"App","app_package_name":"com.example"},"env":{"locale":"en_US"}}`
+	for _, encoded := range []string{header, base64.StdEncoding.EncodeToString([]byte(header))} {
+		client_context, err := ParseClientContext(encoded)
+		if err != nil || client_context.Client.AppPackageName != "com.example" || client_context.Env["locale"] != "en_US" {
+			t.Fatalf("unexpected client context %+v, %v", client_context, err)
+		}
+	}
+	if _, err := ParseClientContext("{"); err == nil {
+		t.Fatal("expected a malformed client context to be rejected")
+	}
+	identity, err := ParseCognitoIdentity(`{"cognitoIdentityId":"id","cognitoIdentityPoolId":"pool"}`)
+	if err != nil || identity.IdentityID != "id" || identity.IdentityPoolID != "pool" {
+		t.Fatalf("unexpected identity %+v, %v", identity, err)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	if _, ok, _ := ParseResponse([]byte(`{"statusCode":200}`)); ok {
+		t.Fatal("expected a protocol 1 response not to be an envelope")
+	}
+	response, ok, err := ParseResponse([]byte(`{"type":"response","protocol_version":2,"body":{"statusCode":200},"timing":{"agent_ms":4,"handler_ms":3}}`))
+	if !ok || err != nil || string(response.Body) != `{"statusCode":200}` || response.Timing.HandlerMs != 3 {
+		t.Fatalf("unexpected response %+v, %v", response, err)
+	}
+	if _, ok, err := ParseResponse([]byte(`{"type":"response","protocol_version":3,"body":{}}`)); !ok || err == nil {
+		t.Fatal("expected a response from a newer protocol to be rejected")
+	}
+
+	built, _ := NewResponse(NewInvocationError("TypeError", "boom", nil))
+	frame, _ := json.Marshal(built)
+	if string(frame) != `{"type":"response","protocol_version":2,"body":{"type":"invocation_error","errorType":"TypeError","errorMessage":"boom"}}` {
+		t.Fatalf("unexpected frame %s", frame)
+	}
+}
+
+func TestInvocationErrorValidate(t *testing.T) {
+	if err := NewInvocationError("TypeError", "", nil).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (InvocationError{Type: TypeInvocationError}).Validate(); err == nil {
+		t.Fatal("expected an empty error frame to be rejected")
+	}
+	if err := (InvocationError{ErrorType: "TypeError"}).Validate(); err == nil {
+		t.Fatal("expected a frame without its type to be rejected")
+	}
+}
+
+func TestChunkValidate(t *testing.T) {
+	checksum := strings.Repeat("a", 64)
+	if err := (Chunk{Type: TypeChunk, TransferID: "req-1", Seq: 1, Total: 2, Checksum: checksum}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, chunk := range map[string]Chunk{
+		"no transfer":    {Seq: 0, Total: 1, Checksum: checksum},
+		"seq past total": {TransferID: "req-1", Seq: 2, Total: 2, Checksum: checksum},
+		"too many":       {TransferID: "req-1", Seq: 0, Total: MaxChunks + 1, Checksum: checksum},
+		"short checksum": {TransferID: "req-1", Seq: 0, Total: 1, Checksum: "abc"},
+	} {
+		if chunk.Validate() == nil {
+			t.Errorf("%s: expected the chunk to be rejected", name)
+		}
+	}
+}
+
+func TestEnvSnapshotUnredacted(t *testing.T) {
+	snapshot := EnvSnapshot{
+		Type:         TypeEnvSnapshot,
+		FunctionName: "orders",
+		Variables:    map[string]string{"TABLE_NAME": "orders", "DB_PASSWORD": Redact("hunter2")},
+		Redacted:     []string{"DB_PASSWORD"},
+	}
+	if err := snapshot.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if variables := snapshot.Unredacted(); len(variables) != 1 || variables["TABLE_NAME"] != "orders" {
+		t.Fatalf("unexpected variables %v", variables)
+	}
+	if redacted := Redact("hunter2"); !IsRedacted(redacted) || redacted != Redact("hunter2") || redacted == Redact("hunter3") || len(redacted) != len(RedactedPrefix)+16 {
+		t.Fatalf("unexpected redaction %q", redacted)
+	}
+	if (EnvSnapshot{Type: TypeEnvSnapshot}).Validate() == nil {
+		t.Fatal("expected a snapshot without its function to be rejected")
+	}
+}
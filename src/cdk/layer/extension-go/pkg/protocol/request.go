@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Request is the envelope the extension publishes for an intercepted
+// invocation. The event is in EventPayload, or in S3 behind EventPayloadRef
+// when the envelope would be too large:
+//
+//	{"request_id": "...", "event_payload": {...}, "context": {...}, "sandbox_id": "...",
+//	 "idempotency_key": "...", "protocol_version": 2, "min_protocol_version": 1, "capabilities": [...]}
+//
+// A compressed or binary event is a base64 string, and an encrypted one an
+// EncryptedPayload holding what event_payload would otherwise be.
+type Request struct {
+	RequestID       string                     `json:"request_id"`
+	EventPayload    json.RawMessage            `json:"event_payload,omitempty"`
+	EventPayloadRef *PayloadReference          `json:"event_payload_ref,omitempty"`
+	ContentEncoding string                     `json:"content_encoding,omitempty"` // "gzip" for a compressed event
+	AcceptEncoding  []string                   `json:"accept_encoding,omitempty"`  // encodings the extension accepts in responses
+	EventFormat     string                     `json:"event_format,omitempty"`     // "binary" when the event is not JSON
+	ContentType     string                     `json:"content_type,omitempty"`     // of a binary event, as the Runtime API reported it
+	ResponseUpload  *ResponseUpload            `json:"response_upload,omitempty"`
+	PayloadKey      *PayloadKey                `json:"payload_key,omitempty"` // set when the extension encrypts payloads
+	Context         Context                    `json:"context"`
+	Trace           *Trace                     `json:"trace,omitempty"`
+	Function        *Function                  `json:"function,omitempty"` // absent before the extension registered
+	SandboxID       string                     `json:"sandbox_id,omitempty"`
+	IdempotencyKey  string                     `json:"idempotency_key,omitempty"` // absent from extensions that predate it
+	Metadata        map[string]json.RawMessage `json:"metadata,omitempty"`        // attached by tools in the sandbox through the local API
+	Handshake
+}
+
+// Context is the Lambda context of an invocation. The fields read from the
+// function's environment are only set when the extension's env filter allows
+// the variable.
+type Context struct {
+	InvokedFunctionARN string `json:"invoked_function_arn"`
+	DeadlineMs         string `json:"deadline_ms"` // Unix milliseconds, as the Runtime API header has it
+	TraceID            string `json:"trace_id"`
+	RequestID          string `json:"request_id"`
+	InvokedAtMs        int64  `json:"invoked_at_ms,omitempty"` // when the extension received the invocation
+
+	FunctionName    string `json:"function_name,omitempty"`
+	FunctionVersion string `json:"function_version,omitempty"`
+	MemorySizeMB    string `json:"memory_size_mb,omitempty"`
+	LogGroupName    string `json:"log_group_name,omitempty"`
+	LogStreamName   string `json:"log_stream_name,omitempty"`
+	AWSRegion       string `json:"aws_region,omitempty"`
+
+	Identity      *CognitoIdentity `json:"identity,omitempty"`       // the Cognito identity, when the caller had one
+	ClientContext *ClientContext   `json:"client_context,omitempty"` // the mobile client context, when the caller sent one
+
+	// The headers as Lambda sent them, when they did not parse into the
+	// typed fields above.
+	IdentityRaw      string `json:"identity_raw,omitempty"`
+	ClientContextRaw string `json:"client_context_raw,omitempty"`
+}
+
+// CognitoIdentity is the Amazon Cognito identity of a caller that invoked the
+// function through the AWS Mobile SDK, from the Lambda-Runtime-Cognito-Identity
+// header.
+type CognitoIdentity struct {
+	IdentityID     string `json:"cognitoIdentityId"`
+	IdentityPoolID string `json:"cognitoIdentityPoolId"`
+}
+
+// ClientContext is what a mobile caller sent about itself, from the
+// Lambda-Runtime-Client-Context header. Custom holds the caller's own values
+// and Env the device's, such as platform and locale.
+type ClientContext struct {
+	Client ClientApplication `json:"client"`
+	Custom map[string]string `json:"custom,omitempty"`
+	Env    map[string]string `json:"env,omitempty"`
+}
+
+// ClientApplication describes the mobile application that made the call.
+type ClientApplication struct {
+	InstallationID string `json:"installation_id,omitempty"`
+	AppTitle       string `json:"app_title,omitempty"`
+	AppVersionName string `json:"app_version_name,omitempty"`
+	AppVersionCode string `json:"app_version_code,omitempty"`
+	AppPackageName string `json:"app_package_name,omitempty"`
+}
+
+// ParseCognitoIdentity decodes a Lambda-Runtime-Cognito-Identity header.
+func ParseCognitoIdentity(header string) (*CognitoIdentity, error) {
+	var identity CognitoIdentity
+	if err := json.Unmarshal([]byte(header), &identity); err != nil {
+		return nil, fmt.Errorf("malformed cognito identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// ParseClientContext decodes a Lambda-Runtime-Client-Context header. The
+// Runtime API passes the JSON as is, but the header is also accepted base64
+// encoded, the way callers hand it to the Invoke API.
+func ParseClientContext(header string) (*ClientContext, error) {
+	encoded := []byte(header)
+	if decoded, err := base64.StdEncoding.DecodeString(header); err == nil {
+		encoded = decoded
+	}
+	var client_context ClientContext
+	if err := json.Unmarshal(encoded, &client_context); err != nil {
+		return nil, fmt.Errorf("malformed client context: %w", err)
+	}
+	return &client_context, nil
+}
+
+// Deadline returns the invocation's deadline, or false when it has none.
+func (c Context) Deadline() (time.Time, bool) {
+	deadline_ms, err := strconv.ParseInt(c.DeadlineMs, 10, 64)
+	if err != nil || deadline_ms <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(deadline_ms), true
+}
+
+// Trace carries the X-Ray trace header to run the handler under.
+type Trace struct {
+	Header string `json:"header"`
+}
+
+// Function is the function the extension registered for.
+type Function struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Handler   string `json:"handler"`
+	AccountID string `json:"account_id,omitempty"` // absent when Lambda does not offer the feature
+}
+
+// ParseRequest decodes and validates a request envelope.
+func ParseRequest(frame []byte) (Request, error) {
+	var request Request
+	if err := json.Unmarshal(frame, &request); err != nil {
+		return Request{}, fmt.Errorf("malformed request envelope: %w", err)
+	}
+	return request, request.Validate()
+}
+
+// Validate checks the fields a receiver relies on.
+func (r Request) Validate() error {
+	if r.RequestID == "" {
+		return errors.New("request envelope is missing request_id")
+	}
+	if (len(r.EventPayload) == 0) == (r.EventPayloadRef == nil) {
+		return errors.New("request envelope needs exactly one of event_payload and event_payload_ref")
+	}
+	if r.EventPayloadRef != nil {
+		if err := r.EventPayloadRef.Validate(); err != nil {
+			return err
+		}
+	}
+	switch r.ContentEncoding {
+	case "", ContentEncodingGzip:
+	default:
+		return fmt.Errorf("unsupported content_encoding %q", r.ContentEncoding)
+	}
+	switch r.EventFormat {
+	case "", EventFormatBinary:
+	default:
+		return fmt.Errorf("unsupported event_format %q", r.EventFormat)
+	}
+	if len(r.EventPayload) > 0 && r.PayloadKey == nil && (r.ContentEncoding != "" || r.EventFormat != "") {
+		var encoded string
+		if json.Unmarshal(r.EventPayload, &encoded) != nil {
+			return errors.New("an encoded or binary event_payload must be a base64 string")
+		}
+	}
+	if r.PayloadKey != nil && r.PayloadKey.KeyARN == "" {
+		return errors.New("payload_key is missing key_arn")
+	}
+	if r.Version != 0 && r.MinVersion > r.Version {
+		return fmt.Errorf("min_protocol_version %d is newer than protocol_version %d", r.MinVersion, r.Version)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Response is the envelope a protocol 2 agent wraps each answer in when the
+// request advertised the response_envelope capability. Body is the response,
+// or an InvocationError, EncryptedPayload or PayloadReference frame in its
+// place. A protocol 1 agent publishes the body alone.
+type Response struct {
+	Type           string          `json:"type"` // "response"
+	Version        int             `json:"protocol_version"`
+	Body           json.RawMessage `json:"body"`
+	RequestID      string          `json:"request_id,omitempty"`      // with the tagged_responses capability
+	IdempotencyKey string          `json:"idempotency_key,omitempty"` // the attempt it answers
+	Signature      string          `json:"signature,omitempty"`       // base64 HMAC of the body, with the signing capability
+	Trace          json.RawMessage `json:"trace,omitempty"`           // the handler's X-Ray subsegments, with the xray capability
+	Timing         *Timing         `json:"timing,omitempty"`          // with the timing capability
+}
+
+// Timing is the agent's side of the extension's latency breakdown, in
+// milliseconds: the time since the request arrived, and the handler's share.
+type Timing struct {
+	AgentMs   float64 `json:"agent_ms"`
+	HandlerMs float64 `json:"handler_ms"`
+}
+
+// NewResponse wraps body, encoded as JSON, in a response envelope.
+func NewResponse(body interface{}) (Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{Type: TypeResponse, Version: Version, Body: encoded}, nil
+}
+
+// ParseResponse decodes frame if it is a response envelope; ok is false for
+// other frames, including protocol 1 responses.
+func ParseResponse(frame []byte) (response Response, ok bool, err error) {
+	if json.Unmarshal(frame, &response) != nil || response.Type != TypeResponse || response.Version == 0 {
+		return Response{}, false, nil
+	}
+	return response, true, response.Validate()
+}
+
+// Validate checks the fields a receiver relies on.
+func (r Response) Validate() error {
+	if r.Version > Version {
+		return fmt.Errorf("response uses protocol %d but this side speaks %d", r.Version, Version)
+	}
+	return nil
+}
+
+// InvocationError is the frame an agent with the error_frames capability sends
+// in place of a response when the handler throws. The extension posts it to
+// the Runtime API as the function's error.
+type InvocationError struct {
+	Type         string   `json:"type"` // "invocation_error"
+	ErrorType    string   `json:"errorType"`
+	ErrorMessage string   `json:"errorMessage"`
+	StackTrace   []string `json:"stackTrace,omitempty"`
+}
+
+// NewInvocationError returns the error frame for a handler failure.
+func NewInvocationError(error_type string, error_message string, stack_trace []string) InvocationError {
+	return InvocationError{Type: TypeInvocationError, ErrorType: error_type, ErrorMessage: error_message, StackTrace: stack_trace}
+}
+
+// Validate checks the fields a receiver relies on.
+func (e InvocationError) Validate() error {
+	if e.Type != TypeInvocationError {
+		return fmt.Errorf("error frame has type %q", e.Type)
+	}
+	if e.ErrorType == "" && e.ErrorMessage == "" {
+		return errors.New("error frame has neither errorType nor errorMessage")
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Developer presence
+//
+// The agent publishes heartbeats on live-lambda/presence/{function} while it is
+// running. Invocations are only offered over AppSync while the last heartbeat is
+// younger than its TTL; otherwise they pass straight through to the bundled
+// handler instead of waiting until their deadline. Without presence, the
+// extension publishes a probe on the same channel, once per TTL while idle and
+// on passed-through invocations, which the agent answers with a heartbeat, so a
+// warm sandbox picks up a newly started agent quickly. LIVE_LAMBDA_PRESENCE_TTL=off disables the check.
+
+const (
+	presence_print_prefix       = "[LiveLambdaExt:Presence]"
+	default_presence_ttl        = 15 * time.Second
+	presence_heartbeat_type     = "heartbeat"
+	presence_probe_type         = "probe"
+	presence_publish_timeout    = 5 * time.Second
+	presence_probe_min_interval = 2 * time.Second
+)
+
+type presence_frame struct {
+	Type     string `json:"type"`
+	AgentID  string `json:"agent_id,omitempty"`
+	TTLMs    int64  `json:"ttl_ms,omitempty"`
+	Delivery string `json:"delivery,omitempty"` // "pull" asks for requests through Mailbox
+	Mailbox  string `json:"mailbox,omitempty"`
+	// AcceptEncoding lists the content encodings the agent can decode
+	AcceptEncoding []string `json:"accept_encoding,omitempty"`
+	// PublicKey is an X25519 key to seal the agent's env_snapshot to
+	PublicKey string `json:"public_key,omitempty"`
+	// PreferredRegion asks for the tunnel to go through that region's endpoint
+	PreferredRegion string `json:"preferred_region,omitempty"`
+	protocol.Handshake
+}
+
+type presence_tracker struct {
+	mu          sync.Mutex
+	default_ttl time.Duration
+	ttl         time.Duration
+	agent_id    string
+	delivery    string
+	mailbox     string
+	encodings   []string
+	protocol    protocol.Handshake
+	protocol_ok error
+	rejected    string
+	public_key  string
+	region      string // the region the agent prefers, if any
+	last_seen   time.Time
+	last_probe  time.Time
+	now         func() time.Time
+}
+
+func new_presence_tracker(ttl time.Duration) *presence_tracker {
+	return &presence_tracker{default_ttl: ttl, ttl: ttl, now: time.Now}
+}
+
+// new_presence_tracker_from_config returns nil when the presence check is disabled.
+func new_presence_tracker_from_config(settings Config) *presence_tracker {
+	if settings.PresenceTTL <= 0 {
+		log.Printf("%s Presence check disabled; every invocation is offered to the agent", presence_print_prefix)
+		return nil
+	}
+	return new_presence_tracker(settings.PresenceTTL)
+}
+
+// record_heartbeat marks the agent as present. A heartbeat may carry its own TTL.
+func (t *presence_tracker) record_heartbeat(agent_id string, ttl time.Duration) (new_agent bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	new_agent = t.agent_id != agent_id || now.Sub(t.last_seen) > t.ttl
+	t.agent_id = agent_id
+	t.last_seen = now
+	t.ttl = t.default_ttl
+	if ttl > 0 {
+		t.ttl = ttl
+	}
+	return new_agent
+}
+
+// record_delivery remembers how the present agent asked to receive requests.
+func (t *presence_tracker) record_delivery(delivery string, mailbox string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delivery = delivery
+	t.mailbox = mailbox
+}
+
+// record_encodings remembers the content encodings the present agent accepts.
+func (t *presence_tracker) record_encodings(encodings []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.encodings = encodings
+}
+
+// record_preferred_region remembers the region the present agent prefers.
+func (t *presence_tracker) record_preferred_region(region string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if region != t.region && region != "" {
+		log.Printf("%s Agent %s prefers region %s", presence_print_prefix, t.agent_id, region)
+	}
+	t.region = region
+}
+
+// record_public_key remembers the key the present agent asked its environment
+// to be sealed to and reports whether it changed.
+func (t *presence_tracker) record_public_key(public_key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := t.public_key != public_key
+	t.public_key = public_key
+	return changed
+}
+
+// record_protocol remembers the protocol the present agent announced. It
+// returns the reason the agent is incompatible the first time it is seen as
+// such, and nil otherwise.
+func (t *presence_tracker) record_protocol(agent_id string, peer protocol.Handshake) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.protocol = peer.Normalized()
+	t.protocol_ok = check_agent_protocol(peer)
+	if t.protocol_ok == nil || t.rejected == agent_id {
+		return nil
+	}
+	t.rejected = agent_id
+	return t.protocol_ok
+}
+
+// compatible returns why the present agent cannot be offered invocations, or
+// nil when it can. A nil tracker never hears heartbeats and assumes protocol 1.
+func (t *presence_tracker) compatible() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.protocol_ok
+}
+
+// supports reports whether both the extension and the present agent support
+// capability. A nil tracker assumes a protocol 1 agent.
+func (t *presence_tracker) supports(capability string) bool {
+	peer := protocol.Handshake{}
+	if t != nil {
+		t.mu.Lock()
+		peer = t.protocol
+		t.mu.Unlock()
+	}
+	for _, shared := range negotiate_capabilities(peer) {
+		if shared == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts_encoding reports whether the present agent can decode encoding. A nil
+// tracker never hears heartbeats, so it accepts nothing.
+func (t *presence_tracker) accepts_encoding(encoding string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, accepted := range t.encodings {
+		if accepted == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// pull_mailbox returns the mailbox a present agent asked to pull requests from.
+// ok is false for push agents, absent agents and a nil tracker.
+func (t *presence_tracker) pull_mailbox() (agent_id string, mailbox string, ok bool) {
+	if t == nil {
+		return "", "", false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.delivery != delivery_pull || t.last_seen.IsZero() || t.now().Sub(t.last_seen) > t.ttl {
+		return "", "", false
+	}
+	return t.agent_id, t.mailbox, true
+}
+
+// preferred_region returns the region the present agent prefers, or "" when
+// none is present or it has no preference.
+func (t *presence_tracker) preferred_region() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last_seen.IsZero() || t.now().Sub(t.last_seen) > t.ttl {
+		return ""
+	}
+	return t.region
+}
+
+// agent returns the ID of the present agent, or "" when none is present or the
+// tracker is nil.
+func (t *presence_tracker) agent() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last_seen.IsZero() || t.now().Sub(t.last_seen) > t.ttl {
+		return ""
+	}
+	return t.agent_id
+}
+
+// mark_absent forgets agent_id's last heartbeat, so invocations pass through
+// until it sends another. It does nothing when another agent is present.
+func (t *presence_tracker) mark_absent(agent_id string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.agent_id == agent_id {
+		t.last_seen = time.Time{}
+	}
+}
+
+// present reports whether a heartbeat arrived within the TTL. A nil tracker is always present.
+func (t *presence_tracker) present() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.last_seen.IsZero() && t.now().Sub(t.last_seen) <= t.ttl
+}
+
+// forget_probe lets the next claim_probe through at once, as the last probe
+// went out on a connection the agent may no longer be listening on.
+func (t *presence_tracker) forget_probe() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last_probe = time.Time{}
+}
+
+// claim_probe returns true when the agent is absent and no probe was sent
+// recently; the caller is then expected to send one.
+func (t *presence_tracker) claim_probe() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if !t.last_seen.IsZero() && now.Sub(t.last_seen) <= t.ttl {
+		return false
+	}
+	if !t.last_probe.IsZero() && now.Sub(t.last_probe) < presence_probe_min_interval {
+		return false
+	}
+	t.last_probe = now
+	return true
+}
+
+// presence_change is what a heartbeat asks of the extension.
+type presence_change struct {
+	agent_id   string
+	rejection  error  // set the first time the agent is found incompatible
+	public_key string // set when the agent is new or announced a new key
+}
+
+// handle_frame applies a frame received on the presence channel.
+func (t *presence_tracker) handle_frame(frame json.RawMessage) presence_change {
+	var parsed presence_frame
+	if err := json.Unmarshal(frame, &parsed); err != nil {
+		log.Printf("%s Ignoring malformed presence frame: %v", presence_print_prefix, err)
+		return presence_change{}
+	}
+	if parsed.Type != presence_heartbeat_type {
+		// Our own probes and rejections, and those of other sandboxes, arrive here too
+		return presence_change{}
+	}
+	new_agent := t.record_heartbeat(parsed.AgentID, time.Duration(parsed.TTLMs)*time.Millisecond)
+	t.record_delivery(parsed.Delivery, parsed.Mailbox)
+	t.record_encodings(parsed.AcceptEncoding)
+	t.record_preferred_region(parsed.PreferredRegion)
+	change := presence_change{agent_id: parsed.AgentID}
+	change.rejection = t.record_protocol(parsed.AgentID, parsed.Handshake)
+	if key_changed := t.record_public_key(parsed.PublicKey); (key_changed || new_agent) && change.rejection == nil && t.compatible() == nil {
+		change.public_key = parsed.PublicKey
+	}
+	if new_agent {
+		peer := parsed.Handshake.Normalized()
+		log.Printf("%s Developer agent %s is present (protocol %d, capabilities %s)", presence_print_prefix, parsed.AgentID, peer.Version, format_capabilities(negotiate_capabilities(peer)))
+	}
+	return change
+}
+
+// presence_topic returns the channel the agent announces itself on for a function.
+func (p *RuntimeAPIProxy) presence_topic() string {
+	return p.channel("presence/%s", p.function_name)
+}
+
+// subscribe_presence_channel tracks heartbeats for the lifetime of ctx and probes
+// for the agent whenever it is absent.
+func (p *RuntimeAPIProxy) subscribe_presence_channel(ctx context.Context) {
+	if !p.subscribe_presence_topic(ctx) {
+		return
+	}
+
+	p.probe_presence()
+	go func() {
+		ticker := time.NewTicker(p.presence.default_ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.probe_presence()
+			}
+		}
+	}()
+}
+
+// subscribe_presence_topic routes presence frames to the tracker. It reports
+// whether the subscription was made.
+func (p *RuntimeAPIProxy) subscribe_presence_topic(ctx context.Context) bool {
+	if p.presence == nil {
+		return false
+	}
+	topic := p.presence_topic()
+	_, err := p.transport.Subscribe(ctx, topic, func(data_payload interface{}) {
+		frame, err := decode_channel_payload(data_payload)
+		if err != nil {
+			log.Printf("%s Error decoding presence frame: %v", presence_print_prefix, err)
+			return
+		}
+		change := p.presence.handle_frame(frame)
+		if change.rejection != nil {
+			go p.reject_agent(change.agent_id, change.rejection)
+		}
+		if change.public_key != "" {
+			go p.send_sealed_env_snapshot(change.agent_id, change.public_key)
+		}
+	})
+	if err != nil {
+		log.Printf("%s Error subscribing to presence topic %s: %v", presence_print_prefix, topic, err)
+		return false
+	}
+	log.Printf("%s Subscribed to presence topic %s", presence_print_prefix, topic)
+	return true
+}
+
+// probe_presence asks the agent to announce itself if it is not known to be present.
+func (p *RuntimeAPIProxy) probe_presence() {
+	if !p.presence.claim_probe() {
+		return
+	}
+	if p.transport == nil || !p.transport.IsConnected() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, presence_publish_timeout)
+	defer cancel()
+	probe := p.presence_probe()
+	if err := p.transport.Publish(ctx, p.presence_topic(), []interface{}{probe}); err != nil {
+		log.Printf("%s Error publishing presence probe: %v", presence_print_prefix, err)
+	}
+	// Pull agents cannot see the presence channel; they find sandboxes through the mailbox
+	p.mailbox.send_probe(ctx, probe)
+}
+
+// presence_probe returns the frame that asks the agent to announce itself.
+func (p *RuntimeAPIProxy) presence_probe() map[string]interface{} {
+	probe := map[string]interface{}{
+		"type":          presence_probe_type,
+		"function_name": p.function_name,
+		"sandbox_id":    p.sandbox_id,
+	}
+	if endpoint := p.failover.active_endpoint(); endpoint != "" {
+		// Agents connected to several endpoints heartbeat on the active one; see endpoint_failover.go
+		probe["endpoint"] = endpoint
+	}
+	add_protocol_envelope(probe)
+	p.add_function_metadata(probe)
+	return probe
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNilPresenceTrackerIsAlwaysPresent(t *testing.T) {
+	var tracker *presence_tracker
+	if !tracker.present() {
+		t.Fatal("expected a disabled presence check to report presence")
+	}
+	if tracker.claim_probe() {
+		t.Fatal("expected a disabled presence check never to probe")
+	}
+}
+
+func TestPresenceTrackerExpiresHeartbeats(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := new_presence_tracker(15 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	if tracker.present() {
+		t.Fatal("expected no presence before the first heartbeat")
+	}
+
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1"}`))
+	if !tracker.present() {
+		t.Fatal("expected presence after a heartbeat")
+	}
+
+	now = now.Add(16 * time.Second)
+	if tracker.present() {
+		t.Fatal("expected presence to expire after the TTL")
+	}
+}
+
+func TestPresenceTrackerHonorsHeartbeatTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := new_presence_tracker(15 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a1","ttl_ms":3000}`))
+	now = now.Add(4 * time.Second)
+	if tracker.present() {
+		t.Fatal("expected the heartbeat's own TTL to apply")
+	}
+}
+
+func TestPresenceTrackerIgnoresProbes(t *testing.T) {
+	tracker := new_presence_tracker(15 * time.Second)
+	tracker.handle_frame(json.RawMessage(`{"type":"probe","function_name":"orders","sandbox_id":"s1"}`))
+	tracker.handle_frame(json.RawMessage(`not json`))
+	if tracker.present() {
+		t.Fatal("expected probes and malformed frames not to count as presence")
+	}
+}
+
+func TestPresenceTrackerRateLimitsProbes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := new_presence_tracker(15 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	if !tracker.claim_probe() {
+		t.Fatal("expected the first probe to be claimed")
+	}
+	if tracker.claim_probe() {
+		t.Fatal("expected a second probe right away to be declined")
+	}
+	now = now.Add(presence_probe_min_interval)
+	if !tracker.claim_probe() {
+		t.Fatal("expected a probe after the minimum interval")
+	}
+
+	tracker.record_heartbeat("a1", 0)
+	now = now.Add(presence_probe_min_interval)
+	if tracker.claim_probe() {
+		t.Fatal("expected no probe while the agent is present")
+	}
+}
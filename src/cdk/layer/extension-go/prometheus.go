@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /metrics on the proxy listener reports counters since the extension
+// started, in the Prometheus text exposition format, so integration tests and
+// sidecar scrapers can assert on what the extension did without parsing logs:
+//
+//   - live_lambda_invocations_intercepted_total: invocations published to the agent.
+//   - live_lambda_invocations_passed_through_total: invocations the function
+//     handled in Lambda, whether never intercepted or after a fallback.
+//   - live_lambda_fallbacks_total: intercepted invocations that did not get the
+//     agent's response.
+//   - live_lambda_publish_errors_total: requests that could not be published.
+//   - live_lambda_reconnects_total: WebSocket reconnects.
+//   - live_lambda_invocation_duration_seconds: a histogram of the time from
+//     intercepting an invocation to the agent's response being handled.
+
+const (
+	metrics_path                     = "/metrics"
+	prometheus_text_content_type     = "text/plain; version=0.0.4; charset=utf-8"
+	prometheus_intercepted_metric    = "live_lambda_invocations_intercepted_total"
+	prometheus_passed_through_metric = "live_lambda_invocations_passed_through_total"
+	prometheus_fallbacks_metric      = "live_lambda_fallbacks_total"
+	prometheus_publish_errors_metric = "live_lambda_publish_errors_total"
+	prometheus_reconnects_metric     = "live_lambda_reconnects_total"
+	prometheus_duration_metric       = "live_lambda_invocation_duration_seconds"
+)
+
+// prometheus_duration_buckets are the histogram's upper bounds in seconds, up
+// to the 15 minute Lambda limit.
+var prometheus_duration_buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// prometheus_metrics counts what the extension did. A nil prometheus_metrics
+// counts nothing.
+type prometheus_metrics struct {
+	intercepted   atomic.Uint64
+	passed        atomic.Uint64
+	fallbacks     atomic.Uint64
+	publish_error atomic.Uint64
+	reconnects    atomic.Uint64
+
+	mu       sync.Mutex
+	buckets  []uint64 // cumulative counts per prometheus_duration_buckets entry
+	count    uint64
+	duration float64 // sum of observed durations in seconds
+}
+
+func new_prometheus_metrics() *prometheus_metrics {
+	return &prometheus_metrics{buckets: make([]uint64, len(prometheus_duration_buckets))}
+}
+
+func (m *prometheus_metrics) intercepted_invocation() {
+	if m != nil {
+		m.intercepted.Add(1)
+	}
+}
+
+func (m *prometheus_metrics) passed_through_invocation() {
+	if m != nil {
+		m.passed.Add(1)
+	}
+}
+
+func (m *prometheus_metrics) fell_back() {
+	if m != nil {
+		m.fallbacks.Add(1)
+	}
+}
+
+func (m *prometheus_metrics) failed_publish() {
+	if m != nil {
+		m.publish_error.Add(1)
+	}
+}
+
+func (m *prometheus_metrics) reconnected() {
+	if m != nil {
+		m.reconnects.Add(1)
+	}
+}
+
+// observe_duration records one intercepted invocation's duration.
+func (m *prometheus_metrics) observe_duration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range prometheus_duration_buckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.count++
+	m.duration += seconds
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *prometheus_metrics) write(w io.Writer) {
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{prometheus_intercepted_metric, "Invocations published to the agent.", m.intercepted.Load()},
+		{prometheus_passed_through_metric, "Invocations the function handled in Lambda.", m.passed.Load()},
+		{prometheus_fallbacks_metric, "Intercepted invocations that did not get the agent's response.", m.fallbacks.Load()},
+		{prometheus_publish_errors_metric, "Requests that could not be published to the agent.", m.publish_error.Load()},
+		{prometheus_reconnects_metric, "WebSocket reconnects.", m.reconnects.Load()},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s Time from intercepting an invocation to handling the agent's response.\n# TYPE %s histogram\n", prometheus_duration_metric, prometheus_duration_metric)
+	for i, bound := range prometheus_duration_buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", prometheus_duration_metric, strconv.FormatFloat(bound, 'g', -1, 64), m.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", prometheus_duration_metric, m.count)
+	fmt.Fprintf(w, "%s_sum %s\n", prometheus_duration_metric, strconv.FormatFloat(m.duration, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", prometheus_duration_metric, m.count)
+}
+
+func (p *RuntimeAPIProxy) handle_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheus_text_content_type)
+	if p.prometheus == nil {
+		return
+	}
+	p.prometheus.write(w)
+}
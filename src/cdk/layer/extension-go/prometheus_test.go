@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpointReportsPrometheusText(t *testing.T) {
+	proxy := new_tracking_proxy()
+	proxy.prometheus = new_prometheus_metrics()
+	proxy.prometheus.intercepted_invocation()
+	proxy.prometheus.intercepted_invocation()
+	proxy.prometheus.passed_through_invocation()
+	proxy.mark_fallback("req-1")
+	proxy.prometheus.observe_duration(40 * time.Millisecond)
+	proxy.prometheus.observe_duration(2 * time.Second)
+
+	recorder := httptest.NewRecorder()
+	proxy.router().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metrics_path, nil))
+
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE live_lambda_invocations_intercepted_total counter",
+		"live_lambda_invocations_intercepted_total 2",
+		"live_lambda_invocations_passed_through_total 1",
+		"live_lambda_fallbacks_total 1",
+		"live_lambda_publish_errors_total 0",
+		`live_lambda_invocation_duration_seconds_bucket{le="0.025"} 0`,
+		`live_lambda_invocation_duration_seconds_bucket{le="0.05"} 1`,
+		`live_lambda_invocation_duration_seconds_bucket{le="2.5"} 2`,
+		`live_lambda_invocation_duration_seconds_bucket{le="+Inf"} 2`,
+		"live_lambda_invocation_duration_seconds_sum 2.04",
+		"live_lambda_invocation_duration_seconds_count 2",
+	} {
+		if !strings.Contains(recorder.Body.String(), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Protocol versioning
+//
+// Request envelopes and presence probes carry the extension's protocol_version,
+// the oldest agent protocol it still understands (min_protocol_version) and the
+// optional features it supports (capabilities). The agent announces the same
+// fields in its heartbeats, so a heartbeat doubles as the agent's half of the
+// handshake. Peers that omit them are treated as protocol 1, which predates
+// versioning and implies every feature it shipped with. An incompatible agent is
+// not offered invocations; the extension tells it why once, with a
+// protocol_rejected frame on the presence channel.
+//
+// From protocol 2 the agent wraps each response in
+// {"type": "response", "protocol_version": 2, "body": ...} when the request
+// envelope advertised the response_envelope capability. With the xray
+// capability the envelope may also carry "trace" (see xray.go). Agents with the
+// claims capability are offered each invocation before it is published (see
+// claims.go), and agents with the binary capability non-JSON events (see
+// binary_payload.go). Agents with the tagged_responses capability put the
+// request_id on every response frame (see response_demux.go), and agents with
+// the timing capability add "timing" to the envelope (see
+// latency_breakdown.go). Chunk frames are
+// not versioned themselves; the envelope they reassemble into is. The message
+// types themselves are in pkg/protocol, which the Go agent shares.
+
+const (
+	protocol_print_prefix      = "[LiveLambdaExt:Protocol]"
+	current_protocol_version   = protocol.Version
+	min_agent_protocol_version = protocol.MinVersion
+	protocol_rejected_type     = "protocol_rejected"
+	response_envelope_type     = protocol.TypeResponse
+
+	capability_chunking          = protocol.CapabilityChunking
+	capability_compression       = protocol.CapabilityCompression
+	capability_streaming         = protocol.CapabilityStreaming
+	capability_offload           = protocol.CapabilityOffload
+	capability_response_envelope = protocol.CapabilityResponseEnvelope
+	capability_error_frames      = protocol.CapabilityErrorFrames
+	capability_xray              = protocol.CapabilityXRay
+	capability_claims            = protocol.CapabilityClaims
+	capability_binary            = protocol.CapabilityBinary
+	capability_encryption        = protocol.CapabilityEncryption
+	capability_signing           = protocol.CapabilitySigning
+	capability_tagged_responses  = protocol.CapabilityTaggedResponses
+	capability_timing            = protocol.CapabilityTiming
+	capability_ack               = protocol.CapabilityAck
+)
+
+// extension_capabilities are the optional features this extension supports.
+var extension_capabilities = []string{
+	capability_chunking,
+	capability_compression,
+	capability_streaming,
+	capability_offload,
+	capability_response_envelope,
+	capability_error_frames,
+	capability_xray,
+	capability_claims,
+	capability_binary,
+	capability_encryption,
+	capability_signing,
+	capability_tagged_responses,
+	capability_timing,
+	capability_ack,
+}
+
+// check_agent_protocol reports why an agent speaking peer cannot be used, with
+// what to upgrade.
+func check_agent_protocol(peer protocol.Handshake) error {
+	peer = peer.Normalized()
+	if peer.Version < min_agent_protocol_version {
+		return fmt.Errorf("the agent speaks protocol %d but this extension needs at least %d; upgrade the live-lambda CLI", peer.Version, min_agent_protocol_version)
+	}
+	if !peer.Accepts(current_protocol_version) {
+		return fmt.Errorf("the agent needs protocol %d or newer but this extension speaks %d; redeploy the function with the latest live-lambda layer", peer.MinVersion, current_protocol_version)
+	}
+	return nil
+}
+
+// negotiate_capabilities returns the capabilities both sides support.
+func negotiate_capabilities(peer protocol.Handshake) []string {
+	peer = peer.Normalized()
+	var shared []string
+	for _, capability := range extension_capabilities {
+		for _, offered := range peer.Capabilities {
+			if capability == offered {
+				shared = append(shared, capability)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+// extension_handshake is the extension's side of the handshake.
+func extension_handshake() protocol.Handshake {
+	return protocol.Current(extension_capabilities)
+}
+
+// add_protocol_envelope stamps a message with the extension's side of the handshake.
+func add_protocol_envelope(message map[string]interface{}) {
+	handshake := extension_handshake()
+	message["protocol_version"] = handshake.Version
+	message["min_protocol_version"] = handshake.MinVersion
+	message["capabilities"] = handshake.Capabilities
+}
+
+// unwrap_response_envelope returns the body of a protocol 2 response envelope.
+// Other frames, including protocol 1 responses, are returned unchanged.
+func unwrap_response_envelope(frame []byte) ([]byte, error) {
+	body, _, err := open_response_envelope(frame)
+	return body, err
+}
+
+// response_metadata is what a response envelope carries besides its body.
+type response_metadata struct {
+	trace  json.RawMessage  // see xray.go
+	timing *protocol.Timing // see latency_breakdown.go
+}
+
+// open_response_envelope is unwrap_response_envelope that also returns the
+// envelope's metadata, if any.
+func open_response_envelope(frame []byte) ([]byte, response_metadata, error) {
+	envelope, ok, err := protocol.ParseResponse(frame)
+	if !ok {
+		return frame, response_metadata{}, nil
+	}
+	if err != nil {
+		return nil, response_metadata{}, err
+	}
+	metadata := response_metadata{trace: envelope.Trace, timing: envelope.Timing}
+	if len(envelope.Body) == 0 {
+		return []byte("null"), metadata, nil
+	}
+	return envelope.Body, metadata, nil
+}
+
+// reject_agent tells an incompatible agent why it is not offered invocations.
+func (p *RuntimeAPIProxy) reject_agent(agent_id string, reason error) {
+	log.Printf("%s Not offering invocations to agent %s: %v", protocol_print_prefix, agent_id, reason)
+	if p.transport == nil || !p.transport.IsConnected() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, presence_publish_timeout)
+	defer cancel()
+	rejection := map[string]interface{}{
+		"type":          protocol_rejected_type,
+		"agent_id":      agent_id,
+		"function_name": p.function_name,
+		"sandbox_id":    p.sandbox_id,
+		"message":       reason.Error(),
+	}
+	add_protocol_envelope(rejection)
+	p.add_function_metadata(rejection)
+	if err := p.transport.Publish(ctx, p.presence_topic(), []interface{}{rejection}); err != nil {
+		log.Printf("%s Error publishing protocol rejection: %v", protocol_print_prefix, err)
+	}
+	// A pull agent only hears from sandboxes through the mailbox
+	p.mailbox.send_probe(ctx, rejection)
+}
+
+// format_capabilities lists capabilities for log lines.
+func format_capabilities(capabilities []string) string {
+	if len(capabilities) == 0 {
+		return "none"
+	}
+	return strings.Join(capabilities, ",")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestCheckAgentProtocol(t *testing.T) {
+	cases := []struct {
+		name    string
+		peer    protocol.Handshake
+		wantErr string
+	}{
+		{name: "unversioned agent", peer: protocol.Handshake{}},
+		{name: "current agent", peer: protocol.Handshake{Version: current_protocol_version, MinVersion: 1}},
+		{name: "newer agent that still speaks ours", peer: protocol.Handshake{Version: current_protocol_version + 1, MinVersion: current_protocol_version}},
+		{name: "agent that needs a newer layer", peer: protocol.Handshake{Version: current_protocol_version + 2, MinVersion: current_protocol_version + 1}, wantErr: "latest live-lambda layer"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := check_agent_protocol(tc.peer)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error mentioning %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	shared := negotiate_capabilities(protocol.Handshake{Version: 2, Capabilities: []string{capability_chunking, "telepathy", capability_response_envelope}})
+	if strings.Join(shared, ",") != "chunking,response_envelope" {
+		t.Fatalf("unexpected shared capabilities %v", shared)
+	}
+
+	// Protocol 1 agents predate capabilities and get everything they shipped with
+	legacy := negotiate_capabilities(protocol.Handshake{})
+	if strings.Join(legacy, ",") != strings.Join(protocol.UnversionedCapabilities, ",") {
+		t.Fatalf("unexpected legacy capabilities %v", legacy)
+	}
+}
+
+func TestUnwrapResponseEnvelope(t *testing.T) {
+	body, err := unwrap_response_envelope([]byte(`{"type":"response","protocol_version":2,"body":{"statusCode":200}}`))
+	if err != nil || string(body) != `{"statusCode":200}` {
+		t.Fatalf("unexpected unwrap result %q, %v", body, err)
+	}
+
+	legacy := []byte(`{"type":"response","statusCode":200}`)
+	if body, err := unwrap_response_envelope(legacy); err != nil || string(body) != string(legacy) {
+		t.Fatalf("expected an unversioned response to pass through, got %q, %v", body, err)
+	}
+
+	if _, err := unwrap_response_envelope([]byte(`{"type":"response","protocol_version":99,"body":1}`)); err == nil {
+		t.Fatal("expected a response from a newer protocol to be rejected")
+	}
+}
+
+func TestPresenceTrackerRejectsIncompatibleAgentsOnce(t *testing.T) {
+	tracker := new_presence_tracker(15 * time.Second)
+	heartbeat := json.RawMessage(`{"type":"heartbeat","agent_id":"a1","protocol_version":9,"min_protocol_version":9}`)
+
+	change := tracker.handle_frame(heartbeat)
+	if change.agent_id != "a1" || change.rejection == nil {
+		t.Fatalf("expected a rejection for a1, got %+v", change)
+	}
+	if change := tracker.handle_frame(heartbeat); change.rejection != nil {
+		t.Fatalf("expected the rejection to be sent once, got %v", change.rejection)
+	}
+	if tracker.compatible() == nil {
+		t.Fatal("expected the agent to stay incompatible")
+	}
+
+	tracker.handle_frame(json.RawMessage(`{"type":"heartbeat","agent_id":"a2","protocol_version":2,"capabilities":["streaming"]}`))
+	if err := tracker.compatible(); err != nil {
+		t.Fatalf("expected a compatible agent to clear the rejection: %v", err)
+	}
+	if tracker.supports(capability_chunking) || !tracker.supports(capability_streaming) {
+		t.Fatal("expected only the advertised capabilities to be supported")
+	}
+}
+
+func TestNilPresenceTrackerAssumesUnversionedAgent(t *testing.T) {
+	var tracker *presence_tracker
+	if tracker.compatible() != nil || !tracker.supports(capability_chunking) || tracker.supports(capability_response_envelope) {
+		t.Fatal("expected a disabled presence check to assume a protocol 1 agent")
+	}
+}
+
+func TestDecodeAgentResponseUnwrapsChunkedEnvelope(t *testing.T) {
+	proxy := new_tracking_proxy()
+	envelope := []byte(`{"type":"response","protocol_version":2,"body":{"statusCode":201},"trace":{"subsegments":[]}}`)
+	var response, trace []byte
+	for _, frame := range split_into_chunks("req-1", envelope, 16) {
+		decoded, decoded_trace, complete, err := proxy.decode_agent_response("req-1", frame)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if complete {
+			response, trace = decoded, decoded_trace.trace
+		}
+	}
+	if string(response) != `{"statusCode":201}` || string(trace) != `{"subsegments":[]}` {
+		t.Fatalf("unexpected response %q with trace %q", response, trace)
+	}
+}
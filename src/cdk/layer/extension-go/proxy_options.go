@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// ProxyOption customizes a RuntimeAPIProxy created by NewRuntimeAPIProxy.
+type ProxyOption func(*proxy_options)
+
+type proxy_options struct {
+	aws_cfg      *aws.Config
+	credentials  aws.CredentialsProvider
+	fallback     *FallbackPolicy
+	settings     *Config
+	transport    Transport
+	interceptors []Interceptor
+}
+
+// WithAWSConfig uses cfg instead of loading the default AWS configuration. If
+// cfg has no region, the AppSync region is used.
+func WithAWSConfig(cfg aws.Config) ProxyOption {
+	return func(o *proxy_options) {
+		o.aws_cfg = &cfg
+	}
+}
+
+// WithCredentialsProvider overrides the credentials used to sign AppSync and AWS
+// API requests. It applies on top of WithAWSConfig when both are given.
+func WithCredentialsProvider(provider aws.CredentialsProvider) ProxyOption {
+	return func(o *proxy_options) {
+		o.credentials = provider
+	}
+}
+
+// WithConfig uses settings instead of loading the configuration from the
+// environment and the config file. The positional arguments of
+// NewRuntimeAPIProxy take precedence over the matching settings.
+func WithConfig(settings Config) ProxyOption {
+	return func(o *proxy_options) {
+		o.settings = &settings
+	}
+}
+
+// WithInterceptor adds interceptor to the end of the proxy's interceptor chain.
+func WithInterceptor(interceptor Interceptor) ProxyOption {
+	return func(o *proxy_options) {
+		o.interceptors = append(o.interceptors, interceptor)
+	}
+}
+
+// resolve_settings returns the configured settings, or loads them. A proxy
+// built without WithConfig starts even when some settings are invalid; the
+// extension's main validates before creating it.
+func (o proxy_options) resolve_settings() Config {
+	if o.settings != nil {
+		return *o.settings
+	}
+	settings, err := LoadConfig()
+	if err != nil {
+		log.Printf("%s Ignoring invalid configuration: %v", config_print_prefix, err)
+	}
+	return settings
+}
+
+// credential_env resolves credential settings from the proxy's configuration
+// when it has one.
+func (o proxy_options) credential_env(name string) string {
+	if o.settings != nil {
+		return o.settings.credential_env(name)
+	}
+	return os.Getenv(name)
+}
+
+// resolve_aws_config returns the AWS configuration described by the options.
+func (o proxy_options) resolve_aws_config(ctx context.Context, aws_region string) (aws.Config, error) {
+	if o.aws_cfg != nil {
+		cfg := o.aws_cfg.Copy()
+		if cfg.Region == "" {
+			cfg.Region = aws_region
+		}
+		if o.credentials != nil {
+			cfg.Credentials = o.credentials
+		}
+		return cfg, nil
+	}
+
+	load_options := []func(*config.LoadOptions) error{config.WithRegion(aws_region)}
+	if o.credentials != nil {
+		load_options = append(load_options, config.WithCredentialsProvider(o.credentials))
+	} else {
+		source, err := select_credential_source(o.credential_env)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		log_credential_source(source)
+		load_options = append(load_options, source.load_options()...)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, load_options...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestNewRuntimeAPIProxyUsesInjectedCredentials(t *testing.T) {
+	t.Setenv(live_lambda_tag_lookup_env, "off")
+	provider := credentials.NewStaticCredentialsProvider("AKID", "secret", "token")
+
+	proxy, err := NewRuntimeAPIProxy(context.Background(), "127.0.0.1:9001", "api.example.com", "realtime.example.com", "eu-west-1", "9009", WithCredentialsProvider(provider))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	credentials, err := proxy.aws_cfg.Credentials.Retrieve(context.Background())
+	if err != nil || credentials.AccessKeyID != "AKID" {
+		t.Fatalf("expected injected credentials, got %+v (err %v)", credentials, err)
+	}
+	if proxy.aws_cfg.Region != "eu-west-1" {
+		t.Errorf("expected region eu-west-1, got %s", proxy.aws_cfg.Region)
+	}
+}
+
+func TestNewRuntimeAPIProxyUsesInjectedConfig(t *testing.T) {
+	t.Setenv(live_lambda_tag_lookup_env, "off")
+	cfg := aws.Config{Credentials: credentials.NewStaticCredentialsProvider("CFG", "secret", "")}
+
+	proxy, err := NewRuntimeAPIProxy(context.Background(), "127.0.0.1:9001", "api.example.com", "realtime.example.com", "us-west-2", "9009", WithAWSConfig(cfg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.aws_cfg.Region != "us-west-2" {
+		t.Errorf("expected missing region to default to the AppSync region, got %q", proxy.aws_cfg.Region)
+	}
+	credentials, _ := proxy.aws_cfg.Credentials.Retrieve(context.Background())
+	if credentials.AccessKeyID != "CFG" {
+		t.Errorf("expected credentials from the injected config, got %s", credentials.AccessKeyID)
+	}
+}
+
+func TestCredentialsProviderOverridesInjectedConfig(t *testing.T) {
+	options := proxy_options{}
+	WithAWSConfig(aws.Config{Region: "ap-south-1", Credentials: credentials.NewStaticCredentialsProvider("CFG", "secret", "")})(&options)
+	WithCredentialsProvider(credentials.NewStaticCredentialsProvider("OVERRIDE", "secret", ""))(&options)
+
+	cfg, err := options.resolve_aws_config(context.Background(), "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	credentials, _ := cfg.Credentials.Retrieve(context.Background())
+	if credentials.AccessKeyID != "OVERRIDE" || cfg.Region != "ap-south-1" {
+		t.Fatalf("unexpected config: region=%s key=%s", cfg.Region, credentials.AccessKeyID)
+	}
+}
+
+func TestDisabledProxyNeverConnects(t *testing.T) {
+	t.Setenv(live_lambda_enabled_env, "off")
+
+	proxy, err := NewRuntimeAPIProxy(context.Background(), "127.0.0.1:9001", "", "", "", "9009")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxy.transport != nil {
+		t.Fatal("expected no transport with the extension disabled")
+	}
+	if enabled, reason := proxy.interception.enabled(); enabled || !proxy.interception.hard_disabled() {
+		t.Fatalf("expected interception to be off for good, got %v (%s)", enabled, reason)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Reconnecting
+//
+// The transport does not tell the extension when its connection drops, and an
+// invocation waiting in handle_next would sit on a dead response subscription
+// until its deadline. watch_connection polls the transport; once the
+// connection is lost it reconnects with backoff, subscribes again to the
+// control and presence channels and to the response channel of every
+// invocation still in flight (or once to the wildcard response channel, see
+// response_demux.go), and publishes a retransmit_request for each
+// invocation already handed to the agent, so the agent resends any response it
+// produced while the extension could not hear it.
+
+const (
+	retransmit_request_type   = "retransmit_request"
+	connection_watch_interval = time.Second
+	reconnect_initial_backoff = time.Second
+	reconnect_max_backoff     = 30 * time.Second
+	reconnect_publish_timeout = 5 * time.Second
+)
+
+// watch_connection reconnects the transport whenever it drops, until ctx is done.
+func (p *RuntimeAPIProxy) watch_connection(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.transport.IsConnected() {
+				continue
+			}
+			if !p.reconnect(ctx) {
+				return
+			}
+		}
+	}
+}
+
+// reconnect connects the transport again and restores its subscriptions. It
+// returns false when ctx ends first.
+func (p *RuntimeAPIProxy) reconnect(ctx context.Context) bool {
+	component_logger(component_transport).Warn("Connection lost, reconnecting", "in_flight", p.requests.in_flight())
+	backoff := reconnect_initial_backoff
+	for {
+		err := p.transport.Connect(ctx)
+		if err == nil {
+			break
+		}
+		component_logger(component_transport).Warn("Reconnect failed", "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reconnect_max_backoff)
+	}
+	component_logger(component_transport).Info("Reconnected")
+	p.prometheus.reconnected()
+
+	p.subscribe_control_channel(ctx)
+	p.subscribe_presence_topic(ctx)
+	p.announce_endpoint_switch(ctx)
+	p.response_demux.reset()
+	resumed := 0
+	for _, request := range p.requests.snapshot() {
+		if region, _ := request.route(); region != "" {
+			// Routed through a preferred region, whose connection is separate
+			continue
+		}
+		if p.resume_request(ctx, request) {
+			resumed++
+		}
+	}
+	p.publish_lifecycle_event(ctx, "reconnected", map[string]interface{}{
+		"in_flight": resumed,
+	})
+	return true
+}
+
+// resume_request subscribes to request's response channel again and, when the
+// request was already published, asks the agent to resend its response.
+func (p *RuntimeAPIProxy) resume_request(ctx context.Context, request *pending_request) bool {
+	request_id := request.request_id
+	topic := p.response_topic(request_id)
+	var err error
+	if request.on_wildcard() {
+		topic = p.response_topic(response_wildcard_id)
+		err = p.subscribe_response_wildcard(ctx)
+	} else {
+		var subscription TransportSubscription
+		subscription, err = p.request_transport(request_id).Subscribe(ctx, topic, func(data_payload interface{}) {
+			p.route_agent_response(request_id, data_payload)
+		})
+		if err == nil {
+			request.set_subscription(subscription)
+		}
+	}
+	if err != nil {
+		request_logger(request_id).Error("Error subscribing again after a reconnect", "topic", topic, "error", err)
+		p.explain(request_id, "resubscribe_failed", "%s: %v", topic, err)
+		return false
+	}
+	request.update_metrics(func(m *invocation_metrics) { m.reconnects++ })
+	p.explain(request_id, "resubscribed", "on %s after a reconnect", topic)
+
+	if request.published().IsZero() {
+		return true
+	}
+	p.request_retransmit(ctx, request_id)
+	return true
+}
+
+// request_retransmit asks the agent to publish its response for request_id again.
+func (p *RuntimeAPIProxy) request_retransmit(ctx context.Context, request_id string) {
+	publish_ctx, cancel := context.WithTimeout(ctx, reconnect_publish_timeout)
+	defer cancel()
+	request := map[string]interface{}{
+		"type":          retransmit_request_type,
+		"request_id":    request_id,
+		"sandbox_id":    p.sandbox_id,
+		"function_name": p.function_name,
+	}
+	p.add_idempotency_key(request, request_id)
+	add_protocol_envelope(request)
+	p.add_function_metadata(request)
+
+	if err := p.agent_publisher(request_id)(publish_ctx, request); err != nil {
+		request_logger(request_id).Warn("Error requesting a retransmit", "error", err)
+		return
+	}
+	p.explain(request_id, "retransmit_requested", "after a reconnect")
+	request_logger(request_id).Info("Asked the agent to resend its response")
+}
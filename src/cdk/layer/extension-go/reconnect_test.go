@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconnectResumesInFlightRequests(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+
+	published, _ := proxy.requests.register("req-published", []byte(`{}`), nil)
+	published.mark_published(time.Now())
+	proxy.requests.register("req-unpublished", []byte(`{}`), nil)
+
+	// The connection watch reconnects once the Events API ends the connection
+	server.SetUnavailable("connection expired")
+	server.SetUnavailable("")
+	requests := wait_for_published(t, server, proxy.requests_topic(), of_type(retransmit_request_type))
+	if len(requests) != 1 || requests[0]["request_id"] != "req-published" || requests[0]["sandbox_id"] != proxy.sandbox_id {
+		t.Fatalf("expected one retransmit request for the published request, got %v", requests)
+	}
+	if !proxy.transport.IsConnected() {
+		t.Fatal("expected the transport to be connected again")
+	}
+	// The control, presence and both response channels
+	if _, subscriptions := server.Counts(); subscriptions != 4 {
+		t.Fatalf("expected 4 subscriptions after the reconnect, got %d", subscriptions)
+	}
+
+	// The resent response reaches the invocation through the new subscription
+	server.Publish(proxy.response_topic("req-published"), map[string]interface{}{"resent": true})
+	select {
+	case posted := <-received:
+		if !strings.Contains(posted.path, "req-published") || !strings.Contains(posted.body, "resent") {
+			t.Fatalf("unexpected post %+v", posted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resent response")
+	}
+	steps, _ := proxy.explanations.lookup("req-published")
+	if len(steps) != 2 || steps[0].Decision != "resubscribed" || steps[1].Decision != "retransmit_requested" {
+		t.Fatalf("unexpected explanation %+v", steps)
+	}
+}
+
+func TestWatchConnectionReconnectsWhenDropped(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+
+	server.SetUnavailable("connection expired")
+	for wait := time.Now().Add(5 * time.Second); proxy.transport.IsConnected(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(wait) {
+			t.Fatal("timed out waiting for the connection to end")
+		}
+	}
+	server.SetUnavailable("")
+	wait_for_subscriptions(t, server, 2)
+	if !proxy.transport.IsConnected() {
+		t.Fatal("expected the transport to be connected again")
+	}
+}
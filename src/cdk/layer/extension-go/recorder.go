@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Recording
+//
+// With LIVE_LAMBDA_RECORD=s3 or channel the extension keeps a copy of every
+// intercepted invocation, so developers can replay production-shaped events
+// against local code later. Each invocation is recorded as an event record
+// holding the event and the Lambda context the agent was sent; with
+// LIVE_LAMBDA_RECORD_RESPONSES=on the agent's response follows as a response
+// record with the same request_id. Streamed responses are not recorded.
+//
+// Records are written one file each to a ring buffer in
+// /tmp/live-lambda-recordings that keeps the newest
+// LIVE_LAMBDA_RECORD_CAPACITY (default 100), and are flushed every
+// LIVE_LAMBDA_RECORD_FLUSH_INTERVAL (default 1m) and at shutdown:
+//
+//   - s3: one JSON Lines object per flush in LIVE_LAMBDA_OFFLOAD_BUCKET, under
+//     live-lambda/recordings/{function}/{sandbox_id}/{time}.jsonl.
+//   - channel: each record is published on live-lambda/recordings/{function}.
+//     A record over the event size limit is published without its event or
+//     response and with truncated set.
+//
+// A flush that fails leaves the records in the buffer for the next one, so
+// nothing but the oldest records is lost while S3 or the transport is away.
+
+const (
+	recorder_print_prefix      = "[LiveLambdaExt:Recorder]"
+	record_off                 = "off"
+	record_s3                  = "s3"
+	record_channel             = "channel"
+	default_record_capacity    = 100
+	default_record_flush_every = time.Minute
+	default_record_dir         = "/tmp/live-lambda-recordings"
+	record_s3_prefix           = "live-lambda/recordings/"
+	record_kind_event          = "event"
+	record_kind_response       = "response"
+	record_file_suffix         = ".json"
+)
+
+// recording is one record in the buffer and in what is flushed.
+type recording struct {
+	Kind         string            `json:"kind"`
+	RequestID    string            `json:"request_id"`
+	FunctionName string            `json:"function_name"`
+	SandboxID    string            `json:"sandbox_id"`
+	RecordedAt   time.Time         `json:"recorded_at"`
+	Event        json.RawMessage   `json:"event,omitempty"`
+	Context      *protocol.Context `json:"context,omitempty"`
+	Response     json.RawMessage   `json:"response,omitempty"`
+	Error        bool              `json:"error,omitempty"` // the response is an invocation error
+	Truncated    bool              `json:"truncated,omitempty"`
+}
+
+type payload_recorder struct {
+	mu            sync.Mutex
+	mode          string
+	dir           string
+	capacity      int
+	responses     bool
+	next          uint64 // sequence number of the next record
+	function_name string
+	sandbox_id    string
+	cfg           aws.Config
+	bucket        string
+	region        string
+	now           func() time.Time
+}
+
+// new_payload_recorder_from_config returns nil unless LIVE_LAMBDA_RECORD is
+// s3 or channel. Recordings go to the offload bucket, in its region.
+func new_payload_recorder_from_config(cfg aws.Config, region string, settings Config, sandbox_id string) *payload_recorder {
+	mode := strings.ToLower(settings.Record)
+	if mode == "" || mode == record_off {
+		return nil
+	}
+	if bucket_region := settings.OffloadRegion; bucket_region != "" {
+		region = bucket_region
+	} else if function_region := settings.FunctionRegion; function_region != "" {
+		region = function_region
+	}
+	recorder := &payload_recorder{
+		mode:          mode,
+		dir:           default_record_dir,
+		capacity:      settings.RecordCapacity,
+		responses:     settings.RecordResponses,
+		function_name: settings.FunctionName,
+		sandbox_id:    sandbox_id,
+		cfg:           cfg,
+		bucket:        settings.OffloadBucket,
+		region:        region,
+		now:           time.Now,
+	}
+	if err := recorder.open(); err != nil {
+		log.Printf("%s Recording disabled: %v", recorder_print_prefix, err)
+		return nil
+	}
+	log.Printf("%s Recording intercepted invocations (%s), keeping up to %d records in %s", recorder_print_prefix, mode, recorder.capacity, recorder.dir)
+	return recorder
+}
+
+// open creates the buffer directory and continues the sequence of any records
+// a previous run of the extension left in it.
+func (r *payload_recorder) open() error {
+	if err := os.MkdirAll(r.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", r.dir, err)
+	}
+	sequences, err := r.sequences()
+	if err != nil {
+		return err
+	}
+	if len(sequences) > 0 {
+		r.next = sequences[len(sequences)-1] + 1
+	}
+	return nil
+}
+
+// sequences lists the records in the buffer, oldest first.
+func (r *payload_recorder) sequences() ([]uint64, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", r.dir, err)
+	}
+	var sequences []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), record_file_suffix)
+		if !ok {
+			continue
+		}
+		if sequence, err := strconv.ParseUint(name, 10, 64); err == nil {
+			sequences = append(sequences, sequence)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences, nil
+}
+
+func (r *payload_recorder) path(sequence uint64) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%020d%s", sequence, record_file_suffix))
+}
+
+// record_event records an intercepted invocation.
+func (r *payload_recorder) record_event(request_id string, event []byte, context_data *protocol.Context) {
+	if r == nil {
+		return
+	}
+	r.write(recording{Kind: record_kind_event, RequestID: request_id, Event: raw_json(event), Context: context_data})
+}
+
+// record_response records the agent's response to request_id when responses
+// are recorded.
+func (r *payload_recorder) record_response(request_id string, response []byte, is_error bool) {
+	if r == nil || !r.responses {
+		return
+	}
+	r.write(recording{Kind: record_kind_response, RequestID: request_id, Response: raw_json(response), Error: is_error})
+}
+
+// write adds a record to the buffer, evicting the oldest past capacity. The
+// record is written under a temporary name so a flush never reads half of it.
+func (r *payload_recorder) write(record recording) {
+	record.FunctionName = r.function_name
+	record.SandboxID = r.sandbox_id
+	record.RecordedAt = r.now().UTC()
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("%s Could not encode the %s record for request ID %s: %v", recorder_print_prefix, record.Kind, record.RequestID, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sequence := r.next
+	r.next++
+	path := r.path(sequence)
+	if err := os.WriteFile(path+".tmp", line, 0o600); err != nil {
+		log.Printf("%s Could not record request ID %s: %v", recorder_print_prefix, record.RequestID, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("%s Could not record request ID %s: %v", recorder_print_prefix, record.RequestID, err)
+		return
+	}
+	if sequence >= uint64(r.capacity) {
+		if err := os.Remove(r.path(sequence - uint64(r.capacity))); err == nil {
+			log.Printf("%s Buffer full, dropped the oldest record", recorder_print_prefix)
+		}
+	}
+}
+
+// buffered reads the records in the buffer, oldest first, with their sequence numbers.
+func (r *payload_recorder) buffered() ([]uint64, [][]byte, error) {
+	sequences, err := r.sequences()
+	if err != nil {
+		return nil, nil, err
+	}
+	kept := sequences[:0]
+	var records [][]byte
+	for _, sequence := range sequences {
+		record, err := os.ReadFile(r.path(sequence))
+		if err != nil {
+			continue // evicted since the listing
+		}
+		kept = append(kept, sequence)
+		records = append(records, record)
+	}
+	return kept, records, nil
+}
+
+// remove deletes flushed records from the buffer.
+func (r *payload_recorder) remove(sequences []uint64) {
+	for _, sequence := range sequences {
+		if err := os.Remove(r.path(sequence)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("%s Could not remove a flushed record: %v", recorder_print_prefix, err)
+		}
+	}
+}
+
+// upload writes records to S3 as one JSON Lines object.
+func (r *payload_recorder) upload(ctx context.Context, records [][]byte) error {
+	key := fmt.Sprintf("%s%s/%s/%s.jsonl", record_s3_prefix, r.function_name, r.sandbox_id, r.now().UTC().Format("20060102T150405.000000000Z"))
+	body := append(bytes.Join(records, []byte("\n")), '\n')
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/x-ndjson")
+	if _, err := send_signed_request(ctx, r.cfg, "s3", r.region, http.MethodPut, s3_object_url(r.bucket, r.region, key), body, headers); err != nil {
+		return fmt.Errorf("failed to upload recordings: %w", err)
+	}
+	log.Printf("%s Uploaded %d records to s3://%s/%s", recorder_print_prefix, len(records), r.bucket, key)
+	return nil
+}
+
+// recordings_topic returns the channel recordings are published on.
+func (p *RuntimeAPIProxy) recordings_topic() string {
+	return p.channel("recordings/%s", p.function_name)
+}
+
+// publish_recordings publishes each record as an event on the recordings
+// channel, leaving out the payloads of records too large for one event.
+func (p *RuntimeAPIProxy) publish_recordings(ctx context.Context, records [][]byte) error {
+	if p.transport == nil || !p.transport.IsConnected() {
+		return errors.New("the transport is not connected")
+	}
+	topic := p.recordings_topic()
+	for _, record := range records {
+		if len(record) > max_inline_event_bytes {
+			var truncated recording
+			if err := json.Unmarshal(record, &truncated); err != nil {
+				continue // not a record; drop it rather than block the buffer
+			}
+			truncated.Event, truncated.Response, truncated.Truncated = nil, nil, true
+			record, _ = json.Marshal(truncated)
+		}
+		if err := p.transport.Publish(ctx, topic, []interface{}{json.RawMessage(record)}); err != nil {
+			return fmt.Errorf("failed to publish to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// flush_recordings sends the buffered records to S3 or the recordings
+// channel and removes them once sent.
+func (p *RuntimeAPIProxy) flush_recordings(ctx context.Context) error {
+	r := p.recorder
+	if r == nil {
+		return nil
+	}
+	sequences, records, err := r.buffered()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	if r.mode == record_s3 {
+		err = r.upload(ctx, records)
+	} else {
+		err = p.publish_recordings(ctx, records)
+	}
+	if err != nil {
+		return err
+	}
+	r.remove(sequences)
+	return nil
+}
+
+// run_recorder flushes the recordings every interval until ctx is done.
+func (p *RuntimeAPIProxy) run_recorder(ctx context.Context, interval time.Duration) {
+	if p.recorder == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.flush_recordings(ctx); err != nil {
+				log.Printf("%s Flush failed, keeping the records for the next one: %v", recorder_print_prefix, err)
+			}
+		}
+	}
+}
+
+// raw_json returns payload as JSON, quoting it as a string if it is not JSON already.
+func raw_json(payload []byte) json.RawMessage {
+	if json.Valid(payload) {
+		return payload
+	}
+	quoted, _ := json.Marshal(string(payload))
+	return quoted
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func test_recorder(t *testing.T, mode string, capacity int) *payload_recorder {
+	t.Helper()
+	recorder := &payload_recorder{
+		mode:          mode,
+		dir:           t.TempDir(),
+		capacity:      capacity,
+		responses:     true,
+		function_name: "orders",
+		sandbox_id:    "sb-1",
+		cfg:           aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")},
+		bucket:        "payloads",
+		region:        "us-east-1",
+		now:           func() time.Time { return time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC) },
+	}
+	if err := recorder.open(); err != nil {
+		t.Fatal(err)
+	}
+	return recorder
+}
+
+func TestRecorderKeepsTheNewestRecords(t *testing.T) {
+	recorder := test_recorder(t, record_s3, 2)
+	recorder.record_event("r1", []byte(`{"n":1}`), nil)
+	recorder.record_event("r2", []byte(`{"n":2}`), &protocol.Context{TraceID: "t2"})
+	recorder.record_response("r2", []byte(`not json`), false)
+
+	_, records, err := recorder.buffered()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("expected two records, got %d (%v)", len(records), err)
+	}
+	var event, response recording
+	json.Unmarshal(records[0], &event)
+	json.Unmarshal(records[1], &response)
+	if event.Kind != record_kind_event || event.RequestID != "r2" || event.Context == nil || event.Context.TraceID != "t2" || event.SandboxID != "sb-1" {
+		t.Fatalf("unexpected event record %+v", event)
+	}
+	if response.Kind != record_kind_response || string(response.Response) != `"not json"` {
+		t.Fatalf("unexpected response record %+v", response)
+	}
+
+	reopened := &payload_recorder{dir: recorder.dir}
+	if err := reopened.open(); err != nil || reopened.next != 3 {
+		t.Fatalf("expected the sequence to continue at 3, got %d (%v)", reopened.next, err)
+	}
+}
+
+func TestRecorderSkipsResponsesUnlessEnabled(t *testing.T) {
+	recorder := test_recorder(t, record_s3, 10)
+	recorder.responses = false
+	recorder.record_response("r1", []byte(`{}`), false)
+	if _, records, _ := recorder.buffered(); len(records) != 0 {
+		t.Fatalf("expected no records, got %d", len(records))
+	}
+	var disabled *payload_recorder
+	disabled.record_event("r1", []byte(`{}`), nil)
+}
+
+func TestFlushRecordingsUploadsJSONLines(t *testing.T) {
+	type upload struct {
+		path string
+		body string
+	}
+	uploads := make(chan upload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploads <- upload{path: r.URL.Path, body: string(body)}
+	}))
+	defer server.Close()
+	previous := s3_object_url
+	s3_object_url = func(bucket string, region string, key string) string { return server.URL + "/" + key }
+	defer func() { s3_object_url = previous }()
+
+	p := &RuntimeAPIProxy{recorder: test_recorder(t, record_s3, 10)}
+	p.recorder.record_event("r1", []byte(`{"n":1}`), nil)
+	p.recorder.record_response("r1", []byte(`{"statusCode":200}`), false)
+	if err := p.flush_recordings(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	uploaded := <-uploads
+	if uploaded.path != "/live-lambda/recordings/orders/sb-1/20250601T100000.000000000Z.jsonl" {
+		t.Fatalf("unexpected key %s", uploaded.path)
+	}
+	if lines := strings.Split(strings.TrimSpace(uploaded.body), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"statusCode":200`) {
+		t.Fatalf("unexpected upload %q", uploaded.body)
+	}
+	if _, records, _ := p.recorder.buffered(); len(records) != 0 {
+		t.Fatalf("expected the flushed records to be removed, %d left", len(records))
+	}
+}
+
+func TestFlushRecordingsPublishesTruncatedRecords(t *testing.T) {
+	server := new_events_server(t)
+	p := new_events_proxy(t, server)
+	p.recorder = test_recorder(t, record_channel, 10)
+	p.recorder.record_event("r1", []byte(`{"n":1}`), nil)
+	p.recorder.record_event("r2", []byte(`"`+strings.Repeat("x", max_inline_event_bytes)+`"`), nil)
+	if err := p.flush_recordings(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	published := server.Published("live-lambda/recordings/orders")
+	if len(published) != 2 {
+		t.Fatalf("expected two records on the recordings channel, got %s", published)
+	}
+	var small, large recording
+	json.Unmarshal(published[0], &small)
+	json.Unmarshal(published[1], &large)
+	if small.Truncated || string(small.Event) != `{"n":1}` {
+		t.Fatalf("unexpected record %+v", small)
+	}
+	if !large.Truncated || large.Event != nil || large.RequestID != "r2" {
+		t.Fatalf("expected a truncated record, got %+v", large)
+	}
+}
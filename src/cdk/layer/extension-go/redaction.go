@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// Redaction
+//
+// Secrets must not leave the sandbox through AppSync. The redactor replaces
+// each secret it finds with protocol.Redact's hash of it, so equal values still
+// look alike to the developer:
+//
+//   - env channel snapshots: the values of variables matching the built-in
+//     denylist or LIVE_LAMBDA_ENV_REDACT;
+//   - forwarded log records: those same values, wherever a record contains
+//     them, unless LIVE_LAMBDA_REDACT_LOGS=off;
+//   - events published to the agent: the fields selected by the JSONPath
+//     patterns in LIVE_LAMBDA_REDACT_PATHS, such as $.headers.authorization or
+//     $..password. The function itself still receives the event unchanged.
+//
+// The patterns support $, .name, ['name'], [n], [*], .* and recursive descent
+// (..name, ..*). A matched string is hashed as is; other values are hashed in
+// their JSON encoding. An event is only re-encoded when a pattern matched,
+// which sorts its object keys.
+
+const (
+	// Shorter values are not looked for in log records, where they would
+	// match by accident.
+	min_log_secret_length = 8
+)
+
+type redactor struct {
+	env_patterns []string
+	secrets      []string // the redacted variables' values to scrub from logs, longest first
+	paths        []json_path
+	redacted     atomic.Int64 // values replaced
+}
+
+// new_redactor_from_config builds the redactor for the sandbox's environment,
+// environ (KEY=value entries).
+func new_redactor_from_config(settings Config, environ []string) *redactor {
+	r := &redactor{
+		env_patterns: append(append([]string{}, default_env_denylist...), split_env_patterns(settings.EnvRedact)...),
+	}
+	// Checked by Config.Validate
+	r.paths, _ = parse_json_paths(settings.RedactPaths)
+	if settings.RedactLogs {
+		seen := map[string]bool{}
+		for _, entry := range environ {
+			name, value, ok := strings.Cut(entry, "=")
+			if ok && len(value) >= min_log_secret_length && !seen[value] && matches_env_pattern(r.env_patterns, name) {
+				seen[value] = true
+				r.secrets = append(r.secrets, value)
+			}
+		}
+		// A secret containing another is replaced first
+		sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+	}
+	return r
+}
+
+// env_value returns what to publish for the variable name, and whether it was
+// redacted. A nil redactor applies the built-in denylist.
+func (r *redactor) env_value(name string, value string) (string, bool) {
+	patterns := default_env_denylist
+	if r != nil {
+		patterns = r.env_patterns
+	}
+	if !matches_env_pattern(patterns, name) {
+		return value, false
+	}
+	if r != nil {
+		r.redacted.Add(1)
+	}
+	return protocol.Redact(value), true
+}
+
+// scrub replaces the secrets in a JSON log record. A secret is looked for both
+// as is and as JSON escapes it inside a string.
+func (r *redactor) scrub(record json.RawMessage) json.RawMessage {
+	for _, secret := range r.secrets {
+		encoded, _ := json.Marshal(secret)
+		for _, form := range [][]byte{[]byte(secret), encoded[1 : len(encoded)-1]} {
+			if count := bytes.Count(record, form); count > 0 {
+				record = bytes.ReplaceAll(record, form, []byte(protocol.Redact(secret)))
+				r.redacted.Add(int64(count))
+			}
+		}
+	}
+	return record
+}
+
+// scrub_records scrubs a batch of log records in place.
+func (r *redactor) scrub_records(records []log_record) {
+	if r == nil || len(r.secrets) == 0 {
+		return
+	}
+	for i := range records {
+		records[i].Record = r.scrub(records[i].Record)
+	}
+}
+
+// redact_event returns the JSON event with the fields LIVE_LAMBDA_REDACT_PATHS
+// selects redacted. event itself is not modified.
+func (r *redactor) redact_event(event []byte) []byte {
+	if r == nil || len(r.paths) == 0 {
+		return event
+	}
+	decoder := json.NewDecoder(bytes.NewReader(event))
+	decoder.UseNumber()
+	var document interface{}
+	if decoder.Decode(&document) != nil {
+		return event
+	}
+	count := 0
+	for _, path := range r.paths {
+		document = path.redact(document, &count)
+	}
+	if count == 0 {
+		return event
+	}
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if encoder.Encode(document) != nil {
+		return event
+	}
+	r.redacted.Add(int64(count))
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+// redact_json_value returns the hash published in place of a matched value.
+func redact_json_value(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return protocol.Redact(text)
+	}
+	encoded, _ := json.Marshal(value)
+	return protocol.Redact(string(encoded))
+}
+
+// json_path_step is one step of a JSONPath pattern. A wildcard step matches
+// every member or element; recursive steps match at any depth below.
+type json_path_step struct {
+	name      string
+	index     int // for an array step; -1 otherwise
+	wildcard  bool
+	recursive bool
+}
+
+type json_path []json_path_step
+
+// parse_json_paths reads a comma-separated list of JSONPath patterns.
+func parse_json_paths(value string) ([]json_path, error) {
+	var paths []json_path
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		path, err := parse_json_path(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func parse_json_path(pattern string) (json_path, error) {
+	if !strings.HasPrefix(pattern, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", pattern)
+	}
+	var path json_path
+	rest := pattern[1:]
+	for rest != "" {
+		step := json_path_step{index: -1}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+		default:
+			return nil, fmt.Errorf("JSONPath %q has an unexpected %q", pattern, rest[:1])
+		}
+		switch {
+		case strings.HasPrefix(rest, "*"):
+			step.wildcard = true
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an unclosed [", pattern)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+			if selector == "*" {
+				step.wildcard = true
+			} else if quoted := len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]; quoted {
+				step.name = selector[1 : len(selector)-1]
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				step.index = index
+			} else {
+				return nil, fmt.Errorf("JSONPath %q has an unsupported selector [%s]", pattern, selector)
+			}
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.name = rest[:end]
+			rest = rest[end:]
+		}
+		if step.name == "" && step.index < 0 && !step.wildcard {
+			return nil, fmt.Errorf("JSONPath %q has an empty step", pattern)
+		}
+		path = append(path, step)
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("JSONPath %q selects the whole event", pattern)
+	}
+	return path, nil
+}
+
+// redact returns node with the values the path selects replaced, adding how
+// many it replaced to count. A recursive step is tried at every depth, but
+// not inside a value it already replaced.
+func (p json_path) redact(node interface{}, count *int) interface{} {
+	if len(p) == 0 {
+		*count++
+		return redact_json_value(node)
+	}
+	step, rest := p[0], p[1:]
+	apply := func(child interface{}, matched bool) interface{} {
+		switch {
+		case matched && step.recursive && len(rest) > 0:
+			return rest.redact(p.redact(child, count), count)
+		case matched:
+			return rest.redact(child, count)
+		case step.recursive:
+			return p.redact(child, count)
+		}
+		return child
+	}
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, member := range value {
+			value[key] = apply(member, step.wildcard || (step.index < 0 && key == step.name))
+		}
+	case []interface{}:
+		for i, element := range value {
+			value[i] = apply(element, step.wildcard || i == step.index)
+		}
+	}
+	return node
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func TestParseJSONPaths(t *testing.T) {
+	paths, err := parse_json_paths(`$.headers.authorization, $['body'].card[0], $..password, $.items[*].token, $.*`)
+	if err != nil || len(paths) != 5 {
+		t.Fatalf("unexpected paths %v, %v", paths, err)
+	}
+	if step := paths[1][2]; step.index != 0 || step.name != "" {
+		t.Fatalf("unexpected index step %+v", step)
+	}
+	if step := paths[2][0]; !step.recursive || step.name != "password" {
+		t.Fatalf("unexpected recursive step %+v", step)
+	}
+	for _, pattern := range []string{"headers.authorization", "$", "$.", "$.a[", "$.a[-1]", "$.a[?(@.b)]", "$a"} {
+		if _, err := parse_json_path(pattern); err == nil {
+			t.Errorf("expected %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestRedactEventReplacesSelectedFieldsWithHashes(t *testing.T) {
+	settings := default_config()
+	settings.RedactPaths = "$.headers.authorization,$..password,$.items[*].card,$.numbers[1]"
+	r := new_redactor_from_config(settings, nil)
+
+	event := []byte(`{"headers":{"authorization":"Bearer abc","host":"a<b>"},"user":{"password":"hunter2","profile":{"password":"swordfish"}},"items":[{"card":4111111111111111,"sku":"x"}],"numbers":[1,2,3],"big":12345678901234567890}`)
+	redacted := r.redact_event(event)
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(redacted, &document); err != nil {
+		t.Fatalf("redacted event is not JSON: %s", redacted)
+	}
+	for value, want := range map[string]string{
+		"Bearer abc":       protocol.Redact("Bearer abc"),
+		"hunter2":          protocol.Redact("hunter2"),
+		"swordfish":        protocol.Redact("swordfish"),
+		"4111111111111111": protocol.Redact("4111111111111111"),
+	} {
+		if strings.Contains(string(redacted), value) || !strings.Contains(string(redacted), want) {
+			t.Errorf("expected %q to be replaced with %s in %s", value, want, redacted)
+		}
+	}
+	// Everything else is kept as it was
+	for _, kept := range []string{`"host":"a<b>"`, `"sku":"x"`, `"numbers":[1,"` + protocol.Redact("2") + `",3]`, `"big":12345678901234567890`} {
+		if !strings.Contains(string(redacted), kept) {
+			t.Errorf("expected %s in %s", kept, redacted)
+		}
+	}
+	if r.redacted.Load() != 5 {
+		t.Fatalf("expected 5 redactions, got %d", r.redacted.Load())
+	}
+
+	untouched := []byte(`{"id": 7}`)
+	if string(r.redact_event(untouched)) != string(untouched) {
+		t.Fatal("expected an event without matches to be published byte for byte")
+	}
+	if string((*redactor)(nil).redact_event(untouched)) != string(untouched) {
+		t.Fatal("expected no redaction without a redactor")
+	}
+}
+
+func TestScrubRecordsRemovesSecretValuesFromLogs(t *testing.T) {
+	settings := default_config()
+	settings.EnvRedact = "STRIPE_*"
+	environ := []string{"STRIPE_KEY=sk_live_abc123", "DB_PASSWORD=pa\"ss\\word", "API_TOKEN=short", "TABLE_NAME=orders-table"}
+	r := new_redactor_from_config(settings, environ)
+
+	records := []log_record{
+		{Type: "function", Record: json.RawMessage(`"charging with sk_live_abc123 on orders-table"`)},
+		{Type: "function", Record: json.RawMessage(`{"message":"connecting with pa\"ss\\word and short"}`)},
+	}
+	r.scrub_records(records)
+
+	if got := string(records[0].Record); got != `"charging with `+protocol.Redact("sk_live_abc123")+` on orders-table"` {
+		t.Fatalf("unexpected record %s", got)
+	}
+	if got := string(records[1].Record); strings.Contains(got, `pa\"ss`) || !strings.Contains(got, protocol.Redact(`pa"ss\word`)) || !strings.Contains(got, "short") {
+		t.Fatalf("expected the escaped secret to be scrubbed and short values kept, got %s", got)
+	}
+	if !json.Valid(records[1].Record) {
+		t.Fatalf("scrubbed record is not JSON: %s", records[1].Record)
+	}
+
+	settings.RedactLogs = false
+	if off := new_redactor_from_config(settings, environ); len(off.secrets) != 0 {
+		t.Fatalf("expected no log scrubbing with %s=off", live_lambda_redact_logs_env)
+	}
+}
+
+func TestConfigValidateRejectsBadRedactPaths(t *testing.T) {
+	settings, _ := load_config(lookup_from(map[string]string{live_lambda_redact_paths_env: "$.ok,body.password"}))
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), live_lambda_redact_paths_env) {
+		t.Fatalf("expected %s to be rejected, got %v", live_lambda_redact_paths_env, err)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Regional endpoints
+//
+// A team spread across continents may deploy the Events API in several
+// regions. LIVE_LAMBDA_REGIONAL_ENDPOINTS lists the other regions' endpoints as
+// region=http_host[|realtime_host], comma separated; the realtime host defaults
+// to the HTTP host with appsync-api replaced by appsync-realtime-api. The
+// extension's own endpoint stays the primary: presence, control, lifecycle and
+// log channels use it as before.
+//
+// An agent names the region closest to the developer in its heartbeats
+// ({"preferred_region": "eu-west-1"}). While that region's endpoint is
+// connected and healthy, the extension subscribes to each invocation's response
+// channel and publishes its request there, saving the cross-region hop on every
+// frame of the tunnel. When a subscribe or publish fails there, or the
+// connection drops, the region is marked unhealthy for
+// LIVE_LAMBDA_REGION_RETRY_INTERVAL (default 30s): invocations in flight move
+// to the primary endpoint, which asks the agent to resend its response, and new
+// ones use the primary until the region connects again. An agent that prefers
+// a region is expected to keep its primary subscriptions as well.
+
+const (
+	regional_print_prefix           = "[LiveLambdaExt:Regional]"
+	default_region_retry_interval   = 30 * time.Second
+	regional_check_interval         = time.Second
+	regional_publish_timeout        = 5 * time.Second
+	region_failover_event_type      = "region_failover"
+	region_failback_event_type      = "region_failback"
+	appsync_api_host_label          = ".appsync-api."
+	appsync_realtime_api_host_label = ".appsync-realtime-api."
+)
+
+// regional_endpoint is one region's Events API endpoint and its connection.
+type regional_endpoint struct {
+	region          string
+	http_host       string
+	realtime_host   string
+	transport       Transport
+	connecting      bool
+	failed          bool // set by mark_failed, cleared once the region connects again
+	unhealthy_until time.Time
+}
+
+// parse_regional_endpoints parses LIVE_LAMBDA_REGIONAL_ENDPOINTS.
+func parse_regional_endpoints(value string) ([]*regional_endpoint, error) {
+	var endpoints []*regional_endpoint
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		endpoint, err := parse_endpoint(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[endpoint.region] {
+			return nil, fmt.Errorf("region %s is listed twice", endpoint.region)
+		}
+		seen[endpoint.region] = true
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// parse_endpoint parses one region=http_host[|realtime_host] entry.
+func parse_endpoint(entry string) (*regional_endpoint, error) {
+	region, hosts, ok := strings.Cut(entry, "=")
+	region = strings.TrimSpace(region)
+	if !ok || region == "" {
+		return nil, fmt.Errorf("%q is not region=http_host[|realtime_host]", entry)
+	}
+	http_host, realtime_host, _ := strings.Cut(hosts, "|")
+	http_host, realtime_host = strings.TrimSpace(http_host), strings.TrimSpace(realtime_host)
+	if http_host == "" {
+		return nil, fmt.Errorf("region %s has no HTTP host", region)
+	}
+	if realtime_host == "" {
+		if !strings.Contains(http_host, appsync_api_host_label) {
+			return nil, fmt.Errorf("region %s needs a realtime host, as %s is not an appsync-api host", region, http_host)
+		}
+		realtime_host = strings.Replace(http_host, appsync_api_host_label, appsync_realtime_api_host_label, 1)
+	}
+	return &regional_endpoint{region: region, http_host: http_host, realtime_host: realtime_host}, nil
+}
+
+// regional_router keeps connections to the preferred regions' endpoints.
+type regional_router struct {
+	mu             sync.Mutex
+	endpoints      map[string]*regional_endpoint
+	retry_interval time.Duration
+	new_transport  func(endpoint *regional_endpoint) (Transport, error)
+	now            func() time.Time
+}
+
+// new_regional_router_from_config returns nil unless LIVE_LAMBDA_REGIONAL_ENDPOINTS
+// names a region other than the extension's own.
+func new_regional_router_from_config(aws_cfg aws.Config, settings Config, client_id string) *regional_router {
+	endpoints, err := parse_regional_endpoints(settings.RegionalEndpoints)
+	if err != nil || len(endpoints) == 0 {
+		return nil
+	}
+	router := &regional_router{
+		endpoints:      map[string]*regional_endpoint{},
+		retry_interval: settings.RegionRetryInterval,
+		now:            time.Now,
+		new_transport: func(endpoint *regional_endpoint) (Transport, error) {
+			regional := settings
+			regional.AppSyncHTTPHost = endpoint.http_host
+			regional.AppSyncRealtimeHost = endpoint.realtime_host
+			regional.AppSyncRegion = endpoint.region
+			return new_transport_from_config(aws_cfg, regional, client_id+"-"+endpoint.region)
+		},
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.region == settings.AppSyncRegion {
+			continue
+		}
+		router.endpoints[endpoint.region] = endpoint
+	}
+	if len(router.endpoints) == 0 {
+		return nil
+	}
+	log.Printf("%s Regional endpoints available in %s", regional_print_prefix, strings.Join(router.regions(), ", "))
+	return router
+}
+
+// regions returns the configured regions, sorted.
+func (r *regional_router) regions() []string {
+	regions := make([]string, 0, len(r.endpoints))
+	for region := range r.endpoints {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// transport_for returns region's transport when it is connected and healthy,
+// and nil otherwise.
+func (r *regional_router) transport_for(region string) Transport {
+	if r == nil || region == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoint := r.endpoints[region]
+	if endpoint == nil || endpoint.failed || endpoint.transport == nil || !endpoint.transport.IsConnected() {
+		return nil
+	}
+	return endpoint.transport
+}
+
+// mark_failed stops routing through region until the retry interval has
+// passed. It reports whether the region was healthy until now.
+func (r *regional_router) mark_failed(region string, err error) bool {
+	if r == nil || region == "" {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoint := r.endpoints[region]
+	if endpoint == nil {
+		return false
+	}
+	endpoint.unhealthy_until = r.now().Add(r.retry_interval)
+	if endpoint.failed {
+		return false
+	}
+	endpoint.failed = true
+	log.Printf("%s Region %s failed, using the primary endpoint for %s: %v", regional_print_prefix, region, r.retry_interval, err)
+	return true
+}
+
+// claim_connect returns the endpoint to connect when region is configured, not
+// connected, and not waiting out its retry interval.
+func (r *regional_router) claim_connect(region string) *regional_endpoint {
+	if r == nil || region == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoint := r.endpoints[region]
+	if endpoint == nil || endpoint.connecting || r.now().Before(endpoint.unhealthy_until) {
+		return nil
+	}
+	if endpoint.transport != nil && endpoint.transport.IsConnected() && !endpoint.failed {
+		return nil
+	}
+	endpoint.connecting = true
+	return endpoint
+}
+
+// connect connects endpoint, which claim_connect returned. It reports whether
+// the region recovered from a failure.
+func (r *regional_router) connect(ctx context.Context, endpoint *regional_endpoint) (recovered bool, err error) {
+	r.mu.Lock()
+	transport := endpoint.transport
+	r.mu.Unlock()
+	if transport == nil {
+		transport, err = r.new_transport(endpoint)
+	}
+	if err == nil && !transport.IsConnected() {
+		err = transport.Connect(ctx)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoint.connecting = false
+	if transport != nil {
+		endpoint.transport = transport
+	}
+	if err != nil {
+		endpoint.unhealthy_until = r.now().Add(r.retry_interval)
+		return false, fmt.Errorf("failed to connect to %s: %w", endpoint.realtime_host, err)
+	}
+	recovered = endpoint.failed
+	endpoint.failed = false
+	return recovered, nil
+}
+
+// close closes every regional connection.
+func (r *regional_router) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, endpoint := range r.endpoints {
+		if endpoint.transport != nil {
+			endpoint.transport.Close()
+		}
+	}
+}
+
+// report describes each region for the health report.
+func (r *regional_router) report() map[string]string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := map[string]string{}
+	for region, endpoint := range r.endpoints {
+		switch {
+		case endpoint.failed:
+			states[region] = "failed"
+		case endpoint.transport != nil && endpoint.transport.IsConnected():
+			states[region] = "connected"
+		default:
+			states[region] = "idle"
+		}
+	}
+	return states
+}
+
+// session_route returns the region and transport a new invocation should use:
+// the present agent's preferred region when it is healthy, or the primary
+// endpoint, reported as region "".
+func (p *RuntimeAPIProxy) session_route() (string, Transport) {
+	region := p.presence.preferred_region()
+	if transport := p.regions.transport_for(region); transport != nil {
+		return region, transport
+	}
+	return "", p.transport
+}
+
+// request_transport returns the transport request_id's invocation is routed over.
+func (p *RuntimeAPIProxy) request_transport(request_id string) Transport {
+	if p.requests == nil {
+		return p.transport
+	}
+	if request, ok := p.requests.lookup(request_id); ok {
+		if _, transport := request.route(); transport != nil {
+			return transport
+		}
+	}
+	return p.transport
+}
+
+// fail_over moves request from its preferred region to the primary endpoint
+// after err, subscribing there again when it had a response subscription. It
+// reports whether the request was moved.
+func (p *RuntimeAPIProxy) fail_over(ctx context.Context, request *pending_request, err error) bool {
+	region, transport := request.route()
+	if region == "" {
+		return false
+	}
+	if p.regions.mark_failed(region, err) {
+		go p.publish_region_event(region_failover_event_type, region, err)
+	}
+	request.set_route("", nil)
+	p.explain(request.request_id, "region_failover", "from %s to the primary endpoint: %v", region, err)
+	subscription := request.response_subscription()
+	if subscription == nil {
+		return true
+	}
+	if transport.IsConnected() {
+		subscription.Unsubscribe()
+	}
+	p.resume_request(ctx, request)
+	return true
+}
+
+// check_regional_endpoints connects the present agent's preferred region when
+// it is down, and moves invocations off regions whose connection dropped.
+func (p *RuntimeAPIProxy) check_regional_endpoints(ctx context.Context) {
+	if endpoint := p.regions.claim_connect(p.presence.preferred_region()); endpoint != nil {
+		recovered, err := p.regions.connect(ctx, endpoint)
+		switch {
+		case err != nil:
+			log.Printf("%s %v; retrying in %s", regional_print_prefix, err, p.regions.retry_interval)
+		case recovered:
+			log.Printf("%s Region %s is healthy again, failing back", regional_print_prefix, endpoint.region)
+			p.publish_region_event(region_failback_event_type, endpoint.region, nil)
+		default:
+			log.Printf("%s Connected to %s for agents preferring %s", regional_print_prefix, endpoint.realtime_host, endpoint.region)
+		}
+	}
+	for _, request := range p.requests.snapshot() {
+		if region, transport := request.route(); region != "" && !transport.IsConnected() {
+			p.fail_over(ctx, request, fmt.Errorf("the connection to %s dropped", region))
+		}
+	}
+}
+
+// run_regional_endpoints checks the regional endpoints every interval until ctx is done.
+func (p *RuntimeAPIProxy) run_regional_endpoints(ctx context.Context, interval time.Duration) {
+	if p.regions == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.regions.close()
+			return
+		case <-ticker.C:
+			p.check_regional_endpoints(ctx)
+		}
+	}
+}
+
+// publish_region_event reports a failover or failback on the lifecycle channel.
+func (p *RuntimeAPIProxy) publish_region_event(event_type string, region string, cause error) {
+	ctx, cancel := context.WithTimeout(p.ctx, regional_publish_timeout)
+	defer cancel()
+	data := map[string]interface{}{
+		"region":         region,
+		"primary_region": p.aws_region,
+		"retry_interval": p.regions.retry_interval.String(),
+		"agent_id":       p.presence.agent(),
+	}
+	if cause != nil {
+		data["reason"] = cause.Error()
+	}
+	_ = p.publish_lifecycle_event(ctx, event_type, data)
+}
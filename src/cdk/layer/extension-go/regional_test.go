@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+func TestParseRegionalEndpoints(t *testing.T) {
+	endpoints, err := parse_regional_endpoints("eu-west-1=abc.appsync-api.eu-west-1.amazonaws.com, ap-southeast-2=api.example.com|realtime.example.com")
+	if err != nil || len(endpoints) != 2 {
+		t.Fatalf("expected two endpoints, got %v (%v)", endpoints, err)
+	}
+	if endpoints[0].realtime_host != "abc.appsync-realtime-api.eu-west-1.amazonaws.com" || endpoints[1].realtime_host != "realtime.example.com" {
+		t.Fatalf("unexpected realtime hosts %s and %s", endpoints[0].realtime_host, endpoints[1].realtime_host)
+	}
+	for _, value := range []string{"eu-west-1", "=api.example.com", "eu-west-1=api.example.com", "eu-west-1=a.appsync-api.x,eu-west-1=b.appsync-api.x"} {
+		if _, err := parse_regional_endpoints(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+
+	settings := default_config()
+	settings.AppSyncRegion = "us-east-1"
+	settings.RegionalEndpoints = "us-east-1=a.appsync-api.us-east-1.amazonaws.com"
+	if new_regional_router_from_config(aws.Config{}, settings, "live-lambda-sandbox") != nil {
+		t.Fatal("expected no router when only the primary region is listed")
+	}
+}
+
+// regional_settings lists server as the eu-west-1 endpoint of a us-east-1
+// extension.
+func regional_settings(server *eventstest.Server) func(settings *Config) {
+	return func(settings *Config) {
+		settings.RegionalEndpoints = events_endpoint("eu-west-1", server)
+		settings.RegionRetryInterval = 30 * time.Second
+	}
+}
+
+// skewed_clock returns a clock running skew ahead of time.Now, for moving a
+// router past its retry interval while it is in use.
+func skewed_clock(skew *atomic.Int64) func() time.Time {
+	return func() time.Time { return time.Now().Add(time.Duration(skew.Load())) }
+}
+
+func TestRegionalRouterFailsBackAfterRetryInterval(t *testing.T) {
+	settings := default_config()
+	settings.AppSyncRegion = "us-east-1"
+	regional_settings(new_events_server(t))(&settings)
+	router := new_regional_router_from_config(events_aws_config(), settings, "live-lambda-sandbox")
+	t.Cleanup(router.close)
+	var skew atomic.Int64
+	router.now = skewed_clock(&skew)
+
+	if router.transport_for("eu-west-1") != nil {
+		t.Fatal("expected no transport before the region connects")
+	}
+	endpoint := router.claim_connect("eu-west-1")
+	if endpoint == nil || router.claim_connect("eu-west-1") != nil {
+		t.Fatal("expected a single claim to connect")
+	}
+	if recovered, err := router.connect(context.Background(), endpoint); err != nil || recovered {
+		t.Fatalf("unexpected connect result %v (%v)", recovered, err)
+	}
+	regional := router.transport_for("eu-west-1")
+	if regional == nil || !regional.IsConnected() || router.transport_for("us-west-2") != nil {
+		t.Fatal("expected only the connected region to be routed")
+	}
+
+	if !router.mark_failed("eu-west-1", errors.New("boom")) || router.mark_failed("eu-west-1", errors.New("boom")) {
+		t.Fatal("expected only the first failure to be reported")
+	}
+	if router.transport_for("eu-west-1") != nil || router.claim_connect("eu-west-1") != nil {
+		t.Fatal("expected the failed region to be avoided during its retry interval")
+	}
+	if state := router.report()["eu-west-1"]; state != "failed" {
+		t.Fatalf("expected the region reported as failed, got %s", state)
+	}
+
+	skew.Add(int64(31 * time.Second))
+	endpoint = router.claim_connect("eu-west-1")
+	if endpoint == nil {
+		t.Fatal("expected a retry after the interval")
+	}
+	if recovered, err := router.connect(context.Background(), endpoint); err != nil || !recovered {
+		t.Fatalf("expected the region to recover, got %v (%v)", recovered, err)
+	}
+	if router.transport_for("eu-west-1") != regional {
+		t.Fatal("expected routing through the region again")
+	}
+}
+
+// wait_for_session_route waits until new invocations are routed to region.
+func wait_for_session_route(t *testing.T, p *RuntimeAPIProxy, region string) Transport {
+	t.Helper()
+	for wait := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if routed, transport := p.session_route(); routed == region {
+			return transport
+		}
+		if time.Now().After(wait) {
+			t.Fatalf("timed out waiting for invocations to be routed to %q", region)
+		}
+	}
+}
+
+func TestPreferredRegionRoutesAndFailsOver(t *testing.T) {
+	primary, regional := new_events_server(t), new_events_server(t)
+	p := build_events_proxy(t, primary, regional_settings(regional))
+	var skew atomic.Int64
+	p.regions.now = skewed_clock(&skew)
+	connect_events_proxy(t, p, primary)
+
+	if region, transport := p.session_route(); region != "" || transport != p.transport {
+		t.Fatal("expected the primary endpoint without a preference")
+	}
+	// The regional endpoints check connects the preferred region
+	primary.Publish(p.presence_topic(), map[string]interface{}{"type": presence_heartbeat_type, "agent_id": "agent-1", "ttl_ms": 15000, "preferred_region": "eu-west-1"})
+	transport := wait_for_session_route(t, p, "eu-west-1")
+	if connections, _ := regional.Counts(); connections != 1 {
+		t.Fatalf("expected a connection to the preferred region, got %d", connections)
+	}
+
+	request, _ := p.requests.register("r1", []byte(`{}`), nil)
+	request.set_route("eu-west-1", transport)
+	subscription, err := transport.Subscribe(p.ctx, p.response_topic("r1"), func(data interface{}) { p.route_agent_response("r1", data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.set_subscription(subscription)
+	request.mark_published(time.Now())
+	if p.request_transport("r1") != transport {
+		t.Fatal("expected the request to use the regional transport")
+	}
+
+	regional.SetUnavailable("outage")
+	retransmits := wait_for_published(t, primary, p.requests_topic(), of_type(retransmit_request_type))
+	if len(retransmits) != 1 || retransmits[0]["request_id"] != "r1" {
+		t.Fatalf("expected a retransmit request on the primary, got %v", retransmits)
+	}
+	if region, _ := request.route(); region != "" || p.request_transport("r1") != p.transport {
+		t.Fatal("expected the request to move to the primary endpoint")
+	}
+	if region, _ := p.session_route(); region != "" {
+		t.Fatal("expected new invocations on the primary while the region is failed")
+	}
+	// The control, presence and response channels
+	if _, subscriptions := primary.Counts(); subscriptions != 3 {
+		t.Fatalf("expected the response channel subscribed on the primary, got %d subscriptions", subscriptions)
+	}
+	if failed_over := wait_for_lifecycle_event(t, primary, p, region_failover_event_type); failed_over["region"] != "eu-west-1" {
+		t.Fatalf("unexpected region_failover event %v", failed_over)
+	}
+
+	regional.SetUnavailable("")
+	p.check_regional_endpoints(p.ctx)
+	if region, _ := p.session_route(); region != "" {
+		t.Fatal("expected the primary until the retry interval has passed")
+	}
+	skew.Add(int64(31 * time.Second))
+	wait_for_session_route(t, p, "eu-west-1")
+	if failed_back := wait_for_lifecycle_event(t, primary, p, region_failback_event_type); failed_back["region"] != "eu-west-1" {
+		t.Fatalf("unexpected region_failback event %v", failed_back)
+	}
+}
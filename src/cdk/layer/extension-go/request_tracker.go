@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+// A sandbox normally handles one invocation at a time, but the proxy can see
+// several /next calls in parallel (e.g. a runtime polling from multiple
+// threads, or tests driving the proxy concurrently). Every intercepted
+// invocation is tracked by request ID with its own response subscription,
+// done channel and stream state, and response events are routed to the
+// matching request so concurrent invocations never see each other's frames.
+
+type pending_request struct {
+	request_id   string
+	attempt      int // how many times the sandbox has intercepted request_id; see idempotency.go
+	event        []byte
+	stream       *response_stream
+	done         chan struct{}
+	finish       sync.Once
+	mu           sync.Mutex
+	received_at  time.Time // when the runtime's /next call returned
+	published_at time.Time
+	acked_at     time.Time             // when the agent acknowledged the request; see agent_ack.go
+	sent_chunks  []protocol.Chunk      // kept for retransmission when the request was chunked
+	subscription TransportSubscription // the response subscription, replaced after a reconnect
+	wildcard     bool                  // waits on the wildcard response subscription; see response_demux.go
+	region       string                // the preferred region the request is routed through, or "" for the primary
+	transport    Transport             // nil for the primary endpoint; see regional.go
+	trace        *xray_trace           // nil unless the invocation is traced; see xray.go
+	metrics      invocation_metrics
+	state        response_state // see response_ordering.go
+	offer_open   bool           // claims are being taken; see claims.go
+	lease        string         // the agent that claimed the request, or ""
+	leased       chan struct{}  // closed when the lease is granted
+}
+
+// complete runs fn and closes done, only for the first caller.
+func (r *pending_request) complete(fn func()) {
+	r.finish.Do(func() {
+		if fn != nil {
+			fn()
+		}
+		close(r.done)
+	})
+}
+
+func (r *pending_request) mark_received(at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received_at = at
+}
+
+func (r *pending_request) mark_published(at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.published_at = at
+}
+
+func (r *pending_request) set_sent_chunks(chunks []protocol.Chunk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent_chunks = chunks
+}
+
+func (r *pending_request) set_subscription(subscription TransportSubscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscription = subscription
+}
+
+// set_route routes the request through region's transport; "" and nil is the
+// primary endpoint.
+func (r *pending_request) set_route(region string, transport Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.region = region
+	r.transport = transport
+}
+
+func (r *pending_request) route() (string, Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.region, r.transport
+}
+
+func (r *pending_request) set_xray_trace(trace *xray_trace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trace = trace
+}
+
+func (r *pending_request) xray_trace() *xray_trace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.trace
+}
+
+// response_subscription returns the current response subscription, or nil.
+func (r *pending_request) response_subscription() TransportSubscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subscription
+}
+
+// update_metrics changes the request's metrics under its lock.
+func (r *pending_request) update_metrics(fn func(m *invocation_metrics)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.metrics)
+}
+
+func (r *pending_request) invocation_metrics() invocation_metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics
+}
+
+// chunks_to_resend returns the sent chunks with the given seqs.
+func (r *pending_request) chunks_to_resend(seqs []int) []protocol.Chunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return select_chunks(r.sent_chunks, seqs)
+}
+
+// received returns when the runtime's /next call returned, or the zero time.
+func (r *pending_request) received() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received_at
+}
+
+// published returns when the request was published, or the zero time.
+func (r *pending_request) published() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.published_at
+}
+
+type request_tracker struct {
+	mu       sync.Mutex
+	requests map[string]*pending_request
+	attempts *attempt_counter
+}
+
+func new_request_tracker() *request_tracker {
+	return &request_tracker{requests: map[string]*pending_request{}, attempts: new_attempt_counter()}
+}
+
+// register starts tracking request_id. It fails if the ID is already in flight.
+func (t *request_tracker) register(request_id string, event []byte, post stream_poster) (*pending_request, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.requests[request_id]; exists {
+		return nil, fmt.Errorf("request ID %s is already in flight", request_id)
+	}
+	request := &pending_request{
+		request_id: request_id,
+		attempt:    t.attempts.next(request_id),
+		event:      event,
+		stream:     new_response_stream(post),
+		done:       make(chan struct{}),
+	}
+	t.requests[request_id] = request
+	return request, nil
+}
+
+func (t *request_tracker) lookup(request_id string) (*pending_request, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	request, ok := t.requests[request_id]
+	return request, ok
+}
+
+// remove stops tracking request_id; later events for it are dropped.
+func (t *request_tracker) remove(request_id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.requests, request_id)
+}
+
+// snapshot returns every request in flight.
+func (t *request_tracker) snapshot() []*pending_request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	requests := make([]*pending_request, 0, len(t.requests))
+	for _, request := range t.requests {
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+func (t *request_tracker) in_flight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.requests)
+}
+
+// route_agent_response handles an event from request_id's response channel.
+func (p *RuntimeAPIProxy) route_agent_response(request_id string, data_payload interface{}) {
+	request, ok := p.requests.lookup(request_id)
+	if !ok {
+		request_logger(request_id).Info("Dropping a response event for a request no longer in flight")
+		return
+	}
+
+	if frame, err := json.Marshal(data_payload); err == nil {
+		if key, stale := request.answers_other_attempt(frame); stale {
+			request_logger(request_id).Info("Dropping an event for another attempt", "idempotency_key", key, "in_flight", request.idempotency_key())
+			return
+		}
+		if retransmit, ok, err := parse_chunk_retransmit(frame); ok {
+			if err != nil {
+				request_logger(request_id).Warn("Error decoding a retransmit request", "error", err)
+				return
+			}
+			go p.resend_chunks(request, retransmit.Seqs)
+			return
+		}
+		if agent_id, ok := parse_claim(frame); ok {
+			if err := p.signatures.verify_frame(request_id, frame); err != nil {
+				request_logger(request_id).Warn("Ignoring a claim that failed verification", "agent_id", agent_id, "error", err)
+				return
+			}
+			if request.claim(agent_id) {
+				request_logger(request_id).Info("Agent claimed the request", "agent_id", agent_id)
+			}
+			return
+		}
+		if agent_id, ok := parse_ack(frame); ok {
+			if err := p.signatures.verify_frame(request_id, frame); err != nil {
+				request_logger(request_id).Warn("Ignoring an ack that failed verification", "agent_id", agent_id, "error", err)
+				return
+			}
+			p.record_ack(request, agent_id)
+			return
+		}
+		if is_lease_announcement(frame) || is_deadline_warning(frame) {
+			return
+		}
+		if control, ok := parse_response_control(frame); ok {
+			if err := p.signatures.verify_frame(request_id, frame); err != nil {
+				request_logger(request_id).Warn("Ignoring a control frame that failed verification", "type", control.Type, "error", err)
+				return
+			}
+			p.apply_response_control(request, control)
+			return
+		}
+	}
+	if state := request.response_state(); state.settled() {
+		request_logger(request_id).Info("Dropping a response event for a settled request", "state", state.String(), "idempotency_key", request.idempotency_key())
+		return
+	}
+
+	// Stream frames cannot be signed, so with signing on they are rejected below
+	if handled := p.signatures == nil && p.relay_stream_frame(request_id, data_payload, request, func() {
+		request.settle(response_responded, nil)
+	}); handled {
+		return
+	}
+
+	response_bytes, metadata, complete, err := p.decode_agent_response(request_id, data_payload)
+	var rejected rejected_response_error
+	if errors.As(err, &rejected) {
+		p.reject_response(request, rejected.cause)
+		return
+	}
+	if err != nil {
+		request_logger(request_id).Error("Error decoding the agent's response", "error", err)
+		return
+	}
+	if !complete {
+		if !request.start_receiving() {
+			p.chunks.discard(request.idempotency_key())
+		}
+		return
+	}
+
+	function_error, is_error := parse_invocation_error(response_bytes)
+	if is_error {
+		p.explain(request_id, "agent_error", "%s: %s", function_error.ErrorType, function_error.ErrorMessage)
+	}
+
+	// AppSync delivers at least once; only the first complete response is
+	// posted, and only if no cancel or decline settled the request first
+	request.settle(response_responded, func() {
+		received_at := time.Now()
+		published_at := request.published()
+		if !published_at.IsZero() {
+			p.latencies.record(latency_phase_execution, received_at.Sub(published_at))
+			p.overhead.record_tunnel(request_id, received_at.Sub(published_at))
+		}
+		if is_error {
+			request_logger(request_id).Info("Agent reported a function error", "error_type", function_error.ErrorType)
+			p.post_function_error(request_id, function_error)
+		} else if malformed := p.check_agent_response(request, response_bytes); malformed != nil {
+			p.reject_malformed_response(request, malformed)
+		} else {
+			p.post_agent_response(request_id, request.event, response_bytes)
+			p.response_cache.store(request.event, response_bytes)
+		}
+		p.recorder.record_response(request_id, response_bytes, is_error)
+		outcome := xray_outcome_responded
+		if is_error {
+			outcome = xray_outcome_error
+		}
+		p.trace_remote_execution(request, received_at, outcome, metadata.trace)
+		p.log_latency_breakdown(request, received_at, time.Now(), metadata.timing)
+		post_back := time.Since(received_at)
+		p.latencies.record(latency_phase_post_back, post_back)
+		request.update_metrics(func(m *invocation_metrics) {
+			m.post_back = post_back
+			if !published_at.IsZero() {
+				m.round_trip = received_at.Sub(published_at)
+				m.responded = true
+			}
+		})
+	})
+}
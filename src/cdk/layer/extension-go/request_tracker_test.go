@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type posted_response struct {
+	path string
+	body string
+}
+
+func start_recording_runtime_api(t *testing.T) <-chan posted_response {
+	t.Helper()
+	received := make(chan posted_response, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- posted_response{path: r.URL.Path, body: string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := aws_lambda_runtime_api
+	aws_lambda_runtime_api = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { aws_lambda_runtime_api = previous })
+	return received
+}
+
+func new_tracking_proxy() *RuntimeAPIProxy {
+	return &RuntimeAPIProxy{
+		requests:  new_request_tracker(),
+		chunks:    new_chunk_reassembler(time.Minute),
+		latencies: new_phase_latencies(0),
+	}
+}
+
+func TestRequestTrackerRejectsDuplicateIDs(t *testing.T) {
+	tracker := new_request_tracker()
+	if _, err := tracker.register("req-1", nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := tracker.register("req-1", nil, nil); err == nil {
+		t.Fatal("expected a duplicate request ID to be rejected")
+	}
+	tracker.remove("req-1")
+	if _, err := tracker.register("req-1", nil, nil); err != nil {
+		t.Fatalf("expected the ID to be reusable after remove: %v", err)
+	}
+}
+
+func TestRouteAgentResponseMultiplexesConcurrentRequests(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+
+	ids := []string{"req-a", "req-b", "req-c"}
+	pending := map[string]*pending_request{}
+	for _, id := range ids {
+		request, err := proxy.requests.register(id, []byte(`{}`), nil)
+		if err != nil {
+			t.Fatalf("register %s: %v", id, err)
+		}
+		pending[id] = request
+	}
+	if proxy.requests.in_flight() != len(ids) {
+		t.Fatalf("expected %d requests in flight, got %d", len(ids), proxy.requests.in_flight())
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			response := map[string]interface{}{"from": id}
+			// Duplicate delivery must only post once
+			proxy.route_agent_response(id, response)
+			proxy.route_agent_response(id, response)
+		}(id)
+	}
+	wg.Wait()
+
+	got := map[string]string{}
+	for range ids {
+		select {
+		case posted := <-received:
+			got[posted.path] = posted.body
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for posted responses")
+		}
+	}
+	select {
+	case extra := <-received:
+		t.Fatalf("unexpected extra post: %+v", extra)
+	default:
+	}
+
+	for _, id := range ids {
+		path := "/2018-06-01/runtime/invocation/" + id + "/response"
+		if body := got[path]; !strings.Contains(body, id) {
+			t.Fatalf("expected %s to carry its own response, got %q", path, body)
+		}
+		select {
+		case <-pending[id].done:
+		default:
+			t.Fatalf("expected %s to be done", id)
+		}
+	}
+}
+
+func TestRouteAgentResponseDropsUnknownRequests(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+
+	proxy.route_agent_response("req-gone", map[string]interface{}{"statusCode": 200})
+
+	select {
+	case posted := <-received:
+		t.Fatalf("expected no post for an untracked request, got %+v", posted)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
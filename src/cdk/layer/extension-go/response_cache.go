@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response cache
+//
+// Some functions see the same event over and over, such as an API Gateway
+// health check hammering a live-routed endpoint. With LIVE_LAMBDA_RESPONSE_CACHE_TTL
+// set, the extension keeps the developer's successful responses in memory,
+// keyed by a SHA-256 hash of the event, and answers an identical event from the
+// cache instead of round-tripping to the workstation. Top-level fields named in
+// LIVE_LAMBDA_RESPONSE_CACHE_IGNORE (default requestContext, which carries a
+// fresh request ID and timestamp on every API Gateway event) are left out of
+// the hash. The cache holds at most LIVE_LAMBDA_RESPONSE_CACHE_SIZE entries and
+// LIVE_LAMBDA_RESPONSE_CACHE_MAX_BYTES of responses, evicting the least
+// recently used first. Only invocations that would have been offered to the
+// agent are answered from it, and handler errors and streamed responses are
+// never cached.
+
+const (
+	default_response_cache_size      = 128
+	default_response_cache_max_bytes = 1024 * 1024
+	default_response_cache_ignore    = "requestContext"
+)
+
+type response_cache_entry struct {
+	key      [sha256.Size]byte
+	response []byte
+	stored   time.Time
+}
+
+type response_cache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	max_items int
+	max_bytes int
+	ignore    map[string]bool
+	bytes     int
+	order     *list.List // most recently used first
+	entries   map[[sha256.Size]byte]*list.Element
+	hits      int
+	misses    int
+	now       func() time.Time
+}
+
+func new_response_cache(ttl time.Duration, max_items int, max_bytes int, ignore string) *response_cache {
+	ignored := map[string]bool{}
+	for _, field := range strings.Split(ignore, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignored[field] = true
+		}
+	}
+	return &response_cache{
+		ttl:       ttl,
+		max_items: max_items,
+		max_bytes: max_bytes,
+		ignore:    ignored,
+		order:     list.New(),
+		entries:   map[[sha256.Size]byte]*list.Element{},
+		now:       time.Now,
+	}
+}
+
+// new_response_cache_from_config returns nil unless LIVE_LAMBDA_RESPONSE_CACHE_TTL is set.
+func new_response_cache_from_config(settings Config) *response_cache {
+	if settings.ResponseCacheTTL <= 0 {
+		return nil
+	}
+	cache := new_response_cache(settings.ResponseCacheTTL, settings.ResponseCacheSize, settings.ResponseCacheMaxBytes, settings.ResponseCacheIgnore)
+	component_logger(component_response_cache).Info("Caching responses", "max_items", cache.max_items, "ttl", cache.ttl)
+	return cache
+}
+
+// key hashes event without its ignored top-level fields. Events that are not
+// JSON objects are hashed as they are.
+func (c *response_cache) key(event []byte) [sha256.Size]byte {
+	var fields map[string]json.RawMessage
+	if len(c.ignore) == 0 || json.Unmarshal(event, &fields) != nil || fields == nil {
+		return sha256.Sum256(event)
+	}
+	for field := range c.ignore {
+		delete(fields, field)
+	}
+	// Marshal sorts the keys, so field order does not change the key
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return sha256.Sum256(event)
+	}
+	return sha256.Sum256(normalized)
+}
+
+// lookup returns the cached response for event and how long ago it was
+// stored. A nil cache never hits.
+func (c *response_cache) lookup(event []byte) ([]byte, time.Duration, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	key := c.key(event)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, 0, false
+	}
+	entry := element.Value.(*response_cache_entry)
+	age := c.now().Sub(entry.stored)
+	if age >= c.ttl {
+		c.remove(element)
+		c.misses++
+		return nil, 0, false
+	}
+	c.order.MoveToFront(element)
+	c.hits++
+	return entry.response, age, true
+}
+
+// store caches response for event, evicting the least recently used entries
+// until the cache is within its limits. Responses larger than the whole cache
+// are not stored.
+func (c *response_cache) store(event []byte, response []byte) {
+	if c == nil || len(response) > c.max_bytes {
+		return
+	}
+	key := c.key(event)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	entry := &response_cache_entry{key: key, response: append([]byte(nil), response...), stored: c.now()}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += len(entry.response)
+	for c.order.Len() > c.max_items || c.bytes > c.max_bytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops element; the caller holds c.mu.
+func (c *response_cache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*response_cache_entry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.response)
+}
+
+// flush drops every response and returns how many there were.
+func (c *response_cache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flushed := len(c.entries)
+	c.order.Init()
+	c.entries = map[[sha256.Size]byte]*list.Element{}
+	c.bytes = 0
+	return flushed
+}
+
+// stats reports the cache's size and hit counts for the status report.
+func (c *response_cache) stats() map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"entries": c.order.Len(),
+		"bytes":   c.bytes,
+		"hits":    c.hits,
+		"misses":  c.misses,
+	}
+}
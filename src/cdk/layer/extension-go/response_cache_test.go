@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func new_test_response_cache(max_items int, max_bytes int, now *time.Time) *response_cache {
+	cache := new_response_cache(time.Minute, max_items, max_bytes, default_response_cache_ignore)
+	cache.now = func() time.Time { return *now }
+	return cache
+}
+
+func TestNilResponseCacheNeverHits(t *testing.T) {
+	var cache *response_cache
+	cache.store([]byte(`{}`), []byte(`"ok"`))
+	if _, _, ok := cache.lookup([]byte(`{}`)); ok {
+		t.Fatal("expected a nil cache to miss")
+	}
+	if cache.stats() != nil {
+		t.Fatal("expected no stats from a nil cache")
+	}
+}
+
+func TestResponseCacheIgnoresRequestContext(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := new_test_response_cache(8, 1024, &now)
+	cache.store([]byte(`{"path":"/health","requestContext":{"requestId":"a"}}`), []byte(`{"statusCode":200}`))
+
+	response, _, ok := cache.lookup([]byte(`{"requestContext":{"requestId":"b"},"path":"/health"}`))
+	if !ok || string(response) != `{"statusCode":200}` {
+		t.Fatalf("expected a hit for the same event with another request context, got %q %v", response, ok)
+	}
+	if _, _, ok := cache.lookup([]byte(`{"path":"/orders","requestContext":{"requestId":"c"}}`)); ok {
+		t.Fatal("expected a different event to miss")
+	}
+	if _, _, ok := cache.lookup([]byte(`not json`)); ok {
+		t.Fatal("expected an unknown non-JSON event to miss")
+	}
+}
+
+func TestResponseCacheExpiresEntries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := new_test_response_cache(8, 1024, &now)
+	cache.store([]byte(`{"a":1}`), []byte(`"one"`))
+
+	now = now.Add(30 * time.Second)
+	if _, age, ok := cache.lookup([]byte(`{"a":1}`)); !ok || age != 30*time.Second {
+		t.Fatalf("expected a hit 30s old, got %v %v", age, ok)
+	}
+	now = now.Add(30 * time.Second)
+	if _, _, ok := cache.lookup([]byte(`{"a":1}`)); ok {
+		t.Fatal("expected the entry to expire after the TTL")
+	}
+	if stats := cache.stats(); stats["entries"] != 0 || stats["hits"] != 1 || stats["misses"] != 1 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := new_test_response_cache(2, 1024, &now)
+	cache.store([]byte(`{"a":1}`), []byte(`"one"`))
+	cache.store([]byte(`{"a":2}`), []byte(`"two"`))
+	cache.lookup([]byte(`{"a":1}`))
+	cache.store([]byte(`{"a":3}`), []byte(`"three"`))
+
+	if _, _, ok := cache.lookup([]byte(`{"a":2}`)); ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+	for _, event := range []string{`{"a":1}`, `{"a":3}`} {
+		if _, _, ok := cache.lookup([]byte(event)); !ok {
+			t.Fatalf("expected %s to be kept", event)
+		}
+	}
+}
+
+func TestResponseCacheHonorsByteLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := new_test_response_cache(8, 10, &now)
+	cache.store([]byte(`{"a":1}`), []byte(`"123456"`))
+	cache.store([]byte(`{"a":2}`), []byte(`"123456"`))
+	if _, _, ok := cache.lookup([]byte(`{"a":1}`)); ok {
+		t.Fatal("expected the older entry to be evicted past the byte limit")
+	}
+	cache.store([]byte(`{"a":3}`), []byte(`"this response is too large"`))
+	if _, _, ok := cache.lookup([]byte(`{"a":3}`)); ok {
+		t.Fatal("expected a response larger than the cache not to be stored")
+	}
+	if stats := cache.stats(); stats["bytes"] != 8 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+func TestRouteAgentResponseFillsResponseCache(t *testing.T) {
+	start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.response_cache = new_response_cache(time.Minute, 8, 1024, "")
+	proxy.requests.register("req-1", []byte(`{"path":"/health"}`), nil)
+	proxy.requests.register("req-2", []byte(`{"path":"/fail"}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"statusCode": 200})
+	proxy.route_agent_response("req-2", map[string]interface{}{"type": invocation_error_frame_type, "errorType": "Error", "errorMessage": "boom"})
+
+	if _, _, ok := proxy.response_cache.lookup([]byte(`{"path":"/health"}`)); !ok {
+		t.Fatal("expected the response to be cached")
+	}
+	if _, _, ok := proxy.response_cache.lookup([]byte(`{"path":"/fail"}`)); ok {
+		t.Fatal("expected a handler error not to be cached")
+	}
+}
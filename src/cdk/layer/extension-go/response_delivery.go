@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Response delivery
+//
+// Once the agent has answered, the response exists only in the extension, so
+// a failed post to /runtime/invocation/{id}/response would lose it. Posts to
+// the Runtime API are retried when the connection fails or Lambda answers 429
+// or 5xx: up to runtime_api_post_attempts in all, with exponential backoff
+// from runtime_api_retry_initial_backoff to runtime_api_retry_max_backoff and
+// jitter of up to half of each delay. Other statuses are final.
+//
+// When a response cannot be delivered, the extension fails the invocation
+// with LiveLambda.ResponseDeliveryFailed, so it does not hang until its
+// timeout, and publishes a delivery_failed lifecycle event so the agent can
+// tell its developer that the response they sent was not used:
+//
+//	{"type": "delivery_failed", "data": {"request_id": "...", "attempts": 4, "status": 502, "error": "..."}}
+
+const (
+	delivery_failed_error             = "LiveLambda.ResponseDeliveryFailed"
+	delivery_failed_event_type        = "delivery_failed"
+	runtime_api_post_attempts         = 4
+	runtime_api_retry_initial_backoff = 50 * time.Millisecond
+	runtime_api_retry_max_backoff     = time.Second
+	delivery_publish_timeout          = 5 * time.Second
+)
+
+// runtime_api_status_error is a post the Runtime API answered with a non-2xx status.
+type runtime_api_status_error struct {
+	status int
+	body   string
+}
+
+func (e runtime_api_status_error) Error() string {
+	return fmt.Sprintf("the Runtime API answered %d: %s", e.status, e.body)
+}
+
+// retryable reports whether a post may succeed when sent again.
+func (e runtime_api_status_error) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// post_runtime_api posts body to the Runtime API, retrying transient failures.
+// It returns the number of attempts made and the last failure.
+func (p *RuntimeAPIProxy) post_runtime_api(ctx context.Context, url string, body []byte, headers http.Header) (int, error) {
+	backoff := runtime_api_retry_initial_backoff
+	for attempt := 1; ; attempt++ {
+		err := p.post_runtime_api_once(ctx, url, body, headers)
+		if err == nil {
+			return attempt, nil
+		}
+		if status, ok := err.(runtime_api_status_error); ok && !status.retryable() {
+			return attempt, err
+		}
+		if attempt == runtime_api_post_attempts {
+			return attempt, err
+		}
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		component_logger(component_proxy).Warn("Retrying a Runtime API post", "url", url, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, runtime_api_retry_max_backoff)
+	}
+}
+
+func (p *RuntimeAPIProxy) post_runtime_api_once(ctx context.Context, url string, body []byte, headers http.Header) error {
+	resp, err := p.forward_request(ctx, "POST", url, bytes.NewReader(body), headers)
+	if err != nil {
+		return err
+	}
+	defer drain_and_close(resp)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp_body, _ := io.ReadAll(resp.Body)
+		return runtime_api_status_error{status: resp.StatusCode, body: string(resp_body)}
+	}
+	return nil
+}
+
+// response_delivery_failed fails an invocation whose response could not be
+// posted and tells the agent.
+func (p *RuntimeAPIProxy) response_delivery_failed(request_id string, attempts int, cause error) {
+	p.explain(request_id, "delivery_failed", "after %d attempts: %v", attempts, cause)
+	p.post_invocation_error(request_id, delivery_failed_error, fmt.Sprintf("live-lambda could not deliver the agent's response: %v", cause))
+
+	data := map[string]interface{}{
+		"request_id": request_id,
+		"attempts":   attempts,
+		"error":      cause.Error(),
+	}
+	if status, ok := cause.(runtime_api_status_error); ok {
+		data["status"] = status.status
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), delivery_publish_timeout)
+		defer cancel()
+		p.publish_lifecycle_event(ctx, delivery_failed_event_type, data)
+	}()
+}
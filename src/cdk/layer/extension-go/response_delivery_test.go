@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// start_flaky_runtime_api answers each post with the next status in statuses,
+// and 202 once they run out, recording every post.
+func start_flaky_runtime_api(t *testing.T, statuses ...int) func() []posted_response {
+	t.Helper()
+	var mu sync.Mutex
+	var posts []posted_response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		posts = append(posts, posted_response{path: r.URL.Path, body: string(body)})
+		status := http.StatusAccepted
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := aws_lambda_runtime_api
+	aws_lambda_runtime_api = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { aws_lambda_runtime_api = previous })
+	return func() []posted_response {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]posted_response(nil), posts...)
+	}
+}
+
+func TestPostAgentResponseRetriesTransientFailures(t *testing.T) {
+	posts := start_flaky_runtime_api(t, http.StatusBadGateway, http.StatusServiceUnavailable)
+	proxy := new_tracking_proxy()
+
+	proxy.post_agent_response("req-1", []byte(`{}`), []byte(`{"ok":true}`))
+	got := posts()
+	if len(got) != 3 {
+		t.Fatalf("expected two retries, got %d posts", len(got))
+	}
+	for _, post := range got {
+		if post.path != "/2018-06-01/runtime/invocation/req-1/response" || post.body != `{"ok":true}` {
+			t.Fatalf("expected the response to be posted again, got %s %q", post.path, post.body)
+		}
+	}
+}
+
+func TestPostAgentResponseReportsUndeliverableResponses(t *testing.T) {
+	posts := start_flaky_runtime_api(t, http.StatusRequestEntityTooLarge)
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server)
+
+	proxy.post_agent_response("req-1", []byte(`{}`), []byte(`{"ok":true}`))
+	got := posts()
+	if len(got) != 2 || got[1].path != "/2018-06-01/runtime/invocation/req-1/error" || !strings.Contains(got[1].body, delivery_failed_error) {
+		t.Fatalf("expected one response post and then an invocation error, got %+v", got)
+	}
+
+	data := wait_for_lifecycle_event(t, server, proxy, delivery_failed_event_type)
+	if data["request_id"] != "req-1" || data["attempts"] != float64(1) || data["status"] != float64(http.StatusRequestEntityTooLarge) {
+		t.Fatalf("unexpected delivery_failed event %v", data)
+	}
+}
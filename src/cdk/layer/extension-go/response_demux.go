@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// Wildcard response subscription
+//
+// By default every invocation subscribes to its own response/{request_id}
+// channel before it publishes the request, so each one pays a subscribe round
+// trip. With LIVE_LAMBDA_RESPONSE_SUBSCRIPTION=wildcard the sandbox subscribes
+// once to response/* and hands each frame to the invocation its request_id
+// names. AppSync does not say which channel a frame arrived on, so only agents
+// announcing the tagged_responses capability are answered this way: they put
+// a top-level request_id on every frame they publish on a response channel.
+// Invocations for other agents, and invocations routed through a preferred
+// region (which has its own connection), still subscribe per request. The
+// subscription also carries the frames for every other sandbox of the
+// namespace; those are dropped.
+//
+// The first invocation that can use it makes the subscription, and it is made
+// again after a reconnect. The IoT transport does not support it.
+
+const (
+	response_subscription_per_request = "per_request"
+	response_subscription_wildcard    = "wildcard"
+	response_wildcard_id              = "*"
+)
+
+// response_demux holds the wildcard response subscription.
+type response_demux struct {
+	mu         sync.Mutex
+	subscribed bool // false until made, and again after the connection drops
+}
+
+// new_response_demux_from_config returns nil unless LIVE_LAMBDA_RESPONSE_SUBSCRIPTION is wildcard.
+func new_response_demux_from_config(settings Config) *response_demux {
+	if strings.ToLower(settings.ResponseSubscription) != response_subscription_wildcard {
+		return nil
+	}
+	return &response_demux{}
+}
+
+// reset forgets the subscription, which went with the connection it was made on.
+func (d *response_demux) reset() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscribed = false
+}
+
+// uses_response_wildcard reports whether request can wait on the wildcard subscription.
+func (p *RuntimeAPIProxy) uses_response_wildcard(request *pending_request) bool {
+	if p.response_demux == nil || !p.presence.supports(capability_tagged_responses) {
+		return false
+	}
+	region, _ := request.route()
+	return region == ""
+}
+
+// subscribe_response_wildcard subscribes to every response channel on the
+// primary transport, unless it already is.
+func (p *RuntimeAPIProxy) subscribe_response_wildcard(ctx context.Context) error {
+	d := p.response_demux
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.subscribed {
+		return nil
+	}
+	topic := p.response_topic(response_wildcard_id)
+	if _, err := p.transport.Subscribe(ctx, topic, p.demux_response); err != nil {
+		return err
+	}
+	d.subscribed = true
+	component_logger(component_transport).Info("Subscribed to the wildcard response channel", "topic", topic)
+	return nil
+}
+
+// demux_response routes a frame from the wildcard subscription to the
+// invocation it names, if that invocation is waiting on the subscription.
+func (p *RuntimeAPIProxy) demux_response(data_payload interface{}) {
+	frame, err := decode_channel_payload(data_payload)
+	if err != nil {
+		return
+	}
+	var tagged struct {
+		RequestID string `json:"request_id"`
+	}
+	if json.Unmarshal(frame, &tagged) != nil || tagged.RequestID == "" {
+		return
+	}
+	// Other sandboxes' invocations, and ours on their own channel, are not ours to route here
+	request, ok := p.requests.lookup(tagged.RequestID)
+	if !ok || !request.on_wildcard() {
+		return
+	}
+	p.route_agent_response(tagged.RequestID, frame)
+}
+
+func (r *pending_request) set_wildcard() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wildcard = true
+}
+
+// on_wildcard reports whether the request waits on the wildcard subscription.
+func (r *pending_request) on_wildcard() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.wildcard
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// new_wildcard_proxy connects a proxy that waits on the wildcard response
+// subscription to server, where an agent with capabilities is heard.
+func new_wildcard_proxy(t *testing.T, server *eventstest.Server, capabilities ...string) *RuntimeAPIProxy {
+	t.Helper()
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.ResponseSubscription = response_subscription_wildcard })
+	publish_heartbeat(server, "orders", capabilities...)
+	wait_for_agent(t, proxy)
+	return proxy
+}
+
+func TestUsesResponseWildcardNeedsTaggingAgent(t *testing.T) {
+	proxy := new_wildcard_proxy(t, new_events_server(t), capability_response_envelope, capability_tagged_responses)
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	if !proxy.uses_response_wildcard(request) {
+		t.Fatal("expected a tagging agent to be answered on the wildcard subscription")
+	}
+	request.set_route("eu-west-1", &fake_transport{})
+	if proxy.uses_response_wildcard(request) {
+		t.Fatal("expected a routed request to subscribe on its own connection")
+	}
+
+	untagged := new_wildcard_proxy(t, new_events_server(t), capability_response_envelope)
+	request, _ = untagged.requests.register("req-1", []byte(`{}`), nil)
+	if untagged.uses_response_wildcard(request) {
+		t.Fatal("expected an agent without tagged_responses to be answered per request")
+	}
+	untagged.response_demux = nil
+	if untagged.uses_response_wildcard(request) {
+		t.Fatal("expected per_request mode never to use the wildcard subscription")
+	}
+}
+
+func TestSubscribeResponseWildcardOncePerConnection(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_wildcard_proxy(t, server)
+	for i := 0; i < 3; i++ {
+		if err := proxy.subscribe_response_wildcard(context.Background()); err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+	}
+	// The control and presence channels, and the wildcard
+	if _, subscriptions := server.Counts(); subscriptions != 3 {
+		t.Fatalf("expected one wildcard subscription, got %d subscriptions", subscriptions)
+	}
+	proxy.response_demux.reset()
+	if err := proxy.subscribe_response_wildcard(context.Background()); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if _, subscriptions := server.Counts(); subscriptions != 4 {
+		t.Fatalf("expected a new subscription after a reset, got %d subscriptions", subscriptions)
+	}
+}
+
+func TestDemuxResponseRoutesByRequestID(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	server := new_events_server(t)
+	proxy := new_wildcard_proxy(t, server, capability_response_envelope, capability_tagged_responses)
+	mine, _ := proxy.requests.register("req-a", []byte(`{}`), nil)
+	mine.set_wildcard()
+	// Waits on its own channel, so a copy from the wildcard subscription is not routed
+	proxy.requests.register("req-b", []byte(`{}`), nil)
+	if err := proxy.subscribe_response_wildcard(context.Background()); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	server.Publish(proxy.response_topic("req-other-sandbox"), json.RawMessage(`{"type":"response","protocol_version":2,"request_id":"req-other-sandbox","body":{"ok":false}}`))
+	server.Publish(proxy.response_topic("req-b"), json.RawMessage(`{"type":"response","protocol_version":2,"request_id":"req-b","body":{"ok":false}}`))
+	server.Publish(proxy.response_topic("req-a"), json.RawMessage(`{"ok":false}`))
+	server.Publish(proxy.response_topic("req-a"), json.RawMessage(`{"type":"response","protocol_version":2,"request_id":"req-a","body":{"ok":true}}`))
+
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-a/response" || !strings.Contains(posted.body, `"ok":true`) {
+			t.Fatalf("unexpected post %+v", posted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+	select {
+	case extra := <-received:
+		t.Fatalf("unexpected extra post: %+v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConfigValidateResponseSubscription(t *testing.T) {
+	settings, _ := load_config(lookup_from(map[string]string{
+		live_lambda_response_subscription_env: "wildcard",
+		live_lambda_transport_env:             "iot",
+		live_lambda_iot_endpoint_env:          "abc-ats.iot.eu-west-1.amazonaws.com",
+		live_lambda_iot_region_env:            "eu-west-1",
+		lrap_runtime_api_endpoint_env:         "127.0.0.1:9001",
+	}))
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), live_lambda_response_subscription_env) {
+		t.Fatalf("expected wildcard to be refused with the IoT transport, got %v", err)
+	}
+	settings.ResponseSubscription = "sometimes"
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), "per_request or wildcard") {
+		t.Fatalf("expected an unknown mode to fail, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Response ordering
+//
+// Besides the response itself, the agent can send two frames on an
+// invocation's response channel:
+//
+//	{"type": "cancel", "request_id": "...", "reason": "..."}
+//	{"type": "decline", "request_id": "..."}
+//
+// cancel fails the invocation with LiveLambda.Cancelled; decline hands it to
+// the function as if it had not been intercepted. Either can arrive while the
+// chunks of a response are still being reassembled, or in the middle of a
+// stream, so each pending request moves through a small state machine and the
+// first frame that settles it wins:
+//
+//	waiting   -> receiving  the first chunk or stream frame of the response
+//	waiting   -> responded  an inline response
+//	waiting   -> cancelled  cancel: LiveLambda.Cancelled is posted
+//	waiting   -> declined   decline: the function handles the invocation
+//	waiting   -> rejected   a response that failed signature verification: the
+//	                        fallback policy applies
+//	waiting   -> unacknowledged  no ack within the ack window: the fallback
+//	                             policy applies; see agent_ack.go
+//	receiving -> responded  the last chunk, or the end of the stream
+//	receiving -> cancelled  cancel: buffered chunks are discarded, or an open
+//	                        stream is ended with the error in its trailers
+//	receiving -> rejected   the reassembled response failed verification
+//
+// A decline while receiving is ignored, because the agent has already started
+// on its response; the response completes, or the deadline passes as usual.
+// Once settled, every later frame for the invocation is dropped, late chunks
+// and duplicate responses included, so the Runtime API never gets parts of two
+// outcomes.
+
+const (
+	cancel_frame_type    = "cancel"
+	decline_frame_type   = "decline"
+	cancelled_error_type = "LiveLambda.Cancelled"
+)
+
+type response_state int
+
+const (
+	response_waiting response_state = iota
+	response_receiving
+	response_responded
+	response_cancelled
+	response_declined
+	response_rejected
+	response_unacknowledged
+)
+
+func (s response_state) String() string {
+	switch s {
+	case response_waiting:
+		return "waiting"
+	case response_receiving:
+		return "receiving"
+	case response_responded:
+		return "responded"
+	case response_cancelled:
+		return "cancelled"
+	case response_declined:
+		return "declined"
+	case response_rejected:
+		return "rejected"
+	case response_unacknowledged:
+		return "unacknowledged"
+	}
+	return fmt.Sprintf("response_state(%d)", int(s))
+}
+
+func (s response_state) settled() bool {
+	return s >= response_responded
+}
+
+// response_control_frame is a cancel or decline frame.
+type response_control_frame struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// parse_response_control decodes a frame if it is a cancel or decline; ok is
+// false for other frames.
+func parse_response_control(frame []byte) (response_control_frame, bool) {
+	var control response_control_frame
+	if json.Unmarshal(frame, &control) != nil {
+		return response_control_frame{}, false
+	}
+	switch control.Type {
+	case cancel_frame_type, decline_frame_type:
+		return control, true
+	}
+	return response_control_frame{}, false
+}
+
+// response_state returns where the request's response stands.
+func (r *pending_request) response_state() response_state {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// start_receiving moves a waiting request to receiving. It returns false once
+// the request is settled, when the frame must be dropped.
+func (r *pending_request) start_receiving() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state.settled() {
+		return false
+	}
+	r.state = response_receiving
+	return true
+}
+
+// settle moves the request to a final state and runs fn, unless the request
+// is already settled or the transition is not allowed. It returns the state
+// the request was in and whether the transition happened.
+func (r *pending_request) settle(to response_state, fn func()) (response_state, bool) {
+	r.mu.Lock()
+	from := r.state
+	if from.settled() || (to == response_declined || to == response_unacknowledged) && from != response_waiting {
+		r.mu.Unlock()
+		return from, false
+	}
+	r.state = to
+	r.mu.Unlock()
+	r.complete(fn)
+	return from, true
+}
+
+// apply_response_control applies a cancel or decline frame for request.
+func (p *RuntimeAPIProxy) apply_response_control(request *pending_request, control response_control_frame) {
+	request_id := request.request_id
+	switch control.Type {
+	case decline_frame_type:
+		from, ok := request.settle(response_declined, nil)
+		if !ok {
+			log.Printf("%s Ignoring decline for request ID %s, which is %s", http_proxy_print_prefix, request_id, from)
+			p.explain(request_id, "decline_ignored", "the response was already %s", from)
+			return
+		}
+		log.Printf("%s Agent declined request ID %s", http_proxy_print_prefix, request_id)
+
+	case cancel_frame_type:
+		message := "the developer cancelled the invocation"
+		if control.Reason != "" {
+			message += ": " + control.Reason
+		}
+		from, ok := request.settle(response_cancelled, func() {
+			p.chunks.discard(request.idempotency_key())
+			if request.stream.abort(cancelled_error_type, message) {
+				return
+			}
+			p.post_invocation_error(request_id, cancelled_error_type, message)
+		})
+		if !ok {
+			log.Printf("%s Ignoring cancel for request ID %s, which is %s", http_proxy_print_prefix, request_id, from)
+			p.explain(request_id, "cancel_ignored", "the response was already %s", from)
+			return
+		}
+		log.Printf("%s Agent cancelled request ID %s while %s", http_proxy_print_prefix, request_id, from)
+	}
+}
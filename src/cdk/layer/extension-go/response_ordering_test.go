@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"live-lambda-extension-go/pkg/protocol"
+)
+
+func expect_posts(t *testing.T, received <-chan posted_response, count int) []posted_response {
+	t.Helper()
+	var posts []posted_response
+	for len(posts) < count {
+		select {
+		case posted := <-received:
+			posts = append(posts, posted)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for post %d", len(posts)+1)
+		}
+	}
+	select {
+	case extra := <-received:
+		t.Fatalf("unexpected extra post: %+v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return posts
+}
+
+func response_chunks(request_id string) []protocol.Chunk {
+	return split_into_chunks(request_id, []byte(`{"statusCode":200,"body":"chunked"}`), 16)
+}
+
+func TestCancelDuringReassemblyDiscardsChunks(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	chunks := response_chunks("req-1")
+
+	proxy.route_agent_response("req-1", chunks[0])
+	if state := request.response_state(); state != response_receiving {
+		t.Fatalf("expected receiving after the first chunk, got %s", state)
+	}
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "cancel", "request_id": "req-1", "reason": "stopped in the debugger"})
+	for _, chunk := range chunks[1:] {
+		proxy.route_agent_response("req-1", chunk)
+	}
+
+	posts := expect_posts(t, received, 1)
+	if !strings.HasSuffix(posts[0].path, "/req-1/error") || !strings.Contains(posts[0].body, cancelled_error_type) || !strings.Contains(posts[0].body, "stopped in the debugger") {
+		t.Fatalf("expected a cancellation error, got %+v", posts[0])
+	}
+	if state := request.response_state(); state != response_cancelled {
+		t.Fatalf("expected cancelled, got %s", state)
+	}
+	if missing := proxy.chunks.missing("req-1"); len(missing) != 0 {
+		t.Fatalf("expected the transfer to be discarded, still missing %v", missing)
+	}
+}
+
+func TestDeclineWhileWaitingSettlesWithoutPosting(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "decline", "request_id": "req-1"})
+	proxy.route_agent_response("req-1", map[string]interface{}{"statusCode": 200})
+
+	expect_posts(t, received, 0)
+	select {
+	case <-request.done:
+	default:
+		t.Fatal("expected the request to be done")
+	}
+	if state := request.response_state(); state != response_declined {
+		t.Fatalf("expected declined, got %s", state)
+	}
+}
+
+func TestDeclineWhileReceivingIsIgnored(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	chunks := response_chunks("req-1")
+
+	proxy.route_agent_response("req-1", chunks[0])
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "decline", "request_id": "req-1"})
+	for _, chunk := range chunks[1:] {
+		proxy.route_agent_response("req-1", chunk)
+	}
+
+	posts := expect_posts(t, received, 1)
+	if !strings.HasSuffix(posts[0].path, "/req-1/response") || !strings.Contains(posts[0].body, "chunked") {
+		t.Fatalf("expected the reassembled response, got %+v", posts[0])
+	}
+	if state := request.response_state(); state != response_responded {
+		t.Fatalf("expected responded, got %s", state)
+	}
+}
+
+func TestCancelAfterResponseIsIgnored(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"statusCode": 200})
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "cancel", "request_id": "req-1"})
+
+	posts := expect_posts(t, received, 1)
+	if !strings.HasSuffix(posts[0].path, "/req-1/response") {
+		t.Fatalf("expected only the response, got %+v", posts[0])
+	}
+	if state := request.response_state(); state != response_responded {
+		t.Fatalf("expected responded, got %s", state)
+	}
+}
+
+func TestCancelMidStreamEndsStreamWithError(t *testing.T) {
+	type streamed struct {
+		body    string
+		trailer http.Header
+	}
+	done := make(chan streamed, 1)
+	poster := func(content_type string, body io.Reader, trailer http.Header) error {
+		data, _ := io.ReadAll(body)
+		done <- streamed{body: string(data), trailer: trailer}
+		return nil
+	}
+	proxy := new_tracking_proxy()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), poster)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "stream_start"})
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "stream_chunk", "seq": 0, "data": "aGVsbG8="})
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "cancel", "request_id": "req-1"})
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": "stream_end", "total": 1})
+
+	select {
+	case result := <-done:
+		if result.body != "hello" || result.trailer.Get(stream_error_type_trailer) != cancelled_error_type {
+			t.Fatalf("expected the partial body with a cancellation trailer, got %q %v", result.body, result.trailer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream")
+	}
+	if state := request.response_state(); state != response_cancelled {
+		t.Fatalf("expected cancelled, got %s", state)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Response shape checks
+//
+// The developer's handler runs far from the service that invoked the
+// function, so a response that service cannot use is easy to miss: API
+// Gateway and ALB answer a response without a statusCode, or with an object
+// body, with a bare 502, and SQS, Kinesis and DynamoDB streams retry the whole
+// batch when batchItemFailures is malformed. With LIVE_LAMBDA_RESPONSE_SHAPE_CHECK
+// on (the default), the extension recognizes the event source from the event
+// and checks the agent's response against what that source expects before
+// posting it. A response that does not fit is posted as a
+// LiveLambda.MalformedResponse invocation error instead, and the agent is
+// told why, where the request went:
+//
+//	{"type": "invalid_response", "request_id": "...", "sandbox_id": "...",
+//	 "function_name": "...", "event_source": "alb", "message": "..."}
+//
+// Only the rules the source enforces are checked. Function URL and HTTP API
+// (payload format 2.0) responses are normalized as before; see
+// function_url_response.go. SNS ignores responses, and events from other
+// sources are posted unchecked, as are responses from the function itself.
+
+const (
+	event_source_api_gateway_v1 = "api_gateway_v1"
+	event_source_api_gateway_v2 = "api_gateway_v2"
+	event_source_function_url   = "function_url"
+	event_source_alb            = "alb"
+	event_source_sqs            = "sqs"
+	event_source_sns            = "sns"
+	event_source_kinesis        = "kinesis"
+	event_source_dynamodb       = "dynamodb_streams"
+
+	malformed_response_error = "LiveLambda.MalformedResponse"
+	invalid_response_type    = "invalid_response"
+)
+
+// event_source_names are the names developers know the event sources by.
+var event_source_names = map[string]string{
+	event_source_api_gateway_v1: "API Gateway (payload format 1.0)",
+	event_source_api_gateway_v2: "API Gateway HTTP API (payload format 2.0)",
+	event_source_function_url:   "Lambda function URL",
+	event_source_alb:            "Application Load Balancer",
+	event_source_sqs:            "SQS",
+	event_source_sns:            "SNS",
+	event_source_kinesis:        "Kinesis",
+	event_source_dynamodb:       "DynamoDB Streams",
+}
+
+// response_shape_error describes a response its event source cannot use.
+type response_shape_error struct {
+	source  string
+	problem string
+}
+
+func (e response_shape_error) Error() string {
+	return fmt.Sprintf("the response is not a valid %s response: %s", event_source_names[e.source], e.problem)
+}
+
+// detect_event_source names the service that sent event, or returns "" for
+// events it does not recognize.
+func detect_event_source(event []byte) string {
+	var probe struct {
+		Version        string          `json:"version"`
+		HTTPMethod     string          `json:"httpMethod"`
+		RequestContext json.RawMessage `json:"requestContext"`
+		Records        []struct {
+			EventSource    string `json:"eventSource"`
+			SNSEventSource string `json:"EventSource"`
+		} `json:"Records"`
+	}
+	if json.Unmarshal(event, &probe) != nil {
+		return ""
+	}
+	if len(probe.Records) > 0 {
+		switch {
+		case probe.Records[0].EventSource == "aws:sqs":
+			return event_source_sqs
+		case probe.Records[0].EventSource == "aws:kinesis":
+			return event_source_kinesis
+		case probe.Records[0].EventSource == "aws:dynamodb":
+			return event_source_dynamodb
+		case probe.Records[0].SNSEventSource == "aws:sns":
+			return event_source_sns
+		}
+		return ""
+	}
+	if len(probe.RequestContext) == 0 {
+		return ""
+	}
+	var request_context struct {
+		ELB        json.RawMessage `json:"elb"`
+		DomainName string          `json:"domainName"`
+	}
+	if json.Unmarshal(probe.RequestContext, &request_context) != nil {
+		return ""
+	}
+	switch {
+	case len(request_context.ELB) > 0:
+		return event_source_alb
+	case probe.Version == "2.0" && strings.Contains(request_context.DomainName, ".lambda-url."):
+		return event_source_function_url
+	case probe.Version == "2.0":
+		return event_source_api_gateway_v2
+	case probe.HTTPMethod != "":
+		return event_source_api_gateway_v1
+	}
+	return ""
+}
+
+// check_response_shape returns a response_shape_error when source cannot use
+// response.
+func check_response_shape(source string, response []byte) error {
+	var problem error
+	switch source {
+	case event_source_api_gateway_v1, event_source_alb:
+		problem = check_proxy_response(response)
+	case event_source_api_gateway_v2, event_source_function_url:
+		_, problem = normalize_function_url_response(response)
+	case event_source_sqs, event_source_kinesis, event_source_dynamodb:
+		problem = check_batch_response(response)
+	}
+	if problem != nil {
+		return response_shape_error{source: source, problem: problem.Error()}
+	}
+	return nil
+}
+
+// check_proxy_response applies the proxy integration rules API Gateway
+// payload format 1.0 and ALB share.
+func check_proxy_response(response []byte) error {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(response, &fields) != nil || fields == nil {
+		return fmt.Errorf("it must be a JSON object with a statusCode, got %s", describe_json(response))
+	}
+	raw, ok := fields["statusCode"]
+	if !ok {
+		return fmt.Errorf("statusCode is missing")
+	}
+	if !is_http_status_code(raw) {
+		return fmt.Errorf("statusCode must be an HTTP status code, got %s", describe_json(raw))
+	}
+	if raw, ok := fields["body"]; ok && !is_json_null(raw) && !is_json_string(raw) {
+		return fmt.Errorf("body must be a string, got %s; serialize it with JSON.stringify or json.dumps", describe_json(raw))
+	}
+	if raw, ok := fields["isBase64Encoded"]; ok && !is_json_null(raw) {
+		var flag bool
+		if json.Unmarshal(raw, &flag) != nil {
+			return fmt.Errorf("isBase64Encoded must be a boolean, got %s", describe_json(raw))
+		}
+	}
+	if raw, ok := fields["headers"]; ok && !is_json_null(raw) {
+		var headers map[string]json.RawMessage
+		if json.Unmarshal(raw, &headers) != nil {
+			return fmt.Errorf("headers must be an object, got %s", describe_json(raw))
+		}
+		for name, value := range headers {
+			if !is_json_scalar(value) {
+				return fmt.Errorf("header %q must be a string, got %s; put repeated headers in multiValueHeaders", name, describe_json(value))
+			}
+		}
+	}
+	if raw, ok := fields["multiValueHeaders"]; ok && !is_json_null(raw) {
+		var headers map[string][]json.RawMessage
+		if json.Unmarshal(raw, &headers) != nil {
+			return fmt.Errorf("multiValueHeaders must map header names to arrays, got %s", describe_json(raw))
+		}
+		for name, values := range headers {
+			for _, value := range values {
+				if !is_json_scalar(value) {
+					return fmt.Errorf("multiValueHeaders %q must hold strings, got %s", name, describe_json(value))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// check_batch_response checks the partial batch response of a stream or
+// queue event. Any other response means the whole batch succeeded.
+func check_batch_response(response []byte) error {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(response, &fields) != nil {
+		return nil
+	}
+	raw, ok := fields["batchItemFailures"]
+	if !ok || is_json_null(raw) {
+		return nil
+	}
+	var failures []map[string]json.RawMessage
+	if json.Unmarshal(raw, &failures) != nil {
+		return fmt.Errorf("batchItemFailures must be an array of objects, got %s", describe_json(raw))
+	}
+	for i, failure := range failures {
+		var identifier string
+		if json.Unmarshal(failure["itemIdentifier"], &identifier) != nil || identifier == "" {
+			return fmt.Errorf("batchItemFailures[%d] needs a non-empty itemIdentifier string", i)
+		}
+	}
+	return nil
+}
+
+// is_http_status_code accepts an integer or a numeric string in the 100-599 range.
+func is_http_status_code(raw json.RawMessage) bool {
+	var code int
+	if json.Unmarshal(raw, &code) != nil {
+		var code_str string
+		if json.Unmarshal(raw, &code_str) != nil {
+			return false
+		}
+		var err error
+		if code, err = strconv.Atoi(strings.TrimSpace(code_str)); err != nil {
+			return false
+		}
+	}
+	return code >= 100 && code <= 599
+}
+
+func is_json_string(raw json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(raw)
+	return len(trimmed) > 0 && trimmed[0] == '"'
+}
+
+// is_json_scalar reports whether raw is a string, number or boolean.
+func is_json_scalar(raw json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(raw)
+	return len(trimmed) > 0 && trimmed[0] != '{' && trimmed[0] != '[' && !is_json_null(trimmed)
+}
+
+// describe_json shortens a JSON value for an error message.
+func describe_json(raw []byte) string {
+	const limit = 60
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > limit {
+		return string(trimmed[:limit]) + "..."
+	}
+	return string(trimmed)
+}
+
+// check_agent_response returns the response_shape_error for an agent response
+// the request's event source cannot use, or nil when the check is off.
+func (p *RuntimeAPIProxy) check_agent_response(request *pending_request, response []byte) error {
+	if !p.config.ResponseShapeCheck {
+		return nil
+	}
+	return check_response_shape(detect_event_source(request.event), response)
+}
+
+// reject_malformed_response posts a malformed agent response as an invocation
+// error and tells the agent, in the background, what was wrong with it.
+func (p *RuntimeAPIProxy) reject_malformed_response(request *pending_request, malformed error) {
+	request_id := request.request_id
+	request_logger(request_id).Warn("The agent's response does not fit the event source", "error", malformed)
+	p.explain(request_id, "malformed_response", "%v", malformed)
+	p.post_invocation_error(request_id, malformed_response_error, malformed.Error())
+
+	var shape response_shape_error
+	if !errors.As(malformed, &shape) {
+		return
+	}
+	message := map[string]interface{}{
+		"type":          invalid_response_type,
+		"request_id":    request_id,
+		"sandbox_id":    p.sandbox_id,
+		"function_name": p.function_name,
+		"event_source":  shape.source,
+		"message":       malformed.Error(),
+	}
+	p.add_idempotency_key(message, request_id)
+	add_protocol_envelope(message)
+	p.add_function_metadata(message)
+	publish := p.agent_publisher(request_id)
+	go func() {
+		ctx, cancel := context.WithTimeout(p.ctx, cancel_publish_timeout)
+		defer cancel()
+		if err := publish(ctx, message); err != nil {
+			request_logger(request_id).Warn("Could not tell the agent why its response was rejected", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDetectEventSource(t *testing.T) {
+	cases := map[string]string{
+		`{"httpMethod":"GET","path":"/","requestContext":{"resourcePath":"/"}}`:                                     event_source_api_gateway_v1,
+		`{"version":"2.0","rawPath":"/","requestContext":{"domainName":"abc.execute-api.us-east-1.amazonaws.com"}}`: event_source_api_gateway_v2,
+		`{"version":"2.0","rawPath":"/","requestContext":{"domainName":"abc.lambda-url.us-east-1.on.aws"}}`:         event_source_function_url,
+		`{"httpMethod":"GET","path":"/","requestContext":{"elb":{"targetGroupArn":"arn"}}}`:                         event_source_alb,
+		`{"Records":[{"eventSource":"aws:sqs","body":"hi"}]}`:                                                       event_source_sqs,
+		`{"Records":[{"EventSource":"aws:sns","Sns":{}}]}`:                                                          event_source_sns,
+		`{"Records":[{"eventSource":"aws:kinesis","kinesis":{}}]}`:                                                  event_source_kinesis,
+		`{"Records":[{"eventSource":"aws:dynamodb","dynamodb":{}}]}`:                                                event_source_dynamodb,
+		`{"Records":[{"eventSource":"aws:s3"}]}`:                                                                    "",
+		`{"orderId":42}`:                                                                                            "",
+		`"plain string"`:                                                                                            "",
+	}
+	for event, want := range cases {
+		if got := detect_event_source([]byte(event)); got != want {
+			t.Errorf("detect_event_source(%s) = %q, want %q", event, got, want)
+		}
+	}
+}
+
+func TestCheckResponseShapeAcceptsValidResponses(t *testing.T) {
+	cases := []struct {
+		source   string
+		response string
+	}{
+		{event_source_api_gateway_v1, `{"statusCode":200,"headers":{"content-type":"text/plain","x-count":3},"body":"ok"}`},
+		{event_source_api_gateway_v1, `{"statusCode":"204","multiValueHeaders":{"set-cookie":["a=1","b=2"]}}`},
+		{event_source_alb, `{"statusCode":502,"statusDescription":"502 Bad Gateway","isBase64Encoded":false,"body":null}`},
+		{event_source_function_url, `{"message":"Lambda serializes this as the body"}`},
+		{event_source_sqs, `{"batchItemFailures":[{"itemIdentifier":"msg-1"}]}`},
+		{event_source_kinesis, `null`},
+		{event_source_dynamodb, `{"batchItemFailures":[]}`},
+		{event_source_sns, `"anything"`},
+		{"", `"anything"`},
+	}
+	for _, c := range cases {
+		if err := check_response_shape(c.source, []byte(c.response)); err != nil {
+			t.Errorf("expected %s to be a valid %s response: %v", c.response, c.source, err)
+		}
+	}
+}
+
+func TestCheckResponseShapeRejectsMalformedResponses(t *testing.T) {
+	cases := []struct {
+		source   string
+		response string
+		want     string
+	}{
+		{event_source_api_gateway_v1, `{"body":"ok"}`, "the response is not a valid API Gateway (payload format 1.0) response: statusCode is missing"},
+		{event_source_api_gateway_v1, `"ok"`, `the response is not a valid API Gateway (payload format 1.0) response: it must be a JSON object with a statusCode, got "ok"`},
+		{event_source_alb, `{"statusCode":200,"body":{"id":1}}`, `the response is not a valid Application Load Balancer response: body must be a string, got {"id":1}; serialize it with JSON.stringify or json.dumps`},
+		{event_source_alb, `{"statusCode":700}`, "the response is not a valid Application Load Balancer response: statusCode must be an HTTP status code, got 700"},
+		{event_source_api_gateway_v1, `{"statusCode":200,"headers":{"accept":["a","b"]}}`, `the response is not a valid API Gateway (payload format 1.0) response: header "accept" must be a string, got ["a","b"]; put repeated headers in multiValueHeaders`},
+		{event_source_api_gateway_v1, `{"statusCode":200,"isBase64Encoded":"yes"}`, `the response is not a valid API Gateway (payload format 1.0) response: isBase64Encoded must be a boolean, got "yes"`},
+		{event_source_function_url, `{"statusCode":"abc"}`, `the response is not a valid Lambda function URL response: statusCode "abc" is not a valid HTTP status code`},
+		{event_source_sqs, `{"batchItemFailures":[{"id":"msg-1"}]}`, "the response is not a valid SQS response: batchItemFailures[0] needs a non-empty itemIdentifier string"},
+		{event_source_kinesis, `{"batchItemFailures":"all"}`, `the response is not a valid Kinesis response: batchItemFailures must be an array of objects, got "all"`},
+	}
+	for _, c := range cases {
+		err := check_response_shape(c.source, []byte(c.response))
+		var shape response_shape_error
+		if !errors.As(err, &shape) || shape.source != c.source {
+			t.Errorf("expected %s to be rejected as a %s response, got %v", c.response, c.source, err)
+			continue
+		}
+		if err.Error() != c.want {
+			t.Errorf("unexpected message for %s:\n got %s\nwant %s", c.response, err, c.want)
+		}
+	}
+}
+
+func TestRouteAgentResponseRejectsMalformedResponses(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.ResponseShapeCheck = true })
+	proxy.requests.register("req-1", []byte(`{"httpMethod":"GET","requestContext":{"elb":{}}}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"body": "no status code"})
+
+	select {
+	case posted := <-received:
+		var body invocation_error
+		if err := json.Unmarshal([]byte(posted.body), &body); err != nil {
+			t.Fatalf("decode posted body: %v", err)
+		}
+		if posted.path != "/2018-06-01/runtime/invocation/req-1/error" || body.ErrorType != malformed_response_error {
+			t.Fatalf("expected a %s error, got %s %s", malformed_response_error, posted.path, posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error post")
+	}
+	message := wait_for_published(t, server, proxy.requests_topic(), of_type(invalid_response_type))[0]
+	if message["event_source"] != event_source_alb || message["idempotency_key"] != "req-1:1" {
+		t.Fatalf("unexpected invalid_response message %v", message)
+	}
+	if message["message"] != "the response is not a valid Application Load Balancer response: statusCode is missing" {
+		t.Fatalf("unexpected message %q", message["message"])
+	}
+}
+
+func TestRouteAgentResponseSkipsTheShapeCheckWhenOff(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.requests.register("req-1", []byte(`{"httpMethod":"GET","requestContext":{"elb":{}}}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"body": "no status code"})
+
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-1/response" || posted.body != `{"body":"no status code"}` {
+			t.Fatalf("expected the response to be posted as is, got %s %s", posted.path, posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response post")
+	}
+}
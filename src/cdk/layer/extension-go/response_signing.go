@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"live-lambda-extension-go/internal/signing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Response signing
+//
+// Anyone allowed to publish on the Events API could otherwise answer an
+// invocation. LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN names an SSM
+// SecureString parameter or a Secrets Manager secret shared with the
+// developer's agent, which then signs each response envelope:
+//
+//	{"type": "response", "protocol_version": 2, "body": ..., "signature": "<base64>"}
+//
+// The signature is the HMAC-SHA256, keyed with the secret, of the request ID,
+// a newline and the body as canonical JSON: object keys sorted, no
+// insignificant whitespace, no HTML escaping, numbers as float64. The body is
+// whatever the agent would otherwise publish, so error frames, payload
+// references and encrypted payloads are signed too.
+//
+// With a secret configured, invocations for agents without the signing
+// capability, or while the secret cannot be read, pass through to the
+// function. A response that is unsigned, or whose signature does not match,
+// is never posted to the Runtime API: the fallback policy applies to the
+// invocation as if the agent had not answered, immediately rather than at
+// the deadline. Streamed responses cannot be signed and are rejected the same
+// way.
+//
+// Claim, cancel and decline frames are signed too, or anyone could take an
+// invocation over or settle it. Their signature covers the whole frame but its
+// signature field, as canonical JSON:
+//
+//	{"type": "claim", "request_id": "...", "agent_id": "laptop", "signature": "<base64>"}
+//
+// Unsigned or mis-signed control frames are dropped. The scheme itself lives
+// in internal/signing, which the agent shares.
+
+const (
+	response_rejected_error = "LiveLambda.ResponseRejected"
+)
+
+// response_verifier fetches and caches the signing secret. A nil verifier
+// accepts every response.
+type response_verifier struct {
+	secret_arn string
+	fetch      func(ctx context.Context) ([]byte, error)
+
+	mu     sync.Mutex
+	secret []byte
+}
+
+// rejected_response_error is returned for a response that fails verification.
+type rejected_response_error struct {
+	cause error
+}
+
+func (e rejected_response_error) Error() string {
+	return fmt.Sprintf("rejected response: %v", e.cause)
+}
+
+// new_response_verifier_from_config returns nil unless
+// LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN is set. Validate has already checked
+// the ARN.
+func new_response_verifier_from_config(cfg aws.Config, settings Config) *response_verifier {
+	if settings.SigningSecretARN == "" {
+		return nil
+	}
+	service, region := parse_resource_arn(settings.SigningSecretARN)
+	v := &response_verifier{secret_arn: settings.SigningSecretARN}
+	switch service {
+	case "ssm":
+		v.fetch = func(ctx context.Context) ([]byte, error) {
+			return read_ssm_parameter(ctx, cfg, region, v.secret_arn)
+		}
+	default:
+		v.fetch = func(ctx context.Context) ([]byte, error) {
+			return read_signing_secret(ctx, cfg, region, v.secret_arn)
+		}
+	}
+	component_logger(component_signing).Info("Verifying response signatures", "secret_arn", settings.SigningSecretARN)
+	return v
+}
+
+// load fetches the secret on first use. A failed fetch is retried on the
+// next call.
+func (v *response_verifier) load(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.secret != nil {
+		return nil
+	}
+	secret, err := v.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if len(secret) == 0 {
+		return fmt.Errorf("%s is empty", v.secret_arn)
+	}
+	v.secret = secret
+	return nil
+}
+
+// verify checks the signature of a response envelope.
+func (v *response_verifier) verify(request_id string, frame []byte) error {
+	if v == nil {
+		return nil
+	}
+	var envelope struct {
+		Type      string          `json:"type"`
+		Body      json.RawMessage `json:"body"`
+		Signature string          `json:"signature"`
+	}
+	if json.Unmarshal(frame, &envelope) != nil || envelope.Type != response_envelope_type {
+		return rejected_response_error{fmt.Errorf("the response is not in a response envelope")}
+	}
+	if envelope.Signature == "" {
+		return rejected_response_error{fmt.Errorf("the response is not signed")}
+	}
+	return v.check(request_id, envelope.Signature, envelope.Body)
+}
+
+// verify_frame checks the signature of a claim or control frame, which covers
+// the frame without its signature field.
+func (v *response_verifier) verify_frame(request_id string, frame []byte) error {
+	if v == nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(frame, &fields) != nil {
+		return rejected_response_error{fmt.Errorf("the frame is not a JSON object")}
+	}
+	var signature string
+	if json.Unmarshal(fields["signature"], &signature) != nil || signature == "" {
+		return rejected_response_error{fmt.Errorf("the frame is not signed")}
+	}
+	delete(fields, "signature")
+	unsigned, err := json.Marshal(fields)
+	if err != nil {
+		return rejected_response_error{err}
+	}
+	return v.check(request_id, signature, unsigned)
+}
+
+// check compares a base64 signature with the HMAC of value for request_id.
+func (v *response_verifier) check(request_id string, signature string, value json.RawMessage) error {
+	v.mu.Lock()
+	secret := v.secret
+	v.mu.Unlock()
+	if secret == nil {
+		return rejected_response_error{fmt.Errorf("the signing secret has not been read")}
+	}
+	given, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return rejected_response_error{fmt.Errorf("the signature is not base64: %w", err)}
+	}
+	expected, err := sign_response(secret, request_id, value)
+	if err != nil {
+		return rejected_response_error{err}
+	}
+	if !hmac.Equal(given, expected) {
+		return rejected_response_error{fmt.Errorf("the signature does not match")}
+	}
+	return nil
+}
+
+// sign_response returns the HMAC of a response body for request_id.
+func sign_response(secret []byte, request_id string, body json.RawMessage) ([]byte, error) {
+	if len(body) == 0 {
+		body = json.RawMessage("null")
+	}
+	signature, err := signing.Sign(secret, request_id, body)
+	if err != nil {
+		return nil, fmt.Errorf("the response body is not JSON: %w", err)
+	}
+	return signature, nil
+}
+
+// reject_response applies the fallback policy to an invocation whose response
+// failed verification: it fails with LiveLambda.ResponseRejected in error
+// mode and is passed through to the function otherwise.
+func (p *RuntimeAPIProxy) reject_response(request *pending_request, cause error) {
+	request_id := request.request_id
+	logger := request_logger(request_id)
+	logger.Warn("Rejecting the response", "error", cause)
+	from, ok := request.settle(response_rejected, func() {
+		p.chunks.discard(request.idempotency_key())
+		p.mark_fallback(request_id)
+		if p.fallback.Mode == FallbackError {
+			p.post_invocation_error(request_id, response_rejected_error, fmt.Sprintf("live-lambda rejected the agent's response: %v", cause))
+		}
+	})
+	if !ok {
+		logger.Info("Ignoring the rejected response", "state", from)
+	}
+}
+
+// read_signing_secret reads a secret's SecretString.
+func read_signing_secret(ctx context.Context, cfg aws.Config, region string, secret_arn string) ([]byte, error) {
+	body, _ := json.Marshal(map[string]string{"SecretId": secret_arn})
+	response, err := send_aws_json_request(ctx, cfg, "secretsmanager", region, secrets_get_secret_value_target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the signing secret: %w", err)
+	}
+	var secret struct {
+		SecretString string
+	}
+	if err := json.Unmarshal(response, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse the signing secret: %w", err)
+	}
+	return []byte(secret.SecretString), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func new_test_verifier() *response_verifier {
+	return &response_verifier{secret_arn: "arn", secret: []byte("shared secret")}
+}
+
+func signed_envelope(t *testing.T, secret []byte, request_id string, body string) map[string]interface{} {
+	t.Helper()
+	signature, err := sign_response(secret, request_id, json.RawMessage(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"type":             response_envelope_type,
+		"protocol_version": current_protocol_version,
+		"body":             json.RawMessage(body),
+		"signature":        base64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+func signed_frame(t *testing.T, secret []byte, request_id string, frame map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	unsigned, _ := json.Marshal(frame)
+	signature, err := sign_response(secret, request_id, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := map[string]interface{}{"signature": base64.StdEncoding.EncodeToString(signature)}
+	for key, value := range frame {
+		signed[key] = value
+	}
+	return signed
+}
+
+func TestParseResourceARN(t *testing.T) {
+	for arn, expected := range map[string]string{
+		"arn:aws:ssm:us-east-1:123456789012:parameter/live-lambda/signing":             "ssm",
+		"arn:aws:secretsmanager:us-east-1:123456789012:secret:live-lambda-signing-AbC": "secretsmanager",
+		"arn:aws:kms:us-east-1:123456789012:key/abc":                                   "kms",
+		"arn:aws:kms:us-east-1:123456789012:alias/live-lambda":                         "",
+		"arn:aws:s3:::bucket": "",
+		"live-lambda/signing": "",
+	} {
+		if service, _ := parse_resource_arn(arn); service != expected {
+			t.Errorf("%s: expected %q, got %q", arn, expected, service)
+		}
+	}
+}
+
+func TestVerifyAcceptsReencodedBodies(t *testing.T) {
+	verifier := new_test_verifier()
+	envelope := signed_envelope(t, verifier.secret, "req-1", `{"statusCode": 200.0, "body": "<ok> & done"}`)
+
+	// The transport hands the extension a decoded event, which it re-encodes
+	frame, _ := json.Marshal(envelope)
+	var decoded interface{}
+	json.Unmarshal(frame, &decoded)
+	frame, _ = json.Marshal(decoded)
+	if err := verifier.verify("req-1", frame); err != nil {
+		t.Fatalf("expected the re-encoded response to verify, got %v", err)
+	}
+	if err := verifier.verify("req-2", frame); err == nil {
+		t.Fatal("expected a signature for another request to be rejected")
+	}
+}
+
+func TestRouteAgentResponseRejectsUnsignedResponses(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.signatures = new_test_verifier()
+	proxy.fallback = FallbackPolicy{Mode: FallbackError}
+	proxy.requests.register("req-1", []byte(`{}`), nil)
+	proxy.requests.register("req-2", []byte(`{}`), nil)
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"statusCode": 200, "body": "spoofed"})
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-1/error" || !strings.Contains(posted.body, response_rejected_error) {
+			t.Fatalf("expected the invocation to fail, got %s %q", posted.path, posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error")
+	}
+
+	proxy.route_agent_response("req-2", signed_envelope(t, proxy.signatures.secret, "req-2", `{"statusCode":200}`))
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-2/response" || posted.body != `{"statusCode":200}` {
+			t.Fatalf("expected the signed response to be posted, got %s %q", posted.path, posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+}
+
+func TestResponseVerifierRetriesFailedFetches(t *testing.T) {
+	attempts := 0
+	verifier := &response_verifier{secret_arn: "arn", fetch: func(ctx context.Context) ([]byte, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, context.DeadlineExceeded
+		}
+		return []byte("shared secret"), nil
+	}}
+	if err := verifier.load(context.Background()); err == nil {
+		t.Fatal("expected the first fetch to fail")
+	}
+	verifier.load(context.Background())
+	verifier.load(context.Background())
+	if attempts != 2 {
+		t.Fatalf("expected the secret to be fetched until it succeeds and then cached, got %d fetches", attempts)
+	}
+}
+
+func TestRouteAgentResponseRequiresSignedControlFrames(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	proxy.signatures = new_test_verifier()
+	request, _ := proxy.requests.register("req-1", []byte(`{}`), nil)
+	request.open_offer()
+
+	claim := map[string]interface{}{"type": claim_frame_type, "request_id": "req-1", "agent_id": "intruder"}
+	proxy.route_agent_response("req-1", claim)
+	forged := signed_frame(t, []byte("another secret"), "req-1", claim)
+	proxy.route_agent_response("req-1", forged)
+	if holder := request.lease_holder(); holder != "" {
+		t.Fatalf("expected unsigned and mis-signed claims to be ignored, %s holds the lease", holder)
+	}
+	claim["agent_id"] = "laptop"
+	proxy.route_agent_response("req-1", signed_frame(t, proxy.signatures.secret, "req-1", claim))
+	if holder := request.lease_holder(); holder != "laptop" {
+		t.Fatalf("expected the signed claim to win the lease, got %q", holder)
+	}
+
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": decline_frame_type})
+	proxy.route_agent_response("req-1", map[string]interface{}{"type": cancel_frame_type, "reason": "spoofed"})
+	if state := request.response_state(); state.settled() {
+		t.Fatalf("expected unsigned control frames to be ignored, the request is %s", state)
+	}
+	// A frame signed for another request cannot be replayed
+	proxy.route_agent_response("req-1", signed_frame(t, proxy.signatures.secret, "req-2", map[string]interface{}{"type": cancel_frame_type}))
+	if state := request.response_state(); state.settled() {
+		t.Fatalf("expected a frame signed for another request to be ignored, the request is %s", state)
+	}
+
+	proxy.route_agent_response("req-1", signed_frame(t, proxy.signatures.secret, "req-1", map[string]interface{}{"type": cancel_frame_type, "reason": "stopped"}))
+	select {
+	case posted := <-received:
+		if posted.path != "/2018-06-01/runtime/invocation/req-1/error" || !strings.Contains(posted.body, "stopped") {
+			t.Fatalf("expected the signed cancel to fail the invocation, got %s %q", posted.path, posted.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the cancellation")
+	}
+}
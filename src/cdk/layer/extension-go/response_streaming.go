@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Streaming responses
+//
+// Instead of a single response event, the agent can stream a response as a
+// sequence of frames on the response channel:
+//
+//	{"type": "stream_start", "content_type": "text/plain"}
+//	{"type": "stream_chunk", "seq": 0, "data": "<base64>"}
+//	{"type": "stream_end", "total": 1}
+//
+// stream_end may carry error_type and error_message to fail the invocation
+// mid-stream. The extension opens a POST to the Runtime API with
+// Lambda-Runtime-Function-Response-Mode: streaming on stream_start and writes
+// chunks to it in seq order as they arrive, so the response is never held in
+// memory as a whole. Chunks that arrive early are buffered until the gap before
+// them is filled; duplicates are dropped.
+
+const (
+	stream_start_frame_type        = "stream_start"
+	stream_chunk_frame_type        = "stream_chunk"
+	stream_end_frame_type          = "stream_end"
+	default_stream_content_type    = "application/octet-stream"
+	streaming_response_mode_header = "Lambda-Runtime-Function-Response-Mode"
+	stream_error_type_trailer      = "Lambda-Runtime-Function-Error-Type"
+	stream_error_body_trailer      = "Lambda-Runtime-Function-Error-Body"
+)
+
+type stream_frame struct {
+	Type         string `json:"type"`
+	ContentType  string `json:"content_type,omitempty"`
+	Seq          int    `json:"seq"`
+	Data         string `json:"data,omitempty"`
+	Total        int    `json:"total"`
+	ErrorType    string `json:"error_type,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// parse_stream_frame decodes a frame if it belongs to a streamed response; ok is false for other frames.
+func parse_stream_frame(frame []byte) (stream_frame, bool, error) {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &probe) != nil || !strings.HasPrefix(probe.Type, "stream_") {
+		return stream_frame{}, false, nil
+	}
+	switch probe.Type {
+	case stream_start_frame_type, stream_chunk_frame_type, stream_end_frame_type:
+	default:
+		return stream_frame{}, false, nil
+	}
+	var parsed stream_frame
+	if err := json.Unmarshal(frame, &parsed); err != nil {
+		return stream_frame{}, true, fmt.Errorf("malformed %s frame: %w", probe.Type, err)
+	}
+	return parsed, true, nil
+}
+
+// stream_poster sends a streamed response body to the Runtime API. Values set in
+// trailer before body reaches EOF are sent as HTTP trailers.
+type stream_poster func(content_type string, body io.Reader, trailer http.Header) error
+
+// response_stream relays one invocation's stream frames to the Runtime API.
+type response_stream struct {
+	mu       sync.Mutex
+	post     stream_poster
+	started  bool
+	finished bool
+	writer   *io.PipeWriter
+	trailer  http.Header
+	result   chan error
+	next_seq int
+	pending  map[int][]byte
+	total    int // -1 until stream_end arrives
+	err_type string
+	err_msg  string
+}
+
+func new_response_stream(post stream_poster) *response_stream {
+	return &response_stream{
+		post:    post,
+		pending: map[int][]byte{},
+		total:   -1,
+		result:  make(chan error, 1),
+	}
+}
+
+// handle applies a frame. finished is true exactly once, after the last chunk was
+// written and the Runtime API answered; err is the outcome of the POST.
+func (s *response_stream) handle(frame stream_frame) (finished bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return false, nil
+	}
+
+	switch frame.Type {
+	case stream_start_frame_type:
+		if !s.started {
+			s.start_locked(frame.ContentType)
+		}
+	case stream_chunk_frame_type:
+		if frame.Seq < s.next_seq {
+			return false, nil
+		}
+		if _, seen := s.pending[frame.Seq]; seen {
+			return false, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(frame.Data)
+		if err != nil {
+			return false, fmt.Errorf("stream chunk %d has invalid data: %w", frame.Seq, err)
+		}
+		s.pending[frame.Seq] = data
+	case stream_end_frame_type:
+		if frame.Total < 0 {
+			return false, fmt.Errorf("stream_end has invalid total %d", frame.Total)
+		}
+		s.total = frame.Total
+		s.err_type = frame.ErrorType
+		s.err_msg = frame.ErrorMessage
+	}
+
+	if !s.started {
+		return false, nil
+	}
+	if err := s.flush_locked(); err != nil {
+		s.finished = true
+		return true, err
+	}
+	if s.total < 0 || s.next_seq < s.total {
+		return false, nil
+	}
+
+	if s.err_type != "" {
+		error_body, _ := json.Marshal(map[string]string{"errorType": s.err_type, "errorMessage": s.err_msg})
+		s.trailer.Set(stream_error_type_trailer, s.err_type)
+		s.trailer.Set(stream_error_body_trailer, base64.StdEncoding.EncodeToString(error_body))
+	}
+	s.writer.Close()
+	s.finished = true
+	return true, <-s.result
+}
+
+// abort ends an open stream with error_type in its trailers and waits for the
+// Runtime API. It returns false when the stream never started, so the error
+// must be posted on its own; a stream that already finished is left alone.
+func (s *response_stream) abort(error_type string, error_message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.finished = true
+		return false
+	}
+	if s.finished {
+		return true
+	}
+	error_body, _ := json.Marshal(map[string]string{"errorType": error_type, "errorMessage": error_message})
+	s.trailer.Set(stream_error_type_trailer, error_type)
+	s.trailer.Set(stream_error_body_trailer, base64.StdEncoding.EncodeToString(error_body))
+	s.writer.Close()
+	s.finished = true
+	if err := <-s.result; err != nil {
+		log.Printf("%s Error ending the aborted stream: %v", http_proxy_print_prefix, err)
+	}
+	return true
+}
+
+func (s *response_stream) start_locked(content_type string) {
+	if content_type == "" {
+		content_type = default_stream_content_type
+	}
+	reader, writer := io.Pipe()
+	s.started = true
+	s.writer = writer
+	s.trailer = http.Header{
+		stream_error_type_trailer: nil,
+		stream_error_body_trailer: nil,
+	}
+	trailer := s.trailer
+	go func() {
+		err := s.post(content_type, reader, trailer)
+		// Unblock pending writes if the POST gave up before reading the whole body
+		reader.CloseWithError(io.ErrClosedPipe)
+		s.result <- err
+	}()
+}
+
+// flush_locked writes every buffered chunk that continues the sequence.
+func (s *response_stream) flush_locked() error {
+	for {
+		data, ok := s.pending[s.next_seq]
+		if !ok {
+			return nil
+		}
+		delete(s.pending, s.next_seq)
+		s.next_seq++
+		if _, err := s.writer.Write(data); err != nil {
+			s.writer.CloseWithError(err)
+			if post_err := <-s.result; post_err != nil {
+				return post_err
+			}
+			return fmt.Errorf("failed to write stream chunk %d: %w", s.next_seq-1, err)
+		}
+	}
+}
+
+// post_streaming_response returns a stream_poster for request_id under api_version.
+func post_streaming_response(api_version string, request_id string) stream_poster {
+	return func(content_type string, body io.Reader, trailer http.Header) error {
+		response_url := runtime_api_url(api_version, fmt.Sprintf("/runtime/invocation/%s/response", request_id))
+		req, err := http.NewRequest(http.MethodPost, response_url, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(streaming_response_mode_header, "streaming")
+		req.Header.Set("Content-Type", content_type)
+		req.TransferEncoding = []string{"chunked"}
+		req.Trailer = trailer
+
+		log.Printf("%s Streaming response for request ID %s to %s", http_proxy_print_prefix, request_id, response_url)
+		resp, err := http_client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to stream response: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			resp_body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("streamed response rejected with status %d: %s", resp.StatusCode, string(resp_body))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type streamed_request struct {
+	mode         string
+	content_type string
+	body         string
+	error_type   string
+}
+
+// start_runtime_api serves the Runtime API response endpoint and reports each request it receives.
+func start_runtime_api(t *testing.T) <-chan streamed_request {
+	t.Helper()
+	received := make(chan streamed_request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- streamed_request{
+			mode:         r.Header.Get(streaming_response_mode_header),
+			content_type: r.Header.Get("Content-Type"),
+			body:         string(body),
+			error_type:   r.Trailer.Get(stream_error_type_trailer),
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := aws_lambda_runtime_api
+	aws_lambda_runtime_api = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { aws_lambda_runtime_api = previous })
+	return received
+}
+
+func stream_chunk(seq int, data string) stream_frame {
+	return stream_frame{Type: stream_chunk_frame_type, Seq: seq, Data: base64.StdEncoding.EncodeToString([]byte(data))}
+}
+
+func TestParseStreamFrame(t *testing.T) {
+	frame, ok, err := parse_stream_frame([]byte(`{"type":"stream_chunk","seq":2,"data":"aGk="}`))
+	if err != nil || !ok || frame.Seq != 2 {
+		t.Fatalf("unexpected result: %+v %v %v", frame, ok, err)
+	}
+	if _, ok, _ := parse_stream_frame([]byte(`{"statusCode":200}`)); ok {
+		t.Fatal("plain responses are not stream frames")
+	}
+	if _, ok, _ := parse_stream_frame([]byte(`{"type":"stream_unknown"}`)); ok {
+		t.Fatal("unknown stream_ types are not stream frames")
+	}
+	if _, ok, err := parse_stream_frame([]byte(`{"type":"stream_chunk","seq":"x"}`)); !ok || err == nil {
+		t.Fatal("expected a malformed stream frame error")
+	}
+}
+
+func TestResponseStreamRelaysChunksInOrder(t *testing.T) {
+	received := start_runtime_api(t)
+	stream := new_response_stream(post_streaming_response(default_runtime_api_version, "req-1"))
+
+	frames := []stream_frame{
+		stream_chunk(1, "world"),
+		{Type: stream_start_frame_type, ContentType: "text/plain"},
+		stream_chunk(0, "hello "),
+		stream_chunk(0, "hello "),
+		{Type: stream_end_frame_type, Total: 3},
+		stream_chunk(2, "!"),
+	}
+	for i, frame := range frames {
+		finished, err := stream.handle(frame)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if finished != (i == len(frames)-1) {
+			t.Fatalf("frame %d: finished = %v", i, finished)
+		}
+	}
+	if finished, _ := stream.handle(stream_chunk(2, "!")); finished {
+		t.Fatal("late duplicates must not finish the stream again")
+	}
+
+	request := <-received
+	if request.mode != "streaming" || request.content_type != "text/plain" {
+		t.Fatalf("unexpected headers: %+v", request)
+	}
+	if request.body != "hello world!" {
+		t.Fatalf("body = %q", request.body)
+	}
+	if request.error_type != "" {
+		t.Fatalf("unexpected error trailer %q", request.error_type)
+	}
+}
+
+func TestResponseStreamReportsMidStreamErrors(t *testing.T) {
+	received := start_runtime_api(t)
+	stream := new_response_stream(post_streaming_response(default_runtime_api_version, "req-2"))
+
+	stream.handle(stream_frame{Type: stream_start_frame_type})
+	stream.handle(stream_chunk(0, "partial"))
+	finished, err := stream.handle(stream_frame{Type: stream_end_frame_type, Total: 1, ErrorType: "Handler.Crash", ErrorMessage: "boom"})
+	if !finished || err != nil {
+		t.Fatalf("finished = %v, err = %v", finished, err)
+	}
+
+	request := <-received
+	if request.content_type != default_stream_content_type || request.body != "partial" {
+		t.Fatalf("unexpected request: %+v", request)
+	}
+	if request.error_type != "Handler.Crash" {
+		t.Fatalf("error trailer = %q", request.error_type)
+	}
+}
+
+func TestResponseStreamSurfacesRejectedPosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, "invalid request ID", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	stream := new_response_stream(func(content_type string, body io.Reader, trailer http.Header) error {
+		resp, err := http.Post(server.URL, content_type, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return fmt.Errorf("status %d", resp.StatusCode)
+	})
+
+	stream.handle(stream_frame{Type: stream_start_frame_type})
+	finished, err := stream.handle(stream_frame{Type: stream_end_frame_type, Total: 0})
+	if !finished || err == nil || err.Error() != "status 400" {
+		t.Fatalf("finished = %v, err = %v", finished, err)
+	}
+}
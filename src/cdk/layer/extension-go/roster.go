@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// When the agent connects it asks every live extension of a function to report
+// in, so the developer can see how many execution environments exist and which
+// of them are busy before they start debugging. The agent publishes a
+// roster_request frame on the control channel; each extension answers with a
+// roster event on the lifecycle channel echoing the request's request_id.
+
+const roster_print_prefix = "[LiveLambdaExt:Roster]"
+
+// extension_version is set at build time with -ldflags "-X main.extension_version=...".
+var extension_version = "dev"
+
+type roster_request struct {
+	RequestID string `json:"request_id"`
+}
+
+// roster_entry describes this sandbox.
+func (p *RuntimeAPIProxy) roster_entry(request_id string, now time.Time) map[string]interface{} {
+	in_flight, max_in_flight := p.agent_capacity.snapshot()
+	enabled, reason := p.interception.enabled()
+	entry := map[string]interface{}{
+		"request_id":           request_id,
+		"function_version":     p.config.FunctionVersion,
+		"extension_version":    extension_version,
+		"claimed":              in_flight > 0,
+		"in_flight":            in_flight,
+		"max_in_flight":        max_in_flight,
+		"interception_enabled": enabled,
+		"started_at":           p.started_at.UTC().Format(time.RFC3339Nano),
+		"uptime_seconds":       int64(now.Sub(p.started_at).Seconds()),
+	}
+	if !enabled {
+		entry["disabled_reason"] = reason
+	}
+	if p.tunnel_breaker.is_tripped() {
+		entry["auto_disabled"] = true
+	}
+	return entry
+}
+
+// register_roster_handler answers roster_request frames on the lifecycle channel.
+func (p *RuntimeAPIProxy) register_roster_handler() {
+	p.control.register("roster_request", func(frame json.RawMessage) {
+		var request roster_request
+		if err := json.Unmarshal(frame, &request); err != nil {
+			log.Printf("%s Ignoring malformed roster_request frame: %v", roster_print_prefix, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+		defer cancel()
+		if err := p.publish_lifecycle_event(ctx, "roster", p.roster_entry(request.RequestID, time.Now())); err == nil {
+			log.Printf("%s Answered roster request %s", roster_print_prefix, request.RequestID)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRosterEntryReportsClaimAndInterception(t *testing.T) {
+	started := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &RuntimeAPIProxy{
+		agent_capacity: new_agent_capacity(),
+		interception:   new_interception_switch(),
+		started_at:     started,
+		config:         Config{FunctionVersion: "12"},
+	}
+
+	entry := p.roster_entry("r1", started.Add(90*time.Second))
+	if entry["request_id"] != "r1" || entry["function_version"] != "12" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+	if entry["claimed"] != false || entry["uptime_seconds"] != int64(90) {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+	if _, ok := entry["disabled_reason"]; ok {
+		t.Fatal("disabled_reason should be omitted while interception is enabled")
+	}
+
+	if !p.agent_capacity.try_acquire() {
+		t.Fatal("expected to acquire capacity")
+	}
+	p.interception.disable("paused")
+	entry = p.roster_entry("r2", started)
+	if entry["claimed"] != true || entry["in_flight"] != 1 {
+		t.Fatalf("expected a claimed sandbox: %v", entry)
+	}
+	if entry["interception_enabled"] != false || entry["disabled_reason"] != "paused" {
+		t.Fatalf("expected interception disabled: %v", entry)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Routing rules
+//
+// LIVE_LAMBDA_ROUTING_RULES targets the traffic a developer cares about with
+// ordered rules, given inline as JSON or as the ARN of an SSM parameter
+// holding it:
+//
+//	{
+//	  "default": "pass",
+//	  "rules": [
+//	    {"name": "health", "action": "pass", "match": [{"path": "rawPath", "equals": "/health"}]},
+//	    {"name": "checkout", "match": [{"path": "requestContext.http.path", "prefix": "/checkout"}]},
+//	    {"name": "tenant", "match": [{"path": "Records.0.kinesis.partitionKey", "regex": "^tenant-4[0-9]$"}]},
+//	    {"name": "debug", "match": [{"header": "X-Live-Lambda"}]}
+//	  ]
+//	}
+//
+// The first rule whose conditions all hold decides: "intercept" (the default
+// action) routes the invocation to the developer, "pass" runs it locally.
+// When no rule matches, "default" decides, and it defaults to "pass". Paths
+// and headers are looked up as for LIVE_LAMBDA_INTERCEPT_WHEN (see
+// traffic_split.go); a condition with no operator requires the value to be
+// present, and "present": false requires it to be absent. Values compare as
+// strings, with non-strings as their JSON text.
+//
+// A parameter is read on the first invocation and kept for the life of the
+// sandbox; while it cannot be read, invocations pass through to the function.
+// The rules run before the sample rate and adaptive sampling.
+
+const (
+	routing_action_intercept = "intercept"
+	routing_action_pass      = "pass"
+)
+
+// routing_condition is one entry of a rule's match list.
+type routing_condition struct {
+	Path    string  `json:"path,omitempty"`
+	Header  string  `json:"header,omitempty"`
+	Equals  *string `json:"equals,omitempty"`
+	Prefix  *string `json:"prefix,omitempty"`
+	Regex   string  `json:"regex,omitempty"`
+	Present *bool   `json:"present,omitempty"`
+
+	path    []string
+	pattern *regexp.Regexp
+}
+
+// routing_rule is one rule of LIVE_LAMBDA_ROUTING_RULES.
+type routing_rule struct {
+	Name   string              `json:"name,omitempty"`
+	Action string              `json:"action,omitempty"`
+	Match  []routing_condition `json:"match"`
+}
+
+// routing_rule_set is the parsed LIVE_LAMBDA_ROUTING_RULES document.
+type routing_rule_set struct {
+	Default string         `json:"default,omitempty"`
+	Rules   []routing_rule `json:"rules"`
+}
+
+// routing_rules evaluates the rules in handle_next. A nil routing_rules
+// intercepts every invocation.
+type routing_rules struct {
+	source string // the parameter ARN, or empty for inline rules
+	fetch  func(ctx context.Context) ([]byte, error)
+
+	mu  sync.Mutex
+	set *routing_rule_set
+}
+
+// new_routing_rules_from_config returns nil unless LIVE_LAMBDA_ROUTING_RULES
+// is set. Validate has already checked inline rules and parameter ARNs.
+func new_routing_rules_from_config(cfg aws.Config, settings Config) *routing_rules {
+	spec := strings.TrimSpace(settings.RoutingRules)
+	if spec == "" {
+		return nil
+	}
+	if !is_routing_rules_parameter(spec) {
+		set, _ := parse_routing_rules([]byte(spec))
+		return &routing_rules{set: set}
+	}
+	_, region := parse_resource_arn(spec)
+	component_logger(component_routing).Info("Reading routing rules from a parameter", "parameter", spec)
+	return &routing_rules{
+		source: spec,
+		fetch: func(ctx context.Context) ([]byte, error) {
+			return read_ssm_parameter(ctx, cfg, region, spec)
+		},
+	}
+}
+
+// is_routing_rules_parameter reports whether spec names a parameter rather
+// than holding the rules.
+func is_routing_rules_parameter(spec string) bool {
+	return strings.HasPrefix(spec, "arn:")
+}
+
+// parse_routing_rules parses and checks a rules document.
+func parse_routing_rules(document []byte) (*routing_rule_set, error) {
+	var set routing_rule_set
+	decoder := json.NewDecoder(strings.NewReader(string(document)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&set); err != nil {
+		return nil, fmt.Errorf("the routing rules are not valid JSON: %w", err)
+	}
+	if set.Default == "" {
+		set.Default = routing_action_pass
+	}
+	if set.Default != routing_action_intercept && set.Default != routing_action_pass {
+		return nil, fmt.Errorf("default must be intercept or pass, got %q", set.Default)
+	}
+	for i := range set.Rules {
+		rule := &set.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Action == "" {
+			rule.Action = routing_action_intercept
+		}
+		if rule.Action != routing_action_intercept && rule.Action != routing_action_pass {
+			return nil, fmt.Errorf("rule %s: action must be intercept or pass, got %q", rule.Name, rule.Action)
+		}
+		for j := range rule.Match {
+			if err := rule.Match[j].compile(); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+		}
+	}
+	return &set, nil
+}
+
+func (c *routing_condition) compile() error {
+	switch {
+	case (c.Path == "") == (c.Header == ""):
+		return fmt.Errorf("each condition needs exactly one of path or header")
+	case c.Path != "":
+		c.path = strings.Split(c.Path, predicate_path_joiner)
+		for _, segment := range c.path {
+			if segment == "" {
+				return fmt.Errorf("%q is not a dotted path", c.Path)
+			}
+		}
+	default:
+		c.Header = strings.ToLower(c.Header)
+	}
+	if c.Regex != "" {
+		pattern, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %w", c.Regex, err)
+		}
+		c.pattern = pattern
+	}
+	return nil
+}
+
+func (c *routing_condition) matches(event interface{}) bool {
+	var found interface{}
+	var ok bool
+	if c.Header != "" {
+		found, ok = event_header(event, c.Header)
+	} else {
+		found, ok = event_path(event, c.path)
+	}
+	ok = ok && found != nil
+	if c.Present != nil && !*c.Present {
+		return !ok
+	}
+	if !ok {
+		return false
+	}
+	value := predicate_value(found)
+	if c.Equals != nil && value != *c.Equals {
+		return false
+	}
+	if c.Prefix != nil && !strings.HasPrefix(value, *c.Prefix) {
+		return false
+	}
+	return c.pattern == nil || c.pattern.MatchString(value)
+}
+
+// load reads the rules parameter on first use. A failed read is retried on
+// the next call.
+func (r *routing_rules) load(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.set != nil {
+		return nil
+	}
+	document, err := r.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	set, err := parse_routing_rules(document)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.source, err)
+	}
+	r.set = set
+	return nil
+}
+
+// route reports whether the invocation with event is intercepted and which
+// rule, or the default, decided it. load must have succeeded.
+func (r *routing_rules) route(event []byte) (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	r.mu.Lock()
+	set := r.set
+	r.mu.Unlock()
+	decoded, err := decode_event(event)
+	if err != nil {
+		return set.Default == routing_action_intercept, "the default, since the event is not JSON"
+	}
+	for _, rule := range set.Rules {
+		matched := true
+		for i := range rule.Match {
+			if !rule.Match[i].matches(decoded) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule.Action == routing_action_intercept, "rule " + rule.Name
+		}
+	}
+	return set.Default == routing_action_intercept, "the default, since no rule matched"
+}
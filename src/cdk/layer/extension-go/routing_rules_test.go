@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const test_routing_rules = `{
+	"rules": [
+		{"name": "health", "action": "pass", "match": [{"path": "requestContext.http.path", "equals": "/checkout/health"}]},
+		{"name": "checkout", "match": [{"path": "requestContext.http.path", "prefix": "/checkout"}]},
+		{"name": "tenant", "match": [{"path": "Records.0.kinesis.partitionKey", "regex": "^tenant-4[0-9]$"}]},
+		{"name": "debug", "match": [{"header": "X-Live-Lambda"}, {"header": "X-Skip", "present": false}]}
+	]
+}`
+
+func TestRoutingRulesFirstMatchDecides(t *testing.T) {
+	settings := default_config()
+	settings.RoutingRules = test_routing_rules
+	rules := new_routing_rules_from_config(aws.Config{}, settings)
+	if err := rules.load(context.Background()); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, tc := range []struct {
+		event      string
+		intercept  bool
+		decided_by string
+	}{
+		{`{"requestContext":{"http":{"path":"/checkout/cart"}}}`, true, "rule checkout"},
+		{`{"requestContext":{"http":{"path":"/checkout/health"}}}`, false, "rule health"},
+		{`{"requestContext":{"http":{"path":"/orders"}}}`, false, "the default, since no rule matched"},
+		{`{"Records":[{"kinesis":{"partitionKey":"tenant-42"}}]}`, true, "rule tenant"},
+		{`{"Records":[{"kinesis":{"partitionKey":"tenant-52"}}]}`, false, "the default, since no rule matched"},
+		{`{"headers":{"x-live-lambda":"1"}}`, true, "rule debug"},
+		{`{"headers":{"x-live-lambda":"1","x-skip":"1"}}`, false, "the default, since no rule matched"},
+		{`not json`, false, "the default, since the event is not JSON"},
+	} {
+		intercept, decided_by := rules.route([]byte(tc.event))
+		if intercept != tc.intercept || decided_by != tc.decided_by {
+			t.Errorf("%s: got %v by %q, want %v by %q", tc.event, intercept, decided_by, tc.intercept, tc.decided_by)
+		}
+	}
+
+	var off *routing_rules
+	if intercept, _ := off.route([]byte(`{}`)); !intercept {
+		t.Fatal("expected no rules to intercept everything")
+	}
+}
+
+func TestRoutingRulesFromParameter(t *testing.T) {
+	fetches := 0
+	rules := &routing_rules{source: "arn:aws:ssm:eu-west-1:123456789012:parameter/rules", fetch: func(ctx context.Context) ([]byte, error) {
+		fetches++
+		if fetches == 1 {
+			return nil, errors.New("throttled")
+		}
+		return []byte(`{"default": "intercept", "rules": []}`), nil
+	}}
+	if err := rules.load(context.Background()); err == nil {
+		t.Fatal("expected the first read to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := rules.load(context.Background()); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("expected the parameter to be read until it succeeds, got %d reads", fetches)
+	}
+	if intercept, decided_by := rules.route([]byte(`{}`)); !intercept || !strings.Contains(decided_by, "default") {
+		t.Fatalf("expected the default to intercept, got %v by %q", intercept, decided_by)
+	}
+}
+
+func TestConfigValidateRoutingRules(t *testing.T) {
+	for value, want := range map[string]string{
+		`{"rules": [{"match": [{"path": "a", "header": "b"}]}]}`: "exactly one of path or header",
+		`{"rules": [{"action": "maybe", "match": []}]}`:          "intercept or pass",
+		`{"rules": [{"match": [{"path": "a", "regex": "("}]}]}`:  "invalid regex",
+		`{"rule": []}`: "not valid JSON",
+		"arn:aws:secretsmanager:eu-west-1:123456789012:secret:rules": "SSM parameter ARN",
+	} {
+		settings, err := load_config(lookup_from(map[string]string{
+			live_lambda_routing_rules_env: value,
+			lrap_runtime_api_endpoint_env: "127.0.0.1:9001",
+		}))
+		if err == nil {
+			err = settings.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", value, want, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Runtime API client
+//
+// Every invocation crosses the hop to the Runtime API at least twice: the
+// /next long poll and the response or error post. Both run over one tuned
+// transport so the connections to 127.0.0.1 stay open between invocations:
+// LIVE_LAMBDA_RUNTIME_API_MAX_IDLE_CONNS (default 8) are kept per host, bodies
+// are never gzipped, and the proxy environment variables are ignored.
+//
+// The long polls (/next and /restore/next) and streamed responses have no
+// timeout, since they last as long as the function waits or streams. Posts
+// give up after LIVE_LAMBDA_RUNTIME_API_POST_TIMEOUT (default 10s, off for no
+// timeout), so a stuck post does not hold the response goroutine forever.
+
+const (
+	default_runtime_api_max_idle_conns = 8
+	default_runtime_api_post_timeout   = 10 * time.Second
+	runtime_api_idle_conn_timeout      = 90 * time.Second
+	runtime_api_dial_timeout           = 2 * time.Second
+)
+
+// new_runtime_api_transport returns the transport shared by the Runtime API clients.
+func new_runtime_api_transport(max_idle_conns int) *http.Transport {
+	return &http.Transport{
+		Proxy:               nil,
+		DialContext:         (&net.Dialer{Timeout: runtime_api_dial_timeout, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        max_idle_conns,
+		MaxIdleConnsPerHost: max_idle_conns,
+		IdleConnTimeout:     runtime_api_idle_conn_timeout,
+		DisableCompression:  true,
+	}
+}
+
+// new_runtime_api_clients returns the client for long polls and streams and
+// the client for posts.
+func new_runtime_api_clients(settings Config) (*http.Client, *http.Client) {
+	transport := new_runtime_api_transport(settings.RuntimeAPIMaxIdleConns)
+	return &http.Client{Transport: transport}, &http.Client{Transport: transport, Timeout: settings.RuntimeAPIPostTimeout}
+}
+
+// runtime_api_client picks the client for a request to the Runtime API. Only
+// the long polls are GETs.
+func runtime_api_client(method string) *http.Client {
+	if method == http.MethodGet {
+		return http_client
+	}
+	return runtime_api_post_client
+}
+
+// drain_and_close reads what is left of a Runtime API response so its
+// connection can be reused.
+func drain_and_close(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRuntimeAPIClientsShareATunedTransport(t *testing.T) {
+	settings := default_config()
+	settings.RuntimeAPIPostTimeout = 3 * time.Second
+	long_poll, post := new_runtime_api_clients(settings)
+	if long_poll.Timeout != 0 || post.Timeout != 3*time.Second {
+		t.Fatalf("expected only posts to time out, got %v and %v", long_poll.Timeout, post.Timeout)
+	}
+	transport, ok := long_poll.Transport.(*http.Transport)
+	if !ok || post.Transport != long_poll.Transport {
+		t.Fatal("expected both clients to share one transport")
+	}
+	if transport.MaxIdleConnsPerHost != default_runtime_api_max_idle_conns || !transport.DisableCompression || transport.Proxy != nil {
+		t.Fatalf("unexpected transport %+v", transport)
+	}
+}
+
+func TestPostAgentResponseReusesTheConnection(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	previous := aws_lambda_runtime_api
+	aws_lambda_runtime_api = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() { aws_lambda_runtime_api = previous })
+
+	proxy := new_tracking_proxy()
+	for _, request_id := range []string{"req-1", "req-2", "req-3"} {
+		proxy.requests.register(request_id, []byte(`{}`), nil)
+		proxy.route_agent_response(request_id, map[string]interface{}{"statusCode": 200})
+	}
+	if got := atomic.LoadInt32(&connections); got != 1 {
+		t.Fatalf("expected the posts to share one connection, got %d", got)
+	}
+}
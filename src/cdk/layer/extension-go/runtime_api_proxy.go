@@ -9,37 +9,37 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"live-lambda-extension-go/pkg/protocol"
+
 	"github.com/go-chi/chi/v5"
 )
 
-const (
-	http_proxy_print_prefix = "[Runtime API Proxy]"
-	maxLambdaTimeout        = 15 * time.Minute // 15 minutes in Go's time.Duration
-	safetyBuffer            = 30 * time.Second // Buffer for cleanup and processing
-	websocketTimeout        = maxLambdaTimeout - safetyBuffer
-)
+const http_proxy_print_prefix = "[Runtime API Proxy]"
 
 var (
 	aws_lambda_runtime_api string
-	http_client            = &http.Client{}
-	// AppSyncProxyHelper and SetAppSyncHelper are removed as RuntimeAPIProxy methods now handle AppSync directly.
+	// Replaced by new_proxy_server with clients built from the proxy's config
+	http_client, runtime_api_post_client = new_runtime_api_clients(default_config())
 )
 
 func (p *RuntimeAPIProxy) handle_next(w http.ResponseWriter, r *http.Request) {
-	log.Println(http_proxy_print_prefix, "GET /next")
+	component_logger(component_proxy).Debug("GET /next")
 
 	// 1. Forward the request to the Lambda Runtime API
-	url := fmt.Sprintf("http://%s/2018-06-01/runtime/invocation/next", aws_lambda_runtime_api)
-	resp, err := p.forward_request("GET", url, r.Body, r.Header)
+	api_version := p.api_versions.observe(r)
+	url := runtime_api_url(api_version, "/runtime/invocation/next")
+	// The sandbox is idle, and may be frozen, until the Runtime API answers
+	idle_since := time.Now()
+	// Tied to the function's request, so a runtime that goes away, as Lambda's
+	// does before SHUTDOWN, does not leave the forward blocked on the Runtime API
+	resp, err := p.forward_request(r.Context(), "GET", url, r.Body, r.Header)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error forwarding /next request: %v", err), http.StatusInternalServerError)
 		return
@@ -55,239 +55,537 @@ func (p *RuntimeAPIProxy) handle_next(w http.ResponseWriter, r *http.Request) {
 
 	// 3. Get the request ID from the headers
 	request_id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+	logger := request_logger(request_id)
 	if request_id == "" {
-		log.Printf("%s Warning: No request ID found in headers", http_proxy_print_prefix)
+		logger.Warn("No request ID found in headers")
 	}
 
-	// 4. Check if we should use AppSync
-	if p.appsync_ws_client != nil && p.appsync_ws_client.IsConnected() && request_id != "" {
-		// Create a context with our timeout
-		ctx, cancel := context.WithTimeout(r.Context(), websocketTimeout)
+	// 4. Run the interceptors, which see every event whether or not it is intercepted
+	received_at := time.Now()
+	invocation := &Invocation{
+		RequestID: request_id,
+		Event:     body_bytes,
+		Headers:   resp.Header.Clone(),
+		Deadline:  invocation_deadline(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 0, received_at),
+	}
+	p.interceptors.on_event(r.Context(), invocation)
+	body_bytes, headers := invocation.Event, invocation.Headers
+
+	// 5. Check if we should use AppSync, respecting presence, sampling and the capacity the agent advertised
+	deadline := invocation_deadline(headers.Get("Lambda-Runtime-Deadline-Ms"), p.config.DeadlineMargin, time.Now())
+	p.explain(request_id, "received", "deadline %s", deadline.UTC().Format(time.RFC3339Nano))
+	if request_id != "" {
+		idle_ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		p.refresh_dynamic_config(idle_ctx, request_id)
+		p.check_connection(idle_ctx, request_id)
+		p.after_idle(idle_ctx, request_id, time.Since(idle_since))
+		cancel()
+	}
+	use_appsync := p.transport != nil && p.transport.IsConnected() && request_id != ""
+	if !use_appsync {
+		p.explain(request_id, "not_intercepted", "the transport is not connected")
+	} else {
+		p.publish_env_channel()
+	}
+	if use_appsync && !deadline.After(time.Now()) {
+		logger.Info("Too close to its deadline, passing through to the function")
+		p.explain(request_id, "not_intercepted", "too close to the deadline")
+		use_appsync = false
+	}
+	if use_appsync {
+		p.wait_for_function_tags(r.Context())
+	}
+	if enabled, reason := p.interception.enabled(); use_appsync && !enabled {
+		logger.Info("Interception disabled, passing through to the function", "reason", reason)
+		p.explain(request_id, "not_intercepted", "interception disabled: %s", reason)
+		use_appsync = false
+	}
+	if use_appsync && p.shed_invocation(request_id) {
+		use_appsync = false
+	}
+	if use_appsync && !p.presence.present() {
+		logger.Info("No developer present, passing through to the function")
+		p.explain(request_id, "not_intercepted", "no agent heartbeat within the presence TTL")
+		go p.probe_presence()
+		use_appsync = false
+	}
+	if err := p.presence.compatible(); use_appsync && err != nil {
+		logger.Warn("Agent is incompatible, passing through to the function", "error", err)
+		p.explain(request_id, "not_intercepted", "incompatible agent: %v", err)
+		use_appsync = false
+	}
+	binary_event := is_binary_event(body_bytes)
+	if use_appsync && binary_event && !p.presence.supports(capability_binary) {
+		logger.Info("The event is not JSON and the agent does not support binary payloads, passing through to the function")
+		p.explain(request_id, "not_intercepted", "the event is not JSON and the agent does not support binary payloads")
+		use_appsync = false
+	}
+	// With payload encryption on, an event the agent cannot decrypt is never published
+	var encryption_key *data_key
+	if use_appsync && p.encryptor != nil {
+		if !p.presence.supports(capability_encryption) {
+			logger.Info("Payload encryption is on and the agent does not support it, passing through to the function")
+			p.explain(request_id, "not_intercepted", "payload encryption is on and the agent does not support it")
+			use_appsync = false
+		} else if encryption_key, err = p.encryptor.data_key(r.Context()); err != nil {
+			logger.Warn("The payload key is unavailable, passing through to the function", "error", err)
+			p.explain(request_id, "not_intercepted", "the payload key is unavailable: %v", err)
+			use_appsync = false
+		}
+	}
+	// With response signing on, only an agent that signs its responses can answer
+	if use_appsync && p.signatures != nil {
+		if !p.presence.supports(capability_signing) {
+			logger.Info("Response signing is on and the agent does not sign its responses, passing through to the function")
+			p.explain(request_id, "not_intercepted", "response signing is on and the agent does not support it")
+			use_appsync = false
+		} else if err := p.signatures.load(r.Context()); err != nil {
+			logger.Warn("The signing secret is unavailable, passing through to the function", "error", err)
+			p.explain(request_id, "not_intercepted", "the signing secret is unavailable: %v", err)
+			use_appsync = false
+		}
+	}
+	if rules := p.routing_rules.Load(); use_appsync && rules != nil {
+		if err := rules.load(r.Context()); err != nil {
+			logger.Warn("The routing rules are unavailable, passing through to the function", "error", err)
+			p.explain(request_id, "not_intercepted", "the routing rules are unavailable: %v", err)
+			use_appsync = false
+		} else if intercepted, decided_by := rules.route(body_bytes); !intercepted {
+			logger.Info("Routed to the function by the routing rules", "decided_by", decided_by)
+			p.explain(request_id, "not_intercepted", "passed through by %s", decided_by)
+			use_appsync = false
+		}
+	}
+	if use_appsync {
+		if admitted, reason := p.traffic_split.Load().admit(body_bytes); !admitted {
+			logger.Info("Not selected for interception, passing through to the function", "reason", reason)
+			p.explain(request_id, "not_intercepted", "%s", reason)
+			use_appsync = false
+		}
+	}
+	if use_appsync {
+		sampled, change := p.sampler.admit()
+		if change != nil {
+			go p.announce_sampling_change(change)
+		}
+		if !sampled {
+			logger.Info("Not sampled, passing through to the function", "rate", p.sampler.current_rate())
+			p.explain(request_id, "not_intercepted", "not sampled at rate %.3f", p.sampler.current_rate())
+			use_appsync = false
+		}
+	}
+	if use_appsync {
+		if cached, age, ok := p.response_cache.lookup(body_bytes); ok {
+			logger.Info("Answering from the response cache", "age", age)
+			p.explain(request_id, "cached", "response stored %s ago", age.Round(time.Millisecond))
+			p.post_agent_response(request_id, body_bytes, cached)
+			return
+		}
+	}
+	if use_appsync {
+		if p.agent_capacity.try_acquire() {
+			defer p.agent_capacity.release()
+		} else {
+			logger.Info("Agent at capacity, passing through to the function")
+			p.explain(request_id, "not_intercepted", "the agent is at capacity")
+			use_appsync = false
+		}
+	}
+	var pending *pending_request
+	var local_metadata map[string]json.RawMessage
+	if use_appsync {
+		pending, err = p.requests.register(request_id, body_bytes, post_streaming_response(api_version, request_id))
+		if err != nil {
+			logger.Warn("Passing through to the function", "error", err)
+			p.explain(request_id, "not_intercepted", "%v", err)
+			use_appsync = false
+		} else {
+			pending.mark_received(received_at)
+			defer p.requests.remove(request_id)
+			defer func() { p.metrics.record_invocation(request_id, pending.invocation_metrics()) }()
+			// Registered first, so a pass-through requested from here on declines pending
+			if pass_through, metadata := p.local_api.claim(request_id); pass_through {
+				logger.Info("Pass-through requested over the local API")
+				p.explain(request_id, "not_intercepted", "pass-through requested over the local API")
+				use_appsync = false
+			} else {
+				local_metadata = metadata
+			}
+		}
+	}
+	if use_appsync {
+		if agent := p.presence.agent(); agent != "" {
+			p.explain(request_id, "intercepted", "for agent %s", agent)
+		} else {
+			p.explain(request_id, "intercepted", "")
+		}
+		// Stop waiting for the agent just before the invocation times out
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
 		defer cancel()
 
-		// Create a channel to signal when we're done
-		done := make(chan struct{})
-		response_topic := fmt.Sprintf("live-lambda/response/%s", request_id)
-		sub_id := fmt.Sprintf("sub-%s", request_id)
-		
-		// Cleanup function
-		cleanup := func() {
-			if p.appsync_ws_client != nil && p.appsync_ws_client.IsConnected() {
-				// Use a separate context with a short timeout for cleanup
-				_, cleanupCancel := context.WithTimeout(context.Background(), 5*time.Second) // cleanupCtx assigned to _ as it's not used after Unsubscribe was commented out
-				defer cleanupCancel()
-				// p.appsync_ws_client.Unsubscribe(cleanupCtx, sub_id, response_topic) // Commented out due to build error: Unsubscribe undefined (type *appsyncwsclient.Client has no field or method Unsubscribe)
-				// Subscription cleanup will rely on the cancellation of the context passed to the Subscribe call (appsyncOpCtx).
-				log.Printf("%s AppSync Unsubscribe call commented out. Cleanup for sub_id %s on topic %s relies on context cancellation.", http_proxy_print_prefix, sub_id, response_topic)
-			}
+		claim_started := time.Now()
+		response_topic := p.response_topic(request_id)
+
+		// Use the agent's preferred region for this invocation while it is healthy
+		if region, transport := p.session_route(); region != "" {
+			pending.set_route(region, transport)
+			p.explain(request_id, "routed", "through the %s endpoint", region)
 		}
-		defer cleanup()
-
-		// 5. Subscribe to the response topic
-		subConfirmation, err := p.appsync_ws_client.Subscribe(
-			ctx,
-			response_topic, // Use response_topic as the identifier
-			// This function will be called when a message is received
-			func(data_payload interface{}) {
-				log.Printf("%s Received message on topic %s", http_proxy_print_prefix, response_topic)
-				
-				// Convert the response to bytes
-				response_bytes, err := json.Marshal(data_payload)
-				if err != nil {
-					log.Printf("%s Error marshaling WebSocket response: %v", http_proxy_print_prefix, err)
-					close(done)
-					return
-				}
 
-				// Log the raw response for debugging
-				log.Printf("%s Raw WebSocket response: %s", http_proxy_print_prefix, string(response_bytes))
-
-				// Create a reader for the response body
-				body_reader := bytes.NewReader(response_bytes)
-				
-				// Post the response back to the Runtime API
-				response_url := fmt.Sprintf("http://%s/2018-06-01/runtime/invocation/%s/response", 
-					aws_lambda_runtime_api, request_id)
-				
-				log.Printf("%s Posting response back to Lambda Runtime API: %s", 
-					http_proxy_print_prefix, response_url)
-				
-				// Use forward_request to post the response
-				resp, err := p.forward_request("POST", response_url, body_reader, nil)
-				if err != nil {
-					log.Printf("%s Error posting response to Lambda Runtime API: %v", 
-						http_proxy_print_prefix, err)
-					close(done)
-					return
-				}
-				defer resp.Body.Close()
-				
-				// Log the response status
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					log.Printf("%s Successfully posted response for request ID %s", 
-						http_proxy_print_prefix, request_id)
-				} else {
-					body, _ := io.ReadAll(resp.Body)
-					log.Printf("%s Error response from Lambda Runtime API: %d - %s", 
-						http_proxy_print_prefix, resp.StatusCode, string(body))
+		// With an agent that tags its frames, wait on the sandbox's wildcard
+		// subscription instead of subscribing per invocation
+		wildcard := p.uses_response_wildcard(pending)
+		if wildcard {
+			response_topic = p.response_topic(response_wildcard_id)
+			pending.set_wildcard()
+		}
+
+		// 6. Subscribe to the response topic, and drop the subscription once the
+		// invocation is done. A reconnect may replace it while we wait.
+		var subConfirmation TransportSubscription
+		defer func() {
+			if subscription := pending.response_subscription(); subscription != nil && p.request_transport(request_id).IsConnected() {
+				if err := subscription.Unsubscribe(); err != nil {
+					logger.Warn("Failed to unsubscribe", "topic", response_topic, "error", err)
 				}
-				
-				// Signal that we're done
-				close(done)
-			},
-		)
-		
+			}
+		}()
+		err := p.fallback.attempt(ctx, func(ctx context.Context) error {
+			if wildcard {
+				return p.subscribe_response_wildcard(ctx)
+			}
+			subscribe := func() (TransportSubscription, error) {
+				return p.request_transport(request_id).Subscribe(
+					ctx,
+					response_topic, // Use response_topic as the identifier
+					// This function will be called when a message is received
+					func(data_payload interface{}) {
+						logger.Debug("Received message", "topic", response_topic)
+						p.route_agent_response(request_id, data_payload)
+					},
+				)
+			}
+			confirmation, err := subscribe()
+			if err != nil && p.fail_over(ctx, pending, err) {
+				confirmation, err = subscribe()
+			}
+			subConfirmation = confirmation
+			if err == nil {
+				pending.set_subscription(confirmation)
+			}
+			return err
+		})
+
 		if err != nil {
-			log.Printf("%s Error subscribing to topic %s: %v", http_proxy_print_prefix, response_topic, err)
-			// Continue to normal processing if subscription fails
+			logger.Error("Error subscribing", "topic", response_topic, "error", err)
+			p.explain(request_id, "subscribe_failed", "%s: %v", response_topic, err)
+			// Fail the invocation or continue to normal processing, per the fallback policy
+			if p.fall_back(request_id, fmt.Errorf("failed to subscribe to %s: %w", response_topic, err)) {
+				return
+			}
 		} else {
-			log.Printf("%s Successfully subscribed to topic %s. Confirmation: %v", http_proxy_print_prefix, response_topic, subConfirmation)
-			// 6. Publish the request to AppSync
-			publish_topic := "live-lambda/requests"
+			logger.Debug("Subscribed", "topic", response_topic, "confirmation", subConfirmation)
+			// 7. Publish the request to AppSync
+			publish_topic := p.requests_topic()
 
 			// Gather Lambda context information
-            context_data := map[string]interface{}{
-                "invoked_function_arn": resp.Header.Get("Lambda-Runtime-Invoked-Function-Arn"),
-                "deadline_ms":          resp.Header.Get("Lambda-Runtime-Deadline-Ms"),
-                "trace_id":             resp.Header.Get("Lambda-Runtime-Trace-Id"),
-                "function_name":        os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
-                "function_version":     os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
-                "memory_size_mb":       os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"),
-                "log_group_name":       os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"),
-                "log_stream_name":      os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
-                "aws_region":           os.Getenv("AWS_REGION"),
-                "request_id":           request_id,
-            }
-
-            // Parse and add Cognito identity if present
-            cognito_identity_str := resp.Header.Get("Lambda-Runtime-Cognito-Identity")
-            if cognito_identity_str != "" {
-                var parsed_cognito_identity map[string]interface{}
-                if err := json.Unmarshal([]byte(cognito_identity_str), &parsed_cognito_identity); err == nil {
-                    context_data["identity"] = parsed_cognito_identity
-                } else {
-                    log.Printf("%s Warning: Failed to unmarshal Lambda-Runtime-Cognito-Identity: %v", http_proxy_print_prefix, err)
-                }
-            }
-
-            // Parse and add client context if present
-            client_context_b64_str := resp.Header.Get("Lambda-Runtime-Client-Context")
-            if client_context_b64_str != "" {
-                decoded_client_context_bytes, err := base64.StdEncoding.DecodeString(client_context_b64_str)
-                if err == nil {
-                    var parsed_client_context map[string]interface{}
-                    if err := json.Unmarshal(decoded_client_context_bytes, &parsed_client_context); err == nil {
-                        context_data["client_context"] = parsed_client_context
-                    } else {
-                        log.Printf("%s Warning: Failed to unmarshal decoded Lambda-Runtime-Client-Context: %v", http_proxy_print_prefix, err)
-                    }
-                } else {
-                    log.Printf("%s Warning: Failed to base64 decode Lambda-Runtime-Client-Context: %v", http_proxy_print_prefix, err)
-                }
-            }
-
-            payload := map[string]interface{}{
-                "request_id":    request_id,
-                "event_payload": json.RawMessage(body_bytes),
-                "context":       context_data, // Renamed from lambda_context
-            }
-            
-            payload_bytes, _ := json.Marshal(payload)
-            
-            log.Printf("%s Publishing to AppSync topic %s: %s", 
-                http_proxy_print_prefix, publish_topic, string(payload_bytes))
-            
-            if err := p.appsync_ws_client.Publish(ctx, publish_topic, []interface{}{payload}); err != nil {
-                log.Printf("%s Error publishing to AppSync: %v", http_proxy_print_prefix, err)
-                // Continue to normal processing if publish fails
-            } else {
-                log.Printf("%s Successfully published to AppSync topic %s", 
-                    http_proxy_print_prefix, publish_topic)
-                
-                // 7. Wait for the response (with timeout)
-                select {
-                case <-done:
-                    // Response was received and processed
-                    return
-                    
-                case <-time.After(websocketTimeout):
-                    log.Printf("%s Timeout waiting for response from AppSync (reached %.0f second timeout)", 
-                        http_proxy_print_prefix, websocketTimeout.Seconds())
-                    // Continue to normal processing
-                }
-            }
-        }
-    }
-
-    // 8. If we get here, either we're not using AppSync or there was an error
-    // Just return the original Lambda response
-    modified_body, modified_headers := process_request(r.Context(), request_id, body_bytes, resp.Header)
-    copy_headers(modified_headers, w.Header())
-    w.WriteHeader(resp.StatusCode)
-    if _, err := w.Write(modified_body); err != nil {
-        log.Printf("%s Error writing response: %v", http_proxy_print_prefix, err)
-    }
+			context_data := protocol.Context{
+				InvokedFunctionARN: headers.Get("Lambda-Runtime-Invoked-Function-Arn"),
+				DeadlineMs:         headers.Get("Lambda-Runtime-Deadline-Ms"),
+				TraceID:            headers.Get("Lambda-Runtime-Trace-Id"),
+				RequestID:          request_id,
+				InvokedAtMs:        claim_started.UnixMilli(),
+			}
+			p.env_filter.add_context_env(&context_data, os.Getenv)
+
+			add_caller_context(&context_data, headers, logger)
+			// What the agent sees; the function still gets body_bytes
+			event_bytes := body_bytes
+			if !binary_event {
+				event_bytes = p.redactor.redact_event(body_bytes)
+			}
+			p.recorder.record_event(request_id, event_bytes, &context_data)
+
+			payload := &protocol.Request{
+				RequestID:      request_id,
+				Context:        context_data,
+				SandboxID:      p.sandbox_id,
+				IdempotencyKey: pending.idempotency_key(),
+				Handshake:      extension_handshake(),
+				Function:       p.function.Load(),
+				Metadata:       local_metadata,
+			}
+			if binary_event {
+				add_binary_event(payload, event_bytes, headers.Get("Content-Type"))
+			} else {
+				payload.EventPayload = event_bytes
+			}
+			if trace_header := headers.Get("Lambda-Runtime-Trace-Id"); trace_header != "" {
+				if trace := p.xray.start(trace_header); trace != nil {
+					pending.set_xray_trace(trace)
+					trace_header = trace.propagated_header()
+				}
+				payload.Trace = &protocol.Trace{Header: trace_header}
+			}
+			if p.presence.supports(capability_compression) {
+				p.compressor.compress_request_envelope(payload, event_bytes, p.presence.accepts_encoding(content_encoding_gzip))
+			}
+			if encryption_key != nil {
+				encryption_key.seal_request_envelope(request_id, payload)
+			}
+
+			// Only offload to S3 when the agent can fetch the event back
+			offloader := p.offloader
+			if !p.presence.supports(capability_offload) {
+				offloader = nil
+			}
+			if offloader != nil {
+				if upload, err := offloader.response_upload(ctx, request_id); err == nil {
+					payload.ResponseUpload = &upload
+				} else {
+					logger.Warn("Could not presign a response upload", "error", err)
+				}
+			}
+			payload_bytes, err := offloader.offload_request_envelope(ctx, request_id, payload, event_bytes)
+			if err != nil {
+				logger.Warn("Could not offload the event, publishing inline", "error", err)
+				payload_bytes, _ = json.Marshal(payload)
+			}
+
+			// A pull agent receives the request through the mailbox instead
+			pull := p.pull_delivery(ctx)
+			if pull {
+				publish_topic = p.mailbox.queue_url
+			} else if agent_id, claimed := p.offer_invocation(ctx, pending); claimed {
+				// Only the agent holding the lease receives the request
+				publish_topic = p.agent_topic(agent_id)
+			}
+
+			logger.Debug("Publishing request", "topic", publish_topic, "payload", string(payload_bytes))
+
+			// Envelopes AppSync would reject are refused before publishing;
+			// see payload_size.go
+			chunked := p.presence.supports(capability_chunking)
+			var publish_err error
+			if !pull && !chunked {
+				publish_err = p.account_payload_size(request_id, payload_direction_request, len(payload_bytes), max_inline_event_bytes)
+			}
+
+			publish_started := time.Now()
+			if publish_err == nil {
+				publish_err = p.fallback.attempt(ctx, func(ctx context.Context) error {
+					if pull {
+						return p.mailbox.send(ctx, payload_bytes)
+					}
+					publish := func() error {
+						if chunked && len(payload_bytes) > max_inline_event_bytes {
+							return p.publish_chunked(ctx, publish_topic, pending, payload_bytes)
+						}
+						return p.request_transport(request_id).Publish(ctx, publish_topic, []interface{}{payload})
+					}
+					err := publish()
+					if err != nil && p.fail_over(ctx, pending, err) {
+						err = publish()
+					}
+					return err
+				})
+			}
+			if err := publish_err; err != nil {
+				if !is_payload_too_large(err) {
+					logger.Error("Error publishing request", "topic", publish_topic, "error", err)
+					p.explain(request_id, "publish_failed", "%s: %v", publish_topic, err)
+					p.prometheus.failed_publish()
+				}
+				// Fail the invocation or continue to normal processing, per the fallback policy
+				if p.fall_back(request_id, fmt.Errorf("failed to publish to %s: %w", publish_topic, err)) {
+					return
+				}
+			} else {
+				logger.Info("Published request", "topic", publish_topic, "bytes", len(payload_bytes))
+				published_at := time.Now()
+				pending.mark_published(published_at)
+				p.explain(request_id, "published", "on %s, %d bytes", publish_topic, len(payload_bytes))
+				p.prometheus.intercepted_invocation()
+				p.health.record_publish(published_at)
+				p.latencies.record(latency_phase_claim, published_at.Sub(claim_started))
+				pending.update_metrics(func(m *invocation_metrics) {
+					m.claim = published_at.Sub(claim_started)
+					m.publish = published_at.Sub(publish_started)
+					m.published = true
+				})
+
+				// 8. Wait for the response (with timeout), asking for missing
+				// chunks whenever a chunked response stalls
+				timeout := time.After(time.Until(deadline))
+				retransmit := time.NewTicker(p.retransmit_interval())
+				defer retransmit.Stop()
+				deadline_warning, stop_deadline_warning := deadline_warning_timer(received_at, invocation.Deadline, deadline)
+				defer stop_deadline_warning()
+				ack_window, stop_ack_window := p.ack_timer()
+				defer stop_ack_window()
+			wait:
+				for {
+					select {
+					case <-pending.done:
+						switch pending.response_state() {
+						case response_declined:
+							p.explain(request_id, "declined", "after %s", time.Since(published_at).Round(time.Millisecond))
+							break wait
+						case response_cancelled:
+							p.explain(request_id, "cancelled", "after %s", time.Since(published_at).Round(time.Millisecond))
+							return
+						case response_rejected:
+							p.explain(request_id, "response_rejected", "after %s", time.Since(published_at).Round(time.Millisecond))
+							if p.fallback.Mode == FallbackError {
+								return
+							}
+							break wait
+						case response_unacknowledged:
+							p.explain(request_id, "unacknowledged", "no ack after %s", time.Since(published_at).Round(time.Millisecond))
+							if p.fallback.Mode == FallbackError {
+								return
+							}
+							break wait
+						}
+						// Response was received and processed
+						p.explain(request_id, "responded", "after %s", time.Since(published_at).Round(time.Millisecond))
+						p.prometheus.observe_duration(time.Since(claim_started))
+						p.finish_latency_invocation()
+						return
+
+					case <-retransmit.C:
+						p.request_missing_chunks(request_id)
+
+					case <-ack_window:
+						ack_window = nil
+						p.check_acknowledged(pending)
+
+					case <-deadline_warning:
+						p.warn_deadline(request_id, received_at, invocation.Deadline)
+
+					case <-timeout:
+						logger.Warn("Timeout waiting for response from AppSync", "deadline", deadline.Format(time.RFC3339Nano))
+						p.explain(request_id, "deadline_reached", "no response after %s", time.Since(published_at).Round(time.Millisecond))
+						p.trace_remote_execution(pending, time.Now(), xray_outcome_timeout, nil)
+						// Fail the invocation or continue to normal processing, per the fallback policy
+						p.cancel_invocation(request_id, cancel_reason_deadline)
+						if p.agent_timed_out(request_id, deadline) {
+							return
+						}
+						break wait
+
+					case <-r.Context().Done():
+						// The runtime gave up on /next: the function timed out or the sandbox is being reset
+						logger.Warn("The runtime abandoned the invocation while waiting for the agent", "error", r.Context().Err())
+						p.explain(request_id, "abandoned", "after %s", time.Since(published_at).Round(time.Millisecond))
+						p.cancel_invocation(request_id, cancel_reason_abandoned)
+						return
+					}
+				}
+			}
+		}
+	}
+
+	// 9. If we get here, either we're not using AppSync or there was an error
+	// Just return the original Lambda response
+	p.explain(request_id, "passed_through", "the function handles the invocation in Lambda")
+	p.prometheus.passed_through_invocation()
+	p.activity.start(request_id, invocation.Deadline)
+	copy_headers(headers, w.Header())
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(body_bytes); err != nil {
+		logger.Error("Error writing response", "error", err)
+	}
 }
 
 func (p *RuntimeAPIProxy) handle_response(w http.ResponseWriter, r *http.Request) {
 	request_id := chi.URLParam(r, "requestId")
-	url := fmt.Sprintf("http://%s/2018-06-01/runtime/invocation/%s/response", aws_lambda_runtime_api, request_id)
-	log.Println(http_proxy_print_prefix, "POST", url)
+	p.activity.finish(request_id)
+	url := runtime_api_url(p.api_versions.observe(r), fmt.Sprintf("/runtime/invocation/%s/response", request_id))
+	request_logger(request_id).Debug("POST response", "url", url)
 
-	p.forward_and_respond(w, "POST", url, r.Body, r.Header)
+	// A streamed response is forwarded as it arrives rather than read whole
+	if r.Header.Get(streaming_response_mode_header) == "streaming" {
+		p.forward_and_respond(w, "POST", url, r.Body, r.Header)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading response body: %v", err), http.StatusInternalServerError)
+		return
+	}
+	body = p.interceptors.on_response(r.Context(), request_id, body)
+	// Lambda rejects an oversized response itself; this only tells the agent
+	_ = p.account_payload_size(request_id, payload_direction_function_reply, len(body), lambda_response_limit_bytes)
+	p.forward_and_respond(w, "POST", url, io.NopCloser(bytes.NewReader(body)), r.Header)
 }
 
 func (p *RuntimeAPIProxy) handle_init_error(w http.ResponseWriter, r *http.Request) {
-	url := fmt.Sprintf("http://%s/2018-06-01/runtime/init/error", aws_lambda_runtime_api)
-	log.Println(http_proxy_print_prefix, "POST", url)
+	url := runtime_api_url(p.api_versions.observe(r), "/runtime/init/error")
+	component_logger(component_proxy).Warn("POST init error", "url", url)
 	p.forward_and_respond(w, "POST", url, r.Body, r.Header)
 }
 
 func (p *RuntimeAPIProxy) handle_invoke_error(w http.ResponseWriter, r *http.Request) {
 	request_id := chi.URLParam(r, "requestId")
-	log.Println(http_proxy_print_prefix, "POST /invoke/error for requestID:", request_id)
-	url := fmt.Sprintf("http://%s/2018-06-01/runtime/invocation/%s/error", aws_lambda_runtime_api, request_id)
-	p.forward_and_respond(w, "POST", url, r.Body, r.Header)
+	p.activity.finish(request_id)
+	request_logger(request_id).Info("POST invocation error")
+	url := runtime_api_url(p.api_versions.observe(r), fmt.Sprintf("/runtime/invocation/%s/error", request_id))
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading error body: %v", err), http.StatusInternalServerError)
+		return
+	}
+	body = p.interceptors.on_error(r.Context(), request_id, body)
+	p.forward_and_respond(w, "POST", url, io.NopCloser(bytes.NewReader(body)), r.Header)
 }
 
 func (p *RuntimeAPIProxy) handle_exit_error(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s Path or Protocol Error: %s %s", http_proxy_print_prefix, r.Method, r.URL.Path)
+	component_logger(component_proxy).Warn("Path or Protocol Error", "method", r.Method, "path", r.URL.Path)
 	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
 
-func StartProxy(proxy_instance *RuntimeAPIProxy, actual_runtime_api string, port int) {
-	log.Println(http_proxy_print_prefix, "Starting proxy server on port", port, "targeting", actual_runtime_api)
+// new_proxy_server returns the proxy listener. The caller runs ListenAndServe
+// and shuts it down.
+func new_proxy_server(proxy_instance *RuntimeAPIProxy, actual_runtime_api string, port int) *http.Server {
+	component_logger(component_proxy).Info("Creating proxy server", "port", port, "runtime_api", actual_runtime_api)
 	aws_lambda_runtime_api = actual_runtime_api
+	http_client, runtime_api_post_client = new_runtime_api_clients(proxy_instance.config)
 
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: proxy_instance.router(),
+	}
+}
+
+// router routes Runtime API calls on the path after the API version date.
+func (p *RuntimeAPIProxy) router() http.Handler {
 	r := chi.NewRouter()
 	r.Use(simple_logger)
 
+	r.Get(livez_path, p.handle_livez)
+	r.Get(healthz_path, p.handle_healthz)
+	r.Get(explain_route, p.handle_explain)
+	r.Get(status_path, p.handle_status)
+	r.Get(metrics_path, p.handle_metrics)
+
 	// Lambda Runtime API endpoints
-	r.HandleFunc("/2018-06-01/runtime/invocation/next", proxy_instance.handle_next)
-	r.HandleFunc("/2018-06-01/runtime/invocation/{requestId}/response", proxy_instance.handle_response)
-	r.HandleFunc("/2018-06-01/runtime/invocation/{requestId}/error", proxy_instance.handle_invoke_error)
-	r.HandleFunc("/2018-06-01/runtime/init/error", proxy_instance.handle_init_error)
+	r.Route(runtime_api_version_route, func(r chi.Router) {
+		r.HandleFunc("/runtime/invocation/next", p.handle_next)
+		r.HandleFunc("/runtime/invocation/{requestId}/response", p.handle_response)
+		r.HandleFunc("/runtime/invocation/{requestId}/error", p.handle_invoke_error)
+		r.HandleFunc("/runtime/init/error", p.handle_init_error)
+		r.HandleFunc("/runtime/restore/next", p.handle_restore_next)
+		r.HandleFunc("/runtime/restore/error", p.handle_restore_error)
+	})
 
 	r.NotFound(handle_error)
 	r.MethodNotAllowed(handle_error)
-
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: r,
-	}
-
-	go func() {
-		err := server.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			log.Printf("%s proxy server ListenAndServe error: %v", http_proxy_print_prefix, err)
-		}
-		log.Println(http_proxy_print_prefix, "Proxy server goroutine finished.")
-	}()
-	log.Println(http_proxy_print_prefix, "Proxy Server Started")
+	return r
 }
 
 func (p *RuntimeAPIProxy) forward_and_respond(w http.ResponseWriter, method string, url string, body io.ReadCloser, headers http.Header) {
-	resp, err := p.forward_request(method, url, body, headers)
+	resp, err := p.forward_request(context.Background(), method, url, body, headers)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error forwarding %s request to %s: %v", method, url, err), http.StatusInternalServerError)
 		return
@@ -304,12 +602,160 @@ func (p *RuntimeAPIProxy) forward_and_respond(w http.ResponseWriter, method stri
 	w.WriteHeader(resp.StatusCode)
 	_, err = w.Write(resp_body_bytes)
 	if err != nil {
-		log.Printf("%s Error writing response to client: %v", http_proxy_print_prefix, err)
+		component_logger(component_proxy).Error("Error writing response to client", "url", url, "error", err)
+	}
+}
+
+// decode_agent_response turns an event from the response channel into response
+// bytes. payload_ref frames are downloaded; chunk frames are fed to the
+// reassembler and complete is false until the whole payload has arrived;
+// encrypted_payload frames are decrypted, binary_payload frames decoded and
+// encoded_payload frames decompressed. Response envelopes are unwrapped
+// whether they arrive inline or in chunks, and their metadata returned. With
+// response signing on, a response that fails verification returns a
+// rejected_response_error.
+func (p *RuntimeAPIProxy) decode_agent_response(request_id string, data_payload interface{}) ([]byte, response_metadata, bool, error) {
+	response_bytes, err := json.Marshal(data_payload)
+	if err != nil {
+		return nil, response_metadata{}, false, fmt.Errorf("error marshaling WebSocket response: %w", err)
+	}
+	// A chunked response is verified once it has been reassembled
+	if _, is_chunk, _ := parse_chunk_frame(response_bytes); !is_chunk {
+		if err := p.signatures.verify(request_id, response_bytes); err != nil {
+			return nil, response_metadata{}, false, err
+		}
+	}
+	response_bytes, metadata, err := open_response_envelope(response_bytes)
+	if err != nil {
+		return nil, response_metadata{}, false, err
+	}
+	if ref, is_ref, err := parse_payload_reference(response_bytes); is_ref {
+		if err != nil {
+			return nil, response_metadata{}, false, err
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, 30*time.Second)
+		defer cancel()
+		payload, err := fetch_payload_reference(ctx, ref)
+		if err != nil {
+			return nil, response_metadata{}, false, err
+		}
+		return payload, metadata, true, nil
+	}
+	chunk, is_chunk, err := parse_chunk_frame(response_bytes)
+	if err != nil {
+		return nil, response_metadata{}, false, err
+	}
+	complete := true
+	if is_chunk {
+		if response_bytes, complete, err = p.chunks.add(p.transfer_key(request_id), chunk); err != nil || !complete {
+			return response_bytes, response_metadata{}, complete, err
+		}
+		// A chunked response carries its idempotency key inside
+		if request, tracked := p.requests.lookup(request_id); tracked {
+			if key, stale := request.answers_other_attempt(response_bytes); stale {
+				return nil, response_metadata{}, false, fmt.Errorf("the response answers %s, not %s", key, request.idempotency_key())
+			}
+		}
+		if err := p.signatures.verify(request_id, response_bytes); err != nil {
+			return nil, response_metadata{}, false, err
+		}
+		if response_bytes, metadata, err = open_response_envelope(response_bytes); err != nil {
+			return nil, response_metadata{}, false, err
+		}
+	}
+	if p.encryptor != nil {
+		if response_bytes, err = p.encryptor.open_response(request_id, response_bytes); err != nil {
+			return nil, response_metadata{}, false, err
+		}
+	}
+	// A binary or compressed response may arrive inline or split into chunks
+	if binary, is_binary, err := parse_binary_payload(response_bytes); is_binary {
+		if err != nil {
+			return nil, response_metadata{}, false, err
+		}
+		return binary, metadata, true, nil
+	}
+	encoded, is_encoded, err := parse_encoded_payload(response_bytes)
+	if err != nil {
+		return nil, response_metadata{}, false, err
+	}
+	if !is_encoded {
+		return response_bytes, metadata, true, nil
+	}
+	payload, err := decode_encoded_payload(encoded)
+	if err != nil {
+		return nil, response_metadata{}, false, err
+	}
+	return payload, metadata, true, nil
+}
+
+// relay_stream_frame forwards a streamed response frame and reports whether the
+// event was one. on_finished runs once the stream has been handed to the Runtime API.
+func (p *RuntimeAPIProxy) relay_stream_frame(request_id string, data_payload interface{}, request *pending_request, on_finished func()) bool {
+	frame_bytes, err := json.Marshal(data_payload)
+	if err != nil {
+		return false
+	}
+	frame, is_stream, err := parse_stream_frame(frame_bytes)
+	if !is_stream {
+		return false
+	}
+	if err != nil {
+		request_logger(request_id).Error("Error decoding stream frame", "error", err)
+		return true
+	}
+	if !request.start_receiving() {
+		return true
+	}
+	finished, err := request.stream.handle(frame)
+	if err != nil {
+		request_logger(request_id).Error("Error streaming response", "error", err)
+	}
+	if finished {
+		if err == nil {
+			request_logger(request_id).Info("Streamed response")
+		}
+		on_finished()
 	}
+	return true
+}
+
+// post_agent_response posts the developer's response for request_id to the Runtime API.
+func (p *RuntimeAPIProxy) post_agent_response(request_id string, event []byte, response_bytes []byte) {
+	logger := request_logger(request_id)
+	logger.Debug("Raw WebSocket response", "payload", string(response_bytes))
+
+	// Function URL / HTTP API events expect a payload format 2.0 response
+	if is_payload_format_v2_event(event) {
+		normalized, err := normalize_function_url_response(response_bytes)
+		if err != nil {
+			logger.Error("Invalid payload format 2.0 response", "error", err)
+			p.post_invocation_error(request_id, "LiveLambda.InvalidFunctionURLResponse", err.Error())
+			return
+		}
+		response_bytes = normalized
+	}
+	response_bytes = p.interceptors.on_response(context.Background(), request_id, response_bytes)
+	if err := p.account_payload_size(request_id, payload_direction_response, len(response_bytes), lambda_response_limit_bytes); err != nil {
+		p.post_invocation_error(request_id, payload_too_large_error_type, err.Error())
+		return
+	}
+
+	// Post the response back to the Runtime API
+	response_url := runtime_api_url(p.api_versions.current(), fmt.Sprintf("/runtime/invocation/%s/response", request_id))
+	logger.Debug("Posting response back to Lambda Runtime API", "url", response_url)
+
+	attempts, err := p.post_runtime_api(context.Background(), response_url, response_bytes, nil)
+	if err != nil {
+		logger.Error("Could not post the response to the Lambda Runtime API", "attempts", attempts, "error", err)
+		p.response_delivery_failed(request_id, attempts, err)
+		return
+	}
+	logger.Info("Posted response", "attempts", attempts)
 }
 
 func handle_error(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s Path or Protocol Error: %s %s", http_proxy_print_prefix, r.Method, r.URL.Path)
+	component_logger(component_proxy).Warn("Path or Protocol Error", "method", r.Method, "path", r.URL.Path)
 	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
 
@@ -319,78 +765,29 @@ func copy_headers(source http.Header, dest http.Header) {
 	}
 }
 
-func (p *RuntimeAPIProxy) forward_request(method string, url string, body io.Reader, headers http.Header) (*http.Response, error) { // MODIFIED
-	req, err := http.NewRequest(method, url, body)
+func (p *RuntimeAPIProxy) forward_request(ctx context.Context, method string, url string, body io.Reader, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		log.Printf("%s Error creating %s request to %s: %v", http_proxy_print_prefix, method, url, err)
+		component_logger(component_proxy).Error("Error creating request", "method", method, "url", url, "error", err)
 		return nil, err
 	}
-	copy_headers(headers, req.Header) // MODIFIED
+	copy_headers(headers, req.Header)
 
 	// Ensure Host header is set correctly if it's being proxied.
 	// For Lambda Runtime API, it's a local endpoint, so default behavior is likely fine.
 
-	resp, err := http_client.Do(req)
+	resp, err := runtime_api_client(method).Do(req)
 	if err != nil {
-		log.Printf("%s Error sending %s request to %s: %v", http_proxy_print_prefix, method, url, err)
+		component_logger(component_proxy).Error("Error sending request", "method", method, "url", url, "error", err)
 		return nil, err
 	}
 	return resp, nil
 }
 
-func simple_logger(next http.Handler) http.Handler { // MODIFIED
+func simple_logger(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", http_proxy_print_prefix, r.Method, r.URL.Path)
+		component_logger(component_proxy).Debug("Request", "method", r.Method, "path", r.URL.Path)
 		next.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(fn)
 }
-
-// process_request can modify the request body or headers before sending to the Runtime API (for /next)
-// or before sending back to the function (if we were proxying the other way).
-// For /next, this is modifying the response *from* the Runtime API *before* it goes to the function.
-func process_request(ctx context.Context, request_id string, body []byte, headers http.Header) ([]byte, http.Header) { // MODIFIED
-	log.Printf("%s process_request for requestID: %s", http_proxy_print_prefix, request_id)
-	// AppSync subscription logic is now part of p.handle_next, called after this response is sent to the function.
-	// No AppSyncProxyHelper call needed here anymore.
-
-	// Example modification (from sample)
-	json_body, err := unmarshal_body(body) // MODIFIED
-	if err == nil {
-		new_body, marshal_err := json.Marshal(json_body) // MODIFIED
-		if marshal_err == nil {
-			return new_body, headers
-		}
-		log.Printf("%s Error marshalling modified request body: %v", http_proxy_print_prefix, marshal_err)
-	}
-	return body, headers // Return original on error
-}
-
-// process_response can modify the response body or headers from the function before sending to the Runtime API.
-func process_response(ctx context.Context, request_id string, body []byte, headers http.Header) ([]byte, http.Header) { // MODIFIED
-	log.Printf("%s process_response for requestID: %s", http_proxy_print_prefix, request_id)
-	// AppSync publishing logic for responses (if needed in the future) would be added here or in a dedicated method.
-	// No AppSyncProxyHelper call needed here anymore.
-
-	// Example modification (from sample)
-	json_body, err := unmarshal_body(body) // MODIFIED
-	if err == nil {
-		new_body, marshal_err := json.Marshal(json_body) // MODIFIED
-		if marshal_err == nil {
-			return new_body, headers
-		}
-		log.Printf("%s Error marshalling modified response body: %v", http_proxy_print_prefix, marshal_err)
-	}
-	return body, headers // Return original on error
-}
-
-func unmarshal_body(body []byte) (map[string]interface{}, error) { // MODIFIED
-	var temp = make(map[string]interface{})
-	err := json.Unmarshal(body, &temp)
-	if err != nil {
-		// It's common for response bodies to not be JSON, so don't be too noisy.
-		// log.Printf("%s failed to unmarshal response body: %v", http_proxy_print_prefix, err)
-		return nil, err
-	}
-	return temp, nil
-}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Runtime API versions
+//
+// Runtime API paths start with a date segment (2018-06-01 today). The proxy
+// routes on the rest of the path, so a runtime built against a newer date is
+// proxied as-is: the date it used is echoed upstream untouched. Requests the
+// proxy makes on its own behalf (posting agent responses and errors) use the
+// date last seen from the runtime, or the default before the first /next.
+
+const (
+	default_runtime_api_version = "2018-06-01"
+	runtime_api_version_param   = "apiVersion"
+	runtime_api_version_route   = "/{" + runtime_api_version_param + ":[0-9]{4}-[0-9]{2}-[0-9]{2}}"
+)
+
+// runtime_api_url builds an upstream Runtime API URL for path under api_version.
+func runtime_api_url(api_version string, path string) string {
+	if api_version == "" {
+		api_version = default_runtime_api_version
+	}
+	return fmt.Sprintf("http://%s/%s%s", aws_lambda_runtime_api, api_version, path)
+}
+
+// runtime_api_versions remembers the last API version the runtime called.
+type runtime_api_versions struct {
+	last atomic.Value // string
+}
+
+// observe records and returns the API version of a routed runtime request.
+func (v *runtime_api_versions) observe(r *http.Request) string {
+	api_version := chi.URLParam(r, runtime_api_version_param)
+	if api_version == "" {
+		return v.current()
+	}
+	v.last.Store(api_version)
+	return api_version
+}
+
+func (v *runtime_api_versions) current() string {
+	if api_version, ok := v.last.Load().(string); ok {
+		return api_version
+	}
+	return default_runtime_api_version
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterEchoesRuntimeAPIVersion(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	proxy := new_tracking_proxy()
+	router := proxy.router()
+
+	for _, path := range []string{
+		"/2018-06-01/runtime/invocation/req-1/response",
+		"/2031-01-15/runtime/invocation/req-2/error",
+		"/2031-01-15/runtime/init/error",
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("%s: expected the upstream status, got %d", path, recorder.Code)
+		}
+		select {
+		case posted := <-received:
+			if posted.path != path {
+				t.Fatalf("expected %s to be forwarded untouched, got %s", path, posted.path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for the upstream request", path)
+		}
+	}
+
+	if got := proxy.api_versions.current(); got != "2031-01-15" {
+		t.Fatalf("expected the last seen version to be remembered, got %s", got)
+	}
+	proxy.post_invocation_error("req-3", "Test.Error", "boom")
+	if posted := <-received; posted.path != "/2031-01-15/runtime/invocation/req-3/error" {
+		t.Fatalf("expected proxy-originated requests to use the runtime's version, got %s", posted.path)
+	}
+}
+
+func TestRouterRejectsUnknownPaths(t *testing.T) {
+	router := new_tracking_proxy().router()
+	for _, path := range []string{"/latest/runtime/invocation/next", "/2018-06-01/runtime/unknown"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", path, recorder.Code)
+		}
+	}
+}
+
+func TestRuntimeAPIVersionsDefault(t *testing.T) {
+	var versions runtime_api_versions
+	if got := versions.current(); got != default_runtime_api_version {
+		t.Fatalf("expected the default version, got %s", got)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Adaptive sampling
+//
+// Under an unexpected traffic spike, offering every invocation to the agent can
+// swamp the developer's machine and exhaust AppSync quotas. When
+// LIVE_LAMBDA_SAMPLING_MAX_RPS is set, the extension keeps an exponentially
+// decayed estimate of the invocation rate and halves the share of invocations
+// it intercepts whenever the intercepted rate exceeds the limit. The share is
+// only doubled again once the doubled rate would stay below
+// LIVE_LAMBDA_SAMPLING_RECOVER_RATIO of the limit, and changes are at least
+// LIVE_LAMBDA_SAMPLING_COOLDOWN apart, so the rate does not flap around the
+// threshold. Invocations that are not sampled pass through to the bundled
+// handler. Every change is announced as a sampling_changed lifecycle event.
+
+const (
+	sampling_print_prefix          = "[LiveLambdaExt:Sampling]"
+	default_sampling_min_rate      = 0.01
+	default_sampling_recover_ratio = 0.5
+	default_sampling_cooldown      = 10 * time.Second
+	sampling_rate_half_life        = 10 * time.Second
+)
+
+// sampling_change describes a sample rate adjustment.
+type sampling_change struct {
+	SampleRate         float64
+	PreviousSampleRate float64
+	ObservedRPS        float64
+}
+
+type adaptive_sampler struct {
+	mu            sync.Mutex
+	max_rps       float64
+	min_rate      float64
+	recover_ratio float64
+	cooldown      time.Duration
+	tau           float64 // decay time constant of the rate estimate, in seconds
+	weight        float64 // exponentially decayed arrival count
+	last_arrival  time.Time
+	last_change   time.Time
+	sample_rate   float64
+	now           func() time.Time
+	random        func() float64
+}
+
+func new_adaptive_sampler(max_rps float64, min_rate float64, recover_ratio float64, cooldown time.Duration) *adaptive_sampler {
+	if min_rate <= 0 || min_rate > 1 {
+		min_rate = default_sampling_min_rate
+	}
+	if recover_ratio <= 0 || recover_ratio > 1 {
+		recover_ratio = default_sampling_recover_ratio
+	}
+	return &adaptive_sampler{
+		max_rps:       max_rps,
+		min_rate:      min_rate,
+		recover_ratio: recover_ratio,
+		cooldown:      cooldown,
+		tau:           sampling_rate_half_life.Seconds() / math.Ln2,
+		sample_rate:   1,
+		now:           time.Now,
+		random:        rand.Float64,
+	}
+}
+
+// new_adaptive_sampler_from_config returns nil unless LIVE_LAMBDA_SAMPLING_MAX_RPS is set.
+func new_adaptive_sampler_from_config(settings Config) *adaptive_sampler {
+	if settings.SamplingMaxRPS <= 0 {
+		return nil
+	}
+	sampler := new_adaptive_sampler(
+		settings.SamplingMaxRPS,
+		settings.SamplingMinRate,
+		settings.SamplingRecoverRatio,
+		settings.SamplingCooldown,
+	)
+	log.Printf("%s Sampling invocations above %.2f rps (min rate %.3f)", sampling_print_prefix, sampler.max_rps, sampler.min_rate)
+	return sampler
+}
+
+// admit records an invocation and decides whether to intercept it. change is
+// non-nil when this invocation moved the sample rate. A nil sampler admits
+// everything.
+func (s *adaptive_sampler) admit() (sampled bool, change *sampling_change) {
+	if s == nil {
+		return true, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if !s.last_arrival.IsZero() {
+		s.weight *= math.Exp(-now.Sub(s.last_arrival).Seconds() / s.tau)
+	}
+	s.weight++
+	s.last_arrival = now
+	observed := s.weight / s.tau
+
+	previous := s.sample_rate
+	if s.last_change.IsZero() || now.Sub(s.last_change) >= s.cooldown {
+		intercepted := observed * s.sample_rate
+		switch {
+		case intercepted > s.max_rps && s.sample_rate > s.min_rate:
+			s.sample_rate = math.Max(s.sample_rate/2, s.min_rate)
+		case s.sample_rate < 1 && intercepted*2 < s.max_rps*s.recover_ratio:
+			s.sample_rate = math.Min(s.sample_rate*2, 1)
+		}
+	}
+	if s.sample_rate != previous {
+		s.last_change = now
+		change = &sampling_change{SampleRate: s.sample_rate, PreviousSampleRate: previous, ObservedRPS: observed}
+	}
+
+	return s.sample_rate >= 1 || s.random() < s.sample_rate, change
+}
+
+// current_rate returns the share of invocations currently intercepted.
+func (s *adaptive_sampler) current_rate() float64 {
+	if s == nil {
+		return 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sample_rate
+}
+
+// announce_sampling_change logs a sample rate change and tells the agent about it.
+func (p *RuntimeAPIProxy) announce_sampling_change(change *sampling_change) {
+	log.Printf("%s Sample rate %.3f -> %.3f at %.2f rps observed", sampling_print_prefix, change.PreviousSampleRate, change.SampleRate, change.ObservedRPS)
+	ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+	defer cancel()
+	_ = p.publish_lifecycle_event(ctx, "sampling_changed", map[string]interface{}{
+		"sample_rate":          change.SampleRate,
+		"previous_sample_rate": change.PreviousSampleRate,
+		"observed_rps":         math.Round(change.ObservedRPS*100) / 100,
+		"max_rps":              p.sampler.max_rps,
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func new_test_sampler(max_rps float64, now *time.Time) *adaptive_sampler {
+	sampler := new_adaptive_sampler(max_rps, 0.1, 0.5, 5*time.Second)
+	sampler.now = func() time.Time { return *now }
+	sampler.random = func() float64 { return 0.99 }
+	return sampler
+}
+
+// drive admits invocations at rps for duration and returns the changes seen.
+func drive(sampler *adaptive_sampler, now *time.Time, rps float64, duration time.Duration) []*sampling_change {
+	var changes []*sampling_change
+	step := time.Duration(float64(time.Second) / rps)
+	for end := now.Add(duration); now.Before(end); *now = now.Add(step) {
+		if _, change := sampler.admit(); change != nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func TestNilSamplerAdmitsEverything(t *testing.T) {
+	var sampler *adaptive_sampler
+	if sampled, change := sampler.admit(); !sampled || change != nil {
+		t.Fatalf("expected a nil sampler to admit without changes, got %v %v", sampled, change)
+	}
+	if rate := sampler.current_rate(); rate != 1 {
+		t.Fatalf("expected rate 1, got %v", rate)
+	}
+}
+
+func TestSamplerKeepsFullRateBelowLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sampler := new_test_sampler(10, &now)
+	if changes := drive(sampler, &now, 5, time.Minute); len(changes) != 0 {
+		t.Fatalf("expected no changes below the limit, got %d", len(changes))
+	}
+	if sampled, _ := sampler.admit(); !sampled {
+		t.Fatal("expected invocations to be sampled at full rate")
+	}
+}
+
+func TestSamplerBacksOffUnderLoad(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sampler := new_test_sampler(10, &now)
+
+	changes := drive(sampler, &now, 60, time.Minute)
+	if len(changes) == 0 {
+		t.Fatal("expected the sample rate to drop")
+	}
+	for i, change := range changes {
+		if change.SampleRate != change.PreviousSampleRate/2 && change.SampleRate != 0.1 {
+			t.Fatalf("change %d: expected halving, got %v -> %v", i, change.PreviousSampleRate, change.SampleRate)
+		}
+	}
+	for i, change := range changes {
+		if change.ObservedRPS*change.PreviousSampleRate <= 10 {
+			t.Fatalf("change %d happened at %v rps, within the limit", i, change.ObservedRPS)
+		}
+	}
+	if rate := sampler.current_rate(); rate != 0.125 {
+		t.Fatalf("expected the rate to settle at 0.125 for 60 rps against 10, got %v", rate)
+	}
+	if sampled, _ := sampler.admit(); sampled {
+		t.Fatal("expected an unlucky invocation to pass through while sampling")
+	}
+}
+
+func TestSamplerRespectsMinimumRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sampler := new_test_sampler(1, &now)
+	drive(sampler, &now, 500, 2*time.Minute)
+	if rate := sampler.current_rate(); rate != 0.1 {
+		t.Fatalf("expected the rate to stop at the minimum 0.1, got %v", rate)
+	}
+}
+
+func TestSamplerRecoversWithHysteresis(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sampler := new_test_sampler(10, &now)
+	drive(sampler, &now, 36, time.Minute)
+	if rate := sampler.current_rate(); rate != 0.25 {
+		t.Fatalf("expected rate 0.25 at 36 rps, got %v", rate)
+	}
+
+	// Doubling at 12 rps would intercept 6 rps, above half the limit: hold.
+	if changes := drive(sampler, &now, 12, time.Minute); len(changes) != 0 {
+		t.Fatalf("expected the rate to hold inside the hysteresis band, got %d changes", len(changes))
+	}
+
+	changes := drive(sampler, &now, 1, 2*time.Minute)
+	if sampler.current_rate() != 1 {
+		t.Fatalf("expected full sampling once traffic dropped, got %v", sampler.current_rate())
+	}
+	for i := 1; i < len(changes); i++ {
+		if changes[i].SampleRate != changes[i].PreviousSampleRate*2 {
+			t.Fatalf("change %d: expected doubling, got %v -> %v", i, changes[i].PreviousSampleRate, changes[i].SampleRate)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The extension's long-running parts (the proxy listener, the transport and the
+// Extensions API event loop) run in one task group. When the event loop ends,
+// on SHUTDOWN, a signal or an error, the rest are torn down in a fixed order:
+// stop intercepting /next, drain in-flight invocations, fail the ones still
+// waiting, close the transport, then close the listeners and exit. Lambda
+// allows extensions about two seconds after SHUTDOWN, so every step is
+// bounded. The drain lasts until the SHUTDOWN event's deadline less
+// shutdown_deadline_buffer, which keeps time for the steps after it; without
+// a deadline, as on a signal, it lasts LIVE_LAMBDA_DRAIN_TIMEOUT.
+
+const (
+	shutdown_print_prefix    = "[LiveLambdaExt:Shutdown]"
+	default_drain_timeout    = time.Second
+	shutdown_step_timeout    = 250 * time.Millisecond
+	shutdown_deadline_buffer = 4 * shutdown_step_timeout // the steps after the drain
+	drain_poll_interval      = 20 * time.Millisecond
+	shutdown_error           = "LiveLambda.ExtensionShutdown"
+)
+
+// task_group runs goroutines that share a context, like errgroup.WithContext:
+// the first task to fail cancels the context, and wait returns its error.
+type task_group struct {
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+	once   sync.Once
+	err    error
+}
+
+func new_task_group(ctx context.Context) (*task_group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &task_group{cancel: cancel}, ctx
+}
+
+// run starts fn in the group.
+func (g *task_group) run(name string, fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			log.Printf("%s %s failed: %v", shutdown_print_prefix, name, err)
+			g.once.Do(func() {
+				g.err = fmt.Errorf("%s: %w", name, err)
+				g.cancel()
+			})
+			return
+		}
+		log.Printf("%s %s stopped", shutdown_print_prefix, name)
+	}()
+}
+
+// wait blocks until every task has returned and reports the first failure.
+func (g *task_group) wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+// shutdown_step is one stage of the ordered teardown.
+type shutdown_step struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// run_shutdown runs steps in order, each under its own timeout so a slow step
+// cannot starve the ones after it. Every step runs; their errors are joined.
+func run_shutdown(steps []shutdown_step) error {
+	var errs []error
+	for _, step := range steps {
+		ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+		started := time.Now()
+		err := step.run(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("%s %s failed after %s: %v", shutdown_print_prefix, step.name, time.Since(started), err)
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+			continue
+		}
+		log.Printf("%s %s done in %s", shutdown_print_prefix, step.name, time.Since(started))
+	}
+	return errors.Join(errs...)
+}
+
+// drain_timeout returns how long the drain may last: until deadline less
+// shutdown_deadline_buffer, or LIVE_LAMBDA_DRAIN_TIMEOUT when deadline is
+// zero. A drain timeout of 0 skips the drain either way.
+func (p *RuntimeAPIProxy) drain_timeout(deadline time.Time, now time.Time) time.Duration {
+	if p.config.DrainTimeout <= 0 || deadline.IsZero() {
+		return p.config.DrainTimeout
+	}
+	return max(deadline.Sub(now)-shutdown_deadline_buffer, 0)
+}
+
+// shutdown_steps returns the teardown for the proxy. deadline is the SHUTDOWN
+// event's deadline, or zero. close_transport stops the connection manager,
+// which closes the transport, and transport_done is closed when it has
+// returned.
+func (p *RuntimeAPIProxy) shutdown_steps(server *http.Server, deadline time.Time, close_transport context.CancelFunc, transport_done <-chan struct{}, close_listeners context.CancelFunc) []shutdown_step {
+	return []shutdown_step{
+		{name: "stop intercepting /next", timeout: shutdown_step_timeout, run: func(ctx context.Context) error {
+			// /next keeps working, but new invocations go straight to the function
+			p.interception.disable_hard("extension shutting down")
+			return nil
+		}},
+		{name: "drain", timeout: p.drain_timeout(deadline, time.Now()), run: p.drain},
+		{name: "fail in-flight invocations", timeout: shutdown_step_timeout, run: p.fail_in_flight},
+		{name: "flush recordings", timeout: shutdown_step_timeout, run: p.flush_recordings},
+		{name: "close transport", timeout: shutdown_step_timeout, run: func(ctx context.Context) error {
+			close_transport()
+			select {
+			case <-transport_done:
+				return nil
+			case <-ctx.Done():
+				return fmt.Errorf("transport did not close: %w", ctx.Err())
+			}
+		}},
+		// The Extensions API has no deregistration call; Lambda treats the
+		// extension as done when it exits, which main does after this step.
+		{name: "deregister", timeout: shutdown_step_timeout, run: func(ctx context.Context) error {
+			close_listeners()
+			return errors.Join(p.local_api.close(ctx), server.Shutdown(ctx))
+		}},
+	}
+}
+
+// fail_in_flight posts a best-effort error for every invocation the drain left
+// waiting, so the Runtime API hears from the extension before it exits. A
+// response that arrives first still wins; see response_ordering.go.
+func (p *RuntimeAPIProxy) fail_in_flight(ctx context.Context) error {
+	failed := 0
+	for _, request := range p.requests.snapshot() {
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed %d invocations before running out of time: %w", failed, ctx.Err())
+		}
+		request_id := request.request_id
+		message := "the extension shut down before the agent responded"
+		if _, ok := request.settle(response_cancelled, func() {
+			if request.stream.abort(shutdown_error, message) {
+				return
+			}
+			p.post_invocation_error(request_id, shutdown_error, message)
+		}); ok {
+			log.Printf("%s Failed request ID %s with %s", shutdown_print_prefix, request_id, shutdown_error)
+			p.explain(request_id, "failed", "%s: %s", shutdown_error, message)
+			failed++
+		}
+	}
+	return nil
+}
+
+// drain waits for in-flight invocations to receive their responses.
+func (p *RuntimeAPIProxy) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drain_poll_interval)
+	defer ticker.Stop()
+	for {
+		in_flight := p.requests.in_flight()
+		if in_flight == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d invocations still in flight", in_flight)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type shutdown_recorder struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (r *shutdown_recorder) record(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+}
+
+func (r *shutdown_recorder) recorded() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.steps, ",")
+}
+
+func new_shutdown_fixture(drain_timeout time.Duration) (*RuntimeAPIProxy, *http.Server, *shutdown_recorder, []shutdown_step) {
+	p := &RuntimeAPIProxy{
+		interception: new_interception_switch(),
+		requests:     new_request_tracker(),
+		config:       Config{DrainTimeout: drain_timeout},
+	}
+	recorder := &shutdown_recorder{}
+	transport_done := make(chan struct{})
+	server := &http.Server{Addr: "127.0.0.1:0"}
+	steps := p.shutdown_steps(server, time.Time{}, func() {
+		recorder.record("transport")
+		close(transport_done)
+	}, transport_done, func() { recorder.record("listeners") })
+	return p, server, recorder, steps
+}
+
+func TestShutdownTearsDownInOrder(t *testing.T) {
+	p, server, recorder, steps := new_shutdown_fixture(time.Second)
+	p.requests.register("r1", nil, nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if enabled, _ := p.interception.enabled(); !enabled {
+			recorder.record("intercepting_stopped")
+		}
+		recorder.record("r1_done")
+		p.requests.remove("r1")
+	}()
+
+	if err := run_shutdown(steps); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := recorder.recorded(); got != "intercepting_stopped,r1_done,transport,listeners" {
+		t.Fatalf("unexpected shutdown order: %s", got)
+	}
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		t.Fatalf("expected the proxy listener to be shut down, got %v", err)
+	}
+}
+
+func TestShutdownContinuesAfterDrainTimeout(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	p, _, recorder, steps := new_shutdown_fixture(20 * time.Millisecond)
+	stuck, _ := p.requests.register("stuck", nil, nil)
+
+	err := run_shutdown(steps)
+	if err == nil || !strings.Contains(err.Error(), "drain: 1 invocations still in flight") {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+	if got := recorder.recorded(); got != "transport,listeners" {
+		t.Fatalf("expected the later steps to run anyway, got %s", got)
+	}
+	select {
+	case posted := <-received:
+		if !strings.HasSuffix(posted.path, "/stuck/error") || !strings.Contains(posted.body, shutdown_error) {
+			t.Fatalf("expected a shutdown error for the stuck invocation, got %+v", posted)
+		}
+	default:
+		t.Fatal("expected the stuck invocation to be failed")
+	}
+	if state := stuck.response_state(); state != response_cancelled {
+		t.Fatalf("expected the stuck invocation to be settled, got %s", state)
+	}
+}
+
+func TestDrainTimeoutFollowsShutdownDeadline(t *testing.T) {
+	p := &RuntimeAPIProxy{config: Config{DrainTimeout: time.Second}}
+	now := time.Now()
+
+	if got := p.drain_timeout(time.Time{}, now); got != time.Second {
+		t.Fatalf("expected the configured timeout without a deadline, got %s", got)
+	}
+	if got := p.drain_timeout(now.Add(2*time.Second), now); got != 2*time.Second-shutdown_deadline_buffer {
+		t.Fatalf("expected the deadline less the buffer, got %s", got)
+	}
+	if got := p.drain_timeout(now.Add(shutdown_deadline_buffer/2), now); got != 0 {
+		t.Fatalf("expected no drain this close to the deadline, got %s", got)
+	}
+	p.config.DrainTimeout = 0
+	if got := p.drain_timeout(now.Add(2*time.Second), now); got != 0 {
+		t.Fatalf("expected a drain timeout of 0 to skip the drain, got %s", got)
+	}
+}
+
+func TestTaskGroupCancelsOnFirstError(t *testing.T) {
+	group, ctx := new_task_group(t.Context())
+	group.run("waits", func() error {
+		<-ctx.Done()
+		return nil
+	})
+	group.run("fails", func() error { return errors.New("listen failed") })
+
+	if err := group.wait(); err == nil || err.Error() != "fails: listen failed" {
+		t.Fatalf("expected the first failure, got %v", err)
+	}
+}
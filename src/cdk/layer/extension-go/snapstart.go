@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SnapStart restore hooks
+//
+// On SnapStart functions Lambda snapshots the sandbox after init and restores
+// copies of it later. Before the snapshot, the runtime blocks on
+// /runtime/restore/next; the call returns once the copy is restored, and the
+// runtime then runs its afterRestore hooks, reporting failures to
+// /runtime/restore/error. The proxy forwards both untouched.
+//
+// The connection the extension opened during init does not survive the
+// snapshot, but the transport may not notice until a publish fails. When
+// /runtime/restore/next returns, the proxy therefore reconnects and restores
+// its subscriptions before handing the restore to the runtime, and publishes
+// a restored lifecycle event, so the first invocation after a restore does not
+// sit on a dead connection. The reconnect is bounded by
+// restore_reconnect_timeout; past it, watch_connection keeps trying in the
+// background. LIVE_LAMBDA_RESTORE_RECONNECT=off only forwards the calls.
+
+const restore_reconnect_timeout = 5 * time.Second
+
+func (p *RuntimeAPIProxy) handle_restore_next(w http.ResponseWriter, r *http.Request) {
+	url := runtime_api_url(p.api_versions.observe(r), "/runtime/restore/next")
+	component_logger(component_proxy).Info("GET restore next, waiting for a restore", "url", url)
+	resp, err := p.forward_request(r.Context(), "GET", url, r.Body, r.Header)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error forwarding /restore/next request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	body_bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading /restore/next response body: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && p.config.RestoreReconnect {
+		p.reconnect_after_restore()
+	}
+
+	copy_headers(resp.Header, w.Header())
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(body_bytes); err != nil {
+		component_logger(component_proxy).Error("Error writing restore response", "error", err)
+	}
+}
+
+func (p *RuntimeAPIProxy) handle_restore_error(w http.ResponseWriter, r *http.Request) {
+	url := runtime_api_url(p.api_versions.observe(r), "/runtime/restore/error")
+	component_logger(component_proxy).Warn("POST restore error", "url", url)
+	p.forward_and_respond(w, "POST", url, r.Body, r.Header)
+}
+
+// reconnect_after_restore replaces the connection that was snapshotted with
+// the sandbox.
+func (p *RuntimeAPIProxy) reconnect_after_restore() {
+	if p.transport == nil {
+		return
+	}
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(p.ctx, restore_reconnect_timeout)
+	defer cancel()
+	// The client still counts the snapshotted connection as open, and would
+	// keep it on Connect
+	p.transport.Close()
+	if !p.reconnect(ctx) {
+		component_logger(component_proxy).Warn("Could not reconnect after the restore, retrying in the background", "timeout", restore_reconnect_timeout)
+		return
+	}
+	_ = p.publish_lifecycle_event(ctx, "restored", map[string]interface{}{
+		"reconnect_ms": time.Since(started).Milliseconds(),
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterForwardsRestoreHooks(t *testing.T) {
+	received := start_recording_runtime_api(t)
+	router := new_tracking_proxy().router()
+
+	for _, call := range []struct{ method, path string }{
+		{http.MethodGet, "/2018-06-01/runtime/restore/next"},
+		{http.MethodPost, "/2018-06-01/runtime/restore/error"},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(call.method, call.path, strings.NewReader("{}")))
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("%s: expected the upstream status, got %d", call.path, recorder.Code)
+		}
+		select {
+		case posted := <-received:
+			if posted.path != call.path {
+				t.Fatalf("expected %s to be forwarded untouched, got %s", call.path, posted.path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for the upstream request", call.path)
+		}
+	}
+}
+
+func TestRestoreReconnectsTheTransport(t *testing.T) {
+	start_recording_runtime_api(t)
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.RestoreReconnect = true })
+
+	// The snapshot's connection is dead, but the client cannot tell yet
+	server.DropConnections()
+	recorder := httptest.NewRecorder()
+	proxy.router().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/2018-06-01/runtime/restore/next", nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected the upstream status, got %d", recorder.Code)
+	}
+	if connections, subscriptions := server.Counts(); connections != 1 || subscriptions != 2 {
+		t.Fatalf("expected a reconnect with the control and presence channels restored, got %d connections and %d subscriptions", connections, subscriptions)
+	}
+	wait_for_lifecycle_event(t, server, proxy, "restored")
+
+	// Off, restores are only forwarded
+	proxy.config.RestoreReconnect = false
+	server.DropConnections()
+	proxy.router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/2018-06-01/runtime/restore/next", nil))
+	if connections, _ := server.Counts(); connections != 0 {
+		t.Fatalf("expected no reconnect with the hook off, got %d connections", connections)
+	}
+}
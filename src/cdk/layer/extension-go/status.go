@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// GET /live-lambda/status on the proxy listener reports what the running
+// extension was built from: its version, the Go toolchain, the VCS revision
+// when the binary was built from a checkout, and every module compiled into
+// it (the AWS SDK, the WebSocket library, chi and so on) with its version and
+// go.sum checksum. The report is read from the build information Go embeds in
+// the binary, so platform and security teams can audit deployed layers across
+// a fleet without pulling the artifacts apart. The agent can ask every sandbox
+// of a function for it with a status_request frame on the control channel;
+// each answers with a status event on the lifecycle channel echoing the
+// request's request_id.
+
+const (
+	status_print_prefix = "[LiveLambdaExt:Status]"
+	status_path         = "/live-lambda/status"
+)
+
+type status_request struct {
+	RequestID string `json:"request_id"`
+}
+
+// build_dependency is a module compiled into the extension.
+type build_dependency struct {
+	Path       string            `json:"path"`
+	Version    string            `json:"version"`
+	Sum        string            `json:"sum,omitempty"`
+	ReplacedBy *build_dependency `json:"replaced_by,omitempty"`
+}
+
+func new_build_dependency(module *debug.Module) *build_dependency {
+	dependency := &build_dependency{Path: module.Path, Version: module.Version, Sum: module.Sum}
+	if module.Replace != nil {
+		dependency.ReplacedBy = new_build_dependency(module.Replace)
+	}
+	return dependency
+}
+
+// build_report describes the binary from its embedded build information. ok
+// is false when the binary has none, as with some test builds.
+func build_report(info *debug.BuildInfo, ok bool) map[string]interface{} {
+	report := map[string]interface{}{
+		"extension_version": extension_version,
+		"protocol_version":  current_protocol_version,
+	}
+	if !ok || info == nil {
+		report["dependencies"] = []*build_dependency{}
+		return report
+	}
+	report["go_version"] = info.GoVersion
+	report["module"] = info.Main.Path
+	vcs := map[string]string{}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			vcs["revision"] = setting.Value
+		case "vcs.time":
+			vcs["time"] = setting.Value
+		case "vcs.modified":
+			vcs["modified"] = setting.Value
+		}
+	}
+	if len(vcs) > 0 {
+		report["vcs"] = vcs
+	}
+	dependencies := make([]*build_dependency, 0, len(info.Deps))
+	for _, module := range info.Deps {
+		dependencies = append(dependencies, new_build_dependency(module))
+	}
+	report["dependencies"] = dependencies
+	return report
+}
+
+// running_build is the build report of this binary, read once.
+var running_build = sync.OnceValue(func() map[string]interface{} {
+	return build_report(debug.ReadBuildInfo())
+})
+
+// status_report is the build report with this sandbox's identity.
+func (p *RuntimeAPIProxy) status_report(request_id string) map[string]interface{} {
+	report := map[string]interface{}{
+		"sandbox_id":       p.sandbox_id,
+		"function_name":    p.function_name,
+		"function_version": p.config.FunctionVersion,
+	}
+	if request_id != "" {
+		report["request_id"] = request_id
+	}
+	for key, value := range running_build() {
+		report[key] = value
+	}
+	if stats := p.response_cache.stats(); stats != nil {
+		report["response_cache"] = stats
+	}
+	if p.redactor != nil {
+		report["redactions"] = p.redactor.redacted.Load()
+	}
+	return report
+}
+
+func (p *RuntimeAPIProxy) handle_status(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(p.status_report(""))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// register_status_handler answers status_request frames on the lifecycle channel.
+func (p *RuntimeAPIProxy) register_status_handler() {
+	p.control.register("status_request", func(frame json.RawMessage) {
+		var request status_request
+		if err := json.Unmarshal(frame, &request); err != nil {
+			log.Printf("%s Ignoring malformed status_request frame: %v", status_print_prefix, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+		defer cancel()
+		if err := p.publish_lifecycle_event(ctx, "status", p.status_report(request.RequestID)); err == nil {
+			log.Printf("%s Answered status request %s", status_print_prefix, request.RequestID)
+		}
+	})
+}
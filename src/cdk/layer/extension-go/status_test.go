@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+)
+
+func TestBuildReportListsDependencies(t *testing.T) {
+	info := &debug.BuildInfo{
+		GoVersion: "go1.24.2",
+		Main:      debug.Module{Path: "live-lambda-extension-go"},
+		Deps: []*debug.Module{
+			{Path: "github.com/go-chi/chi/v5", Version: "v5.2.1", Sum: "h1:abc="},
+			{Path: "nhooyr.io/websocket", Version: "v1.8.11", Replace: &debug.Module{Path: "../websocket", Version: "(devel)"}},
+		},
+		Settings: []debug.BuildSetting{{Key: "vcs.revision", Value: "2790ac7"}, {Key: "vcs.modified", Value: "false"}, {Key: "GOOS", Value: "linux"}},
+	}
+
+	report := build_report(info, true)
+	if report["go_version"] != "go1.24.2" || report["module"] != "live-lambda-extension-go" || report["extension_version"] != extension_version {
+		t.Fatalf("unexpected report %v", report)
+	}
+	vcs := report["vcs"].(map[string]string)
+	if vcs["revision"] != "2790ac7" || vcs["modified"] != "false" || len(vcs) != 2 {
+		t.Fatalf("unexpected vcs %v", vcs)
+	}
+	dependencies := report["dependencies"].([]*build_dependency)
+	if len(dependencies) != 2 || dependencies[0].Version != "v5.2.1" || dependencies[0].Sum != "h1:abc=" {
+		t.Fatalf("unexpected dependencies %+v", dependencies)
+	}
+	if dependencies[1].ReplacedBy == nil || dependencies[1].ReplacedBy.Path != "../websocket" {
+		t.Fatalf("expected the replacement to be reported, got %+v", dependencies[1])
+	}
+
+	if empty := build_report(nil, false); len(empty["dependencies"].([]*build_dependency)) != 0 {
+		t.Fatalf("expected no dependencies without build info, got %v", empty)
+	}
+}
+
+func TestStatusRoute(t *testing.T) {
+	p := &RuntimeAPIProxy{sandbox_id: "sb-1", function_name: "orders", config: Config{FunctionVersion: "3"}}
+	recorder := httptest.NewRecorder()
+	p.router().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, status_path, nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report["sandbox_id"] != "sb-1" || report["function_version"] != "3" {
+		t.Fatalf("unexpected report %v", report)
+	}
+	if _, ok := report["dependencies"].([]interface{}); !ok {
+		t.Fatalf("expected a dependency list, got %v", report["dependencies"])
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Telemetry forwarding
+//
+// The extension subscribes to the Lambda Telemetry API and receives batches of
+// platform, function and (optionally) extension log records on a local HTTP
+// listener. While a developer is present, the records are republished on
+// live-lambda/logs/{function} so the agent can show what CloudWatch would,
+// in real time. Records are dropped rather than queued without bound when the
+// agent is absent or AppSync cannot keep up. Runtimes without the Telemetry
+// API get the same forwarding through the Logs API (logs_api.go).
+
+const (
+	telemetry_print_prefix      = "[LiveLambdaExt:Telemetry]"
+	telemetry_schema_version    = "2022-12-13"
+	default_telemetry_port      = 4243
+	default_telemetry_types     = "platform,function"
+	telemetry_queue_size        = 64
+	max_telemetry_batch_records = 100
+	max_telemetry_batch_bytes   = 128 * 1024
+	telemetry_publish_timeout   = 5 * time.Second
+)
+
+// log_record is one record as the Telemetry and Logs APIs deliver it and as
+// the agent receives it.
+type log_record struct {
+	Time   string          `json:"time"`
+	Type   string          `json:"type"`
+	Record json.RawMessage `json:"record"`
+}
+
+type telemetry_destination struct {
+	Protocol string `json:"protocol"`
+	URI      string `json:"URI"`
+}
+
+type telemetry_buffering struct {
+	MaxItems  int `json:"maxItems"`
+	MaxBytes  int `json:"maxBytes"`
+	TimeoutMs int `json:"timeoutMs"`
+}
+
+type telemetry_subscription struct {
+	SchemaVersion string                `json:"schemaVersion"`
+	Destination   telemetry_destination `json:"destination"`
+	Types         []string              `json:"types"`
+	Buffering     telemetry_buffering   `json:"buffering"`
+}
+
+func new_telemetry_subscription(port int, types []string) telemetry_subscription {
+	return telemetry_subscription{
+		SchemaVersion: telemetry_schema_version,
+		Destination: telemetry_destination{
+			Protocol: "HTTP",
+			URI:      fmt.Sprintf("http://sandbox.localdomain:%d", port),
+		},
+		Types: types,
+		Buffering: telemetry_buffering{
+			MaxItems:  1000,
+			MaxBytes:  256 * 1024,
+			TimeoutMs: 100,
+		},
+	}
+}
+
+// parse_telemetry_types reads a comma-separated list of platform, function and extension.
+func parse_telemetry_types(value string) ([]string, error) {
+	var types []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		switch part {
+		case "":
+		case "platform", "function", "extension":
+			types = append(types, part)
+		default:
+			return nil, fmt.Errorf("unknown telemetry type %q", part)
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no telemetry types given")
+	}
+	return types, nil
+}
+
+// split_telemetry_batches groups events into batches small enough for one AppSync event.
+func split_telemetry_batches(events []log_record, max_records int, max_bytes int) [][]log_record {
+	var batches [][]log_record
+	var current []log_record
+	current_bytes := 0
+	for _, event := range events {
+		size := len(event.Time) + len(event.Type) + len(event.Record) + 40
+		if len(current) > 0 && (len(current) >= max_records || current_bytes+size > max_bytes) {
+			batches = append(batches, current)
+			current = nil
+			current_bytes = 0
+		}
+		current = append(current, event)
+		current_bytes += size
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// telemetry_forwarder receives Telemetry API batches and publishes them in the background.
+type telemetry_forwarder struct {
+	queue          chan []log_record
+	dropped        atomic.Int64
+	should_forward func() bool
+	publish        func(ctx context.Context, events []log_record) error
+	observe        func(events []log_record) // optional; sees every batch, forwarded or not
+}
+
+func new_telemetry_forwarder(should_forward func() bool, publish func(ctx context.Context, events []log_record) error) *telemetry_forwarder {
+	return &telemetry_forwarder{
+		queue:          make(chan []log_record, telemetry_queue_size),
+		should_forward: should_forward,
+		publish:        publish,
+	}
+}
+
+// ServeHTTP accepts a Telemetry API batch. It always answers quickly so the
+// platform never buffers on our behalf.
+func (f *telemetry_forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer w.WriteHeader(http.StatusOK)
+	var events []log_record
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		log.Printf("%s Ignoring malformed telemetry batch: %v", telemetry_print_prefix, err)
+		return
+	}
+	f.accept(events)
+}
+
+// accept queues a batch for publishing, dropping it when the queue is full.
+func (f *telemetry_forwarder) accept(events []log_record) {
+	if len(events) > 0 && f.observe != nil {
+		f.observe(events)
+	}
+	if len(events) == 0 || !f.should_forward() {
+		return
+	}
+	select {
+	case f.queue <- events:
+	default:
+		f.dropped.Add(int64(len(events)))
+	}
+}
+
+// run publishes queued batches until ctx is done.
+func (f *telemetry_forwarder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case events := <-f.queue:
+			for _, batch := range split_telemetry_batches(events, max_telemetry_batch_records, max_telemetry_batch_bytes) {
+				publish_ctx, cancel := context.WithTimeout(ctx, telemetry_publish_timeout)
+				if err := f.publish(publish_ctx, batch); err != nil {
+					f.dropped.Add(int64(len(batch)))
+				}
+				cancel()
+			}
+			if dropped := f.dropped.Swap(0); dropped > 0 {
+				log.Printf("%s Dropped %d telemetry records", telemetry_print_prefix, dropped)
+			}
+		}
+	}
+}
+
+// logs_topic returns the channel telemetry records are republished on.
+func (p *RuntimeAPIProxy) logs_topic() string {
+	return p.channel("logs/%s", p.function_name)
+}
+
+// publish_telemetry publishes a batch of records on the function's logs channel.
+func (p *RuntimeAPIProxy) publish_telemetry(ctx context.Context, events []log_record) error {
+	if p.transport == nil || !p.transport.IsConnected() {
+		return fmt.Errorf("transport is not connected")
+	}
+	p.redactor.scrub_records(events)
+	message := map[string]interface{}{
+		"sandbox_id":    p.sandbox_id,
+		"function_name": p.function_name,
+		"records":       events,
+	}
+	return p.transport.Publish(ctx, p.logs_topic(), []interface{}{message})
+}
+
+// start_telemetry starts the telemetry listener and subscribes to the Telemetry
+// API, or tails the function's output in cooperative mode.
+// LIVE_LAMBDA_TELEMETRY=off disables it.
+func (p *RuntimeAPIProxy) start_telemetry(ctx context.Context, extension_client *Client) {
+	if !p.config.Telemetry {
+		log.Printf("%s Telemetry forwarding disabled", telemetry_print_prefix)
+		return
+	}
+	types_value := p.config.TelemetryTypes
+	if types_value == "" {
+		types_value = default_telemetry_types
+	}
+	types, err := parse_telemetry_types(types_value)
+	if err != nil {
+		log.Printf("%s Invalid %s: %v. Telemetry forwarding disabled.", telemetry_print_prefix, live_lambda_telemetry_types_env, err)
+		return
+	}
+	port := p.config.TelemetryPort
+
+	forwarder := new_telemetry_forwarder(func() bool {
+		return p.transport != nil && p.transport.IsConnected() && p.presence.present() && !p.shedder.active()
+	}, p.publish_telemetry)
+	if p.output_tail != nil {
+		go forwarder.run(ctx)
+		go p.output_tail.run(ctx, forwarder, function_output_poll_interval)
+		log.Printf("%s Forwarding function output to %s", telemetry_print_prefix, p.logs_topic())
+		return
+	}
+	forwarder.observe = p.observe_platform_reports
+	server := &http.Server{
+		Addr:    fmt.Sprintf("sandbox.localdomain:%d", port),
+		Handler: forwarder,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("%s Telemetry listener error: %v", telemetry_print_prefix, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown_ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdown_ctx)
+	}()
+	go forwarder.run(ctx)
+
+	if err := extension_client.SubscribeTelemetry(ctx, new_telemetry_subscription(port, types)); err != nil {
+		log.Printf("%s Failed to subscribe to the Telemetry API, trying the Logs API: %v", telemetry_print_prefix, err)
+		if err := extension_client.SubscribeLogs(ctx, new_logs_subscription(port, types)); err != nil {
+			log.Printf("%s Failed to subscribe to the Logs API: %v", telemetry_print_prefix, err)
+			return
+		}
+		log.Printf("%s Forwarding %s logs from the Logs API to %s", telemetry_print_prefix, strings.Join(types, ","), p.logs_topic())
+		return
+	}
+	log.Printf("%s Forwarding %s telemetry to %s", telemetry_print_prefix, strings.Join(types, ","), p.logs_topic())
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cooperative telemetry
+//
+// APM extensions (Datadog, New Relic, Dynatrace, OpenTelemetry collectors and
+// others) subscribe to the Telemetry API too, and a function that runs several
+// subscribers can hit the Telemetry API's subscriber limit. With
+// LIVE_LAMBDA_TELEMETRY_COOPERATIVE=auto (the default) the extension looks for
+// a known APM extension in /opt/extensions or the environment; when it finds
+// one, or with on, it does not subscribe at all. The runtime wrapper instead
+// tees the function's stdout and stderr into a file in /tmp, which the
+// extension tails and forwards as function records. Platform records are not
+// available in this mode, so overhead reports are not published.
+
+const (
+	telemetry_cooperative_auto    = "auto"
+	telemetry_cooperative_on      = "on"
+	telemetry_cooperative_off     = "off"
+	lambda_extensions_dir         = "/opt/extensions"
+	function_output_path          = "/tmp/live-lambda-function-output.log" // keep in step with live-lambda-runtime-wrapper.sh
+	function_output_poll_interval = 200 * time.Millisecond
+	function_output_max_bytes     = 1024 * 1024 // the file is truncated once this much has been read
+)
+
+// apm_extension_names are fragments of known APM extension executable names.
+var apm_extension_names = []string{
+	"datadog", "newrelic", "dynatrace", "lumigo", "honeycomb", "elastic-apm",
+	"sumologic", "coralogix", "appdynamics", "splunk", "collector",
+}
+
+// apm_environment_markers are variables that only an APM extension's setup sets.
+var apm_environment_markers = map[string]string{
+	"DD_API_KEY":                          "datadog",
+	"DD_API_KEY_SECRET_ARN":               "datadog",
+	"NEW_RELIC_LAMBDA_EXTENSION_ENABLED":  "newrelic",
+	"DT_TENANT":                           "dynatrace",
+	"LUMIGO_TRACER_TOKEN":                 "lumigo",
+	"ELASTIC_APM_LAMBDA_APM_SERVER":       "elastic-apm",
+	"OPENTELEMETRY_COLLECTOR_CONFIG_URI":  "collector",
+	"OPENTELEMETRY_COLLECTOR_CONFIG_FILE": "collector",
+}
+
+// detect_apm_extensions returns the APM extensions found in extensions_dir or
+// announced by the environment, sorted and without duplicates.
+func detect_apm_extensions(extensions_dir string, getenv func(string) string) []string {
+	found := map[string]bool{}
+	if entries, err := os.ReadDir(extensions_dir); err == nil {
+		for _, entry := range entries {
+			name := strings.ToLower(entry.Name())
+			for _, apm := range apm_extension_names {
+				if strings.Contains(name, apm) {
+					found[apm] = true
+				}
+			}
+		}
+	}
+	for variable, apm := range apm_environment_markers {
+		if getenv(variable) != "" {
+			found[apm] = true
+		}
+	}
+	detected := make([]string, 0, len(found))
+	for apm := range found {
+		detected = append(detected, apm)
+	}
+	sort.Strings(detected)
+	return detected
+}
+
+// cooperative_telemetry reports whether to tail the function's output instead
+// of subscribing to the Telemetry API, and why.
+func cooperative_telemetry(mode string, detected []string) (bool, string) {
+	switch strings.ToLower(mode) {
+	case telemetry_cooperative_on:
+		return true, fmt.Sprintf("%s=on", live_lambda_telemetry_cooperative_env)
+	case telemetry_cooperative_off:
+		return false, ""
+	}
+	if len(detected) == 0 {
+		return false, ""
+	}
+	return true, "found " + strings.Join(detected, ", ")
+}
+
+// prepare_telemetry chooses the telemetry source. It runs before the extension
+// registers, so that the file the runtime wrapper tees into exists before the
+// runtime starts.
+func (p *RuntimeAPIProxy) prepare_telemetry() {
+	if !p.config.Telemetry {
+		return
+	}
+	cooperative, reason := cooperative_telemetry(p.config.TelemetryCooperative, detect_apm_extensions(lambda_extensions_dir, os.Getenv))
+	if !cooperative {
+		return
+	}
+	tail, err := new_function_output_tail(function_output_path)
+	if err != nil {
+		log.Printf("%s Could not create %s, subscribing to the Telemetry API: %v", telemetry_print_prefix, function_output_path, err)
+		return
+	}
+	log.Printf("%s Cooperative telemetry (%s): tailing the function's output instead of subscribing to the Telemetry API", telemetry_print_prefix, reason)
+	p.output_tail = tail
+}
+
+// function_output_tail reads the lines the runtime wrapper appends to a file.
+type function_output_tail struct {
+	path   string
+	offset int64
+	now    func() time.Time
+}
+
+// new_function_output_tail creates an empty file at path for the wrapper to append to.
+func new_function_output_tail(path string) (*function_output_tail, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		return nil, err
+	}
+	return &function_output_tail{path: path, now: time.Now}, nil
+}
+
+// read returns the complete lines appended since the last read as function
+// records. A partial last line is left for the next read. Once
+// function_output_max_bytes have been read the file is truncated; lines
+// written between the read and the truncation are lost.
+func (t *function_output_tail) read() ([]log_record, error) {
+	file, err := os.OpenFile(t.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < t.offset {
+		t.offset = 0
+	}
+	if info.Size() == t.offset {
+		return nil, nil
+	}
+	data := make([]byte, info.Size()-t.offset)
+	n, err := file.ReadAt(data, t.offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = data[:n]
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return nil, nil
+	}
+	t.offset += int64(end + 1)
+
+	timestamp := t.now().UTC().Format(time.RFC3339Nano)
+	var events []log_record
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		record, _ := json.Marshal(line)
+		events = append(events, log_record{Time: timestamp, Type: "function", Record: record})
+	}
+
+	if t.offset >= function_output_max_bytes && t.offset == info.Size() {
+		if err := file.Truncate(0); err == nil {
+			t.offset = 0
+		}
+	}
+	return events, nil
+}
+
+// run hands new lines to forwarder until ctx is done.
+func (t *function_output_tail) run(ctx context.Context, forwarder *telemetry_forwarder, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			events, err := t.read()
+			if err != nil {
+				log.Printf("%s Error reading %s: %v", telemetry_print_prefix, t.path, err)
+				continue
+			}
+			forwarder.accept(events)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectAPMExtensions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"datadog-agent", "live-lambda-extension-go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := map[string]string{"DT_TENANT": "abc", "DD_API_KEY": "key"}
+
+	detected := detect_apm_extensions(dir, func(name string) string { return env[name] })
+	if !reflect.DeepEqual(detected, []string{"datadog", "dynatrace"}) {
+		t.Fatalf("unexpected detection %v", detected)
+	}
+	if detected := detect_apm_extensions(filepath.Join(dir, "missing"), func(string) string { return "" }); len(detected) != 0 {
+		t.Fatalf("expected nothing, got %v", detected)
+	}
+}
+
+func TestCooperativeTelemetryMode(t *testing.T) {
+	cases := []struct {
+		mode     string
+		detected []string
+		want     bool
+	}{
+		{telemetry_cooperative_auto, nil, false},
+		{telemetry_cooperative_auto, []string{"datadog"}, true},
+		{telemetry_cooperative_on, nil, true},
+		{telemetry_cooperative_off, []string{"datadog"}, false},
+	}
+	for _, c := range cases {
+		if got, reason := cooperative_telemetry(c.mode, c.detected); got != c.want || got && reason == "" {
+			t.Errorf("%s with %v: got %v (%q)", c.mode, c.detected, got, reason)
+		}
+	}
+}
+
+func TestFunctionOutputTailReadsCompleteLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	tail, err := new_function_output_tail(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	append_output := func(text string) {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.WriteString(text)
+	}
+
+	append_output("START\nhello wor")
+	events, err := tail.read()
+	if err != nil || len(events) != 1 || string(events[0].Record) != `"START"` || events[0].Type != "function" {
+		t.Fatalf("unexpected events %+v (%v)", events, err)
+	}
+
+	append_output("ld\n")
+	events, _ = tail.read()
+	if len(events) != 1 || string(events[0].Record) != `"hello world"` {
+		t.Fatalf("expected the completed line, got %+v", events)
+	}
+	if events, _ := tail.read(); len(events) != 0 {
+		t.Fatalf("expected nothing new, got %+v", events)
+	}
+
+	// A large enough read truncates the file so /tmp does not fill up
+	append_output(strings.Repeat("x", function_output_max_bytes) + "\n")
+	if events, _ := tail.read(); len(events) != 1 {
+		t.Fatalf("expected one long line, got %d", len(events))
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 || tail.offset != 0 {
+		t.Fatalf("expected the file to be truncated, size %d offset %d", info.Size(), tail.offset)
+	}
+	append_output("after\n")
+	if events, _ := tail.read(); len(events) != 1 || string(events[0].Record) != `"after"` {
+		t.Fatalf("unexpected events after truncation %+v", events)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTelemetryTypes(t *testing.T) {
+	types, err := parse_telemetry_types(" platform, function ,extension")
+	if err != nil || strings.Join(types, ",") != "platform,function,extension" {
+		t.Fatalf("unexpected result: %v %v", types, err)
+	}
+	if _, err := parse_telemetry_types("platform,metrics"); err == nil {
+		t.Fatal("expected an unknown type to be rejected")
+	}
+	if _, err := parse_telemetry_types(" , "); err == nil {
+		t.Fatal("expected an empty list to be rejected")
+	}
+}
+
+func TestSplitTelemetryBatches(t *testing.T) {
+	events := make([]log_record, 5)
+	for i := range events {
+		events[i] = log_record{Time: "t", Type: "function", Record: json.RawMessage(`"` + strings.Repeat("x", 100) + `"`)}
+	}
+
+	if batches := split_telemetry_batches(events, 2, 1<<20); len(batches) != 3 || len(batches[2]) != 1 {
+		t.Fatalf("expected batches of 2,2,1 by count, got %d", len(batches))
+	}
+	if batches := split_telemetry_batches(events, 100, 310); len(batches) != 3 {
+		t.Fatalf("expected batches split by size, got %d", len(batches))
+	}
+	oversized := []log_record{{Record: json.RawMessage(`"` + strings.Repeat("y", 1000) + `"`)}}
+	if batches := split_telemetry_batches(oversized, 100, 300); len(batches) != 1 {
+		t.Fatalf("expected an oversized record to be sent on its own, got %d batches", len(batches))
+	}
+}
+
+func TestTelemetryForwarderPublishesWhileForwarding(t *testing.T) {
+	var mu sync.Mutex
+	var published [][]log_record
+	forwarding := true
+	forwarder := new_telemetry_forwarder(func() bool { return forwarding }, func(ctx context.Context, events []log_record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, events)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.run(ctx)
+
+	post := func(body string) int {
+		recorder := httptest.NewRecorder()
+		forwarder.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	if code := post(`[{"time":"2024-01-01T00:00:00Z","type":"function","record":"hello"}]`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	forwarding = false
+	post(`[{"time":"2024-01-01T00:00:01Z","type":"function","record":"ignored"}]`)
+	if code := post(`not json`); code != http.StatusOK {
+		t.Fatalf("expected malformed batches to be acknowledged, got %d", code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		count := len(published)
+		mu.Unlock()
+		if count > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != 1 || len(published[0]) != 1 || string(published[0][0].Record) != `"hello"` {
+		t.Fatalf("expected only the first record to be published, got %+v", published)
+	}
+}
+
+func TestSubscribeTelemetry(t *testing.T) {
+	var method, extension_id string
+	var subscription telemetry_subscription
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		extension_id = r.Header.Get(extension_identifier_header)
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &subscription)
+		if r.URL.Path != "/2022-07-01/telemetry" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewClient(strings.TrimPrefix(server.URL, "http://"))
+	client.extension_id = "ext-123"
+	if err := client.SubscribeTelemetry(context.Background(), new_telemetry_subscription(4243, []string{"platform", "function"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if method != http.MethodPut || extension_id != "ext-123" {
+		t.Fatalf("unexpected request: method=%s extension_id=%s", method, extension_id)
+	}
+	if subscription.SchemaVersion != telemetry_schema_version ||
+		subscription.Destination.URI != "http://sandbox.localdomain:4243" ||
+		strings.Join(subscription.Types, ",") != "platform,function" {
+		t.Fatalf("unexpected subscription: %+v", subscription)
+	}
+}
+
+func TestSubscribeLogsUsesTheLogsAPI(t *testing.T) {
+	var path string
+	var subscription telemetry_subscription
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &subscription)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewClient(strings.TrimPrefix(server.URL, "http://"))
+	if err := client.SubscribeLogs(context.Background(), new_logs_subscription(4243, []string{"platform", "function"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if path != "/2020-08-15/logs" || subscription.SchemaVersion != logs_api_schema_version || subscription.Destination.URI != "http://sandbox.localdomain:4243" {
+		t.Fatalf("unexpected subscription to %s: %+v", path, subscription)
+	}
+}
+
+func TestTelemetryForwarderReadsLogsAPIBatches(t *testing.T) {
+	var accepted []log_record
+	forwarder := new_telemetry_forwarder(func() bool { return false }, nil)
+	forwarder.observe = func(events []log_record) { accepted = events }
+
+	batch := `[{"time":"2020-08-20T12:31:32.123Z","type":"function","record":"hello\n"},` +
+		`{"time":"2020-08-20T12:31:33.123Z","type":"platform.report","record":{"requestId":"req-1","metrics":{"durationMs":12.5,"billedDurationMs":13}}}]`
+	forwarder.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(batch)))
+
+	if len(accepted) != 2 || accepted[1].Type != platform_report_type {
+		t.Fatalf("unexpected records %+v", accepted)
+	}
+	if report, ok := parse_platform_report(accepted[1]); !ok || report.RequestID != "req-1" || report.PlatformDurationMs != 12.5 {
+		t.Fatalf("expected the Logs API report to be understood, got %+v %v", report, ok)
+	}
+}
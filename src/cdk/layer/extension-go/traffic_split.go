@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Traffic splitting
+//
+// On a function serving real traffic, a developer chasing an intermittent
+// issue usually wants only some invocations on their machine while the rest
+// run the deployed code. LIVE_LAMBDA_INTERCEPT_WHEN selects invocations by
+// their event, as comma-separated predicates that must all hold:
+//
+//	header:X-Debug=1        a header, matched case-insensitively by name
+//	body.user.id=42         a dotted path into the event
+//	detail-type!=Heartbeat  negated
+//	queryStringParameters.trace
+//	                        the path is present and not null
+//
+// Paths descend into JSON strings, such as API Gateway bodies, and index
+// arrays by number (Records.0.eventSource). Header predicates look in headers
+// and then multiValueHeaders. LIVE_LAMBDA_SAMPLE_RATE (0 to 100, default 100)
+// then intercepts that percentage of the matching invocations at random.
+// Everything else passes through to the bundled handler, before adaptive
+// sampling (see sampling.go) counts it.
+
+const (
+	default_sample_rate   = 100
+	header_predicate_tag  = "header:"
+	predicate_not_equal   = "!="
+	predicate_equal       = "="
+	predicate_path_joiner = "."
+)
+
+// event_predicate is one condition of LIVE_LAMBDA_INTERCEPT_WHEN.
+type event_predicate struct {
+	source    string   // as written, for explanations
+	header    string   // lower-cased header name, for header: predicates
+	path      []string // the JSON path otherwise
+	value     string
+	has_value bool
+	negate    bool
+}
+
+// traffic_split selects the invocations offered to the agent. A nil
+// traffic_split admits every invocation.
+type traffic_split struct {
+	rate       float64 // percent
+	predicates []event_predicate
+	random     func() float64
+}
+
+// new_traffic_split_from_config returns nil when LIVE_LAMBDA_SAMPLE_RATE is
+// 100 and LIVE_LAMBDA_INTERCEPT_WHEN is empty. Validate has already checked
+// the predicates.
+func new_traffic_split_from_config(settings Config) *traffic_split {
+	predicates, _ := parse_event_predicates(settings.InterceptWhen)
+	if settings.SampleRate >= 100 && len(predicates) == 0 {
+		return nil
+	}
+	return &traffic_split{rate: settings.SampleRate, predicates: predicates, random: rand.Float64}
+}
+
+// with_rate returns a split sampling rate percent of the invocations that
+// match the predicates of s. A nil s has no predicates.
+func (s *traffic_split) with_rate(rate float64) *traffic_split {
+	var predicates []event_predicate
+	if s != nil {
+		predicates = s.predicates
+	}
+	if rate >= 100 && len(predicates) == 0 {
+		return nil
+	}
+	return &traffic_split{rate: rate, predicates: predicates, random: rand.Float64}
+}
+
+// parse_event_predicates parses the comma-separated predicates in spec.
+func parse_event_predicates(spec string) ([]event_predicate, error) {
+	var predicates []event_predicate
+	for _, source := range strings.Split(spec, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		predicate := event_predicate{source: source}
+		target := source
+		if index := strings.Index(source, predicate_not_equal); index >= 0 {
+			target, predicate.value = source[:index], source[index+len(predicate_not_equal):]
+			predicate.has_value, predicate.negate = true, true
+		} else if index := strings.Index(source, predicate_equal); index >= 0 {
+			target, predicate.value = source[:index], source[index+len(predicate_equal):]
+			predicate.has_value = true
+		}
+		target = strings.TrimSpace(target)
+		predicate.value = strings.TrimSpace(predicate.value)
+		if name, ok := strings.CutPrefix(target, header_predicate_tag); ok {
+			if name == "" {
+				return nil, fmt.Errorf("%q names no header", source)
+			}
+			predicate.header = strings.ToLower(name)
+		} else {
+			predicate.path = strings.Split(target, predicate_path_joiner)
+			for _, segment := range predicate.path {
+				if segment == "" {
+					return nil, fmt.Errorf("%q is not a dotted path", source)
+				}
+			}
+		}
+		predicates = append(predicates, predicate)
+	}
+	return predicates, nil
+}
+
+// admit reports whether the invocation with event is offered to the agent
+// and, if not, why.
+func (s *traffic_split) admit(event []byte) (bool, string) {
+	if s == nil {
+		return true, ""
+	}
+	if len(s.predicates) > 0 {
+		decoded, err := decode_event(event)
+		if err != nil {
+			return false, "the event is not JSON, so it cannot match the intercept predicates"
+		}
+		for _, predicate := range s.predicates {
+			if !predicate.matches(decoded) {
+				return false, fmt.Sprintf("the event does not match %s", predicate.source)
+			}
+		}
+	}
+	if s.rate < 100 && s.random()*100 >= s.rate {
+		return false, fmt.Sprintf("outside the %s%% sample", strconv.FormatFloat(s.rate, 'g', -1, 64))
+	}
+	return true, ""
+}
+
+// decode_event decodes an event for predicates, keeping numbers as written.
+func decode_event(event []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(event))
+	decoder.UseNumber()
+	var decoded interface{}
+	err := decoder.Decode(&decoded)
+	return decoded, err
+}
+
+func (p event_predicate) matches(event interface{}) bool {
+	var found interface{}
+	var ok bool
+	if p.header != "" {
+		found, ok = event_header(event, p.header)
+	} else {
+		found, ok = event_path(event, p.path)
+	}
+	if !p.has_value {
+		return ok && found != nil
+	}
+	return (ok && predicate_value(found) == p.value) != p.negate
+}
+
+// event_path walks path through event, parsing JSON strings on the way.
+func event_path(event interface{}, path []string) (interface{}, bool) {
+	current := event
+	for _, segment := range path {
+		if encoded, ok := current.(string); ok {
+			decoder := json.NewDecoder(strings.NewReader(encoded))
+			decoder.UseNumber()
+			if decoder.Decode(&current) != nil {
+				return nil, false
+			}
+		}
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// event_header looks name up in the event's headers, then in its
+// multiValueHeaders, ignoring case.
+func event_header(event interface{}, name string) (interface{}, bool) {
+	object, ok := event.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	for _, field := range []string{"headers", "multiValueHeaders"} {
+		headers, ok := object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range headers {
+			if strings.ToLower(key) != name {
+				continue
+			}
+			if values, ok := value.([]interface{}); ok {
+				if len(values) == 0 {
+					return nil, false
+				}
+				return values[0], true
+			}
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// predicate_value renders a value the way a predicate writes it: strings
+// bare, anything else as JSON.
+func predicate_value(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
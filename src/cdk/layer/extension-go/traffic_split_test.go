@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func new_test_split(t *testing.T, rate float64, spec string) *traffic_split {
+	t.Helper()
+	settings := default_config()
+	settings.SampleRate = rate
+	settings.InterceptWhen = spec
+	split := new_traffic_split_from_config(settings)
+	if split == nil {
+		t.Fatal("expected a traffic split")
+	}
+	return split
+}
+
+func TestTrafficSplitPredicates(t *testing.T) {
+	api_event := `{"headers":{"X-Debug":"1"},"multiValueHeaders":{"X-Tenant":["acme","other"]},"body":"{\"user\":{\"id\":42}}","Records":[{"eventSource":"aws:sqs"}]}`
+	for _, tc := range []struct {
+		spec string
+		want bool
+	}{
+		{"header:x-debug=1", true},
+		{"header:X-Debug=0", false},
+		{"header:x-tenant=acme", true},
+		{"header:X-Missing", false},
+		{"header:X-Missing!=1", true},
+		{"body.user.id=42", true},
+		{"body.user.id!=42", false},
+		{"body.user", true},
+		{"Records.0.eventSource=aws:sqs", true},
+		{"Records.1.eventSource", false},
+		{"header:X-Debug=1, body.user.id=7", false},
+	} {
+		admitted, reason := new_test_split(t, 100, tc.spec).admit([]byte(api_event))
+		if admitted != tc.want {
+			t.Errorf("%s: got %v (%s), want %v", tc.spec, admitted, reason, tc.want)
+		}
+	}
+
+	if admitted, _ := new_test_split(t, 100, "header:X-Debug").admit([]byte("not json")); admitted {
+		t.Fatal("expected a non-JSON event not to match")
+	}
+}
+
+func TestTrafficSplitSampleRate(t *testing.T) {
+	split := new_test_split(t, 25, "")
+	split.random = func() float64 { return 0.2 }
+	if admitted, _ := split.admit([]byte(`{}`)); !admitted {
+		t.Fatal("expected a draw below the rate to be intercepted")
+	}
+	split.random = func() float64 { return 0.3 }
+	admitted, reason := split.admit([]byte(`{}`))
+	if admitted || !strings.Contains(reason, "25%") {
+		t.Fatalf("expected a draw above the rate to pass through, got %v (%s)", admitted, reason)
+	}
+
+	// Predicates are checked before the draw
+	split = new_test_split(t, 50, "source=aws.events")
+	split.random = func() float64 { t.Fatal("unexpected draw"); return 0 }
+	if admitted, _ := split.admit([]byte(`{"source":"aws.s3"}`)); admitted {
+		t.Fatal("expected a non-matching event to pass through")
+	}
+
+	if new_traffic_split_from_config(default_config()) != nil {
+		t.Fatal("expected no traffic split by default")
+	}
+	var off *traffic_split
+	if admitted, _ := off.admit(nil); !admitted {
+		t.Fatal("expected a nil traffic split to admit everything")
+	}
+}
+
+func TestConfigValidateTrafficSplit(t *testing.T) {
+	base := map[string]string{lrap_runtime_api_endpoint_env: "127.0.0.1:9001"}
+	for name, value := range map[string]string{
+		live_lambda_sample_rate_env:    "101",
+		live_lambda_intercept_when_env: "body..id=1",
+	} {
+		env := map[string]string{name: value}
+		for k, v := range base {
+			env[k] = v
+		}
+		settings, err := load_config(lookup_from(env))
+		if err == nil {
+			err = settings.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected %s=%s to fail, got %v", name, value, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	appsyncwsclient "github.com/boundlessdigital/aws-appsync-events-websockets-client-go"
+)
+
+// The extension talks to the agent over a publish/subscribe Transport.
+// LIVE_LAMBDA_TRANSPORT selects the backend: appsync (default) uses the AppSync
+// Events API, authorized as LIVE_LAMBDA_APPSYNC_AUTH_MODE says; iot uses AWS IoT Core over MQTT on a WebSocket, at the endpoint
+// in LIVE_LAMBDA_IOT_ENDPOINT. Channel names are the same on both, e.g.
+// live-lambda/requests.
+
+const (
+	transport_print_prefix = "[LiveLambdaExt:Transport]"
+	transport_appsync      = "appsync"
+	transport_iot          = "iot"
+)
+
+// Transport publishes events to channels and delivers events published on
+// subscribed channels. Events are JSON values; subscribers receive each one
+// decoded, or as its JSON string.
+type Transport interface {
+	Connect(ctx context.Context) error
+	IsConnected() bool
+	Publish(ctx context.Context, channel string, events []interface{}) error
+	Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error)
+	Close() error
+}
+
+// TransportSubscription is an active subscription returned by Transport.Subscribe.
+type TransportSubscription interface {
+	Unsubscribe() error
+}
+
+// WithTransport uses transport instead of the one selected by LIVE_LAMBDA_TRANSPORT.
+func WithTransport(transport Transport) ProxyOption {
+	return func(o *proxy_options) {
+		o.transport = transport
+	}
+}
+
+// new_transport_from_config creates the transport named by settings.Transport,
+// pooled when settings.TransportPoolSize asks for several connections.
+func new_transport_from_config(aws_cfg aws.Config, settings Config, client_id string) (Transport, error) {
+	if settings.TransportPoolSize > 1 {
+		member_settings := settings
+		member_settings.TransportPoolSize = 1
+		return new_transport_pool(settings.TransportPoolSize, func(index int) (Transport, error) {
+			return new_transport_from_config(aws_cfg, member_settings, fmt.Sprintf("%s-%d", client_id, index))
+		})
+	}
+	switch strings.ToLower(settings.Transport) {
+	case "", transport_appsync:
+		if mode := strings.ToLower(settings.AppSyncAuthMode); mode != "" && mode != appsync_auth_iam {
+			return new_appsync_header_transport(settings)
+		}
+		return new_appsync_transport(aws_cfg, settings.AppSyncHTTPHost, settings.AppSyncRealtimeHost, settings.AppSyncRegion)
+	case transport_iot:
+		region := settings.IoTRegion
+		if region == "" {
+			region = settings.AppSyncRegion
+		}
+		log.Printf("%s Using AWS IoT Core at %s (%s)", transport_print_prefix, settings.IoTEndpoint, region)
+		return new_iot_transport(aws_cfg, settings.IoTEndpoint, region, client_id), nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", settings.Transport)
+	}
+}
+
+// appsync_transport adapts the AppSync Events WebSocket client to Transport.
+type appsync_transport struct {
+	*appsyncwsclient.Client
+	keep_alive_tracker // see connection_check.go
+}
+
+func new_appsync_transport(aws_cfg aws.Config, appsync_http_url string, appsync_realtime_url string, aws_region string) (*appsync_transport, error) {
+	transport := &appsync_transport{}
+	client_options := appsyncwsclient.ClientOptions{
+		AppSyncAPIHost:      appsync_http_url,     // e.g. <id>.appsync-api.<region>.amazonaws.com
+		AppSyncRealtimeHost: appsync_realtime_url, // e.g. <id>.appsync-realtime-api.<region>.amazonaws.com
+		AWSRegion:           aws_region,
+		AWSCfg:              aws_cfg,
+		Debug:               true, // Enable for detailed logging
+		KeepAliveInterval:   2 * time.Minute,
+		ReadTimeout:         10 * time.Minute, // Default in client is 15, AppSync server idle is often ~10 min
+		OperationTimeout:    30 * time.Second,
+		OnConnectionAck: func(msg appsyncwsclient.Message) {
+			log.Printf("%s [AppSyncWSClient CB] Connection Acknowledged. Timeout: %dms", main_print_prefix, *msg.ConnectionTimeoutMs)
+			transport.set_timeout(time.Duration(*msg.ConnectionTimeoutMs) * time.Millisecond)
+			transport.heard(time.Now())
+		},
+		OnConnectionError: func(msg appsyncwsclient.Message) {
+			log.Printf("%s [AppSyncWSClient CB] Connection Error: %s", main_print_prefix, msg.ToJSONString())
+		},
+		OnConnectionClose: func(code int, reason string) {
+			log.Printf("%s [AppSyncWSClient CB] Connection Closed. Code: %d, Reason: %s", main_print_prefix, code, reason)
+		},
+		OnKeepAlive: func() {
+			// log.Printf("%s [AppSyncWSClient CB] Keep-alive received.", main_print_prefix) // Can be noisy
+			transport.heard(time.Now())
+		},
+		OnGenericError: func(errMsg appsyncwsclient.MessageError) {
+			log.Printf("%s [AppSyncWSClient CB] Generic Error: Type=%s, Message=%s, Code=%v", main_print_prefix, errMsg.ErrorType, errMsg.Message, errMsg.ErrorCode)
+		},
+		OnSubscriptionError: func(subscriptionID string, errMsg appsyncwsclient.MessageError) {
+			log.Printf("%s [AppSyncWSClient CB] Subscription Error for ID '%s': Type=%s, Message=%s, Code=%v",
+				main_print_prefix, subscriptionID, errMsg.ErrorType, errMsg.Message, errMsg.ErrorCode)
+		},
+	}
+
+	client, err := appsyncwsclient.NewClient(client_options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AppSync WebSocket client: %w", err)
+	}
+	transport.Client = client
+	return transport, nil
+}
+
+func (t *appsync_transport) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error) {
+	subscription, err := t.Client.Subscribe(ctx, channel, on_data)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
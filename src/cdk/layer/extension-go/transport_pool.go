@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport pooling
+//
+// Every publish goes over one WebSocket, which a function invoked hundreds of
+// times a second can saturate. LIVE_LAMBDA_TRANSPORT_POOL_SIZE (default 1, at
+// most max_transport_pool_size) opens that many connections instead:
+//
+//   - publishes go round-robin over the connected members, and a member found
+//     disconnected is reconnected in the background;
+//   - subscriptions are all made on the first member, so events are not
+//     delivered once per connection. Subscribers of the same channel share one
+//     subscription, whose events are handed to each of them;
+//   - the pool counts as connected while the first member is, so the
+//     reconnect loop (see reconnect.go) restores it and its subscriptions.
+//
+// Regional endpoints (see regional.go) get a pool of the same size each.
+
+const (
+	default_transport_pool_size = 1
+	max_transport_pool_size     = 8
+	pool_reconnect_timeout      = 30 * time.Second
+)
+
+// transport_pool spreads publishes over several transports.
+type transport_pool struct {
+	members      []Transport
+	next         atomic.Uint64
+	reconnecting []atomic.Bool
+
+	mu       sync.Mutex
+	channels map[string]*shared_subscription
+	next_id  uint64
+}
+
+// shared_subscription is the first member's subscription to a channel and the
+// handlers it feeds.
+type shared_subscription struct {
+	subscription TransportSubscription
+	handlers     map[uint64]func(data_payload interface{})
+}
+
+// pooled_subscription is one subscriber's share of a shared_subscription.
+type pooled_subscription struct {
+	pool    *transport_pool
+	channel string
+	id      uint64
+}
+
+// new_transport_pool creates size members with new_member; the first member
+// carries the subscriptions.
+func new_transport_pool(size int, new_member func(index int) (Transport, error)) (Transport, error) {
+	pool := &transport_pool{reconnecting: make([]atomic.Bool, size), channels: map[string]*shared_subscription{}}
+	for i := 0; i < size; i++ {
+		member, err := new_member(i)
+		if err != nil {
+			return nil, fmt.Errorf("pool member %d: %w", i, err)
+		}
+		pool.members = append(pool.members, member)
+	}
+	if _, ok := pool.members[0].(keep_alive_reporter); ok {
+		return reporting_transport_pool{pool}, nil
+	}
+	return pool, nil
+}
+
+// Connect connects every member that is not connected. Only the first
+// member's failure is an error; the others are retried when next picked.
+func (t *transport_pool) Connect(ctx context.Context) error {
+	logger := component_logger(component_transport)
+	if !t.members[0].IsConnected() {
+		if err := t.members[0].Connect(ctx); err != nil {
+			return err
+		}
+		// The old subscriptions went down with the connection; subscribers
+		// subscribe again after a reconnect
+		t.mu.Lock()
+		t.channels = map[string]*shared_subscription{}
+		t.mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i, member := range t.members[1:] {
+		if member.IsConnected() {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, member Transport) {
+			defer wg.Done()
+			if err := member.Connect(ctx); err != nil {
+				logger.Warn("Could not connect a pooled connection; publishing over the others", "member", index, "error", err)
+			}
+		}(i+1, member)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (t *transport_pool) IsConnected() bool {
+	return t.members[0].IsConnected()
+}
+
+// pick returns the next connected member, reconnecting disconnected ones it
+// passes over in the background.
+func (t *transport_pool) pick() Transport {
+	for range t.members {
+		index := int(t.next.Add(1)-1) % len(t.members)
+		member := t.members[index]
+		if member.IsConnected() {
+			return member
+		}
+		if index > 0 {
+			t.reconnect_member(index)
+		}
+	}
+	return t.members[0]
+}
+
+// reconnect_member connects member index again, unless that is already under way.
+func (t *transport_pool) reconnect_member(index int) {
+	if !t.reconnecting[index].CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer t.reconnecting[index].Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), pool_reconnect_timeout)
+		defer cancel()
+		if err := t.members[index].Connect(ctx); err != nil {
+			component_logger(component_transport).Warn("Could not reconnect a pooled connection", "member", index, "error", err)
+		}
+	}()
+}
+
+func (t *transport_pool) Publish(ctx context.Context, channel string, events []interface{}) error {
+	return t.pick().Publish(ctx, channel, events)
+}
+
+// Subscribe adds on_data to the channel's shared subscription, subscribing the
+// first member when it is the channel's first subscriber.
+func (t *transport_pool) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	shared, ok := t.channels[channel]
+	if !ok {
+		shared = &shared_subscription{handlers: map[uint64]func(data_payload interface{}){}}
+		subscription, err := t.members[0].Subscribe(ctx, channel, func(data_payload interface{}) {
+			t.deliver(shared, data_payload)
+		})
+		if err != nil {
+			return nil, err
+		}
+		shared.subscription = subscription
+		t.channels[channel] = shared
+	}
+	t.next_id++
+	shared.handlers[t.next_id] = on_data
+	return &pooled_subscription{pool: t, channel: channel, id: t.next_id}, nil
+}
+
+// deliver hands an event to every handler of a shared subscription.
+func (t *transport_pool) deliver(shared *shared_subscription, data_payload interface{}) {
+	t.mu.Lock()
+	handlers := make([]func(data_payload interface{}), 0, len(shared.handlers))
+	for _, on_data := range shared.handlers {
+		handlers = append(handlers, on_data)
+	}
+	t.mu.Unlock()
+	for _, on_data := range handlers {
+		on_data(data_payload)
+	}
+}
+
+// Unsubscribe removes the subscriber, and the shared subscription with its last one.
+func (s *pooled_subscription) Unsubscribe() error {
+	t := s.pool
+	t.mu.Lock()
+	shared, ok := t.channels[s.channel]
+	if !ok {
+		t.mu.Unlock()
+		return nil
+	}
+	delete(shared.handlers, s.id)
+	if len(shared.handlers) > 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	delete(t.channels, s.channel)
+	t.mu.Unlock()
+	if shared.subscription == nil {
+		return nil
+	}
+	return shared.subscription.Unsubscribe()
+}
+
+func (t *transport_pool) Close() error {
+	var first error
+	for _, member := range t.members {
+		if err := member.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// reporting_transport_pool is a transport_pool whose first member sees the
+// server's keep-alives, which the connection check then judges the pool by.
+type reporting_transport_pool struct {
+	*transport_pool
+}
+
+func (t reporting_transport_pool) keep_alive() (time.Time, time.Duration) {
+	return t.members[0].(keep_alive_reporter).keep_alive()
+}
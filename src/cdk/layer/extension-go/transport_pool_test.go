@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"live-lambda-extension-go/internal/eventstest"
+)
+
+// new_test_transport_pool connects a pool of size members, each an AppSync
+// transport to its own eventstest server, so the servers show which member
+// carried what.
+func new_test_transport_pool(t *testing.T, size int) (*transport_pool, []*eventstest.Server) {
+	t.Helper()
+	var servers []*eventstest.Server
+	transport, err := new_transport_pool(size, func(index int) (Transport, error) {
+		server := new_events_server(t)
+		servers = append(servers, server)
+		return new_appsync_transport(events_aws_config(), server.Host(), server.Host(), "us-east-1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := transport.(reporting_transport_pool).transport_pool
+	t.Cleanup(func() { pool.Close() })
+	if err := pool.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return pool, servers
+}
+
+// next_event returns the next event a subscriber got, failing the test when
+// none arrives.
+func next_event(t *testing.T, events <-chan interface{}) interface{} {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return nil
+	}
+}
+
+// expect_no_event fails the test when a subscriber gets an event.
+func expect_no_event(t *testing.T, events <-chan interface{}) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Fatalf("expected no event, got %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// wait_for_disconnect waits until transport notices its connection ended.
+func wait_for_disconnect(t *testing.T, transport Transport) {
+	t.Helper()
+	for wait := time.Now().Add(5 * time.Second); transport.IsConnected(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(wait) {
+			t.Fatal("timed out waiting for the connection to end")
+		}
+	}
+}
+
+func TestTransportPoolPublishesRoundRobin(t *testing.T) {
+	pool, servers := new_test_transport_pool(t, 3)
+	for i := 0; i < 6; i++ {
+		if err := pool.Publish(context.Background(), "live-lambda/requests", []interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, server := range servers {
+		if got := len(server.Published("live-lambda/requests")); got != 2 {
+			t.Fatalf("expected member %d to publish 2 events, got %d", i, got)
+		}
+	}
+}
+
+func TestTransportPoolSkipsDisconnectedMembers(t *testing.T) {
+	pool, servers := new_test_transport_pool(t, 2)
+	servers[1].SetUnavailable("outage")
+	wait_for_disconnect(t, pool.members[1])
+
+	for i := 0; i < 4; i++ {
+		if err := pool.Publish(context.Background(), "live-lambda/requests", []interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if published := len(servers[0].Published("live-lambda/requests")); published < 3 {
+		t.Fatalf("expected the connected member to take the dropped one's share, published %d", published)
+	}
+}
+
+func TestTransportPoolSharesSubscriptions(t *testing.T) {
+	pool, servers := new_test_transport_pool(t, 2)
+	first, second := make(chan interface{}, 4), make(chan interface{}, 4)
+	first_subscription, err := pool.Subscribe(context.Background(), "live-lambda/control", func(data_payload interface{}) {
+		first <- data_payload
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Subscribe(context.Background(), "live-lambda/control", func(data_payload interface{}) {
+		second <- data_payload
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, subscriptions := servers[1].Counts(); subscriptions != 0 {
+		t.Fatal("expected only the first member to subscribe")
+	}
+	if _, subscriptions := servers[0].Counts(); subscriptions != 1 {
+		t.Fatalf("expected one subscription for both subscribers, got %d", subscriptions)
+	}
+
+	servers[0].Publish("live-lambda/control", "one")
+	next_event(t, first)
+	next_event(t, second)
+
+	if err := first_subscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	servers[0].Publish("live-lambda/control", "two")
+	next_event(t, second)
+	expect_no_event(t, first)
+}
+
+func TestTransportPoolResubscribesAfterReconnect(t *testing.T) {
+	pool, servers := new_test_transport_pool(t, 2)
+	received := make(chan interface{}, 4)
+	on_data := func(data_payload interface{}) { received <- data_payload }
+	if _, err := pool.Subscribe(context.Background(), "live-lambda/control", on_data); err != nil {
+		t.Fatal(err)
+	}
+
+	servers[0].SetUnavailable("outage")
+	wait_for_disconnect(t, pool)
+	servers[0].SetUnavailable("")
+	if err := pool.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Subscribe(context.Background(), "live-lambda/control", on_data); err != nil {
+		t.Fatal(err)
+	}
+	if _, subscriptions := servers[0].Counts(); subscriptions != 1 {
+		t.Fatalf("expected the first member to subscribe again, got %d subscriptions", subscriptions)
+	}
+	servers[0].Publish("live-lambda/control", "event")
+	next_event(t, received)
+	expect_no_event(t, received)
+}
+
+func TestTransportPoolSizeFromConfig(t *testing.T) {
+	settings := default_config()
+	settings.Transport = transport_iot
+	settings.IoTEndpoint = "example-ats.iot.us-east-1.amazonaws.com"
+	settings.IoTRegion = "us-east-1"
+	settings.TransportPoolSize = 3
+	transport, err := new_transport_from_config(aws.Config{}, settings, "live-lambda-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, ok := transport.(*transport_pool)
+	if !ok {
+		t.Fatalf("expected a pool, got %T", transport)
+	}
+	if len(pool.members) != 3 {
+		t.Fatalf("expected 3 members, got %d", len(pool.members))
+	}
+	if iot := pool.members[2].(*iot_transport); iot.client_id != "live-lambda-sandbox-2" {
+		t.Fatalf("expected each member to have its own client ID, got %q", iot.client_id)
+	}
+
+	settings, _ = load_config(lookup_from(map[string]string{
+		live_lambda_transport_pool_size_env: "9",
+		lrap_runtime_api_endpoint_env:       "127.0.0.1:9001",
+	}))
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), live_lambda_transport_pool_size_env) {
+		t.Fatalf("expected an oversized pool to be rejected, got %v", err)
+	}
+}
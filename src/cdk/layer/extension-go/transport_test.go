@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+type fake_transport struct{ published []string }
+
+func (f *fake_transport) Connect(ctx context.Context) error { return nil }
+func (f *fake_transport) IsConnected() bool                 { return true }
+func (f *fake_transport) Close() error                      { return nil }
+
+func (f *fake_transport) Publish(ctx context.Context, channel string, events []interface{}) error {
+	f.published = append(f.published, channel)
+	return nil
+}
+
+func (f *fake_transport) Subscribe(ctx context.Context, channel string, on_data func(data_payload interface{})) (TransportSubscription, error) {
+	return nil, nil
+}
+
+func TestNewRuntimeAPIProxyUsesInjectedTransport(t *testing.T) {
+	t.Setenv(live_lambda_tag_lookup_env, "off")
+	transport := &fake_transport{}
+	provider := credentials.NewStaticCredentialsProvider("AKID", "secret", "")
+
+	proxy, err := NewRuntimeAPIProxy(context.Background(), "127.0.0.1:9001", "api.example.com", "realtime.example.com", "eu-west-1", "9009", WithCredentialsProvider(provider), WithTransport(transport))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := proxy.publish_lifecycle_event(context.Background(), "test", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(transport.published) != 1 {
+		t.Fatalf("expected the event on the injected transport, got %v", transport.published)
+	}
+}
+
+func TestTransportSelection(t *testing.T) {
+	settings := default_config()
+	settings.AppSyncRegion = "eu-west-1"
+	settings.Transport = transport_iot
+	settings.IoTEndpoint = "abc-ats.iot.eu-west-1.amazonaws.com"
+
+	transport, err := new_transport_from_config(aws.Config{}, settings, "live-lambda-sandbox")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	iot, ok := transport.(*iot_transport)
+	if !ok || iot.region != "eu-west-1" || iot.client_id != "live-lambda-sandbox" {
+		t.Fatalf("expected an IoT transport in the AppSync region, got %#v", transport)
+	}
+
+	settings.Transport = "kinesis"
+	if _, err := new_transport_from_config(aws.Config{}, settings, "c"); err == nil {
+		t.Fatal("expected an unknown transport to fail")
+	}
+}
+
+func TestConfigValidateIoTTransport(t *testing.T) {
+	settings, _ := load_config(lookup_from(map[string]string{
+		live_lambda_transport_env:     "iot",
+		lrap_runtime_api_endpoint_env: "127.0.0.1:9001",
+	}))
+	err := settings.Validate()
+	if err == nil || !strings.Contains(err.Error(), live_lambda_iot_endpoint_env) {
+		t.Fatalf("expected the IoT endpoint to be required, got %v", err)
+	}
+	if strings.Contains(err.Error(), live_lambda_appsync_http_host_env) {
+		t.Errorf("expected the AppSync hosts not to be required, got %v", err)
+	}
+}
+
+func TestPresignIoTURL(t *testing.T) {
+	cfg := aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "to+ken")}
+	signed, err := presign_iot_url(context.Background(), cfg, "abc-ats.iot.eu-west-1.amazonaws.com", "eu-west-1", time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(signed, "wss://abc-ats.iot.eu-west-1.amazonaws.com/mqtt?") {
+		t.Fatalf("unexpected URL %s", signed)
+	}
+	query := strings.SplitN(signed, "?", 2)[1]
+	if !strings.HasSuffix(query, "X-Amz-Security-Token=to%2Bken") {
+		t.Errorf("expected the session token to be appended after signing, got %s", query)
+	}
+	if values, _ := url.ParseQuery(query); values.Get("X-Amz-Security-Token") != "to+ken" {
+		t.Errorf("expected the session token to round-trip, got %q", values.Get("X-Amz-Security-Token"))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A sandbox on a bad network path fails every invocation it tries to hand to
+// the agent, and each failure costs the fallback policy's retries before the
+// invocation is passed through. Once LIVE_LAMBDA_TUNNEL_FAILURE_LIMIT tunnel
+// failures (subscribe or publish errors) happen within
+// LIVE_LAMBDA_TUNNEL_FAILURE_WINDOW, the breaker trips: interception is
+// hard-disabled for the rest of the sandbox's lifetime, an
+// interception_auto_disabled lifecycle event is published and the roster
+// reports the sandbox as auto-disabled. Response timeouts do not count, since
+// a developer paused at a breakpoint looks the same.
+
+const (
+	tunnel_breaker_print_prefix    = "[LiveLambdaExt:TunnelBreaker]"
+	default_tunnel_failure_limit   = 5
+	default_tunnel_failure_window  = 5 * time.Minute
+	tunnel_breaker_publish_timeout = 5 * time.Second
+)
+
+type tunnel_breaker struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	failures []time.Time
+	tripped  bool
+	now      func() time.Time
+}
+
+func new_tunnel_breaker(limit int, window time.Duration) *tunnel_breaker {
+	return &tunnel_breaker{limit: limit, window: window, now: time.Now}
+}
+
+// new_tunnel_breaker_from_config returns nil when LIVE_LAMBDA_TUNNEL_FAILURE_LIMIT is 0.
+func new_tunnel_breaker_from_config(settings Config) *tunnel_breaker {
+	if settings.TunnelFailureLimit <= 0 {
+		return nil
+	}
+	return new_tunnel_breaker(settings.TunnelFailureLimit, settings.TunnelFailureWindow)
+}
+
+// record_failure counts a tunnel failure and returns true when it trips the
+// breaker. A nil breaker never trips.
+func (b *tunnel_breaker) record_failure() (tripped bool) {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped {
+		return false
+	}
+	now := b.now()
+	recent := b.failures[:0]
+	for _, at := range b.failures {
+		if now.Sub(at) < b.window {
+			recent = append(recent, at)
+		}
+	}
+	b.failures = append(recent, now)
+	b.tripped = len(b.failures) >= b.limit
+	return b.tripped
+}
+
+// is_tripped reports whether the breaker has disabled interception.
+func (b *tunnel_breaker) is_tripped() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tripped
+}
+
+// record_tunnel_failure feeds a failed handoff to the breaker and disables
+// interception for good when it trips.
+func (p *RuntimeAPIProxy) record_tunnel_failure(cause error) {
+	if !p.tunnel_breaker.record_failure() {
+		return
+	}
+	reason := fmt.Sprintf("%d tunnel failures within %s", p.tunnel_breaker.limit, p.tunnel_breaker.window)
+	p.interception.disable_hard(reason)
+	log.Printf("%s Disabling interception for this sandbox after %s; last error: %v", tunnel_breaker_print_prefix, reason, cause)
+	go func() {
+		ctx, cancel := context.WithTimeout(p.ctx, tunnel_breaker_publish_timeout)
+		defer cancel()
+		// Best effort: the tunnel that just failed may not carry this either
+		_ = p.publish_lifecycle_event(ctx, "interception_auto_disabled", map[string]interface{}{
+			"reason":         reason,
+			"failures":       p.tunnel_breaker.limit,
+			"window_seconds": p.tunnel_breaker.window.Seconds(),
+			"last_error":     cause.Error(),
+		})
+	}()
+}
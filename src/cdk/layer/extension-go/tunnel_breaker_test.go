@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTunnelBreakerTripsWithinWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	breaker := new_tunnel_breaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	breaker.record_failure()
+	now = now.Add(2 * time.Minute)
+	if breaker.record_failure() || breaker.record_failure() {
+		t.Fatal("expected failures outside the window not to count")
+	}
+	now = now.Add(10 * time.Second)
+	if !breaker.record_failure() {
+		t.Fatal("expected the third failure within the window to trip the breaker")
+	}
+	if breaker.record_failure() {
+		t.Fatal("expected the breaker to trip only once")
+	}
+	if !breaker.is_tripped() {
+		t.Fatal("expected the breaker to stay tripped")
+	}
+}
+
+func TestNilTunnelBreakerNeverTrips(t *testing.T) {
+	var breaker *tunnel_breaker
+	if breaker.record_failure() || breaker.is_tripped() {
+		t.Fatal("expected a disabled breaker never to trip")
+	}
+	if new_tunnel_breaker_from_config(Config{TunnelFailureLimit: 0}) != nil {
+		t.Fatal("expected a limit of 0 to disable the breaker")
+	}
+}
+
+func TestTunnelFailuresDisableInterception(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &RuntimeAPIProxy{
+		ctx:            ctx,
+		agent_capacity: new_agent_capacity(),
+		interception:   new_interception_switch(),
+		tunnel_breaker: new_tunnel_breaker(2, time.Minute),
+	}
+
+	p.fall_back("r1", errors.New("publish failed"))
+	if enabled, _ := p.interception.enabled(); !enabled {
+		t.Fatal("expected one failure to leave interception enabled")
+	}
+	p.fall_back("r2", errors.New("publish failed"))
+	if !p.interception.hard_disabled() {
+		t.Fatal("expected repeated failures to hard-disable interception")
+	}
+	entry := p.roster_entry("roster", time.Now())
+	if entry["auto_disabled"] != true || entry["disabled_reason"] != "2 tunnel failures within 1m0s" {
+		t.Fatalf("expected the roster to report the decision: %v", entry)
+	}
+}
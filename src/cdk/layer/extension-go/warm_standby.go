@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idle sandboxes and warm standby
+//
+// Lambda freezes a sandbox between invocations, WebSocket keep-alives
+// included, and a provisioned concurrency sandbox may sit initialized for
+// hours before its first invocation. By then AppSync has usually closed the
+// connection, but the transport only notices once a publish fails, so the
+// first invocation after a long idle would be published into a dead
+// connection and wait for its deadline.
+//
+// The proxy notes when the runtime asks for the next invocation. When /next
+// returns after LIVE_LAMBDA_IDLE_RECONNECT_AFTER (default 5m) or longer, it
+// pings the connection by publishing a presence probe, bounded by
+// idle_ping_timeout. If the ping fails, it closes the transport and waits up
+// to idle_reconnect_timeout for watch_connection to reconnect and restore the
+// control and presence subscriptions before it decides whether to intercept
+// the invocation. Both waits end at the invocation's deadline.
+// LIVE_LAMBDA_IDLE_RECONNECT_AFTER=off disables the check.
+//
+// Warm standby goes further for the first invocation after an idle period:
+// when the agent's heartbeats have expired while the sandbox was frozen, the
+// invocation waits up to warm_standby_presence_wait for the agent to answer
+// the probe, so it reaches a running agent instead of passing through to the
+// function. LIVE_LAMBDA_WARM_STANDBY=auto (the default) turns it on for
+// sandboxes initialized for provisioned concurrency, whose
+// AWS_LAMBDA_INITIALIZATION_TYPE is provisioned-concurrency; on and off force
+// it either way.
+
+const (
+	default_idle_reconnect_after      = 5 * time.Minute
+	warm_standby_auto                 = "auto"
+	warm_standby_on                   = "on"
+	warm_standby_off                  = "off"
+	provisioned_concurrency_init_type = "provisioned-concurrency"
+	idle_ping_timeout                 = 2 * time.Second
+	idle_reconnect_timeout            = 5 * time.Second
+	warm_standby_presence_wait        = 500 * time.Millisecond
+	idle_poll_interval                = 25 * time.Millisecond
+)
+
+// idle_watch checks the connection after the sandbox has been idle. A nil
+// idle_watch checks nothing.
+type idle_watch struct {
+	after   time.Duration
+	standby bool
+
+	mu         sync.Mutex // held for a whole check, so concurrent /next calls ping once
+	checked_at time.Time
+}
+
+// new_idle_watch_from_config returns nil when LIVE_LAMBDA_IDLE_RECONNECT_AFTER
+// is off.
+func new_idle_watch_from_config(settings Config) *idle_watch {
+	if settings.IdleReconnectAfter <= 0 {
+		return nil
+	}
+	w := &idle_watch{after: settings.IdleReconnectAfter}
+	switch strings.ToLower(settings.WarmStandby) {
+	case warm_standby_on:
+		w.standby = true
+	case warm_standby_auto:
+		w.standby = settings.FunctionInitType == provisioned_concurrency_init_type
+	}
+	if w.standby {
+		component_logger(component_transport).Info("Warm standby on", "presence_wait", warm_standby_presence_wait, "idle_after", w.after)
+	}
+	return w
+}
+
+// after_idle runs the idle check before an invocation that arrived after the
+// sandbox had been waiting for idle.
+func (p *RuntimeAPIProxy) after_idle(ctx context.Context, request_id string, idle time.Duration) {
+	w := p.idle
+	if w == nil || idle < w.after || p.transport == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.checked_at.IsZero() && time.Since(w.checked_at) < w.after {
+		// Another invocation checked while this one waited for the lock
+		return
+	}
+	defer func() { w.checked_at = time.Now() }()
+
+	logger := request_logger(request_id)
+	if err := p.ping_transport(ctx); err != nil {
+		logger.Info("The connection did not survive the idle period, reconnecting", "idle", idle.Round(time.Second), "error", err)
+		p.explain(request_id, "idle_reconnect", "idle for %s: %v", idle.Round(time.Second), err)
+		p.transport.Close()
+		if !wait_until(ctx, idle_reconnect_timeout, p.transport.IsConnected) {
+			logger.Warn("Could not reconnect after the idle period", "timeout", idle_reconnect_timeout)
+			return
+		}
+		if w.standby {
+			// The probe the ping published went out on the dead connection
+			p.ping_transport(ctx)
+		}
+	}
+	if w.standby && !p.presence.present() {
+		if wait_until(ctx, warm_standby_presence_wait, p.presence.present) {
+			logger.Info("The agent answered the warm standby probe", "agent_id", p.presence.agent())
+		}
+	}
+}
+
+// ping_transport publishes a presence probe, which doubles as a check that the
+// connection is alive.
+func (p *RuntimeAPIProxy) ping_transport(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, idle_ping_timeout)
+	defer cancel()
+	return p.transport.Publish(ctx, p.presence_topic(), []interface{}{p.presence_probe()})
+}
+
+// wait_until polls condition until it holds, timeout passes or ctx ends, and
+// reports whether it held.
+func wait_until(ctx context.Context, timeout time.Duration, condition func() bool) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(idle_poll_interval)
+	defer ticker.Stop()
+	for {
+		if condition() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
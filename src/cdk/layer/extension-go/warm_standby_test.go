@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleWatchFromConfig(t *testing.T) {
+	settings := default_config()
+	if w := new_idle_watch_from_config(settings); w == nil || w.standby {
+		t.Fatalf("expected an idle check without warm standby for on-demand sandboxes, got %+v", w)
+	}
+	settings.FunctionInitType = provisioned_concurrency_init_type
+	if w := new_idle_watch_from_config(settings); w == nil || !w.standby {
+		t.Fatalf("expected warm standby for provisioned concurrency, got %+v", w)
+	}
+	settings.WarmStandby = warm_standby_off
+	if w := new_idle_watch_from_config(settings); w.standby {
+		t.Fatal("expected warm standby to be off")
+	}
+	settings.IdleReconnectAfter = 0
+	if w := new_idle_watch_from_config(settings); w != nil {
+		t.Fatalf("expected no idle check, got %+v", w)
+	}
+}
+
+func TestAfterIdleReconnectsAStaleConnection(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) { settings.IdleReconnectAfter = time.Minute })
+	ctx := proxy.ctx
+
+	probes := len(server.Published(proxy.presence_topic()))
+	proxy.after_idle(ctx, "req-1", time.Second)
+	if len(server.Published(proxy.presence_topic())) != probes {
+		t.Fatal("expected no ping after a short idle")
+	}
+
+	// The server closed the connection while the sandbox idled
+	server.DropConnections()
+	proxy.after_idle(ctx, "req-2", 10*time.Minute)
+	if connections, _ := server.Counts(); !proxy.transport.IsConnected() || connections != 1 {
+		t.Fatalf("expected the invocation to wait for a reconnect, got %d connections", connections)
+	}
+	// The control and presence channels
+	wait_for_subscriptions(t, server, 2)
+	steps, _ := proxy.explanations.lookup("req-2")
+	if len(steps) != 1 || steps[0].Decision != "idle_reconnect" {
+		t.Fatalf("unexpected explanation %+v", steps)
+	}
+}
+
+func TestWarmStandbyWaitsForTheAgent(t *testing.T) {
+	server := new_events_server(t)
+	proxy := new_events_proxy(t, server, func(settings *Config) {
+		settings.IdleReconnectAfter = time.Minute
+		settings.WarmStandby = warm_standby_on
+	})
+	events_agent(server, "orders")
+	wait_for_agent(t, proxy)
+	proxy.presence.mark_absent("agent-1")
+	probes := len(server.Published(proxy.presence_topic()))
+
+	proxy.after_idle(proxy.ctx, "req-1", time.Hour)
+	if !proxy.presence.present() {
+		t.Fatal("expected the invocation to wait for the agent's heartbeat")
+	}
+	if got := len(server.Published(proxy.presence_topic())) - probes; got != 1 {
+		t.Fatalf("expected one probe, got %d", got)
+	}
+}
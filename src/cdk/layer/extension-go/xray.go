@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// X-Ray trace propagation
+//
+// Lambda hands each invocation its trace header in Lambda-Runtime-Trace-Id
+// (Root=1-...;Parent=...;Sampled=1). When the invocation is sampled and
+// LIVE_LAMBDA_XRAY is on (the default), the extension opens a subsegment for
+// the detour through the developer's workstation and publishes the header with
+// that subsegment as its Parent in the request envelope:
+//
+//	{"trace": {"header": "Root=1-...;Parent=<subsegment>;Sampled=1"}}
+//
+// so calls the handler makes from the workstation nest under it. An agent
+// with the xray capability may return its own subsegments in the response
+// envelope, {"type": "response", ..., "trace": {"subsegments": [...]}}, and
+// they are nested under the remote execution subsegment. Once the response
+// arrives, or the invocation reaches its deadline, the subsegment is sent to
+// the X-Ray daemon at AWS_XRAY_DAEMON_ADDRESS over UDP. Unsampled invocations
+// carry Lambda's header unchanged and emit nothing.
+
+const (
+	xray_subsegment_name     = "live-lambda remote execution"
+	xray_daemon_header       = `{"format": "json", "version": 1}` + "\n"
+	max_xray_document_bytes  = 62 * 1024 // a UDP datagram to the daemon must stay under 64KB
+	max_agent_subsegments    = 64
+	xray_outcome_responded   = "responded"
+	xray_outcome_error       = "error"
+	xray_outcome_timeout     = "timeout"
+	xray_trace_header_root   = "Root"
+	xray_trace_header_parent = "Parent"
+)
+
+// xray_trace_header is a parsed Lambda-Runtime-Trace-Id header.
+type xray_trace_header struct {
+	root    string
+	parent  string
+	sampled bool
+	fields  []string // every key=value pair, in order
+}
+
+// parse_xray_trace_header parses value, reporting false when it has no Root.
+func parse_xray_trace_header(value string) (xray_trace_header, bool) {
+	var header xray_trace_header
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, val, _ := strings.Cut(field, "=")
+		switch key {
+		case xray_trace_header_root:
+			header.root = val
+		case xray_trace_header_parent:
+			header.parent = val
+		case "Sampled":
+			header.sampled = val == "1"
+		}
+		header.fields = append(header.fields, field)
+	}
+	return header, header.root != ""
+}
+
+// with_parent returns the header with parent as its Parent.
+func (h xray_trace_header) with_parent(parent string) string {
+	fields := make([]string, 0, len(h.fields)+1)
+	replaced := false
+	for _, field := range h.fields {
+		if strings.HasPrefix(field, xray_trace_header_parent+"=") {
+			field = xray_trace_header_parent + "=" + parent
+			replaced = true
+		}
+		fields = append(fields, field)
+	}
+	if !replaced {
+		fields = append(fields, xray_trace_header_parent+"="+parent)
+	}
+	return strings.Join(fields, ";")
+}
+
+// new_xray_id returns a 64-bit segment ID as 16 hex digits.
+func new_xray_id() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// xray_trace is the remote execution subsegment opened for one invocation.
+type xray_trace struct {
+	header        xray_trace_header
+	subsegment_id string
+}
+
+// propagated_header is the trace header the agent should use.
+func (t *xray_trace) propagated_header() string {
+	return t.header.with_parent(t.subsegment_id)
+}
+
+// remote_trace is the trace data an agent returns in its response envelope.
+type remote_trace struct {
+	Subsegments []map[string]interface{} `json:"subsegments"`
+}
+
+// parse_xray_daemon_address returns the UDP address in AWS_XRAY_DAEMON_ADDRESS,
+// which is either host:port or "tcp:host:port udp:host:port".
+func parse_xray_daemon_address(value string) (string, error) {
+	for _, part := range strings.Fields(value) {
+		if address, ok := strings.CutPrefix(part, "udp:"); ok {
+			value = address
+			break
+		}
+	}
+	if strings.HasPrefix(value, "tcp:") {
+		return "", fmt.Errorf("%q has no UDP address", value)
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		return "", fmt.Errorf("%q is not host:port: %w", value, err)
+	}
+	return value, nil
+}
+
+type xray_emitter struct {
+	mu            sync.Mutex
+	address       string
+	conn          net.Conn // dialled on the first send
+	function_name string
+	sandbox_id    string
+	new_id        func() string
+}
+
+// new_xray_emitter_from_config returns nil when LIVE_LAMBDA_XRAY is off or
+// there is no X-Ray daemon, as when active tracing is disabled.
+func new_xray_emitter_from_config(settings Config, sandbox_id string) *xray_emitter {
+	if !settings.XRay || settings.XRayDaemonAddress == "" {
+		return nil
+	}
+	address, err := parse_xray_daemon_address(settings.XRayDaemonAddress)
+	if err != nil {
+		component_logger(component_xray).Warn("Not emitting subsegments", "error", err)
+		return nil
+	}
+	return &xray_emitter{
+		address:       address,
+		function_name: settings.FunctionName,
+		sandbox_id:    sandbox_id,
+		new_id:        new_xray_id,
+	}
+}
+
+// start opens a remote execution subsegment for an invocation with the given
+// trace header. It returns nil when the invocation is not sampled.
+func (e *xray_emitter) start(trace_header string) *xray_trace {
+	if e == nil {
+		return nil
+	}
+	header, ok := parse_xray_trace_header(trace_header)
+	if !ok || !header.sampled || header.parent == "" {
+		return nil
+	}
+	return &xray_trace{header: header, subsegment_id: e.new_id()}
+}
+
+// remote_execution_document builds the subsegment for trace from started to
+// ended, nesting the agent's subsegments when there are any.
+func (e *xray_emitter) remote_execution_document(trace *xray_trace, started, ended time.Time, outcome string, annotations map[string]interface{}, remote *remote_trace) map[string]interface{} {
+	annotations["live_lambda_outcome"] = outcome
+	document := map[string]interface{}{
+		"type":        "subsegment",
+		"id":          trace.subsegment_id,
+		"trace_id":    trace.header.root,
+		"parent_id":   trace.header.parent,
+		"name":        xray_subsegment_name,
+		"namespace":   "remote",
+		"start_time":  xray_time(started),
+		"end_time":    xray_time(ended),
+		"annotations": annotations,
+		"metadata": map[string]interface{}{
+			"live_lambda": map[string]interface{}{
+				"function_name": e.function_name,
+				"sandbox_id":    e.sandbox_id,
+			},
+		},
+	}
+	switch outcome {
+	case xray_outcome_error:
+		document["error"] = true
+	case xray_outcome_timeout:
+		document["fault"] = true
+	}
+	if remote != nil {
+		if subsegments := e.agent_subsegments(remote.Subsegments); len(subsegments) > 0 {
+			document["subsegments"] = subsegments
+		}
+	}
+	return document
+}
+
+// agent_subsegments keeps the agent's subsegments that have a name and times,
+// giving an ID to those without one.
+func (e *xray_emitter) agent_subsegments(subsegments []map[string]interface{}) []map[string]interface{} {
+	var kept []map[string]interface{}
+	for _, subsegment := range subsegments {
+		if len(kept) == max_agent_subsegments {
+			break
+		}
+		name, _ := subsegment["name"].(string)
+		_, has_start := subsegment["start_time"].(float64)
+		_, has_end := subsegment["end_time"].(float64)
+		if name == "" || !has_start || !has_end {
+			continue
+		}
+		if id, _ := subsegment["id"].(string); len(id) != 16 {
+			subsegment["id"] = e.new_id()
+		}
+		delete(subsegment, "trace_id")
+		delete(subsegment, "parent_id")
+		delete(subsegment, "type")
+		if nested, ok := subsegment["subsegments"].([]interface{}); ok {
+			subsegment["subsegments"] = e.agent_subsegments(as_documents(nested))
+		}
+		kept = append(kept, subsegment)
+	}
+	return kept
+}
+
+func as_documents(values []interface{}) []map[string]interface{} {
+	documents := make([]map[string]interface{}, 0, len(values))
+	for _, value := range values {
+		if document, ok := value.(map[string]interface{}); ok {
+			documents = append(documents, document)
+		}
+	}
+	return documents
+}
+
+// xray_time is t in epoch seconds, as X-Ray expects.
+func xray_time(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// encode_document marshals document for the daemon, dropping the agent's
+// subsegments when they would not fit in one datagram.
+func encode_document(document map[string]interface{}) ([]byte, error) {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > max_xray_document_bytes {
+		if _, ok := document["subsegments"]; !ok {
+			return nil, fmt.Errorf("subsegment is %d bytes", len(body))
+		}
+		delete(document, "subsegments")
+		document["annotations"].(map[string]interface{})["live_lambda_agent_subsegments_dropped"] = true
+		return encode_document(document)
+	}
+	return append([]byte(xray_daemon_header), body...), nil
+}
+
+// send writes document to the daemon.
+func (e *xray_emitter) send(document map[string]interface{}) error {
+	datagram, err := encode_document(document)
+	if err != nil {
+		return fmt.Errorf("failed to encode subsegment: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		conn, err := net.Dial("udp", e.address)
+		if err != nil {
+			return fmt.Errorf("failed to reach the X-Ray daemon at %s: %w", e.address, err)
+		}
+		e.conn = conn
+	}
+	if _, err := e.conn.Write(datagram); err != nil {
+		return fmt.Errorf("failed to send subsegment: %w", err)
+	}
+	return nil
+}
+
+// trace_remote_execution emits request's remote execution subsegment, which
+// ended at ended with outcome. remote is the trace data from the agent's
+// response envelope, if any.
+func (p *RuntimeAPIProxy) trace_remote_execution(request *pending_request, ended time.Time, outcome string, remote json.RawMessage) {
+	trace := request.xray_trace()
+	started := request.published()
+	if p.xray == nil || trace == nil || started.IsZero() {
+		return
+	}
+	var agent_trace *remote_trace
+	if len(remote) > 0 {
+		agent_trace = &remote_trace{}
+		if err := json.Unmarshal(remote, agent_trace); err != nil {
+			request_logger(request.request_id).Warn("Ignoring trace data from the agent", "error", err)
+			agent_trace = nil
+		}
+	}
+	region, _ := request.route()
+	if region == "" {
+		region = p.aws_region
+	}
+	annotations := map[string]interface{}{
+		"live_lambda_agent_id": p.presence.agent(),
+		"live_lambda_region":   region,
+	}
+	document := p.xray.remote_execution_document(trace, started, ended, outcome, annotations, agent_trace)
+	if err := p.xray.send(document); err != nil {
+		request_logger(request.request_id).Warn("Error sending the subsegment", "error", err)
+		return
+	}
+	p.explain(request.request_id, "xray_subsegment", "%s in trace %s", trace.subsegment_id, trace.header.root)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXRayTraceHeaderPropagation(t *testing.T) {
+	header, ok := parse_xray_trace_header("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1;Lineage=a87bd80c:0")
+	if !ok || header.root != "1-5759e988-bd862e3fe1be46a994272793" || header.parent != "53995c3f42cd8ad8" || !header.sampled {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	if got := header.with_parent("0123456789abcdef"); got != "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=0123456789abcdef;Sampled=1;Lineage=a87bd80c:0" {
+		t.Fatalf("unexpected propagated header %q", got)
+	}
+
+	emitter := &xray_emitter{new_id: func() string { return "0123456789abcdef" }}
+	if emitter.start("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0") != nil {
+		t.Fatal("expected no subsegment for an unsampled invocation")
+	}
+	if emitter.start("Parent=53995c3f42cd8ad8;Sampled=1") != nil {
+		t.Fatal("expected no subsegment without a trace ID")
+	}
+	var disabled *xray_emitter
+	if disabled.start("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1") != nil {
+		t.Fatal("expected no subsegment with tracing disabled")
+	}
+}
+
+func TestParseXRayDaemonAddress(t *testing.T) {
+	for value, expected := range map[string]string{
+		"169.254.79.129:2000":                   "169.254.79.129:2000",
+		"tcp:127.0.0.1:2000 udp:127.0.0.2:2001": "127.0.0.2:2001",
+	} {
+		if address, err := parse_xray_daemon_address(value); err != nil || address != expected {
+			t.Errorf("expected %q to give %s, got %s (%v)", value, expected, address, err)
+		}
+	}
+	for _, value := range []string{"tcp:127.0.0.1:2000", "localhost"} {
+		if _, err := parse_xray_daemon_address(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestRemoteExecutionSubsegmentReachesDaemon(t *testing.T) {
+	daemon, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer daemon.Close()
+
+	p := new_tracking_proxy()
+	p.aws_region = "us-east-1"
+	p.explanations = new_explain_log(default_explain_capacity)
+	p.xray = &xray_emitter{address: daemon.LocalAddr().String(), function_name: "orders", sandbox_id: "sandbox-1", new_id: new_xray_id}
+	request, _ := p.requests.register("r1", []byte(`{}`), nil)
+	trace := p.xray.start("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	request.set_xray_trace(trace)
+	published := time.Unix(1_700_000_000, 0)
+	request.mark_published(published)
+
+	remote := json.RawMessage(`{"subsegments":[{"name":"handler","start_time":1700000000.1,"end_time":1700000000.4},{"name":"no times"}]}`)
+	p.trace_remote_execution(request, published.Add(500*time.Millisecond), xray_outcome_error, remote)
+
+	buf := make([]byte, 64*1024)
+	daemon.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := daemon.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected a datagram: %v", err)
+	}
+	header, body, _ := bytes.Cut(buf[:n], []byte("\n"))
+	if string(header)+"\n" != xray_daemon_header {
+		t.Fatalf("unexpected daemon header %q", header)
+	}
+	var document struct {
+		Type        string                   `json:"type"`
+		ID          string                   `json:"id"`
+		TraceID     string                   `json:"trace_id"`
+		ParentID    string                   `json:"parent_id"`
+		StartTime   float64                  `json:"start_time"`
+		EndTime     float64                  `json:"end_time"`
+		Error       bool                     `json:"error"`
+		Annotations map[string]interface{}   `json:"annotations"`
+		Subsegments []map[string]interface{} `json:"subsegments"`
+	}
+	if err := json.Unmarshal(body, &document); err != nil {
+		t.Fatalf("unexpected document %q: %v", body, err)
+	}
+	if document.Type != "subsegment" || document.ID != trace.subsegment_id || document.TraceID != trace.header.root || document.ParentID != "53995c3f42cd8ad8" {
+		t.Fatalf("unexpected identifiers %+v", document)
+	}
+	if document.EndTime-document.StartTime < 0.49 || !document.Error || document.Annotations["live_lambda_outcome"] != xray_outcome_error || document.Annotations["live_lambda_region"] != "us-east-1" {
+		t.Fatalf("unexpected subsegment %+v", document)
+	}
+	if len(document.Subsegments) != 1 || document.Subsegments[0]["name"] != "handler" || len(document.Subsegments[0]["id"].(string)) != 16 {
+		t.Fatalf("expected only the agent's complete subsegment with an ID, got %v", document.Subsegments)
+	}
+}
+
+func TestOversizedAgentSubsegmentsAreDropped(t *testing.T) {
+	emitter := &xray_emitter{new_id: new_xray_id}
+	trace := &xray_trace{header: xray_trace_header{root: "1-5759e988-bd862e3fe1be46a994272793", parent: "53995c3f42cd8ad8", sampled: true}, subsegment_id: new_xray_id()}
+	remote := &remote_trace{Subsegments: []map[string]interface{}{{
+		"name": "handler", "start_time": 1.0, "end_time": 2.0,
+		"metadata": map[string]interface{}{"blob": strings.Repeat("x", max_xray_document_bytes)},
+	}}}
+	document := emitter.remote_execution_document(trace, time.Unix(1, 0), time.Unix(2, 0), xray_outcome_responded, map[string]interface{}{}, remote)
+	datagram, err := encode_document(document)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if len(datagram) > max_xray_document_bytes || bytes.Contains(datagram, []byte(`"subsegments"`)) || !bytes.Contains(datagram, []byte("live_lambda_agent_subsegments_dropped")) {
+		t.Fatalf("expected the agent's subsegments to be dropped, got %d bytes", len(datagram))
+	}
+}
@@ -13,13 +13,74 @@ export interface LiveLambdaInstallProps {
    * Example: ['arn:aws:iam::OTHER_ACCOUNT:user/developer']
    */
   developer_principal_arns?: string[]
+  /**
+   * S3 bucket used to offload payloads larger than the AppSync event size limit.
+   */
+  offload_bucket_name?: string
+  /**
+   * SQS queue URL used as the mailbox for agents running in pull mode.
+   */
+  mailbox_queue_url?: string
+  /**
+   * AWS IoT Core data endpoint to use instead of AppSync as the transport.
+   */
+  iot_endpoint?: string
+  /**
+   * KMS key or Secrets Manager secret ARN used to encrypt payloads end to end.
+   */
+  payload_key_arn?: string
+  /**
+   * SSM parameter or Secrets Manager secret ARN the agent signs responses with.
+   */
+  response_signing_secret_arn?: string
+  /**
+   * Routing rules as inline JSON, or the ARN of an SSM parameter holding them.
+   */
+  routing_rules?: string
+  /**
+   * SSM parameter ARN whose settings override the deployed ones at runtime.
+   */
+  dynamic_config_parameter?: string
+  /**
+   * Stages sharing the Events API; each gets its own channel namespace.
+   */
+  stages?: string[]
+  /**
+   * Stage this app's functions belong to. Must be one of `stages`.
+   */
+  stage?: string
+  /**
+   * Channel scope template for this app's functions, e.g. `{function}/{dev}`.
+   */
+  channel_scope?: string
+  /**
+   * Developer ID that fills `{dev}` in `channel_scope`.
+   */
+  developer_id?: string
+  /**
+   * Requests channel template for this app's functions, e.g. `invocations/{function}`.
+   */
+  requests_channel?: string
+  /**
+   * Response channel template for this app's functions, ending in `{request_id}`.
+   */
+  response_channel?: string
 }
 
 export class LiveLambda {
   public static install(app: cdk.App, props?: LiveLambdaInstallProps): void {
     const { env } = props ?? {}
 
-    const { api } = new AppSyncStack(app, 'AppSyncStack', { env })
+    if (props?.stage && !props.stages?.includes(props.stage)) {
+      throw new Error(`Stage "${props.stage}" is not one of the stages: ${props.stages?.join(', ') ?? 'none'}`)
+    }
+
+    const { api } = new AppSyncStack(app, 'AppSyncStack', {
+      env,
+      stages: props?.stages,
+      requests_channel: props?.requests_channel,
+      response_channel: props?.response_channel
+    })
 
     const layer_stack = new LiveLambdaLayerStack(app, 'LiveLambda-LayerStack', {
       api,
@@ -29,7 +90,19 @@ export class LiveLambda {
     const aspect = new LiveLambdaLayerAspect({
       api,
       layer_stack,
-      developer_principal_arns: props?.developer_principal_arns
+      developer_principal_arns: props?.developer_principal_arns,
+      offload_bucket_name: props?.offload_bucket_name,
+      mailbox_queue_url: props?.mailbox_queue_url,
+      iot_endpoint: props?.iot_endpoint,
+      payload_key_arn: props?.payload_key_arn,
+      response_signing_secret_arn: props?.response_signing_secret_arn,
+      routing_rules: props?.routing_rules,
+      dynamic_config_parameter: props?.dynamic_config_parameter,
+      stage: props?.stage,
+      channel_scope: props?.channel_scope,
+      developer_id: props?.developer_id,
+      requests_channel: props?.requests_channel,
+      response_channel: props?.response_channel
     })
 
     if (!props?.skip_layer) {
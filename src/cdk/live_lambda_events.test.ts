@@ -0,0 +1,145 @@
+import { describe, it, expect, beforeAll, afterAll } from 'vitest'
+import * as cdk from 'aws-cdk-lib'
+import { Template, Match } from 'aws-cdk-lib/assertions'
+import * as lambda from 'aws-cdk-lib/aws-lambda'
+import * as fs from 'fs'
+import * as path from 'path'
+import * as os from 'os'
+import { LiveLambdaEvents, LiveLambdaEventsProps } from './live_lambda_events.js'
+import {
+  ENV_LAMBDA_EXEC_WRAPPER,
+  OUTPUT_EVENT_API_HTTP_HOST,
+  OUTPUT_LIVE_LAMBDA_PROXY_LAYER_ARN
+} from '../lib/constants.js'
+
+describe('LiveLambdaEvents', () => {
+  let temp_asset_dir: string
+
+  beforeAll(() => {
+    temp_asset_dir = fs.mkdtempSync(
+      path.join(os.tmpdir(), 'live-lambda-events-test-')
+    )
+    fs.writeFileSync(
+      path.join(temp_asset_dir, 'placeholder.txt'),
+      'test layer content'
+    )
+  })
+
+  afterAll(() => {
+    fs.rmSync(temp_asset_dir, { recursive: true, force: true })
+  })
+
+  function create_stack(props?: Partial<LiveLambdaEventsProps>) {
+    const app = new cdk.App()
+    const stack = new cdk.Stack(app, 'TestStack', {
+      env: { account: '123456789012', region: 'us-east-1' }
+    })
+    const wired = new lambda.Function(stack, 'Wired', {
+      runtime: lambda.Runtime.NODEJS_20_X,
+      handler: 'index.handler',
+      code: lambda.Code.fromInline('exports.handler = async () => ({})')
+    })
+    new lambda.Function(stack, 'Untouched', {
+      runtime: lambda.Runtime.NODEJS_20_X,
+      handler: 'index.handler',
+      code: lambda.Code.fromInline('exports.handler = async () => ({})')
+    })
+    const events = new LiveLambdaEvents(stack, 'LiveLambda', {
+      asset_path: temp_asset_dir,
+      functions: [wired],
+      ...props
+    })
+    return { stack, events, template: Template.fromStack(stack) }
+  }
+
+  it('creates the Events API, the namespace and the layer', () => {
+    const { template } = create_stack()
+
+    template.resourceCountIs('AWS::AppSync::Api', 1)
+    template.hasResourceProperties('AWS::AppSync::ChannelNamespace', {
+      Name: 'live-lambda'
+    })
+    template.resourceCountIs('AWS::Lambda::LayerVersion', 1)
+  })
+
+  it('emits the outputs live-lambda start reads', () => {
+    const { template } = create_stack()
+
+    const outputs = template.findOutputs('*')
+    expect(outputs[OUTPUT_EVENT_API_HTTP_HOST]).toBeDefined()
+    expect(outputs[OUTPUT_LIVE_LAMBDA_PROXY_LAYER_ARN]).toBeDefined()
+  })
+
+  it('only wires the functions it is given', () => {
+    const { template } = create_stack()
+
+    const functions = template.findResources('AWS::Lambda::Function')
+    const wrapped = Object.entries(functions).filter(
+      ([, fn]) =>
+        fn.Properties?.Environment?.Variables?.AWS_LAMBDA_EXEC_WRAPPER ===
+        ENV_LAMBDA_EXEC_WRAPPER
+    )
+    expect(wrapped.map(([id]) => id)).toEqual([
+      expect.stringMatching(/^Wired/)
+    ])
+    expect(wrapped[0][1].Properties.Layers).toHaveLength(1)
+  })
+
+  it('limits publish and subscribe to the function namespace', () => {
+    const { template } = create_stack()
+
+    template.hasResourceProperties('AWS::IAM::Policy', {
+      PolicyDocument: {
+        Statement: Match.arrayWith([
+          Match.objectLike({
+            Action: ['appsync:EventPublish', 'appsync:EventSubscribe'],
+            Resource: {
+              'Fn::Join': [
+                '',
+                Match.arrayWith([
+                  '/channelNamespace/live-lambda'
+                ])
+              ]
+            }
+          })
+        ])
+      }
+    })
+  })
+
+  it('scopes functions to their stage', () => {
+    const { template } = create_stack({ stages: ['dev', 'qa'], stage: 'qa' })
+
+    template.hasResourceProperties('AWS::AppSync::ChannelNamespace', {
+      Name: 'live-lambda-qa'
+    })
+    template.hasResourceProperties('AWS::Lambda::Function', {
+      Environment: {
+        Variables: Match.objectLike({
+          LIVE_LAMBDA_APPSYNC_NAMESPACE: 'live-lambda-qa',
+          LIVE_LAMBDA_NAMESPACE_CHECK: 'enforce'
+        })
+      }
+    })
+  })
+
+  it('rejects a stage that is not one of the stages', () => {
+    expect(() => create_stack({ stages: ['dev'], stage: 'qa' })).toThrow(
+      /not one of the stages/
+    )
+  })
+
+  it('reuses a layer it is given', () => {
+    const app = new cdk.App()
+    const stack = new cdk.Stack(app, 'TestStack')
+    const layer = lambda.LayerVersion.fromLayerVersionArn(
+      stack,
+      'Existing',
+      'arn:aws:lambda:us-east-1:123456789012:layer:live-lambda-proxy:7'
+    )
+    const events = new LiveLambdaEvents(stack, 'LiveLambda', { layer })
+
+    expect(events.layer).toBe(layer)
+    Template.fromStack(stack).resourceCountIs('AWS::Lambda::LayerVersion', 0)
+  })
+})
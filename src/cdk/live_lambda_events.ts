@@ -0,0 +1,128 @@
+import * as cdk from 'aws-cdk-lib'
+import * as lambda from 'aws-cdk-lib/aws-lambda'
+import * as appsync from 'aws-cdk-lib/aws-appsync'
+import { Construct } from 'constructs'
+import { fileURLToPath } from 'node:url'
+import { dirname, join } from 'node:path'
+import {
+  APPSYNC_EVENTS_API_NAMESPACE,
+  channel_template,
+  stage_namespace
+} from '../constants.js'
+import {
+  LAYER_VERSION_NAME,
+  LAYER_DESCRIPTION,
+  OUTPUT_EVENT_API_HTTP_HOST,
+  OUTPUT_EVENT_API_REALTIME_HOST,
+  OUTPUT_LIVE_LAMBDA_PROXY_LAYER_ARN
+} from '../lib/constants.js'
+import { channel_handler_code } from './stacks/channel_handlers.js'
+import { stage_channel_statements } from './stacks/appsync.stack.js'
+import {
+  LiveLambdaFunctionProps,
+  configure_live_lambda_function
+} from './aspects/live-lambda-layer.aspect.js'
+
+const __dirname = dirname(fileURLToPath(import.meta.url))
+
+export interface LiveLambdaEventsProps
+  extends Omit<LiveLambdaFunctionProps, 'api'> {
+  /**
+   * Functions to wire for live-lambda. More can be added with `add_function`.
+   */
+  readonly functions?: lambda.Function[]
+  /**
+   * Stages sharing the Events API; each gets its own channel namespace.
+   */
+  readonly stages?: string[]
+  /**
+   * Layer holding the extension, when one is already deployed. By default the
+   * construct creates it from the built extension.
+   */
+  readonly layer?: lambda.ILayerVersion
+  /** Override asset path for testing. If not provided, uses the default dist directory. */
+  readonly asset_path?: string
+}
+
+/**
+ * Everything live-lambda needs inside one stack: the Events API and its
+ * channel namespaces, the extension layer, and for each function the layer,
+ * the extension's environment variables and a role policy that only reaches
+ * the function's namespace. Unlike `LiveLambda.install`, which adds its own
+ * stacks and wires every NodejsFunction in the app, it only touches the
+ * functions it is given.
+ *
+ * The stack gets the outputs `live-lambda start` reads from the stacks
+ * `LiveLambda.install` creates, so use one construct per stack.
+ */
+export class LiveLambdaEvents extends Construct {
+  readonly api: appsync.EventApi
+  readonly layer: lambda.ILayerVersion
+  private readonly props: LiveLambdaEventsProps
+
+  constructor(scope: Construct, id: string, props: LiveLambdaEventsProps = {}) {
+    super(scope, id)
+    this.props = props
+
+    if (props.stage && !props.stages?.includes(props.stage)) {
+      throw new Error(`Stage "${props.stage}" is not one of the stages: ${props.stages?.join(', ') ?? 'none'}`)
+    }
+
+    this.api = new appsync.EventApi(this, 'EventApi', {
+      apiName: `live-lambda-events-${cdk.Names.uniqueResourceName(this, { maxLength: 30 })}`,
+      authorizationConfig: {
+        authProviders: [
+          { authorizationType: appsync.AppSyncAuthorizationType.IAM }
+        ]
+      }
+    })
+
+    const template = channel_template(props.requests_channel, props.response_channel)
+    for (const namespace of [
+      APPSYNC_EVENTS_API_NAMESPACE,
+      ...(props.stages ?? []).map((stage) => stage_namespace(stage))
+    ]) {
+      this.api.addChannelNamespace(namespace, {
+        code: appsync.Code.fromInline(channel_handler_code(namespace, template))
+      })
+    }
+
+    // After compiling, __dirname is '.../dist/cdk', so the layer is one level up
+    this.layer =
+      props.layer ??
+      new lambda.LayerVersion(this, 'Layer', {
+        layerVersionName: LAYER_VERSION_NAME,
+        code: lambda.Code.fromAsset(props.asset_path ?? join(__dirname, '..')),
+        compatibleArchitectures: [
+          lambda.Architecture.ARM_64,
+          lambda.Architecture.X86_64
+        ],
+        description: LAYER_DESCRIPTION
+      })
+
+    const outputs: [string, string][] = [
+      [OUTPUT_EVENT_API_HTTP_HOST, this.api.httpDns],
+      [OUTPUT_EVENT_API_REALTIME_HOST, this.api.realtimeDns],
+      [OUTPUT_LIVE_LAMBDA_PROXY_LAYER_ARN, this.layer.layerVersionArn]
+    ]
+    for (const [key, value] of outputs) {
+      new cdk.CfnOutput(this, key, { value }).overrideLogicalId(key)
+    }
+
+    for (const fn of props.functions ?? []) {
+      this.add_function(fn)
+    }
+  }
+
+  /**
+   * Adds the layer, the extension's environment variables and the AppSync
+   * policy to a function.
+   */
+  add_function(fn: lambda.Function): void {
+    fn.addLayers(this.layer)
+    for (const statement of stage_channel_statements(this.api, this.props.stage)) {
+      fn.addToRolePolicy(statement)
+    }
+    configure_live_lambda_function(fn, { ...this.props, api: this.api })
+  }
+}
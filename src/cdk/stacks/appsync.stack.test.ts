@@ -40,6 +40,53 @@ describe('AppSyncStack', () => {
         Name: 'live-lambda'
       })
     })
+
+    it('should attach the generated handlers to the namespace', () => {
+      template.hasResourceProperties('AWS::AppSync::ChannelNamespace', {
+        Name: 'live-lambda',
+        CodeHandlers: Match.stringLikeRegexp('export function onSubscribe')
+      })
+    })
+  })
+
+  describe('Stages', () => {
+    let staged: AppSyncStack
+    let staged_template: Template
+
+    beforeEach(() => {
+      const staged_app = new cdk.App()
+      staged = new AppSyncStack(staged_app, 'StagedAppSyncStack', {
+        env: { account: '123456789012', region: 'us-east-1' },
+        stages: ['dev', 'qa']
+      })
+      staged_template = Template.fromStack(staged)
+    })
+
+    it('should create a namespace per stage next to the default one', () => {
+      staged_template.resourceCountIs('AWS::AppSync::ChannelNamespace', 3)
+      for (const name of ['live-lambda-dev', 'live-lambda-qa']) {
+        staged_template.hasResourceProperties('AWS::AppSync::ChannelNamespace', {
+          Name: name,
+          CodeHandlers: Match.stringLikeRegexp(`const NAMESPACE = "${name}"`)
+        })
+      }
+    })
+
+    it('should expose a policy per stage scoped to its namespace', () => {
+      expect(Object.keys(staged.stage_policies)).toEqual(['dev', 'qa'])
+      const statements = staged.stage_policies.dev.document.toJSON().Statement
+      expect(statements[0].Action).toBe('appsync:EventConnect')
+      expect(JSON.stringify(statements[1].Resource)).toContain(
+        '/channelNamespace/live-lambda-dev'
+      )
+    })
+
+    it('should reject stage names AppSync cannot use', () => {
+      expect(
+        () =>
+          new AppSyncStack(new cdk.App(), 'BadStack', { stages: ['dev/feature'] })
+      ).toThrow('Invalid stage')
+    })
   })
 
   describe('IAM Policy', () => {
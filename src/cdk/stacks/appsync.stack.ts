@@ -2,15 +2,33 @@ import * as cdk from 'aws-cdk-lib'
 import { Construct } from 'constructs'
 import * as appsync from 'aws-cdk-lib/aws-appsync'
 import * as iam from 'aws-cdk-lib/aws-iam'
-import { APPSYNC_EVENTS_API_NAMESPACE } from '../../constants.js'
+import {
+  APPSYNC_EVENTS_API_NAMESPACE,
+  channel_template,
+  stage_namespace
+} from '../../constants.js'
+import { channel_handler_code } from './channel_handlers.js'
 
 export interface AppSyncStackProps extends cdk.StackProps {
   readonly live_lambda_enabled?: boolean
+  /**
+   * Stages sharing this Events API. Each gets its own channel namespace,
+   * live-lambda-{stage}, and a policy in `stage_policies` that only reaches it.
+   */
+  readonly stages?: string[]
+  /**
+   * Requests and response channel templates the functions use instead of the
+   * defaults (see `LiveLambdaFunctionProps`), so the namespace handlers accept them.
+   */
+  readonly requests_channel?: string
+  readonly response_channel?: string
 }
 
 export class AppSyncStack extends cdk.Stack {
   readonly api: appsync.EventApi
   readonly api_policy: iam.Policy
+  /** Per-stage policies for developers who may only use their own stage's channels. */
+  readonly stage_policies: Record<string, iam.Policy> = {}
 
   constructor(scope: Construct, id: string, props?: AppSyncStackProps) {
     super(scope, id, props)
@@ -24,7 +42,15 @@ export class AppSyncStack extends cdk.Stack {
       }
     })
 
-    this.api.addChannelNamespace(APPSYNC_EVENTS_API_NAMESPACE)
+    const template = channel_template(props?.requests_channel, props?.response_channel)
+    for (const namespace of [
+      APPSYNC_EVENTS_API_NAMESPACE,
+      ...(props?.stages ?? []).map((stage) => stage_namespace(stage))
+    ]) {
+      this.api.addChannelNamespace(namespace, {
+        code: appsync.Code.fromInline(channel_handler_code(namespace, template))
+      })
+    }
 
     this.api_policy = new iam.Policy(this, 'LiveLambdaEventApiPolicy', {
       policyName: `live-lambda-events-${this.stackName}`,
@@ -42,6 +68,13 @@ export class AppSyncStack extends cdk.Stack {
 
     //docs.aws.amazon.com/appsync/latest/eventapi/configure-event-api-auth.html
 
+    for (const stage of props?.stages ?? []) {
+      this.stage_policies[stage] = new iam.Policy(this, `LiveLambdaEventApiPolicy-${stage}`, {
+        policyName: `live-lambda-events-${this.stackName}-${stage}`,
+        statements: stage_channel_statements(this.api, stage)
+      })
+    }
+
     new cdk.CfnOutput(this, 'LiveLambdaEventApiId', {
       value: this.api.apiId,
       description: 'The ID of the AppSync Event API for Live Lambda.'
@@ -70,3 +103,22 @@ export class AppSyncStack extends cdk.Stack {
     })
   }
 }
+
+/**
+ * Grants connecting to the API and using the channels of one stage's namespace only.
+ */
+export function stage_channel_statements(
+  api: appsync.IEventApi,
+  stage?: string
+): iam.PolicyStatement[] {
+  return [
+    new iam.PolicyStatement({
+      actions: ['appsync:EventConnect'],
+      resources: [api.apiArn]
+    }),
+    new iam.PolicyStatement({
+      actions: ['appsync:EventPublish', 'appsync:EventSubscribe'],
+      resources: [`${api.apiArn}/channelNamespace/${stage_namespace(stage)}`]
+    })
+  ]
+}
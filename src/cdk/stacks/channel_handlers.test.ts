@@ -0,0 +1,85 @@
+import { describe, it, expect, vi } from 'vitest'
+import { channel_template } from '../../constants.js'
+import { channel_depths, channel_handler_code } from './channel_handlers.js'
+
+// Runs the generated handlers as plain JavaScript, with util.unauthorized throwing
+function load_handlers(namespace: string, template?: string[]) {
+  const unauthorized = vi.fn(() => {
+    throw new Error('Unauthorized')
+  })
+  const source = channel_handler_code(namespace, template)
+    .replace("import { util } from '@aws-appsync/utils'", '')
+    .replace(/export function/g, 'function')
+  const factory = new Function(
+    'util',
+    `${source}\nreturn { onSubscribe, onPublish }`
+  )
+  return factory({ unauthorized })
+}
+
+function context(path: string, events: unknown[] = []) {
+  return {
+    info: { channel: { path, segments: path.split('/').filter(Boolean) } },
+    events
+  }
+}
+
+describe('channel_handlers', () => {
+  it('should derive channel depths from the template', () => {
+    expect(channel_depths()).toEqual({
+      requests: 0,
+      response: 1,
+      presence: 1,
+      lifecycle: 1,
+      control: 1,
+      logs: 1,
+      recordings: 1,
+      agents: 1,
+      reply: 1
+    })
+    expect(() => channel_depths(['{stage}/requests'])).toThrow('fixed segment')
+  })
+
+  it('should allow template channels and refuse others', () => {
+    const handlers = load_handlers('live-lambda-dev')
+    expect(() => handlers.onSubscribe(context('/live-lambda-dev/presence/*'))).not.toThrow()
+    expect(() => handlers.onSubscribe(context('/live-lambda-dev/requests'))).not.toThrow()
+    expect(() => handlers.onSubscribe(context('/live-lambda-dev/reply/r1'))).not.toThrow()
+    expect(() => handlers.onSubscribe(context('/live-lambda-dev/*'))).toThrow('Unauthorized')
+    expect(() => handlers.onSubscribe(context('/live-lambda-dev/response/a/b'))).toThrow('Unauthorized')
+    expect(() => handlers.onSubscribe(context('/live-lambda-prod/requests'))).toThrow('Unauthorized')
+  })
+
+  it('should allow template channels under a channel scope', () => {
+    const handlers = load_handlers('live-lambda')
+    expect(() => handlers.onSubscribe(context('/live-lambda/orders/alice/requests'))).not.toThrow()
+    expect(() => handlers.onSubscribe(context('/live-lambda/alice/presence/*'))).not.toThrow()
+    expect(() => handlers.onPublish(context('/live-lambda/orders/alice/response/r1'))).not.toThrow()
+    expect(() => handlers.onSubscribe(context('/live-lambda/a/b/c/requests'))).toThrow('Unauthorized')
+    expect(() => handlers.onSubscribe(context('/live-lambda/alice/*'))).toThrow('Unauthorized')
+  })
+
+  it('should allow custom requests and response channels instead of the defaults', () => {
+    const template = channel_template('/invocations/{function}/', 'answers/{request_id}')
+    expect(channel_depths(template)).toMatchObject({ invocations: 1, answers: 1, presence: 1 })
+    expect(channel_depths(template)).not.toHaveProperty('requests')
+
+    const handlers = load_handlers('live-lambda', template)
+    expect(() => handlers.onSubscribe(context('/live-lambda/alice/invocations/orders'))).not.toThrow()
+    expect(() => handlers.onPublish(context('/live-lambda/answers/r1'))).not.toThrow()
+    expect(() => handlers.onSubscribe(context('/live-lambda/requests'))).toThrow('Unauthorized')
+  })
+
+  it('should stamp namespace checks and pass other events through', () => {
+    const handlers = load_handlers('live-lambda-dev')
+    const check = { id: '1', payload: { type: 'namespace_check', data: { nonce: 'n' } } }
+    const other = { id: '2', payload: { type: 'env_snapshot', data: {} } }
+
+    const published = handlers.onPublish(
+      context('/live-lambda-dev/lifecycle/orders', [check, other])
+    )
+
+    expect(published[0].payload.data).toEqual({ nonce: 'n', namespace: 'live-lambda-dev' })
+    expect(published[1]).toBe(other)
+  })
+})
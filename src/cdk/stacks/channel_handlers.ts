@@ -0,0 +1,76 @@
+import { CHANNEL_TEMPLATE, MAX_CHANNEL_SCOPE_SEGMENTS } from '../../constants.js'
+
+/**
+ * Namespace handlers generated from CHANNEL_TEMPLATE. Each live-lambda
+ * namespace refuses subscriptions and publishes outside the template, with or
+ * without a channel scope (up to MAX_CHANNEL_SCOPE_SEGMENTS segments, e.g.
+ * /live-lambda/orders/alice/requests), and
+ * stamps its own name into namespace_check lifecycle events so an extension
+ * can confirm which namespace it reached (LIVE_LAMBDA_NAMESPACE_CHECK).
+ */
+
+/**
+ * Maps the first segment of each template channel to the number of segments
+ * that follow it, e.g. presence/{function_name} becomes presence: 1.
+ */
+export function channel_depths(
+  template: string[] = CHANNEL_TEMPLATE
+): Record<string, number> {
+  const depths: Record<string, number> = {}
+  for (const channel of template) {
+    const [root, ...rest] = channel.split('/')
+    if (root.startsWith('{')) {
+      throw new Error(`Channel template "${channel}" must start with a fixed segment`)
+    }
+    depths[root] = rest.length
+  }
+  return depths
+}
+
+/**
+ * Returns the APPSYNC_JS code for a namespace's onSubscribe and onPublish handlers.
+ */
+export function channel_handler_code(
+  namespace: string,
+  template: string[] = CHANNEL_TEMPLATE
+): string {
+  return `import { util } from '@aws-appsync/utils'
+
+const NAMESPACE = ${JSON.stringify(namespace)}
+const CHANNEL_DEPTHS = ${JSON.stringify(channel_depths(template))}
+const SCOPE_LENGTHS = ${JSON.stringify([...Array(MAX_CHANNEL_SCOPE_SEGMENTS + 1).keys()])}
+
+function allowed(segments) {
+  if (segments[0] !== NAMESPACE) {
+    return false
+  }
+  for (const scope of SCOPE_LENGTHS) {
+    const depth = CHANNEL_DEPTHS[segments[scope + 1]]
+    if (depth !== undefined && segments.length === scope + depth + 2) {
+      return true
+    }
+  }
+  return false
+}
+
+export function onSubscribe(ctx) {
+  if (!allowed(ctx.info.channel.segments)) {
+    util.unauthorized()
+  }
+}
+
+export function onPublish(ctx) {
+  if (!allowed(ctx.info.channel.segments)) {
+    util.unauthorized()
+  }
+  return ctx.events.map((event) => {
+    const payload = event.payload
+    if (!payload || payload.type !== 'namespace_check') {
+      return event
+    }
+    const data = Object.assign({}, payload.data, { namespace: NAMESPACE })
+    return { id: event.id, payload: Object.assign({}, payload, { data: data }) }
+  })
+}
+`
+}
@@ -0,0 +1,178 @@
+import { describe, it, expect, vi, beforeEach } from 'vitest'
+
+vi.mock('@aws-sdk/credential-providers', () => {
+  const credentials = () =>
+    Promise.resolve({ accessKeyId: 'AKIDEXAMPLE', secretAccessKey: 'secret' })
+  return { fromIni: () => credentials, fromNodeProviderChain: () => credentials }
+})
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  EXPIRES_AT_TAG,
+  ObjectStore,
+  S3ObjectStore,
+  StoredObject,
+  cleanup_orphans,
+  parse_max_age,
+  run_cleanup
+} from './cleanup.js'
+
+describe('cleanup', () => {
+  const now = Date.parse('2025-06-01T12:00:00Z')
+  const hour = 3_600_000
+
+  function memory_store(
+    objects: (StoredObject & { tags?: Record<string, string> })[]
+  ): ObjectStore & { removed: string[] } {
+    const removed: string[] = []
+    return {
+      removed,
+      list: async (prefix) => objects.filter((object) => object.key.startsWith(prefix)),
+      tags: async (key) => objects.find((object) => object.key === key)?.tags ?? {},
+      remove: async (key) => {
+        removed.push(key)
+      }
+    }
+  }
+
+  describe('cleanup_orphans', () => {
+    const objects = [
+      {
+        key: 'live-lambda/payloads/r1/request.json',
+        last_modified: new Date(now - 5 * hour),
+        tags: { [EXPIRES_AT_TAG]: String((now + hour) / 1000) }
+      },
+      {
+        key: 'live-lambda/payloads/r2/request.json',
+        last_modified: new Date(now - 5 * 60_000),
+        tags: { [EXPIRES_AT_TAG]: String((now - 60_000) / 1000) }
+      },
+      { key: 'live-lambda/payloads/r3/response.json', last_modified: new Date(now - 2 * hour) },
+      { key: 'live-lambda/payloads/r4/response.json', last_modified: new Date(now - 10 * 60_000) },
+      { key: 'other/keep.json', last_modified: new Date(0) }
+    ]
+
+    it('should remove objects past their expiry tag or, untagged, past the max age', async () => {
+      const store = memory_store(objects)
+
+      const report = await cleanup_orphans(store, { now: () => now })
+
+      expect(report.scanned).toBe(4)
+      expect(report.removed).toEqual([
+        'live-lambda/payloads/r2/request.json',
+        'live-lambda/payloads/r3/response.json'
+      ])
+      expect(store.removed).toEqual(report.removed)
+    })
+
+    it('should only report what it would remove in a dry run', async () => {
+      const store = memory_store(objects)
+
+      const report = await cleanup_orphans(store, {
+        now: () => now,
+        max_age_ms: 5 * 60_000,
+        dry_run: true
+      })
+
+      expect(report.removed).toContain('live-lambda/payloads/r4/response.json')
+      expect(store.removed).toEqual([])
+    })
+  })
+
+  describe('parse_max_age', () => {
+    it('should read durations with a unit or plain seconds', () => {
+      expect(parse_max_age('90m')).toBe(90 * 60_000)
+      expect(parse_max_age('2d')).toBe(2 * 86_400_000)
+      expect(parse_max_age('30')).toBe(30_000)
+    })
+
+    it('should reject anything else', () => {
+      expect(() => parse_max_age('soon')).toThrow('Invalid age')
+    })
+  })
+
+  describe('S3ObjectStore', () => {
+    const mock_fetch = vi.fn()
+    const store = new S3ObjectStore('payloads', 'eu-west-1', undefined, mock_fetch)
+
+    const reply = (body: string, status = 200) => ({
+      ok: status < 300,
+      status,
+      text: async () => body
+    })
+
+    beforeEach(() => {
+      mock_fetch.mockReset()
+    })
+
+    it('should page through listed objects', async () => {
+      mock_fetch
+        .mockResolvedValueOnce(
+          reply(
+            '<ListBucketResult><IsTruncated>true</IsTruncated><NextContinuationToken>t1</NextContinuationToken>' +
+              '<Contents><Key>live-lambda/payloads/a&amp;b/request.json</Key><LastModified>2025-06-01T10:00:00.000Z</LastModified></Contents>' +
+              '</ListBucketResult>'
+          )
+        )
+        .mockResolvedValueOnce(
+          reply(
+            '<ListBucketResult><IsTruncated>false</IsTruncated>' +
+              '<Contents><Key>live-lambda/payloads/c/response.json</Key><LastModified>2025-06-01T11:00:00.000Z</LastModified></Contents>' +
+              '</ListBucketResult>'
+          )
+        )
+
+      const objects = await store.list('live-lambda/payloads/')
+
+      expect(objects.map((object) => object.key)).toEqual([
+        'live-lambda/payloads/a&b/request.json',
+        'live-lambda/payloads/c/response.json'
+      ])
+      const [first_url, first_init] = mock_fetch.mock.calls[0]
+      expect(String(first_url)).toContain('https://payloads.s3.eu-west-1.amazonaws.com/?list-type=2')
+      expect(first_init.headers.authorization).toContain('AWS4-HMAC-SHA256')
+      expect(new URL(mock_fetch.mock.calls[1][0]).searchParams.get('continuation-token')).toBe('t1')
+    })
+
+    it('should read object tags and delete objects', async () => {
+      mock_fetch.mockResolvedValueOnce(
+        reply(
+          `<Tagging><TagSet><Tag><Key>${EXPIRES_AT_TAG}</Key><Value>1748779200</Value></Tag></TagSet></Tagging>`
+        )
+      )
+      mock_fetch.mockResolvedValueOnce(reply('', 204))
+
+      expect(await store.tags('live-lambda/payloads/r1/request.json')).toEqual({
+        [EXPIRES_AT_TAG]: '1748779200'
+      })
+      await store.remove('live-lambda/payloads/r1/request.json')
+
+      expect(String(mock_fetch.mock.calls[0][0])).toBe(
+        'https://payloads.s3.eu-west-1.amazonaws.com/live-lambda/payloads/r1/request.json?tagging='
+      )
+      expect(mock_fetch.mock.calls[1][1].method).toBe('DELETE')
+    })
+
+    it('should surface S3 errors', async () => {
+      mock_fetch.mockResolvedValueOnce(reply('<Error>AccessDenied</Error>', 403))
+
+      await expect(store.remove('k')).rejects.toThrow('403')
+    })
+  })
+
+  describe('run_cleanup', () => {
+    it('should require a bucket', async () => {
+      await expect(run_cleanup({})).rejects.toThrow('--bucket is required')
+    })
+  })
+})
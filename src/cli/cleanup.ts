@@ -0,0 +1,237 @@
+import { fromIni, fromNodeProviderChain } from '@aws-sdk/credential-providers'
+import { Sha256 } from '@aws-crypto/sha256-js'
+import { HttpRequest } from '@smithy/protocol-http'
+import { SignatureV4 } from '@smithy/signature-v4'
+import { logger } from '../lib/logger.js'
+
+/**
+ * Removes resources left behind by crashed sessions. The only AWS resources a
+ * session creates are offloaded payloads under live-lambda/payloads/ in the
+ * offload bucket; the pull mailbox is shared and owned by the app. The
+ * extension tags each payload it uploads with live-lambda:expires-at (Unix
+ * seconds). Objects without the tag, such as responses the agent uploaded
+ * through a presigned URL, expire max_age after they were last modified.
+ */
+
+export const EXPIRES_AT_TAG = 'live-lambda:expires-at'
+export const DEFAULT_PAYLOAD_PREFIX = 'live-lambda/payloads/'
+export const DEFAULT_MAX_AGE_MS = 60 * 60_000
+
+export interface StoredObject {
+  key: string
+  last_modified: Date
+}
+
+export interface ObjectStore {
+  list(prefix: string): Promise<StoredObject[]>
+  tags(key: string): Promise<Record<string, string>>
+  remove(key: string): Promise<void>
+}
+
+export interface CleanupOptions {
+  prefix?: string
+  max_age_ms?: number
+  dry_run?: boolean
+  now?: () => number
+}
+
+export interface CleanupReport {
+  scanned: number
+  removed: string[]
+}
+
+/**
+ * Returns when an object may be removed: its expiry tag when it has one,
+ * otherwise max_age_ms after it was last modified.
+ */
+export function expires_at(
+  object: StoredObject,
+  tags: Record<string, string>,
+  max_age_ms: number
+): number {
+  const tagged = Number(tags[EXPIRES_AT_TAG])
+  if (tags[EXPIRES_AT_TAG] && Number.isFinite(tagged)) {
+    return tagged * 1000
+  }
+  return object.last_modified.getTime() + max_age_ms
+}
+
+export async function cleanup_orphans(
+  store: ObjectStore,
+  options: CleanupOptions = {}
+): Promise<CleanupReport> {
+  const prefix = options.prefix ?? DEFAULT_PAYLOAD_PREFIX
+  const max_age_ms = options.max_age_ms ?? DEFAULT_MAX_AGE_MS
+  const now = (options.now ?? Date.now)()
+
+  const objects = await store.list(prefix)
+  const removed: string[] = []
+  for (const object of objects) {
+    const tags = await store.tags(object.key)
+    if (expires_at(object, tags, max_age_ms) > now) {
+      continue
+    }
+    if (options.dry_run) {
+      logger.info(`Would remove ${object.key}`)
+    } else {
+      await store.remove(object.key)
+      logger.debug(`Removed ${object.key}`)
+    }
+    removed.push(object.key)
+  }
+  return { scanned: objects.length, removed }
+}
+
+/**
+ * Reads a duration such as 90m, 1h or 2d; a bare number is seconds.
+ */
+export function parse_max_age(value: string): number {
+  const match = /^(\d+)\s*(s|m|h|d)?$/.exec(value.trim())
+  if (!match) {
+    throw new Error(`Invalid age "${value}": expected a duration such as 90m, 1h or 2d`)
+  }
+  const unit_ms = { s: 1_000, m: 60_000, h: 3_600_000, d: 86_400_000 }
+  return Number(match[1]) * unit_ms[(match[2] ?? 's') as keyof typeof unit_ms]
+}
+
+function xml_values(xml: string, tag: string): string[] {
+  const pattern = new RegExp(`<${tag}>([\\s\\S]*?)</${tag}>`, 'g')
+  return Array.from(xml.matchAll(pattern), (match) =>
+    match[1]
+      .replace(/&lt;/g, '<')
+      .replace(/&gt;/g, '>')
+      .replace(/&quot;/g, '"')
+      .replace(/&apos;/g, "'")
+      .replace(/&amp;/g, '&')
+  )
+}
+
+/**
+ * A bucket accessed through signed S3 REST calls.
+ */
+export class S3ObjectStore implements ObjectStore {
+  private readonly signer: SignatureV4
+  private readonly hostname: string
+
+  constructor(
+    bucket: string,
+    region: string,
+    profile?: string,
+    private readonly fetch_impl: typeof fetch = fetch
+  ) {
+    this.hostname = `${bucket}.s3.${region}.amazonaws.com`
+    this.signer = new SignatureV4({
+      service: 's3',
+      region,
+      credentials: profile ? fromIni({ profile }) : fromNodeProviderChain(),
+      sha256: Sha256,
+      uriEscapePath: false
+    })
+  }
+
+  async list(prefix: string): Promise<StoredObject[]> {
+    const objects: StoredObject[] = []
+    let continuation_token: string | undefined
+    do {
+      const xml = await this.send('GET', '/', {
+        'list-type': '2',
+        prefix,
+        ...(continuation_token ? { 'continuation-token': continuation_token } : {})
+      })
+      for (const contents of xml_values(xml, 'Contents')) {
+        const [key] = xml_values(contents, 'Key')
+        const [last_modified] = xml_values(contents, 'LastModified')
+        if (key) {
+          objects.push({ key, last_modified: new Date(last_modified) })
+        }
+      }
+      continuation_token =
+        xml_values(xml, 'IsTruncated')[0] === 'true'
+          ? xml_values(xml, 'NextContinuationToken')[0]
+          : undefined
+    } while (continuation_token)
+    return objects
+  }
+
+  async tags(key: string): Promise<Record<string, string>> {
+    const xml = await this.send('GET', this.object_path(key), { tagging: '' })
+    const tags: Record<string, string> = {}
+    for (const tag of xml_values(xml, 'Tag')) {
+      const [name] = xml_values(tag, 'Key')
+      const [value] = xml_values(tag, 'Value')
+      if (name) {
+        tags[name] = value ?? ''
+      }
+    }
+    return tags
+  }
+
+  async remove(key: string): Promise<void> {
+    await this.send('DELETE', this.object_path(key))
+  }
+
+  private object_path(key: string): string {
+    return '/' + key.split('/').map(encodeURIComponent).join('/')
+  }
+
+  private async send(
+    method: string,
+    path: string,
+    query: Record<string, string> = {}
+  ): Promise<string> {
+    const signed = await this.signer.sign(
+      new HttpRequest({
+        method,
+        protocol: 'https:',
+        hostname: this.hostname,
+        path,
+        query,
+        headers: { host: this.hostname }
+      })
+    )
+    const url = new URL(`https://${this.hostname}${path}`)
+    for (const [name, value] of Object.entries(query)) {
+      url.searchParams.set(name, value)
+    }
+    const response = await this.fetch_impl(url, { method, headers: signed.headers })
+    const body = await response.text()
+    if (!response.ok) {
+      throw new Error(`S3 ${method} ${path} failed: ${response.status} ${body}`)
+    }
+    return body
+  }
+}
+
+export interface CleanupCommandOptions {
+  bucket?: string
+  prefix?: string
+  region?: string
+  profile?: string
+  maxAge?: string
+  dryRun?: boolean
+}
+
+/**
+ * Runs `live-lambda cleanup` with the options given on the command line.
+ */
+export async function run_cleanup(options: CleanupCommandOptions): Promise<CleanupReport> {
+  if (!options.bucket) {
+    throw new Error('--bucket is required: pass the offload_bucket_name given to LiveLambda.install')
+  }
+  const region = options.region ?? process.env.AWS_REGION ?? process.env.AWS_DEFAULT_REGION
+  if (!region) {
+    throw new Error('--region is required when AWS_REGION is not set')
+  }
+
+  const store = new S3ObjectStore(options.bucket, region, options.profile)
+  const report = await cleanup_orphans(store, {
+    prefix: options.prefix,
+    max_age_ms: options.maxAge ? parse_max_age(options.maxAge) : undefined,
+    dry_run: options.dryRun
+  })
+  const verb = options.dryRun ? 'Would remove' : 'Removed'
+  logger.info(
+    `${verb} ${report.removed.length} of ${report.scanned} objects in s3://${options.bucket}/${options.prefix ?? DEFAULT_PAYLOAD_PREFIX}`
+  )
+  return report
+}
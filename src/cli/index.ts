@@ -22,6 +22,38 @@ program
 program
   .command('start')
   .description('Starts the development server')
+  .option(
+    '--runtime-image [image]',
+    'Run each invocation inside an AWS Lambda base image via the Runtime Interface Emulator (defaults to the image matching the function runtime)'
+  )
+  .option(
+    '--diff-events [key]',
+    'Log how each event differs from the previous one for the same function, optionally grouped by the value at a dotted event path'
+  )
+  .option(
+    '--pull <queue-url>',
+    'Pull requests from an SQS mailbox and publish over HTTP instead of holding a WebSocket open'
+  )
+  .option(
+    '--deterministic [seed]',
+    'Run handlers with the clock frozen at the invocation time and Math.random seeded from the request ID, or from the given seed'
+  )
+  .option(
+    '--stage <stage>',
+    'Serve the channels of this stage (namespace live-lambda-<stage>) on an Events API shared by several stages'
+  )
+  .option(
+    '--channel-scope <scope>',
+    'Serve the channels under this scope, as the functions render LIVE_LAMBDA_CHANNEL_SCOPE, e.g. orders/alice'
+  )
+  .option(
+    '--requests-channel <channel>',
+    'Serve this requests channel, as the functions render LIVE_LAMBDA_REQUESTS_CHANNEL, e.g. invocations/orders'
+  )
+  .option(
+    '--response-channel <channel>',
+    'Answer on this response channel, as the functions render LIVE_LAMBDA_RESPONSE_CHANNEL, e.g. answers/{request_id}'
+  )
   .action(async function (this: Command) {
     await main(this)
   })
@@ -33,4 +65,34 @@ program
     await main(this)
   })
 
+program
+  .command('cleanup')
+  .description('Removes payloads left in the offload bucket by crashed sessions')
+  .requiredOption('--bucket <name>', 'Offload bucket given to LiveLambda.install')
+  .option('--prefix <prefix>', 'Key prefix to scan (defaults to live-lambda/payloads/)')
+  .option('--region <region>', 'Bucket region (defaults to AWS_REGION)')
+  .option('--profile <profile>', 'AWS profile to use')
+  .option(
+    '--max-age <age>',
+    'Remove untagged objects older than this, e.g. 90m, 1h or 2d (defaults to 1h)'
+  )
+  .option('--dry-run', 'List what would be removed without removing it')
+  .action(async function (this: Command) {
+    await main(this)
+  })
+
+program
+  .command('migrate-config')
+  .description(
+    "Upgrades functions' live-lambda environment variables from older names and channel namespaces"
+  )
+  .requiredOption('--function <names...>', 'Names or ARNs of the functions to migrate')
+  .option('--stage <stage>', 'Move the functions to this stage\'s channel namespace')
+  .option('--apply', 'Update the functions instead of only printing the new environment')
+  .option('--region <region>', 'Function region (defaults to AWS_REGION)')
+  .option('--profile <profile>', 'AWS profile to use')
+  .action(async function (this: Command) {
+    await main(this)
+  })
+
 program.parse(process.argv)
@@ -19,6 +19,8 @@ const {
   mock_read_file_sync,
   mock_chokidar_watch,
   mock_watcher_on,
+  mock_run_cleanup,
+  mock_run_migrate_config,
   mock_logger
 } = vi.hoisted(() => ({
   mock_deploy: vi.fn(),
@@ -30,6 +32,8 @@ const {
   mock_read_file_sync: vi.fn(),
   mock_chokidar_watch: vi.fn(),
   mock_watcher_on: vi.fn(),
+  mock_run_cleanup: vi.fn(),
+  mock_run_migrate_config: vi.fn(),
   mock_logger: {
     info: vi.fn(),
     error: vi.fn(),
@@ -62,6 +66,18 @@ vi.mock('../server/index.js', () => {
   }
 })
 
+vi.mock('./cleanup.js', () => {
+  return {
+    run_cleanup: mock_run_cleanup
+  }
+})
+
+vi.mock('./migrate_config.js', () => {
+  return {
+    run_migrate_config: mock_run_migrate_config
+  }
+})
+
 vi.mock('../cdk/toolkit/iohost.js', () => {
   return {
     CustomIoHost: vi.fn().mockImplementation(function () {
@@ -96,7 +112,7 @@ vi.mock('chokidar', () => {
 })
 
 // Import after mocks
-import { main } from './main.js'
+import { main, resolve_deterministic, resolve_runtime_image } from './main.js'
 import * as toolkit_lib from '@aws-cdk/toolkit-lib'
 import * as iohost_module from '../cdk/toolkit/iohost.js'
 
@@ -106,9 +122,13 @@ describe('main', () => {
   let sigint_handler: (() => Promise<void>) | null = null
   let sigterm_handler: (() => Promise<void>) | null = null
 
-  function create_mock_command(name: string): Command {
+  function create_mock_command(
+    name: string,
+    opts: Record<string, unknown> = {}
+  ): Command {
     return {
-      name: () => name
+      name: () => name,
+      opts: () => opts
     } as unknown as Command
   }
 
@@ -386,6 +406,33 @@ describe('main', () => {
     })
   })
 
+  describe('cleanup command', () => {
+    it('should run the janitor without loading the CDK app', async () => {
+      const options = { bucket: 'payloads', maxAge: '2h', dryRun: true }
+      mock_run_cleanup.mockResolvedValue({ scanned: 0, removed: [] })
+
+      await main(create_mock_command('cleanup', options))
+
+      expect(mock_run_cleanup).toHaveBeenCalledWith(options)
+      expect(mock_read_file_sync).not.toHaveBeenCalled()
+      expect(mock_deploy).not.toHaveBeenCalled()
+      expect(mock_destroy).not.toHaveBeenCalled()
+    })
+  })
+
+  describe('migrate-config command', () => {
+    it('should migrate functions without loading the CDK app', async () => {
+      const options = { function: ['orders'], stage: 'dev', apply: true }
+      mock_run_migrate_config.mockResolvedValue({})
+
+      await main(create_mock_command('migrate-config', options))
+
+      expect(mock_run_migrate_config).toHaveBeenCalledWith(options)
+      expect(mock_read_file_sync).not.toHaveBeenCalled()
+      expect(mock_deploy).not.toHaveBeenCalled()
+    })
+  })
+
   describe('server config extraction', () => {
     it('should extract server config from deployment outputs', async () => {
       const command = create_mock_command('start')
@@ -740,4 +787,74 @@ describe('main', () => {
       mock_exit.mockRestore()
     })
   })
+
+  describe('server options', () => {
+    it('should pass --runtime-image, --diff-events, --pull and --deterministic through to the server', async () => {
+      const queue_url = 'https://sqs.us-east-1.amazonaws.com/123456789012/live-lambda'
+      const command = create_mock_command('start', {
+        runtimeImage: true,
+        diffEvents: 'rawPath',
+        pull: queue_url,
+        deterministic: '42'
+      })
+      mock_deploy.mockResolvedValue(
+        create_mock_deployment([
+          {
+            stackName: APPSYNC_STACK_NAME,
+            environment: { region: 'us-east-1' },
+            outputs: {
+              [OUTPUT_EVENT_API_HTTP_HOST]: 'http-host.appsync.aws',
+              [OUTPUT_EVENT_API_REALTIME_HOST]: 'realtime-host.appsync.aws'
+            }
+          },
+          {
+            stackName: LAYER_STACK_NAME,
+            outputs: {
+              [OUTPUT_LIVE_LAMBDA_PROXY_LAYER_ARN]:
+                'arn:aws:lambda:us-east-1:123456789012:layer:LiveLambdaProxy:1'
+            }
+          }
+        ])
+      )
+
+      await main(command)
+
+      expect(mock_serve).toHaveBeenCalledWith(
+        expect.objectContaining({
+          runtime_image: 'auto',
+          diff_events: 'rawPath',
+          pull_mailbox: queue_url,
+          deterministic: 42
+        })
+      )
+    })
+  })
+
+  describe('resolve_runtime_image', () => {
+    it('should run in-process when the option is not set', () => {
+      expect(resolve_runtime_image(undefined)).toBeUndefined()
+    })
+
+    it('should pick the image from the function runtime for a bare flag', () => {
+      expect(resolve_runtime_image(true)).toBe('auto')
+    })
+
+    it('should pass an explicit image through', () => {
+      expect(resolve_runtime_image('public.ecr.aws/lambda/nodejs:22')).toBe(
+        'public.ecr.aws/lambda/nodejs:22'
+      )
+    })
+  })
+
+  describe('resolve_deterministic', () => {
+    it('should derive seeds from request IDs for a bare flag', () => {
+      expect(resolve_deterministic(undefined)).toBeUndefined()
+      expect(resolve_deterministic(true)).toBe(true)
+    })
+
+    it('should fix the seed to an integer value', () => {
+      expect(resolve_deterministic('7')).toBe(7)
+      expect(() => resolve_deterministic('soon')).toThrow('expected an integer')
+    })
+  })
 })
@@ -5,11 +5,15 @@ import {
   StackSelectionStrategy
 } from '@aws-cdk/toolkit-lib'
 import { serve } from '../server/index.js'
+import { run_cleanup } from './cleanup.js'
+import { run_migrate_config } from './migrate_config.js'
 import { Command } from 'commander'
 import * as fs from 'fs'
 import chokidar from 'chokidar'
 import { CustomIoHost } from '../cdk/toolkit/iohost.js'
 import { logger } from '../lib/logger.js'
+import { AUTO_RUNTIME_IMAGE } from '../server/container_runtime.js'
+import type { ServerConfig } from '../server/types.js'
 import {
   APPSYNC_STACK_NAME,
   LAYER_STACK_NAME,
@@ -19,6 +23,18 @@ import {
 } from '../lib/constants.js'
 
 const CDK_OUTPUTS_FILE = 'cdk.out/outputs.json'
+// Server settings that come from command-line options rather than stack outputs
+type ServerOptions = Pick<
+  ServerConfig,
+  | 'runtime_image'
+  | 'diff_events'
+  | 'pull_mailbox'
+  | 'deterministic'
+  | 'stage'
+  | 'channel_scope'
+  | 'requests_channel'
+  | 'response_channel'
+>
 const MAX_CONCURRENCY = 5
 export async function main(command: Command) {
   const custom_io_host = new CustomIoHost()
@@ -46,6 +62,16 @@ export async function main(command: Command) {
   try {
     const command_name = command.name()
 
+    // Cleanup and migrate-config work on AWS resources directly and need no CDK app
+    if (command_name === 'cleanup') {
+      await run_cleanup(command.opts())
+      return
+    }
+    if (command_name === 'migrate-config') {
+      await run_migrate_config(command.opts())
+      return
+    }
+
     const { app: entrypoint, watch: watch_config } = JSON.parse(
       fs.readFileSync('cdk.json', 'utf-8')
     )
@@ -53,8 +79,19 @@ export async function main(command: Command) {
     const assembly = await cdk.fromCdkApp(entrypoint)
 
     if (command_name === 'start') {
+      const options = command.opts()
+      const server_options: ServerOptions = {
+        runtime_image: resolve_runtime_image(options.runtimeImage),
+        diff_events: options.diffEvents,
+        pull_mailbox: options.pull,
+        deterministic: resolve_deterministic(options.deterministic),
+        stage: options.stage,
+        channel_scope: options.channelScope,
+        requests_channel: options.requestsChannel,
+        response_channel: options.responseChannel
+      }
       try {
-        await run_server(cdk, assembly, watch_config)
+        await run_server(cdk, assembly, watch_config, server_options)
       } catch (error) {
         // Attempt to destroy stacks on error during start, then re-run server
         // This might be specific to your workflow, adjust as needed
@@ -63,7 +100,7 @@ export async function main(command: Command) {
           error
         )
         await destroy_stacks(cdk, assembly)
-        await run_server(cdk, assembly, watch_config)
+        await run_server(cdk, assembly, watch_config, server_options)
       }
     }
 
@@ -79,15 +116,49 @@ export async function main(command: Command) {
   }
 }
 
+/**
+ * Normalizes the --runtime-image option: a bare flag selects the base image
+ * matching each function's runtime.
+ */
+export function resolve_runtime_image(
+  option: string | boolean | undefined
+): string | undefined {
+  if (option === true) {
+    return AUTO_RUNTIME_IMAGE
+  }
+  return option || undefined
+}
+
+/**
+ * Normalizes the --deterministic option: a bare flag derives each seed from
+ * the request ID, a value fixes the seed.
+ */
+export function resolve_deterministic(
+  option: string | boolean | undefined
+): true | number | undefined {
+  if (option === undefined || option === false) {
+    return undefined
+  }
+  if (option === true) {
+    return true
+  }
+  const seed = Number(option)
+  if (!Number.isInteger(seed)) {
+    throw new Error(`Invalid --deterministic seed "${option}": expected an integer`)
+  }
+  return seed
+}
+
 async function run_server(
   cdk: Toolkit,
   assembly: ICloudAssemblySource,
-  watch_config: any
+  watch_config: any,
+  server_options: ServerOptions = {}
 ): Promise<void> {
   const deployment = await deploy_stacks(cdk, assembly)
 
   const config = extract_server_config(deployment)
-  await serve(config)
+  await serve({ ...config, ...server_options })
   await watch_file_changes(cdk, assembly)
   await watch_stacks(cdk, assembly, watch_config)
 
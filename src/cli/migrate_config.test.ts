@@ -0,0 +1,124 @@
+import { describe, it, expect, vi } from 'vitest'
+
+vi.mock('@aws-sdk/client-lambda', () => ({
+  LambdaClient: class {},
+  GetFunctionConfigurationCommand: class {},
+  UpdateFunctionConfigurationCommand: class {}
+}))
+
+vi.mock('@aws-sdk/credential-providers', () => ({
+  fromIni: vi.fn(),
+  fromNodeProviderChain: vi.fn()
+}))
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  FunctionEnvironment,
+  format_migration,
+  plan_migration,
+  run_migrate_config
+} from './migrate_config.js'
+
+const legacy_environment = {
+  AWS_LAMBDA_EXEC_WRAPPER: '/opt/live-lambda-runtime-wrapper.sh',
+  APPSYNC_ENDPOINT_URL: 'wss://abc.appsync-realtime-api.us-east-1.amazonaws.com/event/realtime',
+  APPSYNC_API_ID: 'abc123',
+  APPSYNC_REGION: 'us-east-1',
+  LIVE_LAMBDA_LAYER_ARN: 'arn:aws:lambda:us-east-1:123456789012:layer:live-lambda-proxy:3',
+  LIVE_LAMBDA_CHUNKSIZE: '65536',
+  LRAP_LISTENER_PORT: '8082'
+}
+
+function memory_functions(
+  environments: Record<string, Record<string, string>>
+): FunctionEnvironment & { written: Record<string, Record<string, string>> } {
+  const written: Record<string, Record<string, string>> = {}
+  return {
+    written,
+    read: async (function_name) => ({ ...environments[function_name] }),
+    write: async (function_name, environment) => {
+      written[function_name] = environment
+    }
+  }
+}
+
+describe('migrate_config', () => {
+  describe('plan_migration', () => {
+    it('should move legacy AppSync settings to their current names', () => {
+      const { environment } = plan_migration(legacy_environment)
+
+      expect(environment).toEqual({
+        AWS_LAMBDA_EXEC_WRAPPER: '/opt/live-lambda-runtime-wrapper.sh',
+        LIVE_LAMBDA_APPSYNC_REALTIME_HOST: 'abc.appsync-realtime-api.us-east-1.amazonaws.com',
+        LIVE_LAMBDA_APPSYNC_HTTP_HOST: 'abc.appsync-api.us-east-1.amazonaws.com',
+        LIVE_LAMBDA_APPSYNC_REGION: 'us-east-1',
+        LIVE_LAMBDA_CHUNK_SIZE: '65536',
+        LRAP_LISTENER_PORT: '8082'
+      })
+    })
+
+    it('should keep a current value over a legacy one', () => {
+      const plan = plan_migration({
+        APPSYNC_REGION: 'us-east-1',
+        LIVE_LAMBDA_APPSYNC_REGION: 'eu-west-1'
+      })
+
+      expect(plan.environment).toEqual({ LIVE_LAMBDA_APPSYNC_REGION: 'eu-west-1' })
+      expect(plan.changes).toEqual([
+        expect.objectContaining({ action: 'remove', name: 'APPSYNC_REGION' })
+      ])
+    })
+
+    it('should move the function to its stage namespace', () => {
+      const plan = plan_migration({ LIVE_LAMBDA_APPSYNC_REGION: 'us-east-1' }, { stage: 'dev' })
+
+      expect(plan.environment).toMatchObject({
+        LIVE_LAMBDA_APPSYNC_NAMESPACE: 'live-lambda-dev',
+        LIVE_LAMBDA_NAMESPACE_CHECK: 'enforce'
+      })
+      expect(() => plan_migration({}, { stage: 'dev/feature' })).toThrow('Invalid stage')
+    })
+
+    it('should report nothing for an up-to-date environment', () => {
+      const plan = plan_migration({ LIVE_LAMBDA_APPSYNC_REGION: 'us-east-1', LIVE_LAMBDA_CUSTOM: 'x' })
+
+      expect(plan.changes).toEqual([])
+      expect(format_migration('orders', plan)).toBe('orders: already up to date')
+    })
+  })
+
+  describe('run_migrate_config', () => {
+    it('should only write the environment with --apply', async () => {
+      const functions = memory_functions({ orders: legacy_environment })
+
+      await run_migrate_config({ function: ['orders'] }, functions)
+      expect(functions.written).toEqual({})
+
+      await run_migrate_config({ function: ['orders'], apply: true }, functions)
+      expect(functions.written.orders.LIVE_LAMBDA_APPSYNC_REGION).toBe('us-east-1')
+      expect(functions.written.orders.APPSYNC_REGION).toBeUndefined()
+    })
+
+    it('should not write functions that are up to date', async () => {
+      const functions = memory_functions({ orders: { LIVE_LAMBDA_APPSYNC_REGION: 'us-east-1' } })
+
+      await run_migrate_config({ function: ['orders'], apply: true }, functions)
+
+      expect(functions.written).toEqual({})
+    })
+
+    it('should require at least one function', async () => {
+      await expect(run_migrate_config({}, memory_functions({}))).rejects.toThrow('--function is required')
+    })
+  })
+})
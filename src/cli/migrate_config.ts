@@ -0,0 +1,345 @@
+import {
+  GetFunctionConfigurationCommand,
+  LambdaClient,
+  UpdateFunctionConfigurationCommand
+} from '@aws-sdk/client-lambda'
+import { fromIni, fromNodeProviderChain } from '@aws-sdk/credential-providers'
+import { stage_namespace } from '../constants.js'
+import { logger } from '../lib/logger.js'
+
+/**
+ * Upgrades a function's live-lambda environment variables to the current
+ * names. Older deployments configured the extension with APPSYNC_* variables,
+ * and all stages shared the live-lambda channel namespace. `live-lambda
+ * migrate-config` prints the new environment and, with --apply, writes it back
+ * with the Lambda API.
+ */
+
+/**
+ * Every variable the extension reads, mirroring the constants in
+ * src/cdk/layer/extension-go/main.go.
+ */
+export const EXTENSION_SETTINGS = [
+  'LIVE_LAMBDA_APPSYNC_HTTP_HOST',
+  'LIVE_LAMBDA_APPSYNC_REALTIME_HOST',
+  'LIVE_LAMBDA_APPSYNC_REGION',
+  'LIVE_LAMBDA_APPSYNC_NAMESPACE',
+  'LIVE_LAMBDA_NAMESPACE_CHECK',
+  'LIVE_LAMBDA_DIAGNOSTICS_INTERVAL',
+  'LIVE_LAMBDA_PING_INTERVAL',
+  'LIVE_LAMBDA_FUNCTION_TAGS',
+  'LIVE_LAMBDA_TAG_LOOKUP',
+  'LIVE_LAMBDA_CHUNK_REASSEMBLY_TIMEOUT',
+  'LIVE_LAMBDA_CHUNK_SIZE',
+  'LIVE_LAMBDA_CHUNK_RETRANSMIT_AFTER',
+  'LIVE_LAMBDA_AWS_PROFILE',
+  'LIVE_LAMBDA_AWS_CREDENTIAL_SOURCE',
+  'LIVE_LAMBDA_LATENCY_SUMMARY_EVERY',
+  'LIVE_LAMBDA_ENV_ALLOWLIST',
+  'LIVE_LAMBDA_ENV_DENYLIST',
+  'LIVE_LAMBDA_ENV_ENCRYPTION',
+  'LIVE_LAMBDA_SHARE_CREDENTIALS',
+  'LIVE_LAMBDA_ENV_CHANNEL',
+  'LIVE_LAMBDA_ENV_REDACT',
+  'LIVE_LAMBDA_REDACT_LOGS',
+  'LIVE_LAMBDA_REDACT_PATHS',
+  'LIVE_LAMBDA_LOCAL_API_SOCKET',
+  'LIVE_LAMBDA_OFFLOAD_BUCKET',
+  'LIVE_LAMBDA_OFFLOAD_PREFIX',
+  'LIVE_LAMBDA_OFFLOAD_THRESHOLD',
+  'LIVE_LAMBDA_OFFLOAD_REGION',
+  'LIVE_LAMBDA_OFFLOAD_TTL',
+  'LIVE_LAMBDA_SAMPLING_MAX_RPS',
+  'LIVE_LAMBDA_SAMPLING_MIN_RATE',
+  'LIVE_LAMBDA_SAMPLING_RECOVER_RATIO',
+  'LIVE_LAMBDA_SAMPLING_COOLDOWN',
+  'LIVE_LAMBDA_PRESENCE_TTL',
+  'LIVE_LAMBDA_FALLBACK',
+  'LIVE_LAMBDA_FALLBACK_RETRIES',
+  'LIVE_LAMBDA_FALLBACK_BACKOFF',
+  'LIVE_LAMBDA_MAILBOX_QUEUE_URL',
+  'LIVE_LAMBDA_TELEMETRY',
+  'LIVE_LAMBDA_TELEMETRY_TYPES',
+  'LIVE_LAMBDA_TELEMETRY_PORT',
+  'LIVE_LAMBDA_TELEMETRY_COOPERATIVE',
+  'LIVE_LAMBDA_METRICS',
+  'LIVE_LAMBDA_METRICS_NAMESPACE',
+  'LIVE_LAMBDA_CONFIG_FILE',
+  'LIVE_LAMBDA_COMPRESSION',
+  'LIVE_LAMBDA_COMPRESSION_MIN_BYTES',
+  'LIVE_LAMBDA_TUNNEL_FAILURE_LIMIT',
+  'LIVE_LAMBDA_TUNNEL_FAILURE_WINDOW',
+  'LIVE_LAMBDA_TRANSPORT',
+  'LIVE_LAMBDA_TRANSPORT_POOL_SIZE',
+  'LIVE_LAMBDA_IOT_ENDPOINT',
+  'LIVE_LAMBDA_IOT_REGION',
+  'LIVE_LAMBDA_APPSYNC_AUTH_MODE',
+  'LIVE_LAMBDA_APPSYNC_API_KEY',
+  'LIVE_LAMBDA_APPSYNC_AUTH_TOKEN',
+  'LIVE_LAMBDA_DRAIN_TIMEOUT',
+  'LIVE_LAMBDA_DEADLINE_MARGIN',
+  'LIVE_LAMBDA_RECORD',
+  'LIVE_LAMBDA_RECORD_RESPONSES',
+  'LIVE_LAMBDA_RECORD_CAPACITY',
+  'LIVE_LAMBDA_RECORD_FLUSH_INTERVAL',
+  'LIVE_LAMBDA_LOAD_SHEDDING',
+  'LIVE_LAMBDA_SHED_MEMORY_PERCENT',
+  'LIVE_LAMBDA_SHED_MAX_FUNCTION_MB',
+  'LIVE_LAMBDA_REGIONAL_ENDPOINTS',
+  'LIVE_LAMBDA_REGION_RETRY_INTERVAL',
+  'LIVE_LAMBDA_FAILOVER_ENDPOINTS',
+  'LIVE_LAMBDA_FAILOVER_AFTER',
+  'LIVE_LAMBDA_LOG_LEVEL',
+  'LIVE_LAMBDA_LOG_FORMAT',
+  'LIVE_LAMBDA_XRAY',
+  'LIVE_LAMBDA_ENABLED',
+  'LIVE_LAMBDA_CHANNEL_SCOPE',
+  'LIVE_LAMBDA_DEVELOPER_ID',
+  'LIVE_LAMBDA_REQUESTS_CHANNEL',
+  'LIVE_LAMBDA_RESPONSE_CHANNEL',
+  'LIVE_LAMBDA_CLAIM_WINDOW',
+  'LIVE_LAMBDA_ACK_WINDOW',
+  'LIVE_LAMBDA_RESTORE_RECONNECT',
+  'LIVE_LAMBDA_RESPONSE_CACHE_TTL',
+  'LIVE_LAMBDA_RESPONSE_CACHE_SIZE',
+  'LIVE_LAMBDA_RESPONSE_CACHE_MAX_BYTES',
+  'LIVE_LAMBDA_RESPONSE_CACHE_IGNORE',
+  'LIVE_LAMBDA_REENCODE_EVENTS',
+  'LIVE_LAMBDA_RESPONSE_SHAPE_CHECK',
+  'LIVE_LAMBDA_RUNTIME_API_MAX_IDLE_CONNS',
+  'LIVE_LAMBDA_RUNTIME_API_POST_TIMEOUT',
+  'LIVE_LAMBDA_PAYLOAD_KEY_ARN',
+  'LIVE_LAMBDA_RESPONSE_SIGNING_SECRET_ARN',
+  'LIVE_LAMBDA_IDLE_RECONNECT_AFTER',
+  'LIVE_LAMBDA_WARM_STANDBY',
+  'LIVE_LAMBDA_RESPONSE_SUBSCRIPTION',
+  'LIVE_LAMBDA_CONNECTION_CHECK_AFTER',
+  'LIVE_LAMBDA_SAMPLE_RATE',
+  'LIVE_LAMBDA_INTERCEPT_WHEN',
+  'LIVE_LAMBDA_ROUTING_RULES',
+  'LIVE_LAMBDA_DYNAMIC_CONFIG_PARAMETER',
+  'LIVE_LAMBDA_DYNAMIC_CONFIG_REFRESH'
+]
+
+export interface ConfigChange {
+  action: 'rename' | 'remove' | 'set'
+  name: string
+  from?: string // the variable a rename replaces
+  value?: string
+  note: string
+}
+
+export interface MigrationPlan {
+  environment: Record<string, string>
+  changes: ConfigChange[]
+}
+
+export interface MigrationOptions {
+  stage?: string // move the function to the stage's channel namespace
+}
+
+/**
+ * Turns wss://{host}/event/realtime into {host}.
+ */
+function host_from_url(url: string): string | undefined {
+  try {
+    return new URL(url).hostname || undefined
+  } catch {
+    return undefined
+  }
+}
+
+function squash(name: string): string {
+  return name.replace(/_/g, '')
+}
+
+/**
+ * Works out the up-to-date environment for a function.
+ * Variables the migration does not know are kept as they are.
+ */
+export function plan_migration(
+  current: Record<string, string>,
+  options: MigrationOptions = {}
+): MigrationPlan {
+  const environment = { ...current }
+  const changes: ConfigChange[] = []
+
+  const rename = (from: string, name: string, value: string, note: string) => {
+    delete environment[from]
+    if (environment[name] !== undefined) {
+      changes.push({ action: 'remove', name: from, note: `${name} is already set; ${note}` })
+      return
+    }
+    environment[name] = value
+    changes.push({ action: 'rename', name, from, value, note })
+  }
+  const remove = (name: string, note: string) => {
+    delete environment[name]
+    changes.push({ action: 'remove', name, note })
+  }
+  const set = (name: string, value: string, note: string) => {
+    if (environment[name] === value) {
+      return
+    }
+    environment[name] = value
+    changes.push({ action: 'set', name, value, note })
+  }
+
+  if (current.APPSYNC_ENDPOINT_URL !== undefined) {
+    const realtime_host = host_from_url(current.APPSYNC_ENDPOINT_URL)
+    if (realtime_host) {
+      rename(
+        'APPSYNC_ENDPOINT_URL',
+        'LIVE_LAMBDA_APPSYNC_REALTIME_HOST',
+        realtime_host,
+        'the extension takes the realtime host rather than the WebSocket URL'
+      )
+      if (
+        environment.LIVE_LAMBDA_APPSYNC_HTTP_HOST === undefined &&
+        realtime_host.includes('.appsync-realtime-api.')
+      ) {
+        set(
+          'LIVE_LAMBDA_APPSYNC_HTTP_HOST',
+          realtime_host.replace('.appsync-realtime-api.', '.appsync-api.'),
+          'derived from the realtime host'
+        )
+      }
+    } else {
+      remove('APPSYNC_ENDPOINT_URL', 'not a URL; set LIVE_LAMBDA_APPSYNC_REALTIME_HOST by hand')
+    }
+  }
+  if (current.APPSYNC_REGION !== undefined) {
+    rename('APPSYNC_REGION', 'LIVE_LAMBDA_APPSYNC_REGION', current.APPSYNC_REGION, 'renamed')
+  }
+  if (current.APPSYNC_API_ID !== undefined) {
+    remove('APPSYNC_API_ID', 'the extension finds the API by its hosts')
+  }
+  if (current.LIVE_LAMBDA_LAYER_ARN !== undefined) {
+    remove('LIVE_LAMBDA_LAYER_ARN', 'the layer is attached to the function, not configured')
+  }
+
+  // Misspelled settings the extension would ignore, e.g. LIVE_LAMBDA_CHUNKSIZE
+  for (const name of Object.keys(current)) {
+    if (!name.startsWith('LIVE_LAMBDA_') || EXTENSION_SETTINGS.includes(name)) {
+      continue
+    }
+    if (environment[name] === undefined) {
+      continue
+    }
+    const known = EXTENSION_SETTINGS.find((setting) => squash(setting) === squash(name))
+    if (known) {
+      rename(name, known, current[name], `${name} is not a setting the extension reads`)
+    }
+  }
+
+  if (options.stage) {
+    const namespace = stage_namespace(options.stage)
+    set('LIVE_LAMBDA_APPSYNC_NAMESPACE', namespace, `channels move to the ${namespace} namespace`)
+    set(
+      'LIVE_LAMBDA_NAMESPACE_CHECK',
+      'enforce',
+      'refuse to intercept unless the namespace is confirmed'
+    )
+  }
+
+  return { environment, changes }
+}
+
+/**
+ * Describes a plan for the log, one change per line.
+ */
+export function format_migration(function_name: string, plan: MigrationPlan): string {
+  if (plan.changes.length === 0) {
+    return `${function_name}: already up to date`
+  }
+  const lines = plan.changes.map((change) => {
+    switch (change.action) {
+      case 'rename':
+        return `  ~ ${change.from} -> ${change.name}=${change.value} (${change.note})`
+      case 'set':
+        return `  + ${change.name}=${change.value} (${change.note})`
+      case 'remove':
+        return `  - ${change.name} (${change.note})`
+    }
+  })
+  return [`${function_name}:`, ...lines].join('\n')
+}
+
+export interface FunctionEnvironment {
+  read(function_name: string): Promise<Record<string, string>>
+  write(function_name: string, environment: Record<string, string>): Promise<void>
+}
+
+/**
+ * Reads and writes function environments through the Lambda API.
+ */
+export class LambdaFunctionEnvironment implements FunctionEnvironment {
+  private readonly client: LambdaClient
+
+  constructor(region?: string, profile?: string) {
+    this.client = new LambdaClient({
+      region,
+      credentials: profile ? fromIni({ profile }) : fromNodeProviderChain()
+    })
+  }
+
+  async read(function_name: string): Promise<Record<string, string>> {
+    const configuration = await this.client.send(
+      new GetFunctionConfigurationCommand({ FunctionName: function_name })
+    )
+    return configuration.Environment?.Variables ?? {}
+  }
+
+  async write(function_name: string, environment: Record<string, string>): Promise<void> {
+    await this.client.send(
+      new UpdateFunctionConfigurationCommand({
+        FunctionName: function_name,
+        Environment: { Variables: environment }
+      })
+    )
+  }
+}
+
+export interface MigrateConfigCommandOptions {
+  function?: string[]
+  stage?: string
+  apply?: boolean
+  region?: string
+  profile?: string
+}
+
+/**
+ * Runs `live-lambda migrate-config` with the options given on the command line.
+ * Returns each function's plan; the environments are only written with --apply.
+ */
+export async function run_migrate_config(
+  options: MigrateConfigCommandOptions,
+  functions: FunctionEnvironment = new LambdaFunctionEnvironment(
+    options.region ?? process.env.AWS_REGION ?? process.env.AWS_DEFAULT_REGION,
+    options.profile
+  )
+): Promise<Record<string, MigrationPlan>> {
+  if (!options.function?.length) {
+    throw new Error('--function is required: pass the name or ARN of each function to migrate')
+  }
+
+  const plans: Record<string, MigrationPlan> = {}
+  for (const function_name of options.function) {
+    const plan = plan_migration(await functions.read(function_name), { stage: options.stage })
+    plans[function_name] = plan
+    logger.info(format_migration(function_name, plan))
+    if (plan.changes.length === 0) {
+      continue
+    }
+    if (options.apply) {
+      await functions.write(function_name, plan.environment)
+      logger.info(`Updated the environment of ${function_name}`)
+    } else {
+      logger.info(JSON.stringify({ Variables: plan.environment }, null, 2))
+    }
+  }
+  if (!options.apply && Object.values(plans).some((plan) => plan.changes.length > 0)) {
+    logger.info('Run again with --apply to update the functions')
+  }
+  return plans
+}
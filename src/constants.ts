@@ -1 +1,70 @@
 export const APPSYNC_EVENTS_API_NAMESPACE = 'live-lambda'
+
+/**
+ * The channels live-lambda uses, relative to the namespace. A braced segment
+ * matches any single value. The generated namespace handlers refuse every
+ * other channel.
+ */
+export const CHANNEL_TEMPLATE = [
+  'requests',
+  'response/{request_id}',
+  'presence/{function_name}',
+  'lifecycle/{function_name}',
+  'control/{function_name}',
+  'logs/{function_name}',
+  'recordings/{function_name}',
+  'agents/{agent_id}',
+  'reply/{request_id}'
+]
+
+/**
+ * The default requests and response channels. Functions can move them with
+ * LIVE_LAMBDA_REQUESTS_CHANNEL and LIVE_LAMBDA_RESPONSE_CHANNEL; see
+ * `channel_template`.
+ */
+export const DEFAULT_REQUESTS_CHANNEL = 'requests'
+export const DEFAULT_RESPONSE_CHANNEL = 'response/{request_id}'
+export const REQUEST_ID_PLACEHOLDER = '{request_id}'
+
+/**
+ * Returns CHANNEL_TEMPLATE with the requests and response channels replaced
+ * by the given templates, for the namespace handlers. The handlers only look
+ * at each channel's first segment and length, so placeholders after the first
+ * segment, such as {function}, match any value.
+ */
+export function channel_template(requests?: string, response?: string): string[] {
+  const trim = (template: string) => template.replace(/^\/+|\/+$/g, '')
+  return [
+    trim(requests || DEFAULT_REQUESTS_CHANNEL),
+    trim(response || DEFAULT_RESPONSE_CHANNEL),
+    ...CHANNEL_TEMPLATE.filter(
+      (channel) => channel !== DEFAULT_REQUESTS_CHANNEL && channel !== DEFAULT_RESPONSE_CHANNEL
+    )
+  ]
+}
+
+/**
+ * How many scope segments (LIVE_LAMBDA_CHANNEL_SCOPE) may sit between the
+ * namespace and a template channel. AppSync allows five segments per channel.
+ */
+export const MAX_CHANNEL_SCOPE_SEGMENTS = 2
+
+const STAGE_PATTERN = /^[A-Za-z0-9-]+$/
+const MAX_NAMESPACE_LENGTH = 50
+
+/**
+ * Returns the channel namespace of a stage. Stages that share one Events API
+ * each get their own namespace, so IAM can scope developers to theirs.
+ */
+export function stage_namespace(stage?: string): string {
+  if (!stage) {
+    return APPSYNC_EVENTS_API_NAMESPACE
+  }
+  const namespace = `${APPSYNC_EVENTS_API_NAMESPACE}-${stage}`
+  if (!STAGE_PATTERN.test(stage) || namespace.length > MAX_NAMESPACE_LENGTH) {
+    throw new Error(
+      `Invalid stage "${stage}": use letters, digits and hyphens, at most ${MAX_NAMESPACE_LENGTH - APPSYNC_EVENTS_API_NAMESPACE.length - 1} characters`
+    )
+  }
+  return namespace
+}
@@ -1 +1,2 @@
 export { LiveLambda } from './cdk/live_lambda.js'
+export { LiveLambdaEvents } from './cdk/live_lambda_events.js'
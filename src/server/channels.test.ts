@@ -0,0 +1,45 @@
+import { afterEach, describe, it, expect } from 'vitest'
+import {
+  channel,
+  requests_channel,
+  response_channel,
+  use_channels,
+  use_stage
+} from './channels.js'
+
+describe('channels', () => {
+  afterEach(() => {
+    use_stage(undefined)
+    use_channels()
+  })
+
+  it('should use the live-lambda namespace without a stage', () => {
+    expect(channel('requests')).toBe('/live-lambda/requests')
+  })
+
+  it('should move every channel into the stage namespace', () => {
+    use_stage('dev')
+    expect(channel('presence/*')).toBe('/live-lambda-dev/presence/*')
+  })
+
+  it('should reject stages that are not valid namespace names', () => {
+    expect(() => use_stage('dev/feature')).toThrow('Invalid stage')
+  })
+
+  it('should put every channel under the channel scope', () => {
+    use_stage('dev', '/orders/alice/')
+    expect(channel('requests')).toBe('/live-lambda-dev/orders/alice/requests')
+    expect(() => use_stage(undefined, 'a/b/c')).toThrow('Invalid channel scope')
+    expect(() => use_stage(undefined, 'alice.smith')).toThrow('Invalid channel scope')
+  })
+
+  it('should serve custom requests and response channels', () => {
+    expect(requests_channel()).toBe('/live-lambda/requests')
+    expect(response_channel('r1')).toBe('/live-lambda/response/r1')
+    use_stage('dev', 'alice')
+    use_channels('/invocations/orders/', 'answers/{request_id}')
+    expect(requests_channel()).toBe('/live-lambda-dev/alice/invocations/orders')
+    expect(response_channel('r1')).toBe('/live-lambda-dev/alice/answers/r1')
+    expect(() => use_channels(undefined, 'answers')).toThrow('Invalid response channel')
+  })
+})
@@ -0,0 +1,76 @@
+import {
+  APPSYNC_EVENTS_API_NAMESPACE,
+  DEFAULT_REQUESTS_CHANNEL,
+  DEFAULT_RESPONSE_CHANNEL,
+  MAX_CHANNEL_SCOPE_SEGMENTS,
+  REQUEST_ID_PLACEHOLDER,
+  stage_namespace
+} from '../constants.js'
+
+let active_namespace = APPSYNC_EVENTS_API_NAMESPACE
+let active_scope = ''
+let active_requests = DEFAULT_REQUESTS_CHANNEL
+let active_response = DEFAULT_RESPONSE_CHANNEL
+
+const SCOPE_SEGMENT_PATTERN = /^[A-Za-z0-9-]{1,50}$/
+
+/**
+ * Points every channel at the stage's namespace, under the channel scope the
+ * functions render LIVE_LAMBDA_CHANNEL_SCOPE to, if any (e.g. orders/alice).
+ * Called once by serve(), before any subscription is made.
+ */
+export function use_stage(stage?: string, channel_scope?: string): void {
+  const segments = (channel_scope ?? '').split('/').filter(Boolean)
+  if (
+    segments.length > MAX_CHANNEL_SCOPE_SEGMENTS ||
+    !segments.every((segment) => SCOPE_SEGMENT_PATTERN.test(segment))
+  ) {
+    throw new Error(
+      `Invalid channel scope "${channel_scope}": use at most ${MAX_CHANNEL_SCOPE_SEGMENTS} segments of letters, digits and hyphens`
+    )
+  }
+  active_namespace = stage_namespace(stage)
+  active_scope = segments.join('/')
+}
+
+/**
+ * Returns the absolute path of a channel in the active namespace and scope,
+ * e.g. channel('presence/*') is /live-lambda/presence/* without a stage or scope.
+ */
+export function channel(path: string): string {
+  if (active_scope) {
+    return `/${active_namespace}/${active_scope}/${path}`
+  }
+  return `/${active_namespace}/${path}`
+}
+
+/**
+ * Serves the requests and response channels the functions render
+ * LIVE_LAMBDA_REQUESTS_CHANNEL and LIVE_LAMBDA_RESPONSE_CHANNEL to. The
+ * response channel keeps its {request_id} segment. Called once by serve(),
+ * after use_stage().
+ */
+export function use_channels(requests?: string, response?: string): void {
+  const trimmed_response = response?.replace(/^\/+|\/+$/g, '') || DEFAULT_RESPONSE_CHANNEL
+  if (!trimmed_response.endsWith(`/${REQUEST_ID_PLACEHOLDER}`)) {
+    throw new Error(
+      `Invalid response channel "${response}": it must end in a ${REQUEST_ID_PLACEHOLDER} segment`
+    )
+  }
+  active_requests = requests?.replace(/^\/+|\/+$/g, '') || DEFAULT_REQUESTS_CHANNEL
+  active_response = trimmed_response
+}
+
+/**
+ * Returns the channel functions publish invocations on.
+ */
+export function requests_channel(): string {
+  return channel(active_requests)
+}
+
+/**
+ * Returns the channel an invocation is answered on.
+ */
+export function response_channel(request_id: string): string {
+  return channel(active_response.replace(REQUEST_ID_PLACEHOLDER, request_id))
+}
@@ -0,0 +1,97 @@
+import { describe, it, expect } from 'vitest'
+import { ChunkReassembler, SentChunks, split_into_chunks } from './chunking.js'
+
+describe('chunking', () => {
+  const payload = Buffer.from('0123456789abcdef')
+
+  describe('split_into_chunks', () => {
+    it('should split a payload into frames sharing a checksum', () => {
+      const frames = split_into_chunks('t', payload, 5)
+
+      expect(frames).toHaveLength(4)
+      expect(frames.map((frame) => frame.seq)).toEqual([0, 1, 2, 3])
+      expect(new Set(frames.map((frame) => frame.checksum)).size).toBe(1)
+      expect(frames.every((frame) => frame.total === 4)).toBe(true)
+      expect(Buffer.from(frames[3].data, 'base64').toString()).toBe('f')
+    })
+
+    it('should send an empty payload as a single chunk', () => {
+      expect(split_into_chunks('t', Buffer.alloc(0), 5)).toHaveLength(1)
+    })
+  })
+
+  describe('ChunkReassembler', () => {
+    it('should reassemble chunks delivered out of order with duplicates', () => {
+      const reassembler = new ChunkReassembler()
+      const [a, b, c, d] = split_into_chunks('t', payload, 5)
+
+      expect(reassembler.add(c)).toBeUndefined()
+      expect(reassembler.add(a)).toBeUndefined()
+      expect(reassembler.add(a)).toBeUndefined()
+      expect(reassembler.add(d)).toBeUndefined()
+      expect(reassembler.add(b)).toEqual(payload)
+      expect(reassembler.add(b)).toBeUndefined()
+    })
+
+    it('should reject chunks that disagree with earlier ones', () => {
+      const reassembler = new ChunkReassembler()
+      const [first] = split_into_chunks('t', payload, 5)
+      const [, other] = split_into_chunks('t', Buffer.from('something else'), 5)
+
+      reassembler.add(first)
+      expect(() => reassembler.add(other)).toThrow('disagrees with earlier chunks')
+    })
+
+    it('should detect a checksum mismatch', () => {
+      const reassembler = new ChunkReassembler()
+      const [frame] = split_into_chunks('t', payload, 100)
+
+      expect(() => reassembler.add({ ...frame, data: Buffer.from('tampered').toString('base64') })).toThrow(
+        'Checksum mismatch'
+      )
+    })
+
+    it('should report stalled transfers once per quiet period', () => {
+      let now = 0
+      const reassembler = new ChunkReassembler(30_000, () => now)
+      const frames = split_into_chunks('t', payload, 5)
+      reassembler.add(frames[1])
+
+      now = 1_000
+      expect(reassembler.stalled('t', 2_000)).toBeUndefined()
+      now = 2_000
+      expect(reassembler.stalled('t', 2_000)).toEqual([0, 2, 3])
+      expect(reassembler.stalled('t', 2_000)).toBeUndefined()
+    })
+
+    it('should forget transfers after the reassembly timeout', () => {
+      let now = 0
+      const reassembler = new ChunkReassembler(10_000, () => now)
+      reassembler.add(split_into_chunks('t', payload, 5)[0])
+
+      expect(reassembler.is_pending('t')).toBe(true)
+      now = 11_000
+      expect(reassembler.is_pending('t')).toBe(false)
+    })
+  })
+
+  describe('SentChunks', () => {
+    it('should select retained chunks by seq, ignoring unknown seqs', () => {
+      const sent = new SentChunks()
+      const frames = split_into_chunks('t', payload, 5)
+      sent.remember('t', frames)
+
+      expect(sent.select('t', [2, 0, 9])).toEqual([frames[2], frames[0]])
+      expect(sent.select('other', [0])).toEqual([])
+    })
+
+    it('should drop chunks after the retention period', () => {
+      let now = 0
+      const sent = new SentChunks(1_000, () => now)
+      sent.remember('t', split_into_chunks('t', payload, 5))
+
+      now = 2_000
+      expect(sent.select('t', [0])).toEqual([])
+    })
+  })
+})
@@ -0,0 +1,203 @@
+import { createHash } from 'node:crypto'
+
+/**
+ * Payloads too large for one AppSync event travel as `chunk` frames sharing a
+ * `transfer_id` (the invocation's request ID). Each frame carries its
+ * zero-based `seq`, the `total` number of chunks and the SHA-256 of the whole
+ * payload. AppSync delivers at least once and in no particular order, so the
+ * receiver buffers chunks until every seq is present, drops duplicates and
+ * verifies the checksum. A receiver missing chunks asks for them with a
+ * `chunk_retransmit` frame listing the seqs; the agent sends these on the
+ * invocation's response channel and the extension on the requests channel.
+ * This mirrors chunking.go in the extension.
+ */
+
+// Raw bytes per chunk; base64 keeps each frame under the 240KB event limit
+export const DEFAULT_CHUNK_SIZE = 150 * 1024
+
+// Messages larger than this are sent as chunks
+export const MAX_INLINE_MESSAGE_BYTES = 200 * 1024
+
+export const DEFAULT_REASSEMBLY_TIMEOUT_MS = 30_000
+export const DEFAULT_RETRANSMIT_AFTER_MS = 2_000
+
+export interface ChunkFrame {
+  type: 'chunk'
+  transfer_id: string
+  seq: number
+  total: number
+  checksum: string
+  data: string
+}
+
+export interface ChunkRetransmitFrame {
+  type: 'chunk_retransmit'
+  request_id: string
+  transfer_id: string
+  seqs: number[]
+}
+
+function sha256_hex(payload: Buffer): string {
+  return createHash('sha256').update(payload).digest('hex')
+}
+
+export function split_into_chunks(
+  transfer_id: string,
+  payload: Buffer,
+  chunk_size = DEFAULT_CHUNK_SIZE
+): ChunkFrame[] {
+  const size = chunk_size > 0 ? chunk_size : Math.max(payload.length, 1)
+  const total = Math.max(1, Math.ceil(payload.length / size))
+  const checksum = sha256_hex(payload)
+  return Array.from({ length: total }, (_, seq) => ({
+    type: 'chunk' as const,
+    transfer_id,
+    seq,
+    total,
+    checksum,
+    data: payload.subarray(seq * size, (seq + 1) * size).toString('base64')
+  }))
+}
+
+interface PendingTransfer {
+  total: number
+  checksum: string
+  parts: Map<number, Buffer>
+  started_at: number
+  last_chunk_at: number
+}
+
+export type Clock = () => number
+
+export class ChunkReassembler {
+  private readonly pending = new Map<string, PendingTransfer>()
+  private readonly completed = new Map<string, number>()
+
+  constructor(
+    private readonly timeout_ms = DEFAULT_REASSEMBLY_TIMEOUT_MS,
+    private readonly now: Clock = Date.now
+  ) {}
+
+  /**
+   * Records a chunk and returns the full payload once the last missing chunk
+   * arrives. Duplicates, including late ones, return undefined.
+   */
+  add(frame: ChunkFrame): Buffer | undefined {
+    if (frame.total <= 0 || frame.seq < 0 || frame.seq >= frame.total) {
+      throw new Error(
+        `Chunk ${frame.seq} of transfer ${frame.transfer_id} is outside [0, ${frame.total})`
+      )
+    }
+    const now = this.now()
+    this.expire(now)
+    if (this.completed.has(frame.transfer_id)) {
+      return undefined
+    }
+
+    let transfer = this.pending.get(frame.transfer_id)
+    if (!transfer) {
+      transfer = {
+        total: frame.total,
+        checksum: frame.checksum,
+        parts: new Map(),
+        started_at: now,
+        last_chunk_at: now
+      }
+      this.pending.set(frame.transfer_id, transfer)
+    }
+    if (transfer.total !== frame.total || transfer.checksum !== frame.checksum) {
+      throw new Error(
+        `Chunk ${frame.seq} of transfer ${frame.transfer_id} disagrees with earlier chunks`
+      )
+    }
+    if (transfer.parts.has(frame.seq)) {
+      return undefined
+    }
+    transfer.parts.set(frame.seq, Buffer.from(frame.data, 'base64'))
+    transfer.last_chunk_at = now
+    if (transfer.parts.size < transfer.total) {
+      return undefined
+    }
+
+    this.pending.delete(frame.transfer_id)
+    const payload = Buffer.concat(
+      Array.from({ length: transfer.total }, (_, seq) => transfer.parts.get(seq)!)
+    )
+    if (sha256_hex(payload) !== transfer.checksum) {
+      throw new Error(`Checksum mismatch for transfer ${frame.transfer_id}`)
+    }
+    this.completed.set(frame.transfer_id, now)
+    return payload
+  }
+
+  /**
+   * Returns the missing seqs of a transfer that has received no chunk for at
+   * least quiet_ms, restarting its quiet period. Returns undefined while the
+   * transfer is progressing, complete or unknown.
+   */
+  stalled(transfer_id: string, quiet_ms: number): number[] | undefined {
+    const transfer = this.pending.get(transfer_id)
+    const now = this.now()
+    if (!transfer || now - transfer.last_chunk_at < quiet_ms) {
+      return undefined
+    }
+    transfer.last_chunk_at = now
+    const seqs: number[] = []
+    for (let seq = 0; seq < transfer.total; seq++) {
+      if (!transfer.parts.has(seq)) {
+        seqs.push(seq)
+      }
+    }
+    return seqs
+  }
+
+  is_pending(transfer_id: string): boolean {
+    this.expire(this.now())
+    return this.pending.has(transfer_id)
+  }
+
+  private expire(now: number): void {
+    for (const [id, transfer] of this.pending) {
+      if (now - transfer.started_at > this.timeout_ms) {
+        this.pending.delete(id)
+      }
+    }
+    for (const [id, completed_at] of this.completed) {
+      if (now - completed_at > 2 * 60_000) {
+        this.completed.delete(id)
+      }
+    }
+  }
+}
+
+/**
+ * Keeps the chunks of sent payloads so they can be retransmitted on request.
+ */
+export class SentChunks {
+  private readonly sent = new Map<string, { frames: ChunkFrame[]; sent_at: number }>()
+
+  constructor(
+    private readonly retention_ms = DEFAULT_REASSEMBLY_TIMEOUT_MS,
+    private readonly now: Clock = Date.now
+  ) {}
+
+  remember(transfer_id: string, frames: ChunkFrame[]): void {
+    this.expire()
+    this.sent.set(transfer_id, { frames, sent_at: this.now() })
+  }
+
+  select(transfer_id: string, seqs: number[]): ChunkFrame[] {
+    this.expire()
+    const frames = this.sent.get(transfer_id)?.frames ?? []
+    return seqs.flatMap((seq) => (frames[seq] ? [frames[seq]] : []))
+  }
+
+  private expire(): void {
+    const now = this.now()
+    for (const [id, entry] of this.sent) {
+      if (now - entry.sent_at > this.retention_ms) {
+        this.sent.delete(id)
+      }
+    }
+  }
+}
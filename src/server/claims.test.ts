@@ -0,0 +1,50 @@
+import { afterEach, describe, it, expect, vi } from 'vitest'
+import { agent_channel, claim_offer, parse_offer } from './claims.js'
+import { use_stage } from './channels.js'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: { warn: vi.fn() }
+}))
+
+describe('claims', () => {
+  afterEach(() => use_stage(undefined))
+
+  it('should recognize invocation offers only', () => {
+    expect(parse_offer('{"type":"invocation_offer","request_id":"r1","function_name":"orders"}')).toEqual({
+      type: 'invocation_offer',
+      request_id: 'r1',
+      function_name: 'orders'
+    })
+    expect(parse_offer('{"request_id":"r1","event_payload":{}}')).toBeUndefined()
+    expect(parse_offer('not json')).toBeUndefined()
+  })
+
+  it('should claim on the response channel', async () => {
+    const publisher = { publish: vi.fn().mockResolvedValue(undefined) }
+
+    await claim_offer(publisher, { type: 'invocation_offer', request_id: 'r1' }, 'agent-1')
+
+    expect(publisher.publish).toHaveBeenCalledWith('/live-lambda/response/r1', [
+      { type: 'claim', request_id: 'r1', agent_id: 'agent-1' }
+    ])
+  })
+
+  it('should echo the offer\'s idempotency key', async () => {
+    const publisher = { publish: vi.fn().mockResolvedValue(undefined) }
+
+    await claim_offer(
+      publisher,
+      { type: 'invocation_offer', request_id: 'r1', idempotency_key: 'r1:1' },
+      'agent-1'
+    )
+
+    expect(publisher.publish).toHaveBeenCalledWith('/live-lambda/response/r1', [
+      { type: 'claim', request_id: 'r1', agent_id: 'agent-1', idempotency_key: 'r1:1' }
+    ])
+  })
+
+  it('should put the private channel in the stage namespace', () => {
+    use_stage('dev')
+    expect(agent_channel('agent-1')).toBe('/live-lambda-dev/agents/agent-1')
+  })
+})
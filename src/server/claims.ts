@@ -0,0 +1,60 @@
+import { channel, response_channel } from './channels.js'
+import { logger } from '../lib/logger.js'
+
+import { EventPublisher } from './types.js'
+
+/**
+ * Invocation claims. When several agents serve the same requests channel, an
+ * extension talking to an agent with the `claims` capability first publishes
+ * an `invocation_offer` there. Each agent answers with a `claim` on the
+ * invocation's response channel; the first claim wins, and the extension
+ * publishes the request only on the winner's private channel,
+ * agents/{agent_id}. Unclaimed invocations still go out on the requests
+ * channel. This mirrors claims.go in the extension.
+ */
+
+export interface InvocationOffer {
+  type: 'invocation_offer'
+  request_id: string
+  function_name?: string
+  sandbox_id?: string
+  idempotency_key?: string
+}
+
+/**
+ * Returns the private channel an agent receives the invocations it won on.
+ */
+export function agent_channel(agent_id: string): string {
+  return channel(`agents/${agent_id}`)
+}
+
+export function parse_offer(payload: string): InvocationOffer | undefined {
+  try {
+    const message = JSON.parse(payload)
+    if (message?.type === 'invocation_offer' && typeof message.request_id === 'string') {
+      return message
+    }
+  } catch {
+    // Not an offer; the request handler reports malformed payloads
+  }
+  return undefined
+}
+
+/**
+ * Claims an offered invocation for agent_id. Losing a claim needs no handling:
+ * the request only reaches the winner.
+ */
+export async function claim_offer(
+  publisher: EventPublisher,
+  offer: InvocationOffer,
+  agent_id: string
+): Promise<void> {
+  try {
+    const claim = offer.idempotency_key
+      ? { type: 'claim', request_id: offer.request_id, agent_id, idempotency_key: offer.idempotency_key }
+      : { type: 'claim', request_id: offer.request_id, agent_id }
+    await publisher.publish(response_channel(offer.request_id), [claim])
+  } catch (error) {
+    logger.warn(`Failed to claim ${offer.request_id}:`, error)
+  }
+}
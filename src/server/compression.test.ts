@@ -0,0 +1,41 @@
+import { describe, it, expect } from 'vitest'
+import { gunzipSync, gzipSync } from 'node:zlib'
+import { COMPRESSION_MIN_BYTES, decode_event_payload, encode_response } from './compression.js'
+
+describe('compression', () => {
+  describe('decode_event_payload', () => {
+    it('should return unencoded events as they are', () => {
+      expect(decode_event_payload({ event_payload: { a: 1 } })).toEqual({ a: 1 })
+    })
+
+    it('should gunzip encoded events', () => {
+      const event = { records: ['x'.repeat(100)] }
+      const event_payload = gzipSync(JSON.stringify(event)).toString('base64')
+
+      expect(decode_event_payload({ event_payload, content_encoding: 'gzip' })).toEqual(event)
+    })
+
+    it('should reject encodings it does not know', () => {
+      expect(() => decode_event_payload({ event_payload: 'abc', content_encoding: 'zstd' })).toThrow(
+        'Unsupported content_encoding'
+      )
+    })
+  })
+
+  describe('encode_response', () => {
+    const response = { statusCode: 200, body: 'a'.repeat(COMPRESSION_MIN_BYTES * 2) }
+
+    it('should gzip responses when the extension accepts it', () => {
+      const encoded = encode_response(response, ['gzip']) as any
+
+      expect(encoded.type).toBe('encoded_payload')
+      expect(encoded.content_encoding).toBe('gzip')
+      expect(JSON.parse(gunzipSync(Buffer.from(encoded.data, 'base64')).toString())).toEqual(response)
+    })
+
+    it('should leave responses alone without negotiation or below the threshold', () => {
+      expect(encode_response(response)).toBe(response)
+      expect(encode_response({ statusCode: 204 }, ['gzip'])).toEqual({ statusCode: 204 })
+    })
+  })
+})
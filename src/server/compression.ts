@@ -0,0 +1,67 @@
+import { gunzipSync, gzipSync } from 'node:zlib'
+
+/**
+ * Events and responses may travel gzipped to cut WebSocket traffic and keep
+ * typical JSON payloads under the AppSync event limit. The agent lists the
+ * encodings it decodes in `accept_encoding` on its heartbeats; the extension
+ * then sends `event_payload` as a base64 string and names the encoding in
+ * `content_encoding`. Requests carry `accept_encoding` when the extension can
+ * decode a compressed response, which the agent sends as an `encoded_payload`
+ * frame. This mirrors compression.go in the extension.
+ */
+
+export const CONTENT_ENCODING_GZIP = 'gzip'
+export const ACCEPTED_ENCODINGS = [CONTENT_ENCODING_GZIP]
+
+// Smaller responses are not worth compressing
+export const COMPRESSION_MIN_BYTES = 1024
+
+export interface EncodedPayload {
+  type: 'encoded_payload'
+  content_encoding: string
+  data: string // base64 of the encoded payload
+}
+
+/**
+ * Returns the event of an invocation whose event_payload may be encoded.
+ */
+export function decode_event_payload(invocation: {
+  event_payload?: unknown
+  content_encoding?: string
+}): unknown {
+  if (!invocation.content_encoding) {
+    return invocation.event_payload
+  }
+  if (invocation.content_encoding !== CONTENT_ENCODING_GZIP) {
+    throw new Error(`Unsupported content_encoding "${invocation.content_encoding}"`)
+  }
+  if (typeof invocation.event_payload !== 'string') {
+    throw new Error('Encoded event_payload must be a base64 string')
+  }
+  const body = gunzipSync(Buffer.from(invocation.event_payload, 'base64'))
+  return JSON.parse(body.toString('utf8'))
+}
+
+/**
+ * Returns the message to publish for a response, gzipped when the extension
+ * accepts it and that makes the message smaller.
+ */
+export function encode_response(message: unknown, accept_encoding?: string[]): unknown {
+  if (!accept_encoding?.includes(CONTENT_ENCODING_GZIP)) {
+    return message
+  }
+  const body = Buffer.from(JSON.stringify(message ?? null))
+  if (body.length < COMPRESSION_MIN_BYTES) {
+    return message
+  }
+  const data = gzipSync(body).toString('base64')
+  if (data.length >= body.length) {
+    return message
+  }
+  const encoded: EncodedPayload = {
+    type: 'encoded_payload',
+    content_encoding: CONTENT_ENCODING_GZIP,
+    data
+  }
+  return encoded
+}
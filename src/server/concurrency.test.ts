@@ -0,0 +1,112 @@
+import { describe, it, expect, vi, beforeEach, afterEach } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  ConcurrencyTracker,
+  format_concurrency,
+  parse_ping,
+  start_concurrency_status
+} from './concurrency.js'
+import { logger } from '../lib/logger.js'
+
+function ping(sandbox_id: string, function_name: string, in_flight: number, extra = {}): string {
+  return JSON.stringify({
+    type: 'ping',
+    sandbox_id,
+    function_name,
+    timestamp: '2024-01-01T00:00:00Z',
+    data: { in_flight, interception_enabled: true, interval_ms: 10_000, ...extra }
+  })
+}
+
+describe('concurrency', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  describe('parse_ping', () => {
+    it('should only accept ping events', () => {
+      expect(parse_ping(ping('s1', 'orders', 0))?.sandbox_id).toBe('s1')
+      expect(parse_ping(JSON.stringify({ type: 'probe', sandbox_id: 's1', function_name: 'orders' }))).toBeUndefined()
+      expect(parse_ping('not json')).toBeUndefined()
+    })
+  })
+
+  describe('ConcurrencyTracker', () => {
+    it('should count environments and invocations per function', () => {
+      const tracker = new ConcurrencyTracker(() => 0)
+      tracker.record(parse_ping(ping('s1', 'orders', 1))!)
+      tracker.record(parse_ping(ping('s2', 'orders', 0, { interception_enabled: false }))!)
+      tracker.record(parse_ping(ping('s3', 'billing', 2))!)
+      tracker.record(parse_ping(ping('s1', 'orders', 2))!)
+
+      expect(tracker.estimates()).toEqual([
+        { function_name: 'billing', environments: 1, busy: 1, in_flight: 2, intercepting: 1 },
+        { function_name: 'orders', environments: 2, busy: 1, in_flight: 2, intercepting: 1 }
+      ])
+    })
+
+    it('should forget sandboxes that stop pinging', () => {
+      let now = 0
+      const tracker = new ConcurrencyTracker(() => now)
+      tracker.record(parse_ping(ping('s1', 'orders', 0))!)
+
+      now = 30_000
+      expect(tracker.estimates()).toHaveLength(1)
+      now = 30_001
+      expect(tracker.estimates()).toEqual([])
+    })
+  })
+
+  describe('format_concurrency', () => {
+    it('should summarize an estimate', () => {
+      expect(
+        format_concurrency({ function_name: 'orders', environments: 3, busy: 1, in_flight: 1, intercepting: 2 })
+      ).toBe('[orders] 3 environments (1 busy, 1 in flight, 1 not intercepting)')
+      expect(
+        format_concurrency({ function_name: 'orders', environments: 1, busy: 0, in_flight: 0, intercepting: 1 })
+      ).toBe('[orders] 1 environment (0 busy, 0 in flight)')
+    })
+  })
+
+  describe('start_concurrency_status', () => {
+    beforeEach(() => {
+      vi.useFakeTimers()
+    })
+
+    afterEach(() => {
+      vi.useRealTimers()
+    })
+
+    it('should print an estimate when it changes', async () => {
+      let on_message: ((payload: string) => void) | undefined
+      const client = {
+        subscribe: vi.fn((_channel: string, callback: (payload: string) => void) => {
+          on_message = callback
+          return Promise.resolve()
+        })
+      } as any
+
+      const stop = await start_concurrency_status(client, new ConcurrencyTracker(() => 0), 1_000)
+      expect(client.subscribe).toHaveBeenCalledWith('/live-lambda/lifecycle/*', expect.any(Function))
+
+      on_message!(ping('s1', 'orders', 1))
+      vi.advanceTimersByTime(1_000)
+      vi.advanceTimersByTime(1_000)
+
+      expect(logger.info).toHaveBeenCalledTimes(1)
+      expect(logger.info).toHaveBeenCalledWith('[orders] 1 environment (1 busy, 1 in flight)')
+      stop()
+    })
+  })
+})
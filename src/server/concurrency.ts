@@ -0,0 +1,152 @@
+import type { AppSyncEventWebSocketClient } from '@boundlessdigital/aws-appsync-events-websockets-client'
+import { channel } from './channels.js'
+import { logger } from '../lib/logger.js'
+
+/**
+ * While the agent is present, every sandbox publishes a `ping` lifecycle event
+ * on /live-lambda/lifecycle/{function} with the number of invocations it is
+ * handling. Counting the sandboxes that pinged recently, and how many of them
+ * are busy, estimates each function's live concurrency: how many execution
+ * environments a change affects once interception is on. The agent prints the
+ * estimate whenever it changes. This mirrors concurrency.go in the extension.
+ */
+
+// A sandbox that misses this many pings in a row is assumed to be gone
+export const MISSED_PINGS_BEFORE_EXPIRY = 3
+export const DEFAULT_PING_INTERVAL_MS = 10_000
+
+export interface PingEvent {
+  type: 'ping'
+  sandbox_id: string
+  function_name: string
+  timestamp: string
+  data?: {
+    in_flight?: number
+    interception_enabled?: boolean
+    interval_ms?: number
+  }
+}
+
+export interface ConcurrencyEstimate {
+  function_name: string
+  environments: number // sandboxes that pinged recently
+  busy: number // of those, sandboxes handling at least one invocation
+  in_flight: number // invocations across all of them
+  intercepting: number // sandboxes with interception enabled
+}
+
+interface SandboxState {
+  function_name: string
+  in_flight: number
+  interception_enabled: boolean
+  expires_at: number
+}
+
+type Clock = () => number
+
+export function parse_ping(payload: string): PingEvent | undefined {
+  try {
+    const event = JSON.parse(payload)
+    if (
+      event?.type === 'ping' &&
+      typeof event.sandbox_id === 'string' &&
+      typeof event.function_name === 'string'
+    ) {
+      return event
+    }
+  } catch {
+    // Not a lifecycle event we understand
+  }
+  return undefined
+}
+
+export class ConcurrencyTracker {
+  private readonly sandboxes = new Map<string, SandboxState>()
+
+  constructor(private readonly now: Clock = Date.now) {}
+
+  record(ping: PingEvent): void {
+    const interval_ms = ping.data?.interval_ms || DEFAULT_PING_INTERVAL_MS
+    this.sandboxes.set(ping.sandbox_id, {
+      function_name: ping.function_name,
+      in_flight: ping.data?.in_flight ?? 0,
+      interception_enabled: ping.data?.interception_enabled ?? true,
+      expires_at: this.now() + interval_ms * MISSED_PINGS_BEFORE_EXPIRY
+    })
+  }
+
+  /**
+   * Returns one estimate per function with live sandboxes, sorted by name.
+   */
+  estimates(): ConcurrencyEstimate[] {
+    const now = this.now()
+    const by_function = new Map<string, ConcurrencyEstimate>()
+    for (const [sandbox_id, sandbox] of this.sandboxes) {
+      if (now > sandbox.expires_at) {
+        this.sandboxes.delete(sandbox_id)
+        continue
+      }
+      const estimate = by_function.get(sandbox.function_name) ?? {
+        function_name: sandbox.function_name,
+        environments: 0,
+        busy: 0,
+        in_flight: 0,
+        intercepting: 0
+      }
+      estimate.environments += 1
+      estimate.busy += sandbox.in_flight > 0 ? 1 : 0
+      estimate.in_flight += sandbox.in_flight
+      estimate.intercepting += sandbox.interception_enabled ? 1 : 0
+      by_function.set(sandbox.function_name, estimate)
+    }
+    return [...by_function.values()].sort((a, b) =>
+      a.function_name.localeCompare(b.function_name)
+    )
+  }
+}
+
+export function format_concurrency(estimate: ConcurrencyEstimate): string {
+  const environments = `${estimate.environments} environment${estimate.environments === 1 ? '' : 's'}`
+  const parts = [`${estimate.busy} busy`, `${estimate.in_flight} in flight`]
+  if (estimate.intercepting < estimate.environments) {
+    parts.push(`${estimate.environments - estimate.intercepting} not intercepting`)
+  }
+  return `[${estimate.function_name}] ${environments} (${parts.join(', ')})`
+}
+
+/**
+ * Subscribes to every lifecycle channel and prints a function's concurrency
+ * estimate whenever it changes, checking every interval_ms.
+ */
+export async function start_concurrency_status(
+  client: AppSyncEventWebSocketClient,
+  tracker = new ConcurrencyTracker(),
+  interval_ms = DEFAULT_PING_INTERVAL_MS
+): Promise<() => void> {
+  await client.subscribe(channel('lifecycle/*'), (payload: string) => {
+    const ping = parse_ping(payload)
+    if (ping) {
+      tracker.record(ping)
+    }
+  })
+
+  const printed = new Map<string, string>()
+  const timer = setInterval(() => {
+    const estimates = tracker.estimates()
+    for (const estimate of estimates) {
+      const line = format_concurrency(estimate)
+      if (printed.get(estimate.function_name) !== line) {
+        printed.set(estimate.function_name, line)
+        logger.info(line)
+      }
+    }
+    const live = new Set(estimates.map((estimate) => estimate.function_name))
+    for (const function_name of printed.keys()) {
+      if (!live.has(function_name)) {
+        printed.delete(function_name)
+        logger.info(`[${function_name}] no live environments`)
+      }
+    }
+  }, interval_ms)
+  return () => clearInterval(timer)
+}
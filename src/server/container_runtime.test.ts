@@ -0,0 +1,73 @@
+import { describe, it, expect, vi } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  build_docker_run_args,
+  runtime_image_for
+} from './container_runtime.js'
+
+describe('container runtime', () => {
+  describe('runtime_image_for', () => {
+    it('should map managed runtimes to their base images', () => {
+      expect(runtime_image_for('nodejs20.x')).toBe(
+        'public.ecr.aws/lambda/nodejs:20'
+      )
+      expect(runtime_image_for('python3.12')).toBe(
+        'public.ecr.aws/lambda/python:3.12'
+      )
+      expect(runtime_image_for('java21')).toBe('public.ecr.aws/lambda/java:21')
+    })
+
+    it('should reject runtimes without a matching image', () => {
+      expect(() => runtime_image_for('provided.al2023')).toThrow(
+        '--runtime-image'
+      )
+      expect(() => runtime_image_for(undefined)).toThrow()
+    })
+  })
+
+  describe('build_docker_run_args', () => {
+    it('should mount the asset, publish the RIE port and pass env names only', () => {
+      const args = build_docker_run_args({
+        image: 'public.ecr.aws/lambda/nodejs:20',
+        asset_path: '/project/cdk.out/asset.123',
+        handler: 'index.handler',
+        environment: {
+          AWS_ACCESS_KEY_ID: 'AKID',
+          TABLE_NAME: 'orders',
+          UNSET: undefined
+        },
+        host_port: 9001,
+        name: 'live-lambda-test'
+      })
+
+      expect(args).toEqual([
+        'run',
+        '--rm',
+        '--name',
+        'live-lambda-test',
+        '-p',
+        '127.0.0.1:9001:8080',
+        '-v',
+        '/project/cdk.out/asset.123:/var/task:ro',
+        '-e',
+        'AWS_ACCESS_KEY_ID',
+        '-e',
+        'TABLE_NAME',
+        'public.ecr.aws/lambda/nodejs:20',
+        'index.handler'
+      ])
+      expect(args.join(' ')).not.toContain('AKID')
+    })
+  })
+})
@@ -0,0 +1,170 @@
+import { spawn } from 'node:child_process'
+import * as net from 'node:net'
+import * as path from 'path'
+import { logger } from '../lib/logger.js'
+
+/**
+ * Runs a single invocation inside an AWS Lambda base image. The base images ship
+ * with the Runtime Interface Emulator (RIE), which exposes the Lambda invoke API
+ * on port 8080 inside the container. The function's deployed asset is mounted
+ * at /var/task, so the handler runs on exactly the runtime it uses in AWS.
+ */
+
+const RIE_PORT = 8080
+const RIE_INVOKE_PATH = '/2015-03-31/functions/function/invocations'
+const CONTAINER_READY_TIMEOUT_MS = 30_000
+const CONTAINER_READY_POLL_MS = 250
+
+// Value of --runtime-image when no image is given: pick it from the function's runtime
+export const AUTO_RUNTIME_IMAGE = 'auto'
+
+export interface ContainerInvocationOptions {
+  image: string
+  asset_path: string
+  handler: string
+  environment: Record<string, string | undefined>
+  event: unknown
+  timeout_ms?: number
+}
+
+/**
+ * Maps a Lambda runtime identifier (e.g. nodejs20.x) to its public base image.
+ */
+export function runtime_image_for(runtime: string | undefined): string {
+  const match = runtime?.match(/^([a-z]+)(\d+(?:\.\d+)?)(?:\.x)?$/)
+  if (!match) {
+    throw new Error(
+      `Cannot pick a base image for runtime "${runtime}". Pass an image to --runtime-image.`
+    )
+  }
+  const [, language, version] = match
+  return `public.ecr.aws/lambda/${language}:${version}`
+}
+
+/**
+ * Builds the `docker run` arguments for one invocation container.
+ */
+export function build_docker_run_args(
+  options: Pick<
+    ContainerInvocationOptions,
+    'image' | 'asset_path' | 'handler' | 'environment'
+  > & { host_port: number; name: string }
+): string[] {
+  const args = [
+    'run',
+    '--rm',
+    '--name',
+    options.name,
+    '-p',
+    `127.0.0.1:${options.host_port}:${RIE_PORT}`,
+    '-v',
+    `${path.resolve(options.asset_path)}:/var/task:ro`
+  ]
+  for (const [key, value] of Object.entries(options.environment)) {
+    if (value !== undefined) {
+      // Only the name is passed on the command line; docker reads the value
+      // from its own environment so credentials do not show up in `ps`.
+      args.push('-e', key)
+    }
+  }
+  args.push(options.image, options.handler)
+  return args
+}
+
+async function find_free_port(): Promise<number> {
+  return new Promise((resolve, reject) => {
+    const server = net.createServer()
+    server.unref()
+    server.on('error', reject)
+    server.listen(0, '127.0.0.1', () => {
+      const { port } = server.address() as net.AddressInfo
+      server.close(() => resolve(port))
+    })
+  })
+}
+
+async function wait_for_container(
+  host_port: number,
+  exited: () => boolean
+): Promise<void> {
+  const deadline = Date.now() + CONTAINER_READY_TIMEOUT_MS
+  while (Date.now() < deadline) {
+    if (exited()) {
+      throw new Error('Runtime container exited before it was ready')
+    }
+    const ready = await new Promise<boolean>((resolve) => {
+      const socket = net.connect(host_port, '127.0.0.1')
+      socket.once('connect', () => {
+        socket.destroy()
+        resolve(true)
+      })
+      socket.once('error', () => resolve(false))
+    })
+    if (ready) {
+      return
+    }
+    await new Promise((resolve) => setTimeout(resolve, CONTAINER_READY_POLL_MS))
+  }
+  throw new Error(
+    `Runtime container did not become ready within ${CONTAINER_READY_TIMEOUT_MS}ms`
+  )
+}
+
+/**
+ * Starts a container for the invocation, sends the event through the RIE, and
+ * returns the handler's response. The container is removed afterwards.
+ */
+export async function invoke_in_container(
+  options: ContainerInvocationOptions
+): Promise<unknown> {
+  const host_port = await find_free_port()
+  const name = `live-lambda-${Date.now().toString(36)}-${host_port}`
+  const args = build_docker_run_args({ ...options, host_port, name })
+
+  logger.info(`Invoking ${options.handler} in ${options.image}`)
+  logger.debug(`docker ${args.join(' ')}`)
+
+  const container = spawn('docker', args, {
+    env: { ...process.env, ...options.environment },
+    stdio: ['ignore', 'inherit', 'inherit']
+  })
+  let exited = false
+  const exit = new Promise<void>((resolve) => {
+    container.once('exit', () => {
+      exited = true
+      resolve()
+    })
+    container.once('error', (error) => {
+      logger.error(`Failed to start docker: ${error.message}`)
+      exited = true
+      resolve()
+    })
+  })
+
+  try {
+    await wait_for_container(host_port, () => exited)
+
+    const response = await fetch(
+      `http://127.0.0.1:${host_port}${RIE_INVOKE_PATH}`,
+      {
+        method: 'POST',
+        body: JSON.stringify(options.event ?? null),
+        signal: options.timeout_ms
+          ? AbortSignal.timeout(options.timeout_ms)
+          : undefined
+      }
+    )
+    const body = await response.text()
+    if (!response.ok) {
+      throw new Error(
+        `Runtime container returned ${response.status}: ${body}`
+      )
+    }
+    return body === '' ? null : JSON.parse(body)
+  } finally {
+    if (!exited) {
+      spawn('docker', ['stop', '--time', '1', name], { stdio: 'ignore' })
+      await exit
+    }
+  }
+}
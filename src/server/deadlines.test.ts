@@ -0,0 +1,75 @@
+import { describe, it, expect, vi, beforeEach } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  format_deadline_warning,
+  parse_deadline_warning,
+  start_deadline_warnings
+} from './deadlines.js'
+import { logger } from '../lib/logger.js'
+
+const warning = {
+  type: 'deadline_warning' as const,
+  request_id: 'abc',
+  deadline: '2024-01-01T00:00:03Z',
+  budget_ms: 3000,
+  remaining_ms: 600,
+  fallback: 'error'
+}
+
+describe('deadlines', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  describe('parse_deadline_warning', () => {
+    it('should return deadline warnings only', () => {
+      expect(parse_deadline_warning(JSON.stringify(warning))).toEqual(warning)
+      expect(parse_deadline_warning(JSON.stringify({ type: 'claim', request_id: 'abc' }))).toBeUndefined()
+      expect(parse_deadline_warning('not json')).toBeUndefined()
+    })
+  })
+
+  describe('format_deadline_warning', () => {
+    it('should say what happens when the time runs out', () => {
+      expect(format_deadline_warning(warning)).toBe(
+        'Request abc has 0.6s left before it fails (fallback: error)'
+      )
+      expect(format_deadline_warning({ ...warning, fallback: 'local' })).toBe(
+        'Request abc has 0.6s left before it runs in Lambda instead (fallback: local)'
+      )
+    })
+  })
+
+  describe('start_deadline_warnings', () => {
+    it('should watch every response channel and print the warnings', async () => {
+      let on_message: ((payload: string) => void) | undefined
+      const client = {
+        subscribe: vi.fn((_channel: string, callback: (payload: string) => void) => {
+          on_message = callback
+          return Promise.resolve()
+        })
+      } as any
+
+      await start_deadline_warnings(client)
+      on_message!(JSON.stringify(warning))
+      on_message!(JSON.stringify({ status: 'success', body: {} }))
+
+      expect(client.subscribe).toHaveBeenCalledWith(
+        '/live-lambda/response/*',
+        expect.any(Function)
+      )
+      expect(logger.warn).toHaveBeenCalledTimes(1)
+    })
+  })
+})
@@ -0,0 +1,56 @@
+import type { AppSyncEventWebSocketClient } from '@boundlessdigital/aws-appsync-events-websockets-client'
+import { response_channel } from './channels.js'
+import { logger } from '../lib/logger.js'
+
+/**
+ * The extension publishes a deadline_warning on an invocation's response
+ * channel once 80% of its time budget has passed without a response. Printing
+ * it tells the developer, who may be paused at a breakpoint, how long they
+ * have before the invocation falls back or fails.
+ */
+
+export interface DeadlineWarning {
+  type: 'deadline_warning'
+  request_id: string
+  deadline: string
+  budget_ms: number
+  remaining_ms: number
+  fallback?: string
+}
+
+/**
+ * Returns the deadline warning in payload, or undefined for any other frame.
+ */
+export function parse_deadline_warning(payload: string): DeadlineWarning | undefined {
+  try {
+    const message = JSON.parse(payload)
+    if (message?.type === 'deadline_warning' && typeof message.request_id === 'string') {
+      return message
+    }
+  } catch {
+    // Not JSON, so not a warning
+  }
+  return undefined
+}
+
+/**
+ * Renders a warning as a log line, e.g.
+ * "Request abc has 0.6s left before it fails (fallback: error)".
+ */
+export function format_deadline_warning(warning: DeadlineWarning): string {
+  const seconds = (Math.max(warning.remaining_ms, 0) / 1000).toFixed(1)
+  const outcome =
+    warning.fallback === 'error' ? 'it fails' : 'it runs in Lambda instead'
+  return `Request ${warning.request_id} has ${seconds}s left before ${outcome} (fallback: ${warning.fallback || 'local'})`
+}
+
+export async function start_deadline_warnings(
+  client: AppSyncEventWebSocketClient
+): Promise<void> {
+  await client.subscribe(response_channel('*'), (payload: string) => {
+    const warning = parse_deadline_warning(payload)
+    if (warning) {
+      logger.warn(format_deadline_warning(warning))
+    }
+  })
+}
@@ -0,0 +1,126 @@
+import { describe, it, expect, vi, beforeEach } from 'vitest'
+import {
+  createCipheriv,
+  createPublicKey,
+  diffieHellman,
+  generateKeyPairSync,
+  hkdfSync,
+  randomBytes
+} from 'node:crypto'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import { logger } from '../lib/logger.js'
+import {
+  ENV_SEAL_ALGORITHM,
+  create_env_keys,
+  handed_off_environment,
+  published_environment,
+  receive_env_snapshot,
+  receive_published_env,
+  type SealedPayload
+} from './env_handoff.js'
+
+// Seals the way env_handoff.go in the extension does
+function seal(public_key: string, agent_id: string, environment: Record<string, string>): SealedPayload {
+  const recipient = createPublicKey({ key: { kty: 'OKP', crv: 'X25519', x: public_key }, format: 'jwk' })
+  const ephemeral = generateKeyPairSync('x25519')
+  const secret = diffieHellman({ privateKey: ephemeral.privateKey, publicKey: recipient })
+  const key = Buffer.from(hkdfSync('sha256', secret, Buffer.alloc(0), 'live-lambda env snapshot v1', 32))
+  const nonce = randomBytes(12)
+  const cipher = createCipheriv('aes-256-gcm', key, nonce)
+  cipher.setAAD(Buffer.from(agent_id))
+  const ciphertext = Buffer.concat([
+    cipher.update(JSON.stringify(environment)),
+    cipher.final(),
+    cipher.getAuthTag()
+  ])
+  return {
+    alg: ENV_SEAL_ALGORITHM,
+    epk: ephemeral.publicKey.export({ format: 'jwk' }).x as string,
+    nonce: nonce.toString('base64url'),
+    ciphertext: ciphertext.toString('base64url')
+  }
+}
+
+function snapshot_event(function_name: string, agent_id: string, encrypted: SealedPayload): string {
+  return JSON.stringify({
+    type: 'env_snapshot',
+    sandbox_id: 's1',
+    function_name,
+    data: { agent_id, encrypted }
+  })
+}
+
+describe('env handoff', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  it('should open an environment sealed to its key', () => {
+    const keys = create_env_keys()
+    const environment = { AWS_REGION: 'us-east-1', AWS_ACCESS_KEY_ID: 'AKIA' }
+
+    receive_env_snapshot(snapshot_event('orders', 'agent-1', seal(keys.public_key, 'agent-1', environment)), 'agent-1', keys)
+
+    expect(handed_off_environment('orders')).toEqual(environment)
+  })
+
+  it('should ignore snapshots addressed to other agents', () => {
+    const keys = create_env_keys()
+
+    receive_env_snapshot(
+      snapshot_event('billing', 'agent-2', seal(keys.public_key, 'agent-2', { A: '1' })),
+      'agent-1',
+      keys
+    )
+    receive_env_snapshot(JSON.stringify({ type: 'env_snapshot', function_name: 'billing', data: { A: '1' } }), 'agent-1', keys)
+    receive_env_snapshot('not json', 'agent-1', keys)
+
+    expect(handed_off_environment('billing')).toBeUndefined()
+  })
+
+  it('should warn when a snapshot does not open', () => {
+    const keys = create_env_keys()
+    const other_keys = create_env_keys()
+
+    receive_env_snapshot(
+      snapshot_event('payments', 'agent-1', seal(other_keys.public_key, 'agent-1', { A: '1' })),
+      'agent-1',
+      keys
+    )
+
+    expect(handed_off_environment('payments')).toBeUndefined()
+    expect(logger.warn).toHaveBeenCalledWith(
+      expect.stringContaining('Could not open the environment sent by payments'),
+      expect.anything()
+    )
+  })
+
+  it('should keep the unredacted variables a function publishes on its env channel', () => {
+    receive_published_env(
+      JSON.stringify({
+        type: 'env_snapshot',
+        sandbox_id: 's1',
+        function_name: 'inventory',
+        timestamp: '2026-10-16T00:00:00Z',
+        variables: { TABLE_NAME: 'inventory', DB_PASSWORD: 'redacted:sha256:0123456789abcdef' },
+        redacted: ['DB_PASSWORD']
+      })
+    )
+    receive_published_env(JSON.stringify({ type: 'env_snapshot', function_name: 'ledger', data: {} }))
+    receive_published_env('not json')
+
+    expect(published_environment('inventory')).toEqual({ TABLE_NAME: 'inventory' })
+    expect(published_environment('ledger')).toBeUndefined()
+  })
+})
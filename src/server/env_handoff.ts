@@ -0,0 +1,157 @@
+import type { AppSyncEventWebSocketClient } from '@boundlessdigital/aws-appsync-events-websockets-client'
+import {
+  createDecipheriv,
+  createPublicKey,
+  diffieHellman,
+  generateKeyPairSync,
+  hkdfSync,
+  type KeyObject
+} from 'node:crypto'
+import { logger } from '../lib/logger.js'
+import { channel } from './channels.js'
+
+/**
+ * Encrypted environment hand-off. The agent puts an X25519 public key in its
+ * heartbeats; each extension then publishes an env_snapshot lifecycle event
+ * sealed to that key, so only this agent can read the function's environment
+ * (and its AWS credentials, when the function sets
+ * LIVE_LAMBDA_SHARE_CREDENTIALS=on). This mirrors env_handoff.go in the
+ * extension.
+ */
+
+export const ENV_SEAL_ALGORITHM = 'X25519-HKDF-SHA256-A256GCM'
+const ENV_SEAL_INFO = 'live-lambda env snapshot v1'
+const GCM_TAG_BYTES = 16
+
+export interface SealedPayload {
+  alg: string
+  epk: string // base64url ephemeral X25519 public key
+  nonce: string // base64url
+  ciphertext: string // base64url ciphertext followed by the GCM tag
+}
+
+export interface EnvKeys {
+  public_key: string // base64url raw X25519 public key, as sent in heartbeats
+  open(sealed: SealedPayload, agent_id: string): Record<string, string>
+}
+
+export function create_env_keys(): EnvKeys {
+  const { publicKey, privateKey } = generateKeyPairSync('x25519')
+  return {
+    public_key: publicKey.export({ format: 'jwk' }).x as string,
+    open: (sealed, agent_id) => open_sealed(privateKey, sealed, agent_id)
+  }
+}
+
+function open_sealed(
+  private_key: KeyObject,
+  sealed: SealedPayload,
+  agent_id: string
+): Record<string, string> {
+  if (sealed.alg !== ENV_SEAL_ALGORITHM) {
+    throw new Error(`Unsupported env snapshot algorithm "${sealed.alg}"`)
+  }
+  const ephemeral = createPublicKey({
+    key: { kty: 'OKP', crv: 'X25519', x: sealed.epk },
+    format: 'jwk'
+  })
+  const secret = diffieHellman({ privateKey: private_key, publicKey: ephemeral })
+  const key = Buffer.from(hkdfSync('sha256', secret, Buffer.alloc(0), ENV_SEAL_INFO, 32))
+  const data = Buffer.from(sealed.ciphertext, 'base64url')
+  const decipher = createDecipheriv('aes-256-gcm', key, Buffer.from(sealed.nonce, 'base64url'))
+  decipher.setAAD(Buffer.from(agent_id))
+  decipher.setAuthTag(data.subarray(data.length - GCM_TAG_BYTES))
+  const plaintext = Buffer.concat([
+    decipher.update(data.subarray(0, data.length - GCM_TAG_BYTES)),
+    decipher.final()
+  ])
+  return JSON.parse(plaintext.toString('utf8'))
+}
+
+const handed_off = new Map<string, Record<string, string>>()
+
+/**
+ * Returns the environment the function's extension handed to this agent, if any.
+ */
+export function handed_off_environment(
+  function_name: string
+): Record<string, string> | undefined {
+  return handed_off.get(function_name)
+}
+
+/**
+ * Opens an env_snapshot lifecycle event sealed to this agent and remembers it
+ * for the function. Other events are ignored.
+ */
+export function receive_env_snapshot(payload: string, agent_id: string, keys: EnvKeys): void {
+  let event: any
+  try {
+    event = JSON.parse(payload)
+  } catch {
+    return
+  }
+  if (event?.type !== 'env_snapshot' || event.data?.agent_id !== agent_id || !event.data.encrypted) {
+    return
+  }
+  try {
+    const environment = keys.open(event.data.encrypted, agent_id)
+    handed_off.set(event.function_name, environment)
+    logger.debug(
+      `Received ${Object.keys(environment).length} environment variables from ${event.function_name}`
+    )
+  } catch (error) {
+    logger.warn(`Could not open the environment sent by ${event.function_name}:`, error)
+  }
+}
+
+const published = new Map<string, Record<string, string>>()
+
+/**
+ * Returns the environment the function's extensions published on its env
+ * channel (LIVE_LAMBDA_ENV_CHANNEL=on), without the redacted variables.
+ */
+export function published_environment(
+  function_name: string
+): Record<string, string> | undefined {
+  return published.get(function_name)
+}
+
+/**
+ * Keeps the unredacted variables of an env_snapshot from a function's env
+ * channel. This mirrors protocol.EnvSnapshot in the extension.
+ */
+export function receive_published_env(payload: string): void {
+  let snapshot: any
+  try {
+    snapshot = JSON.parse(payload)
+  } catch {
+    return
+  }
+  if (snapshot?.type !== 'env_snapshot' || !snapshot.function_name || !snapshot.variables) {
+    return
+  }
+  const redacted = new Set<string>(snapshot.redacted ?? [])
+  const environment: Record<string, string> = {}
+  for (const [name, value] of Object.entries(snapshot.variables as Record<string, string>)) {
+    if (!redacted.has(name)) {
+      environment[name] = value
+    }
+  }
+  if (!published.has(snapshot.function_name)) {
+    logger.debug(
+      `Received ${Object.keys(environment).length} environment variables from ${snapshot.function_name} (${redacted.size} redacted)`
+    )
+  }
+  published.set(snapshot.function_name, environment)
+}
+
+export async function start_env_handoff(
+  client: AppSyncEventWebSocketClient,
+  agent_id: string,
+  keys: EnvKeys
+): Promise<void> {
+  await client.subscribe(channel('lifecycle/*'), (payload: string) =>
+    receive_env_snapshot(payload, agent_id, keys)
+  )
+  await client.subscribe(channel('env/*'), receive_published_env)
+}
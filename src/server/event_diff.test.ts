@@ -0,0 +1,108 @@
+import { describe, it, expect } from 'vitest'
+import {
+  diff_events,
+  EventHistory,
+  format_event_diff,
+  value_at_path
+} from './event_diff.js'
+
+describe('event diff', () => {
+  describe('diff_events', () => {
+    it('should report nothing for identical events', () => {
+      const event = { rawPath: '/orders', headers: { a: '1' }, cookies: ['x'] }
+
+      expect(diff_events(event, structuredClone(event))).toEqual([])
+    })
+
+    it('should list added, removed and changed leaves by path', () => {
+      const before = {
+        rawPath: '/orders',
+        headers: { accept: 'json', 'x-old': '1' },
+        requestContext: { http: { method: 'GET' } }
+      }
+      const after = {
+        rawPath: '/orders',
+        headers: { accept: 'xml', 'x-new': '2' },
+        requestContext: { http: { method: 'POST' } }
+      }
+
+      expect(diff_events(before, after)).toEqual([
+        { path: 'headers.accept', kind: 'changed', before: 'json', after: 'xml' },
+        { path: 'headers.x-new', kind: 'added', after: '2' },
+        { path: 'headers.x-old', kind: 'removed', before: '1' },
+        {
+          path: 'requestContext.http.method',
+          kind: 'changed',
+          before: 'GET',
+          after: 'POST'
+        }
+      ])
+    })
+
+    it('should compare arrays element by element', () => {
+      expect(diff_events({ items: [1, 2] }, { items: [1, 3, 4] })).toEqual([
+        { path: 'items[1]', kind: 'changed', before: 2, after: 3 },
+        { path: 'items[2]', kind: 'added', after: 4 }
+      ])
+    })
+
+    it('should report a type change as a change of the whole value', () => {
+      expect(diff_events({ body: { a: 1 } }, { body: 'text' })).toEqual([
+        { path: 'body', kind: 'changed', before: { a: 1 }, after: 'text' }
+      ])
+    })
+  })
+
+  describe('format_event_diff', () => {
+    it('should render one line per change', () => {
+      expect(
+        format_event_diff([
+          { path: 'a', kind: 'added', after: 1 },
+          { path: 'b', kind: 'removed', before: 'x' },
+          { path: 'c', kind: 'changed', before: true, after: false }
+        ])
+      ).toBe('+ a: 1\n- b: "x"\n~ c: true -> false')
+    })
+  })
+
+  describe('EventHistory', () => {
+    it('should diff against the previous event of the same function', () => {
+      const history = new EventHistory()
+
+      expect(history.record('orders', { id: 1 })).toBeUndefined()
+      expect(history.record('payments', { id: 9 })).toBeUndefined()
+      expect(history.record('orders', { id: 2 })).toEqual([
+        { path: 'id', kind: 'changed', before: 1, after: 2 }
+      ])
+    })
+
+    it('should group events by the value at the key path', () => {
+      const history = new EventHistory('rawPath')
+
+      history.record('api', { rawPath: '/a', body: '1' })
+      expect(history.record('api', { rawPath: '/b', body: '2' })).toBeUndefined()
+      expect(history.record('api', { rawPath: '/a', body: '3' })).toEqual([
+        { path: 'body', kind: 'changed', before: '1', after: '3' }
+      ])
+    })
+
+    it('should not be affected by later mutation of a recorded event', () => {
+      const history = new EventHistory()
+      const event = { count: 1 }
+
+      history.record('fn', event)
+      event.count = 5
+
+      expect(history.record('fn', { count: 1 })).toEqual([])
+    })
+  })
+
+  describe('value_at_path', () => {
+    it('should read nested values and tolerate missing segments', () => {
+      const event = { requestContext: { http: { path: '/x' } } }
+
+      expect(value_at_path(event, 'requestContext.http.path')).toBe('/x')
+      expect(value_at_path(event, 'requestContext.missing.path')).toBeUndefined()
+    })
+  })
+})
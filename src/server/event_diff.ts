@@ -0,0 +1,136 @@
+/**
+ * Structural diff between consecutive invocation events, so developers can see
+ * what changed between a working and a failing invocation. Events are grouped
+ * by function name and, optionally, by the value at a dotted path in the event
+ * (e.g. `rawPath` to compare requests to the same route).
+ */
+
+export type EventChangeKind = 'added' | 'removed' | 'changed'
+
+export interface EventChange {
+  path: string
+  kind: EventChangeKind
+  before?: unknown
+  after?: unknown
+}
+
+function is_object(value: unknown): value is Record<string, unknown> {
+  return typeof value === 'object' && value !== null && !Array.isArray(value)
+}
+
+function child_path(parent: string, key: string | number): string {
+  if (typeof key === 'number') {
+    return `${parent}[${key}]`
+  }
+  return parent ? `${parent}.${key}` : key
+}
+
+/**
+ * Lists the leaf-level differences between two events.
+ */
+export function diff_events(
+  before: unknown,
+  after: unknown,
+  path = ''
+): EventChange[] {
+  if (is_object(before) && is_object(after)) {
+    const keys = new Set([...Object.keys(before), ...Object.keys(after)])
+    return [...keys].sort().flatMap((key) => {
+      const next = child_path(path, key)
+      if (!(key in after)) {
+        return [{ path: next, kind: 'removed' as const, before: before[key] }]
+      }
+      if (!(key in before)) {
+        return [{ path: next, kind: 'added' as const, after: after[key] }]
+      }
+      return diff_events(before[key], after[key], next)
+    })
+  }
+
+  if (Array.isArray(before) && Array.isArray(after)) {
+    const changes: EventChange[] = []
+    const length = Math.max(before.length, after.length)
+    for (let index = 0; index < length; index++) {
+      const next = child_path(path, index)
+      if (index >= after.length) {
+        changes.push({ path: next, kind: 'removed', before: before[index] })
+      } else if (index >= before.length) {
+        changes.push({ path: next, kind: 'added', after: after[index] })
+      } else {
+        changes.push(...diff_events(before[index], after[index], next))
+      }
+    }
+    return changes
+  }
+
+  if (JSON.stringify(before) === JSON.stringify(after)) {
+    return []
+  }
+  return [{ path: path || '(event)', kind: 'changed', before, after }]
+}
+
+function format_value(value: unknown): string {
+  const text = JSON.stringify(value) ?? 'undefined'
+  return text.length > 120 ? `${text.slice(0, 117)}...` : text
+}
+
+/**
+ * Renders changes one per line: `+ path: value`, `- path: value`, `~ path: before -> after`.
+ */
+export function format_event_diff(changes: EventChange[]): string {
+  return changes
+    .map((change) => {
+      switch (change.kind) {
+        case 'added':
+          return `+ ${change.path}: ${format_value(change.after)}`
+        case 'removed':
+          return `- ${change.path}: ${format_value(change.before)}`
+        case 'changed':
+          return `~ ${change.path}: ${format_value(change.before)} -> ${format_value(change.after)}`
+      }
+    })
+    .join('\n')
+}
+
+/**
+ * Reads a dotted path such as `requestContext.http.path` from an event.
+ */
+export function value_at_path(event: unknown, path: string): unknown {
+  return path
+    .split('.')
+    .filter(Boolean)
+    .reduce<unknown>(
+      (value, key) => (is_object(value) ? value[key] : undefined),
+      event
+    )
+}
+
+/**
+ * Remembers the last event per function (and key) and diffs each new event
+ * against it.
+ */
+export class EventHistory {
+  private readonly previous = new Map<string, unknown>()
+
+  constructor(private readonly key_path?: string) {}
+
+  history_key(function_name: string, event: unknown): string {
+    if (!this.key_path) {
+      return function_name
+    }
+    const key = value_at_path(event, this.key_path)
+    return `${function_name}:${JSON.stringify(key) ?? ''}`
+  }
+
+  /**
+   * Records the event and returns its changes from the previous one, or
+   * undefined for the first event with this key.
+   */
+  record(function_name: string, event: unknown): EventChange[] | undefined {
+    const key = this.history_key(function_name, event)
+    const had_previous = this.previous.has(key)
+    const previous = this.previous.get(key)
+    this.previous.set(key, structuredClone(event))
+    return had_previous ? diff_events(previous, event) : undefined
+  }
+}
@@ -0,0 +1,37 @@
+import { describe, it, expect } from 'vitest'
+import { DeliveredRequests, delivery_key } from './idempotency.js'
+
+describe('idempotency', () => {
+  it('should key deliveries by sandbox and attempt', () => {
+    expect(delivery_key({ sandbox_id: 'sandbox-1', idempotency_key: 'req-1:2' })).toBe('sandbox-1/req-1:2')
+    expect(delivery_key({ sandbox_id: 'sandbox-1' })).toBeUndefined()
+  })
+
+  describe('DeliveredRequests', () => {
+    it('should admit each key from a sandbox once', () => {
+      const delivered = new DeliveredRequests()
+
+      expect(delivered.first({ sandbox_id: 'sandbox-1', idempotency_key: 'req-1:1' })).toBe(true)
+      expect(delivered.first({ sandbox_id: 'sandbox-1', idempotency_key: 'req-1:1' })).toBe(false)
+      // Lambda retried the invocation, in the same sandbox and in another one
+      expect(delivered.first({ sandbox_id: 'sandbox-1', idempotency_key: 'req-1:2' })).toBe(true)
+      expect(delivered.first({ sandbox_id: 'sandbox-2', idempotency_key: 'req-1:1' })).toBe(true)
+    })
+
+    it('should always admit requests without a key', () => {
+      const delivered = new DeliveredRequests()
+
+      expect(delivered.first({})).toBe(true)
+      expect(delivered.first({})).toBe(true)
+    })
+
+    it('should forget keys after the retention period', () => {
+      let now = 0
+      const delivered = new DeliveredRequests(1_000, () => now)
+      delivered.first({ idempotency_key: 'req-1:1' })
+
+      now = 1_001
+      expect(delivered.first({ idempotency_key: 'req-1:1' })).toBe(true)
+    })
+  })
+})
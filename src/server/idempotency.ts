@@ -0,0 +1,61 @@
+import type { Clock } from './chunking.js'
+import { DEFAULT_RESPONSE_RETENTION_MS } from './retransmit.js'
+
+/**
+ * Every message the extension sends about an invocation carries an
+ * `idempotency_key` of `<request_id>:<attempt>`, where the attempt counts the
+ * times its sandbox has intercepted the request ID. AppSync can deliver a
+ * request twice, and the extension republishes one when a publish is retried,
+ * both under the same key, so the agent runs each key from a sandbox once and
+ * answers a duplicate with the response it kept. Lambda retrying the
+ * invocation is a new attempt, which runs again. Responses echo the key so the
+ * extension can drop answers to an earlier attempt. This mirrors
+ * idempotency.go in the extension.
+ */
+
+export interface IdempotentMessage {
+  sandbox_id?: string
+  idempotency_key?: string
+}
+
+/**
+ * Identifies a request's attempt across deliveries, or is undefined for
+ * extensions that send no idempotency key.
+ */
+export function delivery_key(message: IdempotentMessage): string | undefined {
+  if (!message.idempotency_key) {
+    return undefined
+  }
+  return `${message.sandbox_id ?? ''}/${message.idempotency_key}`
+}
+
+export class DeliveredRequests {
+  private readonly delivered = new Map<string, number>()
+
+  constructor(
+    private readonly retention_ms = DEFAULT_RESPONSE_RETENTION_MS,
+    private readonly now: Clock = Date.now
+  ) {}
+
+  /**
+   * Records a request's delivery and returns whether it is the first. Keys are
+   * forgotten with the kept responses, and requests without one always run.
+   */
+  first(message: IdempotentMessage): boolean {
+    const key = delivery_key(message)
+    if (!key) {
+      return true
+    }
+    const now = this.now()
+    for (const [delivered, at] of this.delivered) {
+      if (now - at > this.retention_ms) {
+        this.delivered.delete(delivered)
+      }
+    }
+    if (this.delivered.has(key)) {
+      return false
+    }
+    this.delivered.set(key, now)
+    return true
+  }
+}
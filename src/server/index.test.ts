@@ -6,13 +6,25 @@ const {
   mock_subscribe,
   mock_publish,
   mock_client_constructor,
-  mock_execute_handler
+  mock_execute_handler,
+  mock_start_presence,
+  mock_start_log_stream,
+  mock_start_env_handoff,
+  mock_answer_probe,
+  mock_http_publish,
+  mock_run_pull_loop
 } = vi.hoisted(() => ({
   mock_connect: vi.fn(),
   mock_subscribe: vi.fn(),
   mock_publish: vi.fn(),
   mock_client_constructor: vi.fn(),
-  mock_execute_handler: vi.fn()
+  mock_execute_handler: vi.fn(),
+  mock_start_presence: vi.fn(),
+  mock_start_log_stream: vi.fn(),
+  mock_start_env_handoff: vi.fn(),
+  mock_answer_probe: vi.fn(),
+  mock_http_publish: vi.fn(),
+  mock_run_pull_loop: vi.fn()
 }))
 
 vi.mock('@boundlessdigital/aws-appsync-events-websockets-client', () => ({
@@ -30,6 +42,37 @@ vi.mock('./runtime.js', () => ({
   execute_handler: mock_execute_handler
 }))
 
+vi.mock('./presence.js', async (import_original) => ({
+  parse_probe: (await import_original<typeof import('./presence.js')>()).parse_probe,
+  start_presence: mock_start_presence,
+  create_presence: () => ({ answer_probe: mock_answer_probe, stop: vi.fn() })
+}))
+
+vi.mock('./mailbox.js', () => ({
+  HttpEventPublisher: class MockHttpEventPublisher {
+    publish = mock_http_publish
+  },
+  SqsMailbox: class MockSqsMailbox {},
+  run_pull_loop: mock_run_pull_loop
+}))
+
+vi.mock('./logs.js', () => ({
+  start_log_stream: mock_start_log_stream
+}))
+
+vi.mock('./deadlines.js', () => ({
+  start_deadline_warnings: vi.fn()
+}))
+
+vi.mock('./concurrency.js', () => ({
+  start_concurrency_status: vi.fn()
+}))
+
+vi.mock('./env_handoff.js', () => ({
+  create_env_keys: () => ({ public_key: 'agent-public-key', open: vi.fn() }),
+  start_env_handoff: mock_start_env_handoff
+}))
+
 vi.mock('../lib/logger.js', () => ({
   logger: {
     trace: vi.fn(),
@@ -43,7 +86,10 @@ vi.mock('../lib/logger.js', () => ({
 
 // Import after mocks are set up
 import { serve } from './index.js'
+import { logger } from '../lib/logger.js'
 import { ServerConfig } from './types.js'
+import { split_into_chunks } from './chunking.js'
+import { gunzipSync, gzipSync } from 'node:zlib'
 
 describe('server index', () => {
   const mock_config: ServerConfig = {
@@ -59,6 +105,9 @@ describe('server index', () => {
     mock_connect.mockResolvedValue(undefined)
     mock_subscribe.mockResolvedValue(undefined)
     mock_publish.mockResolvedValue(undefined)
+    mock_start_presence.mockResolvedValue(() => {})
+    mock_start_log_stream.mockResolvedValue(undefined)
+    mock_start_env_handoff.mockResolvedValue(undefined)
   })
 
   describe('serve', () => {
@@ -74,14 +123,34 @@ describe('server index', () => {
       expect(mock_connect).toHaveBeenCalledTimes(1)
     })
 
-    it('should subscribe to /live-lambda/requests channel', async () => {
+    it('should subscribe to /live-lambda/requests and its private channel', async () => {
       await serve(mock_config)
 
-      expect(mock_subscribe).toHaveBeenCalledTimes(1)
+      expect(mock_subscribe).toHaveBeenCalledTimes(2)
       expect(mock_subscribe).toHaveBeenCalledWith(
         '/live-lambda/requests',
         expect.any(Function)
       )
+      expect(mock_subscribe).toHaveBeenCalledWith(
+        expect.stringMatching(/^\/live-lambda\/agents\/[0-9a-f-]+$/),
+        expect.any(Function)
+      )
+    })
+
+    it('should claim invocation offers instead of handling them', async () => {
+      let on_request: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        on_request ??= callback
+        return Promise.resolve()
+      })
+
+      await serve(mock_config)
+      await on_request!(JSON.stringify({ type: 'invocation_offer', request_id: 'r1', function_name: 'orders' }))
+
+      expect(mock_execute_handler).not.toHaveBeenCalled()
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/r1', [
+        { type: 'claim', request_id: 'r1', agent_id: expect.any(String) }
+      ])
     })
 
     it('should call handle_request on message and publish response', async () => {
@@ -154,7 +223,7 @@ describe('server index', () => {
       await subscribe_callback!(mock_payload)
 
       // Verify execute_handler was called with correct arguments
-      expect(mock_execute_handler).toHaveBeenCalledWith(mock_event, mock_context)
+      expect(mock_execute_handler).toHaveBeenCalledWith(mock_event, mock_context, undefined)
 
       // Verify response was published to correct channel
       expect(mock_publish).toHaveBeenCalledWith(
@@ -211,6 +280,40 @@ describe('server index', () => {
       await expect(subscribe_callback!(mock_payload)).rejects.toThrow('Handler execution failed')
     })
 
+    it('should send handler errors as error frames to extensions that negotiated them', async () => {
+      const mock_payload = JSON.stringify({
+        request_id: 'error-request-790',
+        event_payload: { test: 'event' },
+        context: { function_name: 'test' },
+        protocol_version: 2,
+        capabilities: ['response_envelope', 'error_frames']
+      })
+
+      const handler_error = new TypeError('Cannot read properties of undefined')
+      mock_execute_handler.mockRejectedValue(handler_error)
+
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+
+      await serve(mock_config)
+      await subscribe_callback!(mock_payload)
+
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/error-request-790', [
+        {
+          type: 'response',
+          protocol_version: 2,
+          body: expect.objectContaining({
+            type: 'invocation_error',
+            errorType: 'TypeError',
+            errorMessage: 'Cannot read properties of undefined'
+          })
+        }
+      ])
+    })
+
     it('should handle multiple concurrent requests', async () => {
       const requests = [
         { request_id: 'req-1', event_payload: { path: '/a' }, context: { function_name: 'fn1' } },
@@ -260,7 +363,41 @@ describe('server index', () => {
 
       await serve(mock_config)
 
-      expect(call_order).toEqual(['connect', 'subscribe'])
+      expect(call_order).toEqual(['connect', 'subscribe', 'subscribe'])
+    })
+
+    it('should announce presence after subscribing to requests', async () => {
+      const call_order: string[] = []
+
+      mock_subscribe.mockImplementation(() => {
+        call_order.push('subscribe')
+        return Promise.resolve()
+      })
+      mock_start_presence.mockImplementation(() => {
+        call_order.push('presence')
+        return Promise.resolve(() => {})
+      })
+
+      await serve(mock_config)
+
+      expect(mock_start_presence).toHaveBeenCalledTimes(1)
+      expect(call_order).toEqual(['subscribe', 'subscribe', 'presence'])
+    })
+
+    it('should stream forwarded function logs', async () => {
+      await serve(mock_config)
+
+      expect(mock_start_log_stream).toHaveBeenCalledTimes(1)
+    })
+
+    it('should ask extensions for their environment sealed to its key', async () => {
+      await serve(mock_config)
+
+      const [, agent_id] = mock_start_env_handoff.mock.calls[0]
+      expect(mock_start_presence).toHaveBeenCalledWith(expect.anything(), {
+        agent_id,
+        public_key: 'agent-public-key'
+      })
     })
 
     it('should handle connection failure', async () => {
@@ -278,6 +415,432 @@ describe('server index', () => {
     })
   })
 
+  describe('event diffs', () => {
+    const invocation = (request_id: string, event: unknown) =>
+      JSON.stringify({
+        request_id,
+        event_payload: event,
+        context: { function_name: 'orders' }
+      })
+
+    async function capture_callback(config: ServerConfig) {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      await serve(config)
+      return subscribe_callback!
+    }
+
+    it('should log the diff from the previous event when enabled', async () => {
+      const callback = await capture_callback({ ...mock_config, diff_events: true })
+
+      await callback(invocation('req-1', { rawPath: '/a' }))
+      await callback(invocation('req-2', { rawPath: '/b' }))
+
+      expect(logger.info).toHaveBeenCalledWith(
+        'Event for orders changed since the previous one:\n~ rawPath: "/a" -> "/b"'
+      )
+    })
+
+    it('should not diff events by default', async () => {
+      const callback = await capture_callback(mock_config)
+
+      await callback(invocation('req-1', { rawPath: '/a' }))
+      await callback(invocation('req-2', { rawPath: '/b' }))
+
+      expect(logger.info).not.toHaveBeenCalled()
+    })
+  })
+
+  describe('chunked transfers', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should reassemble a chunked request before invoking the handler', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+      const invocation = {
+        request_id: 'req-chunked',
+        event_payload: { body: 'y'.repeat(1000) },
+        context: { function_name: 'orders' }
+      }
+      const frames = split_into_chunks('req-chunked', Buffer.from(JSON.stringify(invocation)), 256)
+
+      for (const frame of frames.reverse()) {
+        await callback(JSON.stringify(frame))
+      }
+
+      expect(mock_execute_handler).toHaveBeenCalledTimes(1)
+      expect(mock_execute_handler).toHaveBeenCalledWith(
+        invocation.event_payload,
+        invocation.context,
+        undefined
+      )
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/req-chunked', [
+        { statusCode: 200 }
+      ])
+    })
+
+    it('should retransmit requested response chunks', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200, body: 'z'.repeat(300 * 1024) })
+      const callback = await capture_callback()
+      await callback(JSON.stringify({ request_id: 'req-big', event_payload: {}, context: {} }))
+      const sent = mock_publish.mock.calls.map(([, events]) => events[0])
+      mock_publish.mockClear()
+
+      await callback(
+        JSON.stringify({ type: 'chunk_retransmit', request_id: 'req-big', transfer_id: 'req-big', seqs: [1] })
+      )
+
+      expect(mock_publish).toHaveBeenCalledTimes(1)
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/req-big', [sent[1]])
+    })
+  })
+
+  describe('retransmit requests', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should resend a response when the extension reconnects', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+      await callback(JSON.stringify({ request_id: 'req-1', event_payload: {}, context: {} }))
+      mock_publish.mockClear()
+
+      await callback(
+        JSON.stringify({ type: 'retransmit_request', request_id: 'req-1', sandbox_id: 'sandbox-1' })
+      )
+
+      expect(mock_execute_handler).toHaveBeenCalledTimes(1)
+      expect(mock_publish).toHaveBeenCalledTimes(1)
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/req-1', [{ statusCode: 200 }])
+    })
+
+    it('should ignore retransmit requests for responses it has not sent', async () => {
+      const callback = await capture_callback()
+
+      await callback(JSON.stringify({ type: 'retransmit_request', request_id: 'req-unknown' }))
+
+      expect(mock_execute_handler).not.toHaveBeenCalled()
+      expect(mock_publish).not.toHaveBeenCalled()
+    })
+  })
+
+  describe('idempotency', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should run a request delivered twice once and resend its response', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+      const request = JSON.stringify({
+        request_id: 'req-1',
+        sandbox_id: 'sandbox-1',
+        idempotency_key: 'req-1:1',
+        event_payload: {},
+        context: {}
+      })
+
+      await callback(request)
+      await callback(request)
+
+      expect(mock_execute_handler).toHaveBeenCalledTimes(1)
+      expect(mock_publish).toHaveBeenCalledTimes(2)
+      expect(mock_publish).toHaveBeenNthCalledWith(2, '/live-lambda/response/req-1', [{ statusCode: 200 }])
+      expect(logger.info).toHaveBeenCalledWith('req-1:1 was already delivered; not running it again')
+    })
+
+    it('should run a retried invocation again', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+
+      for (const attempt of [1, 2]) {
+        await callback(
+          JSON.stringify({
+            request_id: 'req-1',
+            sandbox_id: 'sandbox-1',
+            idempotency_key: `req-1:${attempt}`,
+            event_payload: {},
+            context: {}
+          })
+        )
+      }
+
+      expect(mock_execute_handler).toHaveBeenCalledTimes(2)
+    })
+  })
+
+  describe('acks', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should acknowledge a request before running its handler', async () => {
+      mock_execute_handler.mockImplementation(async () => {
+        expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/req-1', [
+          { type: 'ack', request_id: 'req-1', idempotency_key: 'req-1:1' }
+        ])
+        return { statusCode: 200 }
+      })
+      const callback = await capture_callback()
+
+      await callback(
+        JSON.stringify({
+          request_id: 'req-1',
+          idempotency_key: 'req-1:1',
+          protocol_version: 2,
+          capabilities: ['ack'],
+          event_payload: {},
+          context: {}
+        })
+      )
+
+      expect(mock_execute_handler).toHaveBeenCalledTimes(1)
+      expect(mock_publish).toHaveBeenCalledTimes(2)
+      expect(mock_publish).toHaveBeenNthCalledWith(2, '/live-lambda/response/req-1', [{ statusCode: 200 }])
+    })
+
+    it('should not acknowledge requests from extensions that do not ask for it', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+
+      await callback(JSON.stringify({ request_id: 'req-1', event_payload: {}, context: {} }))
+
+      expect(mock_publish).toHaveBeenCalledTimes(1)
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/req-1', [{ statusCode: 200 }])
+    })
+  })
+
+  describe('cancellation', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should drop the response of a request the extension cancelled', async () => {
+      let finish: (response: unknown) => void = () => {}
+      mock_execute_handler.mockReturnValue(new Promise((resolve) => (finish = resolve)))
+      const callback = await capture_callback()
+
+      const handled = callback(JSON.stringify({ request_id: 'req-1', event_payload: {}, context: {} }))
+      // Let the request reach its handler
+      await new Promise((resolve) => setImmediate(resolve))
+      await callback(JSON.stringify({ type: 'cancel', request_id: 'req-1', reason: 'deadline' }))
+      finish({ statusCode: 200 })
+      await handled
+
+      expect(mock_publish).not.toHaveBeenCalled()
+    })
+
+    it('should ignore cancels for requests it is not handling', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+
+      await callback(JSON.stringify({ type: 'cancel', request_id: 'req-1', reason: 'abandoned' }))
+      await callback(JSON.stringify({ request_id: 'req-1', event_payload: {}, context: {} }))
+
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/req-1', [{ statusCode: 200 }])
+    })
+  })
+
+  describe('invalid responses', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should log why the extension rejected a response it sent', async () => {
+      mock_execute_handler.mockResolvedValue({ body: 'no status code' })
+      const callback = await capture_callback()
+      await callback(JSON.stringify({ request_id: 'req-1', event_payload: {}, context: {} }))
+
+      await callback(
+        JSON.stringify({
+          type: 'invalid_response',
+          request_id: 'req-1',
+          event_source: 'alb',
+          message: 'the response is not a valid Application Load Balancer response: statusCode is missing'
+        })
+      )
+
+      expect(logger.error).toHaveBeenCalledWith(
+        'The extension rejected the response to req-1: the response is not a valid Application Load Balancer response: statusCode is missing'
+      )
+    })
+
+    it('should ignore rejections of responses it did not send', async () => {
+      const callback = await capture_callback()
+
+      await callback(JSON.stringify({ type: 'invalid_response', request_id: 'req-other', message: 'statusCode is missing' }))
+
+      expect(logger.error).not.toHaveBeenCalled()
+      expect(mock_execute_handler).not.toHaveBeenCalled()
+    })
+  })
+
+  describe('compression', () => {
+    async function capture_callback() {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      await serve(mock_config)
+      return subscribe_callback!
+    }
+
+    it('should decompress gzipped events', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const callback = await capture_callback()
+      const event = { body: 'x'.repeat(2000) }
+
+      await callback(
+        JSON.stringify({
+          request_id: 'req-gzip',
+          event_payload: gzipSync(JSON.stringify(event)).toString('base64'),
+          content_encoding: 'gzip',
+          context: {}
+        })
+      )
+
+      expect(mock_execute_handler).toHaveBeenCalledWith(event, {}, undefined)
+    })
+
+    it('should gzip large responses only when the extension accepts it', async () => {
+      const response = { statusCode: 200, body: 'z'.repeat(4096) }
+      mock_execute_handler.mockResolvedValue(response)
+      const callback = await capture_callback()
+
+      await callback(JSON.stringify({ request_id: 'plain', event_payload: {}, context: {} }))
+      await callback(
+        JSON.stringify({ request_id: 'gzip', event_payload: {}, context: {}, accept_encoding: ['gzip'] })
+      )
+
+      expect(mock_publish).toHaveBeenCalledWith('/live-lambda/response/plain', [response])
+      const [, [frame]] = mock_publish.mock.calls.find(([channel]) => channel.endsWith('/gzip'))!
+      expect(frame).toMatchObject({ type: 'encoded_payload', content_encoding: 'gzip' })
+      expect(JSON.parse(gunzipSync(Buffer.from(frame.data, 'base64')).toString())).toEqual(response)
+    })
+  })
+
+  describe('deterministic mode', () => {
+    it('should pass replay hints from the recorded invocation time', async () => {
+      let subscribe_callback: ((payload: string) => Promise<any>) | undefined
+      mock_subscribe.mockImplementation((channel: string, callback: (payload: string) => Promise<any>) => {
+        subscribe_callback = callback
+        return Promise.resolve()
+      })
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      await serve({ ...mock_config, deterministic: 42 })
+
+      await subscribe_callback!(
+        JSON.stringify({
+          request_id: 'req-replay',
+          event_payload: {},
+          context: { request_id: 'req-replay', invoked_at_ms: 1700000000000 }
+        })
+      )
+
+      expect(mock_execute_handler).toHaveBeenCalledWith({}, expect.any(Object), undefined, {
+        now_ms: 1700000000000,
+        seed: 42
+      })
+    })
+  })
+
+  describe('pull mode', () => {
+    const queue_url = 'https://sqs.us-east-1.amazonaws.com/123456789012/live-lambda'
+
+    async function capture_pull_callback() {
+      mock_http_publish.mockResolvedValue(undefined)
+      mock_run_pull_loop.mockResolvedValue(undefined)
+      await serve({ ...mock_config, pull_mailbox: queue_url })
+      return mock_run_pull_loop.mock.calls[0][1] as (body: string) => Promise<any>
+    }
+
+    it('should pull from the mailbox instead of opening a WebSocket', async () => {
+      await capture_pull_callback()
+
+      expect(mock_client_constructor).not.toHaveBeenCalled()
+      expect(mock_connect).not.toHaveBeenCalled()
+      expect(mock_start_presence).not.toHaveBeenCalled()
+      expect(mock_run_pull_loop).toHaveBeenCalledTimes(1)
+    })
+
+    it('should publish responses to mailbox requests over HTTP', async () => {
+      mock_execute_handler.mockResolvedValue({ statusCode: 200 })
+      const on_message = await capture_pull_callback()
+
+      await on_message(
+        JSON.stringify({ request_id: 'req-pull', event_payload: {}, context: {} })
+      )
+
+      expect(mock_http_publish).toHaveBeenCalledWith('/live-lambda/response/req-pull', [
+        { statusCode: 200 }
+      ])
+      expect(mock_publish).not.toHaveBeenCalled()
+    })
+
+    it('should answer probes and note accepted delivery without invoking the handler', async () => {
+      const on_message = await capture_pull_callback()
+
+      await on_message(
+        JSON.stringify({ type: 'probe', function_name: 'orders', sandbox_id: 'a' })
+      )
+      await on_message(
+        JSON.stringify({ type: 'delivery_accepted', agent_id: 'x', function_name: 'orders' })
+      )
+
+      expect(mock_answer_probe).toHaveBeenCalledWith(
+        expect.objectContaining({ function_name: 'orders' })
+      )
+      expect(logger.info).toHaveBeenCalledWith(
+        'orders now delivers requests through the mailbox'
+      )
+      expect(mock_execute_handler).not.toHaveBeenCalled()
+    })
+  })
+
   describe('request payload parsing', () => {
     it('should correctly parse JSON payload with all fields', async () => {
       const complex_event = {
@@ -560,11 +1123,14 @@ describe('server index', () => {
         expect.any(Object)
       )
 
-      // Verify the large response was published
-      expect(mock_publish).toHaveBeenCalledWith(
-        '/live-lambda/response/large-payload-123',
-        [large_response]
-      )
+      // Verify the large response was published in chunks
+      const frames = mock_publish.mock.calls
+        .filter(([channel]) => channel === '/live-lambda/response/large-payload-123')
+        .map(([, events]) => events[0])
+      expect(frames.length).toBeGreaterThan(1)
+      expect(frames.every((frame) => frame.type === 'chunk')).toBe(true)
+      const body = Buffer.concat(frames.map((frame) => Buffer.from(frame.data, 'base64')))
+      expect(JSON.parse(body.toString('utf8'))).toEqual(large_response)
     })
   })
 })
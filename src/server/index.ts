@@ -1,32 +1,347 @@
 import { AppSyncEventWebSocketClient } from '@boundlessdigital/aws-appsync-events-websockets-client'
-import { APPSYNC_EVENTS_API_NAMESPACE } from '../constants.js'
+import { randomUUID } from 'node:crypto'
+import { requests_channel, response_channel, use_channels, use_stage } from './channels.js'
 import { execute_handler } from './runtime.js'
+import { offload_response, resolve_event_payload } from './payload_offload.js'
+import { encode_response } from './compression.js'
+import { replay_hints } from './replay.js'
+import {
+  ack_frame,
+  check_extension_protocol,
+  create_function_reporter,
+  negotiate_capabilities,
+  parse_rejection,
+  to_invocation_error,
+  wrap_response
+} from './protocol.js'
+import { create_presence, parse_probe, start_presence } from './presence.js'
+import { agent_channel, claim_offer, parse_offer } from './claims.js'
+import { HttpEventPublisher, SqsMailbox, run_pull_loop } from './mailbox.js'
+import { start_log_stream } from './logs.js'
+import { start_deadline_warnings } from './deadlines.js'
+import { start_concurrency_status } from './concurrency.js'
+import { create_env_keys, start_env_handoff } from './env_handoff.js'
+import { EventHistory, format_event_diff } from './event_diff.js'
+import {
+  ChunkReassembler,
+  DEFAULT_RETRANSMIT_AFTER_MS,
+  MAX_INLINE_MESSAGE_BYTES,
+  SentChunks,
+  split_into_chunks
+} from './chunking.js'
+import { SentResponses } from './retransmit.js'
+import { DeliveredRequests } from './idempotency.js'
 import { logger } from '../lib/logger.js'
 
-import { ServerConfig } from './types.js'
+import { EventPublisher, ServerConfig } from './types.js'
+
+interface Transfers {
+  received: ChunkReassembler
+  sent: SentChunks
+  watched: Set<string>
+  responses: SentResponses
+  // Idempotency keys of the requests already run
+  delivered: DeliveredRequests
+  // Requests being handled, and those among them the extension cancelled
+  running: Set<string>
+  cancelled: Set<string>
+}
+
+const report_function = create_function_reporter()
 
 export async function serve(config: ServerConfig): Promise<void> {
   logger.start('Starting LiveLambda server...')
+  use_stage(config.stage, config.channel_scope)
+  use_channels(config.requests_channel, config.response_channel)
 
-  const client = new AppSyncEventWebSocketClient(config)
+  const history = config.diff_events
+    ? new EventHistory(
+        typeof config.diff_events === 'string' ? config.diff_events : undefined
+      )
+    : undefined
+
+  if (config.deterministic && config.runtime_image) {
+    logger.warn('Deterministic mode only applies to handlers run in-process, not in a runtime container')
+  }
 
-  const requests_channel = `/${APPSYNC_EVENTS_API_NAMESPACE}/requests`
+  const transfers: Transfers = {
+    received: new ChunkReassembler(),
+    sent: new SentChunks(),
+    watched: new Set(),
+    responses: new SentResponses(),
+    delivered: new DeliveredRequests(),
+    running: new Set(),
+    cancelled: new Set()
+  }
+
+  if (config.pull_mailbox) {
+    return serve_from_mailbox(config, config.pull_mailbox, transfers, history)
+  }
+
+  const client = new AppSyncEventWebSocketClient(config)
+  const agent_id = randomUUID()
 
   await client.connect()
 
-  await client.subscribe(requests_channel, (payload) =>
-    handle_request(client, payload)
-  )
+  // Offers are claimed; the requests this agent wins arrive on its private channel
+  const on_request = (payload: string) => {
+    const offer = parse_offer(payload)
+    if (offer) {
+      return claim_offer(client, offer, agent_id)
+    }
+    return handle_message(client, payload, transfers, config.runtime_image, history, config.deterministic)
+  }
+  await client.subscribe(requests_channel(), on_request)
+  await client.subscribe(agent_channel(agent_id), on_request)
+
+  await start_log_stream(client)
+  await start_deadline_warnings(client)
+  await start_concurrency_status(client)
+
+  const env_keys = create_env_keys()
+  await start_env_handoff(client, agent_id, env_keys)
+
+  // Announce presence only once requests can be received
+  await start_presence(client, { agent_id, public_key: env_keys.public_key })
+}
+
+/**
+ * Pull mode: requests and presence probes arrive through the SQS mailbox, and
+ * heartbeats and responses are published over HTTP, so no WebSocket is opened.
+ */
+async function serve_from_mailbox(
+  config: ServerConfig,
+  queue_url: string,
+  transfers: Transfers,
+  history?: EventHistory
+): Promise<void> {
+  const publisher = new HttpEventPublisher(config)
+  const mailbox = new SqsMailbox(queue_url, config)
+  const presence = create_presence(publisher, { pull_mailbox: queue_url })
+
+  logger.info(`Pulling requests from ${queue_url}`)
+
+  void run_pull_loop(mailbox, async (body) => {
+    const probe = parse_probe(body)
+    if (probe) {
+      return presence.answer_probe(probe)
+    }
+    const rejection = parse_rejection(body)
+    if (rejection) {
+      return presence.report_rejection(rejection)
+    }
+    const message = JSON.parse(body)
+    if (message?.type === 'delivery_accepted') {
+      logger.info(`${message.function_name} now delivers requests through the mailbox`)
+      return
+    }
+    return handle_message(publisher, body, transfers, config.runtime_image, history, config.deterministic)
+  })
+}
+
+async function handle_message(
+  publisher: EventPublisher,
+  payload: string,
+  transfers: Transfers,
+  runtime_image?: string,
+  history?: EventHistory,
+  deterministic?: ServerConfig['deterministic']
+): Promise<any> {
+  const message = JSON.parse(payload)
+
+  if (message.type === 'chunk') {
+    const assembled = transfers.received.add(message)
+    if (!assembled) {
+      watch_transfer(publisher, transfers, message.transfer_id)
+      return
+    }
+    const invocation = JSON.parse(assembled.toString('utf8'))
+    return handle_request(publisher, invocation, transfers, runtime_image, history, deterministic)
+  }
+
+  if (message.type === 'chunk_retransmit') {
+    const frames = transfers.sent.select(message.transfer_id, message.seqs ?? [])
+    for (const frame of frames) {
+      await publisher.publish(response_channel(message.request_id), [frame])
+    }
+    return
+  }
+
+  if (message.type === 'retransmit_request') {
+    const frames = transfers.responses.frames(message.request_id, message.idempotency_key)
+    if (frames.length > 0) {
+      logger.info(`Resending the response for ${message.request_id} after the extension reconnected`)
+    }
+    for (const frame of frames) {
+      await publisher.publish(response_channel(message.request_id), [frame])
+    }
+    return
+  }
+
+  if (message.type === 'cancel') {
+    // The handler runs in-process and cannot be interrupted; its result is dropped
+    if (transfers.running.has(message.request_id)) {
+      transfers.cancelled.add(message.request_id)
+      logger.warn(
+        `Request ${message.request_id} was cancelled by the extension (${message.reason}); its response will not be sent`
+      )
+    }
+    return
+  }
+
+  if (message.type === 'invalid_response') {
+    // Lambda got a LiveLambda.MalformedResponse error instead of the response
+    if (transfers.responses.frames(message.request_id).length > 0) {
+      logger.error(`The extension rejected the response to ${message.request_id}: ${message.message}`)
+    }
+    return
+  }
+
+  return handle_request(publisher, message, transfers, runtime_image, history, deterministic)
+}
+
+/**
+ * Asks the extension for missing chunks whenever an incoming transfer stalls,
+ * until it completes or times out.
+ */
+function watch_transfer(
+  publisher: EventPublisher,
+  transfers: Transfers,
+  transfer_id: string
+): void {
+  if (transfers.watched.has(transfer_id)) {
+    return
+  }
+  transfers.watched.add(transfer_id)
+  const timer = setInterval(() => {
+    if (!transfers.received.is_pending(transfer_id)) {
+      clearInterval(timer)
+      transfers.watched.delete(transfer_id)
+      return
+    }
+    const seqs = transfers.received.stalled(transfer_id, DEFAULT_RETRANSMIT_AFTER_MS)
+    if (!seqs?.length) {
+      return
+    }
+    logger.debug(`Requesting ${seqs.length} missing chunks for ${transfer_id}`)
+    publisher
+      .publish(response_channel(transfer_id), [
+        {
+          type: 'chunk_retransmit',
+          request_id: transfer_id,
+          transfer_id,
+          seqs
+        }
+      ])
+      .catch((error: unknown) =>
+        logger.warn(`Failed to request missing chunks for ${transfer_id}:`, error)
+      )
+  }, DEFAULT_RETRANSMIT_AFTER_MS)
 }
 
 async function handle_request(
-  client: AppSyncEventWebSocketClient,
-  payload: string
+  publisher: EventPublisher,
+  invocation: any,
+  transfers: Transfers,
+  runtime_image?: string,
+  history?: EventHistory,
+  deterministic?: ServerConfig['deterministic']
 ): Promise<any> {
-  const { request_id, context, event_payload: event } = JSON.parse(payload)
+  const received_at = performance.now()
+  const { request_id, context, response_upload, accept_encoding } = invocation
+  const problem = check_extension_protocol(invocation)
+  if (problem) {
+    // The extension waits for a response until the invocation's deadline
+    logger.error(`Ignoring request ${request_id} from ${context?.function_name}: ${problem}`)
+    return
+  }
+  if (!transfers.delivered.first(invocation)) {
+    // AppSync delivered it again, or the extension republished it
+    logger.info(`${invocation.idempotency_key} was already delivered; not running it again`)
+    for (const frame of transfers.responses.frames(request_id, invocation.idempotency_key)) {
+      await publisher.publish(response_channel(request_id), [frame])
+    }
+    return
+  }
+  const ack = ack_frame(invocation)
+  if (ack) {
+    // Published before the handler runs, so the extension only falls back when nobody is serving it
+    await publisher
+      .publish(response_channel(request_id), [ack])
+      .catch((error: unknown) => logger.warn(`Failed to acknowledge ${request_id}:`, error))
+  }
+  report_function(invocation.function)
+  const event = await resolve_event_payload(invocation)
+
+  if (history) {
+    log_event_diff(history, context?.function_name, event)
+  }
+
+  const replay = deterministic
+    ? replay_hints(context, typeof deterministic === 'number' ? deterministic : undefined)
+    : undefined
+  let result: unknown
+  let handler_ms = 0
+  const handler_started = performance.now()
+  transfers.running.add(request_id)
+  try {
+    const response = await execute_handler(event, context, runtime_image, replay)
+    handler_ms = performance.now() - handler_started
+    result = await offload_response(response, response_upload)
+  } catch (error) {
+    handler_ms ||= performance.now() - handler_started
+    // Extensions without error frames would post the frame as a successful response
+    if (!negotiate_capabilities(invocation).includes('error_frames')) {
+      throw error
+    }
+    logger.error(`Handler failed for request ${request_id}:`, error)
+    result = to_invocation_error(error)
+  } finally {
+    transfers.running.delete(request_id)
+  }
+  if (transfers.cancelled.delete(request_id)) {
+    return
+  }
+  const message = wrap_response(encode_response(result, accept_encoding), invocation, {
+    agent_ms: round_ms(performance.now() - received_at),
+    handler_ms: round_ms(handler_ms)
+  })
+
+  const response_topic = response_channel(request_id)
+  const body = Buffer.from(JSON.stringify(message ?? null))
+  if (body.length <= MAX_INLINE_MESSAGE_BYTES) {
+    transfers.responses.remember(request_id, [message], invocation.idempotency_key)
+    await publisher.publish(response_topic, [message])
+    return
+  }
 
-  const response = await execute_handler(event, context)
+  // Too large for one event and not offloaded to S3: send it in chunks
+  const frames = split_into_chunks(request_id, body)
+  transfers.sent.remember(request_id, frames)
+  transfers.responses.remember(request_id, frames, invocation.idempotency_key)
+  for (const frame of frames) {
+    await publisher.publish(response_topic, [frame])
+  }
+}
+
+function round_ms(ms: number): number {
+  return Math.round(ms * 1000) / 1000
+}
 
-  const response_channel = `/${APPSYNC_EVENTS_API_NAMESPACE}/response/${request_id}`
-  await client.publish(response_channel, [response])
+function log_event_diff(
+  history: EventHistory,
+  function_name: string | undefined,
+  event: unknown
+): void {
+  const changes = history.record(function_name ?? 'unknown', event)
+  if (!changes) {
+    return
+  }
+  if (changes.length === 0) {
+    logger.info(`Event for ${function_name} is unchanged from the previous one`)
+    return
+  }
+  logger.info(
+    `Event for ${function_name} changed since the previous one:\n${format_event_diff(changes)}`
+  )
 }
@@ -0,0 +1,154 @@
+import { describe, it, expect, vi } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  build_go_context,
+  build_node_context,
+  build_python_context,
+  build_runtime_context
+} from './lambda_context.js'
+import { LambdaContext } from './types.js'
+
+describe('lambda context', () => {
+  const context_data: LambdaContext = {
+    aws_region: 'us-east-1',
+    deadline_ms: '1704067260000',
+    function_name: 'test-function',
+    function_version: '$LATEST',
+    invoked_function_arn: 'arn:aws:lambda:us-east-1:123456789012:function:test-function',
+    log_group_name: '/aws/lambda/test-function',
+    log_stream_name: '2024/01/01/[$LATEST]abcdef123456',
+    memory_size_mb: '256',
+    request_id: 'test-request-id',
+    trace_id: 'Root=1-12345678-abcdef',
+    handler_path: 'index',
+    handler_name: 'handler',
+    identity: {
+      cognitoIdentityId: 'identity-id',
+      cognitoIdentityPoolId: 'pool-id'
+    },
+    client_context: {
+      client: { installation_id: 'install-1', app_title: 'App' },
+      custom: { tenant: 'acme' },
+      env: { platform: 'ios' }
+    }
+  }
+
+  describe('build_node_context', () => {
+    it('should mirror the Node.js context API', () => {
+      const context = build_node_context(context_data)
+
+      expect(context).toMatchObject({
+        callbackWaitsForEmptyEventLoop: true,
+        functionName: 'test-function',
+        functionVersion: '$LATEST',
+        invokedFunctionArn: context_data.invoked_function_arn,
+        memoryLimitInMB: '256',
+        awsRequestId: 'test-request-id',
+        logGroupName: '/aws/lambda/test-function',
+        logStreamName: '2024/01/01/[$LATEST]abcdef123456',
+        identity: context_data.identity,
+        clientContext: context_data.client_context
+      })
+    })
+
+    it('should compute the remaining time from deadline_ms on each call', () => {
+      let now = 1704067200000
+      const context = build_node_context(context_data, () => now)
+
+      expect(context.getRemainingTimeInMillis()).toBe(60000)
+      now += 15000
+      expect(context.getRemainingTimeInMillis()).toBe(45000)
+      now += 120000
+      expect(context.getRemainingTimeInMillis()).toBe(0)
+    })
+
+    it('should report no remaining time without a deadline', () => {
+      const context = build_node_context({ ...context_data, deadline_ms: '' })
+
+      expect(context.getRemainingTimeInMillis()).toBe(0)
+    })
+  })
+
+  describe('build_python_context', () => {
+    it('should use the Python LambdaContext attribute names', () => {
+      const context = build_python_context(context_data, () => 1704067250000)
+
+      expect(context).toMatchObject({
+        function_name: 'test-function',
+        memory_limit_in_mb: 256,
+        aws_request_id: 'test-request-id',
+        identity: {
+          cognito_identity_id: 'identity-id',
+          cognito_identity_pool_id: 'pool-id'
+        },
+        client_context: {
+          client: { installation_id: 'install-1', app_title: 'App' },
+          custom: { tenant: 'acme' },
+          env: { platform: 'ios' }
+        }
+      })
+      expect(context.get_remaining_time_in_millis()).toBe(10000)
+    })
+
+    it('should leave client_context empty when none was sent', () => {
+      const context = build_python_context({
+        ...context_data,
+        identity: undefined,
+        client_context: undefined
+      })
+
+      expect(context.client_context).toBeNull()
+      expect(context.identity.cognito_identity_id).toBeNull()
+    })
+  })
+
+  describe('build_go_context', () => {
+    it('should produce lambdacontext values and the deadline', () => {
+      const context = build_go_context(context_data)
+
+      expect(context.lambda_context).toEqual({
+        AwsRequestID: 'test-request-id',
+        InvokedFunctionArn: context_data.invoked_function_arn,
+        Identity: {
+          CognitoIdentityID: 'identity-id',
+          CognitoIdentityPoolID: 'pool-id'
+        },
+        ClientContext: {
+          Client: { installation_id: 'install-1', app_title: 'App' },
+          Env: { platform: 'ios' },
+          Custom: { tenant: 'acme' }
+        }
+      })
+      expect(context.deadline_ms).toBe(1704067260000)
+      expect(context.environment.AWS_LAMBDA_FUNCTION_MEMORY_SIZE).toBe('256')
+    })
+  })
+
+  describe('build_runtime_context', () => {
+    it('should pick the shape for the runtime', () => {
+      expect(build_runtime_context('python3.12', context_data)).toHaveProperty(
+        'aws_request_id'
+      )
+      expect(build_runtime_context('provided.al2023', context_data)).toHaveProperty(
+        'lambda_context'
+      )
+      expect(build_runtime_context('nodejs20.x', context_data)).toHaveProperty(
+        'awsRequestId'
+      )
+      expect(build_runtime_context(undefined, context_data)).toHaveProperty(
+        'awsRequestId'
+      )
+    })
+  })
+})
@@ -0,0 +1,174 @@
+import type { Context } from 'aws-lambda'
+import { LambdaContext } from './types.js'
+import { logger } from '../lib/logger.js'
+
+/**
+ * The extension publishes the invocation context as flat `context_data`. These
+ * builders turn it into the context object each runtime hands its handlers, so
+ * a local handler sees the same API it gets in AWS. The remaining time is
+ * computed from `deadline_ms` on every call.
+ */
+
+type Clock = () => number
+
+function remaining_time(context: LambdaContext, now: Clock): () => number {
+  const deadline = Number(context.deadline_ms)
+  return () => (Number.isFinite(deadline) ? Math.max(0, deadline - now()) : 0)
+}
+
+function memory_limit(context: LambdaContext): number {
+  return Number.parseInt(context.memory_size_mb, 10) || 0
+}
+
+/**
+ * Node.js `context`, as passed by the Node runtime interface client.
+ */
+export function build_node_context(
+  context: LambdaContext,
+  now: Clock = Date.now
+): Context {
+  const legacy = (name: string) => () =>
+    logger.warn(
+      `context.${name}() is not supported by live-lambda; return from the handler instead.`
+    )
+
+  return {
+    callbackWaitsForEmptyEventLoop: true,
+    functionName: context.function_name,
+    functionVersion: context.function_version,
+    invokedFunctionArn: context.invoked_function_arn,
+    memoryLimitInMB: context.memory_size_mb,
+    awsRequestId: context.request_id,
+    logGroupName: context.log_group_name,
+    logStreamName: context.log_stream_name,
+    identity: context.identity,
+    // The Node runtime passes the client context as Lambda sent it, in snake case
+    clientContext: context.client_context as unknown as Context['clientContext'],
+    getRemainingTimeInMillis: remaining_time(context, now),
+    done: legacy('done'),
+    fail: legacy('fail'),
+    succeed: legacy('succeed')
+  }
+}
+
+export interface PythonLambdaContext {
+  function_name: string
+  function_version: string
+  invoked_function_arn: string
+  memory_limit_in_mb: number
+  aws_request_id: string
+  log_group_name: string
+  log_stream_name: string
+  identity: {
+    cognito_identity_id: string | null
+    cognito_identity_pool_id: string | null
+  }
+  client_context: {
+    client: Record<string, unknown> | null
+    custom: unknown
+    env: unknown
+  } | null
+  get_remaining_time_in_millis(): number
+}
+
+/**
+ * Python `LambdaContext` attributes, as set by the Python runtime interface client.
+ */
+export function build_python_context(
+  context: LambdaContext,
+  now: Clock = Date.now
+): PythonLambdaContext {
+  const identity = context.identity
+  const client_context = context.client_context
+
+  return {
+    function_name: context.function_name,
+    function_version: context.function_version,
+    invoked_function_arn: context.invoked_function_arn,
+    memory_limit_in_mb: memory_limit(context),
+    aws_request_id: context.request_id,
+    log_group_name: context.log_group_name,
+    log_stream_name: context.log_stream_name,
+    identity: {
+      cognito_identity_id: identity?.cognitoIdentityId ?? null,
+      cognito_identity_pool_id: identity?.cognitoIdentityPoolId ?? null
+    },
+    client_context: client_context
+      ? {
+          client: client_context.client ?? null,
+          custom: client_context.custom ?? null,
+          env: client_context.env ?? null
+        }
+      : null,
+    get_remaining_time_in_millis: remaining_time(context, now)
+  }
+}
+
+export interface GoLambdaContext {
+  // lambdacontext.LambdaContext, attached to the handler's context.Context
+  lambda_context: {
+    AwsRequestID: string
+    InvokedFunctionArn: string
+    Identity: { CognitoIdentityID: string; CognitoIdentityPoolID: string }
+    ClientContext: {
+      Client: Record<string, unknown>
+      Env: Record<string, string>
+      Custom: Record<string, string>
+    }
+  }
+  // The context.Context deadline, in milliseconds since the epoch
+  deadline_ms: number
+  // Package-level lambdacontext variables, read from the environment in Go
+  environment: Record<string, string>
+}
+
+/**
+ * The values aws-lambda-go exposes through `lambdacontext` and the handler's
+ * `context.Context` deadline.
+ */
+export function build_go_context(context: LambdaContext): GoLambdaContext {
+  const identity = context.identity
+  const client_context = context.client_context
+
+  return {
+    lambda_context: {
+      AwsRequestID: context.request_id,
+      InvokedFunctionArn: context.invoked_function_arn,
+      Identity: {
+        CognitoIdentityID: identity?.cognitoIdentityId ?? '',
+        CognitoIdentityPoolID: identity?.cognitoIdentityPoolId ?? ''
+      },
+      ClientContext: {
+        Client: client_context?.client ?? {},
+        Env: client_context?.env ?? {},
+        Custom: client_context?.custom ?? {}
+      }
+    },
+    deadline_ms: Number(context.deadline_ms) || 0,
+    environment: {
+      AWS_LAMBDA_FUNCTION_NAME: context.function_name,
+      AWS_LAMBDA_FUNCTION_VERSION: context.function_version,
+      AWS_LAMBDA_FUNCTION_MEMORY_SIZE: String(memory_limit(context)),
+      AWS_LAMBDA_LOG_GROUP_NAME: context.log_group_name,
+      AWS_LAMBDA_LOG_STREAM_NAME: context.log_stream_name
+    }
+  }
+}
+
+/**
+ * Picks the context shape for a Lambda runtime identifier such as `python3.12`.
+ * Node.js is the default, since that is what runs in-process.
+ */
+export function build_runtime_context(
+  runtime: string | undefined,
+  context: LambdaContext,
+  now: Clock = Date.now
+): Context | PythonLambdaContext | GoLambdaContext {
+  if (runtime?.startsWith('python')) {
+    return build_python_context(context, now)
+  }
+  if (runtime?.startsWith('go') || runtime?.startsWith('provided')) {
+    return build_go_context(context)
+  }
+  return build_node_context(context, now)
+}
@@ -0,0 +1,75 @@
+import { describe, it, expect, vi, beforeEach } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import { format_telemetry_record, start_log_stream } from './logs.js'
+import { logger } from '../lib/logger.js'
+
+describe('logs', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  describe('format_telemetry_record', () => {
+    it('should print function log lines as they were written', () => {
+      expect(
+        format_telemetry_record('orders', {
+          time: '2024-01-01T00:00:00Z',
+          type: 'function',
+          record: 'INFO processing order 42\n'
+        })
+      ).toBe('[orders] INFO processing order 42')
+    })
+
+    it('should summarize platform records', () => {
+      expect(
+        format_telemetry_record('orders', {
+          time: '2024-01-01T00:00:00Z',
+          type: 'platform.report',
+          record: { requestId: 'abc' }
+        })
+      ).toBe('[orders] platform.report {"requestId":"abc"}')
+    })
+  })
+
+  describe('start_log_stream', () => {
+    it('should subscribe to every logs channel and print each record', async () => {
+      let on_message: ((payload: string) => void) | undefined
+      const client = {
+        subscribe: vi.fn((_channel: string, callback: (payload: string) => void) => {
+          on_message = callback
+          return Promise.resolve()
+        })
+      } as any
+
+      await start_log_stream(client)
+      on_message!(
+        JSON.stringify({
+          sandbox_id: 's1',
+          function_name: 'orders',
+          records: [
+            { time: 't1', type: 'function', record: 'first' },
+            { time: 't2', type: 'function', record: 'second' }
+          ]
+        })
+      )
+      on_message!('not json')
+
+      expect(client.subscribe).toHaveBeenCalledWith(
+        '/live-lambda/logs/*',
+        expect.any(Function)
+      )
+      expect(logger.info).toHaveBeenCalledTimes(2)
+      expect(logger.info).toHaveBeenCalledWith('[orders] second')
+    })
+  })
+})
@@ -0,0 +1,59 @@
+import type { AppSyncEventWebSocketClient } from '@boundlessdigital/aws-appsync-events-websockets-client'
+import { channel } from './channels.js'
+import { logger } from '../lib/logger.js'
+
+/**
+ * The extension forwards Lambda Telemetry API records on
+ * /live-lambda/logs/{function} while the agent is present. Printing them gives
+ * the developer the function's CloudWatch output in real time.
+ */
+
+export interface TelemetryRecord {
+  time: string
+  type: string
+  record: unknown
+}
+
+export interface TelemetryBatch {
+  sandbox_id: string
+  function_name: string
+  records: TelemetryRecord[]
+}
+
+/**
+ * Renders one record as a log line. Function and extension records are the
+ * raw log text; platform records are summarized by their type.
+ */
+export function format_telemetry_record(
+  function_name: string,
+  record: TelemetryRecord
+): string {
+  const prefix = `[${function_name}]`
+  if (record.type === 'function' || record.type === 'extension') {
+    const text =
+      typeof record.record === 'string'
+        ? record.record
+        : JSON.stringify(record.record)
+    return `${prefix} ${text.trimEnd()}`
+  }
+  return `${prefix} ${record.type} ${JSON.stringify(record.record)}`
+}
+
+export async function start_log_stream(
+  client: AppSyncEventWebSocketClient
+): Promise<void> {
+  await client.subscribe(
+    channel('logs/*'),
+    (payload: string) => {
+      let batch: TelemetryBatch
+      try {
+        batch = JSON.parse(payload)
+      } catch {
+        return
+      }
+      for (const record of batch.records ?? []) {
+        logger.info(format_telemetry_record(batch.function_name, record))
+      }
+    }
+  )
+}
@@ -0,0 +1,158 @@
+import { describe, it, expect, vi, beforeEach, afterEach } from 'vitest'
+
+vi.mock('@aws-sdk/credential-providers', () => {
+  const credentials = () =>
+    Promise.resolve({ accessKeyId: 'AKIDEXAMPLE', secretAccessKey: 'secret' })
+  return { fromIni: () => credentials, fromNodeProviderChain: () => credentials }
+})
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import {
+  HttpEventPublisher,
+  Mailbox,
+  PULL_RETRY_DELAY_MS,
+  SqsMailbox,
+  queue_region,
+  run_pull_loop
+} from './mailbox.js'
+
+describe('mailbox', () => {
+  const queue_url = 'https://sqs.eu-west-1.amazonaws.com/123456789012/live-lambda'
+
+  it('should read the region from a queue URL', () => {
+    expect(queue_region(queue_url)).toBe('eu-west-1')
+    expect(queue_region('https://example.com/queue')).toBeUndefined()
+  })
+
+  describe('SqsMailbox', () => {
+    const mock_send = vi.fn()
+    const mailbox = new SqsMailbox(queue_url, { region: 'us-east-1' }, {
+      send: mock_send
+    } as any)
+
+    beforeEach(() => {
+      mock_send.mockReset()
+    })
+
+    it('should long-poll the queue and skip messages without a body', async () => {
+      mock_send.mockResolvedValue({
+        Messages: [{ Body: '{"a":1}', ReceiptHandle: 'r1' }, { ReceiptHandle: 'r2' }]
+      })
+
+      const messages = await mailbox.receive()
+
+      expect(messages).toEqual([{ body: '{"a":1}', receipt: 'r1' }])
+      expect(mock_send.mock.calls[0][0].input).toEqual({
+        QueueUrl: queue_url,
+        MaxNumberOfMessages: 10,
+        WaitTimeSeconds: 20
+      })
+    })
+
+    it('should delete acknowledged messages', async () => {
+      mock_send.mockResolvedValue({})
+
+      await mailbox.acknowledge({ body: '{}', receipt: 'r1' })
+
+      expect(mock_send.mock.calls[0][0].input).toEqual({
+        QueueUrl: queue_url,
+        ReceiptHandle: 'r1'
+      })
+    })
+  })
+
+  describe('HttpEventPublisher', () => {
+    const mock_fetch = vi.fn()
+    const publisher = new HttpEventPublisher(
+      { http: 'test-api.appsync-api.us-east-1.amazonaws.com', region: 'us-east-1' },
+      mock_fetch
+    )
+
+    beforeEach(() => {
+      mock_fetch.mockReset()
+    })
+
+    it('should post signed, stringified events to the event endpoint', async () => {
+      mock_fetch.mockResolvedValue({ ok: true })
+
+      await publisher.publish('/live-lambda/response/req-1', [{ statusCode: 200 }])
+
+      const [url, init] = mock_fetch.mock.calls[0]
+      expect(String(url)).toBe('https://test-api.appsync-api.us-east-1.amazonaws.com/event')
+      expect(JSON.parse(init.body)).toEqual({
+        channel: '/live-lambda/response/req-1',
+        events: ['{"statusCode":200}']
+      })
+      expect(init.headers.authorization).toContain('AWS4-HMAC-SHA256')
+    })
+
+    it('should fail when the endpoint rejects the events', async () => {
+      mock_fetch.mockResolvedValue({ ok: false, status: 401, text: async () => 'denied' })
+
+      await expect(publisher.publish('/live-lambda/response/req-1', [{}])).rejects.toThrow(
+        '401 denied'
+      )
+    })
+  })
+
+  describe('run_pull_loop', () => {
+    beforeEach(() => {
+      vi.useFakeTimers()
+    })
+
+    afterEach(() => {
+      vi.useRealTimers()
+    })
+
+    it('should acknowledge each message before handling it', async () => {
+      const order: string[] = []
+      const mailbox: Mailbox = {
+        queue_url,
+        receive: vi.fn().mockResolvedValue([{ body: 'm1', receipt: 'r1' }]),
+        acknowledge: vi.fn(async () => {
+          order.push('acknowledge')
+        })
+      }
+      let polls = 0
+
+      await run_pull_loop(
+        mailbox,
+        async (body) => {
+          order.push(body)
+        },
+        () => polls++ < 1
+      )
+
+      expect(order).toEqual(['acknowledge', 'm1'])
+    })
+
+    it('should back off after a failed poll', async () => {
+      const receive = vi
+        .fn()
+        .mockRejectedValueOnce(new Error('throttled'))
+        .mockResolvedValue([])
+      let polls = 0
+      const loop = run_pull_loop(
+        { queue_url, receive, acknowledge: vi.fn() },
+        vi.fn(),
+        () => polls++ < 2
+      )
+
+      await vi.advanceTimersByTimeAsync(PULL_RETRY_DELAY_MS - 1)
+      expect(receive).toHaveBeenCalledTimes(1)
+      await vi.advanceTimersByTimeAsync(1)
+      await loop
+      expect(receive).toHaveBeenCalledTimes(2)
+    })
+  })
+})
@@ -0,0 +1,173 @@
+import {
+  DeleteMessageCommand,
+  ReceiveMessageCommand,
+  SQSClient
+} from '@aws-sdk/client-sqs'
+import { fromIni, fromNodeProviderChain } from '@aws-sdk/credential-providers'
+import { Sha256 } from '@aws-crypto/sha256-js'
+import { HttpRequest } from '@smithy/protocol-http'
+import { SignatureV4 } from '@smithy/signature-v4'
+import { logger } from '../lib/logger.js'
+import type { EventPublisher, ServerConfig } from './types.js'
+
+/**
+ * Pull mode, for networks that kill long-lived WebSockets. Instead of
+ * subscribing to /live-lambda/requests, the agent long-polls an SQS queue (the
+ * mailbox) that extensions deliver requests to, and publishes responses and
+ * heartbeats through AppSync's HTTP endpoint. Extensions copy their presence
+ * probes to the mailbox, and switch to it once a heartbeat names the queue
+ * they were configured with, confirming with a `delivery_accepted` message.
+ */
+
+export const PULL_WAIT_SECONDS = 20
+export const PULL_BATCH_SIZE = 10
+export const PULL_RETRY_DELAY_MS = 5_000
+
+export interface MailboxMessage {
+  body: string
+  receipt: string
+}
+
+export interface Mailbox {
+  readonly queue_url: string
+  receive(): Promise<MailboxMessage[]>
+  acknowledge(message: MailboxMessage): Promise<void>
+}
+
+function agent_credentials(profile?: string) {
+  return profile ? fromIni({ profile }) : fromNodeProviderChain()
+}
+
+/**
+ * Reads the region from https://sqs.{region}.amazonaws.com/{account}/{name}.
+ */
+export function queue_region(queue_url: string): string | undefined {
+  const [service, region] = new URL(queue_url).hostname.split('.')
+  return service === 'sqs' ? region : undefined
+}
+
+export class SqsMailbox implements Mailbox {
+  private readonly sqs: SQSClient
+
+  constructor(
+    readonly queue_url: string,
+    config: Pick<ServerConfig, 'region' | 'profile'>,
+    sqs?: SQSClient
+  ) {
+    this.sqs =
+      sqs ??
+      new SQSClient({
+        region: queue_region(queue_url) ?? config.region,
+        credentials: agent_credentials(config.profile)
+      })
+  }
+
+  async receive(): Promise<MailboxMessage[]> {
+    const { Messages } = await this.sqs.send(
+      new ReceiveMessageCommand({
+        QueueUrl: this.queue_url,
+        MaxNumberOfMessages: PULL_BATCH_SIZE,
+        WaitTimeSeconds: PULL_WAIT_SECONDS
+      })
+    )
+    return (Messages ?? []).flatMap((message) =>
+      message.Body && message.ReceiptHandle
+        ? [{ body: message.Body, receipt: message.ReceiptHandle }]
+        : []
+    )
+  }
+
+  async acknowledge(message: MailboxMessage): Promise<void> {
+    await this.sqs.send(
+      new DeleteMessageCommand({
+        QueueUrl: this.queue_url,
+        ReceiptHandle: message.receipt
+      })
+    )
+  }
+}
+
+/**
+ * Publishes events with signed requests to the Event API's HTTP endpoint, so
+ * pull mode needs no WebSocket at all.
+ */
+export class HttpEventPublisher implements EventPublisher {
+  private readonly signer: SignatureV4
+  private readonly endpoint: URL
+
+  constructor(
+    config: Pick<ServerConfig, 'http' | 'region' | 'profile'>,
+    private readonly fetch_impl: typeof fetch = fetch
+  ) {
+    const host = config.http.includes('://') ? config.http : `https://${config.http}`
+    this.endpoint = new URL('/event', host)
+    this.signer = new SignatureV4({
+      service: 'appsync',
+      region: config.region,
+      credentials: agent_credentials(config.profile),
+      sha256: Sha256
+    })
+  }
+
+  async publish(channel: string, events: unknown[]): Promise<void> {
+    const body = JSON.stringify({
+      channel,
+      events: events.map((event) => JSON.stringify(event))
+    })
+    const signed = await this.signer.sign(
+      new HttpRequest({
+        method: 'POST',
+        protocol: this.endpoint.protocol,
+        hostname: this.endpoint.hostname,
+        path: this.endpoint.pathname,
+        headers: {
+          'content-type': 'application/json',
+          host: this.endpoint.hostname
+        },
+        body
+      })
+    )
+    const response = await this.fetch_impl(this.endpoint, {
+      method: 'POST',
+      headers: signed.headers,
+      body
+    })
+    if (!response.ok) {
+      throw new Error(
+        `Failed to publish to ${channel}: ${response.status} ${await response.text()}`
+      )
+    }
+  }
+}
+
+/**
+ * Polls the mailbox until should_continue returns false. Messages are
+ * acknowledged before they are handled: an invocation can outlast the queue's
+ * visibility timeout, and redelivering it would run the handler twice.
+ */
+export async function run_pull_loop(
+  mailbox: Mailbox,
+  on_message: (body: string) => Promise<unknown>,
+  should_continue: () => boolean = () => true
+): Promise<void> {
+  while (should_continue()) {
+    let messages: MailboxMessage[]
+    try {
+      messages = await mailbox.receive()
+    } catch (error) {
+      logger.warn(`Failed to poll ${mailbox.queue_url}:`, error)
+      await new Promise((resolve) => setTimeout(resolve, PULL_RETRY_DELAY_MS))
+      continue
+    }
+    for (const message of messages) {
+      try {
+        await mailbox.acknowledge(message)
+      } catch (error) {
+        logger.warn('Failed to acknowledge mailbox message:', error)
+      }
+      on_message(message.body).catch((error: unknown) =>
+        logger.error('Failed to handle mailbox message:', error)
+      )
+    }
+  }
+}
@@ -0,0 +1,106 @@
+import { describe, it, expect, vi, beforeEach, afterEach } from 'vitest'
+import { createHash } from 'node:crypto'
+import {
+  offload_response,
+  resolve_event_payload,
+  RESPONSE_OFFLOAD_THRESHOLD_BYTES
+} from './payload_offload.js'
+
+const sha256_hex = (body: string) =>
+  createHash('sha256').update(body).digest('hex')
+
+describe('payload offload', () => {
+  const mock_fetch = vi.fn()
+
+  beforeEach(() => {
+    mock_fetch.mockReset()
+    vi.stubGlobal('fetch', mock_fetch)
+  })
+
+  afterEach(() => {
+    vi.unstubAllGlobals()
+  })
+
+  describe('resolve_event_payload', () => {
+    it('should return inline events without fetching', async () => {
+      const event = await resolve_event_payload({ event_payload: { a: 1 } })
+
+      expect(event).toEqual({ a: 1 })
+      expect(mock_fetch).not.toHaveBeenCalled()
+    })
+
+    it('should download offloaded events', async () => {
+      const body = JSON.stringify({ large: 'x'.repeat(10) })
+      mock_fetch.mockResolvedValue({ ok: true, text: async () => body })
+
+      const event = await resolve_event_payload({
+        event_payload_ref: {
+          type: 'payload_ref',
+          url: 'https://bucket.s3.amazonaws.com/request.json?sig',
+          size: body.length,
+          checksum: sha256_hex(body)
+        }
+      })
+
+      expect(mock_fetch).toHaveBeenCalledWith(
+        'https://bucket.s3.amazonaws.com/request.json?sig'
+      )
+      expect(event).toEqual({ large: 'xxxxxxxxxx' })
+    })
+
+    it('should reject offloaded events with a mismatched checksum', async () => {
+      mock_fetch.mockResolvedValue({ ok: true, text: async () => '{}' })
+
+      await expect(
+        resolve_event_payload({
+          event_payload_ref: {
+            type: 'payload_ref',
+            url: 'https://example.com',
+            size: 2,
+            checksum: sha256_hex('[]')
+          }
+        })
+      ).rejects.toThrow('checksum mismatch')
+    })
+  })
+
+  describe('offload_response', () => {
+    const upload = {
+      put_url: 'https://bucket.s3.amazonaws.com/response.json?put',
+      get_url: 'https://bucket.s3.amazonaws.com/response.json?get'
+    }
+
+    it('should publish small responses inline', async () => {
+      const response = { statusCode: 200, body: 'ok' }
+
+      expect(await offload_response(response, upload)).toBe(response)
+      expect(mock_fetch).not.toHaveBeenCalled()
+    })
+
+    it('should publish large responses inline when no upload location was provided', async () => {
+      const response = { body: 'x'.repeat(RESPONSE_OFFLOAD_THRESHOLD_BYTES) }
+
+      expect(await offload_response(response)).toBe(response)
+    })
+
+    it('should upload large responses and return a payload reference', async () => {
+      mock_fetch.mockResolvedValue({ ok: true })
+      const response = { body: 'x'.repeat(RESPONSE_OFFLOAD_THRESHOLD_BYTES) }
+      const body = JSON.stringify(response)
+
+      const message = await offload_response(response, upload)
+
+      expect(mock_fetch).toHaveBeenCalledWith(upload.put_url, {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body
+      })
+      expect(message).toEqual({
+        type: 'payload_ref',
+        url: upload.get_url,
+        size: body.length,
+        checksum: sha256_hex(body)
+      })
+    })
+  })
+})
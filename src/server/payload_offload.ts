@@ -0,0 +1,85 @@
+import { createHash } from 'node:crypto'
+import { decode_event_payload } from './compression.js'
+
+/**
+ * AppSync Events caps each event well below Lambda's 6MB payload limit, so the
+ * extension can move oversized payloads through S3. Requests arrive with an
+ * `event_payload_ref` instead of `event_payload`, and every request may carry a
+ * presigned `response_upload` location for handing back an oversized response.
+ */
+
+// Stay under the AppSync event size limit, leaving room for the envelope
+export const RESPONSE_OFFLOAD_THRESHOLD_BYTES = 200 * 1024
+
+export interface PayloadReference {
+  type: 'payload_ref'
+  url: string
+  size: number
+  checksum: string
+}
+
+export interface ResponseUpload {
+  put_url: string
+  get_url: string
+}
+
+function sha256_hex(body: string): string {
+  return createHash('sha256').update(body).digest('hex')
+}
+
+/**
+ * Returns the invocation event, downloading it when the extension offloaded it
+ * and decompressing it when the extension encoded it.
+ */
+export async function resolve_event_payload(invocation: {
+  event_payload?: unknown
+  event_payload_ref?: PayloadReference
+  content_encoding?: string
+}): Promise<unknown> {
+  const ref = invocation.event_payload_ref
+  if (!ref) {
+    return decode_event_payload(invocation)
+  }
+
+  const response = await fetch(ref.url)
+  if (!response.ok) {
+    throw new Error(`Failed to download offloaded event: ${response.status}`)
+  }
+  const body = await response.text()
+  if (ref.checksum && sha256_hex(body) !== ref.checksum) {
+    throw new Error('Offloaded event checksum mismatch')
+  }
+  return JSON.parse(body)
+}
+
+/**
+ * Returns the message to publish for a handler response. Responses larger than
+ * the threshold are uploaded to the presigned location and replaced by a
+ * payload reference when the extension provided one.
+ */
+export async function offload_response(
+  response: unknown,
+  upload?: ResponseUpload
+): Promise<unknown> {
+  const body = JSON.stringify(response ?? null)
+  if (!upload || Buffer.byteLength(body) <= RESPONSE_OFFLOAD_THRESHOLD_BYTES) {
+    return response
+  }
+
+  const result = await fetch(upload.put_url, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body
+  })
+  if (!result.ok) {
+    throw new Error(`Failed to upload offloaded response: ${result.status}`)
+  }
+
+  const ref: PayloadReference = {
+    type: 'payload_ref',
+    url: upload.get_url,
+    size: Buffer.byteLength(body),
+    checksum: sha256_hex(body)
+  }
+  return ref
+}
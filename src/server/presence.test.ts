@@ -0,0 +1,156 @@
+import { describe, it, expect, vi, beforeEach, afterEach } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import { logger } from '../lib/logger.js'
+import { create_presence, presence_channel, start_presence } from './presence.js'
+import { PROTOCOL_VERSION } from './protocol.js'
+
+describe('presence', () => {
+  const mock_subscribe = vi.fn()
+  const mock_publish = vi.fn()
+  const client = { subscribe: mock_subscribe, publish: mock_publish } as any
+  let on_message: (payload: string) => Promise<void>
+
+  beforeEach(() => {
+    vi.useFakeTimers()
+    vi.clearAllMocks()
+    mock_publish.mockResolvedValue(undefined)
+    mock_subscribe.mockImplementation(
+      (_channel: string, callback: (payload: string) => Promise<void>) => {
+        on_message = callback
+        return Promise.resolve()
+      }
+    )
+  })
+
+  afterEach(() => {
+    vi.useRealTimers()
+  })
+
+  it('should subscribe to every presence channel', async () => {
+    const stop = await start_presence(client)
+
+    expect(mock_subscribe).toHaveBeenCalledWith(
+      '/live-lambda/presence/*',
+      expect.any(Function)
+    )
+    stop()
+  })
+
+  it('should answer a probe with a heartbeat', async () => {
+    const stop = await start_presence(client, { ttl_ms: 9000 })
+
+    await on_message(
+      JSON.stringify({
+        type: 'probe',
+        function_name: 'orders',
+        sandbox_id: 'abc'
+      })
+    )
+
+    expect(mock_publish).toHaveBeenCalledWith(presence_channel('orders'), [
+      expect.objectContaining({ type: 'heartbeat', ttl_ms: 9000, accept_encoding: ['gzip'] })
+    ])
+    stop()
+  })
+
+  it('should ignore its own heartbeats and malformed messages', async () => {
+    const stop = await start_presence(client)
+
+    await on_message(JSON.stringify({ type: 'heartbeat', agent_id: 'x' }))
+    await on_message('not json')
+
+    expect(mock_publish).not.toHaveBeenCalled()
+    stop()
+  })
+
+  it('should announce its protocol in heartbeats', async () => {
+    const presence = create_presence({ publish: mock_publish })
+
+    await presence.answer_probe({ type: 'probe', function_name: 'orders', sandbox_id: 'a' })
+
+    const [, [heartbeat]] = mock_publish.mock.calls[0]
+    expect(heartbeat).toMatchObject({
+      protocol_version: PROTOCOL_VERSION,
+      capabilities: expect.arrayContaining(['response_envelope'])
+    })
+    presence.stop()
+  })
+
+  it('should include its public key when given one', async () => {
+    const presence = create_presence({ publish: mock_publish }, { agent_id: 'agent-1', public_key: 'key' })
+
+    await presence.answer_probe({ type: 'probe', function_name: 'orders', sandbox_id: 'a' })
+
+    const [, [heartbeat]] = mock_publish.mock.calls[0]
+    expect(heartbeat).toMatchObject({ agent_id: 'agent-1', public_key: 'key' })
+    presence.stop()
+  })
+
+  it('should not answer probes from an incompatible extension', async () => {
+    const stop = await start_presence(client)
+
+    await on_message(
+      JSON.stringify({
+        type: 'probe',
+        function_name: 'orders',
+        sandbox_id: 'a',
+        protocol_version: PROTOCOL_VERSION + 1,
+        min_protocol_version: PROTOCOL_VERSION + 1
+      })
+    )
+
+    expect(mock_publish).not.toHaveBeenCalled()
+    expect(logger.error).toHaveBeenCalledWith(expect.stringContaining('upgrade the live-lambda CLI'))
+    stop()
+  })
+
+  it('should ask for pull delivery when given a mailbox', async () => {
+    const mailbox = 'https://sqs.us-east-1.amazonaws.com/123456789012/live-lambda'
+    const stop = await start_presence(client, { pull_mailbox: mailbox })
+
+    await on_message(
+      JSON.stringify({ type: 'probe', function_name: 'orders', sandbox_id: 'a' })
+    )
+
+    expect(mock_publish).toHaveBeenCalledWith(presence_channel('orders'), [
+      expect.objectContaining({ type: 'heartbeat', delivery: 'pull', mailbox })
+    ])
+    stop()
+  })
+
+  it('should answer probes handed to it directly', async () => {
+    const presence = create_presence({ publish: mock_publish })
+
+    await presence.answer_probe({ type: 'probe', function_name: 'orders', sandbox_id: 'a' })
+
+    const [, [heartbeat]] = mock_publish.mock.calls[0]
+    expect(heartbeat).not.toHaveProperty('delivery')
+    presence.stop()
+  })
+
+  it('should keep sending heartbeats to functions that probed until stopped', async () => {
+    const stop = await start_presence(client, { interval_ms: 1000 })
+    await on_message(
+      JSON.stringify({ type: 'probe', function_name: 'orders', sandbox_id: 'a' })
+    )
+    mock_publish.mockClear()
+
+    await vi.advanceTimersByTimeAsync(3000)
+    expect(mock_publish).toHaveBeenCalledTimes(3)
+
+    stop()
+    await vi.advanceTimersByTimeAsync(3000)
+    expect(mock_publish).toHaveBeenCalledTimes(3)
+  })
+})
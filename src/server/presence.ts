@@ -0,0 +1,166 @@
+import type { AppSyncEventWebSocketClient } from '@boundlessdigital/aws-appsync-events-websockets-client'
+import { randomUUID } from 'node:crypto'
+import { channel } from './channels.js'
+import { logger } from '../lib/logger.js'
+import { ACCEPTED_ENCODINGS } from './compression.js'
+import {
+  agent_handshake,
+  check_extension_protocol,
+  create_rejection_reporter,
+  parse_rejection,
+  type ProtocolHandshake,
+  type ProtocolRejection
+} from './protocol.js'
+import type { EventPublisher } from './types.js'
+
+/**
+ * Developer presence. Extensions only intercept invocations while the agent is
+ * known to be running; otherwise they pass straight through to the bundled
+ * handler. An extension without recent presence publishes a probe on
+ * /live-lambda/presence/{function}; the agent answers with a heartbeat and keeps
+ * sending heartbeats to every function that has probed it. A pull-mode agent
+ * receives probes through its mailbox instead and names the mailbox in its
+ * heartbeats. Probes and heartbeats carry each side of the protocol handshake;
+ * probes from an incompatible extension go unanswered, and an extension that
+ * finds this agent incompatible says so with a protocol_rejected message.
+ */
+
+export const PRESENCE_HEARTBEAT_INTERVAL_MS = 5_000
+// Extensions treat the developer as gone once the last heartbeat is this old
+export const PRESENCE_TTL_MS = 15_000
+
+export interface PresenceHeartbeat extends ProtocolHandshake {
+  type: 'heartbeat'
+  agent_id: string
+  ttl_ms: number
+  timestamp: string
+  delivery?: 'pull'
+  mailbox?: string
+  accept_encoding?: string[] // Encodings the agent can decode in requests
+  public_key?: string // X25519 key extensions seal the environment to
+}
+
+export interface PresenceProbe extends ProtocolHandshake {
+  type: 'probe'
+  function_name: string
+  sandbox_id: string
+}
+
+export interface PresenceOptions {
+  interval_ms?: number
+  ttl_ms?: number
+  pull_mailbox?: string // Ask extensions to deliver requests through this mailbox
+  agent_id?: string
+  public_key?: string // Ask extensions for their environment, sealed to this key
+}
+
+export interface Presence {
+  answer_probe(probe: PresenceProbe): Promise<void>
+  report_rejection(rejection: ProtocolRejection): void
+  stop(): void
+}
+
+export function presence_channel(function_name: string): string {
+  return channel(`presence/${function_name}`)
+}
+
+export function parse_probe(payload: string): PresenceProbe | undefined {
+  try {
+    const message = JSON.parse(payload)
+    if (message?.type === 'probe' && typeof message.function_name === 'string') {
+      return message
+    }
+  } catch {
+    // Not a presence message we understand
+  }
+  return undefined
+}
+
+/**
+ * Sends a heartbeat for every probe it answers and keeps sending them
+ * periodically to every function that has probed.
+ */
+export function create_presence(
+  publisher: EventPublisher,
+  options: PresenceOptions = {}
+): Presence {
+  const interval_ms = options.interval_ms ?? PRESENCE_HEARTBEAT_INTERVAL_MS
+  const ttl_ms = options.ttl_ms ?? PRESENCE_TTL_MS
+  const agent_id = options.agent_id ?? randomUUID()
+  const functions = new Set<string>()
+  const incompatible = new Set<string>()
+
+  const send_heartbeat = async (function_name: string) => {
+    const heartbeat: PresenceHeartbeat = {
+      type: 'heartbeat',
+      agent_id,
+      ttl_ms,
+      timestamp: new Date().toISOString(),
+      accept_encoding: ACCEPTED_ENCODINGS,
+      ...agent_handshake(),
+      ...(options.public_key ? { public_key: options.public_key } : {}),
+      ...(options.pull_mailbox
+        ? { delivery: 'pull' as const, mailbox: options.pull_mailbox }
+        : {})
+    }
+    try {
+      await publisher.publish(presence_channel(function_name), [heartbeat])
+    } catch (error) {
+      logger.warn(`Failed to send presence heartbeat to ${function_name}:`, error)
+    }
+  }
+
+  const timer = setInterval(() => {
+    for (const function_name of functions) {
+      void send_heartbeat(function_name)
+    }
+  }, interval_ms)
+
+  return {
+    async answer_probe(probe: PresenceProbe) {
+      const problem = check_extension_protocol(probe)
+      if (problem) {
+        if (!incompatible.has(probe.function_name)) {
+          incompatible.add(probe.function_name)
+          logger.error(`Not serving ${probe.function_name}: ${problem}`)
+        }
+        return
+      }
+      if (!functions.has(probe.function_name)) {
+        functions.add(probe.function_name)
+        logger.info(`Announcing developer presence to ${probe.function_name}`)
+      }
+      await send_heartbeat(probe.function_name)
+    },
+    report_rejection: create_rejection_reporter(agent_id),
+    stop: () => clearInterval(timer)
+  }
+}
+
+/**
+ * Answers presence probes and sends periodic heartbeats. Returns a function
+ * that stops the heartbeats.
+ */
+export async function start_presence(
+  client: AppSyncEventWebSocketClient,
+  options: PresenceOptions = {}
+): Promise<() => void> {
+  const presence = create_presence(client, options)
+
+  await client.subscribe(
+    channel('presence/*'),
+    async (payload: string) => {
+      const probe = parse_probe(payload)
+      if (probe) {
+        await presence.answer_probe(probe)
+        return
+      }
+      const rejection = parse_rejection(payload)
+      if (rejection) {
+        presence.report_rejection(rejection)
+      }
+    }
+  )
+
+  return presence.stop
+}
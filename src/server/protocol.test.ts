@@ -0,0 +1,150 @@
+import { describe, it, expect, vi, beforeEach } from 'vitest'
+
+vi.mock('../lib/logger.js', () => ({
+  logger: {
+    trace: vi.fn(),
+    debug: vi.fn(),
+    info: vi.fn(),
+    warn: vi.fn(),
+    error: vi.fn(),
+    start: vi.fn()
+  }
+}))
+
+import { logger } from '../lib/logger.js'
+import {
+  PROTOCOL_VERSION,
+  ack_frame,
+  check_extension_protocol,
+  create_function_reporter,
+  create_rejection_reporter,
+  negotiate_capabilities,
+  parse_rejection,
+  to_invocation_error,
+  wrap_response
+} from './protocol.js'
+
+describe('protocol', () => {
+  beforeEach(() => {
+    vi.clearAllMocks()
+  })
+
+  it('should accept unversioned and current extensions', () => {
+    expect(check_extension_protocol({})).toBeUndefined()
+    expect(
+      check_extension_protocol({ protocol_version: PROTOCOL_VERSION, min_protocol_version: 1 })
+    ).toBeUndefined()
+  })
+
+  it('should tell the developer to upgrade the CLI for a newer extension', () => {
+    const problem = check_extension_protocol({
+      protocol_version: PROTOCOL_VERSION + 1,
+      min_protocol_version: PROTOCOL_VERSION + 1
+    })
+    expect(problem).toContain('upgrade the live-lambda CLI')
+  })
+
+  it('should only use capabilities both sides support', () => {
+    expect(
+      negotiate_capabilities({ protocol_version: 2, capabilities: ['chunking', 'telepathy'] })
+    ).toEqual(['chunking'])
+    expect(negotiate_capabilities({})).not.toContain('response_envelope')
+  })
+
+  it('should wrap responses only for extensions that negotiated an envelope', () => {
+    const response = { statusCode: 200 }
+    expect(wrap_response(response, {})).toBe(response)
+    expect(
+      wrap_response(response, { protocol_version: 2, capabilities: ['response_envelope'] })
+    ).toEqual({ type: 'response', protocol_version: PROTOCOL_VERSION, body: response })
+  })
+
+  it('should report timing to extensions that negotiated it', () => {
+    const timing = { agent_ms: 41.2, handler_ms: 38.9 }
+
+    expect(
+      wrap_response({ statusCode: 200 }, { protocol_version: 2, capabilities: ['response_envelope', 'timing'] }, timing)
+    ).toEqual({ type: 'response', protocol_version: PROTOCOL_VERSION, body: { statusCode: 200 }, timing })
+    expect(
+      wrap_response({ statusCode: 200 }, { protocol_version: 2, capabilities: ['response_envelope'] }, timing)
+    ).toEqual({ type: 'response', protocol_version: PROTOCOL_VERSION, body: { statusCode: 200 } })
+  })
+
+  it('should acknowledge requests only for extensions that negotiated acks', () => {
+    expect(
+      ack_frame({ request_id: 'req-1', idempotency_key: 'req-1:1', protocol_version: 2, capabilities: ['ack'] })
+    ).toEqual({ type: 'ack', request_id: 'req-1', idempotency_key: 'req-1:1' })
+    expect(ack_frame({ request_id: 'req-1', protocol_version: 2, capabilities: ['timing'] })).toBeUndefined()
+    expect(ack_frame({ request_id: 'req-1' })).toBeUndefined()
+  })
+
+  it('should echo the idempotency key in response envelopes', () => {
+    expect(
+      wrap_response(
+        { statusCode: 200 },
+        { protocol_version: 2, capabilities: ['response_envelope'], idempotency_key: 'req-1:2' }
+      )
+    ).toEqual({
+      type: 'response',
+      protocol_version: PROTOCOL_VERSION,
+      body: { statusCode: 200 },
+      idempotency_key: 'req-1:2'
+    })
+  })
+
+  it('should describe thrown values like the Lambda runtime', () => {
+    const frame = to_invocation_error(new RangeError('out of range'))
+    expect(frame).toMatchObject({
+      type: 'invocation_error',
+      errorType: 'RangeError',
+      errorMessage: 'out of range'
+    })
+    expect(frame.stackTrace[0]).toContain('RangeError: out of range')
+
+    expect(to_invocation_error('plain string')).toEqual({
+      type: 'invocation_error',
+      errorType: 'Error',
+      errorMessage: 'plain string',
+      stackTrace: []
+    })
+  })
+
+  it('should report a rejection of this agent once per function', () => {
+    const report = create_rejection_reporter('agent-1')
+    const rejection = parse_rejection(
+      JSON.stringify({
+        type: 'protocol_rejected',
+        agent_id: 'agent-1',
+        function_name: 'orders',
+        sandbox_id: 's1',
+        message: 'redeploy the function'
+      })
+    )!
+
+    report(rejection)
+    report(rejection)
+    report({ ...rejection, agent_id: 'someone-else', function_name: 'billing' })
+
+    expect(logger.error).toHaveBeenCalledTimes(1)
+    expect(logger.error).toHaveBeenCalledWith(expect.stringContaining('redeploy the function'))
+  })
+
+  it('should log each served function once', () => {
+    const report = create_function_reporter()
+    const orders = { name: 'orders', version: '7', handler: 'index.handler', account_id: '123456789012' }
+
+    report(undefined)
+    report(orders)
+    report(orders)
+    report({ ...orders, handler: 'other.handler', account_id: undefined })
+
+    expect(logger.info).toHaveBeenCalledTimes(2)
+    expect(logger.info).toHaveBeenCalledWith('Serving 123456789012/orders:7 (index.handler)')
+    expect(logger.info).toHaveBeenCalledWith('Serving orders:7 (other.handler)')
+  })
+
+  it('should ignore messages that are not rejections', () => {
+    expect(parse_rejection(JSON.stringify({ type: 'probe' }))).toBeUndefined()
+    expect(parse_rejection('not json')).toBeUndefined()
+  })
+})
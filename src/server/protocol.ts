@@ -0,0 +1,254 @@
+import { logger } from '../lib/logger.js'
+
+/**
+ * Protocol versioning. Request envelopes and presence probes from the extension
+ * carry its `protocol_version`, the oldest agent protocol it still understands
+ * (`min_protocol_version`) and the optional features it supports
+ * (`capabilities`); the agent announces the same in its heartbeats. Peers that
+ * omit them speak protocol 1, which predates versioning and implies every
+ * feature it shipped with. From protocol 2 the agent wraps responses in a
+ * `response` envelope when the request advertised `response_envelope`, with
+ * the agent's timing when it also advertised `timing`, and acknowledges each
+ * request it starts on when it advertised `ack`. This mirrors protocol.go in
+ * the extension.
+ */
+
+export const PROTOCOL_VERSION = 2
+export const UNVERSIONED_PROTOCOL_VERSION = 1
+// The oldest extension protocol this agent still understands
+export const MIN_EXTENSION_PROTOCOL_VERSION = 1
+
+export type Capability =
+  | 'chunking'
+  | 'compression'
+  | 'streaming'
+  | 'offload'
+  | 'response_envelope'
+  | 'error_frames'
+  | 'claims'
+  | 'timing'
+  | 'ack'
+
+export const CAPABILITIES: Capability[] = [
+  'chunking',
+  'compression',
+  'offload',
+  'response_envelope',
+  'error_frames',
+  'claims',
+  'timing',
+  'ack'
+]
+
+const UNVERSIONED_CAPABILITIES: Capability[] = ['chunking', 'compression', 'streaming', 'offload']
+
+export interface ProtocolHandshake {
+  protocol_version?: number
+  min_protocol_version?: number
+  capabilities?: string[]
+}
+
+export interface ResponseEnvelope {
+  type: 'response'
+  protocol_version: number
+  body: unknown
+  // The attempt the response answers; see idempotency.ts
+  idempotency_key?: string
+  timing?: AgentTiming
+}
+
+// The agent's side of the extension's latency breakdown, in milliseconds: the
+// time since the request arrived, and the handler's share of it
+export interface AgentTiming {
+  agent_ms: number
+  handler_ms: number
+}
+
+// Sent instead of a response when the handler throws, so Lambda reports it as a function error
+export interface InvocationErrorFrame {
+  type: 'invocation_error'
+  errorType: string
+  errorMessage: string
+  stackTrace: string[]
+}
+
+export interface ProtocolRejection extends ProtocolHandshake {
+  type: 'protocol_rejected'
+  agent_id: string
+  function_name: string
+  sandbox_id: string
+  message: string
+}
+
+/**
+ * The agent's side of the handshake, sent with every heartbeat.
+ */
+export function agent_handshake(): Required<ProtocolHandshake> {
+  return {
+    protocol_version: PROTOCOL_VERSION,
+    min_protocol_version: MIN_EXTENSION_PROTOCOL_VERSION,
+    capabilities: CAPABILITIES
+  }
+}
+
+/**
+ * Returns why an extension announcing peer cannot be served, with what to
+ * upgrade, or undefined when it can.
+ */
+export function check_extension_protocol(peer: ProtocolHandshake): string | undefined {
+  const version = peer.protocol_version ?? UNVERSIONED_PROTOCOL_VERSION
+  const min_version = peer.min_protocol_version ?? UNVERSIONED_PROTOCOL_VERSION
+  if (version < MIN_EXTENSION_PROTOCOL_VERSION) {
+    return `the extension speaks protocol ${version} but this agent needs at least ${MIN_EXTENSION_PROTOCOL_VERSION}; redeploy the function with the latest live-lambda layer`
+  }
+  if (min_version > PROTOCOL_VERSION) {
+    return `the extension needs protocol ${min_version} or newer but this agent speaks ${PROTOCOL_VERSION}; upgrade the live-lambda CLI`
+  }
+  return undefined
+}
+
+/**
+ * Returns the capabilities both this agent and the extension support.
+ */
+export function negotiate_capabilities(peer: ProtocolHandshake): Capability[] {
+  const offered = peer.protocol_version
+    ? (peer.capabilities ?? [])
+    : UNVERSIONED_CAPABILITIES
+  return CAPABILITIES.filter((capability) => offered.includes(capability))
+}
+
+/**
+ * Wraps a response message in an envelope when the extension negotiated one;
+ * protocol 1 extensions get the message as is.
+ */
+export function wrap_response(
+  message: unknown,
+  peer: ProtocolHandshake & { idempotency_key?: string },
+  timing?: AgentTiming
+): unknown {
+  const capabilities = negotiate_capabilities(peer)
+  if (!capabilities.includes('response_envelope')) {
+    return message
+  }
+  const envelope: ResponseEnvelope = {
+    type: 'response',
+    protocol_version: PROTOCOL_VERSION,
+    body: message ?? null
+  }
+  if (peer.idempotency_key) {
+    envelope.idempotency_key = peer.idempotency_key
+  }
+  if (timing && capabilities.includes('timing')) {
+    envelope.timing = timing
+  }
+  return envelope
+}
+
+// Tells the extension the agent started on a request, so it waits for the
+// response instead of falling back; see agent_ack.go
+export interface AckFrame {
+  type: 'ack'
+  request_id: string
+  idempotency_key?: string
+}
+
+/**
+ * Returns the ack for a request when the extension negotiated acks, or
+ * undefined when it waits for the response without one.
+ */
+export function ack_frame(
+  peer: ProtocolHandshake & { request_id: string; idempotency_key?: string }
+): AckFrame | undefined {
+  if (!negotiate_capabilities(peer).includes('ack')) {
+    return undefined
+  }
+  const ack: AckFrame = { type: 'ack', request_id: peer.request_id }
+  if (peer.idempotency_key) {
+    ack.idempotency_key = peer.idempotency_key
+  }
+  return ack
+}
+
+/**
+ * Describes a thrown value the way the Lambda Node.js runtime reports an
+ * unhandled error.
+ */
+export function to_invocation_error(error: unknown): InvocationErrorFrame {
+  if (error instanceof Error) {
+    return {
+      type: 'invocation_error',
+      errorType: error.name || 'Error',
+      errorMessage: error.message,
+      stackTrace: error.stack ? error.stack.split('\n') : []
+    }
+  }
+  return {
+    type: 'invocation_error',
+    errorType: 'Error',
+    errorMessage: typeof error === 'string' ? error : JSON.stringify(error) ?? String(error),
+    stackTrace: []
+  }
+}
+
+export function parse_rejection(payload: string): ProtocolRejection | undefined {
+  try {
+    const message = JSON.parse(payload)
+    if (message?.type === 'protocol_rejected' && typeof message.message === 'string') {
+      return message
+    }
+  } catch {
+    // Not a protocol message we understand
+  }
+  return undefined
+}
+
+/**
+ * The function an extension registered for, sent with every envelope by
+ * extensions that have registered. Mirrors function_metadata.go.
+ */
+export interface FunctionMetadata {
+  name: string
+  version: string
+  handler: string
+  account_id?: string
+}
+
+export function describe_function(metadata: FunctionMetadata): string {
+  const served = `${metadata.name}:${metadata.version} (${metadata.handler})`
+  return metadata.account_id ? `${metadata.account_id}/${served}` : served
+}
+
+/**
+ * Logs each function and handler this agent serves the first time a request
+ * for it arrives.
+ */
+export function create_function_reporter(): (metadata?: FunctionMetadata) => void {
+  const reported = new Set<string>()
+  return (metadata) => {
+    if (!metadata) {
+      return
+    }
+    const served = describe_function(metadata)
+    if (reported.has(served)) {
+      return
+    }
+    reported.add(served)
+    logger.info(`Serving ${served}`)
+  }
+}
+
+/**
+ * Reports an extension's rejection of this agent once per function.
+ */
+export function create_rejection_reporter(agent_id: string): (rejection: ProtocolRejection) => void {
+  const reported = new Set<string>()
+  return (rejection) => {
+    if (rejection.agent_id !== agent_id || reported.has(rejection.function_name)) {
+      return
+    }
+    reported.add(rejection.function_name)
+    logger.error(
+      `${rejection.function_name} will not send invocations to this agent: ${rejection.message}`
+    )
+  }
+}
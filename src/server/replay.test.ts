@@ -0,0 +1,58 @@
+import { describe, it, expect } from 'vitest'
+import { replay_hints, run_with_replay_hints, seed_from, seeded_random } from './replay.js'
+import type { LambdaContext } from './types.js'
+
+describe('replay', () => {
+  const invoked_at = Date.parse('2025-03-01T09:30:00Z')
+  const context = { request_id: 'req-1', invoked_at_ms: invoked_at } as LambdaContext
+
+  describe('replay_hints', () => {
+    it('should use the recorded time and derive the seed from the request ID', () => {
+      expect(replay_hints(context)).toEqual({ now_ms: invoked_at, seed: seed_from('req-1') })
+    })
+
+    it('should prefer a fixed seed', () => {
+      expect(replay_hints(context, 7).seed).toBe(7)
+    })
+  })
+
+  describe('seeded_random', () => {
+    it('should repeat the same sequence for the same seed', () => {
+      const first = seeded_random(42)
+      const second = seeded_random(42)
+      const values = [first(), first(), first()]
+
+      expect([second(), second(), second()]).toEqual(values)
+      expect(values.every((value) => value >= 0 && value < 1)).toBe(true)
+      expect(seeded_random(43)()).not.toBe(values[0])
+    })
+  })
+
+  describe('run_with_replay_hints', () => {
+    it('should freeze the clock and seed Math.random inside the scope only', async () => {
+      const hints = replay_hints(context)
+      const expected = seeded_random(hints.seed)()
+
+      const observed = await run_with_replay_hints(hints, async () => {
+        await new Promise((resolve) => setTimeout(resolve, 5))
+        return { now: Date.now(), date: new Date().getTime(), random: Math.random() }
+      })
+
+      expect(observed).toEqual({ now: invoked_at, date: invoked_at, random: expected })
+      expect(Date.now()).toBeGreaterThan(invoked_at)
+      expect(new Date(0).getTime()).toBe(0)
+      expect(typeof Date()).toBe('string')
+    })
+
+    it('should keep concurrent invocations apart', async () => {
+      const later = { ...context, invoked_at_ms: invoked_at + 1000 }
+
+      const [a, b] = await Promise.all([
+        run_with_replay_hints(replay_hints(context), async () => Date.now()),
+        run_with_replay_hints(replay_hints(later), async () => Date.now())
+      ])
+
+      expect([a, b]).toEqual([invoked_at, invoked_at + 1000])
+    })
+  })
+})
@@ -0,0 +1,95 @@
+import { AsyncLocalStorage } from 'node:async_hooks'
+import { createHash } from 'node:crypto'
+import type { LambdaContext } from './types.js'
+
+/**
+ * Deterministic runs. The extension records when it received each invocation
+ * in `context.invoked_at_ms`. With `--deterministic`, the agent runs in-process
+ * handlers with the clock frozen at that time and Math.random seeded from the
+ * request ID (or a fixed seed), so time-dependent bugs reproduce the same way
+ * on every run. Hooks are scoped with AsyncLocalStorage, so concurrent
+ * invocations each see their own clock and sequence, and code outside a
+ * handler keeps the real ones.
+ */
+
+export interface ReplayHints {
+  now_ms: number
+  seed: number
+}
+
+/**
+ * Returns the hints for an invocation. A fixed seed overrides the one derived
+ * from the request ID; without a recorded timestamp the clock freezes at now.
+ */
+export function replay_hints(context: LambdaContext, seed?: number): ReplayHints {
+  const recorded = Number(context?.invoked_at_ms)
+  return {
+    now_ms: Number.isFinite(recorded) && recorded > 0 ? recorded : Date.now(),
+    seed: seed ?? seed_from(context?.request_id ?? '')
+  }
+}
+
+export function seed_from(value: string): number {
+  return createHash('sha256').update(value).digest().readUInt32BE(0)
+}
+
+/**
+ * A small PRNG (mulberry32) returning values in [0, 1), like Math.random.
+ */
+export function seeded_random(seed: number): () => number {
+  let state = seed >>> 0
+  return () => {
+    state = (state + 0x6d2b79f5) >>> 0
+    let t = state
+    t = Math.imul(t ^ (t >>> 15), t | 1)
+    t ^= t + Math.imul(t ^ (t >>> 7), t | 61)
+    return ((t ^ (t >>> 14)) >>> 0) / 4294967296
+  }
+}
+
+interface ReplayScope {
+  now_ms: number
+  random: () => number
+}
+
+const scopes = new AsyncLocalStorage<ReplayScope>()
+let installed = false
+
+function install_hooks(): void {
+  if (installed) {
+    return
+  }
+  installed = true
+
+  const RealDate = Date
+  const real_random = Math.random
+
+  const now = () => scopes.getStore()?.now_ms ?? RealDate.now()
+
+  // A proxy rather than a subclass so Date() without new keeps working
+  globalThis.Date = new Proxy(RealDate, {
+    construct(target, args, new_target) {
+      const scope = scopes.getStore()
+      return Reflect.construct(target, args.length === 0 && scope ? [scope.now_ms] : args, new_target)
+    },
+    apply(target, this_arg, args) {
+      const scope = scopes.getStore()
+      return scope ? new target(scope.now_ms).toString() : Reflect.apply(target, this_arg, args)
+    },
+    get(target, property, receiver) {
+      return property === 'now' ? now : Reflect.get(target, property, receiver)
+    }
+  })
+  Math.random = () => {
+    const scope = scopes.getStore()
+    return scope ? scope.random() : real_random()
+  }
+}
+
+/**
+ * Runs fn with Date and Math.random following the hints.
+ */
+export function run_with_replay_hints<T>(hints: ReplayHints, fn: () => T): T {
+  install_hooks()
+  return scopes.run({ now_ms: hints.now_ms, random: seeded_random(hints.seed) }, fn)
+}
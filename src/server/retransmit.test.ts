@@ -0,0 +1,32 @@
+import { describe, it, expect } from 'vitest'
+import { SentResponses } from './retransmit.js'
+
+describe('retransmit', () => {
+  describe('SentResponses', () => {
+    it('should return the frames sent for a request', () => {
+      const sent = new SentResponses()
+      sent.remember('req-1', [{ statusCode: 200 }])
+
+      expect(sent.frames('req-1')).toEqual([{ statusCode: 200 }])
+      expect(sent.frames('req-2')).toEqual([])
+    })
+
+    it('should only return frames for the attempt asked about', () => {
+      const sent = new SentResponses()
+      sent.remember('req-1', [{ statusCode: 200 }], 'req-1:2')
+
+      expect(sent.frames('req-1', 'req-1:2')).toEqual([{ statusCode: 200 }])
+      expect(sent.frames('req-1', 'req-1:1')).toEqual([])
+      expect(sent.frames('req-1')).toEqual([{ statusCode: 200 }])
+    })
+
+    it('should drop responses after the retention period', () => {
+      let now = 0
+      const sent = new SentResponses(1_000, () => now)
+      sent.remember('req-1', [{ statusCode: 200 }])
+
+      now = 1_001
+      expect(sent.frames('req-1')).toEqual([])
+    })
+  })
+})
@@ -0,0 +1,68 @@
+import type { Clock } from './chunking.js'
+
+/**
+ * An extension whose connection drops mid-invocation reconnects, subscribes
+ * to the invocation's response channel again and sends a `retransmit_request`
+ * on the requests channel, since a response published while it was away is
+ * lost. The agent keeps every response it published for as long as an
+ * invocation can run and publishes it again. A request still being handled
+ * has nothing to resend; its response goes out once it is ready. A request
+ * that names its idempotency key only gets a response to that attempt. This
+ * mirrors reconnect.go in the extension.
+ */
+
+// The longest a Lambda invocation can run
+export const DEFAULT_RESPONSE_RETENTION_MS = 15 * 60 * 1000
+
+export interface RetransmitRequestFrame {
+  type: 'retransmit_request'
+  request_id: string
+  sandbox_id?: string
+  function_name?: string
+  idempotency_key?: string
+}
+
+export class SentResponses {
+  private readonly sent = new Map<
+    string,
+    { frames: unknown[]; idempotency_key?: string; sent_at: number }
+  >()
+
+  constructor(
+    private readonly retention_ms = DEFAULT_RESPONSE_RETENTION_MS,
+    private readonly now: Clock = Date.now
+  ) {}
+
+  /**
+   * Keeps the frames published on a request's response channel, in order.
+   */
+  remember(request_id: string, frames: unknown[], idempotency_key?: string): void {
+    this.expire()
+    this.sent.set(request_id, { frames, idempotency_key, sent_at: this.now() })
+  }
+
+  /**
+   * Returns the frames kept for a request, or none when they answer another
+   * attempt than idempotency_key.
+   */
+  frames(request_id: string, idempotency_key?: string): unknown[] {
+    this.expire()
+    const entry = this.sent.get(request_id)
+    if (!entry) {
+      return []
+    }
+    if (idempotency_key && entry.idempotency_key && entry.idempotency_key !== idempotency_key) {
+      return []
+    }
+    return entry.frames
+  }
+
+  private expire(): void {
+    const now = this.now()
+    for (const [id, entry] of this.sent) {
+      if (now - entry.sent_at > this.retention_ms) {
+        this.sent.delete(id)
+      }
+    }
+  }
+}
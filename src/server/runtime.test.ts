@@ -77,9 +77,11 @@ vi.mock('../lib/logger.js', () => ({
 
 // Import after mocks are set up
 import {
+  container_environment,
   execute_handler,
   execute_module_handler,
-  ExecuteHandlerOptions
+  ExecuteHandlerOptions,
+  resolve_container_target
 } from './runtime.js'
 import { LambdaContext } from './types.js'
 import type { APIGatewayProxyEventV2 } from 'aws-lambda'
@@ -775,4 +777,51 @@ describe('runtime', () => {
       )
     })
   })
+
+  describe('runtime container support', () => {
+    it('should resolve the deployed asset and handler string', () => {
+      expect(
+        resolve_container_target(
+          mock_outputs,
+          'arn:aws:lambda:us-east-1:123456789012:function:test-function'
+        )
+      ).toEqual({
+        asset_path: '/path/to/cdk.out/asset.12345',
+        handler: 'index.handler'
+      })
+      expect(
+        resolve_container_target(mock_outputs, 'arn:aws:lambda:other')
+      ).toBeUndefined()
+    })
+
+    it('should drop layer-only variables and add credentials and function metadata', () => {
+      const environment = container_environment(
+        {
+          TABLE_NAME: 'orders',
+          AWS_LAMBDA_EXEC_WRAPPER: '/opt/live-lambda-runtime-wrapper.sh',
+          LRAP_LISTENER_PORT: '8082',
+          LIVE_LAMBDA_APPSYNC_HTTP_HOST: 'host'
+        },
+        {
+          accessKeyId: 'AKID',
+          secretAccessKey: 'secret',
+          sessionToken: 'token'
+        },
+        mock_context,
+        30
+      )
+
+      expect(environment).toMatchObject({
+        TABLE_NAME: 'orders',
+        AWS_REGION: 'us-east-1',
+        AWS_LAMBDA_FUNCTION_NAME: 'test-function',
+        AWS_LAMBDA_FUNCTION_TIMEOUT: '30',
+        AWS_ACCESS_KEY_ID: 'AKID',
+        AWS_SESSION_TOKEN: 'token'
+      })
+      expect(environment).not.toHaveProperty('AWS_LAMBDA_EXEC_WRAPPER')
+      expect(environment).not.toHaveProperty('LRAP_LISTENER_PORT')
+      expect(environment).not.toHaveProperty('LIVE_LAMBDA_APPSYNC_HTTP_HOST')
+    })
+  })
 })
@@ -10,17 +10,37 @@ import * as fs from 'fs'
 import * as esbuild from 'esbuild'
 import * as os from 'os'
 import { logger } from '../lib/logger.js'
+import { build_node_context } from './lambda_context.js'
+import { ReplayHints, run_with_replay_hints } from './replay.js'
+import { handed_off_environment, published_environment } from './env_handoff.js'
+import {
+  AUTO_RUNTIME_IMAGE,
+  invoke_in_container,
+  runtime_image_for
+} from './container_runtime.js'
 
 export interface ExecuteHandlerOptions {
   region: string
   function_arn: string
   event: APIGatewayProxyEventV2
   context: LambdaContext
+  /**
+   * Run the invocation inside this Lambda base image instead of in-process.
+   * AUTO_RUNTIME_IMAGE picks the image matching the function's runtime.
+   */
+  runtime_image?: string
+  /**
+   * Freeze the clock and seed Math.random while the handler runs. Only
+   * in-process handlers are affected.
+   */
+  replay?: ReplayHints
 }
 
 export async function execute_handler(
   event: APIGatewayProxyEventV2,
-  context: LambdaContext
+  context: LambdaContext,
+  runtime_image?: string,
+  replay?: ReplayHints
 ) {
   logger.trace('Received event:', JSON.stringify(event, null, 2))
 
@@ -28,7 +48,9 @@ export async function execute_handler(
     region: context.aws_region as string,
     function_arn: context.invoked_function_arn as string,
     event,
-    context
+    context,
+    runtime_image,
+    replay
   })
 }
 interface OutputsJson {
@@ -170,11 +192,71 @@ function resolve_handler_from_outputs(
   return undefined
 }
 
+/**
+ * Finds the deployed asset directory and handler string for a function ARN, as
+ * needed to run the function inside a runtime container.
+ */
+export function resolve_container_target(
+  outputs: OutputsJson,
+  function_arn: string
+): { asset_path: string; handler: string } | undefined {
+  for (const stack_name of Object.keys(outputs)) {
+    const stack_outputs = outputs[stack_name]
+    if (
+      stack_outputs.FunctionArn === function_arn &&
+      stack_outputs.FunctionHandler &&
+      stack_outputs.FunctionCdkOutAssetPath
+    ) {
+      return {
+        asset_path: stack_outputs.FunctionCdkOutAssetPath,
+        handler: stack_outputs.FunctionHandler
+      }
+    }
+  }
+  return undefined
+}
+
+// Variables the live-lambda layer adds to the deployed function; they point at
+// files that only exist in the layer and must not reach the runtime container.
+const LAYER_ONLY_ENV_PATTERN =
+  /^(AWS_LAMBDA_EXEC_WRAPPER|AWS_LAMBDA_EXTENSION_NAME|LRAP_.*|LIVE_LAMBDA_.*)$/
+
+export function container_environment(
+  function_variables: Record<string, string>,
+  credentials: {
+    accessKeyId: string
+    secretAccessKey: string
+    sessionToken?: string
+  },
+  context: LambdaContext,
+  timeout_seconds?: number
+): Record<string, string | undefined> {
+  const environment: Record<string, string | undefined> = {}
+  for (const [key, value] of Object.entries(function_variables)) {
+    if (!LAYER_ONLY_ENV_PATTERN.test(key)) {
+      environment[key] = value
+    }
+  }
+  return Object.assign(environment, {
+    AWS_REGION: context.aws_region,
+    AWS_DEFAULT_REGION: context.aws_region,
+    AWS_LAMBDA_FUNCTION_NAME: context.function_name,
+    AWS_LAMBDA_FUNCTION_VERSION: context.function_version,
+    AWS_LAMBDA_FUNCTION_MEMORY_SIZE: context.memory_size_mb,
+    AWS_LAMBDA_FUNCTION_TIMEOUT: timeout_seconds?.toString(),
+    AWS_ACCESS_KEY_ID: credentials.accessKeyId,
+    AWS_SECRET_ACCESS_KEY: credentials.secretAccessKey,
+    AWS_SESSION_TOKEN: credentials.sessionToken
+  })
+}
+
 export async function execute_module_handler({
   region,
   function_arn,
   event,
-  context
+  context,
+  runtime_image,
+  replay
 }: ExecuteHandlerOptions): Promise<unknown> {
   /* ---------- 1 · fetch live configuration ---------- */
   const { function_name } = context
@@ -207,22 +289,47 @@ export async function execute_module_handler({
     throw new Error('Lambda configuration did not include execution role ARN.')
   }
 
-  /* ---------- 2 · assume the execution role ---------- */
-  const cred_provider = fromTemporaryCredentials({
-    params: {
-      RoleArn: config.Role,
-      RoleSessionName: `live-lambda-${function_name}`
-        .replace(/[^a-zA-Z0-9_=,.@-]/g, '_')
-        .substring(0, 50)
-        .concat(`-${Date.now().toString(36).substring(0, 8)}`)
-    },
-    clientConfig: { region }
-  })
+  // Variables the sandbox published come first, so the configuration wins
+  const function_variables = {
+    ...published_environment(function_name),
+    ...config.Environment?.Variables
+  }
 
-  const creds = await cred_provider()
+  /* ---------- 2 · use the sandbox's credentials, or assume the execution role ---------- */
+  const creds =
+    handed_off_credentials(function_name) ??
+    (await assume_execution_role(config.Role, function_name, region))
+
+  /* ---------- 2.5 · optionally run inside the Lambda base image ---------- */
+  if (runtime_image) {
+    const target = resolve_container_target(outputs, function_arn)
+    if (!target) {
+      throw new Error(
+        `[live-lambda] Could not find the deployed asset for function ARN: ${function_arn}.`
+      )
+    }
+    const image =
+      runtime_image === AUTO_RUNTIME_IMAGE
+        ? runtime_image_for(config.Runtime)
+        : runtime_image
+
+    return invoke_in_container({
+      image,
+      asset_path: target.asset_path,
+      handler: target.handler,
+      environment: container_environment(
+        function_variables,
+        creds,
+        context,
+        config.Timeout
+      ),
+      event,
+      timeout_ms: config.Timeout ? config.Timeout * 1000 : undefined
+    })
+  }
 
   /* ---------- 3 · inject env vars + creds ---------- */
-  Object.assign(process.env, config.Environment?.Variables ?? {}, {
+  Object.assign(process.env, function_variables, {
     AWS_ACCESS_KEY_ID: creds.accessKeyId,
     AWS_SECRET_ACCESS_KEY: creds.secretAccessKey,
     AWS_SESSION_TOKEN: creds.sessionToken
@@ -275,5 +382,38 @@ export async function execute_module_handler({
     )
   }
 
-  return handler(event, context)
+  if (replay) {
+    return run_with_replay_hints(replay, () => handler(event, build_node_context(context)))
+  }
+  return handler(event, build_node_context(context))
+}
+
+/**
+ * Returns the credentials the function's extension handed to this agent, when
+ * it shares them (LIVE_LAMBDA_SHARE_CREDENTIALS=on).
+ */
+function handed_off_credentials(function_name: string) {
+  const environment = handed_off_environment(function_name)
+  if (!environment?.AWS_ACCESS_KEY_ID || !environment.AWS_SECRET_ACCESS_KEY) {
+    return undefined
+  }
+  return {
+    accessKeyId: environment.AWS_ACCESS_KEY_ID,
+    secretAccessKey: environment.AWS_SECRET_ACCESS_KEY,
+    sessionToken: environment.AWS_SESSION_TOKEN
+  }
+}
+
+function assume_execution_role(role_arn: string, function_name: string, region: string) {
+  const cred_provider = fromTemporaryCredentials({
+    params: {
+      RoleArn: role_arn,
+      RoleSessionName: `live-lambda-${function_name}`
+        .replace(/[^a-zA-Z0-9_=,.@-]/g, '_')
+        .substring(0, 50)
+        .concat(`-${Date.now().toString(36).substring(0, 8)}`)
+    },
+    clientConfig: { region }
+  })
+  return cred_provider()
 }
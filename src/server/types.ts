@@ -1,4 +1,6 @@
 import type { APIGatewayProxyEventV2 } from 'aws-lambda'
+import type { PayloadReference, ResponseUpload } from './payload_offload.js'
+import type { FunctionMetadata, ProtocolHandshake } from './protocol.js'
 
 export interface ServerConfig {
   region: string
@@ -6,12 +8,32 @@ export interface ServerConfig {
   realtime: string
   layer_arn: string
   profile?: string // Add profile
+  runtime_image?: string // Run invocations inside this Lambda base image ('auto' to match the function runtime)
+  diff_events?: true | string // Log each event's diff from the previous one; a string keys history by that event path
+  pull_mailbox?: string // Pull requests from this SQS queue instead of subscribing over WebSocket
+  deterministic?: true | number // Freeze time and seed Math.random in handlers; a number fixes the seed
+  stage?: string // Serve the stage's channel namespace (live-lambda-{stage}) on a shared Events API
+  channel_scope?: string // Serve the channels under this scope, as the functions render LIVE_LAMBDA_CHANNEL_SCOPE
+  requests_channel?: string // Serve this requests channel, as the functions render LIVE_LAMBDA_REQUESTS_CHANNEL
+  response_channel?: string // Answer on this channel, as the functions render LIVE_LAMBDA_RESPONSE_CHANNEL, ending in {request_id}
 }
 
-export interface ProxiedLambdaInvocation {
+// Anything that can publish events to an AppSync channel: the WebSocket client, or HTTP in pull mode
+export interface EventPublisher {
+  publish(channel: string, events: unknown[]): Promise<unknown>
+}
+
+export interface ProxiedLambdaInvocation extends ProtocolHandshake {
   request_id: string // The request_id for AppSync response channel
 
-  event_payload: APIGatewayProxyEventV2
+  event_payload?: APIGatewayProxyEventV2 | string // A base64 string when content_encoding is set
+  event_payload_ref?: PayloadReference // Set instead of event_payload when the event was offloaded to S3
+  content_encoding?: string // How event_payload is encoded, e.g. 'gzip'
+  accept_encoding?: string[] // Encodings the extension can decode in the response
+  response_upload?: ResponseUpload
+  trace?: { header: string } // X-Ray trace header, with live-lambda's subsegment as Parent when sampled
+  function?: FunctionMetadata // Absent until the extension has registered
+  metadata?: Record<string, unknown> // Attached by tools in the sandbox through the extension's local API
   context: LambdaContext
 }
 
@@ -28,4 +50,26 @@ export interface LambdaContext {
   trace_id: string
   handler_path: string
   handler_name: string
+  invoked_at_ms?: number // When the extension received the invocation, in Unix milliseconds
+  identity?: CognitoIdentity // Parsed Lambda-Runtime-Cognito-Identity
+  client_context?: ClientContext // Parsed Lambda-Runtime-Client-Context
+  identity_raw?: string // The Cognito identity header, when it did not parse
+  client_context_raw?: string // The client context header, when it did not parse
+}
+
+export interface CognitoIdentity {
+  cognitoIdentityId: string
+  cognitoIdentityPoolId: string
+}
+
+export interface ClientContext {
+  client: {
+    installation_id?: string
+    app_title?: string
+    app_version_name?: string
+    app_version_code?: string
+    app_package_name?: string
+  }
+  custom?: Record<string, string>
+  env?: Record<string, string>
 }